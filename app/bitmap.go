@@ -0,0 +1,648 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+const maxBitOffset = 1<<32 - 1 // strings are limited to 512MB
+
+var errBitOffset = fmt.Errorf("bit offset is not an integer or out of range")
+
+// Overflow behaviours of BITFIELD SET and INCRBY.
+const (
+	overflowWrap = iota
+	overflowSat
+	overflowFail
+)
+
+// stringValue returns the string stored at key. Strings are held either
+// as a string or, once a bit command has used them, as a []byte; see
+// bitmapValue.
+func (s *Store) stringValue(key string) (string, bool, error) {
+	val, found := s.lookup(key)
+	if !found {
+		return "", false, nil
+	}
+	switch v := val.(type) {
+	case string:
+		return v, true, nil
+	case []byte:
+		return string(v), true, nil
+	}
+	return "", false, errWrongType
+}
+
+// bitmapValue returns the string stored at key as bytes that SETBIT and
+// BITFIELD can change in place, so that setting a bit doesn't copy the
+// whole bitmap. A string is converted to a []byte, which stays in the
+// store, the first time a bit command uses it.
+func (s *Store) bitmapValue(key string) ([]byte, bool, error) {
+	val, found := s.lookup(key)
+	if !found {
+		return nil, false, nil
+	}
+	switch v := val.(type) {
+	case []byte:
+		return v, true, nil
+	case string:
+		buf := []byte(v)
+		s.kv[key] = buf
+		return buf, true, nil
+	}
+	return nil, false, errWrongType
+}
+
+// setStringValue replaces the string at key, keeping its expiration time.
+func (s *Store) setStringValue(key, val string) {
+	if _, found := s.kv[key]; !found {
+		s.create(key, val)
+		return
+	}
+	s.kv[key] = val
+}
+
+// growBitmap returns buf, the bitmap at key, extended with zero bytes to
+// at least size bytes, and stores it at key if it had to grow. As with
+// append, its capacity grows geometrically, so setting bits one after the
+// other past the end of a bitmap stays cheap.
+func (s *Store) growBitmap(key string, buf []byte, size int) []byte {
+	if len(buf) >= size {
+		return buf
+	}
+	buf = growBytes(buf, size)
+	if _, found := s.kv[key]; !found {
+		s.create(key, buf)
+	} else {
+		s.kv[key] = buf
+	}
+	return buf
+}
+
+// parseBitOffset parses the offset argument of SETBIT and GETBIT.
+func parseBitOffset(arg string) (uint64, error) {
+	offset, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil || offset > maxBitOffset {
+		return 0, errBitOffset
+	}
+	return offset, nil
+}
+
+// growBytes returns buf extended with zero bytes to at least size bytes.
+func growBytes(buf []byte, size int) []byte {
+	if len(buf) >= size {
+		return buf
+	}
+	return append(buf, make([]byte, size-len(buf))...)
+}
+
+// handleSetBit handles SETBIT commands.
+func (c *ClientHandler) handleSetBit(args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("wrong number of arguments for SETBIT")
+	}
+	key := args[0]
+	offset, err := parseBitOffset(args[1])
+	if err != nil {
+		return err
+	}
+	if args[2] != "0" && args[2] != "1" {
+		return fmt.Errorf("bit is not an integer or out of range")
+	}
+	buf, _, err := c.Store.bitmapValue(key)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("SETBIT %s %d command received.", key, offset)
+
+	// The bitmap changes if it has to grow or if the bit flips.
+	changed := offset/8 >= uint64(len(buf))
+	buf = c.Store.growBitmap(key, buf, int(offset/8)+1)
+	mask := byte(0x80) >> (offset % 8)
+	old := 0
+	if buf[offset/8]&mask != 0 {
+		old = 1
+	}
+	if bit := int(args[2][0] - '0'); bit != old {
+		buf[offset/8] ^= mask
+		changed = true
+	}
+	if changed {
+		c.Store.notify(notifyString, "setbit", key)
+		c.Store.touch(key)
+	}
+	return c.send(encodeInteger(old))
+}
+
+// handleGetBit handles GETBIT commands.
+func (c *ClientHandler) handleGetBit(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("wrong number of arguments for GETBIT")
+	}
+	offset, err := parseBitOffset(args[1])
+	if err != nil {
+		return err
+	}
+	buf, _, err := c.Store.bitmapValue(args[0])
+	if err != nil {
+		return err
+	}
+	if offset/8 >= uint64(len(buf)) {
+		return c.send(encodeInteger(0))
+	}
+	if buf[offset/8]&(0x80>>(offset%8)) != 0 {
+		return c.send(encodeInteger(1))
+	}
+	return c.send(encodeInteger(0))
+}
+
+// bitRange is a range of bits within a string, resolved from the start,
+// end and BYTE|BIT arguments of BITCOUNT and BITPOS.
+type bitRange struct {
+	start, end int64 // bit offsets, inclusive
+	empty      bool
+}
+
+// parseBitRange resolves the optional start, end and unit arguments against
+// a string of length bytes. Negative indexes count from the end.
+func parseBitRange(args []string, length int) (bitRange, bool, error) {
+	r := bitRange{start: 0, end: int64(length)*8 - 1}
+	if len(args) == 0 {
+		r.empty = length == 0
+		return r, false, nil
+	}
+	if len(args) > 3 {
+		return r, false, errSyntax
+	}
+
+	start, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return r, false, errNotInteger
+	}
+	isBit := false
+	if len(args) == 3 {
+		switch strings.ToUpper(args[2]) {
+		case "BIT":
+			isBit = true
+		case "BYTE":
+		default:
+			return r, false, errSyntax
+		}
+	}
+	total := int64(length)
+	if isBit {
+		total *= 8
+	}
+	end := total - 1
+	hasEnd := len(args) >= 2
+	if hasEnd {
+		if end, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+			return r, false, errNotInteger
+		}
+	}
+
+	if start < 0 {
+		start += total
+	}
+	if end < 0 {
+		end += total
+	}
+	start = max(start, 0)
+	end = max(end, 0)
+	end = min(end, total-1)
+	if start > end || total == 0 {
+		r.empty = true
+		return r, hasEnd, nil
+	}
+	if isBit {
+		r.start, r.end = start, end
+	} else {
+		r.start, r.end = start*8, end*8+7
+	}
+	return r, hasEnd, nil
+}
+
+// handleBitCount handles BITCOUNT commands.
+func (c *ClientHandler) handleBitCount(args []string) error {
+	if len(args) < 1 || len(args) == 2 {
+		return errSyntax
+	}
+	buf, _, err := c.Store.bitmapValue(args[0])
+	if err != nil {
+		return err
+	}
+	r, _, err := parseBitRange(args[1:], len(buf))
+	if err != nil {
+		return err
+	}
+	if r.empty {
+		return c.send(encodeInteger(0))
+	}
+
+	count := 0
+	for bit := r.start; bit <= r.end; {
+		if bit%8 == 0 && bit+7 <= r.end {
+			// Count whole bytes at a time.
+			count += bits.OnesCount8(buf[bit/8])
+			bit += 8
+			continue
+		}
+		if buf[bit/8]&(0x80>>(bit%8)) != 0 {
+			count++
+		}
+		bit++
+	}
+	return c.send(encodeInteger(count))
+}
+
+// handleBitPos handles BITPOS commands.
+func (c *ClientHandler) handleBitPos(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("insufficient number of arguments for BITPOS")
+	}
+	if args[1] != "0" && args[1] != "1" {
+		return fmt.Errorf("The bit argument must be 1 or 0.")
+	}
+	want := args[1] == "1"
+	buf, found, err := c.Store.bitmapValue(args[0])
+	if err != nil {
+		return err
+	}
+	r, hasEnd, err := parseBitRange(args[2:], len(buf))
+	if err != nil {
+		return err
+	}
+	if !found || r.empty {
+		if !want && !found {
+			return c.send(encodeInteger(0))
+		}
+		return c.send(encodeInteger(-1))
+	}
+
+	for bit := r.start; bit <= r.end; bit++ {
+		set := buf[bit/8]&(0x80>>(bit%8)) != 0
+		if set == want {
+			return c.send(encodeInteger(int(bit)))
+		}
+	}
+	// Looking for a clear bit without an explicit end considers the string
+	// to be padded with zeros on the right.
+	if !want && !hasEnd {
+		return c.send(encodeInteger(int(r.end + 1)))
+	}
+	return c.send(encodeInteger(-1))
+}
+
+// handleBitOp handles BITOP commands.
+func (c *ClientHandler) handleBitOp(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("insufficient number of arguments for BITOP")
+	}
+	op, dst, keys := strings.ToUpper(args[0]), args[1], args[2:]
+	switch op {
+	case "AND", "OR", "XOR":
+	case "NOT":
+		if len(keys) != 1 {
+			return fmt.Errorf("BITOP NOT must be called with a single source key.")
+		}
+	default:
+		return errSyntax
+	}
+
+	srcs := make([][]byte, 0, len(keys))
+	length := 0
+	for _, key := range keys {
+		buf, _, err := c.Store.bitmapValue(key)
+		if err != nil {
+			return err
+		}
+		srcs = append(srcs, buf)
+		length = max(length, len(buf))
+	}
+
+	result := make([]byte, length)
+	for i := range result {
+		var b byte
+		for j, src := range srcs {
+			var sb byte
+			if i < len(src) {
+				sb = src[i]
+			}
+			switch {
+			case op == "NOT":
+				b = ^sb
+			case j == 0:
+				b = sb
+			case op == "AND":
+				b &= sb
+			case op == "OR":
+				b |= sb
+			case op == "XOR":
+				b ^= sb
+			}
+		}
+		result[i] = b
+	}
+
+	c.Store.storeResult(dst, result, length > 0, notifyString, "set")
+	return c.send(encodeInteger(length))
+}
+
+// bitfieldType is a signed or unsigned integer type of BITFIELD.
+type bitfieldType struct {
+	signed bool
+	bits   uint64
+}
+
+// parseBitfieldType parses types like i8 or u16. Signed integers can be up
+// to 64 bits wide and unsigned integers up to 63.
+func parseBitfieldType(arg string) (bitfieldType, error) {
+	errType := fmt.Errorf("Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+	if len(arg) < 2 {
+		return bitfieldType{}, errType
+	}
+	var t bitfieldType
+	switch arg[0] {
+	case 'i', 'I':
+		t.signed = true
+	case 'u', 'U':
+	default:
+		return t, errType
+	}
+	width, err := strconv.ParseUint(arg[1:], 10, 64)
+	if err != nil || width < 1 || (t.signed && width > 64) || (!t.signed && width > 63) {
+		return t, errType
+	}
+	t.bits = width
+	return t, nil
+}
+
+// parseBitfieldOffset parses a bit offset, or a "#N" offset meaning N times
+// the width of the type.
+func parseBitfieldOffset(arg string, t bitfieldType) (uint64, error) {
+	multiply := strings.HasPrefix(arg, "#")
+	if multiply {
+		arg = arg[1:]
+	}
+	offset, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil {
+		return 0, errBitOffset
+	}
+	if multiply {
+		offset *= t.bits
+	}
+	if offset+t.bits-1 > maxBitOffset {
+		return 0, errBitOffset
+	}
+	return offset, nil
+}
+
+// getBits reads width bits starting at offset, most significant bit first.
+func getBits(buf []byte, offset, width uint64) uint64 {
+	var val uint64
+	for i := uint64(0); i < width; i++ {
+		pos := offset + i
+		val <<= 1
+		if pos/8 < uint64(len(buf)) && buf[pos/8]&(0x80>>(pos%8)) != 0 {
+			val |= 1
+		}
+	}
+	return val
+}
+
+// setBits writes the low width bits of val starting at offset. buf must be
+// large enough.
+func setBits(buf []byte, offset, width, val uint64) {
+	for i := uint64(0); i < width; i++ {
+		pos := offset + i
+		mask := byte(0x80) >> (pos % 8)
+		if val&(1<<(width-1-i)) != 0 {
+			buf[pos/8] |= mask
+		} else {
+			buf[pos/8] &^= mask
+		}
+	}
+}
+
+// signExtend interprets the low width bits of val as a signed integer.
+func signExtend(val, width uint64) int64 {
+	if width == 64 {
+		return int64(val)
+	}
+	if val&(1<<(width-1)) != 0 {
+		val |= math.MaxUint64 << width
+	} else {
+		val &^= math.MaxUint64 << width
+	}
+	return int64(val)
+}
+
+// unsignedOverflow applies the overflow behaviour to value+incr for an
+// unsigned type. It returns the result and false if the operation fails.
+func unsignedOverflow(value uint64, incr int64, width uint64, mode int) (uint64, bool) {
+	limit := uint64(1)<<width - 1
+	maxIncr := int64(limit - value)
+	minIncr := -int64(value)
+	wrapped := (value + uint64(incr)) & limit
+
+	switch {
+	case value > limit || (incr > 0 && incr > maxIncr):
+		switch mode {
+		case overflowWrap:
+			return wrapped, true
+		case overflowSat:
+			return limit, true
+		}
+		return 0, false
+	case incr < 0 && incr < minIncr:
+		switch mode {
+		case overflowWrap:
+			return wrapped, true
+		case overflowSat:
+			return 0, true
+		}
+		return 0, false
+	}
+	return value + uint64(incr), true
+}
+
+// signedOverflow applies the overflow behaviour to value+incr for a signed
+// type. It returns the result and false if the operation fails.
+func signedOverflow(value, incr int64, width uint64, mode int) (int64, bool) {
+	maxVal := int64(math.MaxInt64)
+	if width < 64 {
+		maxVal = 1<<(width-1) - 1
+	}
+	minVal := -maxVal - 1
+	maxIncr := maxVal - value
+	minIncr := minVal - value
+	wrapped := signExtend(uint64(value)+uint64(incr), width)
+
+	switch {
+	case value > maxVal || (width != 64 && incr > maxIncr) || (value >= 0 && incr > 0 && incr > maxIncr):
+		switch mode {
+		case overflowWrap:
+			return wrapped, true
+		case overflowSat:
+			return maxVal, true
+		}
+		return 0, false
+	case value < minVal || (width != 64 && incr < minIncr) || (value < 0 && incr < 0 && incr < minIncr):
+		switch mode {
+		case overflowWrap:
+			return wrapped, true
+		case overflowSat:
+			return minVal, true
+		}
+		return 0, false
+	}
+	return value + incr, true
+}
+
+// bitfieldOp is a single GET, SET or INCRBY operation of BITFIELD.
+type bitfieldOp struct {
+	op       string
+	t        bitfieldType
+	offset   uint64
+	value    int64
+	overflow int
+}
+
+// handleBitField handles BITFIELD and, with readOnly set, BITFIELD_RO
+// commands.
+func (c *ClientHandler) handleBitField(args []string, readOnly bool) error {
+	if len(args) < 1 {
+		return fmt.Errorf("insufficient number of arguments for BITFIELD")
+	}
+	key := args[0]
+
+	ops := []bitfieldOp{}
+	overflow := overflowWrap
+	writes := false
+	for i := 1; i < len(args); i++ {
+		op := strings.ToUpper(args[i])
+		if op == "OVERFLOW" && !readOnly {
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			switch strings.ToUpper(args[i+1]) {
+			case "WRAP":
+				overflow = overflowWrap
+			case "SAT":
+				overflow = overflowSat
+			case "FAIL":
+				overflow = overflowFail
+			default:
+				return fmt.Errorf("Invalid OVERFLOW type specified")
+			}
+			i++
+			continue
+		}
+
+		switch op {
+		case "GET":
+			if i+2 >= len(args) {
+				return errSyntax
+			}
+		case "SET", "INCRBY":
+			if readOnly {
+				return fmt.Errorf("BITFIELD_RO only supports the GET subcommand")
+			}
+			if i+3 >= len(args) {
+				return errSyntax
+			}
+			writes = true
+		default:
+			return errSyntax
+		}
+
+		t, err := parseBitfieldType(args[i+1])
+		if err != nil {
+			return err
+		}
+		offset, err := parseBitfieldOffset(args[i+2], t)
+		if err != nil {
+			return err
+		}
+		bop := bitfieldOp{op: op, t: t, offset: offset, overflow: overflow}
+		i += 2
+		if op != "GET" {
+			if bop.value, err = strconv.ParseInt(args[i+1], 10, 64); err != nil {
+				return errNotInteger
+			}
+			i++
+		}
+		ops = append(ops, bop)
+	}
+
+	buf, _, err := c.Store.bitmapValue(key)
+	if err != nil {
+		return err
+	}
+	changed := false
+	if writes {
+		size := 0
+		for _, op := range ops {
+			if op.op != "GET" {
+				size = max(size, int((op.offset+op.t.bits-1)/8)+1)
+			}
+		}
+		changed = size > len(buf)
+		buf = c.Store.growBitmap(key, buf, size)
+	}
+
+	result := make([]string, 0, len(ops))
+	for _, op := range ops {
+		raw := getBits(buf, op.offset, op.t.bits)
+		if op.op == "GET" {
+			if op.t.signed {
+				result = append(result, encodeInteger(int(signExtend(raw, op.t.bits))))
+			} else {
+				result = append(result, encodeInteger(int(raw)))
+			}
+			continue
+		}
+
+		var reply int64
+		var newRaw uint64
+		var ok bool
+		if op.t.signed {
+			old := signExtend(raw, op.t.bits)
+			var val int64
+			if op.op == "SET" {
+				val, ok = signedOverflow(op.value, 0, op.t.bits, op.overflow)
+				reply = old
+			} else {
+				val, ok = signedOverflow(old, op.value, op.t.bits, op.overflow)
+				reply = val
+			}
+			newRaw = uint64(val)
+		} else {
+			if op.op == "SET" {
+				newRaw, ok = unsignedOverflow(uint64(op.value), 0, op.t.bits, op.overflow)
+				reply = int64(raw)
+			} else {
+				newRaw, ok = unsignedOverflow(raw, op.value, op.t.bits, op.overflow)
+				reply = int64(newRaw)
+			}
+		}
+		if !ok {
+			result = append(result, nullResponse)
+			continue
+		}
+		if newRaw&(1<<op.t.bits-1) != raw {
+			setBits(buf, op.offset, op.t.bits, newRaw)
+			changed = true
+		}
+		result = append(result, encodeInteger(int(reply)))
+	}
+
+	if changed {
+		c.Store.notify(notifyString, "setbit", key)
+		c.Store.touch(key)
+	}
+	return c.send(encodeArray(result...))
+}
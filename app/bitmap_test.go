@@ -0,0 +1,232 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseBitRange(t *testing.T) {
+	tests := []struct {
+		args       []string
+		length     int
+		start, end int64
+		empty      bool
+		wantErr    bool
+	}{
+		{nil, 3, 0, 23, false, false},
+		{nil, 0, 0, -1, true, false},
+		{[]string{"1", "1"}, 3, 8, 15, false, false},
+		{[]string{"0", "-1"}, 3, 0, 23, false, false},
+		{[]string{"-2", "-1"}, 3, 8, 23, false, false},
+		{[]string{"-100", "100"}, 3, 0, 23, false, false},
+		{[]string{"2", "1"}, 3, 0, 0, true, false},
+		{[]string{"5", "10", "BIT"}, 3, 5, 10, false, false},
+		{[]string{"-3", "-1", "bit"}, 3, 21, 23, false, false},
+		{[]string{"0", "1", "NIBBLE"}, 3, 0, 0, false, true},
+		{[]string{"x"}, 3, 0, 0, false, true},
+		{[]string{"0", "1", "BIT", "extra"}, 3, 0, 0, false, true},
+	}
+	for _, tt := range tests {
+		r, _, err := parseBitRange(tt.args, tt.length)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseBitRange(%q, %d) error = %v", tt.args, tt.length, err)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if r.empty != tt.empty || !r.empty && (r.start != tt.start || r.end != tt.end) {
+			t.Errorf("parseBitRange(%q, %d) = %+v, want %d-%d empty %v", tt.args, tt.length, r, tt.start, tt.end, tt.empty)
+		}
+	}
+}
+
+func TestParseBitfieldType(t *testing.T) {
+	tests := []struct {
+		arg     string
+		want    bitfieldType
+		wantErr bool
+	}{
+		{"i8", bitfieldType{signed: true, bits: 8}, false},
+		{"U16", bitfieldType{bits: 16}, false},
+		{"i64", bitfieldType{signed: true, bits: 64}, false},
+		{"u63", bitfieldType{bits: 63}, false},
+		{"u64", bitfieldType{}, true},
+		{"i65", bitfieldType{}, true},
+		{"i0", bitfieldType{}, true},
+		{"x8", bitfieldType{}, true},
+		{"i", bitfieldType{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseBitfieldType(tt.arg)
+		if (err != nil) != tt.wantErr || !tt.wantErr && got != tt.want {
+			t.Errorf("parseBitfieldType(%q) = %+v, %v", tt.arg, got, err)
+		}
+	}
+
+	u8 := bitfieldType{bits: 8}
+	offsetTests := []struct {
+		arg     string
+		want    uint64
+		wantErr bool
+	}{
+		{"100", 100, false},
+		{"#3", 24, false},
+		{"4294967288", 4294967288, false},
+		{"4294967289", 0, true},
+		{"-1", 0, true},
+	}
+	for _, tt := range offsetTests {
+		got, err := parseBitfieldOffset(tt.arg, u8)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseBitfieldOffset(%q) = %d, %v", tt.arg, got, err)
+		}
+	}
+}
+
+func TestGetSetBits(t *testing.T) {
+	tests := []struct {
+		offset, width, val uint64
+		want               []byte
+	}{
+		{0, 8, 0xAB, []byte{0xAB, 0, 0}},
+		{4, 8, 0xFF, []byte{0x0F, 0xF0, 0}},
+		{1, 1, 1, []byte{0x40, 0, 0}},
+		{3, 13, 0x1FFF, []byte{0x1F, 0xFF, 0}},
+		{0, 24, 0x123456, []byte{0x12, 0x34, 0x56}},
+	}
+	for _, tt := range tests {
+		buf := make([]byte, 3)
+		setBits(buf, tt.offset, tt.width, tt.val)
+		if string(buf) != string(tt.want) {
+			t.Errorf("setBits(%d, %d, %#x) = %x, want %x", tt.offset, tt.width, tt.val, buf, tt.want)
+		}
+		if got := getBits(buf, tt.offset, tt.width); got != tt.val {
+			t.Errorf("getBits(%d, %d) = %#x, want %#x", tt.offset, tt.width, got, tt.val)
+		}
+	}
+	// Bits past the end of the string read as zero.
+	if got := getBits([]byte{0xFF}, 4, 8); got != 0xF0 {
+		t.Errorf("getBits past the end = %#x, want 0xf0", got)
+	}
+}
+
+func TestSignExtend(t *testing.T) {
+	tests := []struct {
+		val, width uint64
+		want       int64
+	}{
+		{0xFF, 8, -1},
+		{0x7F, 8, 127},
+		{0x80, 8, -128},
+		{0x1FF, 8, -1},
+		{1, 1, -1},
+		{math.MaxUint64, 64, -1},
+	}
+	for _, tt := range tests {
+		if got := signExtend(tt.val, tt.width); got != tt.want {
+			t.Errorf("signExtend(%#x, %d) = %d, want %d", tt.val, tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestBitfieldOverflow(t *testing.T) {
+	unsignedTests := []struct {
+		value  uint64
+		incr   int64
+		width  uint64
+		mode   int
+		want   uint64
+		wantOK bool
+	}{
+		{250, 10, 8, overflowWrap, 4, true},
+		{250, 10, 8, overflowSat, 255, true},
+		{250, 10, 8, overflowFail, 0, false},
+		{5, -10, 8, overflowWrap, 251, true},
+		{5, -10, 8, overflowSat, 0, true},
+		{5, -10, 8, overflowFail, 0, false},
+		{5, -5, 8, overflowFail, 0, true},
+		{100, 155, 8, overflowFail, 255, true},
+	}
+	for _, tt := range unsignedTests {
+		got, ok := unsignedOverflow(tt.value, tt.incr, tt.width, tt.mode)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("unsignedOverflow(%d, %d, u%d, %d) = %d, %v", tt.value, tt.incr, tt.width, tt.mode, got, ok)
+		}
+	}
+
+	signedTests := []struct {
+		value, incr int64
+		width       uint64
+		mode        int
+		want        int64
+		wantOK      bool
+	}{
+		{120, 10, 8, overflowWrap, -126, true},
+		{120, 10, 8, overflowSat, 127, true},
+		{120, 10, 8, overflowFail, 0, false},
+		{-120, -10, 8, overflowWrap, 126, true},
+		{-120, -10, 8, overflowSat, -128, true},
+		{-120, -10, 8, overflowFail, 0, false},
+		{-1, 128, 8, overflowFail, 127, true},
+		{math.MaxInt64, 1, 64, overflowWrap, math.MinInt64, true},
+		{math.MaxInt64, 1, 64, overflowSat, math.MaxInt64, true},
+		{math.MinInt64, -1, 64, overflowFail, 0, false},
+	}
+	for _, tt := range signedTests {
+		got, ok := signedOverflow(tt.value, tt.incr, tt.width, tt.mode)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("signedOverflow(%d, %d, i%d, %d) = %d, %v", tt.value, tt.incr, tt.width, tt.mode, got, ok)
+		}
+	}
+}
+
+func TestSetBitInPlace(t *testing.T) {
+	s := newTestServer(nil)
+	c := newTestClient(s)
+	c.do("SET", "k", "\x00\x00")
+	c.do("SETBIT", "k", "0", "1")
+	first, _ := s.Store.kv["k"].([]byte)
+	if first == nil {
+		t.Fatalf("SETBIT left k as %T, want []byte", s.Store.kv["k"])
+	}
+
+	tests := []struct {
+		args      []string
+		want      string
+		wantDirty bool
+	}{
+		{[]string{"SETBIT", "k", "15", "1"}, ":0\r\n", true},
+		{[]string{"SETBIT", "k", "15", "1"}, ":1\r\n", false},
+		{[]string{"SETBIT", "k", "1", "0"}, ":0\r\n", false},
+		{[]string{"BITFIELD", "k", "SET", "u8", "0", "128"}, "*1\r\n:128\r\n", false},
+		{[]string{"BITFIELD", "k", "INCRBY", "u4", "4", "1"}, "*1\r\n:1\r\n", true},
+		{[]string{"BITFIELD", "k", "OVERFLOW", "FAIL", "INCRBY", "u4", "4", "15"}, "*1\r\n$-1\r\n", false},
+		{[]string{"GETBIT", "k", "15"}, ":1\r\n", false},
+		{[]string{"BITCOUNT", "k"}, ":3\r\n", false},
+		{[]string{"GET", "k"}, "$2\r\n\x81\x01\r\n", false},
+		{[]string{"SETBIT", "k", "23", "0"}, ":0\r\n", true}, // grows the bitmap
+	}
+	for _, tt := range tests {
+		c.do("WATCH", "k")
+		if got := c.do(tt.args...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+		if c.tx.dirty != tt.wantDirty {
+			t.Errorf("%v: dirty = %v, want %v", tt.args, c.tx.dirty, tt.wantDirty)
+		}
+		c.do("UNWATCH")
+		if buf := s.Store.kv["k"].([]byte); len(buf) == 2 && &buf[0] != &first[0] {
+			t.Errorf("%v copied the bitmap", tt.args)
+		}
+	}
+	if buf := s.Store.kv["k"].([]byte); len(buf) != 3 {
+		t.Errorf("length = %d, want 3", len(buf))
+	}
+	if got := c.do("TYPE", "k"); got != "+string\r\n" {
+		t.Errorf("TYPE = %q", got)
+	}
+	if val, err := cloneValue(s.Store.kv["k"]); err != nil || val != "\x81\x01\x00" {
+		t.Errorf("DUMP round trip = %q, %v", val, err)
+	}
+}
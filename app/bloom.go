@@ -0,0 +1,497 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	bloomDefaultError     = 0.01
+	bloomDefaultCapacity  = 100
+	bloomDefaultExpansion = 2
+	bloomTighteningRatio  = 0.5 // error rate of each new link relative to the last
+	bloomHashSeed         = 0xc6a4a7935bd1e995
+)
+
+// bloomLink is one fixed size Bloom filter in a scalable chain.
+type bloomLink struct {
+	capacity int
+	errRate  float64
+	hashes   int
+	bits     uint64
+	items    int
+	bitset   []byte
+}
+
+func newBloomLink(capacity int, errRate float64) *bloomLink {
+	bpe := -math.Log(errRate) / (math.Ln2 * math.Ln2)
+	bits := uint64(math.Ceil(float64(capacity) * bpe))
+	return &bloomLink{
+		capacity: capacity,
+		errRate:  errRate,
+		hashes:   int(math.Ceil(math.Ln2 * bpe)),
+		bits:     bits,
+		bitset:   make([]byte, (bits+7)/8),
+	}
+}
+
+// bloomHash returns the two hashes combined to pick an item's bits.
+func bloomHash(item string) (uint64, uint64) {
+	h1 := murmurHash64A([]byte(item), bloomHashSeed)
+	return h1, murmurHash64A([]byte(item), h1)
+}
+
+func (l *bloomLink) test(h1, h2 uint64) bool {
+	for i := 0; i < l.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % l.bits
+		if l.bitset[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *bloomLink) add(h1, h2 uint64) {
+	for i := 0; i < l.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % l.bits
+		l.bitset[bit/8] |= 1 << (bit % 8)
+	}
+	l.items++
+}
+
+// BloomFilter is a scalable Bloom filter: a chain of filters where each new
+// link is larger and has a tighter error rate than the last, so the overall
+// error rate stays bounded as items are added.
+type BloomFilter struct {
+	links      []*bloomLink
+	expansion  int
+	nonScaling bool
+}
+
+func NewBloomFilter(capacity int, errRate float64, expansion int, nonScaling bool) *BloomFilter {
+	return &BloomFilter{
+		links:      []*bloomLink{newBloomLink(capacity, errRate)},
+		expansion:  expansion,
+		nonScaling: nonScaling,
+	}
+}
+
+// Exists reports whether item may have been added.
+func (b *BloomFilter) Exists(item string) bool {
+	h1, h2 := bloomHash(item)
+	for _, l := range b.links {
+		if l.test(h1, h2) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add adds item, returning false if it may already have been added.
+func (b *BloomFilter) Add(item string) (bool, error) {
+	h1, h2 := bloomHash(item)
+	for _, l := range b.links {
+		if l.test(h1, h2) {
+			return false, nil
+		}
+	}
+	last := b.links[len(b.links)-1]
+	if last.items >= last.capacity {
+		if b.nonScaling {
+			return false, fmt.Errorf("non scaling filter is full")
+		}
+		last = newBloomLink(last.capacity*b.expansion, last.errRate*bloomTighteningRatio)
+		b.links = append(b.links, last)
+	}
+	last.add(h1, h2)
+	return true, nil
+}
+
+// Capacity returns the number of items the filter holds before scaling.
+func (b *BloomFilter) Capacity() int {
+	capacity := 0
+	for _, l := range b.links {
+		capacity += l.capacity
+	}
+	return capacity
+}
+
+// Size returns the memory used by the filter in bytes.
+func (b *BloomFilter) Size() int {
+	size := 0
+	for _, l := range b.links {
+		size += len(l.bitset)
+	}
+	return size
+}
+
+// Items returns the number of items added.
+func (b *BloomFilter) Items() int {
+	items := 0
+	for _, l := range b.links {
+		items += l.items
+	}
+	return items
+}
+
+// Bloom filters are saved as module entries of this server's own type.
+const (
+	bloomModuleName   = "BloomFltr"
+	bloomModuleEncver = 1
+)
+
+func (b *BloomFilter) moduleType() (string, int) {
+	return bloomModuleName, bloomModuleEncver
+}
+
+func (b *BloomFilter) saveModule(w *moduleWriter) {
+	w.saveUnsigned(uint64(b.expansion))
+	if b.nonScaling {
+		w.saveUnsigned(1)
+	} else {
+		w.saveUnsigned(0)
+	}
+	w.saveUnsigned(uint64(len(b.links)))
+	for _, l := range b.links {
+		w.saveUnsigned(uint64(l.capacity))
+		w.saveDouble(l.errRate)
+		w.saveUnsigned(uint64(l.hashes))
+		w.saveUnsigned(l.bits)
+		w.saveUnsigned(uint64(l.items))
+		w.saveString(string(l.bitset))
+	}
+}
+
+func loadBloomFilter(r *moduleReader, encver int) (any, error) {
+	if encver != bloomModuleEncver {
+		return nil, fmt.Errorf("unsupported Bloom filter encoding version %d", encver)
+	}
+	var nums [3]uint64
+	for i := range nums {
+		n, err := r.loadUnsigned()
+		if err != nil {
+			return nil, err
+		}
+		nums[i] = n
+	}
+	b := &BloomFilter{expansion: int(nums[0]), nonScaling: nums[1] == 1}
+	for range nums[2] {
+		l := &bloomLink{}
+		capacity, err := r.loadUnsigned()
+		if err != nil {
+			return nil, err
+		}
+		if l.errRate, err = r.loadDouble(); err != nil {
+			return nil, err
+		}
+		hashes, err := r.loadUnsigned()
+		if err != nil {
+			return nil, err
+		}
+		if l.bits, err = r.loadUnsigned(); err != nil {
+			return nil, err
+		}
+		items, err := r.loadUnsigned()
+		if err != nil {
+			return nil, err
+		}
+		bitset, err := r.loadString()
+		if err != nil {
+			return nil, err
+		}
+		if uint64(len(bitset)) != (l.bits+7)/8 {
+			return nil, fmt.Errorf("corrupt Bloom filter")
+		}
+		l.capacity, l.hashes, l.items, l.bitset = int(capacity), int(hashes), int(items), []byte(bitset)
+		b.links = append(b.links, l)
+	}
+	if len(b.links) == 0 {
+		return nil, fmt.Errorf("corrupt Bloom filter")
+	}
+	return b, nil
+}
+
+func init() {
+	moduleLoaders[bloomModuleName] = loadBloomFilter
+}
+
+// bloom returns the Bloom filter stored at key, or nil if there is none.
+func (s *Store) bloom(key string) (*BloomFilter, error) {
+	val, found := s.lookup(key)
+	if !found {
+		return nil, nil
+	}
+	b, ok := val.(*BloomFilter)
+	if !ok {
+		return nil, errWrongType
+	}
+	return b, nil
+}
+
+// bloomOptions holds the parameters of a new Bloom filter.
+type bloomOptions struct {
+	errRate    float64
+	capacity   int
+	expansion  int
+	nonScaling bool
+}
+
+func defaultBloomOptions() bloomOptions {
+	return bloomOptions{bloomDefaultError, bloomDefaultCapacity, bloomDefaultExpansion, false}
+}
+
+func parseBloomErrorRate(arg string) (float64, error) {
+	errRate, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Bad error rate")
+	}
+	if errRate <= 0 || errRate >= 1 {
+		return 0, fmt.Errorf("(0 < error rate range < 1)")
+	}
+	return errRate, nil
+}
+
+func parseBloomCapacity(arg string) (int, error) {
+	capacity, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, fmt.Errorf("Bad capacity")
+	}
+	if capacity <= 0 {
+		return 0, fmt.Errorf("(capacity should be larger than 0)")
+	}
+	return capacity, nil
+}
+
+func parseBloomExpansion(arg string) (int, error) {
+	expansion, err := strconv.Atoi(arg)
+	if err != nil || expansion < 1 {
+		return 0, fmt.Errorf("Bad expansion")
+	}
+	return expansion, nil
+}
+
+// handleBFReserve handles BF.RESERVE commands.
+func (c *ClientHandler) handleBFReserve(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("insufficient number of arguments for BF.RESERVE")
+	}
+	key := args[0]
+	opts := defaultBloomOptions()
+	var err error
+	if opts.errRate, err = parseBloomErrorRate(args[1]); err != nil {
+		return err
+	}
+	if opts.capacity, err = parseBloomCapacity(args[2]); err != nil {
+		return err
+	}
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NONSCALING":
+			opts.nonScaling = true
+		case "EXPANSION":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			if opts.expansion, err = parseBloomExpansion(args[i+1]); err != nil {
+				return err
+			}
+			i++
+		default:
+			return errSyntax
+		}
+	}
+	if _, found := c.Store.lookup(key); found {
+		return fmt.Errorf("item exists")
+	}
+	fmt.Printf("BF.RESERVE %s command received.", key)
+
+	c.Store.create(key, NewBloomFilter(opts.capacity, opts.errRate, opts.expansion, opts.nonScaling))
+	c.Store.notify(notifyModule, "bf.reserve", key)
+	c.Store.touch(key)
+	return c.send(okResponse)
+}
+
+// bloomAdd adds items to the filter at key, creating it with opts unless
+// noCreate is set, and reports event if the filter changed. It returns the
+// reply of each item.
+func (c *ClientHandler) bloomAdd(key string, items []string, opts bloomOptions, noCreate bool, event string) ([]string, error) {
+	b, err := c.Store.bloom(key)
+	if err != nil {
+		return nil, err
+	}
+	changed := false
+	if b == nil {
+		if noCreate {
+			return nil, fmt.Errorf("not found")
+		}
+		b = NewBloomFilter(opts.capacity, opts.errRate, opts.expansion, opts.nonScaling)
+		c.Store.create(key, b)
+		changed = true
+	}
+	result := make([]string, 0, len(items))
+	for _, item := range items {
+		added, err := b.Add(item)
+		switch {
+		case err != nil:
+			result = append(result, encodeError(err))
+		case added:
+			result = append(result, encodeInteger(1))
+			changed = true
+		default:
+			result = append(result, encodeInteger(0))
+		}
+	}
+	if changed {
+		c.Store.notify(notifyModule, event, key)
+		c.Store.touch(key)
+	}
+	return result, nil
+}
+
+// handleBFAdd handles BF.ADD commands.
+func (c *ClientHandler) handleBFAdd(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("wrong number of arguments for BF.ADD")
+	}
+	fmt.Printf("BF.ADD %s command received.", args[0])
+	result, err := c.bloomAdd(args[0], args[1:], defaultBloomOptions(), false, "bf.add")
+	if err != nil {
+		return err
+	}
+	return c.send(result[0])
+}
+
+// handleBFMAdd handles BF.MADD commands.
+func (c *ClientHandler) handleBFMAdd(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("insufficient number of arguments for BF.MADD")
+	}
+	fmt.Printf("BF.MADD %s command received.", args[0])
+	result, err := c.bloomAdd(args[0], args[1:], defaultBloomOptions(), false, "bf.madd")
+	if err != nil {
+		return err
+	}
+	return c.send(encodeArray(result...))
+}
+
+// handleBFInsert handles BF.INSERT commands.
+func (c *ClientHandler) handleBFInsert(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("insufficient number of arguments for BF.INSERT")
+	}
+	key := args[0]
+	opts := defaultBloomOptions()
+	noCreate := false
+	var items []string
+	var err error
+options:
+	for i := 1; i < len(args); i++ {
+		opt := strings.ToUpper(args[i])
+		switch opt {
+		case "NOCREATE":
+			noCreate = true
+			continue
+		case "NONSCALING":
+			opts.nonScaling = true
+			continue
+		case "ITEMS":
+			items = args[i+1:]
+			break options
+		case "CAPACITY", "ERROR", "EXPANSION":
+		default:
+			return errSyntax
+		}
+		if i+1 >= len(args) {
+			return errSyntax
+		}
+		i++
+		switch opt {
+		case "CAPACITY":
+			opts.capacity, err = parseBloomCapacity(args[i])
+		case "ERROR":
+			opts.errRate, err = parseBloomErrorRate(args[i])
+		case "EXPANSION":
+			opts.expansion, err = parseBloomExpansion(args[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(items) == 0 {
+		return errSyntax
+	}
+	fmt.Printf("BF.INSERT %s command received.", key)
+
+	result, err := c.bloomAdd(key, items, opts, noCreate, "bf.insert")
+	if err != nil {
+		return err
+	}
+	return c.send(encodeArray(result...))
+}
+
+// handleBFExists handles BF.EXISTS and, with multi set, BF.MEXISTS
+// commands.
+func (c *ClientHandler) handleBFExists(args []string, multi bool) error {
+	if len(args) < 2 || (!multi && len(args) != 2) {
+		return fmt.Errorf("wrong number of arguments for BF.EXISTS")
+	}
+	b, err := c.Store.bloom(args[0])
+	if err != nil {
+		return err
+	}
+	result := make([]string, 0, len(args)-1)
+	for _, item := range args[1:] {
+		if b != nil && b.Exists(item) {
+			result = append(result, encodeInteger(1))
+		} else {
+			result = append(result, encodeInteger(0))
+		}
+	}
+	if !multi {
+		return c.send(result[0])
+	}
+	return c.send(encodeArray(result...))
+}
+
+// handleBFInfo handles BF.INFO commands.
+func (c *ClientHandler) handleBFInfo(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("wrong number of arguments for BF.INFO")
+	}
+	b, err := c.Store.bloom(args[0])
+	if err != nil {
+		return err
+	}
+	if b == nil {
+		return fmt.Errorf("not found")
+	}
+
+	expansion := encodeInteger(b.expansion)
+	if b.nonScaling {
+		expansion = nullResponse
+	}
+	fields := []struct {
+		option, name, value string
+	}{
+		{"CAPACITY", "Capacity", encodeInteger(b.Capacity())},
+		{"SIZE", "Size", encodeInteger(b.Size())},
+		{"FILTERS", "Number of filters", encodeInteger(len(b.links))},
+		{"ITEMS", "Number of items inserted", encodeInteger(b.Items())},
+		{"EXPANSION", "Expansion rate", expansion},
+	}
+	if len(args) == 2 {
+		for _, f := range fields {
+			if strings.EqualFold(args[1], f.option) {
+				return c.send(encodeArray(f.value))
+			}
+		}
+		return fmt.Errorf("Invalid information value")
+	}
+	result := make([]string, 0, 2*len(fields))
+	for _, f := range fields {
+		result = append(result, encodeSimpleString(f.name), f.value)
+	}
+	return c.send(encodeArray(result...))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	tests := []struct {
+		name       string
+		capacity   int
+		errRate    float64
+		nonScaling bool
+		items      int
+		wantLinks  int
+	}{
+		{"within capacity", 1000, 0.01, false, 1000, 1},
+		{"scaling", 100, 0.01, false, 1000, 4},
+		{"tight error rate", 500, 0.0001, false, 500, 1},
+	}
+	for _, tt := range tests {
+		b := NewBloomFilter(tt.capacity, tt.errRate, bloomDefaultExpansion, tt.nonScaling)
+		for i := 0; i < tt.items; i++ {
+			if _, err := b.Add("item" + strconv.Itoa(i)); err != nil {
+				t.Fatalf("%s: Add: %v", tt.name, err)
+			}
+		}
+		// No false negatives, ever.
+		for i := 0; i < tt.items; i++ {
+			if !b.Exists("item" + strconv.Itoa(i)) {
+				t.Fatalf("%s: item%d is missing", tt.name, i)
+			}
+		}
+		if len(b.links) != tt.wantLinks {
+			t.Errorf("%s: %d links, want %d", tt.name, len(b.links), tt.wantLinks)
+		}
+		// Every link adds at most its own error rate, and they shrink
+		// geometrically, so the total stays within twice the first.
+		falsePositives := 0
+		const probes = 20000
+		for i := 0; i < probes; i++ {
+			if b.Exists("other" + strconv.Itoa(i)) {
+				falsePositives++
+			}
+		}
+		if rate := float64(falsePositives) / probes; rate > 2*tt.errRate+0.002 {
+			t.Errorf("%s: false positive rate %v, want about %v", tt.name, rate, tt.errRate)
+		}
+	}
+}
+
+func TestBloomFilterAdd(t *testing.T) {
+	b := NewBloomFilter(2, 0.01, bloomDefaultExpansion, true)
+	tests := []struct {
+		item    string
+		want    bool
+		wantErr bool
+	}{
+		{"a", true, false},
+		{"a", false, false},
+		{"b", true, false},
+		{"c", false, true},
+	}
+	for _, tt := range tests {
+		got, err := b.Add(tt.item)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("Add(%s) = %v, %v", tt.item, got, err)
+		}
+	}
+	if b.Items() != 2 || b.Capacity() != 2 {
+		t.Errorf("Items() = %d, Capacity() = %d", b.Items(), b.Capacity())
+	}
+}
+
+func TestBloomFilterDumpRoundTrip(t *testing.T) {
+	b := NewBloomFilter(50, 0.01, 2, false)
+	for i := 0; i < 200; i++ {
+		b.Add(strconv.Itoa(i))
+	}
+	payload, err := dumpValue(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := restoreValue(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := val.(*BloomFilter)
+	if restored.Items() != b.Items() || restored.Capacity() != b.Capacity() || restored.Size() != b.Size() {
+		t.Errorf("restored %d items, capacity %d, size %d", restored.Items(), restored.Capacity(), restored.Size())
+	}
+	for i := 0; i < 200; i++ {
+		if !restored.Exists(strconv.Itoa(i)) {
+			t.Fatalf("%d is missing after restoring", i)
+		}
+	}
+}
+
+func TestParseBloomOptions(t *testing.T) {
+	if _, err := parseBloomErrorRate("0.5"); err != nil {
+		t.Errorf("parseBloomErrorRate(0.5): %v", err)
+	}
+	for _, arg := range []string{"0", "1", "-0.1", "x"} {
+		if _, err := parseBloomErrorRate(arg); err == nil {
+			t.Errorf("parseBloomErrorRate(%s) succeeded", arg)
+		}
+	}
+	for _, arg := range []string{"0", "-1", "x"} {
+		if _, err := parseBloomCapacity(arg); err == nil {
+			t.Errorf("parseBloomCapacity(%s) succeeded", arg)
+		}
+	}
+	for _, arg := range []string{"0", "x"} {
+		if _, err := parseBloomExpansion(arg); err == nil {
+			t.Errorf("parseBloomExpansion(%s) succeeded", arg)
+		}
+	}
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// containerCommands are the commands whose first argument is a subcommand,
+// which CLIENT LIST reports along with the command.
+var containerCommands = map[string]bool{
+	"CONFIG":   true,
+	"CLIENT":   true,
+	"SCRIPT":   true,
+	"FUNCTION": true,
+	"PUBSUB":   true,
+	"XGROUP":   true,
+	"XINFO":    true,
+}
+
+// commandName returns the name CLIENT LIST reports for cmd, such as
+// client|list.
+func commandName(cmd Command) string {
+	name := strings.ToUpper(cmd.Command)
+	if containerCommands[name] && len(cmd.Args) > 0 {
+		return strings.ToLower(name + "|" + cmd.Args[0])
+	}
+	return strings.ToLower(name)
+}
+
+// clientType returns the type of the client for CLIENT LIST and CLIENT
+// KILL. Connections to a master aren't handled as clients, so no client is
+// of the master type.
+func (c *ClientHandler) clientType() string {
+	switch {
+	case c.replica:
+		return "replica"
+	case c.inSubscribeMode():
+		return "pubsub"
+	}
+	return "normal"
+}
+
+// parseClientType parses a client type argument, accepting slave for
+// replica.
+func parseClientType(arg string) (string, error) {
+	switch typ := strings.ToLower(arg); typ {
+	case "normal", "master", "replica", "pubsub":
+		return typ, nil
+	case "slave":
+		return "replica", nil
+	}
+	return "", fmt.Errorf("Unknown client type '%s'", arg)
+}
+
+// flags returns the flags of the client for CLIENT LIST.
+func (c *ClientHandler) flags() string {
+	var flags strings.Builder
+	for _, flag := range []struct {
+		set bool
+		ch  byte
+	}{
+		{c.replica, 'S'},
+		{c.inSubscribeMode(), 'P'},
+		{c.tx.active, 'x'},
+		{c.tx.dirty, 'd'},
+		{c.tracking != nil, 't'},
+		{c.tracking != nil && c.tracking.redirect != 0 && c.Server.client(c.tracking.redirect) == nil, 'R'},
+		{c.tracking != nil && c.tracking.bcast, 'B'},
+		{c.noEvict, 'e'},
+		{c.noTouch, 'T'},
+	} {
+		if flag.set {
+			flags.WriteByte(flag.ch)
+		}
+	}
+	if flags.Len() == 0 {
+		return "N"
+	}
+	return flags.String()
+}
+
+// describe returns the line describing the client in CLIENT LIST and
+// CLIENT INFO.
+func (c *ClientHandler) describe(now time.Time) string {
+	var channels, patterns, shards, oll, omem int
+	if c.sub != nil {
+		channels, patterns, shards = len(c.sub.channels), len(c.sub.patterns), len(c.sub.shards)
+		c.sub.mu.Lock()
+		oll, omem = len(c.sub.outbox), c.sub.pending
+		c.sub.mu.Unlock()
+	}
+	multi := -1
+	if c.tx.active {
+		multi = len(c.tx.queued)
+	}
+	redirect := -1
+	if c.tracking != nil {
+		redirect = int(c.tracking.redirect)
+	}
+	fields := []string{
+		"id=" + strconv.FormatInt(c.id, 10),
+		"addr=" + c.addr,
+		"laddr=" + c.laddr,
+		"name=" + c.name,
+		"age=" + strconv.Itoa(int(now.Sub(c.created).Seconds())),
+		"idle=" + strconv.Itoa(int(now.Sub(c.lastInteraction).Seconds())),
+		"flags=" + c.flags(),
+		"db=0",
+		"sub=" + strconv.Itoa(channels),
+		"psub=" + strconv.Itoa(patterns),
+		"ssub=" + strconv.Itoa(shards),
+		"multi=" + strconv.Itoa(multi),
+		"watch=" + strconv.Itoa(len(c.tx.watched)),
+		"qbuf=" + strconv.Itoa(c.queryBuf),
+		"obl=0",
+		"oll=" + strconv.Itoa(oll),
+		"omem=" + strconv.Itoa(omem),
+		"cmd=" + c.lastCmd,
+		"user=default",
+		"redir=" + strconv.Itoa(redirect),
+		"resp=" + strconv.Itoa(c.resp),
+		"lib-name=" + c.libName,
+		"lib-ver=" + c.libVer,
+	}
+	return strings.Join(fields, " ") + "\n"
+}
+
+// addClient registers a connected client, so that other clients can refer
+// to it by ID.
+func (s *Server) addClient(c *ClientHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[c.id] = c
+}
+
+// removeClient forgets a disconnected client.
+func (s *Server) removeClient(c *ClientHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, c.id)
+}
+
+// client returns the connected client with the given ID, or nil.
+func (s *Server) client(id int64) *ClientHandler {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.clients[id]
+}
+
+// getClients returns the connected clients.
+func (s *Server) getClients() []*ClientHandler {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clients := make([]*ClientHandler, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// handleHello handles HELLO commands, which switch the client between the
+// RESP2 and RESP3 protocols. Replies are the same in both, except for maps
+// and push messages.
+func (c *ClientHandler) handleHello(args []string) error {
+	fmt.Printf("HELLO %s command received.", strings.Join(args, " "))
+	if len(args) > 1 {
+		return errSyntax
+	}
+	if len(args) == 1 {
+		ver, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("Protocol version is not an integer or out of range")
+		}
+		if ver != 2 && ver != 3 {
+			return ReplyError{"NOPROTO", "unsupported protocol version"}
+		}
+		c.resp = ver
+		if ver == 3 {
+			// Push messages can be sent to RESP3 clients at any time, so
+			// they go through an outbox like messages to subscribers.
+			c.subscriber()
+		}
+	}
+	return c.send(encodeMap(c.resp,
+		encodeBulkString("server"), encodeBulkString("redis"),
+		encodeBulkString("version"), encodeBulkString("7.2.0"),
+		encodeBulkString("proto"), encodeInteger(c.resp),
+		encodeBulkString("id"), encodeInteger(int(c.id)),
+		encodeBulkString("mode"), encodeBulkString("standalone"),
+		encodeBulkString("role"), encodeBulkString("master"),
+		encodeBulkString("modules"), encodeArray(),
+	))
+}
+
+// handleClient handles CLIENT commands.
+func (c *ClientHandler) handleClient(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("insufficient number of arguments for CLIENT")
+	}
+	subCmd := strings.ToUpper(args[0])
+	fmt.Printf("CLIENT %s command received.", subCmd)
+	switch subCmd {
+	case "ID":
+		if len(args) != 1 {
+			return fmt.Errorf("wrong number of arguments for CLIENT ID")
+		}
+		return c.send(encodeInteger(int(c.id)))
+	case "INFO":
+		if len(args) != 1 {
+			return fmt.Errorf("wrong number of arguments for CLIENT INFO")
+		}
+		return c.send(encodeBulkString(c.describe(time.Now())))
+	case "LIST":
+		return c.handleClientList(args[1:])
+	case "SETNAME":
+		if len(args) != 2 {
+			return fmt.Errorf("wrong number of arguments for CLIENT SETNAME")
+		}
+		if !validClientName(args[1]) {
+			return fmt.Errorf("Client names cannot contain spaces, newlines or special characters.")
+		}
+		c.name = args[1]
+		return c.send(okResponse)
+	case "GETNAME":
+		if len(args) != 1 {
+			return fmt.Errorf("wrong number of arguments for CLIENT GETNAME")
+		}
+		if c.name == "" {
+			return c.send(nullResponse)
+		}
+		return c.send(encodeBulkString(c.name))
+	case "SETINFO":
+		if len(args) != 3 {
+			return fmt.Errorf("wrong number of arguments for CLIENT SETINFO")
+		}
+		if !validClientName(args[2]) {
+			return fmt.Errorf("%s cannot contain spaces, newlines or special characters.", args[1])
+		}
+		switch strings.ToUpper(args[1]) {
+		case "LIB-NAME":
+			c.libName = args[2]
+		case "LIB-VER":
+			c.libVer = args[2]
+		default:
+			return fmt.Errorf("Unrecognized option '%s'", args[1])
+		}
+		return c.send(okResponse)
+	case "KILL":
+		return c.handleClientKill(args[1:])
+	case "NO-EVICT", "NO-TOUCH":
+		if len(args) != 2 {
+			return fmt.Errorf("wrong number of arguments for CLIENT %s", subCmd)
+		}
+		var on bool
+		switch strings.ToUpper(args[1]) {
+		case "ON":
+			on = true
+		case "OFF":
+		default:
+			return errSyntax
+		}
+		if subCmd == "NO-EVICT" {
+			c.noEvict = on
+		} else {
+			c.noTouch = on
+		}
+		return c.send(okResponse)
+	case "PAUSE":
+		return c.handleClientPause(args[1:])
+	case "UNPAUSE":
+		if len(args) != 1 {
+			return fmt.Errorf("wrong number of arguments for CLIENT UNPAUSE")
+		}
+		c.Store.pause = clientPause{}
+		return c.send(okResponse)
+	case "REPLY":
+		if len(args) != 2 {
+			return fmt.Errorf("wrong number of arguments for CLIENT REPLY")
+		}
+		switch strings.ToUpper(args[1]) {
+		case "ON":
+			c.replyOff = false
+			return c.send(okResponse)
+		case "OFF":
+			c.replyOff = true
+		case "SKIP":
+			c.skipNext, c.skipReply = true, true
+		default:
+			return errSyntax
+		}
+		return nil
+	case "TRACKING":
+		return c.handleClientTracking(args[1:])
+	case "CACHING":
+		return c.handleClientCaching(args[1:])
+	case "GETREDIR":
+		if len(args) != 1 {
+			return fmt.Errorf("wrong number of arguments for CLIENT GETREDIR")
+		}
+		redirect := -1
+		if c.tracking != nil {
+			redirect = int(c.tracking.redirect)
+		}
+		return c.send(encodeInteger(redirect))
+	case "TRACKINGINFO":
+		if len(args) != 1 {
+			return fmt.Errorf("wrong number of arguments for CLIENT TRACKINGINFO")
+		}
+		return c.send(c.trackingInfo())
+	}
+	return fmt.Errorf("unknown subcommand %q for CLIENT", args[0])
+}
+
+// validClientName reports whether name can be used as a client name or
+// library name or version, which CLIENT LIST shows without quoting.
+func validClientName(name string) bool {
+	for _, ch := range name {
+		if ch < '!' || ch > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// handleClientList handles CLIENT LIST commands, optionally filtered by
+// TYPE or ID.
+func (c *ClientHandler) handleClientList(args []string) error {
+	var typ string
+	var ids map[int64]bool
+	if len(args) > 0 {
+		switch strings.ToUpper(args[0]) {
+		case "TYPE":
+			if len(args) != 2 {
+				return errSyntax
+			}
+			var err error
+			if typ, err = parseClientType(args[1]); err != nil {
+				return err
+			}
+		case "ID":
+			if len(args) < 2 {
+				return errSyntax
+			}
+			ids = make(map[int64]bool)
+			for _, arg := range args[1:] {
+				id, err := strconv.ParseInt(arg, 10, 64)
+				if err != nil || id <= 0 {
+					return fmt.Errorf("Invalid client ID")
+				}
+				ids[id] = true
+			}
+		default:
+			return errSyntax
+		}
+	}
+
+	clients := c.Server.getClients()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].id < clients[j].id })
+	now := time.Now()
+	var list strings.Builder
+	for _, client := range clients {
+		if (typ != "" && client.clientType() != typ) || (ids != nil && !ids[client.id]) {
+			continue
+		}
+		list.WriteString(client.describe(now))
+	}
+	return c.send(encodeBulkString(list.String()))
+}
+
+// handleClientKill handles CLIENT KILL commands, either with the address of
+// a client or with ID, ADDR, LADDR, TYPE, USER, SKIPME and MAXAGE filters
+// that the killed clients all match.
+func (c *ClientHandler) handleClientKill(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("wrong number of arguments for CLIENT KILL")
+	}
+	oldStyle := len(args) == 1
+	var id int64
+	var addr, laddr, typ, user string
+	var maxAge time.Duration
+	skipMe := true
+	if oldStyle {
+		addr, skipMe = args[0], false
+	} else {
+		if len(args)%2 != 0 {
+			return errSyntax
+		}
+		for i := 0; i < len(args); i += 2 {
+			val := args[i+1]
+			switch strings.ToUpper(args[i]) {
+			case "ID":
+				n, err := strconv.ParseInt(val, 10, 64)
+				if err != nil || n <= 0 {
+					return fmt.Errorf("client-id should be greater than 0")
+				}
+				id = n
+			case "ADDR":
+				addr = val
+			case "LADDR":
+				laddr = val
+			case "TYPE":
+				var err error
+				if typ, err = parseClientType(val); err != nil {
+					return err
+				}
+			case "USER":
+				user = val
+			case "SKIPME":
+				switch strings.ToLower(val) {
+				case "yes":
+					skipMe = true
+				case "no":
+					skipMe = false
+				default:
+					return errSyntax
+				}
+			case "MAXAGE":
+				secs, err := strconv.ParseInt(val, 10, 64)
+				if err != nil {
+					return errNotInteger
+				}
+				maxAge = time.Duration(secs) * time.Second
+			default:
+				return errSyntax
+			}
+		}
+	}
+
+	now := time.Now()
+	killed := 0
+	for _, client := range c.Server.getClients() {
+		switch {
+		case id != 0 && client.id != id,
+			addr != "" && client.addr != addr,
+			laddr != "" && client.laddr != laddr,
+			typ != "" && client.clientType() != typ,
+			user != "" && user != "default",
+			maxAge > 0 && now.Sub(client.created) < maxAge,
+			skipMe && client == c:
+			continue
+		}
+		if client == c {
+			// The reply goes out before the connection is closed.
+			c.Server.removeClient(c)
+			c.closing = true
+		} else {
+			client.kill()
+		}
+		killed++
+	}
+	if oldStyle {
+		if killed == 0 {
+			return fmt.Errorf("No such client")
+		}
+		return c.send(okResponse)
+	}
+	return c.send(encodeInteger(killed))
+}
+
+// clientPause is the state of CLIENT PAUSE.
+type clientPause struct {
+	until time.Time
+	all   bool // pause every command, not only writes
+}
+
+// active reports whether clients are paused.
+func (p clientPause) active() bool {
+	return time.Now().Before(p.until)
+}
+
+// handleClientPause handles CLIENT PAUSE commands. A pause already in
+// effect is only extended or made stricter.
+func (c *ClientHandler) handleClientPause(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("wrong number of arguments for CLIENT PAUSE")
+	}
+	ms, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || ms < 0 {
+		return fmt.Errorf("timeout is not an integer or out of range")
+	}
+	all := true
+	if len(args) == 2 {
+		switch strings.ToUpper(args[1]) {
+		case "ALL":
+		case "WRITE":
+			all = false
+		default:
+			return errSyntax
+		}
+	}
+	pause := clientPause{time.Now().Add(time.Duration(ms) * time.Millisecond), all}
+	if old := c.Store.pause; old.active() {
+		if old.until.After(pause.until) {
+			pause.until = old.until
+		}
+		pause.all = pause.all || old.all
+	}
+	c.Store.pause = pause
+	return c.send(okResponse)
+}
+
+// paused reports whether cmd must wait for CLIENT PAUSE to end. In the
+// WRITE mode only commands that may modify the keyspace or be sent to
+// replicas wait, which for EXEC depends on the queued commands. Replicas
+// and CLIENT UNPAUSE are never paused.
+func (c *ClientHandler) paused(cmd Command) bool {
+	p := c.Store.pause
+	if !p.active() || c.replica {
+		return false
+	}
+	name := strings.ToUpper(cmd.Command)
+	if name == "CLIENT" && len(cmd.Args) > 0 && strings.EqualFold(cmd.Args[0], "UNPAUSE") {
+		return false
+	}
+	if p.all {
+		return true
+	}
+	if c.tx.active {
+		if name != "EXEC" {
+			return false
+		}
+		for _, queued := range c.tx.queued {
+			if info, ok := lookupCommand(queued.Command); ok && info.flags&(cmdWrite|cmdMayReplicate) != 0 {
+				return true
+			}
+		}
+		return false
+	}
+	info, ok := lookupCommand(name)
+	return ok && info.flags&(cmdWrite|cmdMayReplicate) != 0
+}
+
+// kill disconnects the client, stopping any command it is blocked in. It
+// is taken off the client list at once, while the rest of its state is
+// released once its connection handler returns.
+func (c *ClientHandler) kill() {
+	c.Server.removeClient(c)
+	c.cancel()
+	c.Conn.Close()
+}
+
+// waitUnpaused holds cmd until CLIENT PAUSE no longer applies to it,
+// releasing the store lock while waiting. It returns false if the client
+// is stopped meanwhile.
+func (c *ClientHandler) waitUnpaused(cmd Command) bool {
+	for c.paused(cmd) {
+		c.Store.wait(c.Context, c.Store.pause.until)
+		if c.Context.Err() != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -3,11 +3,11 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
   "encoding/hex"
 	"io"
-	"os"
-	"path/filepath"
+	"net"
 	"strconv"
 	"strings"
 	"sync"
@@ -18,24 +18,72 @@ const (
 	pingResponse = "+PONG\r\n"
 	okResponse   = "+OK\r\n"
 	nullResponse = "$-1\r\n"
+
+	nullArrayResponse = "*-1\r\n"
+)
+
+var (
+	errSyntax     = errors.New("syntax error")
+	errNotInteger = errors.New("value is not an integer or out of range")
 )
 
 var emptyRDB, _ = hex.DecodeString("524544495330303131fa0972656469732d76657205372e322e30fa0a72656469732d62697473c040fa056374696d65c26d08bc65fa08757365642d6d656dc2b0c41000fa08616f662d62617365c000fff06e3bfec0ff5aa2")
 
 type ClientHandler struct {
-	Context context.Context
+	Context context.Context // cancelled once the client is killed
 	Conn    io.ReadWriteCloser
 	Server  *Server
 	Store   *Store
+
+	id       int64
+	resp     int // protocol version, 2 or 3
+	tx       transaction
+	sub      *subscriber // set once the client subscribes or switches to RESP3
+	tracking *clientTracking
+	cancel   context.CancelFunc
+
+	// What CLIENT LIST reports about the connection. Except for the
+	// addresses and creation time, these are only used with the store lock
+	// held.
+	addr, laddr     string
+	created         time.Time
+	lastInteraction time.Time
+	lastCmd         string // name of the last command, e.g. client|list
+	queryBuf        int    // bytes read from the connection but not parsed
+	name            string
+	libName, libVer string
+	replica         bool // sent PSYNC
+	noEvict         bool
+	noTouch         bool
+	closing         bool // close the connection once the reply is sent
+	replicated      bool // the command being executed queued its effects for replicas
+
+	// CLIENT REPLY state: replies are dropped while replyOff or skipReply
+	// is set, and skipNext sets skipReply for the next command.
+	replyOff  bool
+	skipNext  bool
+	skipReply bool
 }
 
 func NewClientHandler(ctx context.Context, conn io.ReadWriteCloser, server *Server) *ClientHandler {
-	return &ClientHandler{
-		Context: ctx,
-		Conn:    conn,
-		Server:  server,
-		Store:   NewStore(),
+	now := time.Now()
+	ctx, cancel := context.WithCancel(ctx)
+	c := &ClientHandler{
+		Context:         ctx,
+		cancel:          cancel,
+		Conn:            conn,
+		Server:          server,
+		Store:           server.Store,
+		id:              server.lastClientID.Add(1),
+		resp:            2,
+		created:         now,
+		lastInteraction: now,
+		lastCmd:         "NULL",
+	}
+	if nc, ok := conn.(net.Conn); ok {
+		c.addr, c.laddr = nc.RemoteAddr().String(), nc.LocalAddr().String()
 	}
+	return c
 }
 
 type Command struct {
@@ -47,26 +95,11 @@ type Command struct {
 func (c *ClientHandler) Handle(wg *sync.WaitGroup) {
 	defer c.Conn.Close()
 	defer wg.Done()
+	defer c.release()
+	defer c.cancel()
+	c.Server.addClient(c)
 	fmt.Printf("Connection initiated.")
-	scanner := bufio.NewScanner(c.Conn)
-
-	var (
-		cmd         Command // Command object
-		cmdLength   int     // Number of words in command + args
-		cmdReceived int     // Number of words received from client
-	)
-
-	if c.Server.IsPersistent() {
-		file, err := c.dbFile()
-		if err != nil {
-			fmt.Errorf("Error opening db file: %v", err)
-		}
-		if err := c.Store.Load(file); err != nil {
-			fmt.Errorf("Error reading from db: %v", err)
-		}
-	} else {
-		fmt.Printf("Database file not provided, data will not be saved between sessions.")
-	}
+	reader := bufio.NewReader(c.Conn)
 
 	for {
 		select {
@@ -74,61 +107,131 @@ func (c *ClientHandler) Handle(wg *sync.WaitGroup) {
 			fmt.Printf("Client handler stopping...")
 			return
 		default:
-			for scanner.Scan() {
-				msg := scanner.Text()
-
-				switch msg[0] {
-				case '*':
-					var length int
-					if len(msg) > 1 {
-						length = decodeArrayLength(msg)
-					} else {
-						// "*" can be passed as a parameter for KEYS command.
-						length = 0
-					}
-					cmdLength = length
-					cmdReceived = 0
-				case '$':
-					// Don't need to do anything with this token for now.
-				default:
-					if cmdReceived < cmdLength {
-						if cmdReceived == 0 {
-							cmd.Command = msg
-						} else {
-							cmd.Args = append(cmd.Args, msg)
-						}
-						cmdReceived++
-					}
+			cmd, err := readCommand(reader)
+			if err != nil {
+				var protoErr ProtocolError
+				if errors.As(err, &protoErr) {
+					c.send(encodeError(err))
 				}
+				fmt.Printf("Client disconnected: %v", err)
+				return
+			}
+			if cmd.Command == "" {
+				continue
+			}
 
-				// Execute command if the array is complete.
-				if cmdReceived == cmdLength {
-					if err := c.executeCommand(cmd); err != nil {
-						fmt.Errorf("Error executing command %v: %v", cmd, err)
-					}
-					// Reset for next command.
-					cmd = Command{}
-					cmdLength = 0
-				}
+			if !c.lockStore(cmd) {
+				continue
+			}
+			if !c.waitUnpaused(cmd) {
+				c.Store.mu.Unlock()
+				return
+			}
+			c.lastInteraction, c.lastCmd = time.Now(), commandName(cmd)
+			c.queryBuf = reader.Buffered()
+			c.skipReply, c.skipNext = c.skipNext, false
+			err = c.process(cmd)
+			c.Server.flushPropagated()
+			c.Store.cond.Broadcast()
+			c.Store.mu.Unlock()
+			if err != nil {
+				fmt.Printf("Error executing command %v: %v", cmd, err)
+				c.send(encodeError(err))
+			}
+			c.skipReply = false
+			if c.closing {
+				return
 			}
 		}
 	}
 }
 
+// release drops what the store keeps about the client once it
+// disconnects.
+func (c *ClientHandler) release() {
+	c.Store.mu.Lock()
+	defer c.Store.mu.Unlock()
+	c.discard()
+	c.unsubscribeAll()
+	c.stopTracking()
+	c.Server.removeClient(c)
+	if nc, ok := c.Conn.(net.Conn); ok && c.replica {
+		c.Server.RemoveReplica(nc)
+	}
+}
+
+// process runs a command sent by the client, or queues it while a
+// transaction is open.
+func (c *ClientHandler) process(cmd Command) error {
+	if c.inSubscribeMode() {
+		return c.processSubscribed(cmd)
+	}
+	if c.tx.active {
+		switch strings.ToUpper(cmd.Command) {
+		case "EXEC", "DISCARD", "MULTI", "WATCH":
+		default:
+			return c.queue(cmd)
+		}
+	}
+	return c.call(cmd)
+}
+
+// call executes cmd. Commands mark the keys they change as modified
+// themselves, so that only real changes abort transactions.
+func (c *ClientHandler) call(cmd Command) error {
+	info, ok := lookupCommand(cmd.Command)
+	var keys []string
+	var missing []bool
+	if ok && info.flags&(cmdWrite|cmdReadOnly) != 0 {
+		keys = commandKeys(info, cmd)
+	}
+	if ok && info.flags&cmdReadOnly != 0 {
+		missing = make([]bool, len(keys))
+		for i, key := range keys {
+			_, found := c.Store.lookup(key)
+			missing[i] = !found
+		}
+	}
+	if t := c.Server.tracking; t.current == nil {
+		t.current = c
+		defer func() {
+			t.current = nil
+			t.flushBroadcast()
+		}()
+	}
+	c.replicated = false
+	if err := c.executeCommand(cmd); err != nil {
+		return err
+	}
+	c.propagateCall(cmd, info)
+	c.trackCommand(cmd, info, keys)
+	for i, miss := range missing {
+		if miss {
+			c.Store.notify(notifyKeyMiss, "keymiss", keys[i])
+		}
+	}
+	return nil
+}
+
+// wait blocks until another client has executed a command, like
+// Store.wait. Inside a transaction it returns false at once, as blocking
+// commands don't block there. It also returns false once the client is
+// killed, and blocking commands then give up without replying.
+func (c *ClientHandler) wait(deadline time.Time) bool {
+	if c.tx.executing {
+		return false
+	}
+	return c.Store.wait(c.Context, deadline)
+}
+
 // executeCommand executes the command in the command array.
 func (c *ClientHandler) executeCommand(cmd Command) error {
-	switch cmd.Command {
+	switch strings.ToUpper(cmd.Command) {
 	case "PING":
 		return c.handlePing()
 	case "ECHO":
 		return c.handleEcho(cmd.Args)
 	case "SET":
-    for _, r := range c.Server.GetReplicas() {
-      fmt.Printf("Replica: %v\n", r)
-      if err := r.send(encodeBulkStringArray(len(cmd.Args)+1, append([]string{cmd.Command}, cmd.Args...)...)); err != nil {
-        fmt.Printf("Error sending command to replica: %v\n", err)
-      }
-    }
 		return c.handleSet(cmd.Args)
 	case "GET":
 		return c.handleGet(cmd.Args)
@@ -136,14 +239,411 @@ func (c *ClientHandler) executeCommand(cmd Command) error {
 		return c.handleConfig(cmd.Args)
 	case "KEYS":
 		return c.handleKeys(cmd.Args)
+	case "SCAN":
+		return c.handleScan(cmd.Args)
+	case "SORT":
+		return c.handleSort(cmd.Args, false)
+	case "SORT_RO":
+		return c.handleSort(cmd.Args, true)
+	case "DUMP":
+		return c.handleDump(cmd.Args)
+	case "RESTORE":
+		return c.handleRestore(cmd.Args)
+	case "MIGRATE":
+		return c.handleMigrate(cmd.Args)
 	case "INFO":
 		return c.handleInfo(cmd.Args)
+	case "SAVE":
+		return c.handleSave()
+	case "SHUTDOWN":
+		return c.handleShutdown(cmd.Args)
+	case "HSET", "HMSET":
+		return c.handleHSet(cmd.Args)
+	case "HGET":
+		return c.handleHGet(cmd.Args)
+	case "HMGET":
+		return c.handleHMGet(cmd.Args)
+	case "HDEL":
+		return c.handleHDel(cmd.Args)
+	case "HLEN":
+		return c.handleHLen(cmd.Args)
+	case "HEXISTS":
+		return c.handleHExists(cmd.Args)
+	case "HGETALL":
+		return c.handleHGetAll(cmd.Args, true, true)
+	case "HKEYS":
+		return c.handleHGetAll(cmd.Args, true, false)
+	case "HVALS":
+		return c.handleHGetAll(cmd.Args, false, true)
+	case "HSCAN":
+		return c.handleHScan(cmd.Args)
+	case "HEXPIRE":
+		return c.handleHExpire(cmd.Args, time.Second, false)
+	case "HPEXPIRE":
+		return c.handleHExpire(cmd.Args, time.Millisecond, false)
+	case "HEXPIREAT":
+		return c.handleHExpire(cmd.Args, time.Second, true)
+	case "HPEXPIREAT":
+		return c.handleHExpire(cmd.Args, time.Millisecond, true)
+	case "HTTL":
+		return c.handleHTTL(cmd.Args, time.Second, false)
+	case "HPTTL":
+		return c.handleHTTL(cmd.Args, time.Millisecond, false)
+	case "HEXPIRETIME":
+		return c.handleHTTL(cmd.Args, time.Second, true)
+	case "HPEXPIRETIME":
+		return c.handleHTTL(cmd.Args, time.Millisecond, true)
+	case "HPERSIST":
+		return c.handleHPersist(cmd.Args)
+	case "HGETEX":
+		return c.handleHGetEx(cmd.Args)
+	case "HSETEX":
+		return c.handleHSetEx(cmd.Args)
+	case "LPUSH":
+		return c.handlePush(cmd.Args, true)
+	case "RPUSH":
+		return c.handlePush(cmd.Args, false)
+	case "LRANGE":
+		return c.handleLRange(cmd.Args)
+	case "LLEN":
+		return c.handleLLen(cmd.Args)
+	case "SADD":
+		return c.handleSAdd(cmd.Args)
+	case "SREM":
+		return c.handleSRem(cmd.Args)
+	case "SMEMBERS":
+		return c.handleSMembers(cmd.Args)
+	case "SISMEMBER":
+		return c.handleSIsMember(cmd.Args, false)
+	case "SMISMEMBER":
+		return c.handleSIsMember(cmd.Args, true)
+	case "SCARD":
+		return c.handleSCard(cmd.Args)
+	case "SPOP":
+		return c.handleSPop(cmd.Args, true)
+	case "SRANDMEMBER":
+		return c.handleSPop(cmd.Args, false)
+	case "SMOVE":
+		return c.handleSMove(cmd.Args)
+	case "SINTER":
+		return c.handleSetAlgebra(cmd.Args, setOpInter, false)
+	case "SUNION":
+		return c.handleSetAlgebra(cmd.Args, setOpUnion, false)
+	case "SDIFF":
+		return c.handleSetAlgebra(cmd.Args, setOpDiff, false)
+	case "SINTERSTORE":
+		return c.handleSetAlgebra(cmd.Args, setOpInter, true)
+	case "SUNIONSTORE":
+		return c.handleSetAlgebra(cmd.Args, setOpUnion, true)
+	case "SDIFFSTORE":
+		return c.handleSetAlgebra(cmd.Args, setOpDiff, true)
+	case "SINTERCARD":
+		return c.handleSInterCard(cmd.Args)
+	case "SSCAN":
+		return c.handleSScan(cmd.Args)
+	case "ZADD":
+		return c.handleZAdd(cmd.Args, false)
+	case "ZINCRBY":
+		return c.handleZAdd(cmd.Args, true)
+	case "ZREM":
+		return c.handleZRem(cmd.Args)
+	case "ZSCORE":
+		return c.handleZScore(cmd.Args, false)
+	case "ZMSCORE":
+		return c.handleZScore(cmd.Args, true)
+	case "ZCARD":
+		return c.handleZCard(cmd.Args)
+	case "ZCOUNT":
+		return c.handleZCount(cmd.Args, false)
+	case "ZLEXCOUNT":
+		return c.handleZCount(cmd.Args, true)
+	case "ZRANK":
+		return c.handleZRank(cmd.Args, false)
+	case "ZREVRANK":
+		return c.handleZRank(cmd.Args, true)
+	case "ZRANGE":
+		return c.handleZRange(cmd.Args)
+	case "ZRANGESTORE":
+		return c.handleZRangeStore(cmd.Args)
+	case "ZPOPMIN":
+		return c.handleZPop(cmd.Args, false)
+	case "ZPOPMAX":
+		return c.handleZPop(cmd.Args, true)
+	case "BZPOPMIN":
+		return c.handleBZPop(cmd.Args, false)
+	case "BZPOPMAX":
+		return c.handleBZPop(cmd.Args, true)
+	case "ZUNION":
+		return c.handleZSetAlgebra(cmd.Args, setOpUnion, false)
+	case "ZINTER":
+		return c.handleZSetAlgebra(cmd.Args, setOpInter, false)
+	case "ZDIFF":
+		return c.handleZSetAlgebra(cmd.Args, setOpDiff, false)
+	case "ZUNIONSTORE":
+		return c.handleZSetAlgebra(cmd.Args, setOpUnion, true)
+	case "ZINTERSTORE":
+		return c.handleZSetAlgebra(cmd.Args, setOpInter, true)
+	case "ZDIFFSTORE":
+		return c.handleZSetAlgebra(cmd.Args, setOpDiff, true)
+	case "ZSCAN":
+		return c.handleZScan(cmd.Args)
+	case "XADD":
+		return c.handleXAdd(cmd.Args)
+	case "XRANGE":
+		return c.handleXRange(cmd.Args, false)
+	case "XREVRANGE":
+		return c.handleXRange(cmd.Args, true)
+	case "XLEN":
+		return c.handleXLen(cmd.Args)
+	case "XDEL":
+		return c.handleXDel(cmd.Args)
+	case "XTRIM":
+		return c.handleXTrim(cmd.Args)
+	case "XREAD":
+		return c.handleXRead(cmd.Args)
+	case "XGROUP":
+		return c.handleXGroup(cmd.Args)
+	case "XREADGROUP":
+		return c.handleXReadGroup(cmd.Args)
+	case "XACK":
+		return c.handleXAck(cmd.Args)
+	case "XPENDING":
+		return c.handleXPending(cmd.Args)
+	case "XCLAIM":
+		return c.handleXClaim(cmd.Args)
+	case "XAUTOCLAIM":
+		return c.handleXAutoClaim(cmd.Args)
+	case "XINFO":
+		return c.handleXInfo(cmd.Args)
+	case "SETBIT":
+		return c.handleSetBit(cmd.Args)
+	case "GETBIT":
+		return c.handleGetBit(cmd.Args)
+	case "BITCOUNT":
+		return c.handleBitCount(cmd.Args)
+	case "BITPOS":
+		return c.handleBitPos(cmd.Args)
+	case "BITOP":
+		return c.handleBitOp(cmd.Args)
+	case "BITFIELD":
+		return c.handleBitField(cmd.Args, false)
+	case "BITFIELD_RO":
+		return c.handleBitField(cmd.Args, true)
+	case "PFADD":
+		return c.handlePFAdd(cmd.Args)
+	case "PFCOUNT":
+		return c.handlePFCount(cmd.Args)
+	case "PFMERGE":
+		return c.handlePFMerge(cmd.Args)
+	case "PFDEBUG":
+		return c.handlePFDebug(cmd.Args)
+	case "GEOADD":
+		return c.handleGeoAdd(cmd.Args)
+	case "GEOPOS":
+		return c.handleGeoPos(cmd.Args)
+	case "GEODIST":
+		return c.handleGeoDist(cmd.Args)
+	case "GEOHASH":
+		return c.handleGeoHash(cmd.Args)
+	case "GEOSEARCH":
+		return c.handleGeoSearch(cmd.Args, false)
+	case "GEOSEARCHSTORE":
+		return c.handleGeoSearch(cmd.Args, true)
+	case "JSON.SET":
+		return c.handleJSONSet(cmd.Args)
+	case "JSON.GET":
+		return c.handleJSONGet(cmd.Args)
+	case "JSON.MGET":
+		return c.handleJSONMGet(cmd.Args)
+	case "JSON.DEL", "JSON.FORGET":
+		return c.handleJSONDel(cmd.Args)
+	case "JSON.TYPE":
+		return c.handleJSONType(cmd.Args)
+	case "JSON.NUMINCRBY":
+		return c.handleJSONNumIncrBy(cmd.Args)
+	case "JSON.STRAPPEND":
+		return c.handleJSONStrAppend(cmd.Args)
+	case "JSON.ARRAPPEND":
+		return c.handleJSONArrAppend(cmd.Args)
+	case "JSON.ARRINSERT":
+		return c.handleJSONArrInsert(cmd.Args)
+	case "JSON.ARRPOP":
+		return c.handleJSONArrPop(cmd.Args)
+	case "JSON.ARRLEN":
+		return c.handleJSONArrLen(cmd.Args)
+	case "JSON.OBJKEYS":
+		return c.handleJSONObjKeys(cmd.Args)
+	case "BF.RESERVE":
+		return c.handleBFReserve(cmd.Args)
+	case "BF.ADD":
+		return c.handleBFAdd(cmd.Args)
+	case "BF.MADD":
+		return c.handleBFMAdd(cmd.Args)
+	case "BF.INSERT":
+		return c.handleBFInsert(cmd.Args)
+	case "BF.EXISTS":
+		return c.handleBFExists(cmd.Args, false)
+	case "BF.MEXISTS":
+		return c.handleBFExists(cmd.Args, true)
+	case "BF.INFO":
+		return c.handleBFInfo(cmd.Args)
+	case "CF.RESERVE":
+		return c.handleCFReserve(cmd.Args)
+	case "CF.ADD":
+		return c.handleCFAdd(cmd.Args, false)
+	case "CF.ADDNX":
+		return c.handleCFAdd(cmd.Args, true)
+	case "CF.DEL":
+		return c.handleCFDel(cmd.Args)
+	case "CF.EXISTS":
+		return c.handleCFCount(cmd.Args, true)
+	case "CF.COUNT":
+		return c.handleCFCount(cmd.Args, false)
+	case "CMS.INITBYDIM":
+		return c.handleCMSInit(cmd.Args, false)
+	case "CMS.INITBYPROB":
+		return c.handleCMSInit(cmd.Args, true)
+	case "CMS.INCRBY":
+		return c.handleCMSIncrBy(cmd.Args)
+	case "CMS.QUERY":
+		return c.handleCMSQuery(cmd.Args)
+	case "CMS.MERGE":
+		return c.handleCMSMerge(cmd.Args)
+	case "TOPK.RESERVE":
+		return c.handleTopKReserve(cmd.Args)
+	case "TOPK.ADD":
+		return c.handleTopKAdd(cmd.Args)
+	case "TOPK.QUERY":
+		return c.handleTopKQuery(cmd.Args)
+	case "TOPK.LIST":
+		return c.handleTopKList(cmd.Args)
+	case "TDIGEST.CREATE":
+		return c.handleTDigestCreate(cmd.Args)
+	case "TDIGEST.ADD":
+		return c.handleTDigestAdd(cmd.Args)
+	case "TDIGEST.QUANTILE":
+		return c.handleTDigestEstimate(cmd.Args, false)
+	case "TDIGEST.CDF":
+		return c.handleTDigestEstimate(cmd.Args, true)
+	case "TDIGEST.MIN":
+		return c.handleTDigestMinMax(cmd.Args, false)
+	case "TDIGEST.MAX":
+		return c.handleTDigestMinMax(cmd.Args, true)
+	case "TDIGEST.MERGE":
+		return c.handleTDigestMerge(cmd.Args)
+	case "TS.CREATE":
+		return c.handleTSCreate(cmd.Args)
+	case "TS.ADD":
+		return c.handleTSAdd(cmd.Args)
+	case "TS.MADD":
+		return c.handleTSMAdd(cmd.Args)
+	case "TS.INCRBY":
+		return c.handleTSIncrBy(cmd.Args, false)
+	case "TS.DECRBY":
+		return c.handleTSIncrBy(cmd.Args, true)
+	case "TS.RANGE":
+		return c.handleTSRange(cmd.Args, false)
+	case "TS.REVRANGE":
+		return c.handleTSRange(cmd.Args, true)
+	case "TS.MRANGE":
+		return c.handleTSMRange(cmd.Args, false)
+	case "TS.MREVRANGE":
+		return c.handleTSMRange(cmd.Args, true)
+	case "TS.CREATERULE":
+		return c.handleTSCreateRule(cmd.Args)
+	case "TS.DELETERULE":
+		return c.handleTSDeleteRule(cmd.Args)
+	case "FT.CREATE":
+		return c.handleFTCreate(cmd.Args)
+	case "FT.DROPINDEX":
+		return c.handleFTDropIndex(cmd.Args)
+	case "FT._LIST":
+		return c.handleFTList(cmd.Args)
+	case "FT.INFO":
+		return c.handleFTInfo(cmd.Args)
+	case "FT.SEARCH":
+		return c.handleFTSearch(cmd.Args)
+	case "FT.AGGREGATE":
+		return c.handleFTAggregate(cmd.Args)
+	case "DEL", "UNLINK":
+		return c.handleDel(cmd.Args)
+	case "EXISTS", "TOUCH":
+		return c.handleExists(cmd.Args)
+	case "TYPE":
+		return c.handleType(cmd.Args)
+	case "RENAME":
+		return c.handleRename(cmd.Args, false)
+	case "RENAMENX":
+		return c.handleRename(cmd.Args, true)
+	case "COPY":
+		return c.handleCopy(cmd.Args)
+	case "RANDOMKEY":
+		return c.handleRandomKey(cmd.Args)
+	case "DBSIZE":
+		return c.handleDBSize(cmd.Args)
+	case "FLUSHDB", "FLUSHALL":
+		return c.handleFlush(cmd.Args)
+	case "MULTI":
+		return c.handleMulti(cmd.Args)
+	case "EXEC":
+		return c.handleExec(cmd.Args)
+	case "DISCARD":
+		return c.handleDiscard(cmd.Args)
+	case "WATCH":
+		return c.handleWatch(cmd.Args)
+	case "UNWATCH":
+		return c.handleUnwatch(cmd.Args)
+	case "EVAL":
+		return c.handleEval(cmd.Args, false, false)
+	case "EVALSHA":
+		return c.handleEval(cmd.Args, true, false)
+	case "EVAL_RO":
+		return c.handleEval(cmd.Args, false, true)
+	case "EVALSHA_RO":
+		return c.handleEval(cmd.Args, true, true)
+	case "SCRIPT":
+		return c.handleScript(cmd.Args)
+	case "FCALL":
+		return c.handleFcall(cmd.Args, false)
+	case "FCALL_RO":
+		return c.handleFcall(cmd.Args, true)
+	case "FUNCTION":
+		return c.handleFunction(cmd.Args)
+	case "SUBSCRIBE":
+		return c.handleSubscribe(cmd.Args, channelSubscription)
+	case "PSUBSCRIBE":
+		return c.handleSubscribe(cmd.Args, patternSubscription)
+	case "SSUBSCRIBE":
+		return c.handleSubscribe(cmd.Args, shardSubscription)
+	case "UNSUBSCRIBE":
+		return c.handleUnsubscribe(cmd.Args, channelSubscription)
+	case "PUNSUBSCRIBE":
+		return c.handleUnsubscribe(cmd.Args, patternSubscription)
+	case "SUNSUBSCRIBE":
+		return c.handleUnsubscribe(cmd.Args, shardSubscription)
+	case "PUBLISH":
+		return c.handlePublish(cmd.Args)
+	case "SPUBLISH":
+		return c.handleSPublish(cmd.Args)
+	case "PUBSUB":
+		return c.handlePubSub(cmd.Args)
+	case "HELLO":
+		return c.handleHello(cmd.Args)
+	case "CLIENT":
+		return c.handleClient(cmd.Args)
   case "REPLCONF":
 
     return c.send(okResponse)
   case "PSYNC":
+    c.replica = true
     c.send(encodeBulkString("FULLRESYNC 8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb 0"))
-    return c.send(fmt.Sprintf("$%d\r\n%s", len(emptyRDB), emptyRDB))
+    if err := c.send(fmt.Sprintf("$%d\r\n%s", len(emptyRDB), emptyRDB)); err != nil {
+      return err
+    }
+    if nc, ok := c.Conn.(net.Conn); ok {
+      c.Server.AddReplica(nc)
+    }
+    return nil
 	default:
 		return fmt.Errorf("unrecognized command %q", cmd.Command)
 	}
@@ -173,19 +673,30 @@ func (c *ClientHandler) handleSet(args []string) error {
 	key := args[0]
 	value := args[1]
 	fmt.Printf("SET %s: %q command received.", key, value)
-	if err := c.Store.Add(key, value); err != nil {
-		return err
-	}
 
-	// Check for expiration arguments.
-	if len(args) == 4 && args[2] == "px" {
-		expiry, err := strconv.Atoi(args[3])
+	// Check for expiration arguments. Replicas are given the expiration
+	// time as PXAT, so that it doesn't depend on when they receive it.
+	var expiration time.Time
+	if len(args) == 4 && (strings.EqualFold(args[2], "px") || strings.EqualFold(args[2], "pxat")) {
+		expiry, err := strconv.ParseInt(args[3], 10, 64)
 		if err != nil {
 			return fmt.Errorf("error parsing expiration time: %v", err)
 		}
-		duration := time.Duration(expiry) * time.Millisecond
-		c.Store.expiry[key] = time.Now().UTC().Add(duration)
+		if strings.EqualFold(args[2], "pxat") {
+			expiration = time.UnixMilli(expiry).UTC()
+		} else {
+			expiration = time.Now().UTC().Add(time.Duration(expiry) * time.Millisecond)
+		}
+		c.replicateEffects(Command{"SET", []string{key, value, "PXAT", strconv.FormatInt(expiration.UnixMilli(), 10)}})
+	}
+
+	// SET replaces any value of any type, along with its expiration time.
+	c.Store.setKey(key, value, expiration)
+	c.Store.notify(notifyString, "set", key)
+	if !expiration.IsZero() {
+		c.Store.notify(notifyGeneric, "expire", key)
 	}
+	c.Store.touch(key)
 	return c.send(okResponse)
 }
 
@@ -196,23 +707,15 @@ func (c *ClientHandler) handleGet(args []string) error {
 	}
 	key := args[0]
 	fmt.Printf("GET %s command received.", key)
-	val, err := c.Store.Get(key)
-	if err != nil {
-		fmt.Errorf(err.Error())
+	if _, found := c.Store.lookup(key); !found {
 		return c.send(nullResponse)
 	}
-
-	// Check if KV pair is expired. If so, delete and return null.
-	expiry, hasExpiration := c.Store.expiry[key]
-	if hasExpiration && expiry.Before(time.Now().UTC()) {
-		if err := c.Store.Delete(key); err != nil {
-			fmt.Errorf(err.Error())
-		}
-		delete(c.Store.expiry, key) // remove expiry record
-		return c.send(nullResponse)
+	val, err := c.Store.Get(key)
+	if err != nil {
+		return err
 	}
 
-	return c.send(encodeSimpleString(val))
+	return c.send(encodeBulkString(val))
 }
 
 // handleConfig handles CONFIG requests.
@@ -244,37 +747,53 @@ func (c *ClientHandler) handleConfig(args []string) error {
 		val := args[2]
 		fmt.Printf("CONFIG SET %s: %q command received.", key, val)
 
-		if err := c.Server.Config.Add(key, val); err != nil {
-			return err
+		if key == keyNotifyKeyspaceEvents {
+			if _, err := parseKeyspaceEvents(val); err != nil {
+				return err
+			}
+		}
+
+		if key == keyLuaTimeLimit {
+			if _, err := strconv.Atoi(val); err != nil {
+				return fmt.Errorf("invalid value for %s: %q", key, val)
+			}
+		}
+
+		if key == keyTrackingTableMaxKeys {
+			if n, err := strconv.Atoi(val); err != nil || n < 0 {
+				return fmt.Errorf("invalid value for %s: %q", key, val)
+			}
 		}
 
+		c.Server.Config.Set(key, val)
+		if key == keyTrackingTableMaxKeys {
+			c.Server.tracking.evict("")
+		}
 		return c.send(okResponse)
 	}
 
 	return nil
 }
 
-// handleKeys handles KEY commands.
+// handleKeys handles KEYS commands. Keys are returned in no particular
+// order.
 func (c *ClientHandler) handleKeys(args []string) error {
-	var key, result string
-	if len(args) > 0 {
-		key = args[0]
-		val, err := c.Store.Get(key)
-		if err != nil {
-			return err
+	if len(args) != 1 {
+		return fmt.Errorf("wrong number of arguments for KEYS")
+	}
+	pattern := args[0]
+	fmt.Printf("KEYS %s command received.", pattern)
+
+	keys := []string{}
+	for key := range c.Store.kv {
+		if !stringMatch(pattern, key, false) {
+			continue
 		}
-		result = encodeBulkStringArray(1, val)
-	} else {
-		key = "*"
-		val, err := c.Store.Get(key)
-		if err != nil {
-			return err
+		if _, found := c.Store.lookup(key); found {
+			keys = append(keys, key)
 		}
-		result = val // "*" key will return an already-encoded array
 	}
-	fmt.Printf("KEYS %s command received.", key)
-
-	return c.send(result)
+	return c.send(encodeBulkStringArray(len(keys), keys...))
 }
 
 // handleInfo handles INFO commands.
@@ -288,34 +807,61 @@ func (c *ClientHandler) handleInfo(_ []string) error {
   return c.send(encodeBulkString(info + "\nmaster_replid:8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb\nmaster_repl_offset:0"))
 }
 
-// send sends the message to the client.
-func (c *ClientHandler) send(msg string) error {
-	_, err := c.Conn.Write([]byte(msg))
+// handleSave handles SAVE commands.
+func (c *ClientHandler) handleSave() error {
+	path, err := c.Server.dbPath()
 	if err != nil {
-		return fmt.Errorf("error sending message: %v", err)
+		return err
 	}
-	return nil
+	fmt.Printf("SAVE command received.")
+	if err := c.Store.Save(path); err != nil {
+		return err
+	}
+	return c.send(okResponse)
 }
 
-// dbFile returns a pointer to the database file, if there is one configured.
-func (c *ClientHandler) dbFile() (*os.File, error) {
-	dir, err := c.Server.Config.Get(keyDBDir)
-	if err != nil {
-		return nil, fmt.Errorf("no database path provided: %v", err)
+// handleShutdown handles SHUTDOWN [NOSAVE|SAVE] commands. The database is
+// saved first if SAVE is given, or if a database file is configured and
+// NOSAVE isn't. On success the process ends and no reply is sent.
+func (c *ClientHandler) handleShutdown(args []string) error {
+	save := c.Server.IsPersistent()
+	for _, arg := range args {
+		switch strings.ToUpper(arg) {
+		case "NOSAVE":
+			save = false
+		case "SAVE":
+			save = true
+		default:
+			return errSyntax
+		}
 	}
-	filename, err := c.Server.Config.Get(keyDBFilename)
-	if err != nil {
-		return nil, fmt.Errorf("no database filename provided: %v", err)
+	fmt.Printf("SHUTDOWN command received.")
+	if save {
+		path, err := c.Server.dbPath()
+		if err == nil {
+			err = c.Store.Save(path)
+		}
+		if err != nil {
+			fmt.Printf("Error saving the database before shutdown: %v", err)
+			return fmt.Errorf("Errors trying to SHUTDOWN. Check logs.")
+		}
 	}
+	c.Server.shutdown()
+	return nil
+}
 
-	path := filepath.Join(dir, filename)
-	if _, err := os.Stat(path); err != nil {
-		return nil, fmt.Errorf("database file not found: %v", err)
+// send sends the message to the client.
+func (c *ClientHandler) send(msg string) error {
+	if c.replyOff || c.skipReply {
+		return nil
 	}
-
-	file, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if c.sub != nil {
+		c.sub.push(msg)
+		return nil
+	}
+	_, err := c.Conn.Write([]byte(msg))
 	if err != nil {
-		return nil, fmt.Errorf("unable to open file: %v", err)
+		return fmt.Errorf("error sending message: %v", err)
 	}
-	return file, nil
+	return nil
 }
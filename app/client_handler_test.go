@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testConn is a connection that keeps what is written to it. Subscribers
+// write from a goroutine of their own, so it is safe for concurrent use.
+type testConn struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (*testConn) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (c *testConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.Write(p)
+}
+
+func (*testConn) Close() error {
+	return nil
+}
+
+// take returns what was written so far and forgets it.
+func (c *testConn) take() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	written := c.buf.String()
+	c.buf.Reset()
+	return written
+}
+
+// testClient is a client of a test server whose replies are kept in a
+// buffer rather than sent anywhere.
+type testClient struct {
+	*ClientHandler
+	conn *testConn
+}
+
+// newTestServer returns a server that isn't listening, whose SHUTDOWN
+// records the exit code in exited instead of ending the test binary.
+func newTestServer(exited *int) *Server {
+	s := NewServer(context.Background(), NewStore())
+	s.exit = func(code int) {
+		if exited != nil {
+			*exited = code
+		}
+	}
+	return s
+}
+
+// newTestClient connects a new client to s.
+func newTestClient(s *Server) *testClient {
+	conn := &testConn{}
+	c := NewClientHandler(s.Context, conn, s)
+	s.addClient(c)
+	return &testClient{c, conn}
+}
+
+// do runs a command the way Handle does once the store is free, and
+// returns what was sent to the client since the last read.
+func (c *testClient) do(args ...string) string {
+	cmd := Command{Command: args[0], Args: args[1:]}
+	c.Store.mu.Lock()
+	c.lastCmd = commandName(cmd)
+	c.skipReply, c.skipNext = c.skipNext, false
+	err := c.process(cmd)
+	c.Server.flushPropagated()
+	c.Store.cond.Broadcast()
+	c.Store.mu.Unlock()
+	if err != nil {
+		c.send(encodeError(err))
+	}
+	c.skipReply = false
+	return c.read()
+}
+
+// read returns what was sent to the client since the last read. Once a
+// client has a subscriber, everything it is sent is written by another
+// goroutine, so a marker is queued behind it and waited for.
+func (c *testClient) read() string {
+	const marker = "\x00marker\x00"
+	if c.sub == nil || !c.sub.push(marker) {
+		return c.conn.take()
+	}
+	var written string
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		if written += c.conn.take(); strings.HasSuffix(written, marker) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return strings.TrimSuffix(written, marker)
+}
+
+// close disconnects c the way Handle does when the connection drops.
+func (c *testClient) close() {
+	c.cancel()
+	c.release()
+}
+
+func TestShutdown(t *testing.T) {
+	tests := []struct {
+		name       string
+		persistent bool
+		args       []string
+		wantReply  string
+		wantExit   bool
+		wantSaved  bool
+	}{
+		{"no database file", false, nil, "", true, false},
+		{"saves by default", true, nil, "", true, true},
+		{"NOSAVE", true, []string{"NOSAVE"}, "", true, false},
+		{"SAVE", true, []string{"save"}, "", true, true},
+		{"SAVE without a database file", false, []string{"SAVE"}, "-ERR Errors trying to SHUTDOWN. Check logs.\r\n", false, false},
+		{"unknown option", true, []string{"NOW"}, "-ERR syntax error\r\n", false, false},
+	}
+	for _, tt := range tests {
+		exited := -1
+		s := newTestServer(&exited)
+		path := filepath.Join(t.TempDir(), "dump.rdb")
+		if tt.persistent {
+			s.Config.Add(keyDBDir, filepath.Dir(path))
+			s.Config.Add(keyDBFilename, filepath.Base(path))
+		}
+		s.Store.setStringValue("k", "v")
+		c := newTestClient(s)
+
+		if got := c.do(append([]string{"SHUTDOWN"}, tt.args...)...); got != tt.wantReply {
+			t.Errorf("%s: reply = %q, want %q", tt.name, got, tt.wantReply)
+		}
+		if (exited == 0) != tt.wantExit {
+			t.Errorf("%s: exited = %v, want %v", tt.name, exited == 0, tt.wantExit)
+		}
+		if _, err := os.Stat(path); (err == nil) != tt.wantSaved {
+			t.Errorf("%s: saved = %v, want %v", tt.name, err == nil, tt.wantSaved)
+		}
+	}
+}
+
+func TestShutdownWhileBusy(t *testing.T) {
+	exited := -1
+	s := newTestServer(&exited)
+	c := newTestClient(s)
+	s.scripts.running = &scriptRun{wrote: true, busy: make(chan struct{})}
+
+	c.handleBusy(Command{Command: "SCRIPT", Args: []string{"KILL"}})
+	if got := c.read(); !strings.HasPrefix(got, "-UNKILLABLE") {
+		t.Errorf("SCRIPT KILL = %q, want UNKILLABLE", got)
+	}
+	c.handleBusy(Command{Command: "SHUTDOWN"})
+	if got := c.read(); !strings.HasPrefix(got, "-BUSY") || exited != -1 {
+		t.Errorf("SHUTDOWN = %q, exited = %d, want BUSY", got, exited)
+	}
+	c.handleBusy(Command{Command: "shutdown", Args: []string{"nosave"}})
+	if exited != 0 {
+		t.Errorf("SHUTDOWN NOSAVE didn't end the process while a script was busy")
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clientFields parses the line describing one client in CLIENT LIST and
+// CLIENT INFO replies.
+func clientFields(line string) map[string]string {
+	fields := make(map[string]string)
+	for _, field := range strings.Fields(line) {
+		name, val, _ := strings.Cut(field, "=")
+		fields[name] = val
+	}
+	return fields
+}
+
+// clientLines returns the lines of a CLIENT LIST or CLIENT INFO reply.
+func clientLines(reply string) []string {
+	_, body, _ := strings.Cut(reply, "\r\n")
+	body = strings.TrimSuffix(strings.TrimSuffix(body, "\r\n"), "\n")
+	if body == "" {
+		return nil
+	}
+	return strings.Split(body, "\n")
+}
+
+func TestClientKill(t *testing.T) {
+	tests := []struct {
+		args       []string
+		want       string
+		wantKilled []int // indexes of the killed clients, 0 being the caller
+	}{
+		{[]string{"ID", "2"}, ":1\r\n", []int{1}},
+		{[]string{"ADDR", "10.0.0.2:2000"}, ":1\r\n", []int{1}},
+		{[]string{"LADDR", "127.0.0.1:6379"}, ":1\r\n", []int{1}},
+		{[]string{"LADDR", "127.0.0.1:6379", "SKIPME", "no"}, ":2\r\n", []int{0, 1}},
+		{[]string{"TYPE", "pubsub"}, ":1\r\n", []int{2}},
+		{[]string{"TYPE", "normal"}, ":1\r\n", []int{1}},
+		{[]string{"TYPE", "slave"}, ":0\r\n", nil},
+		{[]string{"USER", "default"}, ":2\r\n", []int{1, 2}},
+		{[]string{"USER", "alice"}, ":0\r\n", nil},
+		{[]string{"MAXAGE", "100"}, ":1\r\n", []int{1}},
+		{[]string{"ID", "2", "TYPE", "pubsub"}, ":0\r\n", nil},
+		{[]string{"ID", "1"}, ":0\r\n", nil},
+		{[]string{"ID", "1", "SKIPME", "NO"}, ":1\r\n", []int{0}},
+		{[]string{"10.0.0.3:3000"}, "+OK\r\n", []int{2}},
+		{[]string{"10.0.0.1:1000"}, "+OK\r\n", []int{0}},
+		{[]string{"10.9.9.9:9"}, "-ERR No such client\r\n", nil},
+		{[]string{"ID", "0"}, "-ERR client-id should be greater than 0\r\n", nil},
+		{[]string{"ID", "2", "ADDR"}, "-ERR syntax error\r\n", nil},
+		{[]string{"TYPE", "bogus"}, "-ERR Unknown client type 'bogus'\r\n", nil},
+		{[]string{"SKIPME", "maybe"}, "-ERR syntax error\r\n", nil},
+		{[]string{"MAXAGE", "old"}, "-ERR value is not an integer or out of range\r\n", nil},
+		{[]string{"COLOR", "red"}, "-ERR syntax error\r\n", nil},
+	}
+	for _, tt := range tests {
+		s := newTestServer(nil)
+		var clients []*testClient
+		for i, laddr := range []string{"127.0.0.1:6379", "127.0.0.1:6379", "127.0.0.1:6380"} {
+			c := newTestClient(s)
+			c.addr, c.laddr = "10.0.0."+strconv.Itoa(i+1)+":"+strconv.Itoa(1000*(i+1)), laddr
+			clients = append(clients, c)
+		}
+		clients[1].created = clients[1].created.Add(-200 * time.Second)
+		clients[2].do("SUBSCRIBE", "news")
+		t.Cleanup(clients[2].close)
+
+		if got := clients[0].do(append([]string{"CLIENT", "KILL"}, tt.args...)...); got != tt.want {
+			t.Errorf("CLIENT KILL %v = %q, want %q", tt.args, got, tt.want)
+		}
+		var killed []int
+		for i, c := range clients {
+			if s.client(c.id) == nil {
+				killed = append(killed, i)
+				if c.Context.Err() == nil && !c.closing {
+					t.Errorf("CLIENT KILL %v: client %d was dropped but is still running", tt.args, i)
+				}
+			}
+		}
+		if !slices.Equal(killed, tt.wantKilled) {
+			t.Errorf("CLIENT KILL %v killed %v, want %v", tt.args, killed, tt.wantKilled)
+		}
+	}
+}
+
+func TestClientList(t *testing.T) {
+	s := newTestServer(nil)
+	a, b, sub, tracker := newTestClient(s), newTestClient(s), newTestClient(s), newTestClient(s)
+	t.Cleanup(sub.close)
+	a.addr, a.laddr = "10.0.0.1:5000", "127.0.0.1:6379"
+	a.created = a.created.Add(-5 * time.Second)
+
+	a.do("CLIENT", "SETNAME", "worker")
+	a.do("CLIENT", "SETINFO", "LIB-NAME", "go-redis")
+	a.do("CLIENT", "SETINFO", "lib-ver", "9.0")
+	a.do("WATCH", "k", "l")
+	a.do("MULTI")
+	a.do("GET", "k")
+	sub.do("SUBSCRIBE", "a", "b")
+	sub.do("PSUBSCRIBE", "p*")
+	tracker.do("CLIENT", "TRACKING", "ON", "BCAST")
+	tracker.do("CLIENT", "NO-EVICT", "ON")
+
+	list := b.do("CLIENT", "LIST")
+	lines := clientLines(list)
+	if len(lines) != 4 {
+		t.Fatalf("CLIENT LIST = %q, want 4 clients", list)
+	}
+	tests := []struct {
+		client *testClient
+		want   map[string]string
+	}{
+		{a, map[string]string{
+			"id": "1", "addr": "10.0.0.1:5000", "laddr": "127.0.0.1:6379", "name": "worker",
+			"age": "5", "flags": "x", "db": "0", "sub": "0", "psub": "0", "multi": "1",
+			"watch": "2", "cmd": "get", "user": "default", "redir": "-1", "resp": "2",
+			"lib-name": "go-redis", "lib-ver": "9.0",
+		}},
+		{b, map[string]string{"id": "2", "name": "", "flags": "N", "multi": "-1", "watch": "0", "cmd": "client|list"}},
+		{sub, map[string]string{"id": "3", "flags": "P", "sub": "2", "psub": "1", "cmd": "psubscribe"}},
+		{tracker, map[string]string{"id": "4", "flags": "tBe", "redir": "0", "cmd": "client|no-evict"}},
+	}
+	for i, tt := range tests {
+		got := clientFields(lines[i])
+		for name, want := range tt.want {
+			if got[name] != want {
+				t.Errorf("client %d: %s=%q, want %q", i+1, name, got[name], want)
+			}
+		}
+	}
+
+	filtered := []struct {
+		args    []string
+		wantIDs []string
+	}{
+		{[]string{"TYPE", "pubsub"}, []string{"3"}},
+		{[]string{"TYPE", "normal"}, []string{"1", "2", "4"}},
+		{[]string{"TYPE", "replica"}, nil},
+		{[]string{"ID", "4", "1", "99"}, []string{"1", "4"}},
+	}
+	for _, tt := range filtered {
+		var ids []string
+		for _, line := range clientLines(b.do(append([]string{"CLIENT", "LIST"}, tt.args...)...)) {
+			ids = append(ids, clientFields(line)["id"])
+		}
+		if !slices.Equal(ids, tt.wantIDs) {
+			t.Errorf("CLIENT LIST %v = %v, want %v", tt.args, ids, tt.wantIDs)
+		}
+	}
+
+	info := clientLines(b.do("CLIENT", "INFO"))
+	if fields := clientFields(info[0]); len(info) != 1 || fields["id"] != "2" || fields["cmd"] != "client|info" {
+		t.Errorf("CLIENT INFO = %q", info)
+	}
+
+	errors := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"CLIENT", "LIST", "TYPE", "bogus"}, "-ERR Unknown client type 'bogus'\r\n"},
+		{[]string{"CLIENT", "LIST", "ID", "x"}, "-ERR Invalid client ID\r\n"},
+		{[]string{"CLIENT", "LIST", "NAME"}, "-ERR syntax error\r\n"},
+		{[]string{"CLIENT", "SETNAME", "has space"}, "-ERR Client names cannot contain spaces, newlines or special characters.\r\n"},
+		{[]string{"CLIENT", "SETINFO", "LIB-COLOR", "red"}, "-ERR Unrecognized option 'LIB-COLOR'\r\n"},
+	}
+	for _, tt := range errors {
+		if got := b.do(tt.args...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestClientPause(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		replica bool
+		queued  [][]string // commands queued in MULTI before cmd, if any
+		cmd     []string
+		want    bool
+	}{
+		{"read during ALL", "ALL", false, nil, []string{"GET", "k"}, true},
+		{"read during WRITE", "WRITE", false, nil, []string{"GET", "k"}, false},
+		{"write during WRITE", "WRITE", false, nil, []string{"SET", "k", "v"}, true},
+		{"may replicate during WRITE", "WRITE", false, nil, []string{"PUBLISH", "c", "m"}, true},
+		{"replica during ALL", "ALL", true, nil, []string{"SET", "k", "v"}, false},
+		{"UNPAUSE during ALL", "ALL", false, nil, []string{"client", "unpause"}, false},
+		{"queueing a write", "WRITE", false, [][]string{}, []string{"SET", "k", "v"}, false},
+		{"EXEC of reads", "WRITE", false, [][]string{{"GET", "k"}}, []string{"EXEC"}, false},
+		{"EXEC with a write", "WRITE", false, [][]string{{"GET", "k"}, {"DEL", "k"}}, []string{"EXEC"}, true},
+		{"EXEC during ALL", "ALL", false, [][]string{{"GET", "k"}}, []string{"EXEC"}, true},
+	}
+	for _, tt := range tests {
+		s := newTestServer(nil)
+		c := newTestClient(s)
+		if tt.queued != nil {
+			c.do("MULTI")
+			for _, args := range tt.queued {
+				c.do(args...)
+			}
+		}
+		c.replica = tt.replica
+		s.Store.pause = clientPause{time.Now().Add(time.Minute), tt.mode == "ALL"}
+		cmd := Command{Command: tt.cmd[0], Args: tt.cmd[1:]}
+		if got := c.paused(cmd); got != tt.want {
+			t.Errorf("%s: paused = %v, want %v", tt.name, got, tt.want)
+		}
+		s.Store.pause.until = time.Now().Add(-time.Millisecond)
+		if c.paused(cmd) {
+			t.Errorf("%s: paused once the deadline passed", tt.name)
+		}
+	}
+}
+
+func TestClientPauseUpdates(t *testing.T) {
+	s := newTestServer(nil)
+	c := newTestClient(s)
+	set := Command{Command: "SET", Args: []string{"k", "v"}}
+	get := Command{Command: "GET", Args: []string{"k"}}
+
+	c.do("CLIENT", "PAUSE", "60000", "WRITE")
+	until := s.Store.pause.until
+	if !c.paused(set) || c.paused(get) {
+		t.Errorf("WRITE pause: SET paused = %v, GET paused = %v", c.paused(set), c.paused(get))
+	}
+	// A shorter pause neither shortens nor relaxes the one in effect, and
+	// ALL makes it stricter.
+	c.do("CLIENT", "PAUSE", "10", "ALL")
+	if !s.Store.pause.until.Equal(until) || !c.paused(get) {
+		t.Errorf("after PAUSE 10 ALL: until moved by %v, GET paused = %v", s.Store.pause.until.Sub(until), c.paused(get))
+	}
+	c.do("CLIENT", "PAUSE", "10", "WRITE")
+	if !c.paused(get) {
+		t.Errorf("PAUSE WRITE relaxed an ALL pause")
+	}
+
+	// A client waiting on the pause resumes once another one unpauses.
+	done := make(chan bool)
+	go func() {
+		s.Store.mu.Lock()
+		defer s.Store.mu.Unlock()
+		done <- c.waitUnpaused(set)
+	}()
+	other := newTestClient(s)
+	if got := other.do("CLIENT", "UNPAUSE"); got != "+OK\r\n" {
+		t.Errorf("CLIENT UNPAUSE = %q", got)
+	}
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Errorf("waitUnpaused = false after UNPAUSE")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the paused client didn't resume after UNPAUSE")
+	}
+	if s.Store.pause.active() || c.paused(set) {
+		t.Errorf("still paused after UNPAUSE")
+	}
+
+	// An expired pause is replaced rather than extended.
+	s.Store.pause = clientPause{time.Now().Add(-time.Second), true}
+	c.do("CLIENT", "PAUSE", "60000", "WRITE")
+	if s.Store.pause.all {
+		t.Errorf("an expired ALL pause made a new WRITE pause stricter")
+	}
+
+	errors := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"CLIENT", "PAUSE", "-1"}, "-ERR timeout is not an integer or out of range\r\n"},
+		{[]string{"CLIENT", "PAUSE", "soon"}, "-ERR timeout is not an integer or out of range\r\n"},
+		{[]string{"CLIENT", "PAUSE", "10", "READ"}, "-ERR syntax error\r\n"},
+		{[]string{"CLIENT", "UNPAUSE", "now"}, "-ERR wrong number of arguments for CLIENT UNPAUSE\r\n"},
+	}
+	for _, tt := range errors {
+		if got := other.do(tt.args...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestClientReply(t *testing.T) {
+	c := newTestClient(newTestServer(nil))
+	steps := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"CLIENT", "REPLY", "OFF"}, ""},
+		{[]string{"SET", "k", "1"}, ""},
+		{[]string{"GET", "k"}, ""},
+		{[]string{"NOSUCHCOMMAND"}, ""}, // errors are dropped too
+		{[]string{"CLIENT", "REPLY", "ON"}, "+OK\r\n"},
+		{[]string{"GET", "k"}, "$1\r\n1\r\n"}, // commands still ran while off
+		{[]string{"CLIENT", "REPLY", "SKIP"}, ""},
+		{[]string{"SET", "k", "2"}, ""},
+		{[]string{"GET", "k"}, "$1\r\n2\r\n"},
+		{[]string{"CLIENT", "REPLY", "SKIP"}, ""},
+		{[]string{"CLIENT", "REPLY", "ON"}, ""}, // the skipped command
+		{[]string{"CLIENT", "REPLY", "SKIP"}, ""},
+		{[]string{"CLIENT", "REPLY", "OFF"}, ""},
+		{[]string{"GET", "k"}, ""}, // OFF outlasts the skip
+		{[]string{"CLIENT", "REPLY", "ON"}, "+OK\r\n"},
+		{[]string{"CLIENT", "REPLY", "MAYBE"}, "-ERR syntax error\r\n"},
+		{[]string{"CLIENT", "REPLY"}, "-ERR wrong number of arguments for CLIENT REPLY\r\n"},
+	}
+	for i, st := range steps {
+		if got := c.do(st.args...); got != st.want {
+			t.Errorf("step %d %v = %q, want %q", i, st.args, got, st.want)
+		}
+	}
+}
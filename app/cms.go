@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// CountMinSketch estimates item frequencies with depth rows of width
+// counters. An item's count is the minimum of its counter in each row, so
+// estimates can be too high but never too low.
+type CountMinSketch struct {
+	width, depth int
+	counts       []uint32
+	total        uint64
+}
+
+func NewCountMinSketch(width, depth int) *CountMinSketch {
+	return &CountMinSketch{width: width, depth: depth, counts: make([]uint32, width*depth)}
+}
+
+// cell returns the index of item's counter in row.
+func (s *CountMinSketch) cell(item string, row int) int {
+	return row*s.width + int(murmurHash64A([]byte(item), uint64(row))%uint64(s.width))
+}
+
+// Query returns the estimated count of item.
+func (s *CountMinSketch) Query(item string) uint32 {
+	count := uint32(math.MaxUint32)
+	for row := 0; row < s.depth; row++ {
+		count = min(count, s.counts[s.cell(item, row)])
+	}
+	return count
+}
+
+// IncrBy increments the count of item, failing without changes if a
+// counter would overflow.
+func (s *CountMinSketch) IncrBy(item string, incr uint32) (uint32, error) {
+	for row := 0; row < s.depth; row++ {
+		if s.counts[s.cell(item, row)] > math.MaxUint32-incr {
+			return 0, fmt.Errorf("CMS: INCRBY overflow")
+		}
+	}
+	for row := 0; row < s.depth; row++ {
+		s.counts[s.cell(item, row)] += incr
+	}
+	s.total += uint64(incr)
+	return s.Query(item), nil
+}
+
+// Count-min sketches are saved as module entries of this server's own type.
+const (
+	cmsModuleName   = "CountMinS"
+	cmsModuleEncver = 1
+)
+
+func (s *CountMinSketch) moduleType() (string, int) {
+	return cmsModuleName, cmsModuleEncver
+}
+
+func (s *CountMinSketch) saveModule(w *moduleWriter) {
+	w.saveUnsigned(uint64(s.width))
+	w.saveUnsigned(uint64(s.depth))
+	w.saveUnsigned(s.total)
+	buf := make([]byte, 4*len(s.counts))
+	for i, count := range s.counts {
+		binary.LittleEndian.PutUint32(buf[4*i:], count)
+	}
+	w.saveString(string(buf))
+}
+
+func loadCountMinSketch(r *moduleReader, encver int) (any, error) {
+	if encver != cmsModuleEncver {
+		return nil, fmt.Errorf("unsupported count-min sketch encoding version %d", encver)
+	}
+	width, err := r.loadUnsigned()
+	if err != nil {
+		return nil, err
+	}
+	depth, err := r.loadUnsigned()
+	if err != nil {
+		return nil, err
+	}
+	s := NewCountMinSketch(int(width), int(depth))
+	if s.total, err = r.loadUnsigned(); err != nil {
+		return nil, err
+	}
+	buf, err := r.loadString()
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) != 4*len(s.counts) {
+		return nil, fmt.Errorf("corrupt count-min sketch")
+	}
+	for i := range s.counts {
+		s.counts[i] = binary.LittleEndian.Uint32([]byte(buf[4*i:]))
+	}
+	return s, nil
+}
+
+func init() {
+	moduleLoaders[cmsModuleName] = loadCountMinSketch
+}
+
+var errCMSNoKey = fmt.Errorf("CMS: key does not exist")
+
+// cms returns the count-min sketch stored at key, or nil if there is none.
+func (s *Store) cms(key string) (*CountMinSketch, error) {
+	val, found := s.lookup(key)
+	if !found {
+		return nil, nil
+	}
+	sketch, ok := val.(*CountMinSketch)
+	if !ok {
+		return nil, errWrongType
+	}
+	return sketch, nil
+}
+
+// handleCMSInit handles CMS.INITBYDIM and, with byProb set, CMS.INITBYPROB
+// commands.
+func (c *ClientHandler) handleCMSInit(args []string, byProb bool) error {
+	if len(args) != 3 {
+		return fmt.Errorf("wrong number of arguments for CMS.INIT")
+	}
+	key := args[0]
+	var width, depth int
+	if byProb {
+		overEst, err := strconv.ParseFloat(args[1], 64)
+		if err != nil || overEst <= 0 || overEst >= 1 {
+			return fmt.Errorf("CMS: invalid overestimation value")
+		}
+		prob, err := strconv.ParseFloat(args[2], 64)
+		if err != nil || prob <= 0 || prob >= 1 {
+			return fmt.Errorf("CMS: invalid prob value")
+		}
+		width = int(math.Ceil(2 / overEst))
+		depth = int(math.Ceil(math.Log10(prob) / math.Log10(0.5)))
+	} else {
+		var err error
+		if width, err = strconv.Atoi(args[1]); err != nil || width < 1 {
+			return fmt.Errorf("CMS: invalid width")
+		}
+		if depth, err = strconv.Atoi(args[2]); err != nil || depth < 1 {
+			return fmt.Errorf("CMS: invalid depth")
+		}
+	}
+	if _, found := c.Store.lookup(key); found {
+		return fmt.Errorf("CMS: key already exists")
+	}
+	fmt.Printf("CMS.INIT %s command received.", key)
+
+	c.Store.create(key, NewCountMinSketch(width, depth))
+	if byProb {
+		c.Store.notify(notifyModule, "cms.initbyprob", key)
+	} else {
+		c.Store.notify(notifyModule, "cms.initbydim", key)
+	}
+	c.Store.touch(key)
+	return c.send(okResponse)
+}
+
+// handleCMSIncrBy handles CMS.INCRBY commands.
+func (c *ClientHandler) handleCMSIncrBy(args []string) error {
+	if len(args) < 3 || len(args)%2 == 0 {
+		return fmt.Errorf("wrong number of arguments for CMS.INCRBY")
+	}
+	key := args[0]
+	incrs := make([]uint32, 0, len(args)/2)
+	for i := 2; i < len(args); i += 2 {
+		incr, err := strconv.ParseUint(args[i], 10, 32)
+		if err != nil {
+			return fmt.Errorf("CMS: Cannot parse number")
+		}
+		incrs = append(incrs, uint32(incr))
+	}
+	sketch, err := c.Store.cms(key)
+	if err != nil {
+		return err
+	}
+	if sketch == nil {
+		return errCMSNoKey
+	}
+	fmt.Printf("CMS.INCRBY %s command received.", key)
+
+	changed := false
+	result := make([]string, 0, len(incrs))
+	for i, incr := range incrs {
+		count, err := sketch.IncrBy(args[1+2*i], incr)
+		if err != nil {
+			result = append(result, encodeError(err))
+			continue
+		}
+		changed = changed || incr > 0
+		result = append(result, encodeInteger(int(count)))
+	}
+	if changed {
+		c.Store.notify(notifyModule, "cms.incrby", key)
+		c.Store.touch(key)
+	}
+	return c.send(encodeArray(result...))
+}
+
+// handleCMSQuery handles CMS.QUERY commands.
+func (c *ClientHandler) handleCMSQuery(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("insufficient number of arguments for CMS.QUERY")
+	}
+	sketch, err := c.Store.cms(args[0])
+	if err != nil {
+		return err
+	}
+	if sketch == nil {
+		return errCMSNoKey
+	}
+	result := make([]string, 0, len(args)-1)
+	for _, item := range args[1:] {
+		result = append(result, encodeInteger(int(sketch.Query(item))))
+	}
+	return c.send(encodeArray(result...))
+}
+
+// handleCMSMerge handles CMS.MERGE commands.
+func (c *ClientHandler) handleCMSMerge(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("insufficient number of arguments for CMS.MERGE")
+	}
+	dst := args[0]
+	numKeys, err := strconv.Atoi(args[1])
+	if err != nil || numKeys < 1 || len(args) < 2+numKeys {
+		return fmt.Errorf("CMS: invalid numkeys")
+	}
+	keys := args[2 : 2+numKeys]
+	rest := args[2+numKeys:]
+	weights := make([]int64, numKeys)
+	for i := range weights {
+		weights[i] = 1
+	}
+	if len(rest) > 0 {
+		if !strings.EqualFold(rest[0], "WEIGHTS") || len(rest) != numKeys+1 {
+			return errSyntax
+		}
+		for i, arg := range rest[1:] {
+			if weights[i], err = strconv.ParseInt(arg, 10, 64); err != nil {
+				return fmt.Errorf("CMS: invalid weight value")
+			}
+		}
+	}
+
+	target, err := c.Store.cms(dst)
+	if err != nil {
+		return err
+	}
+	if target == nil {
+		return errCMSNoKey
+	}
+	sources := make([]*CountMinSketch, 0, numKeys)
+	for _, key := range keys {
+		src, err := c.Store.cms(key)
+		if err != nil {
+			return err
+		}
+		if src == nil {
+			return errCMSNoKey
+		}
+		if src.width != target.width || src.depth != target.depth {
+			return fmt.Errorf("CMS: width/depth is not equal")
+		}
+		sources = append(sources, src)
+	}
+	fmt.Printf("CMS.MERGE %s command received.", dst)
+
+	counts := make([]uint32, len(target.counts))
+	var total uint64
+	for i := range counts {
+		var sum int64
+		for j, src := range sources {
+			sum += int64(src.counts[i]) * weights[j]
+		}
+		if sum < 0 || sum > math.MaxUint32 {
+			return fmt.Errorf("CMS: MERGE overflow")
+		}
+		counts[i] = uint32(sum)
+	}
+	for j, src := range sources {
+		total += uint64(int64(src.total) * weights[j])
+	}
+	target.counts, target.total = counts, total
+	c.Store.notify(notifyModule, "cms.merge", dst)
+	c.Store.touch(dst)
+	return c.send(okResponse)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestCountMinSketch(t *testing.T) {
+	s := NewCountMinSketch(2000, 5)
+	counts := map[string]uint32{}
+	for i := 0; i < 500; i++ {
+		item := "item" + strconv.Itoa(i)
+		counts[item] = uint32(i%10 + 1)
+		if _, err := s.IncrBy(item, counts[item]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for item, want := range counts {
+		// Estimates are never too low, and rarely far too high with
+		// this few items.
+		if got := s.Query(item); got < want || got > want+5 {
+			t.Errorf("Query(%s) = %d, want %d", item, got, want)
+		}
+	}
+	if got := s.Query("missing"); got > 5 {
+		t.Errorf("Query(missing) = %d", got)
+	}
+}
+
+func TestCountMinSketchOverflow(t *testing.T) {
+	s := NewCountMinSketch(10, 2)
+	tests := []struct {
+		incr    uint32
+		want    uint32
+		wantErr bool
+	}{
+		{math.MaxUint32 - 1, math.MaxUint32 - 1, false},
+		{2, 0, true},
+		{1, math.MaxUint32, false},
+	}
+	for _, tt := range tests {
+		got, err := s.IncrBy("a", tt.incr)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("IncrBy(%d) = %d, %v", tt.incr, got, err)
+		}
+	}
+	if s.total != math.MaxUint32 {
+		t.Errorf("total = %d after a failed increment", s.total)
+	}
+}
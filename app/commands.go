@@ -0,0 +1,382 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// commandFlags describe what a command does, like the flags COMMAND INFO
+// reports in Redis.
+type commandFlags uint8
+
+const (
+	cmdWrite        commandFlags = 1 << iota // may modify the keyspace
+	cmdReadOnly                              // reads keys but never modifies them
+	cmdNoScript                              // can't be called from scripts
+	cmdMayReplicate                          // may be sent to replicas, such as PUBLISH
+)
+
+// keySpec returns the key arguments of a command, given the command name
+// and its arguments as argv.
+type keySpec func(argv []string) []string
+
+// commandInfo describes a command. Arity counts the command name, and a
+// negative arity means at least that many arguments.
+type commandInfo struct {
+	arity int
+	flags commandFlags
+	keys  keySpec
+}
+
+// keyRange returns a keySpec for keys from position first to last, every
+// step arguments. A negative last position counts from the end of argv.
+func keyRange(first, last, step int) keySpec {
+	return func(argv []string) []string {
+		end := last
+		if end < 0 {
+			end += len(argv)
+		}
+		var keys []string
+		for i := first; i <= end && i < len(argv); i += step {
+			keys = append(keys, argv[i])
+		}
+		return keys
+	}
+}
+
+// numKeys returns a keySpec for commands that take fixed keys up to fixed,
+// followed by a count of keys at position fixed+1 and those keys, such as
+// ZUNIONSTORE dest numkeys key [key ...].
+func numKeys(fixed int) keySpec {
+	return func(argv []string) []string {
+		if len(argv) <= fixed+1 {
+			return nil
+		}
+		keys := append([]string{}, argv[1:fixed+1]...)
+		n, err := strconv.Atoi(argv[fixed+1])
+		if err != nil || n < 0 {
+			return keys
+		}
+		return append(keys, argv[fixed+2:min(fixed+2+n, len(argv))]...)
+	}
+}
+
+// streamsKeys returns the keys of XREAD and XREADGROUP, the first half of
+// the arguments after STREAMS.
+func streamsKeys(argv []string) []string {
+	for i, arg := range argv {
+		if strings.EqualFold(arg, "STREAMS") {
+			rest := argv[i+1:]
+			return rest[:len(rest)/2]
+		}
+	}
+	return nil
+}
+
+// subcommandKey returns the key of container commands like XGROUP, which
+// follows the subcommand.
+func subcommandKey(argv []string) []string {
+	if len(argv) < 3 {
+		return nil
+	}
+	return argv[2:3]
+}
+
+// sortKeys returns the keys of SORT, the sorted key and the STORE
+// destination. Keys read through BY and GET patterns are not included.
+func sortKeys(argv []string) []string {
+	for i := 2; i+1 < len(argv); i++ {
+		if strings.EqualFold(argv[i], "STORE") {
+			return []string{argv[1], argv[i+1]}
+		}
+	}
+	return argv[1:2]
+}
+
+// migrateKeys returns the keys of MIGRATE, either the key argument or the
+// keys following KEYS.
+func migrateKeys(argv []string) []string {
+	if argv[3] != "" {
+		return argv[3:4]
+	}
+	for i := 6; i < len(argv); i++ {
+		if strings.EqualFold(argv[i], "KEYS") {
+			return argv[i+1:]
+		}
+	}
+	return nil
+}
+
+// scriptKeys returns the keys of EVAL and the like, which follow the
+// script and the number of keys.
+func scriptKeys(argv []string) []string {
+	if len(argv) < 3 {
+		return nil
+	}
+	n, err := strconv.Atoi(argv[2])
+	if err != nil || n < 0 {
+		return nil
+	}
+	return argv[3:min(3+n, len(argv))]
+}
+
+var (
+	noKeys     keySpec = func([]string) []string { return nil }
+	firstKey           = keyRange(1, 1, 1)
+	firstTwo           = keyRange(1, 2, 1)
+	everyKey           = keyRange(1, -1, 1)
+	allButLast         = keyRange(1, -2, 1)
+)
+
+// commandTable describes every command the server supports.
+var commandTable = map[string]commandInfo{
+	"PING":     {-1, 0, noKeys},
+	"ECHO":     {2, 0, noKeys},
+	"CONFIG":   {-2, 0, noKeys},
+	"INFO":     {-1, 0, noKeys},
+	"SAVE":     {1, cmdNoScript, noKeys},
+	"SHUTDOWN": {-1, cmdNoScript, noKeys},
+	"REPLCONF": {-1, cmdNoScript, noKeys},
+	"PSYNC":    {-3, cmdNoScript, noKeys},
+	"HELLO":    {-1, cmdNoScript, noKeys},
+	"CLIENT":   {-2, cmdNoScript, noKeys},
+
+	"SET":       {-3, cmdWrite, firstKey},
+	"GET":       {2, cmdReadOnly, firstKey},
+	"KEYS":      {2, cmdReadOnly, noKeys},
+	"SCAN":      {-2, cmdReadOnly, noKeys},
+	"SORT":      {-2, cmdWrite, sortKeys},
+	"SORT_RO":   {-2, cmdReadOnly, firstKey},
+	"DUMP":      {2, cmdReadOnly, firstKey},
+	"RESTORE":   {-4, cmdWrite, firstKey},
+	"MIGRATE":   {-6, cmdWrite, migrateKeys},
+	"DEL":       {-2, cmdWrite, everyKey},
+	"UNLINK":    {-2, cmdWrite, everyKey},
+	"EXISTS":    {-2, cmdReadOnly, everyKey},
+	"TOUCH":     {-2, cmdReadOnly, everyKey},
+	"TYPE":      {2, cmdReadOnly, firstKey},
+	"RENAME":    {3, cmdWrite, firstTwo},
+	"RENAMENX":  {3, cmdWrite, firstTwo},
+	"COPY":      {-3, cmdWrite, firstTwo},
+	"RANDOMKEY": {1, cmdReadOnly, noKeys},
+	"DBSIZE":    {1, cmdReadOnly, noKeys},
+	"FLUSHDB":   {-1, cmdWrite, noKeys},
+	"FLUSHALL":  {-1, cmdWrite, noKeys},
+
+	"MULTI":   {1, cmdNoScript, noKeys},
+	"EXEC":    {1, cmdNoScript, noKeys},
+	"DISCARD": {1, cmdNoScript, noKeys},
+	"WATCH":   {-2, cmdNoScript, everyKey},
+	"UNWATCH": {1, cmdNoScript, noKeys},
+
+	"EVAL":       {-3, cmdWrite | cmdNoScript, scriptKeys},
+	"EVALSHA":    {-3, cmdWrite | cmdNoScript, scriptKeys},
+	"EVAL_RO":    {-3, cmdReadOnly | cmdNoScript, scriptKeys},
+	"EVALSHA_RO": {-3, cmdReadOnly | cmdNoScript, scriptKeys},
+	"SCRIPT":     {-2, cmdNoScript, noKeys},
+	"FCALL":      {-3, cmdWrite | cmdNoScript, scriptKeys},
+	"FCALL_RO":   {-3, cmdReadOnly | cmdNoScript, scriptKeys},
+	"FUNCTION":   {-2, cmdNoScript, noKeys},
+
+	"SUBSCRIBE":    {-2, cmdNoScript, noKeys},
+	"UNSUBSCRIBE":  {-1, cmdNoScript, noKeys},
+	"PSUBSCRIBE":   {-2, cmdNoScript, noKeys},
+	"PUNSUBSCRIBE": {-1, cmdNoScript, noKeys},
+	"SSUBSCRIBE":   {-2, cmdNoScript, everyKey},
+	"SUNSUBSCRIBE": {-1, cmdNoScript, everyKey},
+	"PUBLISH":      {3, cmdMayReplicate, noKeys},
+	"SPUBLISH":     {3, cmdMayReplicate, firstKey},
+	"PUBSUB":       {-2, 0, noKeys},
+
+	"HSET":         {-4, cmdWrite, firstKey},
+	"HMSET":        {-4, cmdWrite, firstKey},
+	"HGET":         {3, cmdReadOnly, firstKey},
+	"HMGET":        {-3, cmdReadOnly, firstKey},
+	"HDEL":         {-3, cmdWrite, firstKey},
+	"HLEN":         {2, cmdReadOnly, firstKey},
+	"HEXISTS":      {3, cmdReadOnly, firstKey},
+	"HGETALL":      {2, cmdReadOnly, firstKey},
+	"HKEYS":        {2, cmdReadOnly, firstKey},
+	"HVALS":        {2, cmdReadOnly, firstKey},
+	"HSCAN":        {-3, cmdReadOnly, firstKey},
+	"HEXPIRE":      {-6, cmdWrite, firstKey},
+	"HPEXPIRE":     {-6, cmdWrite, firstKey},
+	"HEXPIREAT":    {-6, cmdWrite, firstKey},
+	"HPEXPIREAT":   {-6, cmdWrite, firstKey},
+	"HTTL":         {-5, cmdReadOnly, firstKey},
+	"HPTTL":        {-5, cmdReadOnly, firstKey},
+	"HEXPIRETIME":  {-5, cmdReadOnly, firstKey},
+	"HPEXPIRETIME": {-5, cmdReadOnly, firstKey},
+	"HPERSIST":     {-5, cmdWrite, firstKey},
+	"HGETEX":       {-5, cmdWrite, firstKey},
+	"HSETEX":       {-6, cmdWrite, firstKey},
+
+	"LPUSH":  {-3, cmdWrite, firstKey},
+	"RPUSH":  {-3, cmdWrite, firstKey},
+	"LRANGE": {4, cmdReadOnly, firstKey},
+	"LLEN":   {2, cmdReadOnly, firstKey},
+
+	"SADD":        {-3, cmdWrite, firstKey},
+	"SREM":        {-3, cmdWrite, firstKey},
+	"SMEMBERS":    {2, cmdReadOnly, firstKey},
+	"SISMEMBER":   {3, cmdReadOnly, firstKey},
+	"SMISMEMBER":  {-3, cmdReadOnly, firstKey},
+	"SCARD":       {2, cmdReadOnly, firstKey},
+	"SPOP":        {-2, cmdWrite, firstKey},
+	"SRANDMEMBER": {-2, cmdReadOnly, firstKey},
+	"SMOVE":       {4, cmdWrite, firstTwo},
+	"SINTER":      {-2, cmdReadOnly, everyKey},
+	"SUNION":      {-2, cmdReadOnly, everyKey},
+	"SDIFF":       {-2, cmdReadOnly, everyKey},
+	"SINTERSTORE": {-3, cmdWrite, everyKey},
+	"SUNIONSTORE": {-3, cmdWrite, everyKey},
+	"SDIFFSTORE":  {-3, cmdWrite, everyKey},
+	"SINTERCARD":  {-3, cmdReadOnly, numKeys(0)},
+	"SSCAN":       {-3, cmdReadOnly, firstKey},
+
+	"ZADD":        {-4, cmdWrite, firstKey},
+	"ZINCRBY":     {4, cmdWrite, firstKey},
+	"ZREM":        {-3, cmdWrite, firstKey},
+	"ZSCORE":      {3, cmdReadOnly, firstKey},
+	"ZMSCORE":     {-3, cmdReadOnly, firstKey},
+	"ZCARD":       {2, cmdReadOnly, firstKey},
+	"ZCOUNT":      {4, cmdReadOnly, firstKey},
+	"ZLEXCOUNT":   {4, cmdReadOnly, firstKey},
+	"ZRANK":       {-3, cmdReadOnly, firstKey},
+	"ZREVRANK":    {-3, cmdReadOnly, firstKey},
+	"ZRANGE":      {-4, cmdReadOnly, firstKey},
+	"ZRANGESTORE": {-5, cmdWrite, firstTwo},
+	"ZPOPMIN":     {-2, cmdWrite, firstKey},
+	"ZPOPMAX":     {-2, cmdWrite, firstKey},
+	"BZPOPMIN":    {-3, cmdWrite, allButLast},
+	"BZPOPMAX":    {-3, cmdWrite, allButLast},
+	"ZUNION":      {-3, cmdReadOnly, numKeys(0)},
+	"ZINTER":      {-3, cmdReadOnly, numKeys(0)},
+	"ZDIFF":       {-3, cmdReadOnly, numKeys(0)},
+	"ZUNIONSTORE": {-4, cmdWrite, numKeys(1)},
+	"ZINTERSTORE": {-4, cmdWrite, numKeys(1)},
+	"ZDIFFSTORE":  {-4, cmdWrite, numKeys(1)},
+	"ZSCAN":       {-3, cmdReadOnly, firstKey},
+
+	"XADD":       {-5, cmdWrite, firstKey},
+	"XRANGE":     {-4, cmdReadOnly, firstKey},
+	"XREVRANGE":  {-4, cmdReadOnly, firstKey},
+	"XLEN":       {2, cmdReadOnly, firstKey},
+	"XDEL":       {-3, cmdWrite, firstKey},
+	"XTRIM":      {-4, cmdWrite, firstKey},
+	"XREAD":      {-4, cmdReadOnly, streamsKeys},
+	"XGROUP":     {-2, cmdWrite, subcommandKey},
+	"XREADGROUP": {-7, cmdWrite, streamsKeys},
+	"XACK":       {-4, cmdWrite, firstKey},
+	"XPENDING":   {-3, cmdReadOnly, firstKey},
+	"XCLAIM":     {-6, cmdWrite, firstKey},
+	"XAUTOCLAIM": {-6, cmdWrite, firstKey},
+	"XINFO":      {-2, cmdReadOnly, subcommandKey},
+
+	"SETBIT":      {4, cmdWrite, firstKey},
+	"GETBIT":      {3, cmdReadOnly, firstKey},
+	"BITCOUNT":    {-2, cmdReadOnly, firstKey},
+	"BITPOS":      {-3, cmdReadOnly, firstKey},
+	"BITOP":       {-4, cmdWrite, keyRange(2, -1, 1)},
+	"BITFIELD":    {-2, cmdWrite, firstKey},
+	"BITFIELD_RO": {-2, cmdReadOnly, firstKey},
+
+	"PFADD":   {-2, cmdWrite, firstKey},
+	"PFCOUNT": {-2, cmdReadOnly, everyKey},
+	"PFMERGE": {-2, cmdWrite, everyKey},
+	"PFDEBUG": {3, cmdWrite, keyRange(2, 2, 1)},
+
+	"GEOADD":         {-5, cmdWrite, firstKey},
+	"GEOPOS":         {-2, cmdReadOnly, firstKey},
+	"GEODIST":        {-4, cmdReadOnly, firstKey},
+	"GEOHASH":        {-2, cmdReadOnly, firstKey},
+	"GEOSEARCH":      {-7, cmdReadOnly, firstKey},
+	"GEOSEARCHSTORE": {-8, cmdWrite, firstTwo},
+
+	"JSON.SET":       {-4, cmdWrite, firstKey},
+	"JSON.GET":       {-2, cmdReadOnly, firstKey},
+	"JSON.MGET":      {-3, cmdReadOnly, allButLast},
+	"JSON.DEL":       {-2, cmdWrite, firstKey},
+	"JSON.FORGET":    {-2, cmdWrite, firstKey},
+	"JSON.TYPE":      {-2, cmdReadOnly, firstKey},
+	"JSON.NUMINCRBY": {4, cmdWrite, firstKey},
+	"JSON.STRAPPEND": {-3, cmdWrite, firstKey},
+	"JSON.ARRAPPEND": {-4, cmdWrite, firstKey},
+	"JSON.ARRINSERT": {-5, cmdWrite, firstKey},
+	"JSON.ARRPOP":    {-2, cmdWrite, firstKey},
+	"JSON.ARRLEN":    {-2, cmdReadOnly, firstKey},
+	"JSON.OBJKEYS":   {-2, cmdReadOnly, firstKey},
+
+	"BF.RESERVE": {-4, cmdWrite, firstKey},
+	"BF.ADD":     {3, cmdWrite, firstKey},
+	"BF.MADD":    {-3, cmdWrite, firstKey},
+	"BF.INSERT":  {-4, cmdWrite, firstKey},
+	"BF.EXISTS":  {3, cmdReadOnly, firstKey},
+	"BF.MEXISTS": {-3, cmdReadOnly, firstKey},
+	"BF.INFO":    {-2, cmdReadOnly, firstKey},
+
+	"CF.RESERVE": {-3, cmdWrite, firstKey},
+	"CF.ADD":     {3, cmdWrite, firstKey},
+	"CF.ADDNX":   {3, cmdWrite, firstKey},
+	"CF.DEL":     {3, cmdWrite, firstKey},
+	"CF.EXISTS":  {3, cmdReadOnly, firstKey},
+	"CF.COUNT":   {3, cmdReadOnly, firstKey},
+
+	"CMS.INITBYDIM":  {4, cmdWrite, firstKey},
+	"CMS.INITBYPROB": {4, cmdWrite, firstKey},
+	"CMS.INCRBY":     {-4, cmdWrite, firstKey},
+	"CMS.QUERY":      {-3, cmdReadOnly, firstKey},
+	"CMS.MERGE":      {-4, cmdWrite, numKeys(1)},
+
+	"TOPK.RESERVE": {-3, cmdWrite, firstKey},
+	"TOPK.ADD":     {-3, cmdWrite, firstKey},
+	"TOPK.QUERY":   {-3, cmdReadOnly, firstKey},
+	"TOPK.LIST":    {-2, cmdReadOnly, firstKey},
+
+	"TDIGEST.CREATE":   {-2, cmdWrite, firstKey},
+	"TDIGEST.ADD":      {-3, cmdWrite, firstKey},
+	"TDIGEST.QUANTILE": {-3, cmdReadOnly, firstKey},
+	"TDIGEST.CDF":      {-3, cmdReadOnly, firstKey},
+	"TDIGEST.MIN":      {2, cmdReadOnly, firstKey},
+	"TDIGEST.MAX":      {2, cmdReadOnly, firstKey},
+	"TDIGEST.MERGE":    {-4, cmdWrite, numKeys(1)},
+
+	"TS.CREATE":     {-2, cmdWrite, firstKey},
+	"TS.ADD":        {-4, cmdWrite, firstKey},
+	"TS.MADD":       {-4, cmdWrite, keyRange(1, -1, 3)},
+	"TS.INCRBY":     {-3, cmdWrite, firstKey},
+	"TS.DECRBY":     {-3, cmdWrite, firstKey},
+	"TS.RANGE":      {-4, cmdReadOnly, firstKey},
+	"TS.REVRANGE":   {-4, cmdReadOnly, firstKey},
+	"TS.MRANGE":     {-5, cmdReadOnly, noKeys},
+	"TS.MREVRANGE":  {-5, cmdReadOnly, noKeys},
+	"TS.CREATERULE": {-6, cmdWrite, firstTwo},
+	"TS.DELETERULE": {3, cmdWrite, firstTwo},
+
+	"FT.CREATE":    {-5, cmdWrite, noKeys},
+	"FT.DROPINDEX": {-2, cmdWrite, noKeys},
+	"FT._LIST":     {1, cmdReadOnly, noKeys},
+	"FT.INFO":      {2, cmdReadOnly, noKeys},
+	"FT.SEARCH":    {-3, cmdReadOnly, noKeys},
+	"FT.AGGREGATE": {-3, cmdReadOnly, noKeys},
+}
+
+// lookupCommand returns the description of the named command.
+func lookupCommand(name string) (commandInfo, bool) {
+	info, ok := commandTable[strings.ToUpper(name)]
+	return info, ok
+}
+
+// checkArity reports whether a command with argc arguments, counting the
+// command name, has the right number of arguments.
+func (info commandInfo) checkArity(argc int) bool {
+	if info.arity < 0 {
+		return argc >= -info.arity
+	}
+	return argc == info.arity
+}
+
+// commandKeys returns the keys cmd refers to.
+func commandKeys(info commandInfo, cmd Command) []string {
+	return info.keys(append([]string{cmd.Command}, cmd.Args...))
+}
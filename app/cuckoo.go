@@ -0,0 +1,391 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+const (
+	cuckooDefaultCapacity      = 1024
+	cuckooDefaultBucketSize    = 2
+	cuckooDefaultMaxIterations = 20
+	cuckooDefaultExpansion     = 1
+	cuckooMaxFilters           = 32
+)
+
+// cuckooTable is one fixed size cuckoo hash table of 8-bit fingerprints,
+// where zero marks an empty slot. The number of buckets is a power of two
+// so that an item's alternate bucket can be derived from either bucket.
+type cuckooTable struct {
+	numBuckets uint64
+	data       []uint8
+}
+
+func newCuckooTable(capacity, bucketSize int) *cuckooTable {
+	buckets := uint64(max((capacity+bucketSize-1)/bucketSize, 1))
+	buckets = 1 << bits.Len64(buckets-1)
+	return &cuckooTable{numBuckets: buckets, data: make([]uint8, int(buckets)*bucketSize)}
+}
+
+// cuckooHash returns an item's fingerprint and its primary hash.
+func cuckooHash(item string) (uint8, uint64) {
+	h := murmurHash64A([]byte(item), 0)
+	return uint8(h%255 + 1), h
+}
+
+// altIndex returns the other bucket a fingerprint may live in.
+func (t *cuckooTable) altIndex(fp uint8, index uint64) uint64 {
+	return (index ^ uint64(fp)*0x5bd1e995) & (t.numBuckets - 1)
+}
+
+func (t *cuckooTable) bucket(index uint64, bucketSize int) []uint8 {
+	start := int(index) * bucketSize
+	return t.data[start : start+bucketSize]
+}
+
+// count returns how many times fp appears in the item's two buckets.
+func (t *cuckooTable) count(fp uint8, h uint64, bucketSize int) int {
+	i1 := h & (t.numBuckets - 1)
+	i2 := t.altIndex(fp, i1)
+	n := 0
+	for _, slot := range t.bucket(i1, bucketSize) {
+		if slot == fp {
+			n++
+		}
+	}
+	if i2 != i1 {
+		for _, slot := range t.bucket(i2, bucketSize) {
+			if slot == fp {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// insertFree stores fp in an empty slot of bucket index.
+func (t *cuckooTable) insertFree(fp uint8, index uint64, bucketSize int) bool {
+	b := t.bucket(index, bucketSize)
+	for i, slot := range b {
+		if slot == 0 {
+			b[i] = fp
+			return true
+		}
+	}
+	return false
+}
+
+// insert stores fp, evicting other fingerprints to their alternate bucket
+// for up to maxIterations moves. If that fails, every move is undone.
+func (t *cuckooTable) insert(fp uint8, h uint64, bucketSize, maxIterations int) bool {
+	i1 := h & (t.numBuckets - 1)
+	i2 := t.altIndex(fp, i1)
+	if t.insertFree(fp, i1, bucketSize) || t.insertFree(fp, i2, bucketSize) {
+		return true
+	}
+
+	type move struct {
+		index uint64
+		slot  int
+	}
+	moves := []move{}
+	index := i2
+	for i := 0; i < maxIterations; i++ {
+		slot := i % bucketSize
+		b := t.bucket(index, bucketSize)
+		fp, b[slot] = b[slot], fp
+		moves = append(moves, move{index, slot})
+		index = t.altIndex(fp, index)
+		if t.insertFree(fp, index, bucketSize) {
+			return true
+		}
+	}
+	for i := len(moves) - 1; i >= 0; i-- {
+		b := t.bucket(moves[i].index, bucketSize)
+		fp, b[moves[i].slot] = b[moves[i].slot], fp
+	}
+	return false
+}
+
+// remove deletes one copy of fp from the item's buckets.
+func (t *cuckooTable) remove(fp uint8, h uint64, bucketSize int) bool {
+	i1 := h & (t.numBuckets - 1)
+	for _, index := range []uint64{i1, t.altIndex(fp, i1)} {
+		b := t.bucket(index, bucketSize)
+		for i, slot := range b {
+			if slot == fp {
+				b[i] = 0
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CuckooFilter is a cuckoo filter that supports deletion. When a table
+// fills up, a new larger one is added, up to cuckooMaxFilters tables.
+type CuckooFilter struct {
+	tables        []*cuckooTable
+	capacity      int
+	bucketSize    int
+	maxIterations int
+	expansion     int
+	items         int
+	deletes       int
+}
+
+func NewCuckooFilter(capacity, bucketSize, maxIterations, expansion int) *CuckooFilter {
+	return &CuckooFilter{
+		tables:        []*cuckooTable{newCuckooTable(capacity, bucketSize)},
+		capacity:      capacity,
+		bucketSize:    bucketSize,
+		maxIterations: maxIterations,
+		expansion:     expansion,
+	}
+}
+
+// Count returns how many times item may have been added.
+func (f *CuckooFilter) Count(item string) int {
+	fp, h := cuckooHash(item)
+	n := 0
+	for _, t := range f.tables {
+		n += t.count(fp, h, f.bucketSize)
+	}
+	return n
+}
+
+// Add adds item, growing the filter if needed.
+func (f *CuckooFilter) Add(item string) error {
+	fp, h := cuckooHash(item)
+	for _, t := range f.tables {
+		if t.insertFree(fp, h&(t.numBuckets-1), f.bucketSize) ||
+			t.insertFree(fp, t.altIndex(fp, h&(t.numBuckets-1)), f.bucketSize) {
+			f.items++
+			return nil
+		}
+	}
+	last := f.tables[len(f.tables)-1]
+	if !last.insert(fp, h, f.bucketSize, f.maxIterations) {
+		if f.expansion == 0 || len(f.tables) >= cuckooMaxFilters {
+			return fmt.Errorf("Filter is full")
+		}
+		growth := 1
+		for range len(f.tables) {
+			growth *= f.expansion
+		}
+		last = newCuckooTable(f.capacity*growth, f.bucketSize)
+		f.tables = append(f.tables, last)
+		last.insert(fp, h, f.bucketSize, f.maxIterations)
+	}
+	f.items++
+	return nil
+}
+
+// Delete removes one copy of item, newest tables first.
+func (f *CuckooFilter) Delete(item string) bool {
+	fp, h := cuckooHash(item)
+	for i := len(f.tables) - 1; i >= 0; i-- {
+		if f.tables[i].remove(fp, h, f.bucketSize) {
+			f.items--
+			f.deletes++
+			return true
+		}
+	}
+	return false
+}
+
+// Cuckoo filters are saved as module entries of this server's own type.
+const (
+	cuckooModuleName   = "CuckooFlt"
+	cuckooModuleEncver = 1
+)
+
+func (f *CuckooFilter) moduleType() (string, int) {
+	return cuckooModuleName, cuckooModuleEncver
+}
+
+func (f *CuckooFilter) saveModule(w *moduleWriter) {
+	for _, n := range []int{f.capacity, f.bucketSize, f.maxIterations, f.expansion, f.items, f.deletes, len(f.tables)} {
+		w.saveUnsigned(uint64(n))
+	}
+	for _, t := range f.tables {
+		w.saveUnsigned(t.numBuckets)
+		w.saveString(string(t.data))
+	}
+}
+
+func loadCuckooFilter(r *moduleReader, encver int) (any, error) {
+	if encver != cuckooModuleEncver {
+		return nil, fmt.Errorf("unsupported cuckoo filter encoding version %d", encver)
+	}
+	var nums [7]int
+	for i := range nums {
+		n, err := r.loadUnsigned()
+		if err != nil {
+			return nil, err
+		}
+		nums[i] = int(n)
+	}
+	f := &CuckooFilter{
+		capacity:      nums[0],
+		bucketSize:    nums[1],
+		maxIterations: nums[2],
+		expansion:     nums[3],
+		items:         nums[4],
+		deletes:       nums[5],
+	}
+	for range nums[6] {
+		buckets, err := r.loadUnsigned()
+		if err != nil {
+			return nil, err
+		}
+		data, err := r.loadString()
+		if err != nil {
+			return nil, err
+		}
+		if len(data) != int(buckets)*f.bucketSize || buckets&(buckets-1) != 0 {
+			return nil, fmt.Errorf("corrupt cuckoo filter")
+		}
+		f.tables = append(f.tables, &cuckooTable{numBuckets: buckets, data: []uint8(data)})
+	}
+	if len(f.tables) == 0 {
+		return nil, fmt.Errorf("corrupt cuckoo filter")
+	}
+	return f, nil
+}
+
+func init() {
+	moduleLoaders[cuckooModuleName] = loadCuckooFilter
+}
+
+// cuckoo returns the cuckoo filter stored at key, or nil if there is none.
+func (s *Store) cuckoo(key string) (*CuckooFilter, error) {
+	val, found := s.lookup(key)
+	if !found {
+		return nil, nil
+	}
+	f, ok := val.(*CuckooFilter)
+	if !ok {
+		return nil, errWrongType
+	}
+	return f, nil
+}
+
+// handleCFReserve handles CF.RESERVE commands.
+func (c *ClientHandler) handleCFReserve(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("insufficient number of arguments for CF.RESERVE")
+	}
+	key := args[0]
+	capacity, err := strconv.Atoi(args[1])
+	if err != nil || capacity < 1 {
+		return fmt.Errorf("Bad capacity")
+	}
+	bucketSize, maxIterations, expansion := cuckooDefaultBucketSize, cuckooDefaultMaxIterations, cuckooDefaultExpansion
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return errSyntax
+		}
+		n, err := strconv.Atoi(args[i+1])
+		switch strings.ToUpper(args[i]) {
+		case "BUCKETSIZE":
+			if err != nil || n < 1 || n > 255 {
+				return fmt.Errorf("Bad bucket size")
+			}
+			bucketSize = n
+		case "MAXITERATIONS":
+			if err != nil || n < 1 || n > 65535 {
+				return fmt.Errorf("Bad maxIterations")
+			}
+			maxIterations = n
+		case "EXPANSION":
+			if err != nil || n < 0 || n > 32768 {
+				return fmt.Errorf("Bad expansion")
+			}
+			expansion = n
+		default:
+			return errSyntax
+		}
+	}
+	if _, found := c.Store.lookup(key); found {
+		return fmt.Errorf("item exists")
+	}
+	fmt.Printf("CF.RESERVE %s command received.", key)
+
+	c.Store.create(key, NewCuckooFilter(capacity, bucketSize, maxIterations, expansion))
+	c.Store.notify(notifyModule, "cf.reserve", key)
+	c.Store.touch(key)
+	return c.send(okResponse)
+}
+
+// handleCFAdd handles CF.ADD and, with nx set, CF.ADDNX commands.
+func (c *ClientHandler) handleCFAdd(args []string, nx bool) error {
+	if len(args) != 2 {
+		return fmt.Errorf("wrong number of arguments for CF.ADD")
+	}
+	key, item := args[0], args[1]
+	f, err := c.Store.cuckoo(key)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("CF.ADD %s command received.", key)
+
+	if f == nil {
+		f = NewCuckooFilter(cuckooDefaultCapacity, cuckooDefaultBucketSize, cuckooDefaultMaxIterations, cuckooDefaultExpansion)
+		c.Store.create(key, f)
+	}
+	if nx && f.Count(item) > 0 {
+		return c.send(encodeInteger(0))
+	}
+	if err := f.Add(item); err != nil {
+		return err
+	}
+	if nx {
+		c.Store.notify(notifyModule, "cf.addnx", key)
+	} else {
+		c.Store.notify(notifyModule, "cf.add", key)
+	}
+	c.Store.touch(key)
+	return c.send(encodeInteger(1))
+}
+
+// handleCFDel handles CF.DEL commands.
+func (c *ClientHandler) handleCFDel(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("wrong number of arguments for CF.DEL")
+	}
+	f, err := c.Store.cuckoo(args[0])
+	if err != nil {
+		return err
+	}
+	if f == nil {
+		return fmt.Errorf("Not found")
+	}
+	if f.Delete(args[1]) {
+		c.Store.notify(notifyModule, "cf.del", args[0])
+		c.Store.touch(args[0])
+		return c.send(encodeInteger(1))
+	}
+	return c.send(encodeInteger(0))
+}
+
+// handleCFCount handles CF.COUNT and, with exists set, CF.EXISTS commands.
+func (c *ClientHandler) handleCFCount(args []string, exists bool) error {
+	if len(args) != 2 {
+		return fmt.Errorf("wrong number of arguments for CF.COUNT")
+	}
+	f, err := c.Store.cuckoo(args[0])
+	if err != nil {
+		return err
+	}
+	count := 0
+	if f != nil {
+		count = f.Count(args[1])
+	}
+	if exists {
+		count = min(count, 1)
+	}
+	return c.send(encodeInteger(count))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestCuckooTableAltIndex(t *testing.T) {
+	table := newCuckooTable(1000, 2)
+	if table.numBuckets != 512 {
+		t.Errorf("numBuckets = %d, want 512", table.numBuckets)
+	}
+	// The alternate of the alternate bucket is the original one.
+	for i := 0; i < 1000; i++ {
+		fp, h := cuckooHash(strconv.Itoa(i))
+		if fp == 0 {
+			t.Fatalf("fingerprint of %d is zero", i)
+		}
+		i1 := h & (table.numBuckets - 1)
+		if back := table.altIndex(fp, table.altIndex(fp, i1)); back != i1 {
+			t.Fatalf("altIndex is not symmetric for %d", i)
+		}
+	}
+}
+
+func TestCuckooFilter(t *testing.T) {
+	tests := []struct {
+		name       string
+		capacity   int
+		expansion  int
+		items      int
+		wantTables int
+		wantErr    bool
+	}{
+		{"within capacity", 1024, 1, 700, 1, false},
+		{"expanding", 100, 2, 1000, 4, false},
+		{"not expanding", 64, 0, 200, 1, true},
+	}
+	for _, tt := range tests {
+		f := NewCuckooFilter(tt.capacity, cuckooDefaultBucketSize, cuckooDefaultMaxIterations, tt.expansion)
+		added := 0
+		var err error
+		for ; added < tt.items; added++ {
+			if err = f.Add("item" + strconv.Itoa(added)); err != nil {
+				break
+			}
+		}
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Add error = %v after %d items", tt.name, err, added)
+		}
+		if len(f.tables) != tt.wantTables {
+			t.Errorf("%s: %d tables, want %d", tt.name, len(f.tables), tt.wantTables)
+		}
+		if f.items != added {
+			t.Errorf("%s: %d items, want %d", tt.name, f.items, added)
+		}
+		for i := 0; i < added; i++ {
+			if f.Count("item"+strconv.Itoa(i)) == 0 {
+				t.Fatalf("%s: item%d is missing", tt.name, i)
+			}
+		}
+	}
+}
+
+func TestCuckooFilterDelete(t *testing.T) {
+	f := NewCuckooFilter(100, 4, cuckooDefaultMaxIterations, 1)
+	for range 3 {
+		f.Add("dup")
+	}
+	f.Add("other")
+	tests := []struct {
+		item      string
+		wantOK    bool
+		wantCount int
+	}{
+		{"dup", true, 2},
+		{"dup", true, 1},
+		{"dup", true, 0},
+		{"dup", false, 0},
+		{"other", true, 0},
+		{"missing", false, 0},
+	}
+	for _, tt := range tests {
+		if ok := f.Delete(tt.item); ok != tt.wantOK {
+			t.Errorf("Delete(%s) = %v, want %v", tt.item, ok, tt.wantOK)
+		}
+		if n := f.Count(tt.item); n != tt.wantCount {
+			t.Errorf("Count(%s) = %d after deleting, want %d", tt.item, n, tt.wantCount)
+		}
+	}
+	if f.items != 0 || f.deletes != 4 {
+		t.Errorf("items = %d, deletes = %d", f.items, f.deletes)
+	}
+}
+
+func TestCuckooFilterDumpRoundTrip(t *testing.T) {
+	f := NewCuckooFilter(64, 2, 20, 2)
+	for i := 0; i < 300; i++ {
+		f.Add(strconv.Itoa(i))
+	}
+	f.Delete("7")
+	payload, err := dumpValue(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := restoreValue(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := val.(*CuckooFilter)
+	if len(restored.tables) != len(f.tables) || restored.items != f.items || restored.deletes != f.deletes {
+		t.Errorf("restored %d tables, %d items, %d deletes", len(restored.tables), restored.items, restored.deletes)
+	}
+	for i := 0; i < 300; i++ {
+		item := strconv.Itoa(i)
+		if restored.Count(item) != f.Count(item) {
+			t.Errorf("Count(%s) = %d after restoring, want %d", item, restored.Count(item), f.Count(item))
+		}
+	}
+}
@@ -1,22 +1,162 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"strconv"
+	"strings"
 )
 
 const (
 	fmtArray        = "*%d\r\n"
 	fmtBulkStr      = "$%d\r\n%s\r\n"
 	fmtSimpleString = "+%s\r\n"
+	fmtInteger      = ":%d\r\n"
+	fmtError        = "-%s\r\n"
+	fmtMap          = "%%%d\r\n" // RESP3
+	fmtPush         = ">%d\r\n"  // RESP3
 )
 
-func decodeArrayLength(msg string) int {
-	length, err := strconv.Atoi(msg[1:])
+// ReplyError is an error reply carrying its own error code, e.g. WRONGTYPE.
+// Any other error returned by a command handler is sent with the generic
+// ERR code.
+type ReplyError struct {
+	Code string
+	Msg  string
+}
+
+func (e ReplyError) Error() string {
+	return e.Code + " " + e.Msg
+}
+
+// ProtocolError is returned by readCommand when the client sends malformed
+// input. The connection can't be recovered after one.
+type ProtocolError string
+
+func (e ProtocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+// readCommand reads the next command from the client. Commands are normally
+// sent as an array of bulk strings, but like Redis, a single line of space
+// separated words is accepted too, for use with telnet and the like. An
+// empty command is returned for blank lines.
+func readCommand(r *bufio.Reader) (Command, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return Command{}, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		words := strings.Fields(line)
+		if len(words) == 0 {
+			return Command{}, nil
+		}
+		return Command{Command: words[0], Args: words[1:]}, nil
+	}
+
+	length, err := strconv.Atoi(line[1:])
+	if err != nil || length > 1024*1024 {
+		return Command{}, ProtocolError("invalid multibulk length")
+	}
+	words := make([]string, 0, max(length, 0))
+	for i := 0; i < length; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return Command{}, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return Command{}, ProtocolError(fmt.Sprintf("expected '$', got '%.1s'", line))
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > 512*1024*1024 {
+			return Command{}, ProtocolError("invalid bulk length")
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return Command{}, err
+		}
+		if string(data[size:]) != "\r\n" {
+			return Command{}, ProtocolError("bulk string not terminated by CRLF")
+		}
+		words = append(words, string(data[:size]))
+	}
+	if len(words) == 0 {
+		return Command{}, nil
+	}
+	return Command{Command: words[0], Args: words[1:]}, nil
+}
+
+// readLine reads a line terminated by CRLF, or just LF, without the line
+// terminator.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+// statusReply and errorReply are the simple string and error replies read
+// by readReply. Bulk strings are read as strings, integers as int64, arrays
+// as []any and null replies as nil.
+type (
+	statusReply string
+	errorReply  string
+)
+
+// readReply reads a reply, as sent by a server.
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := readLine(r)
 	if err != nil {
-		fmt.Printf("Error parsing array length: %v", err)
+		return nil, err
+	}
+	if line == "" {
+		return nil, ProtocolError("empty reply")
 	}
-	return length
+	switch line[0] {
+	case '+':
+		return statusReply(line[1:]), nil
+	case '-':
+		return errorReply(line[1:]), nil
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, ProtocolError("invalid integer reply")
+		}
+		return n, nil
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, ProtocolError("invalid bulk length")
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, ProtocolError("invalid multibulk length")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, ProtocolError(fmt.Sprintf("unexpected reply type '%c'", line[0]))
 }
 
 func encodeSimpleString(str string) string {
@@ -34,3 +174,54 @@ func encodeBulkStringArray(length int, bulkStrings ...string) string {
 	}
 	return encoded
 }
+
+func encodeInteger(num int) string {
+	return fmt.Sprintf(fmtInteger, num)
+}
+
+// formatFloat formats a double the way Redis does in replies: integers
+// without a fractional part or exponent, other values in their shortest
+// form that parses back to the same double.
+func formatFloat(num float64) string {
+	switch {
+	case math.IsInf(num, 1):
+		return "inf"
+	case math.IsInf(num, -1):
+		return "-inf"
+	}
+	if abs := math.Abs(num); abs == 0 || (abs >= 1e-4 && abs < 1e17) {
+		return strconv.FormatFloat(num, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(num, 'g', -1, 64)
+}
+
+// encodeArray encodes an array of already encoded elements.
+func encodeArray(elements ...string) string {
+	return fmt.Sprintf(fmtArray, len(elements)) + strings.Join(elements, "")
+}
+
+// encodeMap encodes a map from alternating already encoded keys and values,
+// as a RESP3 map or, for RESP2 clients, a flat array.
+func encodeMap(resp int, elements ...string) string {
+	if resp == 3 {
+		return fmt.Sprintf(fmtMap, len(elements)/2) + strings.Join(elements, "")
+	}
+	return encodeArray(elements...)
+}
+
+// encodePush encodes a RESP3 push message of already encoded elements.
+func encodePush(elements ...string) string {
+	return fmt.Sprintf(fmtPush, len(elements)) + strings.Join(elements, "")
+}
+
+// encodeError encodes err as an error reply. Line breaks are not allowed in
+// error replies, so they are replaced by spaces.
+func encodeError(err error) string {
+	msg := "ERR " + err.Error()
+	var replyErr ReplyError
+	if errors.As(err, &replyErr) {
+		msg = err.Error()
+	}
+	msg = strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+	return fmt.Sprintf(fmtError, msg)
+}
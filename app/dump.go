@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc64"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dumpRDBVersion        = 12                 // RDB version written to DUMP payloads, as in rdbHeader
+	dumpFooterSize        = 10                 // RDB version and CRC64 ending each payload
+	crc64JonesPoly        = 0x95ac9329ac4bc9b5 // reversed form, as hash/crc64 expects
+	defaultMigrateTimeout = 1000               // milliseconds, used when MIGRATE is given 0
+	maxRestoreFreq        = 255                // largest LFU counter RESTORE accepts
+)
+
+var crc64Table = crc64.MakeTable(crc64JonesPoly)
+
+// crc64Jones returns the CRC-64/Jones checksum Redis uses for RDB files and
+// DUMP payloads. Unlike hash/crc64, it starts from zero and does not invert
+// the result.
+func crc64Jones(data []byte) uint64 {
+	return ^crc64.Update(^uint64(0), crc64Table, data)
+}
+
+// dumpValue serializes val the way DUMP does: the value type and value as
+// they appear in an RDB file, followed by the RDB version and a CRC64 of
+// everything before it, both little-endian.
+func dumpValue(val any) (string, error) {
+	var buf bytes.Buffer
+	rw := newRDBWriter(&buf)
+	rw.noKeys = true
+	if err := rw.writeObject("", val); err != nil {
+		return "", err
+	}
+	return rw.finishDump(&buf)
+}
+
+// finishDump writes the footer of a DUMP payload being written to buf,
+// the RDB version and a CRC64 of everything before it, and returns the
+// payload.
+func (rw *rdbWriter) finishDump(buf *bytes.Buffer) (string, error) {
+	binary.Write(rw.w, binary.LittleEndian, uint16(dumpRDBVersion))
+	if err := rw.w.Flush(); err != nil {
+		return "", err
+	}
+	binary.Write(buf, binary.LittleEndian, crc64Jones(buf.Bytes()))
+	return buf.String(), nil
+}
+
+// openDump checks the version and checksum of a DUMP payload, returning a
+// reader for its contents, or nil if the check fails.
+func openDump(payload string) *bufio.Reader {
+	if len(payload) < dumpFooterSize+1 {
+		return nil
+	}
+	data := []byte(payload)
+	body, footer := data[:len(data)-8], data[len(data)-8:]
+	version := binary.LittleEndian.Uint16(body[len(body)-2:])
+	if version > dumpRDBVersion || binary.LittleEndian.Uint64(footer) != crc64Jones(body) {
+		return nil
+	}
+	return bufio.NewReader(bytes.NewReader(body[:len(body)-2]))
+}
+
+// restoreValue decodes a payload made by dumpValue, checking its version
+// and checksum first.
+func restoreValue(payload string) (any, error) {
+	r := openDump(payload)
+	if r == nil {
+		return nil, fmt.Errorf("DUMP payload version or checksum are wrong")
+	}
+	valueType, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	val, err := readObject(r, valueType)
+	if err != nil || r.Buffered() > 0 {
+		return nil, fmt.Errorf("Bad data format")
+	}
+	return val, nil
+}
+
+// handleDump handles DUMP commands.
+func (c *ClientHandler) handleDump(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("wrong number of arguments for DUMP")
+	}
+	val, found := c.Store.lookup(args[0])
+	if !found {
+		return c.send(nullResponse)
+	}
+	fmt.Printf("DUMP %s command received.", args[0])
+	payload, err := dumpValue(val)
+	if err != nil {
+		return err
+	}
+	return c.send(encodeBulkString(payload))
+}
+
+// handleRestore handles RESTORE commands. IDLETIME and FREQ are checked but
+// otherwise ignored, as keys carry no access statistics here.
+func (c *ClientHandler) handleRestore(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("insufficient number of arguments for RESTORE")
+	}
+	key, payload := args[0], args[2]
+	ttl, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	if ttl < 0 {
+		return fmt.Errorf("Invalid TTL value, must be >= 0")
+	}
+	replace, absTTL, idleTime, freq := false, false, false, false
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absTTL = true
+		case "IDLETIME":
+			if i+1 >= len(args) || freq {
+				return errSyntax
+			}
+			idle, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return errNotInteger
+			}
+			if idle < 0 {
+				return fmt.Errorf("Invalid IDLETIME value, must be >= 0")
+			}
+			idleTime = true
+			i++
+		case "FREQ":
+			if i+1 >= len(args) || idleTime {
+				return errSyntax
+			}
+			f, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return errNotInteger
+			}
+			if f < 0 || f > maxRestoreFreq {
+				return fmt.Errorf("Invalid FREQ value, must be >= 0 and <= %d", maxRestoreFreq)
+			}
+			freq = true
+			i++
+		default:
+			return errSyntax
+		}
+	}
+	if _, found := c.Store.lookup(key); found && !replace {
+		return ReplyError{"BUSYKEY", "Target key name already exists."}
+	}
+	val, err := restoreValue(payload)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("RESTORE %s command received.", key)
+
+	var expiration time.Time
+	if ttl > 0 {
+		if absTTL {
+			expiration = time.UnixMilli(ttl).UTC()
+		} else {
+			expiration = time.Now().UTC().Add(time.Duration(ttl) * time.Millisecond)
+		}
+		if expiration.Before(time.Now().UTC()) {
+			// The key would expire at once, so it is only deleted.
+			c.replicateEffects(Command{"DEL", []string{key}})
+			c.Store.storeResult(key, nil, false, notifyGeneric, "restore")
+			return c.send(okResponse)
+		}
+		// Replicas are given the expiration time rather than the TTL.
+		effect := []string{key, strconv.FormatInt(expiration.UnixMilli(), 10), payload, "ABSTTL"}
+		if replace {
+			effect = append(effect, "REPLACE")
+		}
+		c.replicateEffects(Command{"RESTORE", effect})
+	}
+	c.Store.setKey(key, val, expiration)
+	c.Store.notify(notifyGeneric, "restore", key)
+	return c.send(okResponse)
+}
+
+// handleMigrate handles MIGRATE commands. Keys are sent to the target with
+// RESTORE and, unless COPY is given, deleted once the target accepted
+// them. The store stays locked for the whole transfer, so other clients
+// never see a key in both places or in neither.
+func (c *ClientHandler) handleMigrate(args []string) error {
+	if len(args) < 5 {
+		return fmt.Errorf("insufficient number of arguments for MIGRATE")
+	}
+	// Replicas only delete the keys that were moved.
+	c.replicateEffects()
+	host, port, db := args[0], args[1], args[3]
+	keys := []string{args[2]}
+	if _, err := strconv.Atoi(db); err != nil {
+		return errNotInteger
+	}
+	timeout, err := strconv.Atoi(args[4])
+	if err != nil {
+		return errNotInteger
+	}
+	if timeout <= 0 {
+		timeout = defaultMigrateTimeout
+	}
+	copyKeys, replace := false, false
+	var auth []string
+	for i := 5; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COPY":
+			copyKeys = true
+		case "REPLACE":
+			replace = true
+		case "AUTH":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			auth = []string{"AUTH", args[i+1]}
+			i++
+		case "AUTH2":
+			if i+2 >= len(args) {
+				return errSyntax
+			}
+			auth = []string{"AUTH", args[i+1], args[i+2]}
+			i += 2
+		case "KEYS":
+			if args[2] != "" {
+				return fmt.Errorf("When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			keys = args[i+1:]
+			i = len(args)
+		default:
+			return errSyntax
+		}
+	}
+	fmt.Printf("MIGRATE %s:%s command received.", host, port)
+
+	// Each key is dumped up front, along with its remaining time to live.
+	type migration struct {
+		key     string
+		ttl     int64
+		payload string
+	}
+	var migrations []migration
+	for _, key := range keys {
+		val, found := c.Store.lookup(key)
+		if !found {
+			continue
+		}
+		var ttl int64
+		if exp, ok := c.Store.expiry[key]; ok {
+			ttl = max(time.Until(exp).Milliseconds(), 1)
+		}
+		payload, err := dumpValue(val)
+		if err != nil {
+			return err
+		}
+		migrations = append(migrations, migration{key, ttl, payload})
+	}
+	if len(migrations) == 0 {
+		return c.send(encodeSimpleString("NOKEY"))
+	}
+
+	deadline := time.Duration(timeout) * time.Millisecond
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), deadline)
+	if err != nil {
+		return ReplyError{"IOERR", "error or timeout connecting to the client"}
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(deadline))
+
+	var commands [][]string
+	if auth != nil {
+		commands = append(commands, auth)
+	}
+	if db != "0" {
+		commands = append(commands, []string{"SELECT", db})
+	}
+	for _, m := range migrations {
+		cmd := []string{"RESTORE", m.key, strconv.FormatInt(m.ttl, 10), m.payload}
+		if replace {
+			cmd = append(cmd, "REPLACE")
+		}
+		commands = append(commands, cmd)
+	}
+	var out strings.Builder
+	for _, cmd := range commands {
+		out.WriteString(encodeBulkStringArray(len(cmd), cmd...))
+	}
+	if _, err := conn.Write([]byte(out.String())); err != nil {
+		return ReplyError{"IOERR", "error or timeout writing to target instance"}
+	}
+
+	// A failed AUTH or SELECT stops the migration. Otherwise every RESTORE
+	// reply is read, so that keys the target accepted are deleted even if
+	// others were refused.
+	r := bufio.NewReader(conn)
+	first := len(commands) - len(migrations)
+	var replyErr error
+	var deleted []string
+	for i := range commands {
+		line, err := readLine(r)
+		if err != nil {
+			return ReplyError{"IOERR", "error or timeout reading to target instance"}
+		}
+		if strings.HasPrefix(line, "-") {
+			replyErr = fmt.Errorf("Target instance replied with error: %s", line[1:])
+			if i < first {
+				return replyErr
+			}
+			continue
+		}
+		if i >= first && !copyKeys {
+			c.Store.remove(migrations[i-first].key)
+			c.Store.notify(notifyGeneric, "del", migrations[i-first].key)
+			deleted = append(deleted, migrations[i-first].key)
+		}
+	}
+	if len(deleted) > 0 {
+		c.replicateEffects(Command{"DEL", deleted})
+	}
+	if replyErr != nil {
+		return replyErr
+	}
+	return c.send(okResponse)
+}
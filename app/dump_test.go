@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestCRC64Jones(t *testing.T) {
+	tests := []struct {
+		data string
+		want uint64
+	}{
+		{"", 0},
+		{"123456789", 0xe9c6d914c4b8d9ca},
+	}
+	for _, tt := range tests {
+		if got := crc64Jones([]byte(tt.data)); got != tt.want {
+			t.Errorf("crc64Jones(%q) = %#x, want %#x", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestDumpRoundTrip(t *testing.T) {
+	set := NewSet()
+	for _, m := range []string{"a", "b", "c"} {
+		set.Add(m)
+	}
+	intset := NewSet()
+	for _, m := range []string{"3", "-1", "20"} {
+		intset.Add(m)
+	}
+	hash := NewHash()
+	hash.Set("f1", "v1")
+	hash.Set("f2", "v2")
+	zset := NewZSet()
+	zset.Set("one", 1)
+	zset.Set("two", 2.5)
+
+	tests := []struct {
+		name string
+		val  any
+		view func(any) any // what must survive the round trip
+	}{
+		{"string", "hello", func(v any) any { return v }},
+		{"integer string", "12345", func(v any) any { return v }},
+		{"empty string", "", func(v any) any { return v }},
+		{"list", NewList([]string{"x", "y", "x"}), func(v any) any { return v.(*List).Elements() }},
+		{"set", set, func(v any) any { return sortedMembers(v.(*Set)) }},
+		{"intset", intset, func(v any) any { return sortedMembers(v.(*Set)) }},
+		{"hash", hash, func(v any) any { return v.(*Hash).fields }},
+		{"zset", zset, func(v any) any { return v.(*ZSet).Entries() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := dumpValue(tt.val)
+			if err != nil {
+				t.Fatalf("dumpValue: %v", err)
+			}
+			got, err := restoreValue(payload)
+			if err != nil {
+				t.Fatalf("restoreValue: %v", err)
+			}
+			if !reflect.DeepEqual(tt.view(got), tt.view(tt.val)) {
+				t.Errorf("round trip gave %v, want %v", tt.view(got), tt.view(tt.val))
+			}
+		})
+	}
+}
+
+func TestRestoreRedisPayload(t *testing.T) {
+	// DUMP of the integer 10 from the Redis documentation, RDB version 9.
+	val, err := restoreValue("\x00\xc0\n\t\x00\xbem\x06\x89Z(\x00\n")
+	if err != nil {
+		t.Fatalf("restoreValue: %v", err)
+	}
+	if val != "10" {
+		t.Errorf("restoreValue = %q, want %q", val, "10")
+	}
+}
+
+func TestRestoreRejectsBadPayloads(t *testing.T) {
+	payload, err := dumpValue("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := []byte(payload)
+	corrupt[1] ^= 0xff
+	// A payload from a newer RDB version, with a valid checksum.
+	newer := []byte(payload[:len(payload)-8])
+	newer[len(newer)-2] = dumpRDBVersion + 1
+	newer = binary.LittleEndian.AppendUint64(newer, crc64Jones(newer))
+
+	tests := []struct {
+		name    string
+		payload string
+	}{
+		{"empty", ""},
+		{"truncated", payload[:len(payload)-1]},
+		{"corrupt body", string(corrupt)},
+		{"newer version", string(newer)},
+	}
+	for _, tt := range tests {
+		if _, err := restoreValue(tt.payload); err == nil {
+			t.Errorf("%s: restoreValue succeeded", tt.name)
+		}
+	}
+}
+
+func sortedMembers(s *Set) []string {
+	members := s.Members()
+	slices.Sort(members)
+	return members
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const functionLoadTimeout = 500 * time.Millisecond // time a library may take to load
+
+// functionFlags are the flags a function may be registered with.
+var functionFlags = []string{"no-writes", "allow-oom", "allow-stale", "no-cluster", "allow-cross-slot-keys"}
+
+// functionLibrary is a library loaded with FUNCTION LOAD. Its code is kept
+// so that it can be listed, dumped and saved.
+type functionLibrary struct {
+	name      string
+	code      string
+	functions []*libraryFunction // in registration order
+}
+
+// libraryFunction is a function registered by a library with
+// redis.register_function.
+type libraryFunction struct {
+	name        string
+	description string
+	flags       []string
+	callback    any
+	library     *functionLibrary
+}
+
+// functionLibraries holds the loaded libraries and the interpreter their
+// functions run in. Function names are unique across libraries.
+type functionLibraries struct {
+	engine    *scriptEngine
+	lua       *luaState
+	libraries map[string]*functionLibrary
+	functions map[string]*libraryFunction
+	loading   *functionLibrary // the library whose code is being run by load
+}
+
+func newFunctionLibraries(e *scriptEngine) *functionLibraries {
+	fl := &functionLibraries{engine: e}
+	fl.reset()
+	return fl
+}
+
+// reset drops every library and starts over with a fresh interpreter.
+func (fl *functionLibraries) reset() {
+	fl.libraries = make(map[string]*functionLibrary)
+	fl.functions = make(map[string]*libraryFunction)
+	fl.lua = fl.engine.newLuaState("user_function")
+	redis := fl.lua.globals.get("redis").(*luaTable)
+	fl.lua.register(redis, "register_function", fl.registerFunction)
+}
+
+// sorted returns the libraries ordered by name.
+func (fl *functionLibraries) sorted() []*functionLibrary {
+	libs := make([]*functionLibrary, 0, len(fl.libraries))
+	for _, lib := range fl.libraries {
+		libs = append(libs, lib)
+	}
+	sort.Slice(libs, func(i, j int) bool { return libs[i].name < libs[j].name })
+	return libs
+}
+
+// isValidFunctionName reports whether name only has letters, digits and
+// underscores, as required of library and function names.
+func isValidFunctionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isLuaNameChar(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseLibraryMetadata returns the library name given by the first line of
+// a library's code, like #!lua name=mylib.
+func parseLibraryMetadata(code string) (string, error) {
+	first, _, _ := strings.Cut(code, "\n")
+	if !strings.HasPrefix(first, "#!") {
+		return "", errors.New("Missing library metadata")
+	}
+	parts := strings.Fields(first[2:])
+	if len(parts) == 0 || parts[0] != "lua" {
+		engine := ""
+		if len(parts) > 0 {
+			engine = parts[0]
+		}
+		return "", fmt.Errorf("Engine '%s' not found", engine)
+	}
+	name := ""
+	for _, part := range parts[1:] {
+		key, val, found := strings.Cut(part, "=")
+		if !found || key != "name" {
+			return "", fmt.Errorf("Invalid metadata value given: %s", part)
+		}
+		name = val
+	}
+	if name == "" {
+		return "", errors.New("Library name was not given")
+	}
+	if !isValidFunctionName(name) {
+		return "", errors.New("Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	return name, nil
+}
+
+// load runs a library's code, which registers its functions, and adds the
+// library. An existing library of the same name is replaced if replace is
+// set. Nothing changes if loading fails.
+func (fl *functionLibraries) load(code string, replace bool) (string, error) {
+	name, err := parseLibraryMetadata(code)
+	if err != nil {
+		return "", err
+	}
+	old := fl.libraries[name]
+	if old != nil && !replace {
+		return "", fmt.Errorf("Library '%s' already exists", name)
+	}
+	proto, err := luaCompile(code, "user_function")
+	if err != nil {
+		return "", fmt.Errorf("Error compiling function: %v", err)
+	}
+
+	lib := &functionLibrary{name: name, code: code}
+	deadline := time.Now().Add(functionLoadTimeout)
+	fl.loading = lib
+	fl.lua.hook = func() {
+		if time.Now().After(deadline) {
+			panic(&luaFatalError{errors.New("FUNCTION LOAD timeout")})
+		}
+	}
+	_, err = fl.lua.run(&luaClosure{proto: proto}, nil)
+	fl.loading = nil
+	fl.lua.hook = fl.engine.check
+	if err != nil {
+		return "", fmt.Errorf("Error registering functions: %v", err)
+	}
+	if len(lib.functions) == 0 {
+		return "", errors.New("No functions registered")
+	}
+	for _, fn := range lib.functions {
+		if other, ok := fl.functions[fn.name]; ok && other.library != old {
+			return "", fmt.Errorf("Function %s already exists", fn.name)
+		}
+	}
+
+	if old != nil {
+		fl.remove(old)
+	}
+	fl.libraries[name] = lib
+	for _, fn := range lib.functions {
+		fl.functions[fn.name] = fn
+	}
+	return name, nil
+}
+
+func (fl *functionLibraries) remove(lib *functionLibrary) {
+	delete(fl.libraries, lib.name)
+	for _, fn := range lib.functions {
+		delete(fl.functions, fn.name)
+	}
+}
+
+// registerFunction implements redis.register_function, which takes either
+// a name and a callback, or a table of named arguments.
+func (fl *functionLibraries) registerFunction(L *luaState, args []any) []any {
+	if fl.loading == nil {
+		L.errorf(L.line, "redis.register_function can only be called on FUNCTION LOAD command")
+	}
+	fn := &libraryFunction{library: fl.loading}
+	switch arg := luaArg(args, 0).(type) {
+	case string:
+		if len(args) != 2 {
+			L.errorf(L.line, "wrong number of arguments to redis.register_function")
+		}
+		fn.name, fn.callback = arg, args[1]
+	case *luaTable:
+		if len(args) != 1 {
+			L.errorf(L.line, "wrong number of arguments to redis.register_function")
+		}
+		var key any
+		for {
+			var val any
+			key, val, _ = arg.next(key)
+			if key == nil {
+				break
+			}
+			switch key {
+			case "function_name":
+				name, ok := val.(string)
+				if !ok {
+					L.errorf(L.line, "function_name argument given to redis.register_function must be a string")
+				}
+				fn.name = name
+			case "description":
+				desc, ok := val.(string)
+				if !ok {
+					L.errorf(L.line, "description argument given to redis.register_function must be a string")
+				}
+				fn.description = desc
+			case "callback":
+				fn.callback = val
+			case "flags":
+				fn.flags = fl.checkFlags(L, val)
+			default:
+				L.errorf(L.line, "unknown argument given to redis.register_function")
+			}
+		}
+	default:
+		L.errorf(L.line, "calling redis.register_function with a single argument is only applicable to Lua table (representing named arguments).")
+	}
+
+	if !isValidFunctionName(fn.name) {
+		L.errorf(L.line, "Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	switch fn.callback.(type) {
+	case *luaClosure, *luaGoFunction:
+	default:
+		L.errorf(L.line, "callback argument given to redis.register_function must be a function")
+	}
+	for _, other := range fl.loading.functions {
+		if other.name == fn.name {
+			L.errorf(L.line, "Function already exists in the library")
+		}
+	}
+	fl.loading.functions = append(fl.loading.functions, fn)
+	return nil
+}
+
+func (fl *functionLibraries) checkFlags(L *luaState, val any) []string {
+	t, ok := val.(*luaTable)
+	if !ok {
+		L.errorf(L.line, "flags argument to redis.register_function must be a table representing function flags")
+	}
+	var flags []string
+	for i := 1; i <= t.length(); i++ {
+		flag, ok := t.get(float64(i)).(string)
+		if !ok || !slices.Contains(functionFlags, flag) {
+			L.errorf(L.line, "unknown flag given")
+		}
+		flags = append(flags, flag)
+	}
+	return flags
+}
+
+// dump serializes every library the way FUNCTION DUMP does: the libraries'
+// code as in an RDB file, with the DUMP payload footer.
+func (fl *functionLibraries) dump() (string, error) {
+	var buf bytes.Buffer
+	rw := newRDBWriter(&buf)
+	rw.writeFunctions(fl)
+	return rw.finishDump(&buf)
+}
+
+// writeFunctions writes the code of every library.
+func (rw *rdbWriter) writeFunctions(fl *functionLibraries) {
+	for _, lib := range fl.sorted() {
+		rw.w.WriteByte(opCodeFunction2)
+		rw.writeString(lib.code)
+	}
+}
+
+// restore loads the libraries of a FUNCTION DUMP payload. With the FLUSH
+// policy every library is dropped first, with REPLACE libraries of the same
+// name are replaced, and with APPEND they make the restore fail. Nothing
+// changes if any library fails to load.
+func (fl *functionLibraries) restore(payload, policy string) error {
+	r := openDump(payload)
+	if r == nil {
+		return errors.New("payload version or checksum are wrong")
+	}
+	var codes []string
+	for {
+		opcode, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil || opcode != opCodeFunction2 {
+			return errors.New("given type is not a function")
+		}
+		code, err := readString(r)
+		if err != nil {
+			return errors.New("payload version or checksum are wrong")
+		}
+		codes = append(codes, code)
+	}
+
+	libraries, functions, lua := fl.libraries, fl.functions, fl.lua
+	if policy == "FLUSH" {
+		fl.reset()
+	} else {
+		fl.libraries = make(map[string]*functionLibrary, len(libraries))
+		for name, lib := range libraries {
+			fl.libraries[name] = lib
+		}
+		fl.functions = make(map[string]*libraryFunction, len(functions))
+		for name, fn := range functions {
+			fl.functions[name] = fn
+		}
+	}
+	for _, code := range codes {
+		if _, err := fl.load(code, policy == "REPLACE"); err != nil {
+			fl.libraries, fl.functions, fl.lua = libraries, functions, lua
+			return err
+		}
+	}
+	return nil
+}
+
+// handleFcall handles FCALL and FCALL_RO commands.
+func (c *ClientHandler) handleFcall(args []string, readOnly bool) error {
+	numKeys, err := parseNumKeys(args)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("FCALL %s command received.", args[0])
+	e := c.Server.scripts
+	fn := e.functions.functions[args[0]]
+	if fn == nil {
+		return errors.New("Function not found")
+	}
+	noWrites := slices.Contains(fn.flags, "no-writes")
+	if readOnly && !noWrites {
+		return errors.New("Can not execute a script with write flag using *_ro command.")
+	}
+	fnArgs := []any{luaStringArray(args[2 : 2+numKeys]), luaStringArray(args[2+numKeys:])}
+	return e.run(c, e.functions.lua, fn.callback, fn.name, fnArgs, true, readOnly || noWrites)
+}
+
+// handleFunction handles FUNCTION commands. Commands that change the
+// libraries are sent on to replicas.
+func (c *ClientHandler) handleFunction(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("insufficient number of arguments for FUNCTION")
+	}
+	fl := c.Server.scripts.functions
+	subCmd := strings.ToUpper(args[0])
+	fmt.Printf("FUNCTION %s command received.", subCmd)
+	switch subCmd {
+	case "LOAD":
+		replace := len(args) == 3 && strings.EqualFold(args[1], "REPLACE")
+		if len(args) != 2 && !replace {
+			return errSyntax
+		}
+		name, err := fl.load(args[len(args)-1], replace)
+		if err != nil {
+			return err
+		}
+		c.replicateEffects(Command{"FUNCTION", args})
+		return c.send(encodeBulkString(name))
+	case "LIST":
+		return c.functionList(fl, args[1:])
+	case "DELETE":
+		if len(args) != 2 {
+			return fmt.Errorf("wrong number of arguments for FUNCTION DELETE")
+		}
+		lib := fl.libraries[args[1]]
+		if lib == nil {
+			return errors.New("Library not found")
+		}
+		fl.remove(lib)
+		c.replicateEffects(Command{"FUNCTION", args})
+		return c.send(okResponse)
+	case "FLUSH":
+		if len(args) > 2 || (len(args) == 2 && !strings.EqualFold(args[1], "ASYNC") && !strings.EqualFold(args[1], "SYNC")) {
+			return errSyntax
+		}
+		fl.reset()
+		c.replicateEffects(Command{"FUNCTION", args})
+		return c.send(okResponse)
+	case "DUMP":
+		if len(args) != 1 {
+			return fmt.Errorf("wrong number of arguments for FUNCTION DUMP")
+		}
+		payload, err := fl.dump()
+		if err != nil {
+			return err
+		}
+		return c.send(encodeBulkString(payload))
+	case "RESTORE":
+		if len(args) != 2 && len(args) != 3 {
+			return fmt.Errorf("wrong number of arguments for FUNCTION RESTORE")
+		}
+		policy := "APPEND"
+		if len(args) == 3 {
+			policy = strings.ToUpper(args[2])
+			if policy != "APPEND" && policy != "REPLACE" && policy != "FLUSH" {
+				return errors.New("Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.")
+			}
+		}
+		if err := fl.restore(args[1], policy); err != nil {
+			return err
+		}
+		c.replicateEffects(Command{"FUNCTION", args})
+		return c.send(okResponse)
+	case "KILL":
+		if len(args) != 1 {
+			return fmt.Errorf("wrong number of arguments for FUNCTION KILL")
+		}
+		// The store is locked, so no function is running.
+		if err := c.Server.scripts.kill(true); err != nil {
+			return err
+		}
+		return c.send(okResponse)
+	}
+	return fmt.Errorf("unknown subcommand %q for FUNCTION", args[0])
+}
+
+// functionList replies to FUNCTION LIST [WITHCODE] [LIBRARYNAME pattern].
+func (c *ClientHandler) functionList(fl *functionLibraries, args []string) error {
+	withCode := false
+	pattern := ""
+	for i := 0; i < len(args); i++ {
+		switch {
+		case strings.EqualFold(args[i], "WITHCODE"):
+			withCode = true
+		case strings.EqualFold(args[i], "LIBRARYNAME") && i+1 < len(args):
+			pattern = args[i+1]
+			i++
+		default:
+			return fmt.Errorf("Unknown argument %s", args[i])
+		}
+	}
+
+	var libs []string
+	for _, lib := range fl.sorted() {
+		if pattern != "" && !stringMatch(pattern, lib.name, false) {
+			continue
+		}
+		functions := make([]string, len(lib.functions))
+		for i, fn := range lib.functions {
+			desc := nullResponse
+			if fn.description != "" {
+				desc = encodeBulkString(fn.description)
+			}
+			functions[i] = encodeArray(
+				encodeBulkString("name"), encodeBulkString(fn.name),
+				encodeBulkString("description"), desc,
+				encodeBulkString("flags"), encodeBulkStringArray(len(fn.flags), fn.flags...),
+			)
+		}
+		fields := []string{
+			encodeBulkString("library_name"), encodeBulkString(lib.name),
+			encodeBulkString("engine"), encodeBulkString("LUA"),
+			encodeBulkString("functions"), encodeArray(functions...),
+		}
+		if withCode {
+			fields = append(fields, encodeBulkString("library_code"), encodeBulkString(lib.code))
+		}
+		libs = append(libs, encodeArray(fields...))
+	}
+	return c.send(encodeArray(libs...))
+}
@@ -0,0 +1,759 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Geospatial indexes are sorted sets whose scores are 52-bit geohashes of
+// the members' coordinates, interleaving 26 bits of latitude with 26 bits of
+// longitude, as in Redis.
+const (
+	geoStepMax        = 26
+	geoLatMin         = -85.05112878
+	geoLatMax         = 85.05112878
+	geoLongMin        = -180.0
+	geoLongMax        = 180.0
+	earthRadiusMeters = 6372797.560856
+	mercatorMax       = 20037726.37
+	geoAlphabet       = "0123456789bcdefghjkmnpqrstuvwxyz"
+)
+
+// geohashRange is the span of one coordinate covered by a geohash cell.
+type geohashRange struct {
+	min, max float64
+}
+
+var (
+	geoLongRange = geohashRange{geoLongMin, geoLongMax}
+	geoLatRange  = geohashRange{geoLatMin, geoLatMax}
+)
+
+// geohashBits is a geohash of step bits per coordinate.
+type geohashBits struct {
+	bits uint64
+	step uint
+}
+
+// isZero reports whether h is an excluded search area.
+func (h geohashBits) isZero() bool {
+	return h.bits == 0 && h.step == 0
+}
+
+// geohashArea is the cell described by a geohash.
+type geohashArea struct {
+	hash      geohashBits
+	long, lat geohashRange
+}
+
+// interleave64 spreads the bits of x over the even bits and those of y
+// over the odd bits of the result.
+func interleave64(x, y uint32) uint64 {
+	var result uint64
+	for i := 0; i < 32; i++ {
+		result |= uint64(x>>i&1) << (2 * i)
+		result |= uint64(y>>i&1) << (2*i + 1)
+	}
+	return result
+}
+
+// deinterleave64 reverses interleave64, returning x in the low 32 bits and
+// y in the high 32 bits.
+func deinterleave64(interleaved uint64) uint64 {
+	var x, y uint64
+	for i := 0; i < 32; i++ {
+		x |= (interleaved >> (2 * i) & 1) << i
+		y |= (interleaved >> (2*i + 1) & 1) << i
+	}
+	return x | y<<32
+}
+
+// geohashEncode computes the geohash of a position within the given
+// coordinate ranges.
+func geohashEncode(longRange, latRange geohashRange, long, lat float64, step uint) (geohashBits, bool) {
+	if long > geoLongMax || long < geoLongMin || lat > geoLatMax || lat < geoLatMin {
+		return geohashBits{}, false
+	}
+	if long < longRange.min || long > longRange.max || lat < latRange.min || lat > latRange.max {
+		return geohashBits{}, false
+	}
+	latOffset := (lat - latRange.min) / (latRange.max - latRange.min)
+	longOffset := (long - longRange.min) / (longRange.max - longRange.min)
+	latOffset *= float64(uint64(1) << step)
+	longOffset *= float64(uint64(1) << step)
+	return geohashBits{interleave64(uint32(latOffset), uint32(longOffset)), step}, true
+}
+
+// geohashDecode returns the cell described by a geohash.
+func geohashDecode(longRange, latRange geohashRange, h geohashBits) geohashArea {
+	sep := deinterleave64(h.bits)
+	latScale := latRange.max - latRange.min
+	longScale := longRange.max - longRange.min
+	ilat := float64(uint32(sep))
+	ilong := float64(uint32(sep >> 32))
+	cells := float64(uint64(1) << h.step)
+	return geohashArea{
+		hash: h,
+		lat:  geohashRange{latRange.min + ilat/cells*latScale, latRange.min + (ilat+1)/cells*latScale},
+		long: geohashRange{longRange.min + ilong/cells*longScale, longRange.min + (ilong+1)/cells*longScale},
+	}
+}
+
+// center returns the coordinates at the middle of the cell.
+func (a geohashArea) center() (float64, float64) {
+	long := min(max((a.long.min+a.long.max)/2, geoLongMin), geoLongMax)
+	lat := min(max((a.lat.min+a.lat.max)/2, geoLatMin), geoLatMax)
+	return long, lat
+}
+
+// geoDecodeScore returns the coordinates stored in a sorted set score.
+func geoDecodeScore(score float64) (float64, float64) {
+	h := geohashBits{uint64(score), geoStepMax}
+	return geohashDecode(geoLongRange, geoLatRange, h).center()
+}
+
+// geohashString returns the standard 11 character geohash of the position
+// stored in a sorted set score, as GEOHASH reports it.
+func geohashString(score float64) string {
+	// Standard geohashes cover latitudes up to +/-90 degrees.
+	long, lat := geoDecodeScore(score)
+	h, _ := geohashEncode(geoLongRange, geohashRange{-90, 90}, long, lat, geoStepMax)
+	buf := make([]byte, 11)
+	for i := range buf {
+		idx := 0
+		if i < 10 {
+			idx = int(h.bits >> (52 - (i+1)*5) & 0x1f)
+		}
+		buf[i] = geoAlphabet[idx]
+	}
+	return string(buf)
+}
+
+// geohashMoveX moves a geohash d cells east (d > 0) or west (d < 0).
+func geohashMoveX(h geohashBits, d int) geohashBits {
+	x := h.bits & 0xaaaaaaaaaaaaaaaa
+	y := h.bits & 0x5555555555555555
+	zz := uint64(0x5555555555555555) >> (64 - h.step*2)
+	if d > 0 {
+		x += zz + 1
+	} else {
+		x |= zz
+		x -= zz + 1
+	}
+	x &= 0xaaaaaaaaaaaaaaaa >> (64 - h.step*2)
+	return geohashBits{x | y, h.step}
+}
+
+// geohashMoveY moves a geohash d cells north (d > 0) or south (d < 0).
+func geohashMoveY(h geohashBits, d int) geohashBits {
+	x := h.bits & 0xaaaaaaaaaaaaaaaa
+	y := h.bits & 0x5555555555555555
+	zz := uint64(0xaaaaaaaaaaaaaaaa) >> (64 - h.step*2)
+	if d > 0 {
+		y += zz + 1
+	} else {
+		y |= zz
+		y -= zz + 1
+	}
+	y &= 0x5555555555555555 >> (64 - h.step*2)
+	return geohashBits{x | y, h.step}
+}
+
+// geohashNeighbors returns the cell and its eight neighbours, in the order
+// centre, N, S, E, W, NE, NW, SE, SW.
+func geohashNeighbors(h geohashBits) [9]geohashBits {
+	north, south := geohashMoveY(h, 1), geohashMoveY(h, -1)
+	return [9]geohashBits{
+		h, north, south,
+		geohashMoveX(h, 1), geohashMoveX(h, -1),
+		geohashMoveX(north, 1), geohashMoveX(north, -1),
+		geohashMoveX(south, 1), geohashMoveX(south, -1),
+	}
+}
+
+// geohashEstimateSteps picks a geohash precision whose cells are roughly
+// the size of the search radius.
+func geohashEstimateSteps(rangeMeters, lat float64) uint {
+	if rangeMeters == 0 {
+		return geoStepMax
+	}
+	step := 1
+	for rangeMeters < mercatorMax {
+		rangeMeters *= 2
+		step++
+	}
+	step -= 2
+	// Cells get narrower near the poles.
+	if lat > 66 || lat < -66 {
+		step--
+		if lat > 80 || lat < -80 {
+			step--
+		}
+	}
+	return uint(min(max(step, 1), geoStepMax))
+}
+
+// geohashDistance returns the distance in meters between two positions
+// using the haversine formula.
+func geohashDistance(long1, lat1, long2, lat2 float64) float64 {
+	lat1r, long1r := lat1*math.Pi/180, long1*math.Pi/180
+	lat2r, long2r := lat2*math.Pi/180, long2*math.Pi/180
+	u := math.Sin((lat2r - lat1r) / 2)
+	v := math.Sin((long2r - long1r) / 2)
+	a := u*u + math.Cos(lat1r)*math.Cos(lat2r)*v*v
+	return 2 * earthRadiusMeters * math.Asin(math.Sqrt(a))
+}
+
+// geoShape is the area searched by GEOSEARCH: a circle or a box around a
+// centre. Sizes are in meters.
+type geoShape struct {
+	long, lat     float64
+	box           bool
+	radius        float64
+	width, height float64
+	conversion    float64 // meters per unit of the reply
+}
+
+// distance returns the distance from the centre of the shape to a position,
+// and false if the position lies outside the shape.
+func (s geoShape) distance(long, lat float64) (float64, bool) {
+	if !s.box {
+		dist := geohashDistance(s.long, s.lat, long, lat)
+		return dist, dist <= s.radius
+	}
+	latDist := earthRadiusMeters * math.Abs(lat*math.Pi/180-s.lat*math.Pi/180)
+	if latDist > s.height/2 {
+		return 0, false
+	}
+	if geohashDistance(long, lat, s.long, lat) > s.width/2 {
+		return 0, false
+	}
+	return geohashDistance(s.long, s.lat, long, lat), true
+}
+
+// boundingBox returns the minimum longitude, minimum latitude, maximum
+// longitude and maximum latitude enclosing the shape.
+func (s geoShape) boundingBox() (float64, float64, float64, float64) {
+	height, width := s.radius, s.radius
+	if s.box {
+		height, width = s.height/2, s.width/2
+	}
+	latDelta := height / earthRadiusMeters * 180 / math.Pi
+	longDeltaTop := width / earthRadiusMeters / math.Cos((s.lat+latDelta)*math.Pi/180) * 180 / math.Pi
+	longDeltaBottom := width / earthRadiusMeters / math.Cos((s.lat-latDelta)*math.Pi/180) * 180 / math.Pi
+	longDelta := longDeltaTop
+	if s.lat < 0 {
+		longDelta = longDeltaBottom
+	}
+	return s.long - longDelta, s.lat - latDelta, s.long + longDelta, s.lat + latDelta
+}
+
+// searchAreas returns the geohash cells that cover the shape. Cells that
+// cannot contain matches are zero.
+func (s geoShape) searchAreas() [9]geohashBits {
+	radius := s.radius
+	if s.box {
+		radius = math.Hypot(s.width/2, s.height/2)
+	}
+	minLong, minLat, maxLong, maxLat := s.boundingBox()
+	steps := geohashEstimateSteps(radius, s.lat)
+
+	h, _ := geohashEncode(geoLongRange, geoLatRange, s.long, s.lat, steps)
+	neighbors := geohashNeighbors(h)
+	area := geohashDecode(geoLongRange, geoLatRange, h)
+
+	// The estimate may be too precise for the edges of the bounding box.
+	north := geohashDecode(geoLongRange, geoLatRange, neighbors[1])
+	south := geohashDecode(geoLongRange, geoLatRange, neighbors[2])
+	east := geohashDecode(geoLongRange, geoLatRange, neighbors[3])
+	west := geohashDecode(geoLongRange, geoLatRange, neighbors[4])
+	if steps > 1 && (north.lat.max < maxLat || south.lat.min > minLat ||
+		east.long.max < maxLong || west.long.min > minLong) {
+		steps--
+		h, _ = geohashEncode(geoLongRange, geoLatRange, s.long, s.lat, steps)
+		neighbors = geohashNeighbors(h)
+		area = geohashDecode(geoLongRange, geoLatRange, h)
+	}
+
+	// Skip neighbours on the sides the bounding box does not reach.
+	if steps >= 2 {
+		if area.lat.min < minLat {
+			neighbors[2], neighbors[7], neighbors[8] = geohashBits{}, geohashBits{}, geohashBits{}
+		}
+		if area.lat.max > maxLat {
+			neighbors[1], neighbors[5], neighbors[6] = geohashBits{}, geohashBits{}, geohashBits{}
+		}
+		if area.long.min < minLong {
+			neighbors[4], neighbors[8], neighbors[6] = geohashBits{}, geohashBits{}, geohashBits{}
+		}
+		if area.long.max > maxLong {
+			neighbors[3], neighbors[7], neighbors[5] = geohashBits{}, geohashBits{}, geohashBits{}
+		}
+	}
+	return neighbors
+}
+
+// geoPoint is a member found by a geo search.
+type geoPoint struct {
+	member    string
+	score     float64
+	dist      float64
+	long, lat float64
+}
+
+// geoSearch returns the members of z within the shape. If limit is
+// positive, the search stops once that many members are found.
+func geoSearch(z *ZSet, shape geoShape, limit int) []geoPoint {
+	points := []geoPoint{}
+	seen := map[geohashBits]bool{}
+	for _, h := range shape.searchAreas() {
+		if h.isZero() || seen[h] {
+			continue
+		}
+		seen[h] = true
+
+		// Align the cell to a 52-bit score range.
+		shift := 2 * (geoStepMax - h.step)
+		r := scoreRange{
+			min:   float64(h.bits << shift),
+			max:   float64((h.bits + 1) << shift),
+			maxex: true,
+		}
+		for _, entry := range z.RangeBySpec(r, false, 0, -1) {
+			long, lat := geoDecodeScore(entry.score)
+			dist, ok := shape.distance(long, lat)
+			if !ok {
+				continue
+			}
+			points = append(points, geoPoint{entry.member, entry.score, dist, long, lat})
+			if limit > 0 && len(points) >= limit {
+				return points
+			}
+		}
+	}
+	return points
+}
+
+// parseGeoUnit parses a distance unit, returning its length in meters.
+func parseGeoUnit(arg string) (float64, error) {
+	switch strings.ToLower(arg) {
+	case "m":
+		return 1, nil
+	case "km":
+		return 1000, nil
+	case "ft":
+		return 0.3048, nil
+	case "mi":
+		return 1609.34, nil
+	}
+	return 0, fmt.Errorf("unsupported unit provided. please use M, KM, FT, MI")
+}
+
+// parseLongLat parses a longitude and latitude pair.
+func parseLongLat(longArg, latArg string) (float64, float64, error) {
+	long, err := parseFloat(longArg)
+	if err != nil {
+		return 0, 0, err
+	}
+	lat, err := parseFloat(latArg)
+	if err != nil {
+		return 0, 0, err
+	}
+	if long < geoLongMin || long > geoLongMax || lat < geoLatMin || lat > geoLatMax {
+		return 0, 0, fmt.Errorf("invalid longitude,latitude pair %f,%f", long, lat)
+	}
+	return long, lat, nil
+}
+
+// encodeDistance formats a distance the way GEODIST and WITHDIST do.
+func encodeDistance(meters, conversion float64) string {
+	return strconv.FormatFloat(meters/conversion, 'f', 4, 64)
+}
+
+// encodeCoordinates encodes a longitude and latitude pair.
+func encodeCoordinates(long, lat float64) string {
+	return encodeBulkStringArray(2, formatFloat(long), formatFloat(lat))
+}
+
+// handleGeoAdd handles GEOADD commands.
+func (c *ClientHandler) handleGeoAdd(args []string) error {
+	if len(args) < 4 {
+		return fmt.Errorf("insufficient number of arguments for GEOADD")
+	}
+	key := args[0]
+	args = args[1:]
+
+	var nx, xx, ch bool
+flags:
+	for len(args) > 0 {
+		switch strings.ToUpper(args[0]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "CH":
+			ch = true
+		default:
+			break flags
+		}
+		args = args[1:]
+	}
+	if nx && xx {
+		return fmt.Errorf("XX and NX options at the same time are not compatible")
+	}
+	if len(args) == 0 || len(args)%3 != 0 {
+		return errSyntax
+	}
+
+	scores := make([]float64, 0, len(args)/3)
+	for i := 0; i < len(args); i += 3 {
+		long, lat, err := parseLongLat(args[i], args[i+1])
+		if err != nil {
+			return err
+		}
+		h, _ := geohashEncode(geoLongRange, geoLatRange, long, lat, geoStepMax)
+		scores = append(scores, float64(h.bits))
+	}
+	fmt.Printf("GEOADD %s command received.", key)
+
+	z, err := c.Store.zset(key, !xx)
+	if err != nil {
+		return err
+	}
+	if z == nil {
+		return c.send(encodeInteger(0))
+	}
+	added, changed := 0, 0
+	for i, score := range scores {
+		member := args[i*3+2]
+		old, exists := z.Score(member)
+		if exists && nx || !exists && xx {
+			continue
+		}
+		if !exists {
+			added++
+		} else if old != score {
+			changed++
+		}
+		z.Set(member, score)
+	}
+	if added+changed > 0 {
+		c.Store.notify(notifyZSet, "zadd", key)
+		c.Store.touch(key)
+	}
+	c.Store.zsetChanged(key, z)
+
+	if ch {
+		return c.send(encodeInteger(added + changed))
+	}
+	return c.send(encodeInteger(added))
+}
+
+// handleGeoPos handles GEOPOS commands.
+func (c *ClientHandler) handleGeoPos(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("insufficient number of arguments for GEOPOS")
+	}
+	z, err := c.Store.zset(args[0], false)
+	if err != nil {
+		return err
+	}
+	result := make([]string, 0, len(args)-1)
+	for _, member := range args[1:] {
+		score, found := 0.0, false
+		if z != nil {
+			score, found = z.Score(member)
+		}
+		if !found {
+			result = append(result, nullArrayResponse)
+			continue
+		}
+		result = append(result, encodeCoordinates(geoDecodeScore(score)))
+	}
+	return c.send(encodeArray(result...))
+}
+
+// handleGeoDist handles GEODIST commands.
+func (c *ClientHandler) handleGeoDist(args []string) error {
+	if len(args) != 3 && len(args) != 4 {
+		return fmt.Errorf("wrong number of arguments for GEODIST")
+	}
+	conversion := 1.0
+	if len(args) == 4 {
+		var err error
+		if conversion, err = parseGeoUnit(args[3]); err != nil {
+			return err
+		}
+	}
+	z, err := c.Store.zset(args[0], false)
+	if err != nil {
+		return err
+	}
+	if z == nil {
+		return c.send(nullResponse)
+	}
+	score1, found1 := z.Score(args[1])
+	score2, found2 := z.Score(args[2])
+	if !found1 || !found2 {
+		return c.send(nullResponse)
+	}
+	long1, lat1 := geoDecodeScore(score1)
+	long2, lat2 := geoDecodeScore(score2)
+	return c.send(encodeBulkString(encodeDistance(geohashDistance(long1, lat1, long2, lat2), conversion)))
+}
+
+// handleGeoHash handles GEOHASH commands, returning standard 11 character
+// geohash strings.
+func (c *ClientHandler) handleGeoHash(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("insufficient number of arguments for GEOHASH")
+	}
+	z, err := c.Store.zset(args[0], false)
+	if err != nil {
+		return err
+	}
+	result := make([]string, 0, len(args)-1)
+	for _, member := range args[1:] {
+		score, found := 0.0, false
+		if z != nil {
+			score, found = z.Score(member)
+		}
+		if !found {
+			result = append(result, nullResponse)
+			continue
+		}
+		result = append(result, encodeBulkString(geohashString(score)))
+	}
+	return c.send(encodeArray(result...))
+}
+
+// geoSearchQuery holds the parsed arguments of GEOSEARCH and
+// GEOSEARCHSTORE.
+type geoSearchQuery struct {
+	fromMember            string
+	hasMember, hasLongLat bool
+	shape                 geoShape
+	hasShape              bool
+	desc, sorted          bool
+	count                 int
+	any                   bool
+	withCoord, withDist   bool
+	withHash, storeDist   bool
+}
+
+// parseGeoSearchQuery parses the arguments following the source key.
+func parseGeoSearchQuery(args []string, store bool) (geoSearchQuery, error) {
+	q := geoSearchQuery{}
+	for i := 0; i < len(args); i++ {
+		need := func(n int) error {
+			if i+n >= len(args) {
+				return errSyntax
+			}
+			return nil
+		}
+		switch opt := strings.ToUpper(args[i]); opt {
+		case "FROMMEMBER":
+			if err := need(1); err != nil {
+				return q, err
+			}
+			q.fromMember, q.hasMember = args[i+1], true
+			i++
+		case "FROMLONLAT":
+			if err := need(2); err != nil {
+				return q, err
+			}
+			long, lat, err := parseLongLat(args[i+1], args[i+2])
+			if err != nil {
+				return q, err
+			}
+			q.shape.long, q.shape.lat, q.hasLongLat = long, lat, true
+			i += 2
+		case "BYRADIUS":
+			if err := need(2); err != nil {
+				return q, err
+			}
+			radius, err := parseFloat(args[i+1])
+			if err != nil {
+				return q, err
+			}
+			if radius < 0 {
+				return q, fmt.Errorf("radius cannot be negative")
+			}
+			if q.shape.conversion, err = parseGeoUnit(args[i+2]); err != nil {
+				return q, err
+			}
+			if q.hasShape {
+				return q, fmt.Errorf("exactly one of BYRADIUS and BYBOX arguments must be provided for GEOSEARCH")
+			}
+			q.shape.radius = radius * q.shape.conversion
+			q.hasShape = true
+			i += 2
+		case "BYBOX":
+			if err := need(3); err != nil {
+				return q, err
+			}
+			width, err := parseFloat(args[i+1])
+			if err != nil {
+				return q, err
+			}
+			height, err := parseFloat(args[i+2])
+			if err != nil {
+				return q, err
+			}
+			if width < 0 || height < 0 {
+				return q, fmt.Errorf("height or width cannot be negative")
+			}
+			if q.shape.conversion, err = parseGeoUnit(args[i+3]); err != nil {
+				return q, err
+			}
+			if q.hasShape {
+				return q, fmt.Errorf("exactly one of BYRADIUS and BYBOX arguments must be provided for GEOSEARCH")
+			}
+			q.shape.box = true
+			q.shape.width, q.shape.height = width*q.shape.conversion, height*q.shape.conversion
+			q.hasShape = true
+			i += 3
+		case "ASC", "DESC":
+			q.sorted, q.desc = true, opt == "DESC"
+		case "COUNT":
+			if err := need(1); err != nil {
+				return q, err
+			}
+			count, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return q, errNotInteger
+			}
+			if count <= 0 {
+				return q, fmt.Errorf("COUNT must be > 0")
+			}
+			q.count = count
+			i++
+			if i+1 < len(args) && strings.ToUpper(args[i+1]) == "ANY" {
+				q.any = true
+				i++
+			}
+		case "WITHCOORD", "WITHDIST", "WITHHASH":
+			if store {
+				return q, errSyntax
+			}
+			q.withCoord = q.withCoord || opt == "WITHCOORD"
+			q.withDist = q.withDist || opt == "WITHDIST"
+			q.withHash = q.withHash || opt == "WITHHASH"
+		case "STOREDIST":
+			if !store {
+				return q, errSyntax
+			}
+			q.storeDist = true
+		default:
+			return q, errSyntax
+		}
+	}
+
+	if q.hasMember == q.hasLongLat {
+		return q, fmt.Errorf("exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCH")
+	}
+	if !q.hasShape {
+		return q, fmt.Errorf("exactly one of BYRADIUS and BYBOX arguments must be provided for GEOSEARCH")
+	}
+	if q.any && q.count == 0 {
+		return q, fmt.Errorf("the ANY argument requires COUNT argument")
+	}
+	// The nearest members are wanted unless any of them will do.
+	if q.count > 0 && !q.sorted && !q.any {
+		q.sorted = true
+	}
+	return q, nil
+}
+
+// handleGeoSearch handles GEOSEARCH and, with store set, GEOSEARCHSTORE
+// commands.
+func (c *ClientHandler) handleGeoSearch(args []string, store bool) error {
+	minArgs := 5
+	if store {
+		minArgs = 6
+	}
+	if len(args) < minArgs {
+		return fmt.Errorf("insufficient number of arguments for GEOSEARCH")
+	}
+	dst := ""
+	if store {
+		dst, args = args[0], args[1:]
+	}
+	q, err := parseGeoSearchQuery(args[1:], store)
+	if err != nil {
+		return err
+	}
+	z, err := c.Store.zset(args[0], false)
+	if err != nil {
+		return err
+	}
+
+	points := []geoPoint{}
+	if z != nil {
+		if q.hasMember {
+			score, found := z.Score(q.fromMember)
+			if !found {
+				return fmt.Errorf("could not decode requested zset member")
+			}
+			q.shape.long, q.shape.lat = geoDecodeScore(score)
+		}
+		limit := 0
+		if q.any {
+			limit = q.count
+		}
+		points = geoSearch(z, q.shape, limit)
+	}
+	if q.sorted {
+		slices.SortStableFunc(points, func(a, b geoPoint) int {
+			if q.desc {
+				a, b = b, a
+			}
+			switch {
+			case a.dist < b.dist:
+				return -1
+			case a.dist > b.dist:
+				return 1
+			}
+			return 0
+		})
+	}
+	if q.count > 0 && len(points) > q.count {
+		points = points[:q.count]
+	}
+
+	if store {
+		result := NewZSet()
+		for _, p := range points {
+			if q.storeDist {
+				result.Set(p.member, p.dist/q.shape.conversion)
+			} else {
+				result.Set(p.member, p.score)
+			}
+		}
+		c.Store.storeResult(dst, result, result.Len() > 0, notifyZSet, "geosearchstore")
+		return c.send(encodeInteger(len(points)))
+	}
+
+	result := make([]string, 0, len(points))
+	for _, p := range points {
+		if !q.withCoord && !q.withDist && !q.withHash {
+			result = append(result, encodeBulkString(p.member))
+			continue
+		}
+		item := []string{encodeBulkString(p.member)}
+		if q.withDist {
+			item = append(item, encodeBulkString(encodeDistance(p.dist, q.shape.conversion)))
+		}
+		if q.withHash {
+			item = append(item, encodeInteger(int(p.score)))
+		}
+		if q.withCoord {
+			item = append(item, encodeCoordinates(p.long, p.lat))
+		}
+		result = append(result, encodeArray(item...))
+	}
+	return c.send(encodeArray(result...))
+}
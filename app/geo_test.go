@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+// Positions and results from the Redis GEOADD, GEODIST and GEOHASH
+// documentation.
+var geoSicily = []struct {
+	member    string
+	long, lat float64
+	score     float64
+	hash      string
+}{
+	{"Palermo", 13.361389, 38.115556, 3479099956230698, "sqc8b49rny0"},
+	{"Catania", 15.087269, 37.502669, 3479447370796909, "sqdtr74hyu0"},
+}
+
+func TestGeohashEncode(t *testing.T) {
+	for _, tt := range geoSicily {
+		h, ok := geohashEncode(geoLongRange, geoLatRange, tt.long, tt.lat, geoStepMax)
+		if !ok {
+			t.Fatalf("%s: geohashEncode failed", tt.member)
+		}
+		if score := float64(h.bits); score != tt.score {
+			t.Errorf("%s: score %.0f, want %.0f", tt.member, score, tt.score)
+		}
+		long, lat := geoDecodeScore(tt.score)
+		if math.Abs(long-tt.long) > 1e-5 || math.Abs(lat-tt.lat) > 1e-5 {
+			t.Errorf("%s: decoded to %f,%f", tt.member, long, lat)
+		}
+		if got := geohashString(tt.score); got != tt.hash {
+			t.Errorf("%s: geohash %s, want %s", tt.member, got, tt.hash)
+		}
+	}
+}
+
+func TestGeohashEncodeOutOfRange(t *testing.T) {
+	tests := []struct {
+		long, lat float64
+	}{
+		{180.1, 0},
+		{-180.1, 0},
+		{0, 85.1},
+		{0, -85.1},
+	}
+	for _, tt := range tests {
+		if _, ok := geohashEncode(geoLongRange, geoLatRange, tt.long, tt.lat, geoStepMax); ok {
+			t.Errorf("geohashEncode(%v, %v) succeeded", tt.long, tt.lat)
+		}
+	}
+}
+
+func TestInterleave(t *testing.T) {
+	tests := []struct {
+		x, y uint32
+		want uint64
+	}{
+		{0, 0, 0},
+		{1, 0, 1},
+		{0, 1, 2},
+		{0xffffffff, 0, 0x5555555555555555},
+		{0, 0xffffffff, 0xaaaaaaaaaaaaaaaa},
+	}
+	for _, tt := range tests {
+		got := interleave64(tt.x, tt.y)
+		if got != tt.want {
+			t.Errorf("interleave64(%#x, %#x) = %#x, want %#x", tt.x, tt.y, got, tt.want)
+		}
+		if back := deinterleave64(got); back != uint64(tt.x)|uint64(tt.y)<<32 {
+			t.Errorf("deinterleave64(%#x) = %#x", got, back)
+		}
+	}
+}
+
+func TestGeohashDistance(t *testing.T) {
+	// GEODIST measures between the positions as stored, not as given.
+	long1, lat1 := geoDecodeScore(geoSicily[0].score)
+	long2, lat2 := geoDecodeScore(geoSicily[1].score)
+	dist := geohashDistance(long1, lat1, long2, lat2)
+	if got := encodeDistance(dist, 1); got != "166274.1516" {
+		t.Errorf("distance = %s m, want 166274.1516", got)
+	}
+}
+
+func TestGeoSearch(t *testing.T) {
+	z := NewZSet()
+	for _, p := range geoSicily {
+		z.Set(p.member, p.score)
+	}
+	tests := []struct {
+		name  string
+		shape geoShape
+		want  []string
+	}{
+		{"small radius", geoShape{long: 15, lat: 37, radius: 100e3}, []string{"Catania"}},
+		{"large radius", geoShape{long: 15, lat: 37, radius: 200e3}, []string{"Catania", "Palermo"}},
+		{"box", geoShape{long: 15, lat: 37, box: true, width: 400e3, height: 400e3}, []string{"Catania", "Palermo"}},
+		{"far away", geoShape{long: 0, lat: 0, radius: 1000e3}, []string{}},
+	}
+	for _, tt := range tests {
+		got := []string{}
+		for _, p := range geoSearch(z, tt.shape, 0) {
+			got = append(got, p.member)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: found %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,797 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reply codes for commands operating on hash field expiration.
+const (
+	hfieldMissing    = -2 // field does not exist
+	hfieldNoTTL      = -1 // field exists but has no expiration time
+	hfieldNotUpdated = 0  // NX/XX/GT/LT condition was not met
+	hfieldUpdated    = 1  // expiration time was set or removed
+	hfieldDeleted    = 2  // expiration time was in the past, field deleted
+)
+
+// Hash is a map of fields to values. Fields can be given an expiration
+// time of their own, independent of the key holding the hash.
+type Hash struct {
+	fields  map[string]string
+	expires map[string]time.Time
+	table   keyTable // fields, for HSCAN
+}
+
+func NewHash() *Hash {
+	return &Hash{fields: make(map[string]string), expires: make(map[string]time.Time)}
+}
+
+// Get returns the value of field, if it exists.
+func (h *Hash) Get(field string) (string, bool) {
+	val, found := h.fields[field]
+	return val, found
+}
+
+// Set stores the value of field and clears any expiration time it had. It
+// returns true if the field is new.
+func (h *Hash) Set(field, val string) bool {
+	_, found := h.fields[field]
+	h.fields[field] = val
+	delete(h.expires, field)
+	if !found {
+		h.table.add(field)
+	}
+	return !found
+}
+
+// Delete removes field, returning true if it existed.
+func (h *Hash) Delete(field string) bool {
+	_, found := h.fields[field]
+	if found {
+		h.table.remove(field)
+	}
+	delete(h.fields, field)
+	delete(h.expires, field)
+	return found
+}
+
+// Len returns the number of fields in the hash.
+func (h *Hash) Len() int {
+	return len(h.fields)
+}
+
+// Expire sets the expiration time of an existing field.
+func (h *Hash) Expire(field string, at time.Time) {
+	if _, found := h.fields[field]; found {
+		h.expires[field] = at
+	}
+}
+
+// Persist removes the expiration time of field, returning true if it had one.
+func (h *Hash) Persist(field string) bool {
+	_, found := h.expires[field]
+	delete(h.expires, field)
+	return found
+}
+
+// ExpireTime returns the expiration time of field, if it has one.
+func (h *Hash) ExpireTime(field string) (time.Time, bool) {
+	at, found := h.expires[field]
+	return at, found
+}
+
+// MinExpire returns the earliest expiration time of any field.
+func (h *Hash) MinExpire() (time.Time, bool) {
+	var min time.Time
+	for _, at := range h.expires {
+		if min.IsZero() || at.Before(min) {
+			min = at
+		}
+	}
+	return min, !min.IsZero()
+}
+
+// IsVolatile returns true if any field has an expiration time.
+func (h *Hash) IsVolatile() bool {
+	return len(h.expires) > 0
+}
+
+// expireFields deletes the fields whose expiration time is before now and
+// returns them.
+func (h *Hash) expireFields(now time.Time) []string {
+	var deleted []string
+	for field, at := range h.expires {
+		if at.Before(now) {
+			h.Delete(field)
+			deleted = append(deleted, field)
+		}
+	}
+	return deleted
+}
+
+// expireHashFields deletes the expired fields of the hash h stored at key,
+// telling replicas to delete them too. It reports whether any expired.
+func (s *Store) expireHashFields(key string, h *Hash, now time.Time) bool {
+	fields := h.expireFields(now)
+	if len(fields) == 0 {
+		return false
+	}
+	s.replicate(append([]string{"HDEL", key}, fields...)...)
+	s.notify(notifyHash, "hexpired", key)
+	return true
+}
+
+// hash returns the hash stored at key with its expired fields removed. If
+// there is no such key, a new hash is created when create is true and nil
+// is returned otherwise.
+func (s *Store) hash(key string, create bool) (*Hash, error) {
+	val, found := s.lookup(key)
+	if !found {
+		if !create {
+			return nil, nil
+		}
+		h := NewHash()
+		s.create(key, h)
+		return h, nil
+	}
+
+	h, ok := val.(*Hash)
+	if !ok {
+		return nil, errWrongType
+	}
+	if h.IsVolatile() && !s.pause.active() && s.expireHashFields(key, h, time.Now().UTC()) {
+		if h.Len() == 0 && !create {
+			s.remove(key)
+			s.notify(notifyGeneric, "del", key)
+			return nil, nil
+		}
+		s.indexKey(key)
+		s.touch(key)
+	}
+	return h, nil
+}
+
+// hashChanged updates the bookkeeping for key after the fields or field
+// expiration times of its hash were modified.
+func (s *Store) hashChanged(key string, h *Hash) {
+	switch {
+	case h.Len() == 0:
+		s.remove(key)
+		s.notify(notifyGeneric, "del", key)
+	case h.IsVolatile():
+		s.volatileHashes[key] = struct{}{}
+		s.indexKey(key)
+	default:
+		delete(s.volatileHashes, key)
+		s.indexKey(key)
+	}
+}
+
+// parseHashFields parses the "FIELDS numfields field [field ...]" argument
+// block used by the hash field expiration commands. With pairs set, each
+// field is followed by a value.
+func parseHashFields(args []string, pairs bool) ([]string, error) {
+	if len(args) < 2 || strings.ToUpper(args[0]) != "FIELDS" {
+		return nil, fmt.Errorf("mandatory argument FIELDS is missing or not at the right position")
+	}
+	numFields, err := strconv.Atoi(args[1])
+	if err != nil || numFields <= 0 {
+		return nil, fmt.Errorf("Parameter `numFields` should be greater than 0")
+	}
+	width := 1
+	if pairs {
+		width = 2
+	}
+	if len(args)-2 != numFields*width {
+		return nil, fmt.Errorf("The `numfields` parameter must match the number of arguments")
+	}
+	return args[2:], nil
+}
+
+// parseExpireTime converts a relative or absolute expiration argument, in
+// the given unit, to a point in time.
+func parseExpireTime(arg string, unit time.Duration, absolute bool) (time.Time, error) {
+	num, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return time.Time{}, errNotInteger
+	}
+	if num < 0 || num > int64(time.Duration(1<<62)/unit) {
+		return time.Time{}, fmt.Errorf("invalid expire time")
+	}
+	if absolute {
+		return time.UnixMilli(num * int64(unit/time.Millisecond)).UTC(), nil
+	}
+	return time.Now().UTC().Add(time.Duration(num) * unit), nil
+}
+
+// handleHSet handles HSET commands.
+func (c *ClientHandler) handleHSet(args []string) error {
+	if len(args) < 3 || len(args)%2 == 0 {
+		return fmt.Errorf("wrong number of arguments for HSET")
+	}
+	key := args[0]
+	fmt.Printf("HSET %s command received.", key)
+	h, err := c.Store.hash(key, true)
+	if err != nil {
+		return err
+	}
+	added := 0
+	for i := 1; i < len(args); i += 2 {
+		if h.Set(args[i], args[i+1]) {
+			added++
+		}
+	}
+	c.Store.notify(notifyHash, "hset", key)
+	c.Store.hashChanged(key, h)
+	c.Store.touch(key)
+	return c.send(encodeInteger(added))
+}
+
+// handleHGet handles HGET commands.
+func (c *ClientHandler) handleHGet(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("wrong number of arguments for HGET")
+	}
+	h, err := c.Store.hash(args[0], false)
+	if err != nil {
+		return err
+	}
+	if h == nil {
+		return c.send(nullResponse)
+	}
+	val, found := h.Get(args[1])
+	if !found {
+		return c.send(nullResponse)
+	}
+	return c.send(encodeBulkString(val))
+}
+
+// handleHMGet handles HMGET commands.
+func (c *ClientHandler) handleHMGet(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("insufficient number of arguments for HMGET")
+	}
+	h, err := c.Store.hash(args[0], false)
+	if err != nil {
+		return err
+	}
+	return c.send(encodeArray(hashValues(h, args[1:])...))
+}
+
+// hashValues encodes the values of the given fields, with null replies for
+// missing fields.
+func hashValues(h *Hash, fields []string) []string {
+	values := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if h == nil {
+			values = append(values, nullResponse)
+			continue
+		}
+		val, found := h.Get(field)
+		if !found {
+			values = append(values, nullResponse)
+			continue
+		}
+		values = append(values, encodeBulkString(val))
+	}
+	return values
+}
+
+// handleHDel handles HDEL commands.
+func (c *ClientHandler) handleHDel(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("insufficient number of arguments for HDEL")
+	}
+	key := args[0]
+	h, err := c.Store.hash(key, false)
+	if err != nil {
+		return err
+	}
+	if h == nil {
+		return c.send(encodeInteger(0))
+	}
+	deleted := 0
+	for _, field := range args[1:] {
+		if h.Delete(field) {
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		c.Store.notify(notifyHash, "hdel", key)
+		c.Store.hashChanged(key, h)
+		c.Store.touch(key)
+	}
+	return c.send(encodeInteger(deleted))
+}
+
+// handleHLen handles HLEN commands.
+func (c *ClientHandler) handleHLen(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("wrong number of arguments for HLEN")
+	}
+	h, err := c.Store.hash(args[0], false)
+	if err != nil {
+		return err
+	}
+	if h == nil {
+		return c.send(encodeInteger(0))
+	}
+	return c.send(encodeInteger(h.Len()))
+}
+
+// handleHExists handles HEXISTS commands.
+func (c *ClientHandler) handleHExists(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("wrong number of arguments for HEXISTS")
+	}
+	h, err := c.Store.hash(args[0], false)
+	if err != nil {
+		return err
+	}
+	if h == nil {
+		return c.send(encodeInteger(0))
+	}
+	if _, found := h.Get(args[1]); found {
+		return c.send(encodeInteger(1))
+	}
+	return c.send(encodeInteger(0))
+}
+
+// handleHGetAll handles HGETALL, HKEYS and HVALS commands.
+func (c *ClientHandler) handleHGetAll(args []string, withFields, withValues bool) error {
+	if len(args) != 1 {
+		return fmt.Errorf("wrong number of arguments for HGETALL")
+	}
+	h, err := c.Store.hash(args[0], false)
+	if err != nil {
+		return err
+	}
+	result := []string{}
+	if h != nil {
+		for field, val := range h.fields {
+			if withFields {
+				result = append(result, field)
+			}
+			if withValues {
+				result = append(result, val)
+			}
+		}
+	}
+	return c.send(encodeBulkStringArray(len(result), result...))
+}
+
+// handleHScan handles HSCAN commands.
+func (c *ClientHandler) handleHScan(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("insufficient number of arguments for HSCAN")
+	}
+	cursor, err := parseCursor(args[1])
+	if err != nil {
+		return err
+	}
+	opts, err := parseScanOptions(args[2:], false)
+	if err != nil {
+		return err
+	}
+	h, err := c.Store.hash(args[0], false)
+	if err != nil {
+		return err
+	}
+	if h == nil {
+		return c.send(encodeScanReply(0, nil))
+	}
+
+	page, next := h.table.scan(cursor, opts.count)
+	result := []string{}
+	for _, field := range page {
+		if opts.matches(field) {
+			result = append(result, field, h.fields[field])
+		}
+	}
+	return c.send(encodeScanReply(next, result))
+}
+
+// handleHExpire handles HEXPIRE, HPEXPIRE, HEXPIREAT and HPEXPIREAT commands.
+func (c *ClientHandler) handleHExpire(args []string, unit time.Duration, absolute bool) error {
+	if len(args) < 4 {
+		return fmt.Errorf("insufficient number of arguments for HEXPIRE")
+	}
+	key := args[0]
+	at, err := parseExpireTime(args[1], unit, absolute)
+	if err != nil {
+		return err
+	}
+
+	var condition string
+	switch opt := strings.ToUpper(args[2]); opt {
+	case "NX", "XX", "GT", "LT":
+		condition = opt
+		args = args[3:]
+	default:
+		args = args[2:]
+	}
+	fields, err := parseHashFields(args, false)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("HEXPIRE %s %v command received.", key, fields)
+
+	h, err := c.Store.hash(key, false)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	var updated, deleted []string
+	result := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if h == nil {
+			result = append(result, encodeInteger(hfieldMissing))
+			continue
+		}
+		if _, found := h.Get(field); !found {
+			result = append(result, encodeInteger(hfieldMissing))
+			continue
+		}
+
+		current, hasTTL := h.ExpireTime(field)
+		met := true
+		switch condition {
+		case "NX":
+			met = !hasTTL
+		case "XX":
+			met = hasTTL
+		case "GT":
+			met = hasTTL && at.After(current)
+		case "LT":
+			met = !hasTTL || at.Before(current)
+		}
+		if !met {
+			result = append(result, encodeInteger(hfieldNotUpdated))
+			continue
+		}
+
+		if !at.After(now) {
+			h.Delete(field)
+			deleted = append(deleted, field)
+			result = append(result, encodeInteger(hfieldDeleted))
+			continue
+		}
+		h.Expire(field, at)
+		updated = append(updated, field)
+		result = append(result, encodeInteger(hfieldUpdated))
+	}
+	c.replicateHashTTL(key, at, updated, deleted)
+	if len(updated) > 0 {
+		c.Store.notify(notifyHash, "hexpire", key)
+	}
+	if len(deleted) > 0 {
+		c.Store.notify(notifyHash, "hdel", key)
+	}
+	if len(updated)+len(deleted) > 0 {
+		c.Store.hashChanged(key, h)
+		c.Store.touch(key)
+	}
+	return c.send(encodeArray(result...))
+}
+
+// replicateHashTTL sends replicas the outcome of a command that set the
+// expiration time of fields to at: the updated fields are given at as
+// HPEXPIREAT, and the deleted ones, whose time had passed, are deleted.
+func (c *ClientHandler) replicateHashTTL(key string, at time.Time, updated, deleted []string) {
+	c.replicateEffects()
+	if len(updated) > 0 {
+		args := []string{key, strconv.FormatInt(at.UnixMilli(), 10), "FIELDS", strconv.Itoa(len(updated))}
+		c.replicateEffects(Command{"HPEXPIREAT", append(args, updated...)})
+	}
+	if len(deleted) > 0 {
+		c.replicateEffects(Command{"HDEL", append([]string{key}, deleted...)})
+	}
+}
+
+// handleHTTL handles HTTL, HPTTL, HEXPIRETIME and HPEXPIRETIME commands.
+func (c *ClientHandler) handleHTTL(args []string, unit time.Duration, absolute bool) error {
+	if len(args) < 3 {
+		return fmt.Errorf("insufficient number of arguments for HTTL")
+	}
+	fields, err := parseHashFields(args[1:], false)
+	if err != nil {
+		return err
+	}
+	h, err := c.Store.hash(args[0], false)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	result := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if h == nil {
+			result = append(result, encodeInteger(hfieldMissing))
+			continue
+		}
+		if _, found := h.Get(field); !found {
+			result = append(result, encodeInteger(hfieldMissing))
+			continue
+		}
+		at, hasTTL := h.ExpireTime(field)
+		switch {
+		case !hasTTL:
+			result = append(result, encodeInteger(hfieldNoTTL))
+		case absolute:
+			result = append(result, encodeInteger(int(at.UnixMilli()/int64(unit/time.Millisecond))))
+		default:
+			// Round up so that a field never reports a TTL of 0 while it
+			// still exists.
+			ttl := at.Sub(now)
+			result = append(result, encodeInteger(int((ttl+unit-1)/unit)))
+		}
+	}
+	return c.send(encodeArray(result...))
+}
+
+// handleHPersist handles HPERSIST commands.
+func (c *ClientHandler) handleHPersist(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("insufficient number of arguments for HPERSIST")
+	}
+	key := args[0]
+	fields, err := parseHashFields(args[1:], false)
+	if err != nil {
+		return err
+	}
+	h, err := c.Store.hash(key, false)
+	if err != nil {
+		return err
+	}
+
+	persisted := 0
+	result := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if h == nil {
+			result = append(result, encodeInteger(hfieldMissing))
+			continue
+		}
+		if _, found := h.Get(field); !found {
+			result = append(result, encodeInteger(hfieldMissing))
+			continue
+		}
+		if h.Persist(field) {
+			persisted++
+			result = append(result, encodeInteger(hfieldUpdated))
+		} else {
+			result = append(result, encodeInteger(hfieldNoTTL))
+		}
+	}
+	if persisted > 0 {
+		c.Store.notify(notifyHash, "hpersist", key)
+		c.Store.hashChanged(key, h)
+		c.Store.touch(key)
+	}
+	return c.send(encodeArray(result...))
+}
+
+// fieldTTLOption is a parsed EX, PX, EXAT, PXAT, PERSIST or KEEPTTL
+// argument of HGETEX and HSETEX.
+type fieldTTLOption struct {
+	at      time.Time // new expiration time, if set is true
+	set     bool
+	persist bool
+	keep    bool
+}
+
+// parseFieldTTLOption parses the expiration option at args[0], if there is
+// one. It returns the number of arguments consumed.
+func parseFieldTTLOption(args []string, opt *fieldTTLOption, allowPersist, allowKeep bool) (int, error) {
+	if len(args) == 0 {
+		return 0, nil
+	}
+	if opt.set || opt.persist || opt.keep {
+		switch strings.ToUpper(args[0]) {
+		case "EX", "PX", "EXAT", "PXAT", "PERSIST", "KEEPTTL":
+			return 0, fmt.Errorf("only one of EX, PX, EXAT, PXAT, PERSIST or KEEPTTL can be given")
+		}
+	}
+
+	var unit time.Duration
+	var absolute bool
+	switch strings.ToUpper(args[0]) {
+	case "EX":
+		unit = time.Second
+	case "PX":
+		unit = time.Millisecond
+	case "EXAT":
+		unit, absolute = time.Second, true
+	case "PXAT":
+		unit, absolute = time.Millisecond, true
+	case "PERSIST":
+		if !allowPersist {
+			return 0, errSyntax
+		}
+		opt.persist = true
+		return 1, nil
+	case "KEEPTTL":
+		if !allowKeep {
+			return 0, errSyntax
+		}
+		opt.keep = true
+		return 1, nil
+	default:
+		return 0, nil
+	}
+
+	if len(args) < 2 {
+		return 0, errSyntax
+	}
+	at, err := parseExpireTime(args[1], unit, absolute)
+	if err != nil {
+		return 0, err
+	}
+	if !absolute && at.Equal(time.Now().UTC()) {
+		return 0, fmt.Errorf("invalid expire time")
+	}
+	opt.at, opt.set = at, true
+	return 2, nil
+}
+
+// handleHGetEx handles HGETEX commands.
+func (c *ClientHandler) handleHGetEx(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("insufficient number of arguments for HGETEX")
+	}
+	key := args[0]
+	args = args[1:]
+
+	var opt fieldTTLOption
+	n, err := parseFieldTTLOption(args, &opt, true, false)
+	if err != nil {
+		return err
+	}
+	fields, err := parseHashFields(args[n:], false)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("HGETEX %s %v command received.", key, fields)
+
+	h, err := c.Store.hash(key, false)
+	if err != nil {
+		return err
+	}
+	result := hashValues(h, fields)
+	c.replicateEffects()
+	if h == nil {
+		return c.send(encodeArray(result...))
+	}
+
+	now := time.Now().UTC()
+	var event string
+	var changed []string
+	for _, field := range fields {
+		if _, found := h.Get(field); !found {
+			continue
+		}
+		switch {
+		case opt.persist:
+			if h.Persist(field) {
+				event = "hpersist"
+				changed = append(changed, field)
+			}
+		case opt.set && !opt.at.After(now):
+			h.Delete(field)
+			event = "hdel"
+			changed = append(changed, field)
+		case opt.set:
+			h.Expire(field, opt.at)
+			event = "hexpire"
+			changed = append(changed, field)
+		}
+	}
+	switch {
+	case opt.persist && len(changed) > 0:
+		c.replicateEffects(Command{"HPERSIST", append([]string{key, "FIELDS", strconv.Itoa(len(changed))}, changed...)})
+	case event == "hdel":
+		c.replicateHashTTL(key, opt.at, nil, changed)
+	case event == "hexpire":
+		c.replicateHashTTL(key, opt.at, changed, nil)
+	}
+	if event != "" {
+		c.Store.notify(notifyHash, event, key)
+		c.Store.hashChanged(key, h)
+		c.Store.touch(key)
+	}
+	return c.send(encodeArray(result...))
+}
+
+// hashPairFields returns the fields of field-value pairs.
+func hashPairFields(pairs []string) []string {
+	fields := make([]string, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		fields = append(fields, pairs[i])
+	}
+	return fields
+}
+
+// handleHSetEx handles HSETEX commands.
+func (c *ClientHandler) handleHSetEx(args []string) error {
+	if len(args) < 4 {
+		return fmt.Errorf("insufficient number of arguments for HSETEX")
+	}
+	key := args[0]
+	args = args[1:]
+
+	var opt fieldTTLOption
+	var condition string
+	for len(args) > 0 {
+		switch upper := strings.ToUpper(args[0]); upper {
+		case "FNX", "FXX":
+			if condition != "" {
+				return errSyntax
+			}
+			condition = upper
+			args = args[1:]
+			continue
+		}
+		n, err := parseFieldTTLOption(args, &opt, false, true)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		args = args[n:]
+	}
+	pairs, err := parseHashFields(args, true)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("HSETEX %s command received.", key)
+
+	h, err := c.Store.hash(key, false)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(pairs); i += 2 {
+		var found bool
+		if h != nil {
+			_, found = h.Get(pairs[i])
+		}
+		if (condition == "FNX" && found) || (condition == "FXX" && !found) {
+			c.replicateEffects()
+			return c.send(encodeInteger(0))
+		}
+	}
+
+	if h == nil {
+		if h, err = c.Store.hash(key, true); err != nil {
+			return err
+		}
+	}
+	now := time.Now().UTC()
+	for i := 0; i < len(pairs); i += 2 {
+		field, val := pairs[i], pairs[i+1]
+		prev, hadTTL := h.ExpireTime(field)
+		h.Set(field, val)
+		switch {
+		case opt.keep && hadTTL:
+			h.Expire(field, prev)
+		case opt.set && !opt.at.After(now):
+			h.Delete(field)
+		case opt.set:
+			h.Expire(field, opt.at)
+		}
+	}
+	c.Store.notify(notifyHash, "hset", key)
+	switch {
+	case opt.set && !opt.at.After(now):
+		c.replicateEffects(Command{"HDEL", append([]string{key}, hashPairFields(pairs)...)})
+		c.Store.notify(notifyHash, "hdel", key)
+	case opt.set:
+		effect := []string{key, "PXAT", strconv.FormatInt(opt.at.UnixMilli(), 10), "FIELDS", strconv.Itoa(len(pairs) / 2)}
+		c.replicateEffects(Command{"HSETEX", append(effect, pairs...)})
+		c.Store.notify(notifyHash, "hexpire", key)
+	}
+	c.Store.hashChanged(key, h)
+	c.Store.touch(key)
+	return c.send(encodeInteger(1))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseHashFields(t *testing.T) {
+	tests := []struct {
+		args    []string
+		pairs   bool
+		want    []string
+		wantErr bool
+	}{
+		{[]string{"FIELDS", "2", "a", "b"}, false, []string{"a", "b"}, false},
+		{[]string{"fields", "1", "a", "1"}, true, []string{"a", "1"}, false},
+		{[]string{"FIELDS", "2", "a"}, false, nil, true},
+		{[]string{"FIELDS", "1", "a", "b"}, false, nil, true},
+		{[]string{"FIELDS", "1", "a"}, true, nil, true},
+		{[]string{"FIELDS", "0"}, false, nil, true},
+		{[]string{"FIELDS", "x", "a"}, false, nil, true},
+		{[]string{"a", "1", "FIELDS"}, false, nil, true},
+		{[]string{"FIELDS"}, false, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseHashFields(tt.args, tt.pairs)
+		if (err != nil) != tt.wantErr || !slices.Equal(got, tt.want) {
+			t.Errorf("parseHashFields(%q, %v) = %q, %v", tt.args, tt.pairs, got, err)
+		}
+	}
+}
+
+func TestParseFieldTTLOption(t *testing.T) {
+	tests := []struct {
+		name         string
+		args         []string
+		allowPersist bool
+		allowKeep    bool
+		wantN        int
+		wantAt       time.Time // zero if the time is relative
+		want         fieldTTLOption
+		wantErr      bool
+	}{
+		{"no option", []string{"FIELDS", "1", "a"}, true, true, 0, time.Time{}, fieldTTLOption{}, false},
+		{"no arguments", nil, true, true, 0, time.Time{}, fieldTTLOption{}, false},
+		{"EX", []string{"ex", "10", "FIELDS"}, false, false, 2, time.Time{}, fieldTTLOption{set: true}, false},
+		{"PXAT", []string{"PXAT", "1500"}, false, false, 2, time.UnixMilli(1500).UTC(), fieldTTLOption{set: true}, false},
+		{"EXAT", []string{"EXAT", "2"}, false, false, 2, time.UnixMilli(2000).UTC(), fieldTTLOption{set: true}, false},
+		{"PERSIST", []string{"PERSIST"}, true, false, 1, time.Time{}, fieldTTLOption{persist: true}, false},
+		{"PERSIST not allowed", []string{"PERSIST"}, false, true, 0, time.Time{}, fieldTTLOption{}, true},
+		{"KEEPTTL", []string{"KEEPTTL"}, false, true, 1, time.Time{}, fieldTTLOption{keep: true}, false},
+		{"KEEPTTL not allowed", []string{"KEEPTTL"}, true, false, 0, time.Time{}, fieldTTLOption{}, true},
+		{"missing time", []string{"EX"}, false, false, 0, time.Time{}, fieldTTLOption{}, true},
+		{"not an integer", []string{"PX", "soon"}, false, false, 0, time.Time{}, fieldTTLOption{}, true},
+		{"negative time", []string{"EX", "-1"}, false, false, 0, time.Time{}, fieldTTLOption{}, true},
+		{"time overflows", []string{"EX", "9223372036854775807"}, false, false, 0, time.Time{}, fieldTTLOption{}, true},
+	}
+	for _, tt := range tests {
+		var opt fieldTTLOption
+		before := time.Now().UTC()
+		n, err := parseFieldTTLOption(tt.args, &opt, tt.allowPersist, tt.allowKeep)
+		if (err != nil) != tt.wantErr || n != tt.wantN {
+			t.Errorf("%s: consumed %d, error %v", tt.name, n, err)
+			continue
+		}
+		if opt.set != tt.want.set || opt.persist != tt.want.persist || opt.keep != tt.want.keep {
+			t.Errorf("%s: option = %+v, want %+v", tt.name, opt, tt.want)
+		}
+		switch {
+		case !opt.set:
+		case !tt.wantAt.IsZero():
+			if !opt.at.Equal(tt.wantAt) {
+				t.Errorf("%s: at = %v, want %v", tt.name, opt.at, tt.wantAt)
+			}
+		case opt.at.Before(before.Add(10 * time.Second)):
+			t.Errorf("%s: at = %v, want at least 10s after %v", tt.name, opt.at, before)
+		}
+	}
+
+	opt := fieldTTLOption{persist: true}
+	if _, err := parseFieldTTLOption([]string{"EX", "10"}, &opt, true, true); err == nil {
+		t.Errorf("a second expiration option was accepted")
+	}
+}
+
+func TestHashFieldExpiration(t *testing.T) {
+	now := time.Now().UTC()
+	h := NewHash()
+	for _, f := range []string{"a", "b", "c", "d"} {
+		h.Set(f, "v")
+	}
+	h.Expire("a", now.Add(-time.Second))
+	h.Expire("b", now.Add(-time.Minute))
+	h.Expire("c", now.Add(time.Hour))
+	h.Expire("missing", now.Add(time.Hour))
+
+	if at, ok := h.MinExpire(); !ok || !at.Equal(now.Add(-time.Minute)) {
+		t.Errorf("MinExpire = %v, %v", at, ok)
+	}
+	if _, ok := h.ExpireTime("missing"); ok {
+		t.Errorf("a missing field was given an expiration time")
+	}
+	if n := len(h.expireFields(now)); n != 2 {
+		t.Errorf("expireFields deleted %d fields, want 2", n)
+	}
+	if _, found := h.Get("c"); !found || h.Len() != 2 {
+		t.Errorf("fields after expiring = %v", h.fields)
+	}
+	if h.Set("c", "w"); h.IsVolatile() {
+		t.Errorf("Set kept the expiration time of the field")
+	}
+	if h.Persist("c") {
+		t.Errorf("Persist of a field without a TTL returned true")
+	}
+
+	s := NewStore()
+	h, _ = s.hash("k", true)
+	h.Set("x", "1")
+	h.Expire("x", now.Add(-time.Second))
+	s.hashChanged("k", h)
+	if got, err := s.hash("k", false); got != nil || err != nil {
+		t.Errorf("hash with only expired fields = %v, %v, want it deleted", got, err)
+	}
+	if _, found := s.lookup("k"); found {
+		t.Errorf("key of an emptied hash still exists")
+	}
+}
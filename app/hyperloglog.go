@@ -0,0 +1,466 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+	"slices"
+	"strings"
+)
+
+// HyperLogLogs are stored as strings in the same format as Redis, so they
+// survive RDB round trips with real servers. The string starts with a 16 byte
+// header: the "HYLL" magic, the encoding, three unused bytes and the cached
+// cardinality in little endian, whose most significant bit marks it stale.
+const (
+	hllP            = 14
+	hllQ            = 64 - hllP
+	hllRegisters    = 1 << hllP
+	hllBits         = 6
+	hllRegisterMax  = 1<<hllBits - 1
+	hllHeaderSize   = 16
+	hllDenseSize    = hllHeaderSize + (hllRegisters*hllBits+7)/8
+	hllDense        = 0
+	hllSparse       = 1
+	hllSparseMaxLen = 3000 // promote to dense past this many bytes
+	hllAlphaInf     = 0.721347520444481703680
+)
+
+// Sparse opcodes. ZERO and XZERO encode runs of empty registers; VAL encodes
+// a run of up to 4 registers holding the same value between 1 and 32.
+const (
+	hllSparseValMax    = 32
+	hllSparseValMaxLen = 4
+	hllSparseZeroMax   = 64
+	hllSparseXZeroMax  = 16384
+)
+
+var (
+	errNotHLL     = ReplyError{"WRONGTYPE", "Key is not a valid HyperLogLog string value."}
+	errCorruptHLL = ReplyError{"INVALIDOBJ", "Corrupted HLL object detected"}
+)
+
+// murmurHash64A is the hash function Redis uses for HyperLogLog elements.
+func murmurHash64A(key []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+
+	h := seed ^ uint64(len(key))*m
+	data := key
+	for len(data) >= 8 {
+		k := binary.LittleEndian.Uint64(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+		data = data[8:]
+	}
+	if len(data) > 0 {
+		for i := len(data) - 1; i >= 0; i-- {
+			h ^= uint64(data[i]) << (8 * i)
+		}
+		h *= m
+	}
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+// hllPatLen returns the register index for element and the length of the
+// run of zeros in its hash, plus one.
+func hllPatLen(element string) (int, uint8) {
+	hash := murmurHash64A([]byte(element), 0xadc83b19)
+	index := int(hash & (hllRegisters - 1))
+	hash >>= hllP
+	hash |= 1 << hllQ
+	return index, uint8(bits.TrailingZeros64(hash) + 1)
+}
+
+// isHLL reports whether str has a valid HyperLogLog header.
+func isHLL(str string) bool {
+	if len(str) < hllHeaderSize || str[:4] != "HYLL" {
+		return false
+	}
+	switch str[4] {
+	case hllDense:
+		return len(str) == hllDenseSize
+	case hllSparse:
+		return true
+	}
+	return false
+}
+
+// hllDecode expands a HyperLogLog string into one byte per register.
+func hllDecode(str string) ([]uint8, error) {
+	regs := make([]uint8, hllRegisters)
+	body := str[hllHeaderSize:]
+
+	if str[4] == hllDense {
+		for i := range regs {
+			pos := i * hllBits
+			b, fb := pos/8, uint(pos%8)
+			val := uint16(body[b]) >> fb
+			if b+1 < len(body) {
+				val |= uint16(body[b+1]) << (8 - fb)
+			}
+			regs[i] = uint8(val & hllRegisterMax)
+		}
+		return regs, nil
+	}
+
+	idx := 0
+	for i := 0; i < len(body); i++ {
+		op := body[i]
+		switch {
+		case op&0xc0 == 0x00: // ZERO
+			idx += int(op&0x3f) + 1
+		case op&0xc0 == 0x40: // XZERO
+			if i+1 >= len(body) {
+				return nil, errCorruptHLL
+			}
+			idx += (int(op&0x3f)<<8 | int(body[i+1])) + 1
+			i++
+		default: // VAL
+			val := (op>>2)&0x1f + 1
+			runlen := int(op&0x3) + 1
+			if idx+runlen > hllRegisters {
+				return nil, errCorruptHLL
+			}
+			for j := 0; j < runlen; j++ {
+				regs[idx+j] = val
+			}
+			idx += runlen
+		}
+	}
+	if idx != hllRegisters {
+		return nil, errCorruptHLL
+	}
+	return regs, nil
+}
+
+// hllHeader returns a header for encoding with a stale cached cardinality.
+func hllHeader(encoding byte) []byte {
+	header := make([]byte, hllHeaderSize)
+	copy(header, "HYLL")
+	header[4] = encoding
+	header[15] = 0x80
+	return header
+}
+
+// hllEncodeDense packs registers into the dense representation.
+func hllEncodeDense(regs []uint8) string {
+	buf := append(hllHeader(hllDense), make([]byte, hllDenseSize-hllHeaderSize)...)
+	body := buf[hllHeaderSize:]
+	for i, val := range regs {
+		pos := i * hllBits
+		b, fb := pos/8, uint(pos%8)
+		body[b] |= val << fb
+		if b+1 < len(body) {
+			body[b+1] |= byte(uint16(val) >> (8 - fb))
+		}
+	}
+	return string(buf)
+}
+
+// hllEncodeSparse packs registers into the sparse representation. It fails
+// if a register is too large for a VAL opcode or the result is too long.
+func hllEncodeSparse(regs []uint8) (string, bool) {
+	buf := hllHeader(hllSparse)
+	for i := 0; i < len(regs); {
+		val := regs[i]
+		run := 1
+		for i+run < len(regs) && regs[i+run] == val {
+			run++
+		}
+		if val > hllSparseValMax {
+			return "", false
+		}
+		if val == 0 {
+			for left := run; left > 0; {
+				n := min(left, hllSparseXZeroMax)
+				if n > hllSparseZeroMax {
+					buf = append(buf, 0x40|byte((n-1)>>8), byte(n-1))
+				} else {
+					buf = append(buf, byte(n-1))
+				}
+				left -= n
+			}
+		} else {
+			for left := run; left > 0; {
+				n := min(left, hllSparseValMaxLen)
+				buf = append(buf, 0x80|(val-1)<<2|byte(n-1))
+				left -= n
+			}
+		}
+		if len(buf) > hllSparseMaxLen {
+			return "", false
+		}
+		i += run
+	}
+	return string(buf), true
+}
+
+// hllEncode packs registers, keeping the sparse representation when
+// possible unless dense is requested.
+func hllEncode(regs []uint8, dense bool) string {
+	if !dense {
+		if str, ok := hllEncodeSparse(regs); ok {
+			return str
+		}
+	}
+	return hllEncodeDense(regs)
+}
+
+// hllTau and hllSigma are helpers of the improved estimator by Otmar Ertl
+// that Redis uses.
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		zPrime := z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if zPrime == z {
+			return z / 3
+		}
+	}
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		zPrime := z
+		z += x * y
+		y += y
+		if zPrime == z {
+			return z
+		}
+	}
+}
+
+// hllCount estimates the cardinality of a set of registers.
+func hllCount(regs []uint8) uint64 {
+	var histo [64]int
+	for _, val := range regs {
+		histo[val]++
+	}
+	m := float64(hllRegisters)
+	z := m * hllTau((m-float64(histo[hllQ+1]))/m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(histo[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histo[0])/m)
+	return uint64(math.Round(hllAlphaInf * m * m / z))
+}
+
+// hyperLogLog returns the HyperLogLog string stored at key.
+func (s *Store) hyperLogLog(key string) (string, bool, error) {
+	str, found, err := s.stringValue(key)
+	if err != nil || !found {
+		return "", false, err
+	}
+	if !isHLL(str) {
+		return "", false, errNotHLL
+	}
+	return str, true, nil
+}
+
+// handlePFAdd handles PFADD commands.
+func (c *ClientHandler) handlePFAdd(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("insufficient number of arguments for PFADD")
+	}
+	key := args[0]
+	str, found, err := c.Store.hyperLogLog(key)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("PFADD %s command received.", key)
+
+	regs := make([]uint8, hllRegisters)
+	if found {
+		if regs, err = hllDecode(str); err != nil {
+			return err
+		}
+	}
+	changed := !found
+	for _, element := range args[1:] {
+		index, count := hllPatLen(element)
+		if count > regs[index] {
+			regs[index] = count
+			changed = true
+		}
+	}
+	if !changed {
+		return c.send(encodeInteger(0))
+	}
+
+	c.Store.setStringValue(key, hllEncode(regs, found && str[4] == hllDense))
+	c.Store.notify(notifyString, "pfadd", key)
+	c.Store.touch(key)
+	return c.send(encodeInteger(1))
+}
+
+// handlePFCount handles PFCOUNT commands. A single key caches its
+// cardinality in the header; several keys are merged on the fly.
+func (c *ClientHandler) handlePFCount(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("insufficient number of arguments for PFCOUNT")
+	}
+
+	if len(args) == 1 {
+		key := args[0]
+		str, found, err := c.Store.hyperLogLog(key)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return c.send(encodeInteger(0))
+		}
+		if str[15]&0x80 == 0 {
+			return c.send(encodeInteger(int(binary.LittleEndian.Uint64([]byte(str[8:16])))))
+		}
+		regs, err := hllDecode(str)
+		if err != nil {
+			return err
+		}
+		count := hllCount(regs)
+		buf := []byte(str)
+		binary.LittleEndian.PutUint64(buf[8:16], count)
+		c.Store.setStringValue(key, string(buf))
+		return c.send(encodeInteger(int(count)))
+	}
+
+	merged, _, err := c.Store.mergeHLLs(args)
+	if err != nil {
+		return err
+	}
+	return c.send(encodeInteger(int(hllCount(merged))))
+}
+
+// mergeHLLs returns the register-wise maximum of the HyperLogLogs at keys,
+// and whether any of them uses the dense encoding. Missing keys are skipped.
+func (s *Store) mergeHLLs(keys []string) ([]uint8, bool, error) {
+	merged := make([]uint8, hllRegisters)
+	dense := false
+	for _, key := range keys {
+		str, found, err := s.hyperLogLog(key)
+		if err != nil {
+			return nil, false, err
+		}
+		if !found {
+			continue
+		}
+		dense = dense || str[4] == hllDense
+		regs, err := hllDecode(str)
+		if err != nil {
+			return nil, false, err
+		}
+		for i, val := range regs {
+			merged[i] = max(merged[i], val)
+		}
+	}
+	return merged, dense, nil
+}
+
+// handlePFMerge handles PFMERGE commands.
+func (c *ClientHandler) handlePFMerge(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("insufficient number of arguments for PFMERGE")
+	}
+	merged, dense, err := c.Store.mergeHLLs(args)
+	if err != nil {
+		return err
+	}
+	// The destination is one of the merged keys, so it only changes if
+	// another key had a larger register.
+	dst := args[0]
+	if str, found, _ := c.Store.hyperLogLog(dst); found {
+		if regs, err := hllDecode(str); err == nil && slices.Equal(regs, merged) {
+			return c.send(okResponse)
+		}
+	}
+	c.Store.setStringValue(dst, hllEncode(merged, dense))
+	c.Store.notify(notifyString, "pfadd", dst)
+	c.Store.touch(dst)
+	return c.send(okResponse)
+}
+
+// handlePFDebug handles PFDEBUG commands.
+func (c *ClientHandler) handlePFDebug(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("wrong number of arguments for PFDEBUG")
+	}
+	sub, key := strings.ToUpper(args[0]), args[1]
+	str, found, err := c.Store.hyperLogLog(key)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("The specified key does not exist")
+	}
+	regs, err := hllDecode(str)
+	if err != nil {
+		return err
+	}
+
+	switch sub {
+	case "GETREG":
+		if str[4] == hllSparse {
+			c.Store.setStringValue(key, hllEncodeDense(regs))
+			c.Store.touch(key)
+		}
+		result := make([]string, len(regs))
+		for i, val := range regs {
+			result[i] = encodeInteger(int(val))
+		}
+		return c.send(encodeArray(result...))
+	case "DECODE":
+		if str[4] != hllSparse {
+			return fmt.Errorf("HLL encoding is not sparse")
+		}
+		return c.send(encodeBulkString(hllDescribeSparse(str[hllHeaderSize:])))
+	case "ENCODING":
+		if str[4] == hllSparse {
+			return c.send(encodeSimpleString("sparse"))
+		}
+		return c.send(encodeSimpleString("dense"))
+	case "TODENSE":
+		if str[4] == hllDense {
+			return c.send(encodeInteger(0))
+		}
+		c.Store.setStringValue(key, hllEncodeDense(regs))
+		c.Store.touch(key)
+		return c.send(encodeInteger(1))
+	}
+	return fmt.Errorf("Unknown PFDEBUG subcommand '%s'", args[0])
+}
+
+// hllDescribeSparse renders sparse opcodes the way PFDEBUG DECODE does.
+func hllDescribeSparse(body string) string {
+	var sb strings.Builder
+	for i := 0; i < len(body); i++ {
+		op := body[i]
+		switch {
+		case op&0xc0 == 0x00:
+			fmt.Fprintf(&sb, "z:%d ", op&0x3f+1)
+		case op&0xc0 == 0x40 && i+1 < len(body):
+			fmt.Fprintf(&sb, "Z:%d ", (int(op&0x3f)<<8|int(body[i+1]))+1)
+			i++
+		default:
+			fmt.Fprintf(&sb, "v:%d,%d ", (op>>2)&0x1f+1, op&0x3+1)
+		}
+	}
+	return strings.TrimSuffix(sb.String(), " ")
+}
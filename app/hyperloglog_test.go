@@ -0,0 +1,127 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// hllOf returns the registers of a HyperLogLog holding n distinct elements
+// named with prefix.
+func hllOf(prefix string, n int) []uint8 {
+	regs := make([]uint8, hllRegisters)
+	for i := 0; i < n; i++ {
+		index, count := hllPatLen(prefix + strconv.Itoa(i))
+		regs[index] = max(regs[index], count)
+	}
+	return regs
+}
+
+func TestHLLEncodeRoundTrip(t *testing.T) {
+	large := make([]uint8, hllRegisters)
+	large[7] = hllSparseValMax + 1 // too large for a sparse VAL opcode
+
+	tests := []struct {
+		name       string
+		regs       []uint8
+		dense      bool
+		wantSparse bool
+	}{
+		{"empty sparse", make([]uint8, hllRegisters), false, true},
+		{"empty dense", make([]uint8, hllRegisters), true, false},
+		{"few elements", hllOf("a", 10), false, true},
+		{"few elements dense", hllOf("a", 10), true, false},
+		{"many elements", hllOf("b", 50000), false, false},
+		{"large register", large, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			str := hllEncode(tt.regs, tt.dense)
+			if !isHLL(str) {
+				t.Fatalf("encoding has no valid header")
+			}
+			if sparse := str[4] == hllSparse; sparse != tt.wantSparse {
+				t.Errorf("sparse = %v, want %v", sparse, tt.wantSparse)
+			}
+			got, err := hllDecode(str)
+			if err != nil {
+				t.Fatalf("hllDecode: %v", err)
+			}
+			if !slices.Equal(got, tt.regs) {
+				t.Errorf("registers changed in the round trip")
+			}
+		})
+	}
+}
+
+func TestHLLEmptySparseBody(t *testing.T) {
+	// Redis encodes an empty HyperLogLog as a single XZERO covering every
+	// register.
+	str := hllEncode(make([]uint8, hllRegisters), false)
+	if body := str[hllHeaderSize:]; body != "\x7f\xff" {
+		t.Errorf("empty body = %q, want %q", body, "\x7f\xff")
+	}
+}
+
+func TestHLLDecodeCorrupt(t *testing.T) {
+	header := string(hllHeader(hllSparse))
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"too few registers", "\x00"},
+		{"too many registers", "\x7f\xff\x00"},
+		{"truncated XZERO", "\x7f"},
+		{"VAL past the end", "\x7f\xfe\x83"},
+	}
+	for _, tt := range tests {
+		if _, err := hllDecode(header + tt.body); err == nil {
+			t.Errorf("%s: hllDecode succeeded", tt.name)
+		}
+	}
+}
+
+func TestHLLCount(t *testing.T) {
+	for _, n := range []int{0, 1, 100, 1000, 10000, 100000} {
+		got := hllCount(hllOf("e", n))
+		if diff := math.Abs(float64(got) - float64(n)); diff > 0.02*float64(n)+1 {
+			t.Errorf("hllCount of %d elements = %d", n, got)
+		}
+	}
+}
+
+func TestMergeHLLs(t *testing.T) {
+	s := NewStore()
+	a, b := hllOf("x", 300), hllOf("y", 3000)
+	s.setStringValue("a", hllEncode(a, false))
+	s.setStringValue("b", hllEncode(b, true))
+
+	tests := []struct {
+		name      string
+		keys      []string
+		want      []uint8
+		wantDense bool
+	}{
+		{"one key", []string{"a"}, a, false},
+		{"missing keys skipped", []string{"a", "nope"}, a, false},
+		{"both", []string{"a", "b"}, make([]uint8, hllRegisters), true},
+	}
+	for i := range tests[2].want {
+		tests[2].want[i] = max(a[i], b[i])
+	}
+	for _, tt := range tests {
+		got, dense, err := s.mergeHLLs(tt.keys)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !slices.Equal(got, tt.want) || dense != tt.wantDense {
+			t.Errorf("%s: wrong registers or dense = %v", tt.name, dense)
+		}
+	}
+
+	s.Set("str", "not an hll")
+	if _, _, err := s.mergeHLLs([]string{"a", "str"}); err == nil {
+		t.Errorf("merging a plain string succeeded")
+	}
+}
@@ -0,0 +1,887 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type jsonKind int
+
+const (
+	jsonNull jsonKind = iota
+	jsonBool
+	jsonInteger
+	jsonNumber
+	jsonString
+	jsonArray
+	jsonObject
+)
+
+// jsonTypeNames are the type names reported by JSON.TYPE.
+var jsonTypeNames = [...]string{"null", "boolean", "integer", "number", "string", "array", "object"}
+
+// jsonNode is a value in a JSON document. Integers and floating point
+// numbers are kept apart, and objects remember the order of their keys.
+type jsonNode struct {
+	kind   jsonKind
+	b      bool
+	i      int64
+	f      float64
+	str    string
+	items  []*jsonNode
+	keys   []string
+	fields map[string]*jsonNode
+}
+
+func (n *jsonNode) isNumber() bool {
+	return n.kind == jsonInteger || n.kind == jsonNumber
+}
+
+// float returns the value of a number as a float64.
+func (n *jsonNode) float() float64 {
+	if n.kind == jsonInteger {
+		return float64(n.i)
+	}
+	return n.f
+}
+
+// clone returns a deep copy of n.
+func (n *jsonNode) clone() *jsonNode {
+	c := *n
+	if n.items != nil {
+		c.items = make([]*jsonNode, len(n.items))
+		for i, item := range n.items {
+			c.items[i] = item.clone()
+		}
+	}
+	if n.fields != nil {
+		c.keys = append([]string(nil), n.keys...)
+		c.fields = make(map[string]*jsonNode, len(n.fields))
+		for key, val := range n.fields {
+			c.fields[key] = val.clone()
+		}
+	}
+	return &c
+}
+
+// setField adds or replaces a key of an object.
+func (n *jsonNode) setField(key string, val *jsonNode) {
+	if _, ok := n.fields[key]; !ok {
+		n.keys = append(n.keys, key)
+	}
+	n.fields[key] = val
+}
+
+// deleteField removes a key from an object.
+func (n *jsonNode) deleteField(key string) {
+	if _, ok := n.fields[key]; !ok {
+		return
+	}
+	delete(n.fields, key)
+	for i, k := range n.keys {
+		if k == key {
+			n.keys = append(n.keys[:i], n.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// parseJSON parses a JSON text into a document tree.
+func parseJSON(text string) (*jsonNode, error) {
+	dec := json.NewDecoder(strings.NewReader(text))
+	dec.UseNumber()
+	n, err := decodeJSONValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("trailing characters after JSON value")
+	}
+	return n, nil
+}
+
+func decodeJSONValue(dec *json.Decoder) (*jsonNode, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := tok.(type) {
+	case nil:
+		return &jsonNode{kind: jsonNull}, nil
+	case bool:
+		return &jsonNode{kind: jsonBool, b: t}, nil
+	case string:
+		return &jsonNode{kind: jsonString, str: t}, nil
+	case json.Number:
+		if i, err := strconv.ParseInt(t.String(), 10, 64); err == nil {
+			return &jsonNode{kind: jsonInteger, i: i}, nil
+		}
+		f, err := t.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return &jsonNode{kind: jsonNumber, f: f}, nil
+	case json.Delim:
+		switch t {
+		case '[':
+			n := &jsonNode{kind: jsonArray, items: []*jsonNode{}}
+			for dec.More() {
+				item, err := decodeJSONValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				n.items = append(n.items, item)
+			}
+			_, err := dec.Token()
+			return n, err
+		case '{':
+			n := &jsonNode{kind: jsonObject, keys: []string{}, fields: map[string]*jsonNode{}}
+			for dec.More() {
+				tok, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				val, err := decodeJSONValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				n.setField(tok.(string), val)
+			}
+			_, err := dec.Token()
+			return n, err
+		}
+	}
+	return nil, fmt.Errorf("unexpected JSON token %v", tok)
+}
+
+// jsonFormat holds the INDENT, NEWLINE and SPACE options of JSON.GET.
+type jsonFormat struct {
+	indent, newline, space string
+}
+
+// serialize encodes n as JSON text.
+func (n *jsonNode) serialize(f jsonFormat) string {
+	var buf bytes.Buffer
+	n.write(&buf, f, 0)
+	return buf.String()
+}
+
+func (n *jsonNode) write(buf *bytes.Buffer, f jsonFormat, depth int) {
+	newline := func(depth int) {
+		buf.WriteString(f.newline)
+		buf.WriteString(strings.Repeat(f.indent, depth))
+	}
+	switch n.kind {
+	case jsonNull:
+		buf.WriteString("null")
+	case jsonBool:
+		buf.WriteString(strconv.FormatBool(n.b))
+	case jsonInteger:
+		buf.WriteString(strconv.FormatInt(n.i, 10))
+	case jsonNumber:
+		buf.WriteString(formatJSONNumber(n.f))
+	case jsonString:
+		writeJSONString(buf, n.str)
+	case jsonArray:
+		if len(n.items) == 0 {
+			buf.WriteString("[]")
+			return
+		}
+		buf.WriteByte('[')
+		for i, item := range n.items {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			newline(depth + 1)
+			item.write(buf, f, depth+1)
+		}
+		newline(depth)
+		buf.WriteByte(']')
+	case jsonObject:
+		if len(n.keys) == 0 {
+			buf.WriteString("{}")
+			return
+		}
+		buf.WriteByte('{')
+		for i, key := range n.keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			newline(depth + 1)
+			writeJSONString(buf, key)
+			buf.WriteByte(':')
+			buf.WriteString(f.space)
+			n.fields[key].write(buf, f, depth+1)
+		}
+		newline(depth)
+		buf.WriteByte('}')
+	}
+}
+
+// formatJSONNumber formats a float so that it reads back as a float, e.g.
+// 3.0 rather than 3.
+func formatJSONNumber(f float64) string {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return "null"
+	}
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-5 || abs >= 1e16) {
+		str := strconv.FormatFloat(f, 'e', -1, 64)
+		return strings.NewReplacer("e+", "e", "e-0", "e-").Replace(str)
+	}
+	str := strconv.FormatFloat(f, 'f', -1, 64)
+	if !strings.Contains(str, ".") {
+		str += ".0"
+	}
+	return str
+}
+
+// writeJSONString writes a quoted JSON string.
+func writeJSONString(buf *bytes.Buffer, s string) {
+	const hexDigits = "0123456789abcdef"
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; {
+		case ch == '"' || ch == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(ch)
+		case ch == '\n':
+			buf.WriteString(`\n`)
+		case ch == '\r':
+			buf.WriteString(`\r`)
+		case ch == '\t':
+			buf.WriteString(`\t`)
+		case ch < 0x20:
+			buf.WriteString(`\u00`)
+			buf.WriteByte(hexDigits[ch>>4])
+			buf.WriteByte(hexDigits[ch&0xf])
+		default:
+			buf.WriteByte(ch)
+		}
+	}
+	buf.WriteByte('"')
+}
+
+// JSON is a JSON document stored at a key.
+type JSON struct {
+	root *jsonNode
+}
+
+// JSON documents are saved like RedisJSON does, as their serialized text.
+const (
+	jsonModuleName   = "ReJSON-RL"
+	jsonModuleEncver = 3
+)
+
+func (j *JSON) moduleType() (string, int) {
+	return jsonModuleName, jsonModuleEncver
+}
+
+func (j *JSON) saveModule(w *moduleWriter) {
+	w.saveString(j.root.serialize(jsonFormat{}))
+}
+
+func init() {
+	moduleLoaders[jsonModuleName] = func(r *moduleReader, encver int) (any, error) {
+		if encver != jsonModuleEncver {
+			return nil, fmt.Errorf("unsupported JSON encoding version %d", encver)
+		}
+		text, err := r.loadString()
+		if err != nil {
+			return nil, err
+		}
+		root, err := parseJSON(text)
+		if err != nil {
+			return nil, err
+		}
+		return &JSON{root}, nil
+	}
+}
+
+var errJSONNoKey = fmt.Errorf("could not perform this operation on a key that doesn't exist")
+
+func errJSONPathMissing(path string) error {
+	return fmt.Errorf("Path '%s' does not exist", path)
+}
+
+func errJSONPathType(want jsonKind, got *jsonNode) error {
+	return ReplyError{"WRONGTYPE", fmt.Sprintf("wrong type of path value - expected %s but found %s",
+		jsonTypeNames[want], jsonTypeNames[got.kind])}
+}
+
+// json returns the JSON document stored at key, or nil if there is none.
+func (s *Store) json(key string) (*JSON, error) {
+	val, found := s.lookup(key)
+	if !found {
+		return nil, nil
+	}
+	j, ok := val.(*JSON)
+	if !ok {
+		return nil, errWrongType
+	}
+	return j, nil
+}
+
+// jsonTarget returns the document at key and the values matched by path,
+// for commands that need an existing key.
+func (s *Store) jsonTarget(key, rawPath string) (*JSON, jsonPath, []jsonMatch, error) {
+	path, err := parseJSONPath(rawPath)
+	if err != nil {
+		return nil, path, nil, err
+	}
+	j, err := s.json(key)
+	if err != nil {
+		return nil, path, nil, err
+	}
+	if j == nil {
+		return nil, path, nil, errJSONNoKey
+	}
+	matches := path.eval(j.root)
+	if path.legacy && len(matches) == 0 {
+		return nil, path, nil, errJSONPathMissing(rawPath)
+	}
+	return j, path, matches, nil
+}
+
+// replace stores val in place of the matched value.
+func (j *JSON) replace(m jsonMatch, val *jsonNode) {
+	switch {
+	case m.parent == nil:
+		j.root = val
+	case m.parent.kind == jsonObject:
+		m.parent.fields[m.key] = val
+	default:
+		m.parent.items[m.index] = val
+	}
+}
+
+// handleJSONSet handles JSON.SET commands.
+func (c *ClientHandler) handleJSONSet(args []string) error {
+	if len(args) < 3 || len(args) > 4 {
+		return fmt.Errorf("wrong number of arguments for JSON.SET")
+	}
+	key := args[0]
+	path, err := parseJSONPath(args[1])
+	if err != nil {
+		return err
+	}
+	val, err := parseJSON(args[2])
+	if err != nil {
+		return err
+	}
+	var nx, xx bool
+	if len(args) == 4 {
+		switch strings.ToUpper(args[3]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		default:
+			return errSyntax
+		}
+	}
+	j, err := c.Store.json(key)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("JSON.SET %s command received.", key)
+
+	if j == nil {
+		if !path.isRoot() {
+			return fmt.Errorf("new objects must be created at the root")
+		}
+		if xx {
+			return c.send(nullResponse)
+		}
+		c.Store.create(key, &JSON{val})
+		c.Store.notify(notifyModule, "json.set", key)
+		c.Store.touch(key)
+		return c.send(okResponse)
+	}
+
+	if matches := path.eval(j.root); len(matches) > 0 {
+		if nx {
+			return c.send(nullResponse)
+		}
+		for _, m := range matches {
+			j.replace(m, val.clone())
+		}
+		c.Store.notify(notifyModule, "json.set", key)
+		c.Store.touch(key)
+		return c.send(okResponse)
+	}
+
+	// Nothing matched: add the key to the objects the parent path matches.
+	parentPath, name, ok := path.parentPath()
+	if xx || !ok {
+		return c.send(nullResponse)
+	}
+	added := false
+	for _, m := range parentPath.eval(j.root) {
+		if m.node.kind == jsonObject {
+			m.node.setField(name, val.clone())
+			added = true
+		}
+	}
+	if !added {
+		return c.send(nullResponse)
+	}
+	c.Store.notify(notifyModule, "json.set", key)
+	c.Store.touch(key)
+	return c.send(okResponse)
+}
+
+// parseJSONFormat parses the leading INDENT, NEWLINE and SPACE options of
+// JSON.GET and returns the remaining arguments.
+func parseJSONFormat(args []string) (jsonFormat, []string) {
+	var f jsonFormat
+	for len(args) >= 2 {
+		switch strings.ToUpper(args[0]) {
+		case "INDENT":
+			f.indent = args[1]
+		case "NEWLINE":
+			f.newline = args[1]
+		case "SPACE":
+			f.space = args[1]
+		default:
+			return f, args
+		}
+		args = args[2:]
+	}
+	return f, args
+}
+
+// matchesArray builds an array of the matched values.
+func matchesArray(matches []jsonMatch) *jsonNode {
+	arr := &jsonNode{kind: jsonArray, items: make([]*jsonNode, 0, len(matches))}
+	for _, m := range matches {
+		arr.items = append(arr.items, m.node)
+	}
+	return arr
+}
+
+// handleJSONGet handles JSON.GET commands.
+func (c *ClientHandler) handleJSONGet(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("insufficient number of arguments for JSON.GET")
+	}
+	key := args[0]
+	format, rawPaths := parseJSONFormat(args[1:])
+	if len(rawPaths) == 0 {
+		rawPaths = []string{"."}
+	}
+	paths := make([]jsonPath, 0, len(rawPaths))
+	legacy := true
+	for _, raw := range rawPaths {
+		path, err := parseJSONPath(raw)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+		legacy = legacy && path.legacy
+	}
+	j, err := c.Store.json(key)
+	if err != nil {
+		return err
+	}
+	if j == nil {
+		return c.send(nullResponse)
+	}
+
+	result := func(path jsonPath) (*jsonNode, error) {
+		matches := path.eval(j.root)
+		if !legacy {
+			return matchesArray(matches), nil
+		}
+		if len(matches) == 0 {
+			return nil, errJSONPathMissing(path.raw)
+		}
+		return matches[0].node, nil
+	}
+
+	if len(paths) == 1 {
+		val, err := result(paths[0])
+		if err != nil {
+			return err
+		}
+		return c.send(encodeBulkString(val.serialize(format)))
+	}
+	obj := &jsonNode{kind: jsonObject, keys: []string{}, fields: map[string]*jsonNode{}}
+	for _, path := range paths {
+		val, err := result(path)
+		if err != nil {
+			return err
+		}
+		obj.setField(path.raw, val)
+	}
+	return c.send(encodeBulkString(obj.serialize(format)))
+}
+
+// handleJSONMGet handles JSON.MGET commands.
+func (c *ClientHandler) handleJSONMGet(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("insufficient number of arguments for JSON.MGET")
+	}
+	keys := args[:len(args)-1]
+	path, err := parseJSONPath(args[len(args)-1])
+	if err != nil {
+		return err
+	}
+	result := make([]string, 0, len(keys))
+	for _, key := range keys {
+		j, err := c.Store.json(key)
+		if err != nil || j == nil {
+			result = append(result, nullResponse)
+			continue
+		}
+		matches := path.eval(j.root)
+		switch {
+		case !path.legacy:
+			result = append(result, encodeBulkString(matchesArray(matches).serialize(jsonFormat{})))
+		case len(matches) == 0:
+			result = append(result, nullResponse)
+		default:
+			result = append(result, encodeBulkString(matches[0].node.serialize(jsonFormat{})))
+		}
+	}
+	return c.send(encodeArray(result...))
+}
+
+// handleJSONDel handles JSON.DEL and JSON.FORGET commands.
+func (c *ClientHandler) handleJSONDel(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("wrong number of arguments for JSON.DEL")
+	}
+	key := args[0]
+	rawPath := "$"
+	if len(args) == 2 {
+		rawPath = args[1]
+	}
+	path, err := parseJSONPath(rawPath)
+	if err != nil {
+		return err
+	}
+	j, err := c.Store.json(key)
+	if err != nil {
+		return err
+	}
+	if j == nil {
+		return c.send(encodeInteger(0))
+	}
+	fmt.Printf("JSON.DEL %s command received.", key)
+
+	if path.isRoot() {
+		c.Store.remove(key)
+		c.Store.notify(notifyModule, "json.del", key)
+		return c.send(encodeInteger(1))
+	}
+	deleted := 0
+	for _, m := range path.eval(j.root) {
+		switch m.parent.kind {
+		case jsonObject:
+			if m.parent.fields[m.key] == m.node {
+				m.parent.deleteField(m.key)
+				deleted++
+			}
+		case jsonArray:
+			// Earlier deletions may have shifted the array, so look the
+			// value up again.
+			for i, item := range m.parent.items {
+				if item == m.node {
+					m.parent.items = append(m.parent.items[:i], m.parent.items[i+1:]...)
+					deleted++
+					break
+				}
+			}
+		}
+	}
+	if deleted > 0 {
+		c.Store.notify(notifyModule, "json.del", key)
+		c.Store.touch(key)
+	}
+	return c.send(encodeInteger(deleted))
+}
+
+// handleJSONType handles JSON.TYPE commands.
+func (c *ClientHandler) handleJSONType(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("wrong number of arguments for JSON.TYPE")
+	}
+	rawPath := "."
+	if len(args) == 2 {
+		rawPath = args[1]
+	}
+	path, err := parseJSONPath(rawPath)
+	if err != nil {
+		return err
+	}
+	j, err := c.Store.json(args[0])
+	if err != nil {
+		return err
+	}
+	if j == nil {
+		return c.send(nullResponse)
+	}
+	matches := path.eval(j.root)
+	if path.legacy {
+		if len(matches) == 0 {
+			return c.send(nullResponse)
+		}
+		return c.send(encodeSimpleString(jsonTypeNames[matches[0].node.kind]))
+	}
+	result := make([]string, 0, len(matches))
+	for _, m := range matches {
+		result = append(result, encodeBulkString(jsonTypeNames[m.node.kind]))
+	}
+	return c.send(encodeArray(result...))
+}
+
+// jsonUpdate applies fn to every match of a path on a document. fn returns
+// the reply for one match, or "" if the match has the wrong type. For
+// legacy paths, a wrong type is an error and the last reply is returned on
+// its own. Unless event is empty, fn changes the document when it doesn't
+// reply with nil, and event is reported once it did.
+func (c *ClientHandler) jsonUpdate(key, rawPath string, want jsonKind, event string, fn func(m jsonMatch) (string, error)) error {
+	_, path, matches, err := c.Store.jsonTarget(key, rawPath)
+	if err != nil {
+		return err
+	}
+	changed := false
+	defer func() {
+		// Matches updated before an error stay updated.
+		if changed {
+			c.Store.notify(notifyModule, event, key)
+			c.Store.touch(key)
+		}
+	}()
+	result := make([]string, 0, len(matches))
+	for _, m := range matches {
+		if m.node.kind != want && !(want == jsonNumber && m.node.isNumber()) {
+			if path.legacy {
+				return errJSONPathType(want, m.node)
+			}
+			result = append(result, nullResponse)
+			continue
+		}
+		reply, err := fn(m)
+		if err != nil {
+			return err
+		}
+		if event != "" && reply != nullResponse {
+			changed = true
+		}
+		result = append(result, reply)
+	}
+	if path.legacy {
+		return c.send(result[len(result)-1])
+	}
+	return c.send(encodeArray(result...))
+}
+
+// handleJSONNumIncrBy handles JSON.NUMINCRBY commands.
+func (c *ClientHandler) handleJSONNumIncrBy(args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("wrong number of arguments for JSON.NUMINCRBY")
+	}
+	incr, err := parseJSON(args[2])
+	if err != nil || !incr.isNumber() {
+		return fmt.Errorf("expected a number but found '%s'", args[2])
+	}
+	j, path, matches, err := c.Store.jsonTarget(args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	results := &jsonNode{kind: jsonArray, items: []*jsonNode{}}
+	for _, m := range matches {
+		if !m.node.isNumber() {
+			if path.legacy {
+				return errJSONPathType(jsonNumber, m.node)
+			}
+			results.items = append(results.items, &jsonNode{kind: jsonNull})
+			continue
+		}
+		sum := &jsonNode{kind: jsonNumber, f: m.node.float() + incr.float()}
+		if m.node.kind == jsonInteger && incr.kind == jsonInteger {
+			if i := m.node.i + incr.i; (i > m.node.i) == (incr.i > 0) {
+				sum = &jsonNode{kind: jsonInteger, i: i}
+			}
+		}
+		if math.IsInf(sum.f, 0) {
+			return fmt.Errorf("result is an overflow")
+		}
+		j.replace(m, sum)
+		results.items = append(results.items, sum)
+		changed = true
+	}
+	if changed {
+		c.Store.notify(notifyModule, "json.numincrby", args[0])
+		c.Store.touch(args[0])
+	}
+	if path.legacy {
+		return c.send(encodeBulkString(results.items[len(results.items)-1].serialize(jsonFormat{})))
+	}
+	return c.send(encodeBulkString(results.serialize(jsonFormat{})))
+}
+
+// handleJSONStrAppend handles JSON.STRAPPEND commands.
+func (c *ClientHandler) handleJSONStrAppend(args []string) error {
+	if len(args) < 2 || len(args) > 3 {
+		return fmt.Errorf("wrong number of arguments for JSON.STRAPPEND")
+	}
+	rawPath := "."
+	if len(args) == 3 {
+		rawPath = args[1]
+	}
+	val, err := parseJSON(args[len(args)-1])
+	if err != nil || val.kind != jsonString {
+		return fmt.Errorf("expected a JSON string but found '%s'", args[len(args)-1])
+	}
+	return c.jsonUpdate(args[0], rawPath, jsonString, "json.strappend", func(m jsonMatch) (string, error) {
+		m.node.str += val.str
+		return encodeInteger(len(m.node.str)), nil
+	})
+}
+
+// parseJSONValues parses the JSON values given to the array commands.
+func parseJSONValues(args []string) ([]*jsonNode, error) {
+	values := make([]*jsonNode, 0, len(args))
+	for _, arg := range args {
+		val, err := parseJSON(arg)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, val)
+	}
+	return values, nil
+}
+
+// cloneAll returns deep copies of values, so a value inserted at several
+// matches is not shared between them.
+func cloneAll(values []*jsonNode) []*jsonNode {
+	copies := make([]*jsonNode, len(values))
+	for i, val := range values {
+		copies[i] = val.clone()
+	}
+	return copies
+}
+
+// handleJSONArrAppend handles JSON.ARRAPPEND commands.
+func (c *ClientHandler) handleJSONArrAppend(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("insufficient number of arguments for JSON.ARRAPPEND")
+	}
+	values, err := parseJSONValues(args[2:])
+	if err != nil {
+		return err
+	}
+	return c.jsonUpdate(args[0], args[1], jsonArray, "json.arrappend", func(m jsonMatch) (string, error) {
+		m.node.items = append(m.node.items, cloneAll(values)...)
+		return encodeInteger(len(m.node.items)), nil
+	})
+}
+
+// handleJSONArrInsert handles JSON.ARRINSERT commands.
+func (c *ClientHandler) handleJSONArrInsert(args []string) error {
+	if len(args) < 4 {
+		return fmt.Errorf("insufficient number of arguments for JSON.ARRINSERT")
+	}
+	index, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errNotInteger
+	}
+	values, err := parseJSONValues(args[3:])
+	if err != nil {
+		return err
+	}
+	return c.jsonUpdate(args[0], args[1], jsonArray, "json.arrinsert", func(m jsonMatch) (string, error) {
+		i := index
+		if i < 0 {
+			i += len(m.node.items)
+		}
+		if i < 0 || i > len(m.node.items) {
+			return "", fmt.Errorf("index out of bounds")
+		}
+		items := append([]*jsonNode{}, m.node.items[:i]...)
+		items = append(items, cloneAll(values)...)
+		m.node.items = append(items, m.node.items[i:]...)
+		return encodeInteger(len(m.node.items)), nil
+	})
+}
+
+// handleJSONArrPop handles JSON.ARRPOP commands.
+func (c *ClientHandler) handleJSONArrPop(args []string) error {
+	if len(args) < 1 || len(args) > 3 {
+		return fmt.Errorf("wrong number of arguments for JSON.ARRPOP")
+	}
+	rawPath := "."
+	if len(args) >= 2 {
+		rawPath = args[1]
+	}
+	index := -1
+	if len(args) == 3 {
+		var err error
+		if index, err = strconv.Atoi(args[2]); err != nil {
+			return errNotInteger
+		}
+	}
+	return c.jsonUpdate(args[0], rawPath, jsonArray, "json.arrpop", func(m jsonMatch) (string, error) {
+		items := m.node.items
+		if len(items) == 0 {
+			return nullResponse, nil
+		}
+		i := index
+		if i < 0 {
+			i += len(items)
+		}
+		i = min(max(i, 0), len(items)-1)
+		popped := items[i]
+		m.node.items = append(items[:i], items[i+1:]...)
+		return encodeBulkString(popped.serialize(jsonFormat{})), nil
+	})
+}
+
+// jsonQuery replies with fn applied to every match of a path, like
+// jsonUpdate, but a missing key replies with nil.
+func (c *ClientHandler) jsonQuery(args []string, want jsonKind, fn func(n *jsonNode) string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("wrong number of arguments")
+	}
+	rawPath := "."
+	if len(args) == 2 {
+		rawPath = args[1]
+	}
+	j, err := c.Store.json(args[0])
+	if err != nil {
+		return err
+	}
+	if j == nil {
+		if _, err := parseJSONPath(rawPath); err != nil {
+			return err
+		}
+		return c.send(nullResponse)
+	}
+	return c.jsonUpdate(args[0], rawPath, want, "", func(m jsonMatch) (string, error) {
+		return fn(m.node), nil
+	})
+}
+
+// handleJSONArrLen handles JSON.ARRLEN commands.
+func (c *ClientHandler) handleJSONArrLen(args []string) error {
+	return c.jsonQuery(args, jsonArray, func(n *jsonNode) string {
+		return encodeInteger(len(n.items))
+	})
+}
+
+// handleJSONObjKeys handles JSON.OBJKEYS commands.
+func (c *ClientHandler) handleJSONObjKeys(args []string) error {
+	return c.jsonQuery(args, jsonObject, func(n *jsonNode) string {
+		return encodeBulkStringArray(len(n.keys), n.keys...)
+	})
+}
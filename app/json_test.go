@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestJSONRoundTrip(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{`null`, `null`},
+		{`true`, `true`},
+		{` 42 `, `42`},
+		{`-7`, `-7`},
+		{`3.0`, `3.0`},
+		{`1.5e300`, `1.5e300`},
+		{`0.000001`, `1e-6`},
+		{`12345678901234567890`, `1.2345678901234567e19`},
+		{`"a\"b\\c\né\u0001"`, `"a\"b\\c\né\u0001"`},
+		{`[]`, `[]`},
+		{`{}`, `{}`},
+		{`{"b": 1, "a": [1, 2.5, "x", null], "c": {"d": false}}`, `{"b":1,"a":[1,2.5,"x",null],"c":{"d":false}}`},
+	}
+	for _, tt := range tests {
+		n, err := parseJSON(tt.in)
+		if err != nil {
+			t.Errorf("parseJSON(%s): %v", tt.in, err)
+			continue
+		}
+		if got := n.serialize(jsonFormat{}); got != tt.want {
+			t.Errorf("parseJSON(%s) serializes to %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestJSONParseErrors(t *testing.T) {
+	for _, in := range []string{``, `{`, `[1,]`, `{"a" 1}`, `1 2`, `nul`, `{"a":1}x`} {
+		if _, err := parseJSON(in); err == nil {
+			t.Errorf("parseJSON(%s) succeeded", in)
+		}
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	n, err := parseJSON(`{"a":[1,{}],"b":"x"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := n.serialize(jsonFormat{indent: "  ", newline: "\n", space: " "})
+	want := "{\n  \"a\": [\n    1,\n    {}\n  ],\n  \"b\": \"x\"\n}"
+	if got != want {
+		t.Errorf("formatted as\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestJSONClone(t *testing.T) {
+	n, err := parseJSON(`{"a":[1,{"b":2}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := n.clone()
+	c.fields["a"].items[1].setField("b", &jsonNode{kind: jsonString, str: "changed"})
+	c.deleteField("a")
+	if got := n.serialize(jsonFormat{}); got != `{"a":[1,{"b":2}]}` {
+		t.Errorf("changing a clone changed the original to %s", got)
+	}
+	if got := c.serialize(jsonFormat{}); got != `{}` {
+		t.Errorf("clone = %s, want {}", got)
+	}
+}
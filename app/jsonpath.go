@@ -0,0 +1,670 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// jsonPath is a parsed path into a JSON document. Paths starting with "$"
+// are JSONPath and may match any number of values. Anything else is a
+// legacy path, which matches at most one value and makes commands reply
+// with that value instead of an array of matches.
+type jsonPath struct {
+	raw    string
+	legacy bool
+	steps  []jsonStep
+}
+
+type jsonStepKind int
+
+const (
+	stepKeys     jsonStepKind = iota // .name or ['a','b']
+	stepIndexes                      // [0] or [0,-1]
+	stepWildcard                     // .* or [*]
+	stepSlice                        // [start:end:step]
+	stepFilter                       // [?(expr)]
+)
+
+// jsonStep selects children of each value matched so far. A recursive step
+// applies to the value and all of its descendants.
+type jsonStep struct {
+	kind      jsonStepKind
+	recursive bool
+	keys      []string
+	indexes   []int
+	slice     [3]*int
+	filter    jsonFilter
+}
+
+// jsonMatch is a value matched by a path, along with where it is stored so
+// it can be replaced or deleted. The root has no parent.
+type jsonMatch struct {
+	node   *jsonNode
+	parent *jsonNode
+	key    string
+	index  int
+}
+
+func errJSONPath(path string) error {
+	return fmt.Errorf("JSON Path error: path `%s` is invalid", path)
+}
+
+// parseJSONPath parses a JSONPath or legacy path.
+func parseJSONPath(raw string) (jsonPath, error) {
+	p := jsonPath{raw: raw}
+	rest := raw
+	switch {
+	case strings.HasPrefix(raw, "$"):
+		rest = raw[1:]
+	default:
+		p.legacy = true
+		if rest == "." || rest == "" {
+			rest = ""
+		} else if !strings.HasPrefix(rest, ".") && !strings.HasPrefix(rest, "[") {
+			rest = "." + rest
+		}
+	}
+
+	for len(rest) > 0 {
+		var step jsonStep
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			step.recursive = true
+			rest = rest[2:]
+			if strings.HasPrefix(rest, "[") {
+				break
+			}
+			fallthrough
+		case rest[0] == '.':
+			if !step.recursive {
+				rest = rest[1:]
+			}
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			name := rest[:end]
+			rest = rest[end:]
+			switch name {
+			case "":
+				return p, errJSONPath(raw)
+			case "*":
+				step.kind = stepWildcard
+			default:
+				step.kind, step.keys = stepKeys, []string{name}
+			}
+			p.steps = append(p.steps, step)
+			continue
+		case rest[0] != '[':
+			return p, errJSONPath(raw)
+		}
+
+		end := matchingBracket(rest)
+		if end < 0 {
+			return p, errJSONPath(raw)
+		}
+		if err := parseBracket(strings.TrimSpace(rest[1:end]), &step); err != nil {
+			return p, errJSONPath(raw)
+		}
+		rest = rest[end+1:]
+		p.steps = append(p.steps, step)
+	}
+	return p, nil
+}
+
+// matchingBracket returns the index of the "]" closing the "[" at the start
+// of s, skipping quoted strings and nested brackets.
+func matchingBracket(s string) int {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case quote != 0:
+			if ch == '\\' {
+				i++
+			} else if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == '[':
+			depth++
+		case ch == ']':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// parseBracket parses the contents of a bracketed step.
+func parseBracket(inner string, step *jsonStep) error {
+	switch {
+	case inner == "*":
+		step.kind = stepWildcard
+		return nil
+	case strings.HasPrefix(inner, "?"):
+		expr := strings.TrimSpace(inner[1:])
+		if !strings.HasPrefix(expr, "(") || !strings.HasSuffix(expr, ")") {
+			return fmt.Errorf("invalid filter")
+		}
+		f, err := parseJSONFilter(expr[1 : len(expr)-1])
+		if err != nil {
+			return err
+		}
+		step.kind, step.filter = stepFilter, f
+		return nil
+	case strings.HasPrefix(inner, "'") || strings.HasPrefix(inner, "\""):
+		step.kind = stepKeys
+		for _, part := range splitUnion(inner) {
+			key, err := unquoteJSONPathString(part)
+			if err != nil {
+				return err
+			}
+			step.keys = append(step.keys, key)
+		}
+		return nil
+	case strings.Contains(inner, ":"):
+		parts := strings.Split(inner, ":")
+		if len(parts) > 3 {
+			return fmt.Errorf("invalid slice")
+		}
+		step.kind = stepSlice
+		for i, part := range parts {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return err
+			}
+			step.slice[i] = &n
+		}
+		return nil
+	}
+
+	step.kind = stepIndexes
+	for _, part := range splitUnion(inner) {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return err
+		}
+		step.indexes = append(step.indexes, n)
+	}
+	return nil
+}
+
+// splitUnion splits a comma separated union, keeping quoted commas.
+func splitUnion(s string) []string {
+	parts := []string{}
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case quote != 0:
+			if ch == '\\' {
+				i++
+			} else if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == ',':
+			parts = append(parts, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(parts, strings.TrimSpace(s[start:]))
+}
+
+// unquoteJSONPathString unquotes a single or double quoted string.
+func unquoteJSONPathString(s string) (string, error) {
+	if len(s) < 2 || s[0] != s[len(s)-1] || (s[0] != '\'' && s[0] != '"') {
+		return "", fmt.Errorf("invalid string")
+	}
+	var sb strings.Builder
+	for i := 1; i < len(s)-1; i++ {
+		if s[i] == '\\' && i+1 < len(s)-1 {
+			i++
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String(), nil
+}
+
+// isRoot reports whether the path selects the whole document.
+func (p jsonPath) isRoot() bool {
+	return len(p.steps) == 0
+}
+
+// eval returns the values in root matched by the path. Legacy paths
+// return at most one match.
+func (p jsonPath) eval(root *jsonNode) []jsonMatch {
+	matches := p.evalFrom(jsonMatch{node: root}, root)
+	if p.legacy && len(matches) > 1 {
+		matches = matches[:1]
+	}
+	return matches
+}
+
+// evalFrom applies the steps starting from a single match. Filters
+// resolve paths starting with "$" against root.
+func (p jsonPath) evalFrom(start jsonMatch, root *jsonNode) []jsonMatch {
+	current := []jsonMatch{start}
+	for _, step := range p.steps {
+		next := []jsonMatch{}
+		for _, m := range current {
+			if step.recursive {
+				for _, d := range descendants(m) {
+					next = append(next, step.apply(d, root)...)
+				}
+			} else {
+				next = append(next, step.apply(m, root)...)
+			}
+		}
+		current = next
+	}
+	return current
+}
+
+// descendants returns m and every value nested inside it, in document
+// order.
+func descendants(m jsonMatch) []jsonMatch {
+	result := []jsonMatch{m}
+	for _, child := range children(m.node) {
+		result = append(result, descendants(child)...)
+	}
+	return result
+}
+
+// children returns the direct children of an object or array.
+func children(n *jsonNode) []jsonMatch {
+	result := []jsonMatch{}
+	switch n.kind {
+	case jsonObject:
+		for _, key := range n.keys {
+			result = append(result, jsonMatch{node: n.fields[key], parent: n, key: key})
+		}
+	case jsonArray:
+		for i, item := range n.items {
+			result = append(result, jsonMatch{node: item, parent: n, index: i})
+		}
+	}
+	return result
+}
+
+// apply selects the children of m matched by the step.
+func (step jsonStep) apply(m jsonMatch, root *jsonNode) []jsonMatch {
+	n := m.node
+	result := []jsonMatch{}
+	switch step.kind {
+	case stepKeys:
+		if n.kind != jsonObject {
+			return result
+		}
+		for _, key := range step.keys {
+			if child, ok := n.fields[key]; ok {
+				result = append(result, jsonMatch{node: child, parent: n, key: key})
+			}
+		}
+	case stepIndexes:
+		if n.kind != jsonArray {
+			return result
+		}
+		for _, i := range step.indexes {
+			if i < 0 {
+				i += len(n.items)
+			}
+			if i >= 0 && i < len(n.items) {
+				result = append(result, jsonMatch{node: n.items[i], parent: n, index: i})
+			}
+		}
+	case stepWildcard:
+		return children(n)
+	case stepSlice:
+		if n.kind != jsonArray {
+			return result
+		}
+		length := len(n.items)
+		stride := 1
+		if step.slice[2] != nil {
+			stride = *step.slice[2]
+		}
+		if stride <= 0 {
+			return result
+		}
+		bound := func(p *int, def int) int {
+			if p == nil {
+				return def
+			}
+			i := *p
+			if i < 0 {
+				i += length
+			}
+			return min(max(i, 0), length)
+		}
+		for i := bound(step.slice[0], 0); i < bound(step.slice[1], length); i += stride {
+			result = append(result, jsonMatch{node: n.items[i], parent: n, index: i})
+		}
+	case stepFilter:
+		for _, child := range children(n) {
+			if step.filter.match(child.node, root) {
+				result = append(result, child)
+			}
+		}
+	}
+	return result
+}
+
+// parentPath returns the path to the parent of the values matched by p,
+// and the key those values are stored under, if the last step names a
+// single object key.
+func (p jsonPath) parentPath() (jsonPath, string, bool) {
+	if len(p.steps) == 0 {
+		return p, "", false
+	}
+	last := p.steps[len(p.steps)-1]
+	if last.kind != stepKeys || last.recursive || len(last.keys) != 1 {
+		return p, "", false
+	}
+	parent := p
+	parent.steps = p.steps[:len(p.steps)-1]
+	return parent, last.keys[0], true
+}
+
+// jsonFilter is a filter expression such as @.price < 10 && @.tag == 'x'.
+type jsonFilter interface {
+	match(current, root *jsonNode) bool
+}
+
+type filterAnd struct{ left, right jsonFilter }
+type filterOr struct{ left, right jsonFilter }
+type filterNot struct{ inner jsonFilter }
+
+func (f filterAnd) match(current, root *jsonNode) bool {
+	return f.left.match(current, root) && f.right.match(current, root)
+}
+
+func (f filterOr) match(current, root *jsonNode) bool {
+	return f.left.match(current, root) || f.right.match(current, root)
+}
+
+func (f filterNot) match(current, root *jsonNode) bool {
+	return !f.inner.match(current, root)
+}
+
+// filterOperand is a literal or a path relative to the current value (@)
+// or the document root ($).
+type filterOperand struct {
+	literal *jsonNode
+	path    *jsonPath
+	fromAt  bool
+}
+
+func (o filterOperand) resolve(current, root *jsonNode) *jsonNode {
+	if o.literal != nil {
+		return o.literal
+	}
+	start := root
+	if o.fromAt {
+		start = current
+	}
+	matches := o.path.evalFrom(jsonMatch{node: start}, root)
+	if len(matches) == 0 {
+		return nil
+	}
+	return matches[0].node
+}
+
+// filterCompare compares two operands, or checks that a path exists when
+// there is no operator.
+type filterCompare struct {
+	left, right filterOperand
+	op          string
+	re          *regexp.Regexp
+}
+
+func (f filterCompare) match(current, root *jsonNode) bool {
+	left := f.left.resolve(current, root)
+	if f.op == "" {
+		return left != nil
+	}
+	right := f.right.resolve(current, root)
+	if left == nil || right == nil {
+		return false
+	}
+	if f.op == "=~" {
+		if left.kind != jsonString || f.re == nil {
+			return false
+		}
+		return f.re.MatchString(left.str)
+	}
+
+	cmp, comparable := compareJSON(left, right)
+	switch f.op {
+	case "==":
+		return comparable && cmp == 0
+	case "!=":
+		return !comparable || cmp != 0
+	}
+	if !comparable || (left.kind != jsonString && !left.isNumber()) {
+		return false
+	}
+	switch f.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// compareJSON orders two values of the same type. Numbers compare by
+// value, strings by bytes, and other values only for equality.
+func compareJSON(a, b *jsonNode) (int, bool) {
+	switch {
+	case a.isNumber() && b.isNumber():
+		x, y := a.float(), b.float()
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	case a.kind != b.kind:
+		return 0, false
+	case a.kind == jsonString:
+		return strings.Compare(a.str, b.str), true
+	case a.kind == jsonBool:
+		if a.b == b.b {
+			return 0, true
+		}
+		return 1, true
+	case a.kind == jsonNull:
+		return 0, true
+	}
+	if a.serialize(jsonFormat{}) == b.serialize(jsonFormat{}) {
+		return 0, true
+	}
+	return 1, true
+}
+
+// filterParser is a recursive descent parser for filter expressions.
+type filterParser struct {
+	s   string
+	pos int
+}
+
+func parseJSONFilter(expr string) (jsonFilter, error) {
+	p := &filterParser{s: expr}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos != len(p.s) {
+		return nil, fmt.Errorf("unexpected %q in filter", p.s[p.pos:])
+	}
+	return f, nil
+}
+
+func (p *filterParser) skipSpace() {
+	for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *filterParser) consume(token string) bool {
+	p.skipSpace()
+	if strings.HasPrefix(p.s[p.pos:], token) {
+		p.pos += len(token)
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) parseOr() (jsonFilter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.consume("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = filterOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (jsonFilter, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.consume("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = filterAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (jsonFilter, error) {
+	if p.consume("!") && !strings.HasPrefix(p.s[p.pos:], "=") {
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return filterNot{inner}, nil
+	}
+	if p.consume("(") {
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.consume(")") {
+			return nil, fmt.Errorf("missing ) in filter")
+		}
+		return inner, nil
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	f := filterCompare{left: left}
+	for _, op := range []string{"==", "!=", "<=", ">=", "=~", "<", ">"} {
+		if p.consume(op) {
+			f.op = op
+			break
+		}
+	}
+	if f.op == "" {
+		return f, nil
+	}
+	if f.right, err = p.parseOperand(); err != nil {
+		return nil, err
+	}
+	if f.op == "=~" && f.right.literal != nil && f.right.literal.kind == jsonString {
+		if f.re, err = regexp.Compile(f.right.literal.str); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// parseOperand parses a path starting with @ or $, a quoted string, a
+// number, or true, false or null.
+func (p *filterParser) parseOperand() (filterOperand, error) {
+	p.skipSpace()
+	if p.pos >= len(p.s) {
+		return filterOperand{}, fmt.Errorf("missing operand in filter")
+	}
+	start := p.pos
+	switch ch := p.s[p.pos]; {
+	case ch == '@' || ch == '$':
+		p.pos++
+		for p.pos < len(p.s) {
+			c := p.s[p.pos]
+			if c == '[' {
+				end := matchingBracket(p.s[p.pos:])
+				if end < 0 {
+					return filterOperand{}, fmt.Errorf("unbalanced [ in filter")
+				}
+				p.pos += end + 1
+				continue
+			}
+			if strings.IndexByte(" =!<>&|)", c) >= 0 {
+				break
+			}
+			p.pos++
+		}
+		path, err := parseJSONPath("$" + p.s[start+1:p.pos])
+		if err != nil {
+			return filterOperand{}, err
+		}
+		return filterOperand{path: &path, fromAt: ch == '@'}, nil
+	case ch == '\'' || ch == '"':
+		end := p.pos + 1
+		for end < len(p.s) && p.s[end] != ch {
+			if p.s[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(p.s) {
+			return filterOperand{}, fmt.Errorf("unterminated string in filter")
+		}
+		p.pos = end + 1
+		str, err := unquoteJSONPathString(p.s[start:p.pos])
+		if err != nil {
+			return filterOperand{}, err
+		}
+		return filterOperand{literal: &jsonNode{kind: jsonString, str: str}}, nil
+	}
+
+	for p.pos < len(p.s) && strings.IndexByte(" =!<>&|)", p.s[p.pos]) < 0 {
+		p.pos++
+	}
+	lit, err := parseJSON(p.s[start:p.pos])
+	if err != nil || lit.kind == jsonObject || lit.kind == jsonArray {
+		return filterOperand{}, fmt.Errorf("invalid literal %q in filter", p.s[start:p.pos])
+	}
+	return filterOperand{literal: lit}, nil
+}
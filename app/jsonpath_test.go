@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const jsonStore = `{
+	"store": {
+		"book": [
+			{"category": "reference", "author": "Nigel Rees", "title": "Sayings of the Century", "price": 8.95},
+			{"category": "fiction", "author": "Evelyn Waugh", "title": "Sword of Honour", "price": 12.99},
+			{"category": "fiction", "author": "Herman Melville", "title": "Moby Dick", "isbn": "0-553-21311-3", "price": 8.99},
+			{"category": "fiction", "author": "J. R. R. Tolkien", "title": "The Lord of the Rings", "isbn": "0-395-19395-8", "price": 22.99}
+		],
+		"bicycle": {"color": "red", "price": 19.95}
+	},
+	"a.b": 1
+}`
+
+func TestJSONPathEval(t *testing.T) {
+	root, err := parseJSON(jsonStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want string // matches serialized and joined with spaces
+	}{
+		{"$", ""},
+		{"$.store.bicycle.color", `"red"`},
+		{"$['store']['bicycle']['color']", `"red"`},
+		{"$['a.b']", "1"},
+		{"$.store.book[0].author", `"Nigel Rees"`},
+		{"$.store.book[-1].title", `"The Lord of the Rings"`},
+		{"$.store.book[0,2].price", "8.95 8.99"},
+		{"$.store.book[1:3].price", "12.99 8.99"},
+		{"$.store.book[::2].price", "8.95 8.99"},
+		{"$.store.book[-2:].price", "8.99 22.99"},
+		{"$.store.book[*].category", `"reference" "fiction" "fiction" "fiction"`},
+		{"$.store.bicycle.*", `"red" 19.95`},
+		{"$..color", `"red"`},
+		{"$..book[3].isbn", `"0-395-19395-8"`},
+		{"$.store.book[?(@.isbn)].price", "8.99 22.99"},
+		{"$.store.book[?(@.price < 10)].title", `"Sayings of the Century" "Moby Dick"`},
+		{"$.store.book[?(@.price > 10 && @.category == 'fiction')].price", "12.99 22.99"},
+		{"$.store.book[?(@.price > 20 || @.author == \"Nigel Rees\")].price", "8.95 22.99"},
+		{"$.store.book[?(!@.isbn)].price", "8.95 12.99"},
+		{"$.store.book[?(@.author =~ '^J')].price", "22.99"},
+		{"$.store.book[?(@.price < $.store.bicycle.price)].price", "8.95 12.99 8.99"},
+		{"$.store.missing", ""},
+		{"$.store.book[10]", ""},
+		{"$.store.bicycle[0]", ""},
+		{".store.bicycle.price", "19.95"},
+		{"store.book[1].price", "12.99"},
+		{"$..price", "8.95 12.99 8.99 22.99 19.95"},
+	}
+	for _, tt := range tests {
+		p, err := parseJSONPath(tt.path)
+		if err != nil {
+			t.Errorf("parseJSONPath(%q): %v", tt.path, err)
+			continue
+		}
+		var got []string
+		for _, m := range p.eval(root) {
+			got = append(got, m.node.serialize(jsonFormat{}))
+		}
+		if p.isRoot() {
+			continue
+		}
+		if s := strings.Join(got, " "); s != tt.want {
+			t.Errorf("%s = %s, want %s", tt.path, s, tt.want)
+		}
+	}
+}
+
+func TestJSONPathLegacySingleMatch(t *testing.T) {
+	root, err := parseJSON(`{"a": [{"b": 1}, {"b": 2}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := parseJSONPath(".a[*].b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matches := p.eval(root); len(matches) != 1 || matches[0].node.i != 1 {
+		t.Errorf("legacy path matched %d values", len(matches))
+	}
+}
+
+func TestParseJSONPathErrors(t *testing.T) {
+	tests := []string{
+		"$.",
+		"$.a..",
+		"$[",
+		"$[1",
+		"$['a]",
+		"$[x]",
+		"$[1:2:3:4]",
+		"$[?(@.a ==)]",
+		"$[?@.a]",
+		"$[?(@.a == [1])]",
+		"$a",
+	}
+	for _, path := range tests {
+		if _, err := parseJSONPath(path); err == nil {
+			t.Errorf("parseJSONPath(%q) succeeded", path)
+		}
+	}
+}
+
+func TestJSONPathParentPath(t *testing.T) {
+	tests := []struct {
+		path, parent, key string
+		ok                bool
+	}{
+		{"$.a.b", "$.a", "b", true},
+		{"$['a']", "$", "a", true},
+		{"$.a[0]", "", "", false},
+		{"$..a", "", "", false},
+		{"$", "", "", false},
+	}
+	for _, tt := range tests {
+		p, err := parseJSONPath(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parent, key, ok := p.parentPath()
+		if ok != tt.ok || key != tt.key {
+			t.Errorf("parentPath(%s) = %s, %v", tt.path, key, ok)
+			continue
+		}
+		if want, _ := parseJSONPath(tt.parent); ok && len(parent.steps) != len(want.steps) {
+			t.Errorf("parentPath(%s) has %d steps, want %d", tt.path, len(parent.steps), len(want.steps))
+		}
+	}
+}
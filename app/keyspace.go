@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// typeName returns the name TYPE reports for a value.
+func typeName(val any) string {
+	switch v := val.(type) {
+	case string, []byte:
+		return "string"
+	case *List:
+		return "list"
+	case *Set:
+		return "set"
+	case *ZSet:
+		return "zset"
+	case *Hash:
+		return "hash"
+	case *Stream:
+		return "stream"
+	case moduleValue:
+		name, _ := v.moduleType()
+		return name
+	}
+	return "none"
+}
+
+// cloneValue returns a deep copy of val, made by dumping and restoring it.
+func cloneValue(val any) (any, error) {
+	payload, err := dumpValue(val)
+	if err != nil {
+		return nil, err
+	}
+	return restoreValue(payload)
+}
+
+// setKey stores val at key, replacing whatever was there, and sets up the
+// bookkeeping the new value needs. A zero expiration time means the key
+// does not expire.
+func (s *Store) setKey(key string, val any, expiration time.Time) {
+	_, existed := s.kv[key]
+	s.remove(key)
+	s.put(key, val)
+	if !existed {
+		s.notify(notifyNew, "new", key)
+	}
+	if !expiration.IsZero() {
+		s.expiry[key] = expiration
+	}
+	if h, ok := val.(*Hash); ok {
+		s.hashChanged(key, h)
+	}
+}
+
+// storeResult stores the result of a command with a destination key, such
+// as SINTERSTORE, at key and reports event. An empty result deletes key
+// instead. Key counts as modified unless it was missing and stays missing.
+func (s *Store) storeResult(key string, val any, nonEmpty bool, class int, event string) {
+	if _, found := s.lookup(key); !found && !nonEmpty {
+		return
+	}
+	if nonEmpty {
+		s.setKey(key, val, time.Time{})
+		s.notify(class, event, key)
+	} else {
+		s.remove(key)
+		s.notify(notifyGeneric, "del", key)
+	}
+}
+
+// flush deletes every key, along with the search indexes.
+func (s *Store) flush() {
+	for key := range s.watchers {
+		if _, found := s.kv[key]; found {
+			s.touch(key)
+		}
+	}
+	s.tracking.invalidateAll()
+	s.kv = make(map[string]any)
+	s.keys = keyTable{}
+	s.expiry = make(map[string]time.Time)
+	s.volatileHashes = make(map[string]struct{})
+	s.indexes = make(map[string]*SearchIndex)
+}
+
+// parseDB parses a database index. Only database 0 exists, so any other
+// index is rejected with "ERR DB index is out of range".
+func parseDB(arg string) error {
+	db, err := strconv.Atoi(arg)
+	if err != nil {
+		return errNotInteger
+	}
+	if db != 0 {
+		return fmt.Errorf("DB index is out of range")
+	}
+	return nil
+}
+
+// handleDel handles DEL and UNLINK commands.
+func (c *ClientHandler) handleDel(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("insufficient number of arguments for DEL")
+	}
+	fmt.Printf("DEL %s command received.", strings.Join(args, " "))
+	deleted := 0
+	for _, key := range args {
+		if _, found := c.Store.lookup(key); found {
+			c.Store.remove(key)
+			c.Store.notify(notifyGeneric, "del", key)
+			deleted++
+		}
+	}
+	return c.send(encodeInteger(deleted))
+}
+
+// handleExists handles EXISTS and TOUCH commands. Keys given more than once
+// are counted each time.
+func (c *ClientHandler) handleExists(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("insufficient number of arguments for EXISTS")
+	}
+	count := 0
+	for _, key := range args {
+		if _, found := c.Store.lookup(key); found {
+			count++
+		}
+	}
+	return c.send(encodeInteger(count))
+}
+
+// handleType handles TYPE commands.
+func (c *ClientHandler) handleType(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("wrong number of arguments for TYPE")
+	}
+	val, found := c.Store.lookup(args[0])
+	if !found {
+		return c.send(encodeSimpleString("none"))
+	}
+	return c.send(encodeSimpleString(typeName(val)))
+}
+
+// handleRename handles RENAME and, with nx set, RENAMENX commands. The key
+// keeps its expiration time.
+func (c *ClientHandler) handleRename(args []string, nx bool) error {
+	if len(args) != 2 {
+		return fmt.Errorf("wrong number of arguments for RENAME")
+	}
+	src, dst := args[0], args[1]
+	val, found := c.Store.lookup(src)
+	if !found {
+		return fmt.Errorf("no such key")
+	}
+	if nx {
+		if _, found := c.Store.lookup(dst); found {
+			return c.send(encodeInteger(0))
+		}
+	}
+	fmt.Printf("RENAME %s %s command received.", src, dst)
+
+	if src != dst {
+		expiration := c.Store.expiry[src]
+		c.Store.remove(src)
+		c.Store.setKey(dst, val, expiration)
+		if t, ok := val.(*TimeSeries); ok {
+			c.Store.tsRenamed(t, src, dst)
+		}
+		c.Store.notify(notifyGeneric, "rename_from", src)
+		c.Store.notify(notifyGeneric, "rename_to", dst)
+	}
+	if nx {
+		return c.send(encodeInteger(1))
+	}
+	return c.send(okResponse)
+}
+
+// handleCopy handles COPY commands. The copy keeps the expiration time of
+// the source. DB is accepted for compatibility, but since there is only
+// database 0 it must be 0.
+func (c *ClientHandler) handleCopy(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("insufficient number of arguments for COPY")
+	}
+	src, dst := args[0], args[1]
+	replace := false
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "REPLACE":
+			replace = true
+		case "DB":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			if err := parseDB(args[i+1]); err != nil {
+				return err
+			}
+			i++
+		default:
+			return errSyntax
+		}
+	}
+	if src == dst {
+		return fmt.Errorf("source and destination objects are the same")
+	}
+	val, found := c.Store.lookup(src)
+	if !found {
+		return c.send(encodeInteger(0))
+	}
+	if _, found := c.Store.lookup(dst); found && !replace {
+		return c.send(encodeInteger(0))
+	}
+	fmt.Printf("COPY %s %s command received.", src, dst)
+
+	clone, err := cloneValue(val)
+	if err != nil {
+		return err
+	}
+	if t, ok := clone.(*TimeSeries); ok {
+		// Compaction rules stay with the original series.
+		t.rules, t.srcKey = nil, ""
+	}
+	c.Store.setKey(dst, clone, c.Store.expiry[src])
+	c.Store.notify(notifyGeneric, "copy_to", dst)
+	return c.send(encodeInteger(1))
+}
+
+// handleScan handles SCAN commands. As with Redis, MATCH and TYPE are
+// applied after a page of keys is picked, so a page may come back empty
+// before the iteration is complete.
+func (c *ClientHandler) handleScan(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("insufficient number of arguments for SCAN")
+	}
+	cursor, err := parseCursor(args[0])
+	if err != nil {
+		return err
+	}
+	opts, err := parseScanOptions(args[1:], true)
+	if err != nil {
+		return err
+	}
+
+	page, next := c.Store.keys.scan(cursor, opts.count)
+	result := []string{}
+	for _, key := range page {
+		if !opts.matches(key) {
+			continue
+		}
+		val, found := c.Store.lookup(key)
+		if !found {
+			continue
+		}
+		if opts.valueType != "" && !strings.EqualFold(typeName(val), opts.valueType) {
+			continue
+		}
+		result = append(result, key)
+	}
+	return c.send(encodeScanReply(next, result))
+}
+
+// handleRandomKey handles RANDOMKEY commands.
+func (c *ClientHandler) handleRandomKey(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("wrong number of arguments for RANDOMKEY")
+	}
+	// Map iteration starts at a random position.
+	for key := range c.Store.kv {
+		if _, found := c.Store.lookup(key); found {
+			return c.send(encodeBulkString(key))
+		}
+	}
+	return c.send(nullResponse)
+}
+
+// handleDBSize handles DBSIZE commands.
+func (c *ClientHandler) handleDBSize(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("wrong number of arguments for DBSIZE")
+	}
+	return c.send(encodeInteger(len(c.Store.kv)))
+}
+
+// handleFlush handles FLUSHDB and FLUSHALL commands. ASYNC is accepted,
+// but the keyspace is always emptied before replying.
+func (c *ClientHandler) handleFlush(args []string) error {
+	if len(args) > 1 {
+		return errSyntax
+	}
+	if len(args) == 1 && !strings.EqualFold(args[0], "SYNC") && !strings.EqualFold(args[0], "ASYNC") {
+		return errSyntax
+	}
+	fmt.Printf("FLUSH command received.")
+	c.Store.flush()
+	return c.send(okResponse)
+}
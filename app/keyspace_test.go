@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTypeName(t *testing.T) {
+	tests := []struct {
+		val  any
+		want string
+	}{
+		{"x", "string"},
+		{NewList(nil), "list"},
+		{NewSet(), "set"},
+		{NewZSet(), "zset"},
+		{NewHash(), "hash"},
+		{NewStream(), "stream"},
+		{nil, "none"},
+		{42, "none"},
+	}
+	for _, tt := range tests {
+		if got := typeName(tt.val); got != tt.want {
+			t.Errorf("typeName(%T) = %q, want %q", tt.val, got, tt.want)
+		}
+	}
+}
+
+func TestParseDB(t *testing.T) {
+	tests := []struct {
+		arg     string
+		wantErr bool
+	}{
+		{"0", false},
+		{"1", true},
+		{"-1", true},
+		{"zero", true},
+	}
+	for _, tt := range tests {
+		if err := parseDB(tt.arg); (err != nil) != tt.wantErr {
+			t.Errorf("parseDB(%q) = %v", tt.arg, err)
+		}
+	}
+	if err := parseDB("1"); err == nil || err.Error() != "DB index is out of range" {
+		t.Errorf("parseDB(1) = %v, want the out of range error", err)
+	}
+}
+
+func TestCloneValue(t *testing.T) {
+	h := NewHash()
+	h.Set("f", "v")
+	val, err := cloneValue(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone := val.(*Hash)
+	clone.Set("f", "changed")
+	if got, _ := h.Get("f"); got != "v" {
+		t.Errorf("changing the clone changed the original to %q", got)
+	}
+}
+
+func TestStoreResult(t *testing.T) {
+	s := NewStore()
+	h := NewHash()
+	h.Set("f", "v")
+	s.setKey("dst", h, time.Now().Add(time.Hour))
+
+	s.storeResult("dst", "new", true, notifyString, "set")
+	if val, _ := s.lookup("dst"); val != "new" {
+		t.Errorf("dst = %v, want the stored result", val)
+	}
+	if _, found := s.expiry["dst"]; found {
+		t.Errorf("storing a result kept the old expiration time")
+	}
+	if _, found := s.volatileHashes["dst"]; found {
+		t.Errorf("storing a result kept the old hash bookkeeping")
+	}
+
+	s.storeResult("dst", nil, false, notifyString, "set")
+	if _, found := s.lookup("dst"); found {
+		t.Errorf("an empty result didn't delete dst")
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	opCodeTypeList             byte = 0x01 // length, then element strings
+	opCodeTypeListQuicklist2   byte = 0x12 // nodes holding listpacks or single elements
+	quicklistNodePlain              = 1    // node holding one large element
+	quicklistNodePacked             = 2    // node holding a listpack
+	quicklistMaxPackedElements      = 128  // elements written per listpack node
+)
+
+// List is a list of strings.
+type List struct {
+	elements []string
+}
+
+// NewList returns a list holding elements.
+func NewList(elements []string) *List {
+	return &List{elements: elements}
+}
+
+// Len returns the number of elements in the list.
+func (l *List) Len() int {
+	return len(l.elements)
+}
+
+// Elements returns the elements of the list in order.
+func (l *List) Elements() []string {
+	return l.elements
+}
+
+// Push adds elements at the tail of the list, or at the head if left is
+// set. Pushing to the head one element at a time leaves them in reverse
+// order, as with LPUSH.
+func (l *List) Push(elements []string, left bool) {
+	if !left {
+		l.elements = append(l.elements, elements...)
+		return
+	}
+	head := slices.Clone(elements)
+	slices.Reverse(head)
+	l.elements = append(head, l.elements...)
+}
+
+// Range returns the elements from index start to stop, both inclusive.
+// Negative indexes count from the tail, and out of range indexes are
+// clamped.
+func (l *List) Range(start, stop int) []string {
+	length := l.Len()
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	start = max(start, 0)
+	stop = min(stop, length-1)
+	if start > stop {
+		return nil
+	}
+	return l.elements[start : stop+1]
+}
+
+// list returns the list stored at key. A missing key gives a nil list, or
+// a new empty one stored at key if create is set.
+func (s *Store) list(key string, create bool) (*List, error) {
+	val, found := s.lookup(key)
+	if !found {
+		if !create {
+			return nil, nil
+		}
+		l := NewList(nil)
+		s.create(key, l)
+		return l, nil
+	}
+	l, ok := val.(*List)
+	if !ok {
+		return nil, errWrongType
+	}
+	return l, nil
+}
+
+// handlePush handles LPUSH and, with left unset, RPUSH commands.
+func (c *ClientHandler) handlePush(args []string, left bool) error {
+	name := "RPUSH"
+	if left {
+		name = "LPUSH"
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("insufficient number of arguments for %s", name)
+	}
+	key := args[0]
+	fmt.Printf("%s %s command received.", name, key)
+	l, err := c.Store.list(key, true)
+	if err != nil {
+		return err
+	}
+	l.Push(args[1:], left)
+	c.Store.notify(notifyList, strings.ToLower(name), key)
+	c.Store.touch(key)
+	return c.send(encodeInteger(l.Len()))
+}
+
+// handleLRange handles LRANGE commands.
+func (c *ClientHandler) handleLRange(args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("wrong number of arguments for LRANGE")
+	}
+	start, err := strconv.Atoi(args[1])
+	if err != nil {
+		return errNotInteger
+	}
+	stop, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errNotInteger
+	}
+	l, err := c.Store.list(args[0], false)
+	if err != nil {
+		return err
+	}
+	if l == nil {
+		return c.send(encodeBulkStringArray(0))
+	}
+	elements := l.Range(start, stop)
+	return c.send(encodeBulkStringArray(len(elements), elements...))
+}
+
+// handleLLen handles LLEN commands.
+func (c *ClientHandler) handleLLen(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("wrong number of arguments for LLEN")
+	}
+	l, err := c.Store.list(args[0], false)
+	if err != nil {
+		return err
+	}
+	if l == nil {
+		return c.send(encodeInteger(0))
+	}
+	return c.send(encodeInteger(l.Len()))
+}
+
+// readList reads a list saved with either of the list value types.
+func readList(r *bufio.Reader, valueType byte) (*List, error) {
+	length, err := decodeLength(r)
+	if err != nil {
+		return nil, err
+	}
+	l := NewList(nil)
+	for i := 0; i < length; i++ {
+		if valueType == opCodeTypeList {
+			elem, err := readString(r)
+			if err != nil {
+				return nil, err
+			}
+			l.elements = append(l.elements, elem)
+			continue
+		}
+		container, err := decodeLength(r)
+		if err != nil {
+			return nil, err
+		}
+		blob, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		switch container {
+		case quicklistNodePlain:
+			l.elements = append(l.elements, blob)
+		case quicklistNodePacked:
+			elements, err := decodeListpack([]byte(blob))
+			if err != nil {
+				return nil, err
+			}
+			l.elements = append(l.elements, elements...)
+		default:
+			return nil, fmt.Errorf("invalid quicklist node container %d", container)
+		}
+	}
+	return l, nil
+}
+
+// writeList writes l as a quicklist of listpack nodes, the encoding Redis
+// itself uses.
+func (rw *rdbWriter) writeList(l *List) {
+	numNodes := (l.Len() + quicklistMaxPackedElements - 1) / quicklistMaxPackedElements
+	rw.writeLength(numNodes)
+	for start := 0; start < l.Len(); start += quicklistMaxPackedElements {
+		lp := newListpackWriter()
+		for _, elem := range l.elements[start:min(start+quicklistMaxPackedElements, l.Len())] {
+			lp.appendString(elem)
+		}
+		rw.writeLength(quicklistNodePacked)
+		rw.writeString(string(lp.bytes()))
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestListPushRange(t *testing.T) {
+	l := NewList(nil)
+	l.Push([]string{"c", "d"}, false)
+	l.Push([]string{"b", "a"}, true)
+	l.Push([]string{"e"}, false)
+	if got := l.Elements(); !slices.Equal(got, []string{"a", "b", "c", "d", "e"}) {
+		t.Fatalf("elements = %v", got)
+	}
+
+	tests := []struct {
+		start, stop int
+		want        []string
+	}{
+		{0, -1, []string{"a", "b", "c", "d", "e"}},
+		{1, 2, []string{"b", "c"}},
+		{-2, -1, []string{"d", "e"}},
+		{-100, 0, []string{"a"}},
+		{3, 100, []string{"d", "e"}},
+		{3, 1, nil},
+		{5, 10, nil},
+		{-1, -2, nil},
+	}
+	for _, tt := range tests {
+		if got := l.Range(tt.start, tt.stop); !slices.Equal(got, tt.want) {
+			t.Errorf("Range(%d, %d) = %v, want %v", tt.start, tt.stop, got, tt.want)
+		}
+	}
+}
+
+func TestListDumpRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		elements []string
+	}{
+		{"small", []string{"a", "1", "-5", ""}},
+		{"several nodes", func() []string {
+			elements := []string{}
+			for i := 0; i < 3*quicklistMaxPackedElements+7; i++ {
+				elements = append(elements, "e"+strconv.Itoa(i))
+			}
+			return elements
+		}()},
+		{"large element", []string{"a", strings.Repeat("x", 10000), "b"}},
+	}
+	for _, tt := range tests {
+		payload, err := dumpValue(NewList(slices.Clone(tt.elements)))
+		if err != nil {
+			t.Fatalf("%s: dumpValue: %v", tt.name, err)
+		}
+		val, err := restoreValue(payload)
+		if err != nil {
+			t.Fatalf("%s: restoreValue: %v", tt.name, err)
+		}
+		if got := val.(*List).Elements(); !slices.Equal(got, tt.elements) {
+			t.Errorf("%s: restored %d elements, want %d", tt.name, len(got), len(tt.elements))
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+const (
+	listpackHeaderSize = 6    // total bytes (4) and number of elements (2)
+	listpackEOF        = 0xFF // terminates the listpack
+)
+
+var errListpackCorrupt = errors.New("corrupt listpack")
+
+// listpackWriter builds a listpack, the compact serialization Redis uses
+// for small aggregates and stream nodes. Each element holds its encoding,
+// its data and a back-length that allows iterating from the tail.
+type listpackWriter struct {
+	buf   []byte
+	count int
+}
+
+func newListpackWriter() *listpackWriter {
+	return &listpackWriter{buf: make([]byte, listpackHeaderSize)}
+}
+
+// appendString appends str, encoded as an integer if it is the canonical
+// form of one, just like Redis does.
+func (lp *listpackWriter) appendString(str string) {
+	if num, err := strconv.ParseInt(str, 10, 64); err == nil && strconv.FormatInt(num, 10) == str {
+		lp.appendInt(num)
+		return
+	}
+
+	start := len(lp.buf)
+	switch n := len(str); {
+	case n < 1<<6:
+		lp.buf = append(lp.buf, 0x80|byte(n))
+	case n < 1<<12:
+		lp.buf = append(lp.buf, 0xE0|byte(n>>8), byte(n))
+	default:
+		lp.buf = append(lp.buf, 0xF0)
+		lp.buf = binary.LittleEndian.AppendUint32(lp.buf, uint32(n))
+	}
+	lp.buf = append(lp.buf, str...)
+	lp.appendBacklen(len(lp.buf) - start)
+}
+
+// appendInt appends num using the smallest integer encoding that fits.
+func (lp *listpackWriter) appendInt(num int64) {
+	start := len(lp.buf)
+	switch {
+	case num >= 0 && num <= 127:
+		lp.buf = append(lp.buf, byte(num))
+	case num >= -1<<12 && num < 1<<12:
+		uv := uint16(num) & 0x1FFF
+		lp.buf = append(lp.buf, 0xC0|byte(uv>>8), byte(uv))
+	case num >= -1<<15 && num < 1<<15:
+		lp.buf = append(lp.buf, 0xF1)
+		lp.buf = binary.LittleEndian.AppendUint16(lp.buf, uint16(num))
+	case num >= -1<<23 && num < 1<<23:
+		uv := uint32(num)
+		lp.buf = append(lp.buf, 0xF2, byte(uv), byte(uv>>8), byte(uv>>16))
+	case num >= -1<<31 && num < 1<<31:
+		lp.buf = append(lp.buf, 0xF3)
+		lp.buf = binary.LittleEndian.AppendUint32(lp.buf, uint32(num))
+	default:
+		lp.buf = append(lp.buf, 0xF4)
+		lp.buf = binary.LittleEndian.AppendUint64(lp.buf, uint64(num))
+	}
+	lp.appendBacklen(len(lp.buf) - start)
+}
+
+// appendBacklen appends the length of the element just written, most
+// significant 7 bits first, with the high bit marking continuation bytes.
+func (lp *listpackWriter) appendBacklen(n int) {
+	size := backlenSize(n)
+	for i := size - 1; i >= 0; i-- {
+		b := byte(n>>(7*i)) & 0x7F
+		if i != size-1 {
+			b |= 0x80
+		}
+		lp.buf = append(lp.buf, b)
+	}
+	lp.count++
+}
+
+// backlenSize returns the number of bytes used by the back-length of an
+// element that is n bytes long.
+func backlenSize(n int) int {
+	switch {
+	case n < 1<<7:
+		return 1
+	case n < 1<<14:
+		return 2
+	case n < 1<<21:
+		return 3
+	case n < 1<<28:
+		return 4
+	}
+	return 5
+}
+
+// bytes terminates the listpack and returns its serialized form.
+func (lp *listpackWriter) bytes() []byte {
+	buf := append(lp.buf, listpackEOF)
+	binary.LittleEndian.PutUint32(buf, uint32(len(buf)))
+	count := lp.count
+	if count > 65535 {
+		count = 65535 // element count unknown, readers must iterate
+	}
+	binary.LittleEndian.PutUint16(buf[4:], uint16(count))
+	return buf
+}
+
+// decodeListpack returns the elements of a serialized listpack. Integer
+// elements are returned in their string form.
+func decodeListpack(blob []byte) ([]string, error) {
+	if len(blob) < listpackHeaderSize+1 || int(binary.LittleEndian.Uint32(blob)) != len(blob) {
+		return nil, errListpackCorrupt
+	}
+	elements := []string{}
+	p := blob[listpackHeaderSize:]
+	for len(p) > 0 && p[0] != listpackEOF {
+		var elem string
+		var size int // encoding and data bytes
+		enc := p[0]
+		need := func(n int) bool { return len(p) >= n }
+		switch {
+		case enc&0x80 == 0: // 7 bit unsigned integer
+			elem, size = strconv.Itoa(int(enc)), 1
+		case enc&0xC0 == 0x80: // 6 bit string length
+			n := int(enc & 0x3F)
+			if !need(1 + n) {
+				return nil, errListpackCorrupt
+			}
+			elem, size = string(p[1:1+n]), 1+n
+		case enc&0xE0 == 0xC0: // 13 bit signed integer
+			if !need(2) {
+				return nil, errListpackCorrupt
+			}
+			uv := int(enc&0x1F)<<8 | int(p[1])
+			if uv >= 1<<12 {
+				uv -= 1 << 13
+			}
+			elem, size = strconv.Itoa(uv), 2
+		case enc&0xF0 == 0xE0: // 12 bit string length
+			if !need(2) {
+				return nil, errListpackCorrupt
+			}
+			n := int(enc&0x0F)<<8 | int(p[1])
+			if !need(2 + n) {
+				return nil, errListpackCorrupt
+			}
+			elem, size = string(p[2:2+n]), 2+n
+		case enc == 0xF0: // 32 bit string length
+			if !need(5) {
+				return nil, errListpackCorrupt
+			}
+			n := int(binary.LittleEndian.Uint32(p[1:]))
+			if !need(5 + n) {
+				return nil, errListpackCorrupt
+			}
+			elem, size = string(p[5:5+n]), 5+n
+		case enc == 0xF1:
+			if !need(3) {
+				return nil, errListpackCorrupt
+			}
+			elem, size = strconv.Itoa(int(int16(binary.LittleEndian.Uint16(p[1:])))), 3
+		case enc == 0xF2:
+			if !need(4) {
+				return nil, errListpackCorrupt
+			}
+			// Shift up and back down to sign extend from 24 bits.
+			uv := int32(uint32(p[1])|uint32(p[2])<<8|uint32(p[3])<<16) << 8 >> 8
+			elem, size = strconv.Itoa(int(uv)), 4
+		case enc == 0xF3:
+			if !need(5) {
+				return nil, errListpackCorrupt
+			}
+			elem, size = strconv.Itoa(int(int32(binary.LittleEndian.Uint32(p[1:])))), 5
+		case enc == 0xF4:
+			if !need(9) {
+				return nil, errListpackCorrupt
+			}
+			elem, size = strconv.FormatInt(int64(binary.LittleEndian.Uint64(p[1:])), 10), 9
+		default:
+			return nil, errListpackCorrupt
+		}
+		size += backlenSize(size)
+		if !need(size) {
+			return nil, errListpackCorrupt
+		}
+		elements = append(elements, elem)
+		p = p[size:]
+	}
+	if len(p) != 1 {
+		return nil, errListpackCorrupt
+	}
+	return elements, nil
+}
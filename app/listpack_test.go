@@ -0,0 +1,92 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestListpackRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		elements []string
+		size     int // serialized length, 0 to skip the check
+	}{
+		{"empty", []string{}, 7},
+		{"small ints", []string{"0", "1", "127"}, 7 + 3*2},
+		{"13 bit ints", []string{"128", "-1", "4095", "-4096"}, 7 + 4*3},
+		{"wider ints", []string{"4096", "-32768", "8388607", "-2147483648", "9223372036854775807", "-9223372036854775808"}, 7 + 4 + 4 + 5 + 6 + 10 + 10},
+		{"strings", []string{"", "a", "hello world"}, 7 + 2 + 3 + 13},
+		{"non canonical numbers stay strings", []string{"01", "+1", "1.5", "-0", "18446744073709551616"}, 0},
+		{"12 bit string length", []string{strings.Repeat("x", 64), strings.Repeat("y", 4095)}, 7 + 67 + 4099},
+		{"32 bit string length", []string{strings.Repeat("z", 4096)}, 7 + 5 + 4096 + 2},
+	}
+	for _, tt := range tests {
+		lp := newListpackWriter()
+		for _, e := range tt.elements {
+			lp.appendString(e)
+		}
+		blob := lp.bytes()
+		if tt.size != 0 && len(blob) != tt.size {
+			t.Errorf("%s: %d bytes, want %d", tt.name, len(blob), tt.size)
+		}
+		got, err := decodeListpack(blob)
+		if err != nil {
+			t.Errorf("%s: decodeListpack: %v", tt.name, err)
+			continue
+		}
+		if !slices.Equal(got, tt.elements) {
+			t.Errorf("%s: decoded %q, want %q", tt.name, got, tt.elements)
+		}
+	}
+}
+
+func TestListpackInts(t *testing.T) {
+	// Every boundary of every integer encoding.
+	var nums []int64
+	for _, bound := range []int64{127, 1 << 12, 1 << 15, 1 << 23, 1 << 31} {
+		nums = append(nums, bound-1, bound, -bound, -bound-1)
+	}
+	lp := newListpackWriter()
+	want := []string{}
+	for _, n := range nums {
+		lp.appendInt(n)
+		want = append(want, strconv.FormatInt(n, 10))
+	}
+	got, err := decodeListpack(lp.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("decoded %v, want %v", got, want)
+	}
+}
+
+func TestDecodeListpackCorrupt(t *testing.T) {
+	lp := newListpackWriter()
+	lp.appendString("hello")
+	lp.appendInt(1000)
+	valid := lp.bytes()
+
+	tests := []struct {
+		name string
+		blob []byte
+	}{
+		{"too short", []byte{7, 0, 0, 0}},
+		{"wrong total length", append(slices.Clone(valid[:len(valid)-1]), 0, listpackEOF)},
+		{"truncated", valid[:len(valid)-2]},
+		{"missing terminator", func() []byte {
+			b := slices.Clone(valid)
+			b[len(b)-1] = 0
+			return b
+		}()},
+		{"bad encoding", []byte{8, 0, 0, 0, 1, 0, 0xF5, listpackEOF}},
+		{"string past the end", []byte{8, 0, 0, 0, 1, 0, 0x85, listpackEOF}},
+	}
+	for _, tt := range tests {
+		if _, err := decodeListpack(tt.blob); err == nil {
+			t.Errorf("%s: decoded without error", tt.name)
+		}
+	}
+}
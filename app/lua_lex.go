@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// luaToken kinds. Keywords and operators are kept as their text in
+// luaToken.text, with kind tokOp or tokKeyword.
+const (
+	tokEOF = iota
+	tokName
+	tokKeyword
+	tokNumber
+	tokString
+	tokOp
+)
+
+var luaKeywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true,
+	"end": true, "false": true, "for": true, "function": true, "if": true,
+	"in": true, "local": true, "nil": true, "not": true, "or": true,
+	"repeat": true, "return": true, "then": true, "true": true,
+	"until": true, "while": true,
+}
+
+// luaOps are the operators and punctuation, longest first so that the
+// lexer matches greedily.
+var luaOps = []string{
+	"...", "..", "==", "~=", "<=", ">=",
+	"+", "-", "*", "/", "%", "^", "#", "<", ">", "=",
+	"(", ")", "{", "}", "[", "]", ";", ":", ",", ".",
+}
+
+type luaToken struct {
+	kind int
+	text string  // name, keyword, operator or string contents
+	num  float64 // value of a number
+	line int
+}
+
+// luaLexer splits Lua source into tokens.
+type luaLexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+// luaSyntaxError is raised by the lexer and parser, with the line the
+// error was found on. chunk is filled in by luaCompile.
+type luaSyntaxError struct {
+	line  int
+	msg   string
+	chunk string
+}
+
+func (e *luaSyntaxError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.chunk, e.line, e.msg)
+}
+
+func (lx *luaLexer) errorf(format string, args ...any) {
+	panic(&luaSyntaxError{line: lx.line, msg: fmt.Sprintf(format, args...)})
+}
+
+// tokenize returns every token in src, ending with a tokEOF token.
+func luaTokenize(src string) (tokens []luaToken, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			synErr, ok := r.(*luaSyntaxError)
+			if !ok {
+				panic(r)
+			}
+			err = synErr
+		}
+	}()
+	lx := &luaLexer{src: src, line: 1}
+	// A first line starting with # is skipped, as by the Lua interpreter.
+	if strings.HasPrefix(src, "#") {
+		for lx.pos < len(src) && src[lx.pos] != '\n' {
+			lx.pos++
+		}
+	}
+	for {
+		tok := lx.next()
+		tokens = append(tokens, tok)
+		if tok.kind == tokEOF {
+			return tokens, nil
+		}
+	}
+}
+
+func (lx *luaLexer) peekByte(offset int) byte {
+	if lx.pos+offset < len(lx.src) {
+		return lx.src[lx.pos+offset]
+	}
+	return 0
+}
+
+func (lx *luaLexer) next() luaToken {
+	lx.skipSpaceAndComments()
+	if lx.pos >= len(lx.src) {
+		return luaToken{kind: tokEOF, line: lx.line}
+	}
+	line := lx.line
+	c := lx.src[lx.pos]
+	switch {
+	case isLuaNameStart(c):
+		start := lx.pos
+		for lx.pos < len(lx.src) && isLuaNameChar(lx.src[lx.pos]) {
+			lx.pos++
+		}
+		word := lx.src[start:lx.pos]
+		if luaKeywords[word] {
+			return luaToken{kind: tokKeyword, text: word, line: line}
+		}
+		return luaToken{kind: tokName, text: word, line: line}
+	case isDigit(c) || (c == '.' && isDigit(lx.peekByte(1))):
+		return luaToken{kind: tokNumber, num: lx.number(), line: line}
+	case c == '"' || c == '\'':
+		return luaToken{kind: tokString, text: lx.shortString(c), line: line}
+	case c == '[' && (lx.peekByte(1) == '[' || lx.peekByte(1) == '='):
+		if level, ok := lx.longBracketLevel(); ok {
+			return luaToken{kind: tokString, text: lx.longString(level), line: line}
+		}
+	}
+	for _, op := range luaOps {
+		if strings.HasPrefix(lx.src[lx.pos:], op) {
+			lx.pos += len(op)
+			return luaToken{kind: tokOp, text: op, line: line}
+		}
+	}
+	lx.errorf("unexpected symbol near '%c'", c)
+	return luaToken{}
+}
+
+func (lx *luaLexer) skipSpaceAndComments() {
+	for lx.pos < len(lx.src) {
+		c := lx.src[lx.pos]
+		switch {
+		case c == '\n':
+			lx.line++
+			lx.pos++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			lx.pos++
+		case c == '-' && lx.peekByte(1) == '-':
+			lx.pos += 2
+			if lx.peekByte(0) == '[' {
+				if level, ok := lx.longBracketLevel(); ok {
+					lx.longString(level)
+					continue
+				}
+			}
+			for lx.pos < len(lx.src) && lx.src[lx.pos] != '\n' {
+				lx.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// longBracketLevel reports whether a long bracket such as [==[ starts at
+// the current position, and its level, the number of = signs.
+func (lx *luaLexer) longBracketLevel() (int, bool) {
+	i := lx.pos + 1
+	level := 0
+	for i < len(lx.src) && lx.src[i] == '=' {
+		level++
+		i++
+	}
+	return level, i < len(lx.src) && lx.src[i] == '['
+}
+
+// longString reads a long bracket string or comment of the given level.
+// A newline directly after the opening bracket is skipped.
+func (lx *luaLexer) longString(level int) string {
+	lx.pos += level + 2
+	if lx.peekByte(0) == '\r' {
+		lx.pos++
+	}
+	if lx.peekByte(0) == '\n' {
+		lx.line++
+		lx.pos++
+	}
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(lx.src[lx.pos:], closing)
+	if end < 0 {
+		lx.errorf("unfinished long string")
+	}
+	str := lx.src[lx.pos : lx.pos+end]
+	lx.line += strings.Count(str, "\n")
+	lx.pos += end + len(closing)
+	return str
+}
+
+func (lx *luaLexer) shortString(quote byte) string {
+	lx.pos++
+	var sb strings.Builder
+	for {
+		if lx.pos >= len(lx.src) {
+			lx.errorf("unfinished string")
+		}
+		c := lx.src[lx.pos]
+		switch {
+		case c == quote:
+			lx.pos++
+			return sb.String()
+		case c == '\n':
+			lx.errorf("unfinished string")
+		case c == '\\':
+			lx.pos++
+			e := lx.peekByte(0)
+			lx.pos++
+			switch e {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'r':
+				sb.WriteByte('\r')
+			case 'a':
+				sb.WriteByte('\a')
+			case 'b':
+				sb.WriteByte('\b')
+			case 'f':
+				sb.WriteByte('\f')
+			case 'v':
+				sb.WriteByte('\v')
+			case '\\', '"', '\'':
+				sb.WriteByte(e)
+			case '\n':
+				lx.line++
+				sb.WriteByte('\n')
+			default:
+				if !isDigit(e) {
+					lx.errorf("invalid escape sequence '\\%c'", e)
+				}
+				n := int(e - '0')
+				for i := 0; i < 2 && isDigit(lx.peekByte(0)); i++ {
+					n = n*10 + int(lx.peekByte(0)-'0')
+					lx.pos++
+				}
+				if n > 255 {
+					lx.errorf("escape sequence too large")
+				}
+				sb.WriteByte(byte(n))
+			}
+		default:
+			sb.WriteByte(c)
+			lx.pos++
+		}
+	}
+}
+
+func (lx *luaLexer) number() float64 {
+	start := lx.pos
+	if lx.peekByte(0) == '0' && (lx.peekByte(1) == 'x' || lx.peekByte(1) == 'X') {
+		lx.pos += 2
+		for lx.pos < len(lx.src) && isHexDigit(lx.src[lx.pos]) {
+			lx.pos++
+		}
+		n, err := strconv.ParseUint(lx.src[start+2:lx.pos], 16, 64)
+		if err != nil {
+			lx.errorf("malformed number near '%s'", lx.src[start:lx.pos])
+		}
+		return float64(n)
+	}
+	for lx.pos < len(lx.src) {
+		c := lx.src[lx.pos]
+		if isDigit(c) || c == '.' {
+			lx.pos++
+		} else if (c == 'e' || c == 'E') && lx.pos > start {
+			lx.pos++
+			if lx.peekByte(0) == '+' || lx.peekByte(0) == '-' {
+				lx.pos++
+			}
+		} else {
+			break
+		}
+	}
+	// Like Lua, a number running into a name is malformed.
+	for lx.pos < len(lx.src) && isLuaNameChar(lx.src[lx.pos]) {
+		lx.pos++
+	}
+	n, err := strconv.ParseFloat(lx.src[start:lx.pos], 64)
+	if err != nil {
+		lx.errorf("malformed number near '%s'", lx.src[start:lx.pos])
+	}
+	return n
+}
+
+func isLuaNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isLuaNameChar(c byte) bool {
+	return isLuaNameStart(c) || isDigit(c)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLuaTokenize(t *testing.T) {
+	name := func(s string) luaToken { return luaToken{kind: tokName, text: s} }
+	kw := func(s string) luaToken { return luaToken{kind: tokKeyword, text: s} }
+	op := func(s string) luaToken { return luaToken{kind: tokOp, text: s} }
+	str := func(s string) luaToken { return luaToken{kind: tokString, text: s} }
+	num := func(n float64) luaToken { return luaToken{kind: tokNumber, num: n} }
+
+	tests := []struct {
+		src  string
+		want []luaToken
+	}{
+		{"", nil},
+		{"local x = 1", []luaToken{kw("local"), name("x"), op("="), num(1)}},
+		{"a..b...", []luaToken{name("a"), op(".."), name("b"), op("...")}},
+		{"a<=b~=c==d", []luaToken{name("a"), op("<="), name("b"), op("~="), name("c"), op("=="), name("d")}},
+		{"3 3.5 .5 1e3 2E-2 0x1F", []luaToken{num(3), num(3.5), num(0.5), num(1000), num(0.02), num(31)}},
+		{`"a\tb\n" 'it''s'`, []luaToken{str("a\tb\n"), str("it"), str("s")}},
+		{`"\65\066\0067"`, []luaToken{str("AB\x067")}},
+		{"[[long\nstring]] [==[with ]] inside]==]", []luaToken{str("long\nstring"), str("with ]] inside")}},
+		{"[[\nskipped newline]]", []luaToken{str("skipped newline")}},
+		{"x -- comment\ny", []luaToken{name("x"), name("y")}},
+		{"x --[[ long\ncomment ]] y", []luaToken{name("x"), name("y")}},
+		{"#!/usr/bin/lua\nreturn", []luaToken{kw("return")}},
+		{"t[1]", []luaToken{name("t"), op("["), num(1), op("]")}},
+	}
+	for _, tt := range tests {
+		tokens, err := luaTokenize(tt.src)
+		if err != nil {
+			t.Errorf("luaTokenize(%q): %v", tt.src, err)
+			continue
+		}
+		if last := tokens[len(tokens)-1]; last.kind != tokEOF {
+			t.Errorf("luaTokenize(%q) doesn't end with EOF", tt.src)
+		}
+		got := tokens[:len(tokens)-1]
+		for i := range got {
+			got[i].line = 0
+		}
+		if len(got) == 0 {
+			got = nil
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("luaTokenize(%q) = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestLuaTokenizeLines(t *testing.T) {
+	tokens, err := luaTokenize("a\n[[x\ny]]\n-- c\nb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []int
+	for _, tok := range tokens {
+		lines = append(lines, tok.line)
+	}
+	if want := []int{1, 2, 5, 5}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("lines = %v, want %v", lines, want)
+	}
+}
+
+func TestLuaTokenizeErrors(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{`"open`, "unfinished string"},
+		{"\"line\nbreak\"", "unfinished string"},
+		{"[[open", "unfinished long string"},
+		{`"\q"`, "invalid escape sequence"},
+		{`"\300"`, "escape sequence too large"},
+		{"3x", "malformed number"},
+		{"a @ b", "unexpected symbol"},
+	}
+	for _, tt := range tests {
+		_, err := luaTokenize(tt.src)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("luaTokenize(%q) error = %v, want %q", tt.src, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,959 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The subset of the Lua standard library available to scripts: the base
+// functions and the string, table, math, bit and cjson libraries.
+
+// newLuaState returns an interpreter with the standard library loaded.
+func newLuaState(chunkName string) *luaState {
+	L := &luaState{globals: newLuaTable(0, 64), chunkName: chunkName}
+	L.openBase()
+	L.strings = L.openLib("string", luaStringLib)
+	L.openLib("table", luaTableLib)
+	mathLib := L.openLib("math", luaMathLib)
+	mathLib.set("pi", math.Pi)
+	mathLib.set("huge", math.Inf(1))
+	L.openLib("bit", luaBitLib)
+	cjson := L.openLib("cjson", luaJSONLib)
+	cjson.set("null", luaJSONNull)
+	return L
+}
+
+func (L *luaState) register(t *luaTable, name string, fn func(L *luaState, args []any) []any) {
+	t.set(name, &luaGoFunction{name: name, fn: fn})
+}
+
+func (L *luaState) openLib(name string, funcs map[string]func(L *luaState, args []any) []any) *luaTable {
+	lib := newLuaTable(0, len(funcs))
+	for fname, fn := range funcs {
+		L.register(lib, fname, fn)
+	}
+	L.globals.set(name, lib)
+	return lib
+}
+
+// argError raises the error for a bad argument to a library function.
+func (L *luaState) argError(i int, fname, msg string) {
+	L.errorf(L.line, "bad argument #%d to '%s' (%s)", i+1, fname, msg)
+}
+
+func (L *luaState) typeError(args []any, i int, fname, want string) {
+	got := "no value"
+	if i < len(args) {
+		got = luaTypeName(args[i])
+	}
+	L.argError(i, fname, fmt.Sprintf("%s expected, got %s", want, got))
+}
+
+func luaArg(args []any, i int) any {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
+
+func (L *luaState) checkAny(args []any, i int, fname string) any {
+	if i >= len(args) {
+		L.argError(i, fname, "value expected")
+	}
+	return args[i]
+}
+
+func (L *luaState) checkNumber(args []any, i int, fname string) float64 {
+	n, ok := luaToNumber(luaArg(args, i))
+	if !ok {
+		L.typeError(args, i, fname, "number")
+	}
+	return n
+}
+
+func (L *luaState) checkInt(args []any, i int, fname string) int {
+	return int(L.checkNumber(args, i, fname))
+}
+
+func (L *luaState) optInt(args []any, i int, fname string, def int) int {
+	if luaArg(args, i) == nil {
+		return def
+	}
+	return L.checkInt(args, i, fname)
+}
+
+func (L *luaState) checkString(args []any, i int, fname string) string {
+	s, ok := luaConcatString(luaArg(args, i))
+	if !ok {
+		L.typeError(args, i, fname, "string")
+	}
+	return s
+}
+
+func (L *luaState) checkTable(args []any, i int, fname string) *luaTable {
+	t, ok := luaArg(args, i).(*luaTable)
+	if !ok {
+		L.typeError(args, i, fname, "table")
+	}
+	return t
+}
+
+// tostring converts v to a string like the tostring function, calling
+// the __tostring metamethod if there is one.
+func (L *luaState) tostring(v any) string {
+	if t, ok := v.(*luaTable); ok && t.meta != nil {
+		if handler := t.meta.get("__tostring"); handler != nil {
+			s, ok := luaFirst(L.call(handler, []any{v}, L.line)).(string)
+			if !ok {
+				L.errorf(L.line, "'__tostring' must return a string")
+			}
+			return s
+		}
+	}
+	return luaToString(v)
+}
+
+func (L *luaState) openBase() {
+	g := L.globals
+	g.set("_G", g)
+	g.set("_VERSION", "Lua 5.1")
+	for name, fn := range map[string]func(L *luaState, args []any) []any{
+		"assert":       luaAssert,
+		"error":        luaErrorFunc,
+		"pcall":        luaPcall,
+		"xpcall":       luaXpcall,
+		"type":         luaType,
+		"tostring":     luaTostring,
+		"tonumber":     luaTonumber,
+		"ipairs":       luaIpairs,
+		"pairs":        luaPairs,
+		"next":         luaNext,
+		"select":       luaSelect,
+		"unpack":       luaUnpack,
+		"rawget":       luaRawget,
+		"rawset":       luaRawset,
+		"rawequal":     luaRawequal,
+		"setmetatable": luaSetmetatable,
+		"getmetatable": luaGetmetatable,
+	} {
+		L.register(g, name, fn)
+	}
+}
+
+func luaAssert(L *luaState, args []any) []any {
+	if !luaTruthy(L.checkAny(args, 0, "assert")) {
+		if len(args) > 1 {
+			panic(&luaError{args[1]})
+		}
+		L.errorf(L.line, "assertion failed!")
+	}
+	return args
+}
+
+func luaErrorFunc(L *luaState, args []any) []any {
+	val := luaArg(args, 0)
+	level := L.optInt(args, 1, "error", 1)
+	// Only level 1, the position of the error call, is known.
+	if msg, ok := val.(string); ok && level > 0 && L.line > 0 {
+		val = fmt.Sprintf("%s:%d: %s", L.chunkName, L.line, msg)
+	}
+	panic(&luaError{val})
+}
+
+func luaPcall(L *luaState, args []any) []any {
+	fn := L.checkAny(args, 0, "pcall")
+	rets, err := L.protectedCall(fn, args[1:])
+	if err != nil {
+		return []any{false, err.value}
+	}
+	return append([]any{true}, rets...)
+}
+
+func luaXpcall(L *luaState, args []any) []any {
+	fn := L.checkAny(args, 0, "xpcall")
+	handler := L.checkAny(args, 1, "xpcall")
+	rets, err := L.protectedCall(fn, nil)
+	if err != nil {
+		return append([]any{false}, luaFirst(L.call(handler, []any{err.value}, L.line)))
+	}
+	return append([]any{true}, rets...)
+}
+
+func luaType(L *luaState, args []any) []any {
+	return []any{luaTypeName(L.checkAny(args, 0, "type"))}
+}
+
+func luaTostring(L *luaState, args []any) []any {
+	return []any{L.tostring(L.checkAny(args, 0, "tostring"))}
+}
+
+func luaTonumber(L *luaState, args []any) []any {
+	base := L.optInt(args, 1, "tonumber", 10)
+	v := L.checkAny(args, 0, "tonumber")
+	if base == 10 {
+		if n, ok := luaToNumber(v); ok {
+			return []any{n}
+		}
+		return []any{nil}
+	}
+	if base < 2 || base > 36 {
+		L.argError(1, "tonumber", "base out of range")
+	}
+	s := strings.ToLower(strings.TrimSpace(L.checkString(args, 0, "tonumber")))
+	n, err := strconv.ParseInt(s, base, 64)
+	if err != nil {
+		return []any{nil}
+	}
+	return []any{float64(n)}
+}
+
+func luaIpairs(L *luaState, args []any) []any {
+	L.checkTable(args, 0, "ipairs")
+	iter := &luaGoFunction{name: "ipairs_aux", fn: func(L *luaState, args []any) []any {
+		t := L.checkTable(args, 0, "ipairs")
+		i := L.checkNumber(args, 1, "ipairs") + 1
+		v := t.get(i)
+		if v == nil {
+			return []any{nil}
+		}
+		return []any{i, v}
+	}}
+	return []any{iter, args[0], 0.0}
+}
+
+var luaNextFunc = &luaGoFunction{name: "next", fn: luaNext}
+
+func luaPairs(L *luaState, args []any) []any {
+	L.checkTable(args, 0, "pairs")
+	return []any{luaNextFunc, args[0], nil}
+}
+
+func luaNext(L *luaState, args []any) []any {
+	t := L.checkTable(args, 0, "next")
+	key, val, ok := t.next(luaArg(args, 1))
+	if !ok {
+		L.errorf(L.line, "invalid key to 'next'")
+	}
+	if key == nil {
+		return []any{nil}
+	}
+	return []any{key, val}
+}
+
+func luaSelect(L *luaState, args []any) []any {
+	if s, ok := luaArg(args, 0).(string); ok && s == "#" {
+		return []any{float64(len(args) - 1)}
+	}
+	n := L.checkInt(args, 0, "select")
+	switch {
+	case n < 0:
+		n += len(args)
+		if n < 1 {
+			L.argError(0, "select", "index out of range")
+		}
+	case n == 0:
+		L.argError(0, "select", "index out of range")
+	case n >= len(args):
+		return nil
+	}
+	return args[n:]
+}
+
+func luaUnpack(L *luaState, args []any) []any {
+	t := L.checkTable(args, 0, "unpack")
+	i := L.optInt(args, 1, "unpack", 1)
+	j := L.optInt(args, 2, "unpack", t.length())
+	if i > j {
+		return nil
+	}
+	if j-i >= 8000 {
+		L.errorf(L.line, "too many results to unpack")
+	}
+	vals := make([]any, 0, j-i+1)
+	for k := i; k <= j; k++ {
+		vals = append(vals, t.get(float64(k)))
+	}
+	return vals
+}
+
+func luaRawget(L *luaState, args []any) []any {
+	return []any{L.checkTable(args, 0, "rawget").get(L.checkAny(args, 1, "rawget"))}
+}
+
+func luaRawset(L *luaState, args []any) []any {
+	t := L.checkTable(args, 0, "rawset")
+	key := L.checkAny(args, 1, "rawset")
+	L.checkKey(key, L.line)
+	t.set(key, L.checkAny(args, 2, "rawset"))
+	return []any{t}
+}
+
+func luaRawequal(L *luaState, args []any) []any {
+	return []any{luaRawEqual(L.checkAny(args, 0, "rawequal"), L.checkAny(args, 1, "rawequal"))}
+}
+
+func luaSetmetatable(L *luaState, args []any) []any {
+	t := L.checkTable(args, 0, "setmetatable")
+	switch meta := luaArg(args, 1).(type) {
+	case nil:
+		t.meta = nil
+	case *luaTable:
+		t.meta = meta
+	default:
+		L.argError(1, "setmetatable", "nil or table expected")
+	}
+	if t == L.globals && L.readOnly {
+		L.errorf(L.line, "Attempt to modify a readonly table")
+	}
+	return []any{t}
+}
+
+func luaGetmetatable(L *luaState, args []any) []any {
+	switch v := L.checkAny(args, 0, "getmetatable").(type) {
+	case *luaTable:
+		if v.meta != nil {
+			return []any{v.meta}
+		}
+	case string:
+		meta := newLuaTable(0, 1)
+		meta.set("__index", L.strings)
+		return []any{meta}
+	}
+	return []any{nil}
+}
+
+var luaStringLib = map[string]func(L *luaState, args []any) []any{
+	"len": func(L *luaState, args []any) []any {
+		return []any{float64(len(L.checkString(args, 0, "len")))}
+	},
+	"sub": func(L *luaState, args []any) []any {
+		s := L.checkString(args, 0, "sub")
+		i, j := luaStringRange(len(s), L.optInt(args, 1, "sub", 1), L.optInt(args, 2, "sub", -1))
+		if i > j {
+			return []any{""}
+		}
+		return []any{s[i-1 : j]}
+	},
+	"upper": func(L *luaState, args []any) []any {
+		return []any{strings.ToUpper(L.checkString(args, 0, "upper"))}
+	},
+	"lower": func(L *luaState, args []any) []any {
+		return []any{strings.ToLower(L.checkString(args, 0, "lower"))}
+	},
+	"rep": func(L *luaState, args []any) []any {
+		s := L.checkString(args, 0, "rep")
+		n := L.checkInt(args, 1, "rep")
+		if n <= 0 {
+			return []any{""}
+		}
+		if len(s)*n > 512*1024*1024 {
+			L.errorf(L.line, "not enough memory")
+		}
+		return []any{strings.Repeat(s, n)}
+	},
+	"reverse": func(L *luaState, args []any) []any {
+		b := []byte(L.checkString(args, 0, "reverse"))
+		for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+			b[i], b[j] = b[j], b[i]
+		}
+		return []any{string(b)}
+	},
+	"byte": func(L *luaState, args []any) []any {
+		s := L.checkString(args, 0, "byte")
+		start := L.optInt(args, 1, "byte", 1)
+		i, j := luaStringRange(len(s), start, L.optInt(args, 2, "byte", start))
+		var vals []any
+		for k := i; k <= j; k++ {
+			vals = append(vals, float64(s[k-1]))
+		}
+		return vals
+	},
+	"char": func(L *luaState, args []any) []any {
+		b := make([]byte, len(args))
+		for i := range args {
+			c := L.checkInt(args, i, "char")
+			if c < 0 || c > 255 {
+				L.argError(i, "char", "invalid value")
+			}
+			b[i] = byte(c)
+		}
+		return []any{string(b)}
+	},
+	"format": luaStringFormat,
+	"find": func(L *luaState, args []any) []any {
+		return luaStringFind(L, args, "find", true)
+	},
+	"match": func(L *luaState, args []any) []any {
+		return luaStringFind(L, args, "match", false)
+	},
+	"gmatch": luaStringGmatch,
+	"gsub":   luaStringGsub,
+}
+
+// luaStringRange converts Lua's 1-based and possibly negative string
+// positions i and j into a range clamped to a string of length n.
+func luaStringRange(n, i, j int) (int, int) {
+	if i < 0 {
+		i = max(n+i+1, 1)
+	} else if i == 0 {
+		i = 1
+	}
+	if j < 0 {
+		j = n + j + 1
+	} else if j > n {
+		j = n
+	}
+	return i, j
+}
+
+func luaStringFind(L *luaState, args []any, fname string, find bool) []any {
+	s := L.checkString(args, 0, fname)
+	pattern := L.checkString(args, 1, fname)
+	init := L.optInt(args, 2, fname, 1)
+	if init < 0 {
+		init = max(len(s)+init+1, 1)
+	} else if init == 0 {
+		init = 1
+	}
+	if init > len(s)+1 {
+		return []any{nil}
+	}
+	if find && (luaTruthy(luaArg(args, 3)) || !strings.ContainsAny(pattern, "^$*+?.([%-")) {
+		idx := strings.Index(s[init-1:], pattern)
+		if idx < 0 {
+			return []any{nil}
+		}
+		return []any{float64(init + idx), float64(init + idx + len(pattern) - 1)}
+	}
+	anchor := strings.HasPrefix(pattern, "^")
+	ms := &luaMatchState{L: L, src: s, pattern: pattern}
+	p := 0
+	if anchor {
+		p = 1
+	}
+	for start := init - 1; start <= len(s); start++ {
+		ms.level = 0
+		if end := ms.match(start, p); end != -1 {
+			if find {
+				return append([]any{float64(start + 1), float64(end)}, ms.captures(start, end, false)...)
+			}
+			return ms.captures(start, end, true)
+		}
+		if anchor {
+			break
+		}
+	}
+	return []any{nil}
+}
+
+func luaStringGmatch(L *luaState, args []any) []any {
+	s := L.checkString(args, 0, "gmatch")
+	pattern := L.checkString(args, 1, "gmatch")
+	pos := 0
+	iter := func(L *luaState, _ []any) []any {
+		ms := &luaMatchState{L: L, src: s, pattern: pattern}
+		for ; pos <= len(s); pos++ {
+			ms.level = 0
+			if end := ms.match(pos, 0); end != -1 {
+				start := pos
+				pos = end
+				if end == start {
+					pos++
+				}
+				return ms.captures(start, end, true)
+			}
+		}
+		return []any{nil}
+	}
+	return []any{&luaGoFunction{name: "gmatch_aux", fn: iter}}
+}
+
+func luaStringGsub(L *luaState, args []any) []any {
+	s := L.checkString(args, 0, "gsub")
+	pattern := L.checkString(args, 1, "gsub")
+	repl := luaArg(args, 2)
+	switch repl.(type) {
+	case float64, string, *luaTable, *luaClosure, *luaGoFunction:
+	default:
+		L.typeError(args, 2, "gsub", "string/function/table")
+	}
+	maxN := L.optInt(args, 3, "gsub", len(s)+1)
+	anchor := strings.HasPrefix(pattern, "^")
+	p := 0
+	if anchor {
+		p = 1
+	}
+	ms := &luaMatchState{L: L, src: s, pattern: pattern}
+	var sb strings.Builder
+	pos, n := 0, 0
+	for n < maxN {
+		ms.level = 0
+		end := ms.match(pos, p)
+		if end != -1 {
+			n++
+			luaAddReplacement(L, ms, &sb, pos, end, repl)
+		}
+		switch {
+		case end != -1 && end > pos:
+			pos = end
+		case pos < len(s):
+			sb.WriteByte(s[pos])
+			pos++
+		default:
+			pos = len(s) + 1
+		}
+		if pos > len(s) || anchor {
+			break
+		}
+	}
+	if pos < len(s) {
+		sb.WriteString(s[pos:])
+	}
+	return []any{sb.String(), float64(n)}
+}
+
+func luaAddReplacement(L *luaState, ms *luaMatchState, sb *strings.Builder, s, e int, repl any) {
+	var val any
+	switch r := repl.(type) {
+	case string, float64:
+		str, _ := luaConcatString(r)
+		for i := 0; i < len(str); i++ {
+			c := str[i]
+			if c != '%' || i+1 == len(str) {
+				sb.WriteByte(c)
+				continue
+			}
+			i++
+			switch {
+			case str[i] == '0':
+				sb.WriteString(ms.src[s:e])
+			case isDigit(str[i]):
+				v, _ := luaConcatString(ms.captureValue(int(str[i]-'1'), s, e))
+				sb.WriteString(v)
+			default:
+				sb.WriteByte(str[i])
+			}
+		}
+		return
+	case *luaTable:
+		val = L.index(r, ms.captureValue(0, s, e), L.line)
+	default:
+		val = luaFirst(L.call(r, ms.captures(s, e, true), L.line))
+	}
+	if !luaTruthy(val) {
+		sb.WriteString(ms.src[s:e])
+		return
+	}
+	str, ok := luaConcatString(val)
+	if !ok {
+		L.errorf(L.line, "invalid replacement value (a %s)", luaTypeName(val))
+	}
+	sb.WriteString(str)
+}
+
+func luaStringFormat(L *luaState, args []any) []any {
+	format := L.checkString(args, 0, "format")
+	var sb strings.Builder
+	arg := 0
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' {
+			sb.WriteByte(c)
+			continue
+		}
+		i++
+		if i < len(format) && format[i] == '%' {
+			sb.WriteByte('%')
+			continue
+		}
+		start := i
+		for i < len(format) && strings.IndexByte("-+ #0", format[i]) >= 0 {
+			i++
+		}
+		for i < len(format) && (isDigit(format[i]) || format[i] == '.') {
+			i++
+		}
+		if i >= len(format) || i-start > 8 {
+			L.errorf(L.line, "invalid format (repeated flags)")
+		}
+		spec := "%" + format[start:i]
+		arg++
+		switch conv := format[i]; conv {
+		case 'd', 'i':
+			sb.WriteString(fmt.Sprintf(spec+"d", int64(L.checkNumber(args, arg, "format"))))
+		case 'u':
+			sb.WriteString(fmt.Sprintf(spec+"d", uint64(int64(L.checkNumber(args, arg, "format")))))
+		case 'c':
+			sb.WriteByte(byte(L.checkInt(args, arg, "format")))
+		case 'o', 'x', 'X':
+			sb.WriteString(fmt.Sprintf(spec+string(conv), uint64(int64(L.checkNumber(args, arg, "format")))))
+		case 'e', 'E', 'f', 'g', 'G':
+			sb.WriteString(fmt.Sprintf(spec+string(conv), L.checkNumber(args, arg, "format")))
+		case 'q':
+			sb.WriteString(luaQuote(L.checkString(args, arg, "format")))
+		case 's':
+			sb.WriteString(fmt.Sprintf(spec+"s", L.tostring(L.checkAny(args, arg, "format"))))
+		default:
+			L.errorf(L.line, "invalid option '%%%c' to 'format'", conv)
+		}
+	}
+	return []any{sb.String()}
+}
+
+// luaQuote quotes s so that Lua can read it back, like %q.
+func luaQuote(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\', '\n':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case '\r':
+			sb.WriteString("\\r")
+		case 0:
+			sb.WriteString("\\000")
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+var luaTableLib = map[string]func(L *luaState, args []any) []any{
+	"insert": func(L *luaState, args []any) []any {
+		t := L.checkTable(args, 0, "insert")
+		n := t.length()
+		switch len(args) {
+		case 2:
+			t.set(float64(n+1), args[1])
+		case 3:
+			pos := L.checkInt(args, 1, "insert")
+			for i := n; i >= pos; i-- {
+				t.set(float64(i+1), t.get(float64(i)))
+			}
+			t.set(float64(pos), args[2])
+		default:
+			L.errorf(L.line, "wrong number of arguments to 'insert'")
+		}
+		return nil
+	},
+	"remove": func(L *luaState, args []any) []any {
+		t := L.checkTable(args, 0, "remove")
+		n := t.length()
+		pos := L.optInt(args, 1, "remove", n)
+		if n == 0 {
+			return nil
+		}
+		val := t.get(float64(pos))
+		for i := pos; i < n; i++ {
+			t.set(float64(i), t.get(float64(i+1)))
+		}
+		t.set(float64(n), nil)
+		return []any{val}
+	},
+	"concat": func(L *luaState, args []any) []any {
+		t := L.checkTable(args, 0, "concat")
+		sep := ""
+		if luaArg(args, 1) != nil {
+			sep = L.checkString(args, 1, "concat")
+		}
+		i := L.optInt(args, 2, "concat", 1)
+		j := L.optInt(args, 3, "concat", t.length())
+		parts := make([]string, 0, max(j-i+1, 0))
+		for k := i; k <= j; k++ {
+			s, ok := luaConcatString(t.get(float64(k)))
+			if !ok {
+				L.errorf(L.line, "invalid value (at index %d) in table for 'concat'", k)
+			}
+			parts = append(parts, s)
+		}
+		return []any{strings.Join(parts, sep)}
+	},
+	"sort": func(L *luaState, args []any) []any {
+		t := L.checkTable(args, 0, "sort")
+		less := luaArg(args, 1)
+		n := t.length()
+		vals := make([]any, n)
+		for i := range vals {
+			vals[i] = t.get(float64(i + 1))
+		}
+		sort.SliceStable(vals, func(i, j int) bool {
+			if less != nil {
+				return luaTruthy(luaFirst(L.call(less, []any{vals[i], vals[j]}, L.line)))
+			}
+			return L.lessThan(vals[i], vals[j], L.line)
+		})
+		for i, v := range vals {
+			t.set(float64(i+1), v)
+		}
+		return nil
+	},
+	"getn": func(L *luaState, args []any) []any {
+		return []any{float64(L.checkTable(args, 0, "getn").length())}
+	},
+	"maxn": func(L *luaState, args []any) []any {
+		t := L.checkTable(args, 0, "maxn")
+		maxN := 0.0
+		var key any
+		for {
+			var ok bool
+			key, _, ok = t.next(key)
+			if !ok || key == nil {
+				return []any{maxN}
+			}
+			if f, isNum := key.(float64); isNum && f > maxN {
+				maxN = f
+			}
+		}
+	},
+}
+
+// luaRand is seeded the same way for every script, so that scripts are
+// deterministic, as in Redis.
+var luaRand = rand.New(rand.NewSource(0))
+
+func luaMathFunc(name string, fn func(float64) float64) func(L *luaState, args []any) []any {
+	return func(L *luaState, args []any) []any {
+		return []any{fn(L.checkNumber(args, 0, name))}
+	}
+}
+
+var luaMathLib = map[string]func(L *luaState, args []any) []any{
+	"abs":   luaMathFunc("abs", math.Abs),
+	"ceil":  luaMathFunc("ceil", math.Ceil),
+	"floor": luaMathFunc("floor", math.Floor),
+	"sqrt":  luaMathFunc("sqrt", math.Sqrt),
+	"exp":   luaMathFunc("exp", math.Exp),
+	"log":   luaMathFunc("log", math.Log),
+	"log10": luaMathFunc("log10", math.Log10),
+	"sin":   luaMathFunc("sin", math.Sin),
+	"cos":   luaMathFunc("cos", math.Cos),
+	"tan":   luaMathFunc("tan", math.Tan),
+	"pow": func(L *luaState, args []any) []any {
+		return []any{math.Pow(L.checkNumber(args, 0, "pow"), L.checkNumber(args, 1, "pow"))}
+	},
+	"fmod": func(L *luaState, args []any) []any {
+		return []any{math.Mod(L.checkNumber(args, 0, "fmod"), L.checkNumber(args, 1, "fmod"))}
+	},
+	"modf": func(L *luaState, args []any) []any {
+		i, f := math.Modf(L.checkNumber(args, 0, "modf"))
+		return []any{i, f}
+	},
+	"max": func(L *luaState, args []any) []any {
+		m := L.checkNumber(args, 0, "max")
+		for i := 1; i < len(args); i++ {
+			m = math.Max(m, L.checkNumber(args, i, "max"))
+		}
+		return []any{m}
+	},
+	"min": func(L *luaState, args []any) []any {
+		m := L.checkNumber(args, 0, "min")
+		for i := 1; i < len(args); i++ {
+			m = math.Min(m, L.checkNumber(args, i, "min"))
+		}
+		return []any{m}
+	},
+	"random": func(L *luaState, args []any) []any {
+		r := luaRand.Float64()
+		switch len(args) {
+		case 0:
+			return []any{r}
+		case 1:
+			m := L.checkInt(args, 0, "random")
+			if m < 1 {
+				L.argError(0, "random", "interval is empty")
+			}
+			return []any{math.Floor(r*float64(m)) + 1}
+		default:
+			lo, hi := L.checkInt(args, 0, "random"), L.checkInt(args, 1, "random")
+			if lo > hi {
+				L.argError(1, "random", "interval is empty")
+			}
+			return []any{math.Floor(r*float64(hi-lo+1)) + float64(lo)}
+		}
+	},
+	"randomseed": func(L *luaState, args []any) []any {
+		luaRand.Seed(int64(L.checkNumber(args, 0, "randomseed")))
+		return nil
+	},
+}
+
+// luaBitArg returns argument i as a 32-bit integer, as the bit library
+// of LuaJIT and Redis does.
+func (L *luaState) bitArg(args []any, i int, fname string) int32 {
+	n := L.checkNumber(args, i, fname)
+	return int32(uint32(int64(math.Mod(n, 1<<32))))
+}
+
+func luaBitOp(name string, op func(a, b int32) int32) func(L *luaState, args []any) []any {
+	return func(L *luaState, args []any) []any {
+		r := L.bitArg(args, 0, name)
+		for i := 1; i < len(args); i++ {
+			r = op(r, L.bitArg(args, i, name))
+		}
+		return []any{float64(r)}
+	}
+}
+
+var luaBitLib = map[string]func(L *luaState, args []any) []any{
+	"tobit": func(L *luaState, args []any) []any {
+		return []any{float64(L.bitArg(args, 0, "tobit"))}
+	},
+	"bnot": func(L *luaState, args []any) []any {
+		return []any{float64(^L.bitArg(args, 0, "bnot"))}
+	},
+	"band": luaBitOp("band", func(a, b int32) int32 { return a & b }),
+	"bor":  luaBitOp("bor", func(a, b int32) int32 { return a | b }),
+	"bxor": luaBitOp("bxor", func(a, b int32) int32 { return a ^ b }),
+	"lshift": func(L *luaState, args []any) []any {
+		return []any{float64(L.bitArg(args, 0, "lshift") << (L.bitArg(args, 1, "lshift") & 31))}
+	},
+	"rshift": func(L *luaState, args []any) []any {
+		return []any{float64(int32(uint32(L.bitArg(args, 0, "rshift")) >> (L.bitArg(args, 1, "rshift") & 31)))}
+	},
+	"arshift": func(L *luaState, args []any) []any {
+		return []any{float64(L.bitArg(args, 0, "arshift") >> (L.bitArg(args, 1, "arshift") & 31))}
+	},
+	"tohex": func(L *luaState, args []any) []any {
+		x := uint32(L.bitArg(args, 0, "tohex"))
+		n := 8
+		if luaArg(args, 1) != nil {
+			n = int(L.bitArg(args, 1, "tohex"))
+		}
+		format := "%08x"
+		if n < 0 {
+			n, format = -n, "%08X"
+		}
+		s := fmt.Sprintf(format, x)
+		return []any{s[len(s)-min(n, 8):]}
+	},
+}
+
+// luaJSONNull is cjson.null, which stands for JSON null values.
+var luaJSONNull = &luaUserdata{name: "cjson.null"}
+
+var luaJSONLib = map[string]func(L *luaState, args []any) []any{
+	"encode": func(L *luaState, args []any) []any {
+		var buf bytes.Buffer
+		luaJSONEncode(L, &buf, L.checkAny(args, 0, "encode"), 0)
+		return []any{buf.String()}
+	},
+	"decode": func(L *luaState, args []any) []any {
+		n, err := parseJSON(L.checkString(args, 0, "decode"))
+		if err != nil {
+			L.errorf(L.line, "Expected value but found invalid token")
+		}
+		return []any{luaFromJSON(n)}
+	},
+}
+
+func luaJSONEncode(L *luaState, sb *bytes.Buffer, v any, depth int) {
+	if depth > 1000 {
+		L.errorf(L.line, "Cannot serialise, excessive nesting (1001)")
+	}
+	switch v := v.(type) {
+	case nil:
+		sb.WriteString("null")
+	case bool:
+		sb.WriteString(strconv.FormatBool(v))
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			L.errorf(L.line, "Cannot serialise number: must not be NaN or Inf")
+		}
+		sb.WriteString(luaNumberString(v))
+	case string:
+		writeJSONString(sb, v)
+	case *luaUserdata:
+		if v != luaJSONNull {
+			L.errorf(L.line, "Cannot serialise userdata: type not supported")
+		}
+		sb.WriteString("null")
+	case *luaTable:
+		// A table whose keys are exactly 1..n is an array.
+		n, isArray := 0, true
+		var key any
+		for {
+			var ok bool
+			key, _, ok = v.next(key)
+			if !ok || key == nil {
+				break
+			}
+			n++
+			if f, isNum := key.(float64); !isNum || f != math.Trunc(f) || f < 1 {
+				isArray = false
+			}
+		}
+		if isArray && n > 0 && n == v.length() {
+			sb.WriteByte('[')
+			for i := 1; i <= n; i++ {
+				if i > 1 {
+					sb.WriteByte(',')
+				}
+				luaJSONEncode(L, sb, v.get(float64(i)), depth+1)
+			}
+			sb.WriteByte(']')
+			return
+		}
+		sb.WriteByte('{')
+		first := true
+		key = nil
+		for {
+			var val any
+			key, val, _ = v.next(key)
+			if key == nil {
+				break
+			}
+			var name string
+			switch k := key.(type) {
+			case string:
+				name = k
+			case float64:
+				name = luaNumberString(k)
+			default:
+				L.errorf(L.line, "Cannot serialise %s: table key must be a number or string", luaTypeName(key))
+			}
+			if !first {
+				sb.WriteByte(',')
+			}
+			first = false
+			writeJSONString(sb, name)
+			sb.WriteByte(':')
+			luaJSONEncode(L, sb, val, depth+1)
+		}
+		sb.WriteByte('}')
+	default:
+		L.errorf(L.line, "Cannot serialise %s: type not supported", luaTypeName(v))
+	}
+}
+
+// luaFromJSON converts a JSON document into Lua values.
+func luaFromJSON(n *jsonNode) any {
+	switch n.kind {
+	case jsonNull:
+		return luaJSONNull
+	case jsonBool:
+		return n.b
+	case jsonInteger, jsonNumber:
+		return n.float()
+	case jsonString:
+		return n.str
+	case jsonArray:
+		t := newLuaTable(len(n.items), 0)
+		for i, item := range n.items {
+			t.set(float64(i+1), luaFromJSON(item))
+		}
+		return t
+	}
+	t := newLuaTable(0, len(n.keys))
+	for _, key := range n.keys {
+		t.set(key, luaFromJSON(n.fields[key]))
+	}
+	return t
+}
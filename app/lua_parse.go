@@ -0,0 +1,738 @@
+package main
+
+import "fmt"
+
+// Binary and unary operators of luaBinExpr and luaUnExpr.
+const (
+	luaOpAdd = iota
+	luaOpSub
+	luaOpMul
+	luaOpDiv
+	luaOpMod
+	luaOpPow
+	luaOpConcat
+	luaOpEq
+	luaOpNe
+	luaOpLt
+	luaOpLe
+	luaOpGt
+	luaOpGe
+	luaOpAnd
+	luaOpOr
+	luaOpNeg
+	luaOpNot
+	luaOpLen
+)
+
+// luaBinaryOps maps operator tokens to their opcode and their left and
+// right priorities, as in the Lua 5.1 parser.
+var luaBinaryOps = map[string][3]int{
+	"+": {luaOpAdd, 6, 6}, "-": {luaOpSub, 6, 6},
+	"*": {luaOpMul, 7, 7}, "/": {luaOpDiv, 7, 7}, "%": {luaOpMod, 7, 7},
+	"^":  {luaOpPow, 10, 9},
+	"..": {luaOpConcat, 5, 4},
+	"==": {luaOpEq, 3, 3}, "~=": {luaOpNe, 3, 3},
+	"<": {luaOpLt, 3, 3}, "<=": {luaOpLe, 3, 3},
+	">": {luaOpGt, 3, 3}, ">=": {luaOpGe, 3, 3},
+	"and": {luaOpAnd, 2, 2}, "or": {luaOpOr, 1, 1},
+}
+
+const luaUnaryPriority = 8
+
+// Expressions. Variables are resolved while parsing, to a slot in the
+// frame of the enclosing function, an upvalue of the closure or a global.
+type luaExpr any
+
+type (
+	luaConstExpr  struct{ val any }
+	luaVarargExpr struct{}
+	luaLocalExpr  struct{ slot int }
+	luaUpvalExpr  struct{ index int }
+	luaGlobalExpr struct {
+		name string
+		line int
+	}
+	luaIndexExpr struct {
+		obj, key luaExpr
+		line     int
+	}
+	luaCallExpr struct {
+		fn   luaExpr
+		args []luaExpr
+		line int
+	}
+	luaMethodExpr struct {
+		obj  luaExpr
+		name string
+		args []luaExpr
+		line int
+	}
+	luaFuncExpr struct{ proto *luaProto }
+	luaBinExpr  struct {
+		op   int
+		l, r luaExpr
+		line int
+	}
+	luaUnExpr struct {
+		op   int
+		e    luaExpr
+		line int
+	}
+	luaTableExpr struct {
+		items []luaTableItem
+		line  int
+	}
+	luaParenExpr struct{ e luaExpr }
+)
+
+// luaTableItem is a field of a table constructor. Positional fields have
+// no key.
+type luaTableItem struct {
+	key, val luaExpr
+}
+
+// Statements.
+type luaStat any
+
+type (
+	luaLocalStat struct {
+		slots []int
+		exprs []luaExpr
+	}
+	luaAssignStat struct {
+		targets []luaExpr
+		exprs   []luaExpr
+	}
+	luaCallStat  struct{ call luaExpr }
+	luaDoStat    struct{ body []luaStat }
+	luaWhileStat struct {
+		cond luaExpr
+		body []luaStat
+	}
+	luaRepeatStat struct {
+		body []luaStat
+		cond luaExpr
+	}
+	luaIfStat struct {
+		conds  []luaExpr
+		blocks [][]luaStat
+		orElse []luaStat
+	}
+	luaNumForStat struct {
+		slot              int
+		start, stop, step luaExpr
+		body              []luaStat
+		line              int
+	}
+	luaGenForStat struct {
+		slots []int
+		exprs []luaExpr
+		body  []luaStat
+		line  int
+	}
+	luaLocalFuncStat struct {
+		slot  int
+		proto *luaProto
+	}
+	luaReturnStat struct{ exprs []luaExpr }
+	luaBreakStat  struct{}
+)
+
+// luaProto is a parsed function.
+type luaProto struct {
+	name       string
+	line       int
+	params     []int // slots of the named parameters
+	isVararg   bool
+	numSlots   int
+	upvals     []luaUpvalDesc
+	upvalNames []string
+	body       []luaStat
+}
+
+// luaUpvalDesc tells where a closure finds an upvalue when it is created:
+// in a local slot of the enclosing function, or among its upvalues.
+type luaUpvalDesc struct {
+	fromLocal bool
+	index     int
+}
+
+type luaLocalVar struct {
+	name string
+	slot int
+}
+
+// luaFuncState tracks the function being parsed.
+type luaFuncState struct {
+	parent  *luaFuncState
+	proto   *luaProto
+	actives []luaLocalVar
+}
+
+type luaParser struct {
+	tokens []luaToken
+	pos    int
+	fs     *luaFuncState
+}
+
+// luaCompile parses a chunk of Lua source into the prototype of a vararg
+// function.
+func luaCompile(src, name string) (proto *luaProto, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			synErr, ok := r.(*luaSyntaxError)
+			if !ok {
+				panic(r)
+			}
+			synErr.chunk = name
+			proto, err = nil, synErr
+		}
+	}()
+	tokens, err := luaTokenize(src)
+	if err != nil {
+		err.(*luaSyntaxError).chunk = name
+		return nil, err
+	}
+	p := &luaParser{tokens: tokens}
+	proto = &luaProto{name: name, line: 0, isVararg: true}
+	p.fs = &luaFuncState{proto: proto}
+	proto.body = p.block()
+	if p.peek().kind != tokEOF {
+		p.errorf("'<eof>' expected near '%s'", p.tokenText(p.peek()))
+	}
+	return proto, nil
+}
+
+func (p *luaParser) peek() luaToken {
+	return p.tokens[p.pos]
+}
+
+func (p *luaParser) advance() luaToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *luaParser) errorf(format string, args ...any) {
+	panic(&luaSyntaxError{line: p.peek().line, msg: fmt.Sprintf(format, args...)})
+}
+
+func (p *luaParser) tokenText(tok luaToken) string {
+	switch tok.kind {
+	case tokEOF:
+		return "<eof>"
+	case tokNumber:
+		return luaNumberString(tok.num)
+	}
+	return tok.text
+}
+
+// is reports whether the next token is the given keyword or operator.
+func (p *luaParser) is(text string) bool {
+	tok := p.peek()
+	return (tok.kind == tokKeyword || tok.kind == tokOp) && tok.text == text
+}
+
+// accept consumes the next token if it is the given keyword or operator.
+func (p *luaParser) accept(text string) bool {
+	if p.is(text) {
+		p.advance()
+		return true
+	}
+	return false
+}
+
+func (p *luaParser) expect(text string) {
+	if !p.accept(text) {
+		p.errorf("'%s' expected near '%s'", text, p.tokenText(p.peek()))
+	}
+}
+
+// expectMatch expects the token closing what was opened by open on line.
+func (p *luaParser) expectMatch(text, open string, line int) {
+	if p.accept(text) {
+		return
+	}
+	if line == p.peek().line {
+		p.expect(text)
+	}
+	p.errorf("'%s' expected (to close '%s' at line %d) near '%s'", text, open, line, p.tokenText(p.peek()))
+}
+
+func (p *luaParser) name() string {
+	tok := p.peek()
+	if tok.kind != tokName {
+		p.errorf("<name> expected near '%s'", p.tokenText(tok))
+	}
+	p.advance()
+	return tok.text
+}
+
+// declare adds a local variable to the current scope and returns its slot.
+func (p *luaParser) declare(name string) int {
+	slot := p.fs.proto.numSlots
+	p.fs.proto.numSlots++
+	p.fs.actives = append(p.fs.actives, luaLocalVar{name, slot})
+	return slot
+}
+
+// resolve returns the expression for a variable reference.
+func (p *luaParser) resolve(name string, line int) luaExpr {
+	if slot, ok := findLocal(p.fs, name); ok {
+		return luaLocalExpr{slot}
+	}
+	if index, ok := findUpval(p.fs, name); ok {
+		return luaUpvalExpr{index}
+	}
+	return luaGlobalExpr{name, line}
+}
+
+func findLocal(fs *luaFuncState, name string) (int, bool) {
+	for i := len(fs.actives) - 1; i >= 0; i-- {
+		if fs.actives[i].name == name {
+			return fs.actives[i].slot, true
+		}
+	}
+	return 0, false
+}
+
+// findUpval returns the index of the upvalue of fs that refers to the
+// variable name of an enclosing function, adding the upvalue if needed.
+func findUpval(fs *luaFuncState, name string) (int, bool) {
+	for i, upName := range fs.proto.upvalNames {
+		if upName == name {
+			return i, true
+		}
+	}
+	if fs.parent == nil {
+		return 0, false
+	}
+	var desc luaUpvalDesc
+	if slot, ok := findLocal(fs.parent, name); ok {
+		desc = luaUpvalDesc{fromLocal: true, index: slot}
+	} else if index, ok := findUpval(fs.parent, name); ok {
+		desc = luaUpvalDesc{index: index}
+	} else {
+		return 0, false
+	}
+	fs.proto.upvals = append(fs.proto.upvals, desc)
+	fs.proto.upvalNames = append(fs.proto.upvalNames, name)
+	return len(fs.proto.upvals) - 1, true
+}
+
+// blockEnds reports whether the next token ends a block.
+func (p *luaParser) blockEnds() bool {
+	tok := p.peek()
+	if tok.kind == tokEOF {
+		return true
+	}
+	if tok.kind != tokKeyword {
+		return false
+	}
+	switch tok.text {
+	case "end", "else", "elseif", "until":
+		return true
+	}
+	return false
+}
+
+// block parses statements up to the end of a block, in a new scope.
+func (p *luaParser) block() []luaStat {
+	scope := len(p.fs.actives)
+	defer func() { p.fs.actives = p.fs.actives[:scope] }()
+	return p.statements()
+}
+
+func (p *luaParser) statements() []luaStat {
+	var stats []luaStat
+	for !p.blockEnds() {
+		if p.is("return") {
+			p.advance()
+			var exprs []luaExpr
+			if !p.blockEnds() && !p.is(";") {
+				exprs = p.exprList()
+			}
+			p.accept(";")
+			stats = append(stats, luaReturnStat{exprs})
+			if !p.blockEnds() {
+				p.errorf("'<eof>' expected near '%s'", p.tokenText(p.peek()))
+			}
+			break
+		}
+		if p.is("break") {
+			p.advance()
+			p.accept(";")
+			stats = append(stats, luaBreakStat{})
+			if !p.blockEnds() {
+				p.errorf("'end' expected near '%s'", p.tokenText(p.peek()))
+			}
+			break
+		}
+		if stat := p.statement(); stat != nil {
+			stats = append(stats, stat)
+		}
+		p.accept(";")
+	}
+	return stats
+}
+
+func (p *luaParser) statement() luaStat {
+	line := p.peek().line
+	switch {
+	case p.accept("do"):
+		body := p.block()
+		p.expectMatch("end", "do", line)
+		return luaDoStat{body}
+	case p.accept("while"):
+		cond := p.expr()
+		p.expect("do")
+		body := p.block()
+		p.expectMatch("end", "while", line)
+		return luaWhileStat{cond, body}
+	case p.accept("repeat"):
+		// The condition can see the locals of the body.
+		scope := len(p.fs.actives)
+		body := p.statements()
+		p.expectMatch("until", "repeat", line)
+		cond := p.expr()
+		p.fs.actives = p.fs.actives[:scope]
+		return luaRepeatStat{body, cond}
+	case p.accept("if"):
+		return p.ifStat(line)
+	case p.accept("for"):
+		return p.forStat(line)
+	case p.accept("function"):
+		return p.funcStat(line)
+	case p.accept("local"):
+		if p.accept("function") {
+			name := p.name()
+			slot := p.declare(name)
+			return luaLocalFuncStat{slot, p.funcBody(name, line, false)}
+		}
+		var names []string
+		for {
+			names = append(names, p.name())
+			if !p.accept(",") {
+				break
+			}
+		}
+		var exprs []luaExpr
+		if p.accept("=") {
+			exprs = p.exprList()
+		}
+		// The new locals are only in scope after the statement.
+		slots := make([]int, len(names))
+		for i, name := range names {
+			slots[i] = p.declare(name)
+		}
+		return luaLocalStat{slots, exprs}
+	}
+	return p.exprStat()
+}
+
+func (p *luaParser) ifStat(line int) luaStat {
+	var stat luaIfStat
+	for {
+		stat.conds = append(stat.conds, p.expr())
+		p.expect("then")
+		stat.blocks = append(stat.blocks, p.block())
+		if !p.accept("elseif") {
+			break
+		}
+	}
+	if p.accept("else") {
+		stat.orElse = p.block()
+	}
+	p.expectMatch("end", "if", line)
+	return stat
+}
+
+func (p *luaParser) forStat(line int) luaStat {
+	first := p.name()
+	if p.accept("=") {
+		start := p.expr()
+		p.expect(",")
+		stop := p.expr()
+		var step luaExpr = luaConstExpr{float64(1)}
+		if p.accept(",") {
+			step = p.expr()
+		}
+		p.expect("do")
+		scope := len(p.fs.actives)
+		slot := p.declare(first)
+		body := p.block()
+		p.fs.actives = p.fs.actives[:scope]
+		p.expectMatch("end", "for", line)
+		return luaNumForStat{slot, start, stop, step, body, line}
+	}
+
+	names := []string{first}
+	for p.accept(",") {
+		names = append(names, p.name())
+	}
+	p.expect("in")
+	exprs := p.exprList()
+	p.expect("do")
+	scope := len(p.fs.actives)
+	slots := make([]int, len(names))
+	for i, name := range names {
+		slots[i] = p.declare(name)
+	}
+	body := p.block()
+	p.fs.actives = p.fs.actives[:scope]
+	p.expectMatch("end", "for", line)
+	return luaGenForStat{slots, exprs, body, line}
+}
+
+func (p *luaParser) funcStat(line int) luaStat {
+	name := p.name()
+	fullName := name
+	target := p.resolve(name, line)
+	isMethod := false
+	for p.is(".") || p.is(":") {
+		isMethod = p.advance().text == ":"
+		key := p.name()
+		fullName += "." + key
+		target = luaIndexExpr{target, luaConstExpr{key}, line}
+		if isMethod {
+			break
+		}
+	}
+	fn := p.funcBody(fullName, line, isMethod)
+	return luaAssignStat{[]luaExpr{target}, []luaExpr{luaFuncExpr{fn}}}
+}
+
+// funcBody parses the parameters and body of a function. Methods get an
+// implicit self parameter.
+func (p *luaParser) funcBody(name string, line int, isMethod bool) *luaProto {
+	proto := &luaProto{name: name, line: line}
+	p.fs = &luaFuncState{parent: p.fs, proto: proto}
+	defer func() { p.fs = p.fs.parent }()
+
+	if isMethod {
+		proto.params = append(proto.params, p.declare("self"))
+	}
+	p.expect("(")
+	if !p.is(")") {
+		for {
+			if p.accept("...") {
+				proto.isVararg = true
+				break
+			}
+			proto.params = append(proto.params, p.declare(p.name()))
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	p.expect(")")
+	proto.body = p.block()
+	p.expectMatch("end", "function", line)
+	return proto
+}
+
+// exprStat parses an assignment or a function call statement.
+func (p *luaParser) exprStat() luaStat {
+	line := p.peek().line
+	first := p.suffixedExpr()
+	if !p.is("=") && !p.is(",") {
+		switch first.(type) {
+		case luaCallExpr, luaMethodExpr:
+			return luaCallStat{first}
+		}
+		p.errorf("syntax error near '%s'", p.tokenText(p.peek()))
+	}
+	targets := []luaExpr{first}
+	for p.accept(",") {
+		targets = append(targets, p.suffixedExpr())
+	}
+	p.expect("=")
+	for _, target := range targets {
+		switch target.(type) {
+		case luaLocalExpr, luaUpvalExpr, luaGlobalExpr, luaIndexExpr:
+		default:
+			panic(&luaSyntaxError{line: line, msg: "syntax error near '='"})
+		}
+	}
+	return luaAssignStat{targets, p.exprList()}
+}
+
+func (p *luaParser) exprList() []luaExpr {
+	exprs := []luaExpr{p.expr()}
+	for p.accept(",") {
+		exprs = append(exprs, p.expr())
+	}
+	return exprs
+}
+
+func (p *luaParser) expr() luaExpr {
+	return p.subExpr(0)
+}
+
+// subExpr parses an expression whose binary operators bind tighter than
+// limit.
+func (p *luaParser) subExpr(limit int) luaExpr {
+	var e luaExpr
+	tok := p.peek()
+	unary := -1
+	if tok.kind == tokKeyword && tok.text == "not" {
+		unary = luaOpNot
+	} else if tok.kind == tokOp && tok.text == "-" {
+		unary = luaOpNeg
+	} else if tok.kind == tokOp && tok.text == "#" {
+		unary = luaOpLen
+	}
+	if unary >= 0 {
+		p.advance()
+		operand := p.subExpr(luaUnaryPriority)
+		// Negative number literals are folded into constants.
+		if c, ok := operand.(luaConstExpr); ok && unary == luaOpNeg {
+			if n, ok := c.val.(float64); ok {
+				e = luaConstExpr{-n}
+			}
+		}
+		if e == nil {
+			e = luaUnExpr{unary, operand, tok.line}
+		}
+	} else {
+		e = p.simpleExpr()
+	}
+	for {
+		tok := p.peek()
+		if tok.kind != tokOp && tok.kind != tokKeyword {
+			return e
+		}
+		op, ok := luaBinaryOps[tok.text]
+		if !ok || op[1] <= limit {
+			return e
+		}
+		p.advance()
+		right := p.subExpr(op[2])
+		e = luaBinExpr{op[0], e, right, tok.line}
+	}
+}
+
+func (p *luaParser) simpleExpr() luaExpr {
+	tok := p.peek()
+	switch tok.kind {
+	case tokNumber:
+		p.advance()
+		return luaConstExpr{tok.num}
+	case tokString:
+		p.advance()
+		return luaConstExpr{tok.text}
+	case tokKeyword:
+		switch tok.text {
+		case "nil":
+			p.advance()
+			return luaConstExpr{nil}
+		case "true":
+			p.advance()
+			return luaConstExpr{true}
+		case "false":
+			p.advance()
+			return luaConstExpr{false}
+		case "function":
+			p.advance()
+			return luaFuncExpr{p.funcBody("anonymous", tok.line, false)}
+		}
+	case tokOp:
+		switch tok.text {
+		case "...":
+			if !p.fs.proto.isVararg {
+				p.errorf("cannot use '...' outside a vararg function near '...'")
+			}
+			p.advance()
+			return luaVarargExpr{}
+		case "{":
+			return p.tableConstructor()
+		}
+	}
+	return p.suffixedExpr()
+}
+
+func (p *luaParser) primaryExpr() luaExpr {
+	tok := p.peek()
+	if tok.kind == tokName {
+		p.advance()
+		return p.resolve(tok.text, tok.line)
+	}
+	if p.accept("(") {
+		e := p.expr()
+		p.expectMatch(")", "(", tok.line)
+		return luaParenExpr{e}
+	}
+	p.errorf("unexpected symbol near '%s'", p.tokenText(tok))
+	return nil
+}
+
+func (p *luaParser) suffixedExpr() luaExpr {
+	e := p.primaryExpr()
+	for {
+		tok := p.peek()
+		switch {
+		case p.accept("."):
+			e = luaIndexExpr{e, luaConstExpr{p.name()}, tok.line}
+		case p.accept("["):
+			key := p.expr()
+			p.expect("]")
+			e = luaIndexExpr{e, key, tok.line}
+		case p.accept(":"):
+			name := p.name()
+			e = luaMethodExpr{e, name, p.callArgs(), tok.line}
+		case p.is("(") || p.is("{") || tok.kind == tokString:
+			e = luaCallExpr{e, p.callArgs(), tok.line}
+		default:
+			return e
+		}
+	}
+}
+
+func (p *luaParser) callArgs() []luaExpr {
+	tok := p.peek()
+	switch {
+	case tok.kind == tokString:
+		p.advance()
+		return []luaExpr{luaConstExpr{tok.text}}
+	case p.is("{"):
+		return []luaExpr{p.tableConstructor()}
+	case p.accept("("):
+		var args []luaExpr
+		if !p.is(")") {
+			args = p.exprList()
+		}
+		p.expectMatch(")", "(", tok.line)
+		return args
+	}
+	p.errorf("function arguments expected near '%s'", p.tokenText(tok))
+	return nil
+}
+
+func (p *luaParser) tableConstructor() luaExpr {
+	line := p.peek().line
+	p.expect("{")
+	t := luaTableExpr{line: line}
+	for !p.is("}") {
+		switch {
+		case p.is("["):
+			p.advance()
+			key := p.expr()
+			p.expect("]")
+			p.expect("=")
+			t.items = append(t.items, luaTableItem{key, p.expr()})
+		case p.peek().kind == tokName && p.tokens[p.pos+1].kind == tokOp && p.tokens[p.pos+1].text == "=":
+			key := p.advance().text
+			p.advance()
+			t.items = append(t.items, luaTableItem{luaConstExpr{key}, p.expr()})
+		default:
+			t.items = append(t.items, luaTableItem{nil, p.expr()})
+		}
+		if !p.accept(",") && !p.accept(";") {
+			break
+		}
+	}
+	p.expectMatch("}", "{", line)
+	return t
+}
@@ -0,0 +1,375 @@
+package main
+
+// A port of the pattern matching of Lua 5.1's string library, used by
+// string.find, match, gmatch and gsub.
+
+const (
+	luaMaxCaptures   = 32
+	luaCapUnfinished = -1
+	luaCapPosition   = -2
+	luaMaxMatchDepth = 200
+)
+
+type luaCapture struct {
+	start, len int
+}
+
+type luaMatchState struct {
+	L       *luaState
+	src     string
+	pattern string
+	level   int
+	capture [luaMaxCaptures]luaCapture
+	depth   int
+}
+
+func (ms *luaMatchState) errorf(format string, args ...any) {
+	ms.L.errorf(ms.L.line, format, args...)
+}
+
+// classEnd returns the position after the single character class at p.
+func (ms *luaMatchState) classEnd(p int) int {
+	pat := ms.pattern
+	c := pat[p]
+	p++
+	if c == '%' {
+		if p >= len(pat) {
+			ms.errorf("malformed pattern (ends with '%%')")
+		}
+		return p + 1
+	}
+	if c == '[' {
+		if p < len(pat) && pat[p] == '^' {
+			p++
+		}
+		// The first character of a set is literal, even if it is ']'.
+		for {
+			if p >= len(pat) {
+				ms.errorf("malformed pattern (missing ']')")
+			}
+			c := pat[p]
+			p++
+			if c == '%' {
+				if p >= len(pat) {
+					ms.errorf("malformed pattern (missing ']')")
+				}
+				p++
+			}
+			if p < len(pat) && pat[p] == ']' {
+				return p + 1
+			}
+		}
+	}
+	return p
+}
+
+func luaIsAlpha(c byte) bool { return (c|0x20) >= 'a' && (c|0x20) <= 'z' }
+func luaIsSpace(c byte) bool { return c == ' ' || (c >= '\t' && c <= '\r') }
+func luaIsPunct(c byte) bool {
+	return c > ' ' && c < 0x7f && !luaIsAlpha(c) && !isDigit(c)
+}
+
+// luaClassMatches reports whether c is in the class %cl.
+func luaClassMatches(c byte, cl byte) bool {
+	var res bool
+	switch cl | 0x20 {
+	case 'a':
+		res = luaIsAlpha(c)
+	case 'c':
+		res = c < ' ' || c == 0x7f
+	case 'd':
+		res = isDigit(c)
+	case 'l':
+		res = c >= 'a' && c <= 'z'
+	case 'p':
+		res = luaIsPunct(c)
+	case 's':
+		res = luaIsSpace(c)
+	case 'u':
+		res = c >= 'A' && c <= 'Z'
+	case 'w':
+		res = luaIsAlpha(c) || isDigit(c)
+	case 'x':
+		res = isHexDigit(c)
+	case 'z':
+		res = c == 0
+	default:
+		return cl == c
+	}
+	if cl >= 'A' && cl <= 'Z' {
+		return !res
+	}
+	return res
+}
+
+// setMatches reports whether c is in the set running from p, at '[', to
+// ec, at the closing ']'.
+func (ms *luaMatchState) setMatches(c byte, p, ec int) bool {
+	pat := ms.pattern
+	negate := false
+	p++
+	if pat[p] == '^' {
+		negate = true
+		p++
+	}
+	for ; p < ec; p++ {
+		switch {
+		case pat[p] == '%' && p+1 < ec:
+			p++
+			if luaClassMatches(c, pat[p]) {
+				return !negate
+			}
+		case p+2 < ec && pat[p+1] == '-':
+			if pat[p] <= c && c <= pat[p+2] {
+				return !negate
+			}
+			p += 2
+		case pat[p] == c:
+			return !negate
+		}
+	}
+	return negate
+}
+
+func (ms *luaMatchState) singleMatch(s, p, ep int) bool {
+	if s >= len(ms.src) {
+		return false
+	}
+	c := ms.src[s]
+	switch ms.pattern[p] {
+	case '.':
+		return true
+	case '%':
+		return luaClassMatches(c, ms.pattern[p+1])
+	case '[':
+		return ms.setMatches(c, p, ep-1)
+	}
+	return ms.pattern[p] == c
+}
+
+// match matches the pattern from p against the subject from s, returning
+// the end of the match or -1.
+func (ms *luaMatchState) match(s, p int) int {
+	ms.depth++
+	if ms.depth > luaMaxMatchDepth {
+		ms.errorf("pattern too complex")
+	}
+	defer func() { ms.depth-- }()
+	pat := ms.pattern
+	for {
+		if p >= len(pat) {
+			return s
+		}
+		switch pat[p] {
+		case '(':
+			if p+1 < len(pat) && pat[p+1] == ')' {
+				return ms.startCapture(s, p+2, luaCapPosition)
+			}
+			return ms.startCapture(s, p+1, luaCapUnfinished)
+		case ')':
+			return ms.endCapture(s, p+1)
+		case '$':
+			if p+1 == len(pat) {
+				if s == len(ms.src) {
+					return s
+				}
+				return -1
+			}
+		case '%':
+			if p+1 < len(pat) {
+				switch pat[p+1] {
+				case 'b':
+					s = ms.matchBalance(s, p+2)
+					if s == -1 {
+						return -1
+					}
+					p += 4
+					continue
+				case 'f':
+					p += 2
+					if p >= len(pat) || pat[p] != '[' {
+						ms.errorf("missing '[' after '%%f' in pattern")
+					}
+					ep := ms.classEnd(p)
+					var prev, cur byte
+					if s > 0 {
+						prev = ms.src[s-1]
+					}
+					if s < len(ms.src) {
+						cur = ms.src[s]
+					}
+					if ms.setMatches(prev, p, ep-1) || !ms.setMatches(cur, p, ep-1) {
+						return -1
+					}
+					p = ep
+					continue
+				default:
+					if isDigit(pat[p+1]) {
+						s = ms.matchCapture(s, pat[p+1])
+						if s == -1 {
+							return -1
+						}
+						p += 2
+						continue
+					}
+				}
+			}
+		}
+
+		ep := ms.classEnd(p)
+		m := ms.singleMatch(s, p, ep)
+		var next byte
+		if ep < len(pat) {
+			next = pat[ep]
+		}
+		switch next {
+		case '?':
+			if m {
+				if res := ms.match(s+1, ep+1); res != -1 {
+					return res
+				}
+			}
+			p = ep + 1
+			continue
+		case '*':
+			return ms.maxExpand(s, p, ep)
+		case '+':
+			if !m {
+				return -1
+			}
+			return ms.maxExpand(s+1, p, ep)
+		case '-':
+			return ms.minExpand(s, p, ep)
+		}
+		if !m {
+			return -1
+		}
+		s++
+		p = ep
+	}
+}
+
+func (ms *luaMatchState) maxExpand(s, p, ep int) int {
+	i := 0
+	for ms.singleMatch(s+i, p, ep) {
+		i++
+	}
+	for ; i >= 0; i-- {
+		if res := ms.match(s+i, ep+1); res != -1 {
+			return res
+		}
+	}
+	return -1
+}
+
+func (ms *luaMatchState) minExpand(s, p, ep int) int {
+	for {
+		if res := ms.match(s, ep+1); res != -1 {
+			return res
+		}
+		if !ms.singleMatch(s, p, ep) {
+			return -1
+		}
+		s++
+	}
+}
+
+func (ms *luaMatchState) startCapture(s, p, what int) int {
+	if ms.level >= luaMaxCaptures {
+		ms.errorf("too many captures")
+	}
+	ms.capture[ms.level] = luaCapture{s, what}
+	ms.level++
+	res := ms.match(s, p)
+	if res == -1 {
+		ms.level--
+	}
+	return res
+}
+
+func (ms *luaMatchState) endCapture(s, p int) int {
+	l := -1
+	for i := ms.level - 1; i >= 0; i-- {
+		if ms.capture[i].len == luaCapUnfinished {
+			l = i
+			break
+		}
+	}
+	if l < 0 {
+		ms.errorf("invalid pattern capture")
+	}
+	ms.capture[l].len = s - ms.capture[l].start
+	res := ms.match(s, p)
+	if res == -1 {
+		ms.capture[l].len = luaCapUnfinished
+	}
+	return res
+}
+
+func (ms *luaMatchState) matchBalance(s, p int) int {
+	if p+1 >= len(ms.pattern) {
+		ms.errorf("unbalanced pattern")
+	}
+	if s >= len(ms.src) || ms.src[s] != ms.pattern[p] {
+		return -1
+	}
+	open, close := ms.pattern[p], ms.pattern[p+1]
+	depth := 1
+	for i := s + 1; i < len(ms.src); i++ {
+		switch ms.src[i] {
+		case close:
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		case open:
+			depth++
+		}
+	}
+	return -1
+}
+
+func (ms *luaMatchState) matchCapture(s int, digit byte) int {
+	l := int(digit - '1')
+	if l < 0 || l >= ms.level || ms.capture[l].len == luaCapUnfinished {
+		ms.errorf("invalid capture index")
+	}
+	capture := ms.src[ms.capture[l].start : ms.capture[l].start+ms.capture[l].len]
+	if len(ms.src)-s >= len(capture) && ms.src[s:s+len(capture)] == capture {
+		return s + len(capture)
+	}
+	return -1
+}
+
+// captureValue returns capture i, or the whole match from s to e if the
+// pattern has no captures.
+func (ms *luaMatchState) captureValue(i, s, e int) any {
+	if i >= ms.level {
+		if i == 0 {
+			return ms.src[s:e]
+		}
+		ms.errorf("invalid capture index")
+	}
+	c := ms.capture[i]
+	if c.len == luaCapUnfinished {
+		ms.errorf("unfinished capture")
+	}
+	if c.len == luaCapPosition {
+		return float64(c.start + 1)
+	}
+	return ms.src[c.start : c.start+c.len]
+}
+
+// captures returns the captures of a match from s to e, or the whole match
+// if the pattern has none and wholeIfNone is set.
+func (ms *luaMatchState) captures(s, e int, wholeIfNone bool) []any {
+	n := ms.level
+	if n == 0 && wholeIfNone {
+		n = 1
+	}
+	vals := make([]any, n)
+	for i := range vals {
+		vals[i] = ms.captureValue(i, s, e)
+	}
+	return vals
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLuaPatterns(t *testing.T) {
+	tests := []struct {
+		s, pattern string
+		want       string // captures joined with "|", or "nil"
+	}{
+		{"hello world", "o w", "o w"},
+		{"hello", "^h", "h"},
+		{"hello", "^e", "nil"},
+		{"hello", "o$", "o"},
+		{"hello", "l$", "nil"},
+		{"a.b", "%.", "."},
+		{"abc123def", "%d+", "123"},
+		{"abc123def", "%a+$", "def"},
+		{"  trim  ", "^%s*(.-)%s*$", "trim"},
+		{"key = value", "(%w+)%s*=%s*(%w+)", "key|value"},
+		{"aaa", "a-", ""},
+		{"aaa", "a-$", "aaa"},
+		{"aaab", "a*b", "aaab"},
+		{"b", "a*b", "b"},
+		{"b", "a+b", "nil"},
+		{"color colour", "colou?r", "color"},
+		{"x=10, y=20", "[xy]=(%d+)", "10"},
+		{"HeLLo", "[%u]+", "H"},
+		{"hello", "[^aeiou]+", "h"},
+		{"a-b", "[a%-]+", "a-"},
+		{"a]b", "[]]", "]"},
+		{"f(a(b)c)d", "%b()", "(a(b)c)"},
+		{"THE (quick) fox", "%f[%a]%a+", "THE"},
+		{"the cat the", "(%a+) %a+ %1", "the"},
+		{"abc", "()b()", "2|3"},
+		{"\x00x", "%z", "\x00"},
+		{"a1_", "%w+", "a1"},
+		{"a,b", "%p", ","},
+		{"tab\there", "%c", "\t"},
+		{"ff", "%x+", "ff"},
+	}
+	for _, tt := range tests {
+		rets, err := runLua(`
+			local caps = {string.match(...)}
+			if #caps == 0 then return "nil" end
+			for i = 1, #caps do caps[i] = tostring(caps[i]) end
+			return table.concat(caps, "|")`, tt.s, tt.pattern)
+		if err != nil {
+			t.Errorf("match(%q, %q): %v", tt.s, tt.pattern, err)
+			continue
+		}
+		if rets[0] != tt.want {
+			t.Errorf("match(%q, %q) = %q, want %q", tt.s, tt.pattern, rets[0], tt.want)
+		}
+	}
+}
+
+func TestLuaPatternErrors(t *testing.T) {
+	tests := []struct {
+		pattern, want string
+	}{
+		{"%", "malformed pattern (ends with '%')"},
+		{"[a", "malformed pattern (missing ']')"},
+		{"(a", "unfinished capture"},
+		{"a)", "invalid pattern capture"},
+		{"%1", "invalid capture index"},
+		{"%b", "unbalanced pattern"},
+		{"%fa", "missing '[' after '%f' in pattern"},
+	}
+	for _, tt := range tests {
+		_, err := runLua("return string.match(...)", "abc", tt.pattern)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("match(%q) error = %v, want %q", tt.pattern, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,958 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Lua values are represented by Go values: nil, bool, float64, string,
+// *luaTable, *luaClosure, *luaGoFunction and *luaUserdata.
+
+const (
+	luaMaxCallDepth = 5000 // nested Lua calls before "stack overflow"
+	luaHookInterval = 1024 // loop iterations and calls between hook calls
+)
+
+// luaTable is a Lua table. Keys 1..len(arr) live in the array part, and
+// other keys in the hash part, which remembers insertion order so that
+// next can walk it while fields are changed or cleared.
+type luaTable struct {
+	arr     []any
+	index   map[any]int // key to position in entries
+	entries []luaEntry
+	removed int // entries whose value was set to nil
+	meta    *luaTable
+}
+
+type luaEntry struct {
+	key, val any
+}
+
+// luaCell holds a local variable, shared with the closures that capture
+// it.
+type luaCell struct {
+	v any
+}
+
+// luaClosure is a Lua function along with its upvalues.
+type luaClosure struct {
+	proto  *luaProto
+	upvals []*luaCell
+}
+
+// luaGoFunction is a function implemented in Go.
+type luaGoFunction struct {
+	name string
+	fn   func(L *luaState, args []any) []any
+}
+
+// luaUserdata is an opaque value, such as cjson.null.
+type luaUserdata struct {
+	name string
+}
+
+// luaError is a Lua error being raised, carrying the error value. It is
+// raised as a panic and recovered by pcall.
+type luaError struct {
+	value any
+}
+
+func (e *luaError) Error() string {
+	if t, ok := e.value.(*luaTable); ok {
+		if msg, ok := t.get("err").(string); ok {
+			return msg
+		}
+	}
+	return luaToString(e.value)
+}
+
+// luaFatalError aborts a script without giving pcall a chance to catch
+// it, like a killed or timed out script.
+type luaFatalError struct {
+	err error
+}
+
+// luaState is a Lua interpreter with its own globals.
+type luaState struct {
+	globals   *luaTable
+	strings   *luaTable // the string library, indexed by string values
+	chunkName string    // prefix of error positions, like user_script
+	readOnly  bool      // globals can't be created or changed by scripts
+	line      int       // line of the call being made, for error positions
+	depth     int
+	steps     int
+	hook      func() // called every luaHookInterval steps
+}
+
+func newLuaTable(narr, nhash int) *luaTable {
+	return &luaTable{arr: make([]any, 0, narr), index: make(map[any]int, nhash)}
+}
+
+// normalizeKey reports whether a number key is an integer in the range of
+// the array part, returning it as an int.
+func (t *luaTable) arrayIndex(key any) (int, bool) {
+	f, ok := key.(float64)
+	if !ok {
+		return 0, false
+	}
+	i := int(f)
+	if float64(i) != f || i < 1 {
+		return 0, false
+	}
+	return i, true
+}
+
+func (t *luaTable) get(key any) any {
+	if i, ok := t.arrayIndex(key); ok && i <= len(t.arr) {
+		return t.arr[i-1]
+	}
+	if pos, ok := t.index[key]; ok {
+		return t.entries[pos].val
+	}
+	return nil
+}
+
+// set assigns a field. The caller checks that key is neither nil nor NaN.
+func (t *luaTable) set(key, val any) {
+	if i, ok := t.arrayIndex(key); ok {
+		switch {
+		case i <= len(t.arr):
+			t.arr[i-1] = val
+			for len(t.arr) > 0 && t.arr[len(t.arr)-1] == nil {
+				t.arr = t.arr[:len(t.arr)-1]
+			}
+			return
+		case i == len(t.arr)+1 && val != nil:
+			t.arr = append(t.arr, val)
+			t.deleteEntry(key)
+			// Keys that directly follow move over from the hash part.
+			for {
+				next := float64(len(t.arr) + 1)
+				v := t.rawHashGet(next)
+				if v == nil {
+					break
+				}
+				t.arr = append(t.arr, v)
+				t.deleteEntry(next)
+			}
+			return
+		}
+	}
+	if pos, ok := t.index[key]; ok {
+		if t.entries[pos].val != nil && val == nil {
+			t.removed++
+		} else if t.entries[pos].val == nil && val != nil {
+			t.removed--
+		}
+		t.entries[pos].val = val
+		return
+	}
+	if val == nil {
+		return
+	}
+	if t.removed > 16 && t.removed > len(t.entries)/2 {
+		t.compact()
+	}
+	t.index[key] = len(t.entries)
+	t.entries = append(t.entries, luaEntry{key, val})
+}
+
+func (t *luaTable) rawHashGet(key any) any {
+	if pos, ok := t.index[key]; ok {
+		return t.entries[pos].val
+	}
+	return nil
+}
+
+func (t *luaTable) deleteEntry(key any) {
+	if pos, ok := t.index[key]; ok && t.entries[pos].val != nil {
+		t.entries[pos].val = nil
+		t.removed++
+	}
+}
+
+// compact drops the cleared entries of the hash part. It only runs when a
+// new key is added, which Lua doesn't allow during traversal anyway.
+func (t *luaTable) compact() {
+	entries := t.entries[:0]
+	t.index = make(map[any]int, len(t.entries)-t.removed)
+	for _, e := range t.entries {
+		if e.val != nil {
+			t.index[e.key] = len(entries)
+			entries = append(entries, e)
+		}
+	}
+	t.entries = entries
+	t.removed = 0
+}
+
+// length returns a border of the table, as the # operator does.
+func (t *luaTable) length() int {
+	return len(t.arr)
+}
+
+// next returns the field following key in traversal order, or a nil key
+// once the traversal is complete. ok is false if key isn't in the table.
+func (t *luaTable) next(key any) (nextKey, val any, ok bool) {
+	start := 0
+	if key != nil {
+		if i, isIdx := t.arrayIndex(key); isIdx && i <= len(t.arr) {
+			start = i
+		} else if pos, found := t.index[key]; found {
+			start = len(t.arr) + pos + 1
+		} else {
+			return nil, nil, false
+		}
+	}
+	for i := start; i < len(t.arr); i++ {
+		if t.arr[i] != nil {
+			return float64(i + 1), t.arr[i], true
+		}
+	}
+	for pos := max(start-len(t.arr), 0); pos < len(t.entries); pos++ {
+		if e := t.entries[pos]; e.val != nil {
+			return e.key, e.val, true
+		}
+	}
+	return nil, nil, true
+}
+
+// luaTypeName returns the name type() reports for v.
+func luaTypeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *luaTable:
+		return "table"
+	case *luaClosure, *luaGoFunction:
+		return "function"
+	case *luaUserdata:
+		return "userdata"
+	}
+	return "userdata"
+}
+
+func luaTruthy(v any) bool {
+	return v != nil && v != false
+}
+
+// luaNumberString formats a number the way Lua 5.1 does, with %.14g.
+func luaNumberString(n float64) string {
+	switch {
+	case math.IsInf(n, 1):
+		return "inf"
+	case math.IsInf(n, -1):
+		return "-inf"
+	case math.IsNaN(n):
+		return "nan"
+	}
+	return fmt.Sprintf("%.14g", n)
+}
+
+// luaToString converts v to a string like tostring, without calling
+// __tostring.
+func luaToString(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return luaNumberString(v)
+	case string:
+		return v
+	case *luaTable:
+		return fmt.Sprintf("table: %p", v)
+	case *luaClosure:
+		return fmt.Sprintf("function: %p", v)
+	case *luaGoFunction:
+		return fmt.Sprintf("function: builtin: %p", v)
+	case *luaUserdata:
+		return fmt.Sprintf("userdata: %p", v)
+	}
+	return fmt.Sprint(v)
+}
+
+// luaToNumber converts v to a number, the way arithmetic coerces strings.
+func luaToNumber(v any) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		return luaParseNumber(v)
+	}
+	return 0, false
+}
+
+// luaParseNumber parses a decimal or hexadecimal number surrounded by
+// optional whitespace.
+func luaParseNumber(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, false
+	}
+	neg := false
+	body := s
+	if body[0] == '-' || body[0] == '+' {
+		neg = body[0] == '-'
+		body = body[1:]
+	}
+	if strings.HasPrefix(body, "0x") || strings.HasPrefix(body, "0X") {
+		n, err := strconv.ParseUint(body[2:], 16, 64)
+		if err != nil {
+			return 0, false
+		}
+		if neg {
+			return -float64(n), true
+		}
+		return float64(n), true
+	}
+	// ParseFloat accepts forms Lua doesn't, like "inf" and "1_0".
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		if !isDigit(c) && c != '.' && c != 'e' && c != 'E' && c != '+' && c != '-' {
+			return 0, false
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// errorf raises a runtime error at the given line.
+func (L *luaState) errorf(line int, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if line > 0 {
+		msg = fmt.Sprintf("%s:%d: %s", L.chunkName, line, msg)
+	}
+	panic(&luaError{msg})
+}
+
+func (L *luaState) step() {
+	L.steps++
+	if L.steps%luaHookInterval == 0 && L.hook != nil {
+		L.hook()
+	}
+}
+
+// luaFrame is the activation of a Lua function.
+type luaFrame struct {
+	slots   []*luaCell
+	varargs []any
+	upvals  []*luaCell
+}
+
+// Control flow outcomes of executing statements.
+const (
+	luaCtlNone = iota
+	luaCtlBreak
+	luaCtlReturn
+)
+
+// call calls fn with args and returns its results.
+func (L *luaState) call(fn any, args []any, line int) []any {
+	switch fn := fn.(type) {
+	case *luaClosure:
+		return L.callClosure(fn, args, line)
+	case *luaGoFunction:
+		L.line = line
+		return fn.fn(L, args)
+	case *luaTable:
+		if fn.meta != nil {
+			if handler := fn.meta.get("__call"); handler != nil {
+				return L.call(handler, append([]any{fn}, args...), line)
+			}
+		}
+	}
+	L.errorf(line, "attempt to call a %s value", luaTypeName(fn))
+	return nil
+}
+
+func (L *luaState) callClosure(cl *luaClosure, args []any, line int) []any {
+	if L.depth >= luaMaxCallDepth {
+		L.errorf(line, "stack overflow")
+	}
+	L.depth++
+	defer func() { L.depth-- }()
+	L.step()
+
+	p := cl.proto
+	fr := &luaFrame{slots: make([]*luaCell, p.numSlots), upvals: cl.upvals}
+	for i, slot := range p.params {
+		var v any
+		if i < len(args) {
+			v = args[i]
+		}
+		fr.slots[slot] = &luaCell{v}
+	}
+	if p.isVararg && len(args) > len(p.params) {
+		fr.varargs = args[len(p.params):]
+	}
+	if ctl, rets := L.exec(fr, p.body); ctl == luaCtlReturn {
+		return rets
+	}
+	return nil
+}
+
+func (L *luaState) exec(fr *luaFrame, stats []luaStat) (int, []any) {
+	for _, stat := range stats {
+		switch s := stat.(type) {
+		case luaLocalStat:
+			vals := L.evalList(fr, s.exprs, len(s.slots))
+			for i, slot := range s.slots {
+				fr.slots[slot] = &luaCell{vals[i]}
+			}
+		case luaAssignStat:
+			L.assign(fr, s)
+		case luaCallStat:
+			L.evalMulti(fr, s.call)
+		case luaDoStat:
+			if ctl, rets := L.exec(fr, s.body); ctl != luaCtlNone {
+				return ctl, rets
+			}
+		case luaWhileStat:
+			for luaTruthy(L.eval(fr, s.cond)) {
+				L.step()
+				ctl, rets := L.exec(fr, s.body)
+				if ctl == luaCtlBreak {
+					break
+				}
+				if ctl == luaCtlReturn {
+					return ctl, rets
+				}
+			}
+		case luaRepeatStat:
+			for {
+				L.step()
+				ctl, rets := L.exec(fr, s.body)
+				if ctl == luaCtlBreak {
+					break
+				}
+				if ctl == luaCtlReturn {
+					return ctl, rets
+				}
+				if luaTruthy(L.eval(fr, s.cond)) {
+					break
+				}
+			}
+		case luaIfStat:
+			body := s.orElse
+			for i, cond := range s.conds {
+				if luaTruthy(L.eval(fr, cond)) {
+					body = s.blocks[i]
+					break
+				}
+			}
+			if ctl, rets := L.exec(fr, body); ctl != luaCtlNone {
+				return ctl, rets
+			}
+		case luaNumForStat:
+			if ctl, rets := L.numericFor(fr, s); ctl != luaCtlNone {
+				return ctl, rets
+			}
+		case luaGenForStat:
+			if ctl, rets := L.genericFor(fr, s); ctl != luaCtlNone {
+				return ctl, rets
+			}
+		case luaLocalFuncStat:
+			// The function's own slot exists first, so it can call itself.
+			fr.slots[s.slot] = &luaCell{}
+			fr.slots[s.slot].v = L.closure(fr, s.proto)
+		case luaReturnStat:
+			if len(s.exprs) == 1 {
+				if call, ok := s.exprs[0].(luaCallExpr); ok {
+					return luaCtlReturn, L.evalMulti(fr, call)
+				}
+			}
+			return luaCtlReturn, L.evalList(fr, s.exprs, -1)
+		case luaBreakStat:
+			return luaCtlBreak, nil
+		}
+	}
+	return luaCtlNone, nil
+}
+
+func (L *luaState) numericFor(fr *luaFrame, s luaNumForStat) (int, []any) {
+	start, ok1 := luaToNumber(L.eval(fr, s.start))
+	stop, ok2 := luaToNumber(L.eval(fr, s.stop))
+	step, ok3 := luaToNumber(L.eval(fr, s.step))
+	switch {
+	case !ok1:
+		L.errorf(s.line, "'for' initial value must be a number")
+	case !ok2:
+		L.errorf(s.line, "'for' limit must be a number")
+	case !ok3:
+		L.errorf(s.line, "'for' step must be a number")
+	}
+	for i := start; (step > 0 && i <= stop) || (step <= 0 && i >= stop); i += step {
+		L.step()
+		fr.slots[s.slot] = &luaCell{i}
+		ctl, rets := L.exec(fr, s.body)
+		if ctl == luaCtlBreak {
+			break
+		}
+		if ctl == luaCtlReturn {
+			return ctl, rets
+		}
+	}
+	return luaCtlNone, nil
+}
+
+func (L *luaState) genericFor(fr *luaFrame, s luaGenForStat) (int, []any) {
+	init := L.evalList(fr, s.exprs, 3)
+	fn, state, control := init[0], init[1], init[2]
+	for {
+		L.step()
+		vals := L.call(fn, []any{state, control}, s.line)
+		first := any(nil)
+		if len(vals) > 0 {
+			first = vals[0]
+		}
+		if first == nil {
+			return luaCtlNone, nil
+		}
+		control = first
+		for i, slot := range s.slots {
+			var v any
+			if i < len(vals) {
+				v = vals[i]
+			}
+			fr.slots[slot] = &luaCell{v}
+		}
+		ctl, rets := L.exec(fr, s.body)
+		if ctl == luaCtlBreak {
+			return luaCtlNone, nil
+		}
+		if ctl == luaCtlReturn {
+			return ctl, rets
+		}
+	}
+}
+
+func (L *luaState) assign(fr *luaFrame, s luaAssignStat) {
+	// Table and key expressions are evaluated before any assignment.
+	type target struct {
+		obj, key any
+	}
+	targets := make([]target, len(s.targets))
+	for i, t := range s.targets {
+		if ix, ok := t.(luaIndexExpr); ok {
+			targets[i] = target{L.eval(fr, ix.obj), L.eval(fr, ix.key)}
+		}
+	}
+	vals := L.evalList(fr, s.exprs, len(s.targets))
+	for i, t := range s.targets {
+		switch t := t.(type) {
+		case luaLocalExpr:
+			fr.slots[t.slot].v = vals[i]
+		case luaUpvalExpr:
+			fr.upvals[t.index].v = vals[i]
+		case luaGlobalExpr:
+			L.setGlobal(t.name, vals[i], t.line)
+		case luaIndexExpr:
+			L.setIndex(targets[i].obj, targets[i].key, vals[i], t.line)
+		}
+	}
+}
+
+func (L *luaState) setGlobal(name string, val any, line int) {
+	if L.readOnly {
+		L.errorf(line, "Attempt to modify a readonly table")
+	}
+	L.globals.set(name, val)
+}
+
+// closure creates a closure of proto, capturing its upvalues from fr.
+func (L *luaState) closure(fr *luaFrame, proto *luaProto) *luaClosure {
+	cl := &luaClosure{proto: proto, upvals: make([]*luaCell, len(proto.upvals))}
+	for i, desc := range proto.upvals {
+		if desc.fromLocal {
+			cl.upvals[i] = fr.slots[desc.index]
+		} else {
+			cl.upvals[i] = fr.upvals[desc.index]
+		}
+	}
+	return cl
+}
+
+// evalList evaluates exprs, expanding the results of a trailing call or
+// vararg expression, and adjusts the result to want values unless want is
+// negative.
+func (L *luaState) evalList(fr *luaFrame, exprs []luaExpr, want int) []any {
+	var vals []any
+	for i, e := range exprs {
+		if i == len(exprs)-1 {
+			switch e.(type) {
+			case luaCallExpr, luaMethodExpr, luaVarargExpr:
+				vals = append(vals, L.evalMulti(fr, e)...)
+				continue
+			}
+		}
+		vals = append(vals, L.eval(fr, e))
+	}
+	if want >= 0 {
+		for len(vals) < want {
+			vals = append(vals, nil)
+		}
+		vals = vals[:want]
+	}
+	return vals
+}
+
+// evalMulti evaluates an expression that may produce several values.
+func (L *luaState) evalMulti(fr *luaFrame, e luaExpr) []any {
+	switch e := e.(type) {
+	case luaCallExpr:
+		fn := L.eval(fr, e.fn)
+		args := L.evalList(fr, e.args, -1)
+		if fn == nil {
+			L.errorf(e.line, "attempt to call %s (a nil value)", luaDescribe(e.fn))
+		}
+		return L.call(fn, args, e.line)
+	case luaMethodExpr:
+		obj := L.eval(fr, e.obj)
+		fn := L.index(obj, e.name, e.line)
+		if fn == nil {
+			L.errorf(e.line, "attempt to call method '%s' (a nil value)", e.name)
+		}
+		args := append([]any{obj}, L.evalList(fr, e.args, -1)...)
+		return L.call(fn, args, e.line)
+	case luaVarargExpr:
+		return fr.varargs
+	}
+	return []any{L.eval(fr, e)}
+}
+
+// luaDescribe names the variable an expression refers to, for error
+// messages.
+func luaDescribe(e luaExpr) string {
+	switch e := e.(type) {
+	case luaGlobalExpr:
+		return fmt.Sprintf("global '%s'", e.name)
+	case luaIndexExpr:
+		if c, ok := e.key.(luaConstExpr); ok {
+			if name, ok := c.val.(string); ok {
+				return fmt.Sprintf("field '%s'", name)
+			}
+		}
+	case luaLocalExpr:
+		return "local"
+	case luaUpvalExpr:
+		return "upvalue"
+	}
+	return "a value"
+}
+
+func (L *luaState) eval(fr *luaFrame, e luaExpr) any {
+	switch e := e.(type) {
+	case luaConstExpr:
+		return e.val
+	case luaLocalExpr:
+		return fr.slots[e.slot].v
+	case luaUpvalExpr:
+		return fr.upvals[e.index].v
+	case luaGlobalExpr:
+		v := L.globals.get(e.name)
+		if v == nil && L.readOnly {
+			L.errorf(e.line, "Script attempted to access nonexistent global variable '%s'", e.name)
+		}
+		return v
+	case luaIndexExpr:
+		obj := L.eval(fr, e.obj)
+		if obj == nil {
+			L.errorf(e.line, "attempt to index %s (a nil value)", luaDescribe(e.obj))
+		}
+		return L.index(obj, L.eval(fr, e.key), e.line)
+	case luaCallExpr, luaMethodExpr, luaVarargExpr:
+		if vals := L.evalMulti(fr, e); len(vals) > 0 {
+			return vals[0]
+		}
+		return nil
+	case luaParenExpr:
+		return L.eval(fr, e.e)
+	case luaFuncExpr:
+		return L.closure(fr, e.proto)
+	case luaBinExpr:
+		switch e.op {
+		case luaOpAnd:
+			l := L.eval(fr, e.l)
+			if !luaTruthy(l) {
+				return l
+			}
+			return L.eval(fr, e.r)
+		case luaOpOr:
+			l := L.eval(fr, e.l)
+			if luaTruthy(l) {
+				return l
+			}
+			return L.eval(fr, e.r)
+		}
+		return L.binary(e.op, L.eval(fr, e.l), L.eval(fr, e.r), e.line)
+	case luaUnExpr:
+		v := L.eval(fr, e.e)
+		switch e.op {
+		case luaOpNot:
+			return !luaTruthy(v)
+		case luaOpNeg:
+			n, ok := luaToNumber(v)
+			if !ok {
+				L.errorf(e.line, "attempt to perform arithmetic on a %s value", luaTypeName(v))
+			}
+			return -n
+		case luaOpLen:
+			switch v := v.(type) {
+			case string:
+				return float64(len(v))
+			case *luaTable:
+				return float64(v.length())
+			}
+			L.errorf(e.line, "attempt to get length of a %s value", luaTypeName(v))
+		}
+	case luaTableExpr:
+		return L.tableConstructor(fr, e)
+	}
+	panic(fmt.Sprintf("lua: unexpected expression %T", e))
+}
+
+func (L *luaState) tableConstructor(fr *luaFrame, e luaTableExpr) *luaTable {
+	t := newLuaTable(len(e.items), 0)
+	n := 0
+	for i, item := range e.items {
+		if item.key != nil {
+			key := L.eval(fr, item.key)
+			L.checkKey(key, e.line)
+			t.set(key, L.eval(fr, item.val))
+			continue
+		}
+		if i == len(e.items)-1 {
+			switch item.val.(type) {
+			case luaCallExpr, luaMethodExpr, luaVarargExpr:
+				for _, v := range L.evalMulti(fr, item.val) {
+					n++
+					t.set(float64(n), v)
+				}
+				continue
+			}
+		}
+		n++
+		t.set(float64(n), L.eval(fr, item.val))
+	}
+	return t
+}
+
+func (L *luaState) checkKey(key any, line int) {
+	if key == nil {
+		L.errorf(line, "table index is nil")
+	}
+	if f, ok := key.(float64); ok && math.IsNaN(f) {
+		L.errorf(line, "table index is NaN")
+	}
+}
+
+// index returns obj[key], following __index metamethods.
+func (L *luaState) index(obj, key any, line int) any {
+	for range 100 {
+		switch o := obj.(type) {
+		case *luaTable:
+			v := o.get(key)
+			if v != nil || o.meta == nil {
+				return v
+			}
+			handler := o.meta.get("__index")
+			if handler == nil {
+				return nil
+			}
+			if _, isTable := handler.(*luaTable); !isTable {
+				return luaFirst(L.call(handler, []any{obj, key}, line))
+			}
+			obj = handler
+		case string:
+			return L.strings.get(key)
+		default:
+			L.errorf(line, "attempt to index a %s value", luaTypeName(obj))
+		}
+	}
+	L.errorf(line, "loop in gettable")
+	return nil
+}
+
+// setIndex assigns obj[key] = val, following __newindex metamethods.
+func (L *luaState) setIndex(obj, key, val any, line int) {
+	for range 100 {
+		t, ok := obj.(*luaTable)
+		if !ok {
+			L.errorf(line, "attempt to index a %s value", luaTypeName(obj))
+		}
+		if t.meta != nil && t.get(key) == nil {
+			if handler := t.meta.get("__newindex"); handler != nil {
+				if _, isTable := handler.(*luaTable); !isTable {
+					L.call(handler, []any{obj, key, val}, line)
+					return
+				}
+				obj = handler
+				continue
+			}
+		}
+		L.checkKey(key, line)
+		t.set(key, val)
+		return
+	}
+	L.errorf(line, "loop in settable")
+}
+
+func luaFirst(vals []any) any {
+	if len(vals) == 0 {
+		return nil
+	}
+	return vals[0]
+}
+
+func (L *luaState) binary(op int, a, b any, line int) any {
+	switch op {
+	case luaOpEq:
+		return luaRawEqual(a, b)
+	case luaOpNe:
+		return !luaRawEqual(a, b)
+	case luaOpLt:
+		return L.lessThan(a, b, line)
+	case luaOpGt:
+		return L.lessThan(b, a, line)
+	case luaOpLe:
+		return L.lessEqual(a, b, line)
+	case luaOpGe:
+		return L.lessEqual(b, a, line)
+	case luaOpConcat:
+		as, ok1 := luaConcatString(a)
+		bs, ok2 := luaConcatString(b)
+		if !ok1 || !ok2 {
+			bad := a
+			if ok1 {
+				bad = b
+			}
+			L.errorf(line, "attempt to concatenate a %s value", luaTypeName(bad))
+		}
+		return as + bs
+	}
+	x, ok1 := luaToNumber(a)
+	y, ok2 := luaToNumber(b)
+	if !ok1 || !ok2 {
+		bad := a
+		if ok1 {
+			bad = b
+		}
+		L.errorf(line, "attempt to perform arithmetic on a %s value", luaTypeName(bad))
+	}
+	switch op {
+	case luaOpAdd:
+		return x + y
+	case luaOpSub:
+		return x - y
+	case luaOpMul:
+		return x * y
+	case luaOpDiv:
+		return x / y
+	case luaOpMod:
+		return x - math.Floor(x/y)*y
+	case luaOpPow:
+		return math.Pow(x, y)
+	}
+	panic(fmt.Sprintf("lua: unexpected operator %d", op))
+}
+
+func luaConcatString(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return luaNumberString(v), true
+	}
+	return "", false
+}
+
+func luaRawEqual(a, b any) bool {
+	return a == b
+}
+
+func (L *luaState) lessThan(a, b any, line int) bool {
+	if x, ok := a.(float64); ok {
+		if y, ok := b.(float64); ok {
+			return x < y
+		}
+	}
+	if x, ok := a.(string); ok {
+		if y, ok := b.(string); ok {
+			return x < y
+		}
+	}
+	L.compareError(a, b, line)
+	return false
+}
+
+func (L *luaState) lessEqual(a, b any, line int) bool {
+	if x, ok := a.(float64); ok {
+		if y, ok := b.(float64); ok {
+			return x <= y
+		}
+	}
+	if x, ok := a.(string); ok {
+		if y, ok := b.(string); ok {
+			return x <= y
+		}
+	}
+	L.compareError(a, b, line)
+	return false
+}
+
+func (L *luaState) compareError(a, b any, line int) {
+	ta, tb := luaTypeName(a), luaTypeName(b)
+	if ta == tb {
+		L.errorf(line, "attempt to compare two %s values", ta)
+	}
+	L.errorf(line, "attempt to compare %s with %s", ta, tb)
+}
+
+// protectedCall calls fn, returning any Lua error it raises instead of
+// propagating it.
+func (L *luaState) protectedCall(fn any, args []any) (rets []any, err *luaError) {
+	depth := L.depth
+	defer func() {
+		if r := recover(); r != nil {
+			luaErr, ok := r.(*luaError)
+			if !ok {
+				panic(r)
+			}
+			L.depth = depth
+			rets, err = nil, luaErr
+		}
+	}()
+	return L.call(fn, args, L.line), nil
+}
+
+// run calls fn from Go, turning Lua errors and other failures into Go
+// errors.
+func (L *luaState) run(fn any, args []any) (rets []any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			switch r := r.(type) {
+			case *luaError:
+				err = r
+			case *luaFatalError:
+				err = r.err
+			default:
+				err = fmt.Errorf("%s: internal error: %v", L.chunkName, r)
+			}
+			L.depth = 0
+		}
+	}()
+	return L.call(fn, args, 0), nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// runLua compiles and runs src with the standard library loaded, passing
+// args to the chunk.
+func runLua(src string, args ...any) ([]any, error) {
+	proto, err := luaCompile(src, "test")
+	if err != nil {
+		return nil, err
+	}
+	return newLuaState("test").run(&luaClosure{proto: proto}, args)
+}
+
+func TestLuaRun(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want any
+	}{
+		{"arithmetic", "return 1 + 2 * 3 - 4 / 2", float64(5)},
+		{"power and modulo", "return 2^10 + -7 % 3", float64(1026)},
+		{"string coercion", `return "10" + 5`, float64(15)},
+		{"concatenation", `return "a" .. 1 .. "b" .. 2.5`, "a1b2.5"},
+		{"comparison", `return 1 < 2 and "a" < "b" and not (2 <= 1)`, true},
+		{"and/or", "return nil or false or 'x'", "x"},
+		{"length", `local t = {1, 2, 3, "x"} return #t + #"hello"`, float64(9)},
+		{"table fields", "local t = {a = 1, [2] = 'b'} t.c = t.a + 1 return t.c", float64(2)},
+		{"numeric for", "local s = 0 for i = 10, 1, -2 do s = s + i end return s", float64(30)},
+		{"while and break", "local i = 0 while true do i = i + 1 if i == 5 then break end end return i", float64(5)},
+		{"repeat", "local i = 0 repeat i = i + 1 until i >= 3 return i", float64(3)},
+		{"ipairs", "local s = '' for i, v in ipairs({'a', 'b', 'c'}) do s = s .. i .. v end return s", "1a2b3c"},
+		{"pairs", "local n = 0 for k, v in pairs({x = 1, y = 2, 3}) do n = n + v end return n", float64(6)},
+		{"closures", `
+			local function counter()
+				local n = 0
+				return function() n = n + 1 return n end
+			end
+			local c1, c2 = counter(), counter()
+			c1() c1()
+			return c1() * 10 + c2()`, float64(31)},
+		{"loop upvalues", `
+			local fs = {}
+			for i = 1, 3 do fs[i] = function() return i end end
+			return fs[1]() + fs[2]() * 10 + fs[3]() * 100`, float64(321)},
+		{"recursion", "local function fib(n) if n < 2 then return n end return fib(n-1) + fib(n-2) end return fib(20)", float64(6765)},
+		{"varargs", "local function f(...) return select('#', ...) end return f(1, nil, 3)", float64(3)},
+		{"multiple returns", "local function f() return 1, 2 end local t = {f(), f()} return #t", float64(3)},
+		{"string.format", `return string.format("%d %s %5.2f %q", 3, "x", 1.5, "a\"b")`, `3 x  1.50 "a\"b"`},
+		{"string.rep and sub", `return string.rep("ab", 3):sub(2, -2)`, "baba"},
+		{"string.upper via method", `local s = "abc" return s:upper()`, "ABC"},
+		{"string.find plain", `return string.find("a.b", ".", 1, true)`, float64(2)},
+		{"string.find pattern", `local s, e = string.find("hello world", "o%s*w") return e`, float64(7)},
+		{"string.match captures", `local k, v = string.match("key=value", "(%w+)=(%w+)") return v .. k`, "valuekey"},
+		{"string.gsub", `return (string.gsub("hello world", "o", "0"))`, "hell0 w0rld"},
+		{"string.gsub function", `return (string.gsub("a b c", "%a", function(c) return c:upper() end))`, "A B C"},
+		{"string.gmatch", `local n = 0 for w in string.gmatch("one two three", "%a+") do n = n + 1 end return n`, float64(3)},
+		{"balanced pattern", `return string.match("f(a(b)c)d", "%b()")`, "(a(b)c)"},
+		{"table.concat", `return table.concat({1, 2, 3}, ",")`, "1,2,3"},
+		{"table.insert and remove", `local t = {1, 3} table.insert(t, 2, 2) table.remove(t, 1) return table.concat(t)`, "23"},
+		{"table.sort", `local t = {3, 1, 2} table.sort(t, function(a, b) return a > b end) return table.concat(t)`, "321"},
+		{"math", "return math.floor(3.7) + math.max(1, 5, 2) + math.abs(-2)", float64(10)},
+		{"bit", "return bit.band(0xff, 0x0f) + bit.bor(1, 2) + bit.lshift(1, 4)", float64(34)},
+		{"tostring and tonumber", `return tostring(10) .. tonumber("0x10")`, "1016"},
+		{"cjson round trip", `return cjson.decode(cjson.encode({a = {1, 2, "x"}})).a[3]`, "x"},
+		{"cjson encode", `return cjson.encode({1, "two", true})`, `[1,"two",true]`},
+		{"pcall catches errors", `local ok, err = pcall(error, "boom", 0) return tostring(ok) .. err`, "falseboom"},
+		{"pcall error tables", `local ok, err = pcall(error, {code = 7}) return err.code`, float64(7)},
+		{"metatables", `
+			local t = setmetatable({}, {__index = function(t, k) return k .. "!" end})
+			return t.hi`, "hi!"},
+	}
+	for _, tt := range tests {
+		rets, err := runLua(tt.src)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(rets) == 0 || rets[0] != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, rets, tt.want)
+		}
+	}
+}
+
+func TestLuaErrors(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"return 1 +", "test:1:"},
+		{"x = = 1", "test:1:"},
+		{"local t = nil\nreturn t.x", "test:2: attempt to index"},
+		{"return {} + 1", "attempt to perform arithmetic"},
+		{"return 1 < 'a'", "attempt to compare"},
+		{"return #5", "attempt to get length"},
+		{"undefined()", "attempt to call"},
+		{"error('custom')", "test:1: custom"},
+		{"local function f() return f() + 1 end return f()", "stack overflow"},
+	}
+	for _, tt := range tests {
+		_, err := runLua(tt.src)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("runLua(%q) error = %v, want %q", tt.src, err, tt.want)
+		}
+	}
+}
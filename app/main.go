@@ -54,7 +54,7 @@ func main() {
 	// Initiate server.
 	s := NewServer(ctx, cfg)
 	if err := s.Run(); err != nil {
-		fmt.Printf("Server error: ", err)
+		fmt.Printf("Server error: %v", err)
 	}
 
 	fmt.Printf("Server shutdown complete.")
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// Real Redis stores values of module types such as JSON documents as
+// RDB_TYPE_MODULE_2 entries: a 64-bit module ID made of the 9 character type
+// name and an encoding version, followed by values each tagged with an
+// opcode. Types compatible with those modules are saved the same way.
+const opCodeTypeModule2 byte = 0x07
+
+// Opcodes tagging each value of a module entry.
+const (
+	moduleOpCodeEOF    = 0
+	moduleOpCodeSInt   = 1
+	moduleOpCodeUInt   = 2
+	moduleOpCodeFloat  = 3
+	moduleOpCodeDouble = 4
+	moduleOpCodeString = 5
+)
+
+const moduleIDCharset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+// moduleValue is implemented by values saved as module entries.
+type moduleValue interface {
+	// moduleType returns the module type name and encoding version.
+	moduleType() (string, int)
+	// saveModule writes the value, without the trailing EOF opcode.
+	saveModule(w *moduleWriter)
+}
+
+// moduleLoaders maps module type names to functions that read a value saved
+// with the given encoding version.
+var moduleLoaders = map[string]func(r *moduleReader, encver int) (any, error){}
+
+// moduleID packs a type name and encoding version into a module ID.
+func moduleID(name string, encver int) uint64 {
+	var id uint64
+	for i := 0; i < len(name); i++ {
+		id = id<<6 | uint64(strings.IndexByte(moduleIDCharset, name[i]))
+	}
+	return id<<10 | uint64(encver)
+}
+
+// moduleName unpacks the type name and encoding version of a module ID.
+func moduleName(id uint64) (string, int) {
+	name := make([]byte, 9)
+	for i := len(name) - 1; i >= 0; i-- {
+		name[i] = moduleIDCharset[id>>(10+6*(8-i))&63]
+	}
+	return string(name), int(id & 1023)
+}
+
+// moduleWriter writes the opcode-tagged values of a module entry.
+type moduleWriter struct {
+	rw *rdbWriter
+}
+
+func (w *moduleWriter) saveUnsigned(n uint64) {
+	w.rw.writeLength(moduleOpCodeUInt)
+	w.rw.writeLength(int(n))
+}
+
+func (w *moduleWriter) saveSigned(n int64) {
+	w.rw.writeLength(moduleOpCodeSInt)
+	w.rw.writeLength(int(n))
+}
+
+func (w *moduleWriter) saveDouble(f float64) {
+	w.rw.writeLength(moduleOpCodeDouble)
+	binary.Write(w.rw.w, binary.LittleEndian, math.Float64bits(f))
+}
+
+func (w *moduleWriter) saveString(str string) {
+	w.rw.writeLength(moduleOpCodeString)
+	w.rw.writeString(str)
+}
+
+// writeModule writes a module entry.
+func (rw *rdbWriter) writeModule(key string, v moduleValue) {
+	rw.writeHeader(opCodeTypeModule2, key)
+	rw.writeLength(int(moduleID(v.moduleType())))
+	v.saveModule(&moduleWriter{rw})
+	rw.writeLength(moduleOpCodeEOF)
+}
+
+// moduleReader reads the opcode-tagged values of a module entry.
+type moduleReader struct {
+	r *bufio.Reader
+}
+
+// expect reads an opcode and fails unless it is the wanted one.
+func (mr *moduleReader) expect(opcode int) error {
+	got, err := decodeLength(mr.r)
+	if err != nil {
+		return err
+	}
+	if got != opcode {
+		return fmt.Errorf("unexpected module opcode %d, expected %d", got, opcode)
+	}
+	return nil
+}
+
+func (mr *moduleReader) loadUnsigned() (uint64, error) {
+	if err := mr.expect(moduleOpCodeUInt); err != nil {
+		return 0, err
+	}
+	n, err := decodeLength(mr.r)
+	return uint64(n), err
+}
+
+func (mr *moduleReader) loadSigned() (int64, error) {
+	if err := mr.expect(moduleOpCodeSInt); err != nil {
+		return 0, err
+	}
+	n, err := decodeLength(mr.r)
+	return int64(n), err
+}
+
+func (mr *moduleReader) loadDouble() (float64, error) {
+	if err := mr.expect(moduleOpCodeDouble); err != nil {
+		return 0, err
+	}
+	data := make([]byte, 8)
+	if _, err := io.ReadFull(mr.r, data); err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(data)), nil
+}
+
+func (mr *moduleReader) loadString() (string, error) {
+	if err := mr.expect(moduleOpCodeString); err != nil {
+		return "", err
+	}
+	return readString(mr.r)
+}
+
+// readModule reads a module entry of a known type.
+func readModule(r *bufio.Reader) (any, error) {
+	id, err := decodeLength(r)
+	if err != nil {
+		return nil, err
+	}
+	name, encver := moduleName(uint64(id))
+	load, ok := moduleLoaders[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported module type %s", name)
+	}
+	mr := &moduleReader{r}
+	val, err := load(mr, encver)
+	if err != nil {
+		return nil, err
+	}
+	if err := mr.expect(moduleOpCodeEOF); err != nil {
+		return nil, err
+	}
+	return val, nil
+}
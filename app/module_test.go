@@ -0,0 +1,76 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestModuleID(t *testing.T) {
+	tests := []struct {
+		name   string
+		encver int
+	}{
+		{jsonModuleName, jsonModuleEncver},
+		{tsModuleName, tsModuleEncver},
+		{"AAAAAAAAA", 0},
+		{"_________", 1023},
+	}
+	for _, tt := range tests {
+		name, encver := moduleName(moduleID(tt.name, tt.encver))
+		if name != tt.name || encver != tt.encver {
+			t.Errorf("moduleName(moduleID(%s, %d)) = %s, %d", tt.name, tt.encver, name, encver)
+		}
+	}
+	if moduleID("AAAAAAAAA", 0) != 0 || moduleID("_________", 1023) != 1<<64-1 {
+		t.Errorf("module IDs don't span 64 bits")
+	}
+
+	// Every saved type must have a loader under its name.
+	for _, v := range []moduleValue{&JSON{}, NewTimeSeries(), NewBloomFilter(1, 0.1, 1, false),
+		NewCuckooFilter(1, 1, 1, 1), NewCountMinSketch(1, 1), NewTopK(1, 1, 1, topkDefaultDecay), NewTDigest(1)} {
+		name, _ := v.moduleType()
+		if len(name) != 9 || moduleLoaders[name] == nil {
+			t.Errorf("module type %q has no loader", name)
+		}
+	}
+}
+
+func TestModuleDumpRoundTrip(t *testing.T) {
+	doc, err := parseJSON(`{"a":[1,2.5,"x",null,true],"b":{}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := dumpValue(&JSON{doc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := restoreValue(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := val.(*JSON).root.serialize(jsonFormat{}); got != `{"a":[1,2.5,"x",null,true],"b":{}}` {
+		t.Errorf("restored JSON %s", got)
+	}
+
+	// Time series carry negative numbers, doubles and nested lists.
+	ts := NewTimeSeries()
+	ts.retention = 1000
+	ts.policy = tsPolicySum
+	ts.labels = [][2]string{{"area", "north"}}
+	ts.rules = []*tsRule{{dest: "dest", agg: "avg", duration: 60, align: -5, current: -1}}
+	ts.Add(10, -1.5, tsPolicyBlock)
+	ts.Add(20, 1e300, tsPolicyBlock)
+	if payload, err = dumpValue(ts); err != nil {
+		t.Fatal(err)
+	}
+	if val, err = restoreValue(payload); err != nil {
+		t.Fatal(err)
+	}
+	got := val.(*TimeSeries)
+	if got.retention != 1000 || got.policy != tsPolicySum || !slices.Equal(got.labels, ts.labels) || !slices.Equal(got.samples, ts.samples) {
+		t.Errorf("restored %+v", got)
+	}
+	if len(got.rules) != 1 || *got.rules[0] != *ts.rules[0] {
+		t.Errorf("restored rules %+v", got.rules)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import "fmt"
+
+const keyNotifyKeyspaceEvents = "notify-keyspace-events" // config key for the keyspace event classes
+
+// Keyspace event classes, as selected by the characters of the
+// notify-keyspace-events setting.
+const (
+	notifyKeyspace = 1 << iota // K: __keyspace@<db>__:<key> messages
+	notifyKeyevent             // E: __keyevent@<db>__:<event> messages
+	notifyGeneric              // g: DEL, RENAME, COPY and the like
+	notifyString               // $
+	notifyList                 // l
+	notifySet                  // s
+	notifyHash                 // h
+	notifyZSet                 // z
+	notifyExpired              // x: keys deleted once their TTL passed
+	notifyEvicted              // e: keys evicted for maxmemory
+	notifyStream               // t
+	notifyModule               // d: JSON, probabilistic and time series values
+	notifyNew                  // n: keys that didn't exist before
+	notifyKeyMiss              // m: reads of missing keys
+
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash | notifyZSet | notifyExpired | notifyEvicted | notifyStream | notifyModule
+)
+
+// parseKeyspaceEvents parses a notify-keyspace-events setting.
+func parseKeyspaceEvents(flags string) (int, error) {
+	classes := 0
+	for _, ch := range flags {
+		switch ch {
+		case 'A':
+			classes |= notifyAll
+		case 'K':
+			classes |= notifyKeyspace
+		case 'E':
+			classes |= notifyKeyevent
+		case 'g':
+			classes |= notifyGeneric
+		case '$':
+			classes |= notifyString
+		case 'l':
+			classes |= notifyList
+		case 's':
+			classes |= notifySet
+		case 'h':
+			classes |= notifyHash
+		case 'z':
+			classes |= notifyZSet
+		case 'x':
+			classes |= notifyExpired
+		case 'e':
+			classes |= notifyEvicted
+		case 't':
+			classes |= notifyStream
+		case 'd':
+			classes |= notifyModule
+		case 'n':
+			classes |= notifyNew
+		case 'm':
+			classes |= notifyKeyMiss
+		default:
+			return 0, fmt.Errorf("invalid event class character %q in %s", ch, keyNotifyKeyspaceEvents)
+		}
+	}
+	return classes, nil
+}
+
+// keyspaceEvents returns the classes of keyspace events to publish.
+func (s *Server) keyspaceEvents() int {
+	val, err := s.Config.Get(keyNotifyKeyspaceEvents)
+	if err != nil {
+		return 0
+	}
+	classes, err := parseKeyspaceEvents(val)
+	if err != nil {
+		return 0
+	}
+	return classes
+}
+
+// publishKeyspaceEvent publishes event on key to the keyspace and keyevent
+// channels, if its class is enabled.
+func (s *Server) publishKeyspaceEvent(class int, event, key string) {
+	classes := s.keyspaceEvents()
+	if classes&class == 0 {
+		return
+	}
+	if classes&notifyKeyspace != 0 {
+		s.pubsub.publish("__keyspace@0__:"+key, event)
+	}
+	if classes&notifyKeyevent != 0 {
+		s.pubsub.publish("__keyevent@0__:"+event, key)
+	}
+}
+
+// notify reports a keyspace event, for stores that belong to a server.
+func (s *Store) notify(class int, event, key string) {
+	if s.events != nil {
+		s.events(class, event, key)
+	}
+}
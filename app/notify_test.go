@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestParseKeyspaceEvents(t *testing.T) {
+	tests := []struct {
+		flags   string
+		want    int
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"KEA", notifyKeyspace | notifyKeyevent | notifyAll, false},
+		{"Kg$", notifyKeyspace | notifyGeneric | notifyString, false},
+		{"Elshzxetd", notifyKeyevent | notifyList | notifySet | notifyHash | notifyZSet | notifyExpired | notifyEvicted | notifyStream | notifyModule, false},
+		{"KA", notifyKeyspace | notifyAll, false},
+		{"Enm", notifyKeyevent | notifyNew | notifyKeyMiss, false},
+		{"KEg", notifyKeyspace | notifyKeyevent | notifyGeneric, false},
+		{"Kq", 0, true},
+		{"ka", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseKeyspaceEvents(tt.flags)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseKeyspaceEvents(%q) = %b, %v, want %b", tt.flags, got, err, tt.want)
+		}
+	}
+	// A does not include the new and key miss classes.
+	if all, _ := parseKeyspaceEvents("A"); all&(notifyNew|notifyKeyMiss) != 0 {
+		t.Errorf("A includes n or m")
+	}
+}
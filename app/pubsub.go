@@ -0,0 +1,383 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// pubSubOutputLimit is how many bytes of messages may wait to be written
+// to a subscriber before it is disconnected, like Redis'
+// client-output-buffer-limit for pub/sub clients.
+const pubSubOutputLimit = 32 * 1024 * 1024
+
+// subscriptionKind tells channel, pattern and shard channel subscriptions
+// apart.
+type subscriptionKind int
+
+const (
+	channelSubscription subscriptionKind = iota // SUBSCRIBE
+	patternSubscription                         // PSUBSCRIBE
+	shardSubscription                           // SSUBSCRIBE
+)
+
+// pubSub tracks the channel, pattern and shard channel subscriptions of
+// every client. Publishers hand messages to each subscriber's outbox and
+// never wait for them to be written. As the server is a single shard,
+// shard channels only differ from channels in being a separate namespace
+// that patterns don't match.
+type pubSub struct {
+	mu       sync.Mutex
+	channels map[string]map[*subscriber]struct{}
+	patterns map[string]map[*subscriber]struct{}
+	shards   map[string]map[*subscriber]struct{}
+}
+
+// subscriber is a client that has subscribed at least once. From then on
+// everything sent to the client goes through its outbox, which is written
+// to the connection by a goroutine of its own, so that replies and
+// messages are delivered in order.
+type subscriber struct {
+	client *ClientHandler
+
+	// channels, patterns and shards are only changed with pubSub.mu held.
+	channels map[string]struct{}
+	patterns map[string]struct{}
+	shards   map[string]struct{}
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	outbox  []string
+	pending int  // bytes in outbox
+	closed  bool // no more messages are accepted
+}
+
+func newPubSub() *pubSub {
+	return &pubSub{
+		channels: make(map[string]map[*subscriber]struct{}),
+		patterns: make(map[string]map[*subscriber]struct{}),
+		shards:   make(map[string]map[*subscriber]struct{}),
+	}
+}
+
+func newSubscriber(c *ClientHandler) *subscriber {
+	sub := &subscriber{
+		client:   c,
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+		shards:   make(map[string]struct{}),
+	}
+	sub.cond = sync.NewCond(&sub.mu)
+	go sub.writeLoop()
+	return sub
+}
+
+// push queues msg to be written to the subscriber. A subscriber that
+// falls too far behind is disconnected.
+func (sub *subscriber) push(msg string) bool {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return false
+	}
+	if sub.pending+len(msg) > pubSubOutputLimit {
+		fmt.Printf("Disconnecting subscriber for exceeding the output buffer limit.")
+		sub.closed = true
+		sub.client.Conn.Close()
+		sub.cond.Signal()
+		return false
+	}
+	sub.outbox = append(sub.outbox, msg)
+	sub.pending += len(msg)
+	sub.cond.Signal()
+	return true
+}
+
+// close stops the outbox once what it holds has been written.
+func (sub *subscriber) close() {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	sub.closed = true
+	sub.cond.Signal()
+}
+
+func (sub *subscriber) writeLoop() {
+	for {
+		sub.mu.Lock()
+		for len(sub.outbox) == 0 && !sub.closed {
+			sub.cond.Wait()
+		}
+		msgs := sub.outbox
+		sub.outbox, sub.pending = nil, 0
+		closed := sub.closed
+		sub.mu.Unlock()
+
+		if len(msgs) > 0 {
+			if _, err := sub.client.Conn.Write([]byte(strings.Join(msgs, ""))); err != nil {
+				sub.close()
+				return
+			}
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+// count returns the number of subscriptions reported in the replies to
+// subscribe commands of the given kind. Shard channels are counted apart
+// from channels and patterns.
+func (sub *subscriber) count(kind subscriptionKind) int {
+	if kind == shardSubscription {
+		return len(sub.shards)
+	}
+	return len(sub.channels) + len(sub.patterns)
+}
+
+// subscribe adds target, a channel or a pattern, to subs, reporting
+// whether it wasn't there yet.
+func (ps *pubSub) subscribe(subs map[string]map[*subscriber]struct{}, own map[string]struct{}, sub *subscriber, target string) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if _, found := own[target]; found {
+		return false
+	}
+	own[target] = struct{}{}
+	if subs[target] == nil {
+		subs[target] = make(map[*subscriber]struct{})
+	}
+	subs[target][sub] = struct{}{}
+	return true
+}
+
+// unsubscribe removes target from subs, reporting whether it was there.
+func (ps *pubSub) unsubscribe(subs map[string]map[*subscriber]struct{}, own map[string]struct{}, sub *subscriber, target string) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if _, found := own[target]; !found {
+		return false
+	}
+	delete(own, target)
+	delete(subs[target], sub)
+	if len(subs[target]) == 0 {
+		delete(subs, target)
+	}
+	return true
+}
+
+// publish delivers a message to the subscribers of channel and of the
+// patterns matching it, and returns how many received it.
+func (ps *pubSub) publish(channel, message string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	receivers := 0
+	msg := encodeBulkStringArray(3, "message", channel, message)
+	for sub := range ps.channels[channel] {
+		if sub.push(msg) {
+			receivers++
+		}
+	}
+	for pattern, subs := range ps.patterns {
+		if !stringMatch(pattern, channel, false) {
+			continue
+		}
+		msg := encodeBulkStringArray(4, "pmessage", pattern, channel, message)
+		for sub := range subs {
+			if sub.push(msg) {
+				receivers++
+			}
+		}
+	}
+	return receivers
+}
+
+// publishShard delivers a message to the subscribers of a shard channel,
+// and returns how many received it.
+func (ps *pubSub) publishShard(channel, message string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	receivers := 0
+	msg := encodeBulkStringArray(3, "smessage", channel, message)
+	for sub := range ps.shards[channel] {
+		if sub.push(msg) {
+			receivers++
+		}
+	}
+	return receivers
+}
+
+// subscriber returns the client's subscriber, creating it on first use.
+func (c *ClientHandler) subscriber() *subscriber {
+	if c.sub == nil {
+		c.sub = newSubscriber(c)
+	}
+	return c.sub
+}
+
+// inSubscribeMode reports whether the client has subscriptions, which
+// restricts it to the subscribe commands and PING.
+func (c *ClientHandler) inSubscribeMode() bool {
+	return c.sub != nil && len(c.sub.channels)+len(c.sub.patterns)+len(c.sub.shards) > 0
+}
+
+// processSubscribed runs a command sent in subscribe mode.
+func (c *ClientHandler) processSubscribed(cmd Command) error {
+	switch name := strings.ToUpper(cmd.Command); name {
+	case "SUBSCRIBE", "UNSUBSCRIBE", "PSUBSCRIBE", "PUNSUBSCRIBE", "SSUBSCRIBE", "SUNSUBSCRIBE":
+		return c.call(cmd)
+	case "PING":
+		if len(cmd.Args) > 1 {
+			return fmt.Errorf("wrong number of arguments for PING")
+		}
+		msg := ""
+		if len(cmd.Args) == 1 {
+			msg = cmd.Args[0]
+		}
+		return c.send(encodeBulkStringArray(2, "pong", msg))
+	default:
+		return fmt.Errorf("Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING are allowed in this context", strings.ToLower(name))
+	}
+}
+
+// unsubscribeAll drops every subscription of a disconnecting client and
+// stops its outbox.
+func (c *ClientHandler) unsubscribeAll() {
+	if c.sub == nil {
+		return
+	}
+	ps := c.Server.pubsub
+	for channel := range c.sub.channels {
+		ps.unsubscribe(ps.channels, c.sub.channels, c.sub, channel)
+	}
+	for pattern := range c.sub.patterns {
+		ps.unsubscribe(ps.patterns, c.sub.patterns, c.sub, pattern)
+	}
+	for channel := range c.sub.shards {
+		ps.unsubscribe(ps.shards, c.sub.shards, c.sub, channel)
+	}
+	c.sub.close()
+}
+
+// handleSubscribe handles SUBSCRIBE, PSUBSCRIBE and SSUBSCRIBE commands,
+// replying with a confirmation for each channel or pattern.
+func (c *ClientHandler) handleSubscribe(args []string, kind subscriptionKind) error {
+	if len(args) < 1 {
+		return fmt.Errorf("insufficient number of arguments for subscribing")
+	}
+	sub := c.subscriber()
+	name, subs, own := c.subscriptions(kind)
+	fmt.Printf("%s %s command received.", strings.ToUpper(name), strings.Join(args, " "))
+	for _, target := range args {
+		c.Server.pubsub.subscribe(subs, own, sub, target)
+		if err := c.send(encodeArray(encodeBulkString(name), encodeBulkString(target), encodeInteger(sub.count(kind)))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleUnsubscribe handles UNSUBSCRIBE, PUNSUBSCRIBE and SUNSUBSCRIBE
+// commands. Without arguments every channel or pattern of the kind is
+// unsubscribed from.
+func (c *ClientHandler) handleUnsubscribe(args []string, kind subscriptionKind) error {
+	sub := c.subscriber()
+	name, subs, own := c.subscriptions(kind)
+	name = name[:len(name)-len("subscribe")] + "unsubscribe"
+	fmt.Printf("%s %s command received.", strings.ToUpper(name), strings.Join(args, " "))
+	targets := args
+	if len(targets) == 0 {
+		for target := range own {
+			targets = append(targets, target)
+		}
+		sort.Strings(targets)
+	}
+	if len(targets) == 0 {
+		return c.send(encodeArray(encodeBulkString(name), nullResponse, encodeInteger(sub.count(kind))))
+	}
+	for _, target := range targets {
+		c.Server.pubsub.unsubscribe(subs, own, sub, target)
+		if err := c.send(encodeArray(encodeBulkString(name), encodeBulkString(target), encodeInteger(sub.count(kind)))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subscriptions returns the name of the subscribe command of the given
+// kind, the registry and the client's own set of channels or patterns.
+func (c *ClientHandler) subscriptions(kind subscriptionKind) (string, map[string]map[*subscriber]struct{}, map[string]struct{}) {
+	ps := c.Server.pubsub
+	switch kind {
+	case patternSubscription:
+		return "psubscribe", ps.patterns, c.sub.patterns
+	case shardSubscription:
+		return "ssubscribe", ps.shards, c.sub.shards
+	}
+	return "subscribe", ps.channels, c.sub.channels
+}
+
+// handlePublish handles PUBLISH commands.
+func (c *ClientHandler) handlePublish(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("wrong number of arguments for PUBLISH")
+	}
+	fmt.Printf("PUBLISH %s command received.", args[0])
+	return c.send(encodeInteger(c.Server.pubsub.publish(args[0], args[1])))
+}
+
+// handleSPublish handles SPUBLISH commands.
+func (c *ClientHandler) handleSPublish(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("wrong number of arguments for SPUBLISH")
+	}
+	fmt.Printf("SPUBLISH %s command received.", args[0])
+	return c.send(encodeInteger(c.Server.pubsub.publishShard(args[0], args[1])))
+}
+
+// handlePubSub handles PUBSUB CHANNELS, NUMSUB, NUMPAT, SHARDCHANNELS and
+// SHARDNUMSUB commands.
+func (c *ClientHandler) handlePubSub(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("insufficient number of arguments for PUBSUB")
+	}
+	ps := c.Server.pubsub
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	subCmd := strings.ToUpper(args[0])
+	fmt.Printf("PUBSUB %s command received.", subCmd)
+	switch subCmd {
+	case "CHANNELS", "SHARDCHANNELS":
+		if len(args) > 2 {
+			return fmt.Errorf("wrong number of arguments for PUBSUB %s", subCmd)
+		}
+		subs := ps.channels
+		if subCmd == "SHARDCHANNELS" {
+			subs = ps.shards
+		}
+		var channels []string
+		for channel := range subs {
+			if len(args) == 1 || stringMatch(args[1], channel, false) {
+				channels = append(channels, channel)
+			}
+		}
+		sort.Strings(channels)
+		return c.send(encodeBulkStringArray(len(channels), channels...))
+	case "NUMSUB", "SHARDNUMSUB":
+		subs := ps.channels
+		if subCmd == "SHARDNUMSUB" {
+			subs = ps.shards
+		}
+		replies := make([]string, 0, 2*(len(args)-1))
+		for _, channel := range args[1:] {
+			replies = append(replies, encodeBulkString(channel), encodeInteger(len(subs[channel])))
+		}
+		return c.send(encodeArray(replies...))
+	case "NUMPAT":
+		if len(args) != 1 {
+			return fmt.Errorf("wrong number of arguments for PUBSUB NUMPAT")
+		}
+		return c.send(encodeInteger(len(ps.patterns)))
+	}
+	return fmt.Errorf("unknown subcommand %q for PUBSUB", args[0])
+}
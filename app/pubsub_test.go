@@ -0,0 +1,167 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// subscription returns the reply confirming a subscribe or unsubscribe
+// command for target, with the count of subscriptions left.
+func subscription(name, target string, count int) string {
+	return encodeArray(encodeBulkString(name), encodeBulkString(target), encodeInteger(count))
+}
+
+// newSubscribedClient connects a client to s that runs the given subscribe
+// commands.
+func newSubscribedClient(t *testing.T, s *Server, cmds ...[]string) *testClient {
+	c := newTestClient(s)
+	t.Cleanup(c.close)
+	for _, args := range cmds {
+		c.do(args...)
+	}
+	return c
+}
+
+func TestSubscriptionCounts(t *testing.T) {
+	c := newSubscribedClient(t, newTestServer(nil))
+	steps := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"SUBSCRIBE", "a", "b"}, subscription("subscribe", "a", 1) + subscription("subscribe", "b", 2)},
+		{[]string{"SUBSCRIBE", "a"}, subscription("subscribe", "a", 2)},
+		{[]string{"PSUBSCRIBE", "n*"}, subscription("psubscribe", "n*", 3)},
+		{[]string{"SSUBSCRIBE", "s"}, subscription("ssubscribe", "s", 1)}, // shard channels are counted apart
+		{[]string{"GET", "k"}, "-ERR Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING are allowed in this context\r\n"},
+		{[]string{"PING"}, encodeBulkStringArray(2, "pong", "")},
+		{[]string{"UNSUBSCRIBE", "b"}, subscription("unsubscribe", "b", 2)},
+		{[]string{"UNSUBSCRIBE", "nope"}, subscription("unsubscribe", "nope", 2)},
+		{[]string{"SUBSCRIBE", "c"}, subscription("subscribe", "c", 3)},
+		// Without arguments every channel is dropped, in order.
+		{[]string{"UNSUBSCRIBE"}, subscription("unsubscribe", "a", 2) + subscription("unsubscribe", "c", 1)},
+		{[]string{"UNSUBSCRIBE"}, encodeArray(encodeBulkString("unsubscribe"), nullResponse, encodeInteger(1))},
+		{[]string{"PUNSUBSCRIBE"}, subscription("punsubscribe", "n*", 0)},
+		{[]string{"SUNSUBSCRIBE"}, subscription("sunsubscribe", "s", 0)},
+		{[]string{"GET", "k"}, nullResponse}, // out of subscribe mode
+	}
+	for i, st := range steps {
+		if got := c.do(st.args...); got != st.want {
+			t.Errorf("step %d %v = %q, want %q", i, st.args, got, st.want)
+		}
+	}
+}
+
+func TestPublish(t *testing.T) {
+	s := newTestServer(nil)
+	channel := newSubscribedClient(t, s, []string{"SUBSCRIBE", "news.tech"})
+	pattern := newSubscribedClient(t, s, []string{"PSUBSCRIBE", "news.*", "n?ws.tech", "[a-m]*"})
+	shard := newSubscribedClient(t, s, []string{"SSUBSCRIBE", "news.tech"})
+	publisher := newTestClient(s)
+	for _, c := range []*testClient{channel, pattern, shard} {
+		c.read()
+	}
+
+	tests := []struct {
+		args             []string
+		want             string
+		channel, pattern []string // messages received, in any order
+		shard            []string
+	}{
+		{
+			[]string{"PUBLISH", "news.tech", "hi"}, ":3\r\n",
+			[]string{encodeBulkStringArray(3, "message", "news.tech", "hi")},
+			[]string{
+				encodeBulkStringArray(4, "pmessage", "news.*", "news.tech", "hi"),
+				encodeBulkStringArray(4, "pmessage", "n?ws.tech", "news.tech", "hi"),
+			},
+			nil,
+		},
+		{
+			[]string{"PUBLISH", "news.art", "hi"}, ":1\r\n",
+			nil, []string{encodeBulkStringArray(4, "pmessage", "news.*", "news.art", "hi")}, nil,
+		},
+		{
+			[]string{"PUBLISH", "blog", "hi"}, ":1\r\n",
+			nil, []string{encodeBulkStringArray(4, "pmessage", "[a-m]*", "blog", "hi")}, nil,
+		},
+		{[]string{"PUBLISH", "sports", "hi"}, ":0\r\n", nil, nil, nil},
+		{[]string{"PUBLISH", "News.tech", "hi"}, ":0\r\n", nil, nil, nil},
+		{
+			[]string{"SPUBLISH", "news.tech", "hi"}, ":1\r\n",
+			nil, nil, []string{encodeBulkStringArray(3, "smessage", "news.tech", "hi")},
+		},
+	}
+	for _, tt := range tests {
+		if got := publisher.do(tt.args...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+		receivers := []struct {
+			name string
+			c    *testClient
+			want []string
+		}{{"channel", channel, tt.channel}, {"pattern", pattern, tt.pattern}, {"shard", shard, tt.shard}}
+		for _, r := range receivers {
+			got := r.c.read()
+			for _, msg := range r.want {
+				if !strings.Contains(got, msg) {
+					t.Errorf("%v: %s subscriber didn't receive %q", tt.args, r.name, msg)
+				}
+				got = strings.Replace(got, msg, "", 1)
+			}
+			if got != "" {
+				t.Errorf("%v: %s subscriber received %q", tt.args, r.name, got)
+			}
+		}
+	}
+}
+
+func TestPubSubIntrospection(t *testing.T) {
+	s := newTestServer(nil)
+	a := newSubscribedClient(t, s, []string{"SUBSCRIBE", "news", "blog"}, []string{"PSUBSCRIBE", "n*"}, []string{"SSUBSCRIBE", "s1"})
+	newSubscribedClient(t, s, []string{"SUBSCRIBE", "news"}, []string{"PSUBSCRIBE", "n*", "b*"})
+	c := newTestClient(s)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"PUBSUB", "CHANNELS"}, encodeBulkStringArray(2, "blog", "news")},
+		{[]string{"PUBSUB", "channels", "n*"}, encodeBulkStringArray(1, "news")},
+		{[]string{"PUBSUB", "NUMSUB", "news", "blog", "none"}, encodeArray(
+			encodeBulkString("news"), encodeInteger(2),
+			encodeBulkString("blog"), encodeInteger(1),
+			encodeBulkString("none"), encodeInteger(0),
+		)},
+		{[]string{"PUBSUB", "NUMSUB"}, encodeArray()},
+		{[]string{"PUBSUB", "NUMPAT"}, ":2\r\n"}, // distinct patterns
+		{[]string{"PUBSUB", "SHARDCHANNELS"}, encodeBulkStringArray(1, "s1")},
+		{[]string{"PUBSUB", "SHARDNUMSUB", "s1", "news"}, encodeArray(
+			encodeBulkString("s1"), encodeInteger(1),
+			encodeBulkString("news"), encodeInteger(0),
+		)},
+		{[]string{"PUBSUB", "NUMPAT", "x"}, "-ERR wrong number of arguments for PUBSUB NUMPAT\r\n"},
+		{[]string{"PUBSUB", "HELP"}, "-ERR unknown subcommand \"HELP\" for PUBSUB\r\n"},
+	}
+	for _, tt := range tests {
+		if got := c.do(tt.args...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+
+	// A disconnecting client is dropped from every registry.
+	a.close()
+	after := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"PUBSUB", "CHANNELS"}, encodeBulkStringArray(1, "news")},
+		{[]string{"PUBSUB", "NUMSUB", "news"}, encodeArray(encodeBulkString("news"), encodeInteger(1))},
+		{[]string{"PUBSUB", "NUMPAT"}, ":2\r\n"},
+		{[]string{"PUBSUB", "SHARDCHANNELS"}, encodeBulkStringArray(0)},
+	}
+	for _, tt := range after {
+		if got := c.do(tt.args...); got != tt.want {
+			t.Errorf("after disconnecting: %v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+const rdbHeader = "REDIS0012" // magic string and RDB version written by Save
+
+// rdbWriter encodes values in the RDB format. Write errors are sticky in
+// the underlying bufio.Writer and surface when the writer is flushed.
+type rdbWriter struct {
+	w      *bufio.Writer
+	noKeys bool // leave keys out, as in DUMP payloads
+}
+
+func newRDBWriter(w io.Writer) *rdbWriter {
+	return &rdbWriter{w: bufio.NewWriter(w)}
+}
+
+// writeRDB writes a snapshot of every unexpired key in the store.
+func writeRDB(w io.Writer, s *Store) error {
+	rw := newRDBWriter(w)
+	rw.w.WriteString(rdbHeader)
+	for _, idx := range s.indexes {
+		def := append([]string{idx.name}, idx.args...)
+		rw.w.WriteByte(opCodeAuxField)
+		rw.writeString(rdbAuxSearchIndex)
+		rw.writeString(encodeBulkStringArray(len(def), def...))
+	}
+	if s.functions != nil {
+		rw.writeFunctions(s.functions)
+	}
+	rw.w.WriteByte(opCodeSelectDB)
+	rw.writeLength(0)
+	rw.w.WriteByte(opCodeResizeDB)
+	rw.writeLength(len(s.kv))
+	rw.writeLength(len(s.expiry))
+
+	now := time.Now().UTC()
+	for key, val := range s.kv {
+		if exp, ok := s.expiry[key]; ok {
+			if exp.Before(now) {
+				continue
+			}
+			rw.w.WriteByte(opCodeExpMilSec)
+			rw.writeMillisecondTime(exp)
+		}
+		if err := rw.writeObject(key, val); err != nil {
+			return err
+		}
+	}
+
+	// A zero checksum tells readers that checksumming is disabled.
+	rw.w.WriteByte(opCodeEOF)
+	rw.w.Write(make([]byte, 8))
+	return rw.w.Flush()
+}
+
+// writeObject writes the value type, key and value of one entry.
+func (rw *rdbWriter) writeObject(key string, val any) error {
+	switch v := val.(type) {
+	case string:
+		rw.writeHeader(opCodeTypeString, key)
+		rw.writeString(v)
+	case []byte:
+		rw.writeHeader(opCodeTypeString, key)
+		rw.writeString(string(v))
+	case *Set:
+		if v.IsIntset() {
+			rw.writeHeader(opCodeTypeSetIntset, key)
+			rw.writeString(v.encodeIntset())
+			return nil
+		}
+		rw.writeHeader(opCodeTypeSet, key)
+		rw.writeLength(v.Len())
+		for member := range v.members {
+			rw.writeString(member)
+		}
+	case *ZSet:
+		rw.writeHeader(opCodeTypeZSet2, key)
+		rw.writeLength(v.Len())
+		for member, score := range v.dict {
+			rw.writeString(member)
+			binary.Write(rw.w, binary.LittleEndian, math.Float64bits(score))
+		}
+	case *List:
+		rw.writeHeader(opCodeTypeListQuicklist2, key)
+		rw.writeList(v)
+	case *Stream:
+		rw.writeHeader(opCodeTypeStreamListpacks3, key)
+		rw.writeStream(v)
+	case *Hash:
+		now := time.Now().UTC()
+		v.expireFields(now)
+		if !v.IsVolatile() {
+			rw.writeHeader(opCodeTypeHash, key)
+			rw.writeLength(v.Len())
+			for field, value := range v.fields {
+				rw.writeString(field)
+				rw.writeString(value)
+			}
+			return nil
+		}
+
+		minExpire, _ := v.MinExpire()
+		rw.writeHeader(opCodeTypeHashMetadata, key)
+		rw.writeMillisecondTime(minExpire)
+		rw.writeLength(v.Len())
+		for field, value := range v.fields {
+			if at, ok := v.expires[field]; ok {
+				rw.writeLength(int(at.Sub(minExpire).Milliseconds()) + 1)
+			} else {
+				rw.writeLength(0)
+			}
+			rw.writeString(field)
+			rw.writeString(value)
+		}
+	case moduleValue:
+		rw.writeModule(key, v)
+	default:
+		return fmt.Errorf("cannot save value of type %T", val)
+	}
+	return nil
+}
+
+// writeHeader writes the value type and key that start each entry.
+func (rw *rdbWriter) writeHeader(valueType byte, key string) {
+	rw.w.WriteByte(valueType)
+	if !rw.noKeys {
+		rw.writeString(key)
+	}
+}
+
+// writeLength writes n using the RDB length encoding read by decodeLength.
+// Negative numbers are written as their 64 bit two's complement, which
+// decodeLength turns back into the same int.
+func (rw *rdbWriter) writeLength(n int) {
+	switch u := uint64(n); {
+	case u < 1<<6:
+		rw.w.WriteByte(byte(u))
+	case u < 1<<14:
+		rw.w.Write([]byte{0x40 | byte(u>>8), byte(u)})
+	case u <= 1<<32-1:
+		rw.w.WriteByte(0x80)
+		binary.Write(rw.w, binary.BigEndian, uint32(u))
+	default:
+		rw.w.WriteByte(0x81)
+		binary.Write(rw.w, binary.BigEndian, u)
+	}
+}
+
+// writeString writes a length-prefixed string.
+func (rw *rdbWriter) writeString(str string) {
+	rw.writeLength(len(str))
+	rw.w.WriteString(str)
+}
+
+// writeMillisecondTime writes t as an 8-byte little-endian unix time in
+// milliseconds.
+func (rw *rdbWriter) writeMillisecondTime(t time.Time) {
+	binary.Write(rw.w, binary.LittleEndian, uint64(t.UnixMilli()))
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Replicas are sent the effects of writes rather than the commands that
+// made them, the way Redis replicates scripts. A command that succeeds
+// and may write is queued as it was sent, unless its outcome depends on
+// the time or on chance: such commands queue commands that repeat what
+// they did instead, so SPOP becomes SREM and relative expiration times
+// become absolute ones. Commands run by EXEC and by scripts are queued the
+// same way as the ones clients send, and keys that expire are queued as
+// DEL. The queue is sent once the store is released, wrapped in
+// MULTI/EXEC when it holds several commands, so that replicas apply a
+// transaction or a script at once.
+
+// propagate queues cmd to be sent to replicas. It must be called with the
+// store lock held.
+func (s *Server) propagate(cmd Command) {
+	s.propagated = append(s.propagated, cmd)
+}
+
+// flushPropagated sends the commands queued since the last call to every
+// replica. It must be called with the store lock held, before releasing
+// it.
+func (s *Server) flushPropagated() {
+	cmds := s.propagated
+	s.propagated = nil
+	if len(cmds) == 0 {
+		return
+	}
+	if len(cmds) > 1 {
+		cmds = append(append([]Command{{Command: "MULTI"}}, cmds...), Command{Command: "EXEC"})
+	}
+	var out strings.Builder
+	for _, cmd := range cmds {
+		argv := append([]string{cmd.Command}, cmd.Args...)
+		out.WriteString(encodeBulkStringArray(len(argv), argv...))
+	}
+	for _, r := range s.GetReplicas() {
+		if _, err := r.Write([]byte(out.String())); err != nil {
+			fmt.Printf("Error sending command to replica: %v\n", err)
+		}
+	}
+}
+
+// replicateEffects queues cmds for replicas in place of the command being
+// executed, for commands whose outcome depends on the time or on chance,
+// and for commands that only write in some forms, such as FUNCTION.
+// Without cmds it only keeps the command from being sent.
+func (c *ClientHandler) replicateEffects(cmds ...Command) {
+	c.replicated = true
+	for _, cmd := range cmds {
+		c.Server.propagate(cmd)
+	}
+}
+
+// propagateCall queues cmd for replicas once it ran successfully, if it
+// may write and its handler didn't queue its effects instead.
+func (c *ClientHandler) propagateCall(cmd Command, info commandInfo) {
+	if !c.replicated && info.flags&(cmdWrite|cmdMayReplicate) != 0 {
+		c.Server.propagate(cmd)
+	}
+}
+
+// replicate queues a command for replicas, if the store has any, for
+// changes the store makes by itself such as deleting expired keys.
+func (s *Store) replicate(args ...string) {
+	if s.propagate != nil {
+		s.propagate(Command{args[0], args[1:]})
+	}
+}
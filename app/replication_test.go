@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testReplica is a replica connection that keeps what it is sent in a
+// testConn. Only the methods used on replicas are implemented.
+type testReplica struct {
+	net.Conn
+	conn *testConn
+}
+
+func (r testReplica) Write(p []byte) (int, error) {
+	return r.conn.Write(p)
+}
+
+func (r testReplica) Close() error {
+	return nil
+}
+
+// newReplicatedServer returns a test server with one replica, whose
+// commands are kept in the returned testConn.
+func newReplicatedServer() (*Server, *testConn) {
+	s := newTestServer(nil)
+	replica := &testConn{}
+	s.AddReplica(testReplica{conn: replica})
+	return s, replica
+}
+
+// replicated returns the commands sent to replica since the last call,
+// each with its arguments joined by spaces.
+func replicated(t *testing.T, replica *testConn) []string {
+	t.Helper()
+	var cmds []string
+	r := bufio.NewReader(strings.NewReader(replica.take()))
+	for {
+		cmd, err := readCommand(r)
+		if errors.Is(err, io.EOF) {
+			return cmds
+		}
+		if err != nil {
+			t.Fatalf("replica was sent an invalid command: %v", err)
+		}
+		cmds = append(cmds, strings.Join(append([]string{cmd.Command}, cmd.Args...), " "))
+	}
+}
+
+func TestPropagate(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup [][]string
+		args  []string
+		want  []string
+	}{
+		{"write", nil, []string{"HSET", "h", "f", "v"}, []string{"HSET h f v"}},
+		{"set write", nil, []string{"SADD", "s", "a"}, []string{"SADD s a"}},
+		{"read", [][]string{{"SET", "k", "v"}}, []string{"GET", "k"}, nil},
+		{"failed write", [][]string{{"SET", "k", "v"}}, []string{"HSET", "k", "f", "v"}, nil},
+		{"spop", [][]string{{"SADD", "s", "a"}}, []string{"SPOP", "s"}, []string{"SREM s a"}},
+		{"spop missing key", nil, []string{"SPOP", "s"}, nil},
+		{"bzpopmin", [][]string{{"ZADD", "z", "1", "a"}}, []string{"BZPOPMIN", "z", "0"}, []string{"ZPOPMIN z"}},
+		{"sort", [][]string{{"RPUSH", "l", "2", "1"}}, []string{"SORT", "l"}, nil},
+		{"sort store", [][]string{{"RPUSH", "l", "2", "1"}}, []string{"SORT", "l", "STORE", "d"}, []string{"SORT l STORE d"}},
+		{"publish", nil, []string{"PUBLISH", "ch", "hi"}, []string{"PUBLISH ch hi"}},
+		{"xadd explicit id", nil, []string{"XADD", "st", "5-1", "f", "v"}, []string{"XADD st 5-1 f v"}},
+		{"xadd incomplete id", [][]string{{"XADD", "st", "5-1", "f", "v"}}, []string{"XADD", "st", "5-*", "f", "v"}, []string{"XADD st 5-2 f v"}},
+		{
+			"transaction",
+			[][]string{{"MULTI"}, {"SET", "a", "1"}, {"GET", "a"}, {"SADD", "s", "x"}},
+			[]string{"EXEC"},
+			[]string{"MULTI", "SET a 1", "SADD s x", "EXEC"},
+		},
+		{
+			"script",
+			nil,
+			[]string{"EVAL", "redis.call('SET', KEYS[1], '1'); redis.call('SADD', KEYS[2], 'x')", "2", "a", "s"},
+			[]string{"MULTI", "SET a 1", "SADD s x", "EXEC"},
+		},
+		{
+			"script with one write",
+			[][]string{{"SADD", "s", "a"}},
+			[]string{"EVAL", "return redis.call('SPOP', KEYS[1])", "1", "s"},
+			[]string{"SREM s a"},
+		},
+		{"read-only script", nil, []string{"EVAL", "return redis.call('GET', KEYS[1])", "1", "a"}, nil},
+		{"function list", nil, []string{"FUNCTION", "LIST"}, nil},
+		{"function flush", nil, []string{"FUNCTION", "FLUSH"}, []string{"FUNCTION FLUSH"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, replica := newReplicatedServer()
+			c := newTestClient(s)
+			for _, args := range tt.setup {
+				c.do(args...)
+			}
+			if tt.args[0] != "EXEC" {
+				replicated(t, replica)
+			}
+			if reply := c.do(tt.args...); strings.HasPrefix(reply, "-") && tt.want != nil {
+				t.Fatalf("%v = %q", tt.args, reply)
+			}
+			got := replicated(t, replica)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("%v replicated %q, want %q", tt.args, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPropagateAbsoluteExpiry(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string // {at} stands for the expiration time in milliseconds
+		ttl  time.Duration
+	}{
+		{[]string{"SET", "k", "v", "PX", "10000"}, "SET k v PXAT {at}", 10 * time.Second},
+		{[]string{"HEXPIRE", "h", "100", "FIELDS", "1", "f"}, "HPEXPIREAT h {at} FIELDS 1 f", 100 * time.Second},
+		{[]string{"HSETEX", "h", "PX", "5000", "FIELDS", "1", "f", "w"}, "HSETEX h PXAT {at} FIELDS 1 f w", 5 * time.Second},
+	}
+	for _, tt := range tests {
+		s, replica := newReplicatedServer()
+		c := newTestClient(s)
+		c.do("HSET", "h", "f", "v")
+		replicated(t, replica)
+
+		before := time.Now().Add(tt.ttl).UnixMilli()
+		c.do(tt.args...)
+		after := time.Now().Add(tt.ttl).UnixMilli()
+		got := replicated(t, replica)
+		if len(got) != 1 {
+			t.Errorf("%v replicated %q, want one command", tt.args, got)
+			continue
+		}
+		gotWords, wantWords := strings.Fields(got[0]), strings.Fields(tt.want)
+		if len(gotWords) != len(wantWords) {
+			t.Errorf("%v replicated %q, want %q", tt.args, got[0], tt.want)
+			continue
+		}
+		for i, w := range wantWords {
+			if w != "{at}" {
+				if gotWords[i] != w {
+					t.Errorf("%v replicated %q, want %q", tt.args, got[0], tt.want)
+				}
+				continue
+			}
+			if at, err := strconv.ParseInt(gotWords[i], 10, 64); err != nil || at < before || at > after {
+				t.Errorf("%v replicated expiration time %s, want between %d and %d", tt.args, gotWords[i], before, after)
+			}
+		}
+	}
+}
+
+func TestPropagateExpired(t *testing.T) {
+	s, replica := newReplicatedServer()
+	c := newTestClient(s)
+	c.do("SET", "k", "v")
+	c.do("HSET", "h", "a", "1", "b", "2")
+	c.do("HPEXPIRE", "h", "1", "FIELDS", "1", "a")
+	replicated(t, replica)
+	s.Store.expiry["k"] = time.Now().Add(-time.Second)
+	time.Sleep(2 * time.Millisecond)
+
+	if got := c.do("GET", "k"); got != nullResponse {
+		t.Fatalf("GET of an expired key = %q", got)
+	}
+	if got, want := replicated(t, replica), []string{"DEL k"}; strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expired key replicated %q, want %q", got, want)
+	}
+	c.do("HGETALL", "h")
+	if got, want := replicated(t, replica), []string{"HDEL h a"}; strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expired hash field replicated %q, want %q", got, want)
+	}
+}
+
+func TestPropagateXAddAutoID(t *testing.T) {
+	s, replica := newReplicatedServer()
+	c := newTestClient(s)
+	reply := c.do("XADD", "st", "MAXLEN", "10", "*", "f", "v")
+	id := strings.TrimSuffix(reply[strings.Index(reply, "\r\n")+2:], "\r\n")
+	got := replicated(t, replica)
+	if want := "XADD st MAXLEN 10 " + id + " f v"; len(got) != 1 || got[0] != want {
+		t.Errorf("XADD * replicated %q, want %q", got, want)
+	}
+}
+
+func TestPropagateReadGroup(t *testing.T) {
+	s, replica := newReplicatedServer()
+	c := newTestClient(s)
+	c.do("XADD", "st", "1-1", "f", "v")
+	c.do("XGROUP", "CREATE", "st", "g", "0")
+	replicated(t, replica)
+
+	c.do("XREADGROUP", "GROUP", "g", "alice", "STREAMS", "st", ">")
+	got := replicated(t, replica)
+	want := []string{"MULTI", "XGROUP CREATECONSUMER st g alice", "XCLAIM st g alice 0 1-1 TIME", "XGROUP SETID st g 1-1 ENTRIESREAD 1", "EXEC"}
+	if len(got) != len(want) {
+		t.Fatalf("XREADGROUP replicated %q, want %q", got, want)
+	}
+	for i := range want {
+		if !strings.HasPrefix(got[i], want[i]) {
+			t.Errorf("XREADGROUP replicated %q, want %q", got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+const defaultScanCount = 10 // elements returned per SCAN call without COUNT
+
+// scanOptions are the MATCH, COUNT and TYPE options of the SCAN family.
+type scanOptions struct {
+	match     string
+	count     int
+	valueType string
+}
+
+// parseCursor parses a SCAN cursor argument.
+func parseCursor(arg string) (uint64, error) {
+	cursor, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cursor")
+	}
+	return cursor, nil
+}
+
+// parseScanOptions parses the options following the cursor. TYPE is only
+// accepted when allowType is set.
+func parseScanOptions(args []string, allowType bool) (scanOptions, error) {
+	opts := scanOptions{count: defaultScanCount}
+	for i := 0; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return opts, errSyntax
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			opts.match = args[i+1]
+		case "COUNT":
+			count, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return opts, errNotInteger
+			}
+			if count < 1 {
+				return opts, errSyntax
+			}
+			opts.count = count
+		case "TYPE":
+			if !allowType {
+				return opts, errSyntax
+			}
+			opts.valueType = strings.ToLower(args[i+1])
+		default:
+			return opts, errSyntax
+		}
+	}
+	return opts, nil
+}
+
+// matches reports whether str passes the MATCH filter.
+func (o scanOptions) matches(str string) bool {
+	return o.match == "" || stringMatch(o.match, str, false)
+}
+
+// scanHash returns the hash that places member in a keyTable bucket. It is
+// kept to 63 bits so that a following cursor never wraps around to 0,
+// which ends the iteration.
+func scanHash(member string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(member))
+	return h.Sum64() >> 1
+}
+
+// scanEmptyVisits bounds the empty buckets a SCAN call visits per key
+// requested, so that calls on a sparse table stay cheap.
+const scanEmptyVisits = 10
+
+// keyTable holds strings for the SCAN family: the keys of a store, the
+// members of a set or sorted set, or the fields of a hash. Keys are spread
+// over a power-of-two number of buckets by the low bits of their hash, and
+// the table is kept sized to the number of keys as keys come and go, so a
+// SCAN call only visits the buckets it returns.
+type keyTable struct {
+	buckets [][]string
+	count   int
+}
+
+// add adds key, which must not be in the table yet.
+func (t *keyTable) add(key string) {
+	t.count++
+	if t.count > len(t.buckets) {
+		t.resize(max(2*len(t.buckets), 1))
+	}
+	b := scanHash(key) & uint64(len(t.buckets)-1)
+	t.buckets[b] = append(t.buckets[b], key)
+}
+
+// remove removes key, which must be in the table.
+func (t *keyTable) remove(key string) {
+	b := scanHash(key) & uint64(len(t.buckets)-1)
+	bucket := t.buckets[b]
+	for i, k := range bucket {
+		if k == key {
+			bucket[i] = bucket[len(bucket)-1]
+			t.buckets[b] = bucket[:len(bucket)-1]
+			break
+		}
+	}
+	t.count--
+	if len(t.buckets) > 1 && t.count < len(t.buckets)/4 {
+		t.resize(len(t.buckets) / 2)
+	}
+}
+
+// random returns a random key, which the table must have. As with Redis, a
+// random non-empty bucket is picked and then a key within it, so keys that
+// share a bucket are somewhat less likely to come up. The table is never
+// much larger than its keys, so few empty buckets are tried.
+func (t *keyTable) random() string {
+	for {
+		bucket := t.buckets[rand.Intn(len(t.buckets))]
+		if len(bucket) > 0 {
+			return bucket[rand.Intn(len(bucket))]
+		}
+	}
+}
+
+// resize moves the keys to a table of size buckets.
+func (t *keyTable) resize(size int) {
+	buckets := make([][]string, size)
+	mask := uint64(size - 1)
+	for _, bucket := range t.buckets {
+		for _, key := range bucket {
+			b := scanHash(key) & mask
+			buckets[b] = append(buckets[b], key)
+		}
+	}
+	t.buckets = buckets
+}
+
+// scan returns the keys in the buckets visited from cursor, stopping once
+// at least count keys were collected or count*scanEmptyVisits empty
+// buckets were passed, along with the cursor for the next call, 0 once the
+// iteration is complete. Buckets are visited by incrementing the reversed
+// bits of the cursor. Growing the table splits every bucket into buckets
+// that come later in that order, so as with Redis, every key present for
+// the whole iteration is returned even if the keyspace grows or shrinks
+// between calls, though some may be returned more than once.
+func (t *keyTable) scan(cursor uint64, count int) ([]string, uint64) {
+	if t.count == 0 {
+		return nil, 0
+	}
+	mask := uint64(len(t.buckets) - 1)
+	var page []string
+	for empty := 0; ; {
+		bucket := t.buckets[cursor&mask]
+		if len(bucket) == 0 {
+			empty++
+		}
+		page = append(page, bucket...)
+		cursor |= ^mask
+		cursor = bits.Reverse64(bits.Reverse64(cursor) + 1)
+		if cursor == 0 || len(page) >= count || empty >= count*scanEmptyVisits {
+			return page, cursor
+		}
+	}
+}
+
+// encodeScanReply encodes the two-element reply of the SCAN family.
+func encodeScanReply(cursor uint64, elements []string) string {
+	return encodeArray(
+		encodeBulkString(strconv.FormatUint(cursor, 10)),
+		encodeBulkStringArray(len(elements), elements...),
+	)
+}
+
+// stringMatch reports whether str matches the glob-style pattern, using the
+// same rules as Redis:
+//
+//	?      matches any single character
+//	*      matches any sequence of characters, including none
+//	[abc]  matches one of the listed characters, [^abc] negates the list
+//	       and [a-z] matches a range
+//	\x     matches x literally
+func stringMatch(pattern, str string, nocase bool) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(str); i++ {
+				if stringMatch(pattern[1:], str[i:], nocase) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(str) == 0 {
+				return false
+			}
+			str = str[1:]
+		case '[':
+			if len(str) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			match := false
+			for {
+				if len(pattern) == 0 {
+					// Unterminated class, treat the end as a closing bracket.
+					break
+				}
+				if pattern[0] == ']' {
+					break
+				}
+				if pattern[0] == '\\' && len(pattern) >= 2 {
+					pattern = pattern[1:]
+					if pattern[0] == str[0] {
+						match = true
+					}
+				} else if len(pattern) >= 3 && pattern[1] == '-' {
+					start, end := pattern[0], pattern[2]
+					if start > end {
+						start, end = end, start
+					}
+					c := str[0]
+					if nocase {
+						start, end, c = lower(start), lower(end), lower(c)
+					}
+					if c >= start && c <= end {
+						match = true
+					}
+					pattern = pattern[2:]
+				} else if equalFold(pattern[0], str[0], nocase) {
+					match = true
+				}
+				pattern = pattern[1:]
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			str = str[1:]
+			if len(pattern) == 0 {
+				// The class consumed the rest of the pattern.
+				return len(str) == 0
+			}
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(str) == 0 || !equalFold(pattern[0], str[0], nocase) {
+				return false
+			}
+			str = str[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(str) == 0
+}
+
+func lower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+func equalFold(a, b byte, nocase bool) bool {
+	if nocase {
+		return lower(a) == lower(b)
+	}
+	return a == b
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestStringMatch(t *testing.T) {
+	tests := []struct {
+		pattern, str string
+		nocase       bool
+		want         bool
+	}{
+		{"", "", false, true},
+		{"", "a", false, false},
+		{"*", "", false, true},
+		{"*", "anything", false, true},
+		{"h?llo", "hello", false, true},
+		{"h?llo", "hllo", false, false},
+		{"h*llo", "hllo", false, true},
+		{"h*llo", "heeeello", false, true},
+		{"h**llo", "heello", false, true},
+		{"h*llo", "hellox", false, false},
+		{"*.go", "main.go", false, true},
+		{"*.go", "main.gox", false, false},
+		{"h[ae]llo", "hallo", false, true},
+		{"h[ae]llo", "hillo", false, false},
+		{"h[^e]llo", "hallo", false, true},
+		{"h[^e]llo", "hello", false, false},
+		{"h[a-b]llo", "hbllo", false, true},
+		{"h[b-a]llo", "hbllo", false, true},
+		{"h[a-b]llo", "hcllo", false, false},
+		{"h[\\]]llo", "h]llo", false, true},
+		{"h\\*llo", "h*llo", false, true},
+		{"h\\*llo", "hello", false, false},
+		{"trailing\\", "trailing\\", false, true},
+		{"[abc", "a", false, true},
+		{"[abc", "ab", false, false},
+		{"HELLO", "hello", false, false},
+		{"HELLO", "hello", true, true},
+		{"[A-Z]ey", "key", true, true},
+		{"user:*:name", "user:42:name", false, true},
+		{"user:*:name", "user:42:email", false, false},
+	}
+	for _, tt := range tests {
+		if got := stringMatch(tt.pattern, tt.str, tt.nocase); got != tt.want {
+			t.Errorf("stringMatch(%q, %q, %v) = %v, want %v", tt.pattern, tt.str, tt.nocase, got, tt.want)
+		}
+	}
+}
+
+// scanAll runs a full iteration over table, calling between after each
+// call, and returns how often each key was returned and how many calls
+// were made.
+func scanAll(table *keyTable, count int, between func()) (map[string]int, int) {
+	seen := make(map[string]int)
+	calls := 0
+	for cursor := uint64(0); ; {
+		var page []string
+		page, cursor = table.scan(cursor, count)
+		calls++
+		for _, key := range page {
+			seen[key]++
+		}
+		if cursor == 0 {
+			return seen, calls
+		}
+		between()
+	}
+}
+
+// newKeyTable returns a table holding the keys key:0 to key:n-1.
+func newKeyTable(n int) *keyTable {
+	table := &keyTable{}
+	for i := 0; i < n; i++ {
+		table.add("key:" + strconv.Itoa(i))
+	}
+	return table
+}
+
+func TestKeyTableScan(t *testing.T) {
+	tests := []struct {
+		keys, count int
+	}{
+		{0, 10},
+		{1, 10},
+		{5, 10},
+		{1000, 10},
+		{1000, 1},
+		{1000, 5000},
+	}
+	for _, tt := range tests {
+		seen, calls := scanAll(newKeyTable(tt.keys), tt.count, func() {})
+		if len(seen) != tt.keys {
+			t.Errorf("%d keys, COUNT %d: %d keys returned", tt.keys, tt.count, len(seen))
+		}
+		for key, n := range seen {
+			if n != 1 {
+				t.Errorf("%d keys, COUNT %d: %s returned %d times", tt.keys, tt.count, key, n)
+			}
+		}
+		// Each call returns about count keys, as the table has no more
+		// buckets than keys.
+		if limit := tt.keys/tt.count*2 + 1; calls > limit {
+			t.Errorf("%d keys, COUNT %d: %d calls, want at most %d", tt.keys, tt.count, calls, limit)
+		}
+	}
+}
+
+func TestKeyTableScanWhileChanging(t *testing.T) {
+	const keys = 1000
+	tests := []struct {
+		name   string
+		change func(table *keyTable, call int)
+		kept   int // keys present for the whole iteration
+	}{
+		{"growing", func(table *keyTable, call int) {
+			for i := 0; i < 20; i++ {
+				table.add("new:" + strconv.Itoa(call) + ":" + strconv.Itoa(i))
+			}
+		}, keys},
+		{"shrinking", func(table *keyTable, call int) {
+			for i := 0; i < 20; i++ {
+				if n := keys - 1 - call*20 - i; n >= keys/2 {
+					table.remove("key:" + strconv.Itoa(n))
+				}
+			}
+		}, keys / 2},
+		{"churning", func(table *keyTable, call int) {
+			for i := 0; i < 5; i++ {
+				table.add("new:" + strconv.Itoa(call) + ":" + strconv.Itoa(i))
+			}
+			for i := 0; i < 3; i++ {
+				table.remove("new:" + strconv.Itoa(call) + ":" + strconv.Itoa(i))
+			}
+		}, keys},
+	}
+	for _, tt := range tests {
+		table := newKeyTable(keys)
+		call := 0
+		seen, _ := scanAll(table, 10, func() {
+			tt.change(table, call)
+			call++
+		})
+		for i := 0; i < tt.kept; i++ {
+			if key := "key:" + strconv.Itoa(i); seen[key] == 0 {
+				t.Errorf("%s: %s was never returned", tt.name, key)
+			}
+		}
+	}
+}
+
+func TestKeyTableSize(t *testing.T) {
+	var table keyTable
+	for i := 0; i < 1000; i++ {
+		table.add(strconv.Itoa(i))
+	}
+	if n := len(table.buckets); n != 1024 {
+		t.Errorf("%d buckets for 1000 keys, want 1024", n)
+	}
+	for i := 0; i < 990; i++ {
+		table.remove(strconv.Itoa(i))
+	}
+	if n := len(table.buckets); n > 40 {
+		t.Errorf("%d buckets left for 10 keys", n)
+	}
+	seen, _ := scanAll(&table, 100, func() {})
+	if len(seen) != 10 || table.count != 10 {
+		t.Errorf("scan returned %d keys, count is %d, want 10", len(seen), table.count)
+	}
+}
@@ -0,0 +1,594 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	keyLuaTimeLimit     = "lua-time-limit" // config key for the busy script threshold, in ms
+	defaultLuaTimeLimit = 5 * time.Second
+)
+
+var errBusy = ReplyError{"BUSY", "Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE."}
+
+// scriptEngine runs Lua scripts. Scripts sent with EVAL are cached by the
+// SHA1 digest of their source, so that EVALSHA can run them again.
+type scriptEngine struct {
+	lua       *luaState
+	scripts   map[string]*luaProto
+	functions *functionLibraries
+
+	// mu guards running, which clients waiting for the store read to tell
+	// whether a script is busy, and SCRIPT KILL changes without the store
+	// lock.
+	mu      sync.Mutex
+	running *scriptRun
+}
+
+// scriptRun is a script being run.
+type scriptRun struct {
+	caller   *ClientHandler
+	function bool // run by FCALL rather than EVAL
+	readOnly bool // write commands are refused, as for EVAL_RO
+	start    time.Time
+	limit    time.Duration
+	busy     chan struct{} // closed once the script runs longer than limit
+	isBusy   bool
+	wrote    bool // a write command was called, so it can't be killed
+	killed   bool
+}
+
+// scriptConn collects the replies to the commands a script calls.
+type scriptConn struct {
+	bytes.Buffer
+}
+
+func (*scriptConn) Close() error {
+	return nil
+}
+
+func newScriptEngine() *scriptEngine {
+	e := &scriptEngine{scripts: make(map[string]*luaProto)}
+	e.lua = e.newLuaState("user_script")
+	e.functions = newFunctionLibraries(e)
+	return e
+}
+
+// newLuaState returns an interpreter with the redis library loaded, whose
+// globals scripts can't change.
+func (e *scriptEngine) newLuaState(chunkName string) *luaState {
+	L := newLuaState(chunkName)
+	redis := newLuaTable(0, 32)
+	L.register(redis, "call", func(L *luaState, args []any) []any {
+		return e.redisCall(L, args, true)
+	})
+	L.register(redis, "pcall", func(L *luaState, args []any) []any {
+		return e.redisCall(L, args, false)
+	})
+	L.register(redis, "sha1hex", func(L *luaState, args []any) []any {
+		return []any{sha1Hex(L.checkString(args, 0, "sha1hex"))}
+	})
+	L.register(redis, "error_reply", func(L *luaState, args []any) []any {
+		t := newLuaTable(0, 1)
+		t.set("err", L.checkString(args, 0, "error_reply"))
+		return []any{t}
+	})
+	L.register(redis, "status_reply", func(L *luaState, args []any) []any {
+		t := newLuaTable(0, 1)
+		t.set("ok", L.checkString(args, 0, "status_reply"))
+		return []any{t}
+	})
+	L.register(redis, "log", func(L *luaState, args []any) []any {
+		L.checkInt(args, 0, "log")
+		parts := make([]string, 0, len(args)-1)
+		for i := 1; i < len(args); i++ {
+			parts = append(parts, L.checkString(args, i, "log"))
+		}
+		fmt.Printf("Script log: %s", strings.Join(parts, " "))
+		return nil
+	})
+	L.register(redis, "setresp", func(L *luaState, args []any) []any {
+		if L.checkInt(args, 0, "setresp") != 2 {
+			L.errorf(L.line, "RESP version must be 2")
+		}
+		return nil
+	})
+	// Scripts are always replicated as the commands they run.
+	L.register(redis, "replicate_commands", func(L *luaState, args []any) []any {
+		return []any{true}
+	})
+	L.register(redis, "set_repl", func(L *luaState, args []any) []any {
+		L.checkInt(args, 0, "set_repl")
+		return nil
+	})
+	for i, level := range []string{"LOG_DEBUG", "LOG_VERBOSE", "LOG_NOTICE", "LOG_WARNING"} {
+		redis.set(level, float64(i))
+	}
+	for name, val := range map[string]float64{"REPL_NONE": 0, "REPL_AOF": 1, "REPL_SLAVE": 2, "REPL_REPLICA": 2, "REPL_ALL": 3} {
+		redis.set(name, val)
+	}
+	L.globals.set("redis", redis)
+	L.readOnly = true
+	L.hook = e.check
+	return L
+}
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// load compiles a script and caches it, returning its SHA1 digest.
+func (e *scriptEngine) load(body string) (string, *luaProto, error) {
+	sha := sha1Hex(body)
+	if proto, ok := e.scripts[sha]; ok {
+		return sha, proto, nil
+	}
+	proto, err := luaCompile(body, "user_script")
+	if err != nil {
+		return "", nil, fmt.Errorf("Error compiling script (new function): %v", err)
+	}
+	e.scripts[sha] = proto
+	return sha, proto, nil
+}
+
+// flush forgets the cached scripts and starts over with a fresh
+// interpreter.
+func (e *scriptEngine) flush() {
+	e.scripts = make(map[string]*luaProto)
+	e.lua = e.newLuaState("user_script")
+}
+
+// busy returns a channel that is closed once the running script has been
+// running for too long, or nil if no script is running.
+func (e *scriptEngine) busy() <-chan struct{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.running == nil {
+		return nil
+	}
+	return e.running.busy
+}
+
+// kill stops the running script, or function if function is set, unless
+// it has written to the keyspace, as undoing its writes isn't possible.
+func (e *scriptEngine) kill(function bool) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.running == nil || e.running.function != function {
+		return ReplyError{"NOTBUSY", "No scripts in execution right now."}
+	}
+	if e.running.wrote {
+		return ReplyError{"UNKILLABLE", "Sorry the script already executed write commands against the dataset. You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command."}
+	}
+	e.running.killed = true
+	return nil
+}
+
+// check is called regularly while a script runs. It flags the script as
+// busy once it runs past its time limit, and stops it if it was killed.
+func (e *scriptEngine) check() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	run := e.running
+	if run == nil {
+		return
+	}
+	if !run.isBusy && time.Since(run.start) > run.limit {
+		fmt.Printf("Slow script detected: still in execution after %d milliseconds.", time.Since(run.start).Milliseconds())
+		run.isBusy = true
+		close(run.busy)
+	}
+	if run.killed {
+		command := "SCRIPT"
+		if run.function {
+			command = "FUNCTION"
+		}
+		panic(&luaFatalError{fmt.Errorf("Script killed by user with %s KILL...", command)})
+	}
+}
+
+// busyError returns the error for commands sent while the running script
+// is busy.
+func (e *scriptEngine) busyError() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.running != nil && e.running.function {
+		return ReplyError{"BUSY", "Redis is busy running a script. You can only call FUNCTION KILL or SHUTDOWN NOSAVE."}
+	}
+	return errBusy
+}
+
+// run calls fn with args on behalf of c, and sends its result to c. The
+// store stays locked throughout, so scripts run atomically.
+func (e *scriptEngine) run(c *ClientHandler, L *luaState, fn any, name string, args []any, function, readOnly bool) error {
+	run := &scriptRun{
+		caller:   c,
+		function: function,
+		readOnly: readOnly,
+		start:    time.Now(),
+		limit:    c.Server.scriptTimeLimit(),
+		busy:     make(chan struct{}),
+	}
+	e.mu.Lock()
+	e.running = run
+	e.mu.Unlock()
+	// Replicas are sent the writes of the script rather than the script.
+	c.replicateEffects()
+	defer func() {
+		e.mu.Lock()
+		e.running = nil
+		e.mu.Unlock()
+	}()
+
+	rets, err := L.run(fn, args)
+	if err != nil {
+		var luaErr *luaError
+		if !errors.As(err, &luaErr) {
+			return err
+		}
+		if msg, ok := luaErrorReply(luaErr.value); ok {
+			return parseErrorReply(msg)
+		}
+		return fmt.Errorf("%s script: %s", luaErr.Error(), name)
+	}
+	reply, err := luaToReply(luaFirst(rets))
+	if err != nil {
+		return err
+	}
+	return c.send(reply)
+}
+
+func luaStringArray(strs []string) *luaTable {
+	t := newLuaTable(len(strs), 0)
+	for i, s := range strs {
+		t.set(float64(i+1), s)
+	}
+	return t
+}
+
+// luaErrorReply returns the message of an error reply table, a table
+// with an err field.
+func luaErrorReply(v any) (string, bool) {
+	t, ok := v.(*luaTable)
+	if !ok {
+		return "", false
+	}
+	msg, ok := t.get("err").(string)
+	return msg, ok
+}
+
+// parseErrorReply returns the error for an error reply message that starts
+// with its error code.
+func parseErrorReply(msg string) error {
+	code, rest, found := strings.Cut(msg, " ")
+	if !found {
+		return ReplyError{"ERR", msg}
+	}
+	return ReplyError{code, rest}
+}
+
+// luaToReply converts the value returned by a script into a reply.
+// Numbers are truncated to integers, true becomes 1 and false a null reply,
+// and tables become arrays up to their first nil, unless they are status
+// or error replies. A top level error reply is returned as an error.
+func luaToReply(v any) (string, error) {
+	if msg, ok := luaErrorReply(v); ok {
+		return "", parseErrorReply(msg)
+	}
+	return luaEncodeReply(v, 0), nil
+}
+
+func luaEncodeReply(v any, depth int) string {
+	switch v := v.(type) {
+	case float64:
+		return fmt.Sprintf(fmtInteger, int64(v))
+	case string:
+		return encodeBulkString(v)
+	case bool:
+		if v {
+			return encodeInteger(1)
+		}
+	case *luaTable:
+		if msg, ok := luaErrorReply(v); ok {
+			return fmt.Sprintf(fmtError, strings.NewReplacer("\r", " ", "\n", " ").Replace(msg))
+		}
+		if status, ok := v.get("ok").(string); ok {
+			return encodeSimpleString(status)
+		}
+		if depth > 1000 {
+			return nullResponse
+		}
+		var elements []string
+		for i := 1; ; i++ {
+			item := v.get(float64(i))
+			if item == nil {
+				break
+			}
+			elements = append(elements, luaEncodeReply(item, depth+1))
+		}
+		return encodeArray(elements...)
+	}
+	return nullResponse
+}
+
+// replyToLua converts a command reply into a Lua value. Null replies
+// become false, status and error replies tables with an ok or err field.
+func replyToLua(reply any) any {
+	switch r := reply.(type) {
+	case int64:
+		return float64(r)
+	case string:
+		return r
+	case statusReply:
+		t := newLuaTable(0, 1)
+		t.set("ok", string(r))
+		return t
+	case errorReply:
+		t := newLuaTable(0, 1)
+		t.set("err", string(r))
+		return t
+	case []any:
+		t := newLuaTable(len(r), 0)
+		for i, item := range r {
+			t.set(float64(i+1), replyToLua(item))
+		}
+		return t
+	}
+	return false
+}
+
+// redisCall implements redis.call and redis.pcall. Errors replied by the
+// command are raised by redis.call and returned by redis.pcall.
+func (e *scriptEngine) redisCall(L *luaState, args []any, raise bool) []any {
+	argv := make([]string, len(args))
+	for i, arg := range args {
+		switch arg := arg.(type) {
+		case string:
+			argv[i] = arg
+		case float64:
+			argv[i] = strconv.FormatFloat(arg, 'g', 17, 64)
+		default:
+			L.errorf(L.line, "Lua redis lib command arguments must be strings or integers")
+		}
+	}
+	if e.running == nil {
+		L.errorf(L.line, "redis.call can only be called while running a script or function")
+	}
+	var reply any = errorReply("ERR Please specify at least one argument for this redis lib call")
+	if len(argv) > 0 {
+		reply = e.execute(Command{Command: argv[0], Args: argv[1:]})
+	}
+	val := replyToLua(reply)
+	if _, isErr := reply.(errorReply); isErr && raise {
+		panic(&luaError{val})
+	}
+	return []any{val}
+}
+
+// execute runs a command called by the running script and returns its
+// reply.
+func (e *scriptEngine) execute(cmd Command) any {
+	run := e.running
+	info, ok := lookupCommand(cmd.Command)
+	switch {
+	case !ok:
+		return errorReply("ERR Unknown Redis command called from script")
+	case !info.checkArity(len(cmd.Args) + 1):
+		return errorReply("ERR Wrong number of args calling Redis command from script")
+	case info.flags&cmdNoScript != 0:
+		return errorReply("ERR This Redis command is not allowed from script")
+	case info.flags&cmdWrite != 0 && run.readOnly:
+		return errorReply("ERR Write commands are not allowed from read-only scripts.")
+	}
+	if info.flags&cmdWrite != 0 {
+		e.mu.Lock()
+		run.wrote = true
+		e.mu.Unlock()
+	}
+
+	// The command runs as a client of its own, which never blocks, like
+	// commands in a transaction.
+	conn := &scriptConn{}
+	client := &ClientHandler{
+		Context: run.caller.Context,
+		Conn:    conn,
+		Server:  run.caller.Server,
+		Store:   run.caller.Store,
+		tx:      transaction{executing: true},
+	}
+	if err := client.call(cmd); err != nil {
+		msg := strings.TrimSuffix(encodeError(err), "\r\n")
+		return errorReply(msg[1:])
+	}
+	reply, err := readReply(bufio.NewReader(conn))
+	if err != nil {
+		return errorReply("ERR " + err.Error())
+	}
+	return reply
+}
+
+// scriptTimeLimit returns how long a script may run before other clients
+// are told it is busy.
+func (s *Server) scriptTimeLimit() time.Duration {
+	if val, err := s.Config.Get(keyLuaTimeLimit); err == nil {
+		if ms, err := strconv.Atoi(val); err == nil && ms > 0 {
+			return time.Duration(ms) * time.Millisecond
+		}
+	}
+	return defaultLuaTimeLimit
+}
+
+// lockStore locks the store to run cmd. If a script keeps the store
+// locked for longer than its time limit, cmd is answered without the lock
+// instead, which only SCRIPT KILL gets done, and false is returned.
+func (c *ClientHandler) lockStore(cmd Command) bool {
+	if c.Store.mu.TryLock() {
+		return true
+	}
+	locked := make(chan struct{})
+	go func() {
+		c.Store.mu.Lock()
+		close(locked)
+	}()
+	// A script may start after we began waiting, so the busy channel is
+	// looked up again now and then.
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-locked:
+			return true
+		case <-c.Server.scripts.busy():
+			select {
+			case <-locked:
+				return true
+			default:
+			}
+			go func() {
+				<-locked
+				c.Store.mu.Unlock()
+			}()
+			c.handleBusy(cmd)
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleBusy answers cmd while a script is busy.
+func (c *ClientHandler) handleBusy(cmd Command) {
+	e := c.Server.scripts
+	var err error
+	switch {
+	case isKill(cmd, "SCRIPT"):
+		err = e.kill(false)
+	case isKill(cmd, "FUNCTION"):
+		err = e.kill(true)
+	case isShutdownNoSave(cmd):
+		// The script holds the store, so there is no saving it.
+		c.Server.shutdown()
+		return
+	default:
+		err = e.busyError()
+	}
+	if err != nil {
+		c.send(encodeError(err))
+		return
+	}
+	c.send(okResponse)
+}
+
+// isKill reports whether cmd is SCRIPT KILL or FUNCTION KILL, as named by
+// command.
+func isKill(cmd Command, command string) bool {
+	return strings.EqualFold(cmd.Command, command) && len(cmd.Args) == 1 && strings.EqualFold(cmd.Args[0], "KILL")
+}
+
+// isShutdownNoSave reports whether cmd is SHUTDOWN NOSAVE, the only way
+// to stop a busy script that has written to the keyspace.
+func isShutdownNoSave(cmd Command) bool {
+	return strings.EqualFold(cmd.Command, "SHUTDOWN") && len(cmd.Args) == 1 && strings.EqualFold(cmd.Args[0], "NOSAVE")
+}
+
+// parseNumKeys returns the number of keys given to EVAL or FCALL, which
+// follows the script or function name.
+func parseNumKeys(args []string) (int, error) {
+	if len(args) < 2 {
+		return 0, fmt.Errorf("insufficient number of arguments")
+	}
+	numKeys, err := strconv.Atoi(args[1])
+	if err != nil {
+		return 0, errNotInteger
+	}
+	if numKeys < 0 {
+		return 0, fmt.Errorf("Number of keys can't be negative")
+	}
+	if numKeys > len(args)-2 {
+		return 0, fmt.Errorf("Number of keys can't be greater than number of args")
+	}
+	return numKeys, nil
+}
+
+// handleEval handles EVAL, EVALSHA and their read-only variants.
+func (c *ClientHandler) handleEval(args []string, bySHA, readOnly bool) error {
+	numKeys, err := parseNumKeys(args)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("EVAL command received.")
+
+	e := c.Server.scripts
+	var sha string
+	var proto *luaProto
+	if bySHA {
+		sha = strings.ToLower(args[0])
+		if proto = e.scripts[sha]; proto == nil {
+			return ReplyError{"NOSCRIPT", "No matching script. Please use EVAL."}
+		}
+	} else if sha, proto, err = e.load(args[0]); err != nil {
+		return err
+	}
+	e.lua.globals.set("KEYS", luaStringArray(args[2:2+numKeys]))
+	e.lua.globals.set("ARGV", luaStringArray(args[2+numKeys:]))
+	return e.run(c, e.lua, &luaClosure{proto: proto}, sha, nil, false, readOnly)
+}
+
+// handleScript handles SCRIPT commands.
+func (c *ClientHandler) handleScript(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("insufficient number of arguments for SCRIPT")
+	}
+	e := c.Server.scripts
+	subCmd := strings.ToUpper(args[0])
+	fmt.Printf("SCRIPT %s command received.", subCmd)
+	switch subCmd {
+	case "LOAD":
+		if len(args) != 2 {
+			return fmt.Errorf("wrong number of arguments for SCRIPT LOAD")
+		}
+		sha, _, err := e.load(args[1])
+		if err != nil {
+			return err
+		}
+		return c.send(encodeBulkString(sha))
+	case "EXISTS":
+		if len(args) < 2 {
+			return fmt.Errorf("wrong number of arguments for SCRIPT EXISTS")
+		}
+		replies := make([]string, len(args)-1)
+		for i, sha := range args[1:] {
+			exists := 0
+			if _, ok := e.scripts[strings.ToLower(sha)]; ok {
+				exists = 1
+			}
+			replies[i] = encodeInteger(exists)
+		}
+		return c.send(encodeArray(replies...))
+	case "FLUSH":
+		if len(args) > 2 || (len(args) == 2 && !strings.EqualFold(args[1], "ASYNC") && !strings.EqualFold(args[1], "SYNC")) {
+			return errSyntax
+		}
+		e.flush()
+		return c.send(okResponse)
+	case "KILL":
+		if len(args) != 1 {
+			return fmt.Errorf("wrong number of arguments for SCRIPT KILL")
+		}
+		// The store is locked, so no script is running.
+		if err := e.kill(false); err != nil {
+			return err
+		}
+		return c.send(okResponse)
+	}
+	return fmt.Errorf("unknown subcommand %q for SCRIPT", args[0])
+}
@@ -0,0 +1,1154 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// rdbAuxSearchIndex is the RDB aux field that holds the FT.CREATE
+// arguments of an index. The indexed documents are rebuilt from the keys
+// when the snapshot is loaded.
+const rdbAuxSearchIndex = "search-index"
+
+const searchDefaultLimit = 10
+
+// searchDefaultStopwords are left out of text fields and queries.
+var searchDefaultStopwords = []string{
+	"a", "is", "the", "an", "and", "are", "as", "at", "be", "but", "by", "for", "if", "in", "into",
+	"it", "no", "not", "of", "on", "or", "such", "that", "their", "then", "there", "these", "they",
+	"this", "to", "was", "will", "with",
+}
+
+type searchFieldType string
+
+const (
+	searchText    searchFieldType = "TEXT"
+	searchTag     searchFieldType = "TAG"
+	searchNumeric searchFieldType = "NUMERIC"
+	searchVector  searchFieldType = "VECTOR"
+)
+
+// searchField is an attribute of an index. identifier is the hash field it
+// reads and name is the alias queries refer to it by.
+type searchField struct {
+	identifier, name string
+	kind             searchFieldType
+	weight           float64
+	separator        string
+	caseSensitive    bool
+	sortable         bool
+	noIndex          bool
+	vector           *vectorParams
+}
+
+// searchDoc is the indexed form of one hash.
+type searchDoc struct {
+	key     string
+	id      uint64
+	tokens  map[string][]string // text field name to its terms, in order
+	tags    map[string][]string
+	numbers map[string]float64
+	vectors map[string][]float32
+}
+
+// SearchIndex indexes the hashes whose keys start with one of its
+// prefixes. Text fields go into an inverted index from terms to documents;
+// tag and numeric values are kept per document, and vectors in a vector
+// index per field.
+type SearchIndex struct {
+	name      string
+	args      []string // FT.CREATE arguments after the name
+	prefixes  []string
+	fields    []*searchField
+	stopwords map[string]bool
+	docs      map[string]*searchDoc
+	nextID    uint64
+	terms     map[string]map[string]map[string]int // field, term, key: frequency
+	vectors   map[string]vectorIndex
+	failures  int
+}
+
+// parseSearchIndex parses the arguments of FT.CREATE after the index name.
+func parseSearchIndex(name string, args []string) (*SearchIndex, error) {
+	idx := &SearchIndex{
+		name:    name,
+		args:    args,
+		docs:    make(map[string]*searchDoc),
+		terms:   make(map[string]map[string]map[string]int),
+		vectors: make(map[string]vectorIndex),
+	}
+	stopwords := searchDefaultStopwords
+	i := 0
+	for ; i < len(args) && !strings.EqualFold(args[i], "SCHEMA"); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "ON":
+			if i+1 >= len(args) {
+				return nil, errSyntax
+			}
+			if !strings.EqualFold(args[i+1], "HASH") {
+				return nil, fmt.Errorf("Invalid index type: only HASH indexes are supported")
+			}
+			i++
+		case "PREFIX", "STOPWORDS":
+			if i+1 >= len(args) {
+				return nil, errSyntax
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 0 || i+1+n >= len(args) {
+				return nil, fmt.Errorf("Bad arguments for %s: invalid count", strings.ToUpper(args[i]))
+			}
+			values := args[i+2 : i+2+n]
+			if strings.EqualFold(args[i], "PREFIX") {
+				idx.prefixes = append(idx.prefixes, values...)
+			} else {
+				stopwords = values
+			}
+			i += 1 + n
+		default:
+			return nil, fmt.Errorf("Unknown argument `%s`", args[i])
+		}
+	}
+	if len(idx.prefixes) == 0 {
+		idx.prefixes = []string{""}
+	}
+	idx.stopwords = make(map[string]bool, len(stopwords))
+	for _, w := range stopwords {
+		idx.stopwords[strings.ToLower(w)] = true
+	}
+
+	schema := args[min(i+1, len(args)):]
+	if i >= len(args) || len(schema) == 0 {
+		return nil, fmt.Errorf("Fields arguments are missing")
+	}
+	for j := 0; j < len(schema); {
+		f := &searchField{identifier: schema[j], name: schema[j], weight: 1, separator: ","}
+		j++
+		if j+1 < len(schema) && strings.EqualFold(schema[j], "AS") {
+			f.name = schema[j+1]
+			j += 2
+		}
+		if j >= len(schema) {
+			return nil, fmt.Errorf("Field `%s` has no type", f.name)
+		}
+		f.kind = searchFieldType(strings.ToUpper(schema[j]))
+		switch f.kind {
+		case searchText, searchTag, searchNumeric:
+			j++
+		case searchVector:
+			var err error
+			if f.vector, j, err = parseVectorParams(schema, j+1); err != nil {
+				return nil, err
+			}
+			idx.vectors[f.name] = newVectorIndex(f.vector)
+		default:
+			return nil, fmt.Errorf("Invalid field type for field `%s`", f.name)
+		}
+	options:
+		for j < len(schema) {
+			switch opt := strings.ToUpper(schema[j]); {
+			case opt == "SORTABLE":
+				f.sortable = true
+			case opt == "NOINDEX":
+				f.noIndex = true
+			case opt == "NOSTEM" && f.kind == searchText:
+			case opt == "CASESENSITIVE" && f.kind == searchTag:
+				f.caseSensitive = true
+			case opt == "WEIGHT" && f.kind == searchText && j+1 < len(schema):
+				weight, err := strconv.ParseFloat(schema[j+1], 64)
+				if err != nil || weight < 0 {
+					return nil, fmt.Errorf("Bad arguments for WEIGHT: Could not convert argument to expected type")
+				}
+				f.weight = weight
+				j++
+			case opt == "SEPARATOR" && f.kind == searchTag && j+1 < len(schema):
+				if len(schema[j+1]) != 1 {
+					return nil, fmt.Errorf("Tag separator must be a single character")
+				}
+				f.separator = schema[j+1]
+				j++
+			default:
+				break options
+			}
+			j++
+		}
+		if idx.field(f.name) != nil {
+			return nil, fmt.Errorf("Duplicate field in schema - %s", f.name)
+		}
+		idx.fields = append(idx.fields, f)
+	}
+	return idx, nil
+}
+
+// field returns the attribute called name, or nil.
+func (idx *SearchIndex) field(name string) *searchField {
+	for _, f := range idx.fields {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// covers reports whether key belongs in the index.
+func (idx *SearchIndex) covers(key string) bool {
+	return slices.ContainsFunc(idx.prefixes, func(p string) bool { return strings.HasPrefix(key, p) })
+}
+
+// tokenize splits text into lower case terms, leaving out stopwords.
+func (idx *SearchIndex) tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+	terms := words[:0]
+	for _, w := range words {
+		if !idx.stopwords[w] {
+			terms = append(terms, w)
+		}
+	}
+	return terms
+}
+
+// splitTags splits a tag field value into its tags.
+func (f *searchField) splitTags(val string) []string {
+	tags := []string{}
+	for _, tag := range strings.Split(val, f.separator) {
+		tag = strings.TrimSpace(tag)
+		if !f.caseSensitive {
+			tag = strings.ToLower(tag)
+		}
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// add indexes the hash at key, replacing any earlier version. A hash with
+// a numeric field that is not a number is counted as a failure and left
+// out of the index.
+func (idx *SearchIndex) add(key string, h *Hash) {
+	idx.remove(key)
+	doc := &searchDoc{
+		key:     key,
+		tokens:  make(map[string][]string),
+		tags:    make(map[string][]string),
+		numbers: make(map[string]float64),
+		vectors: make(map[string][]float32),
+	}
+	for _, f := range idx.fields {
+		val, ok := h.Get(f.identifier)
+		if !ok {
+			continue
+		}
+		switch f.kind {
+		case searchText:
+			doc.tokens[f.name] = idx.tokenize(val)
+		case searchTag:
+			doc.tags[f.name] = f.splitTags(val)
+		case searchNumeric:
+			num, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+			if err != nil || math.IsNaN(num) {
+				idx.failures++
+				return
+			}
+			doc.numbers[f.name] = num
+		case searchVector:
+			vec, ok := f.vector.parseVector(val)
+			if !ok {
+				idx.failures++
+				return
+			}
+			doc.vectors[f.name] = vec
+		}
+	}
+
+	idx.nextID++
+	doc.id = idx.nextID
+	idx.docs[key] = doc
+	for field, vec := range doc.vectors {
+		idx.vectors[field].add(key, vec)
+	}
+	for field, tokens := range doc.tokens {
+		if idx.field(field).noIndex {
+			continue
+		}
+		if idx.terms[field] == nil {
+			idx.terms[field] = make(map[string]map[string]int)
+		}
+		for _, term := range tokens {
+			if idx.terms[field][term] == nil {
+				idx.terms[field][term] = make(map[string]int)
+			}
+			idx.terms[field][term][key]++
+		}
+	}
+}
+
+// remove drops key from the index.
+func (idx *SearchIndex) remove(key string) {
+	doc, ok := idx.docs[key]
+	if !ok {
+		return
+	}
+	delete(idx.docs, key)
+	for field := range doc.vectors {
+		idx.vectors[field].remove(key)
+	}
+	for field, tokens := range doc.tokens {
+		for _, term := range tokens {
+			postings := idx.terms[field][term]
+			delete(postings, key)
+			if len(postings) == 0 {
+				delete(idx.terms[field], term)
+			}
+		}
+	}
+}
+
+// build indexes every hash in the keyspace that the index covers.
+func (idx *SearchIndex) build(s *Store) {
+	for key := range s.kv {
+		if !idx.covers(key) {
+			continue
+		}
+		if h, err := s.hash(key, false); err == nil && h != nil {
+			idx.add(key, h)
+		}
+	}
+}
+
+// numTerms returns the number of distinct terms in the index.
+func (idx *SearchIndex) numTerms() int {
+	terms := map[string]bool{}
+	for _, postings := range idx.terms {
+		for term := range postings {
+			terms[term] = true
+		}
+	}
+	return len(terms)
+}
+
+// indexKey brings the indexes covering key up to date after the hash
+// stored there changed.
+func (s *Store) indexKey(key string) {
+	for _, idx := range s.indexes {
+		if !idx.covers(key) {
+			continue
+		}
+		if h, ok := s.kv[key].(*Hash); ok {
+			idx.add(key, h)
+		} else {
+			idx.remove(key)
+		}
+	}
+}
+
+// unindexKey removes key from every index.
+func (s *Store) unindexKey(key string) {
+	for _, idx := range s.indexes {
+		idx.remove(key)
+	}
+}
+
+// loadSearchIndex recreates an index from its RDB aux field. The index is
+// filled once every key has been loaded.
+func (s *Store) loadSearchIndex(def string) error {
+	cmd, err := readCommand(bufio.NewReader(strings.NewReader(def)))
+	if err != nil {
+		return err
+	}
+	idx, err := parseSearchIndex(cmd.Command, cmd.Args)
+	if err != nil {
+		return err
+	}
+	s.indexes[idx.name] = idx
+	return nil
+}
+
+// searchIndex returns the index called name.
+func (s *Store) searchIndex(name string) (*SearchIndex, error) {
+	idx, ok := s.indexes[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: no such index", name)
+	}
+	return idx, nil
+}
+
+// searchResult is a matching document and its score. Results of KNN
+// queries also carry their distance, returned as the field scoreName.
+type searchResult struct {
+	doc       *searchDoc
+	hash      *Hash
+	score     float64
+	scoreName string
+	distance  float64
+}
+
+// get returns a field of the result.
+func (r searchResult) get(name string) (string, bool) {
+	if r.scoreName != "" && name == r.scoreName {
+		return formatFloat(r.distance), true
+	}
+	return r.hash.Get(name)
+}
+
+// runQuery returns the live documents matching query, best first, or
+// closest first for KNN queries. Keys that expired or no longer hold a hash
+// are dropped from the index on the way.
+func (s *Store) runQuery(idx *SearchIndex, query string, params map[string]string) ([]searchResult, error) {
+	q, err := parseSearchQuery(idx, query, params)
+	if err != nil {
+		return nil, err
+	}
+	matched := q.eval(idx)
+	if q.knn != nil {
+		var filter docSet
+		if _, all := q.root.(queryAll); !all {
+			filter = matched
+		}
+		hits := idx.vectors[q.knn.field.name].knn(q.knn.vec, q.knn.k, filter, q.knn.ef)
+		results := make([]searchResult, 0, len(hits))
+		for _, hit := range hits {
+			if h, err := s.hash(hit.key, false); err == nil && h != nil && idx.docs[hit.key] != nil {
+				results = append(results, searchResult{idx.docs[hit.key], h, 0, q.knn.scoreName, hit.dist})
+			}
+		}
+		return results, nil
+	}
+	results := make([]searchResult, 0, len(matched))
+	for key := range matched {
+		doc := idx.docs[key]
+		h, err := s.hash(key, false)
+		if err != nil || h == nil {
+			idx.remove(key)
+			continue
+		}
+		if idx.docs[key] != doc {
+			// Expired fields changed the document.
+			if doc = idx.docs[key]; doc == nil || !q.eval(idx).has(key) {
+				continue
+			}
+		}
+		results = append(results, searchResult{doc: doc, hash: h, score: q.score(idx, doc)})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		return results[i].doc.id < results[j].doc.id
+	})
+	return results, nil
+}
+
+// sortValue returns the value of a field for sorting, which is a number
+// for numeric fields.
+func (r searchResult) sortValue(idx *SearchIndex, name string) (string, float64, bool) {
+	if r.scoreName != "" && name == r.scoreName {
+		return "", r.distance, true
+	}
+	f := idx.field(name)
+	if f == nil {
+		val, ok := r.hash.Get(name)
+		return val, 0, ok
+	}
+	if f.kind == searchNumeric {
+		num, ok := r.doc.numbers[f.name]
+		return "", num, ok
+	}
+	val, ok := r.hash.Get(f.identifier)
+	return strings.ToLower(val), 0, ok
+}
+
+// parseSearchParams parses the PARAMS option at args[i].
+func parseSearchParams(args []string, i int) (map[string]string, int, error) {
+	if i+1 >= len(args) {
+		return nil, 0, errSyntax
+	}
+	n, err := strconv.Atoi(args[i+1])
+	if err != nil || n < 0 || n%2 != 0 || i+1+n >= len(args) {
+		return nil, 0, fmt.Errorf("Bad arguments for PARAMS: Expected an even number of arguments")
+	}
+	params := make(map[string]string, n/2)
+	for j := i + 2; j < i+2+n; j += 2 {
+		params[args[j]] = args[j+1]
+	}
+	return params, i + 1 + n, nil
+}
+
+// handleFTCreate handles FT.CREATE commands.
+func (c *ClientHandler) handleFTCreate(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("insufficient number of arguments for FT.CREATE")
+	}
+	name := args[0]
+	if _, ok := c.Store.indexes[name]; ok {
+		return fmt.Errorf("Index already exists")
+	}
+	idx, err := parseSearchIndex(name, args[1:])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("FT.CREATE %s command received.", name)
+
+	idx.build(c.Store)
+	c.Store.indexes[name] = idx
+	return c.send(okResponse)
+}
+
+// handleFTDropIndex handles FT.DROPINDEX commands. With DD the indexed
+// hashes are deleted too.
+func (c *ClientHandler) handleFTDropIndex(args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return fmt.Errorf("wrong number of arguments for FT.DROPINDEX")
+	}
+	if len(args) == 2 && !strings.EqualFold(args[1], "DD") {
+		return errSyntax
+	}
+	idx, ok := c.Store.indexes[args[0]]
+	if !ok {
+		return fmt.Errorf("Unknown Index name")
+	}
+	fmt.Printf("FT.DROPINDEX %s command received.", args[0])
+
+	delete(c.Store.indexes, args[0])
+	if len(args) == 2 {
+		for key := range idx.docs {
+			c.Store.remove(key)
+			c.Store.notify(notifyGeneric, "del", key)
+		}
+	}
+	return c.send(okResponse)
+}
+
+// handleFTList handles FT._LIST commands.
+func (c *ClientHandler) handleFTList(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("wrong number of arguments for FT._LIST")
+	}
+	names := make([]string, 0, len(c.Store.indexes))
+	for name := range c.Store.indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return c.send(encodeBulkStringArray(len(names), names...))
+}
+
+// handleFTInfo handles FT.INFO commands.
+func (c *ClientHandler) handleFTInfo(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("wrong number of arguments for FT.INFO")
+	}
+	idx, ok := c.Store.indexes[args[0]]
+	if !ok {
+		return fmt.Errorf("Unknown index name")
+	}
+	attrs := make([]string, 0, len(idx.fields))
+	for _, f := range idx.fields {
+		attr := []string{"identifier", f.identifier, "attribute", f.name, "type", string(f.kind)}
+		switch f.kind {
+		case searchText:
+			attr = append(attr, "WEIGHT", formatFloat(f.weight))
+		case searchTag:
+			attr = append(attr, "SEPARATOR", f.separator)
+			if f.caseSensitive {
+				attr = append(attr, "CASESENSITIVE")
+			}
+		}
+		if f.sortable {
+			attr = append(attr, "SORTABLE")
+		}
+		if f.noIndex {
+			attr = append(attr, "NOINDEX")
+		}
+		if v := f.vector; v != nil {
+			attr = append(attr, "algorithm", v.algorithm, "data_type", "FLOAT32",
+				"dim", strconv.Itoa(v.dim), "distance_metric", v.metric)
+			if v.algorithm == vectorHNSW {
+				attr = append(attr, "M", strconv.Itoa(v.m), "ef_construction", strconv.Itoa(v.efConstruction),
+					"ef_runtime", strconv.Itoa(v.efRuntime))
+			}
+		}
+		attrs = append(attrs, encodeBulkStringArray(len(attr), attr...))
+	}
+	records := 0
+	for _, doc := range idx.docs {
+		for _, tokens := range doc.tokens {
+			records += len(tokens)
+		}
+	}
+	definition := encodeArray(
+		encodeBulkString("key_type"), encodeBulkString("HASH"),
+		encodeBulkString("prefixes"), encodeBulkStringArray(len(idx.prefixes), idx.prefixes...),
+		encodeBulkString("default_score"), encodeBulkString("1"),
+	)
+	return c.send(encodeArray(
+		encodeBulkString("index_name"), encodeBulkString(idx.name),
+		encodeBulkString("index_options"), encodeArray(),
+		encodeBulkString("index_definition"), definition,
+		encodeBulkString("attributes"), encodeArray(attrs...),
+		encodeBulkString("num_docs"), encodeInteger(len(idx.docs)),
+		encodeBulkString("max_doc_id"), encodeInteger(int(idx.nextID)),
+		encodeBulkString("num_terms"), encodeInteger(idx.numTerms()),
+		encodeBulkString("num_records"), encodeInteger(records),
+		encodeBulkString("hash_indexing_failures"), encodeInteger(idx.failures),
+		encodeBulkString("indexing"), encodeInteger(0),
+		encodeBulkString("percent_indexed"), encodeBulkString("1"),
+	))
+}
+
+// handleFTSearch handles FT.SEARCH commands.
+func (c *ClientHandler) handleFTSearch(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("insufficient number of arguments for FT.SEARCH")
+	}
+	idx, err := c.Store.searchIndex(args[0])
+	if err != nil {
+		return err
+	}
+	var (
+		noContent, withScores, desc bool
+		returnFields, returnNames   []string
+		sortBy                      string
+		offset, limit               = 0, searchDefaultLimit
+		params                      map[string]string
+		filters                     []*queryNumeric
+	)
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NOCONTENT":
+			noContent = true
+		case "WITHSCORES":
+			withScores = true
+		case "VERBATIM", "NOSTOPWORDS":
+		case "RETURN":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 0 || i+1+n >= len(args) {
+				return fmt.Errorf("Bad arguments for RETURN: invalid count")
+			}
+			returnFields, returnNames = []string{}, []string{}
+			for j := i + 2; j < i+2+n; j++ {
+				field, name := args[j], args[j]
+				if j+2 < i+2+n && strings.EqualFold(args[j+1], "AS") {
+					name = args[j+2]
+					j += 2
+				}
+				returnFields, returnNames = append(returnFields, field), append(returnNames, name)
+			}
+			noContent = n == 0
+			i += 1 + n
+		case "SORTBY":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			sortBy = strings.TrimPrefix(args[i+1], "@")
+			i++
+			if i+1 < len(args) && (strings.EqualFold(args[i+1], "ASC") || strings.EqualFold(args[i+1], "DESC")) {
+				desc = strings.EqualFold(args[i+1], "DESC")
+				i++
+			}
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return errSyntax
+			}
+			offset, err = strconv.Atoi(args[i+1])
+			if err == nil {
+				limit, err = strconv.Atoi(args[i+2])
+			}
+			if err != nil || offset < 0 || limit < 0 {
+				return fmt.Errorf("Bad arguments for LIMIT: Value is not an integer or out of range")
+			}
+			i += 2
+		case "PARAMS":
+			if params, i, err = parseSearchParams(args, i); err != nil {
+				return err
+			}
+		case "DIALECT":
+			i++
+		case "FILTER":
+			if i+3 >= len(args) {
+				return errSyntax
+			}
+			f, err := parseNumericRange(idx, args[i+1], args[i+2], args[i+3])
+			if err != nil {
+				return err
+			}
+			filters = append(filters, f)
+			i += 3
+		default:
+			return errSyntax
+		}
+	}
+	fmt.Printf("FT.SEARCH %s command received.", idx.name)
+
+	results, err := c.Store.runQuery(idx, args[1], params)
+	if err != nil {
+		return err
+	}
+	results = slices.DeleteFunc(results, func(r searchResult) bool {
+		return slices.ContainsFunc(filters, func(f *queryNumeric) bool { return !f.matches(r.doc) })
+	})
+	if sortBy != "" {
+		if f := idx.field(sortBy); f == nil && !slices.ContainsFunc(results, func(r searchResult) bool { return r.scoreName == sortBy }) {
+			return fmt.Errorf("Property `%s` not loaded nor in schema", sortBy)
+		}
+		slices.SortStableFunc(results, func(a, b searchResult) int {
+			cmp := compareSearchValues(idx, a, b, sortBy)
+			if desc {
+				return -cmp
+			}
+			return cmp
+		})
+	}
+
+	reply := []string{encodeInteger(len(results))}
+	for _, r := range results[min(offset, len(results)):min(offset+limit, len(results))] {
+		reply = append(reply, encodeBulkString(r.doc.key))
+		if withScores {
+			reply = append(reply, encodeBulkString(formatFloat(r.score)))
+		}
+		if noContent {
+			continue
+		}
+		fields := []string{}
+		if returnFields == nil {
+			if r.scoreName != "" {
+				fields = append(fields, r.scoreName, formatFloat(r.distance))
+			}
+			names := make([]string, 0, r.hash.Len())
+			for field := range r.hash.fields {
+				names = append(names, field)
+			}
+			sort.Strings(names)
+			for _, field := range names {
+				fields = append(fields, field, r.hash.fields[field])
+			}
+		} else {
+			for i, field := range returnFields {
+				if f := idx.field(field); f != nil {
+					field = f.identifier
+				}
+				if val, ok := r.get(field); ok {
+					fields = append(fields, returnNames[i], val)
+				}
+			}
+		}
+		reply = append(reply, encodeBulkStringArray(len(fields), fields...))
+	}
+	return c.send(encodeArray(reply...))
+}
+
+// compareSearchValues orders two results by a field, with missing values
+// last.
+func compareSearchValues(idx *SearchIndex, a, b searchResult, name string) int {
+	as, an, aok := a.sortValue(idx, name)
+	bs, bn, bok := b.sortValue(idx, name)
+	switch {
+	case !aok || !bok:
+		if aok == bok {
+			return 0
+		}
+		if aok {
+			return -1
+		}
+		return 1
+	case an < bn:
+		return -1
+	case an > bn:
+		return 1
+	}
+	return strings.Compare(as, bs)
+}
+
+// aggregateRow is a row of the FT.AGGREGATE pipeline. Rows start out as a
+// matching document and become plain values once grouped.
+type aggregateRow struct {
+	result *searchResult
+	names  []string
+	values map[string]any // string, or []string for TOLIST
+}
+
+// get returns a property of the row, falling back to the document's hash.
+func (r *aggregateRow) get(idx *SearchIndex, name string) (string, bool) {
+	if val, ok := r.values[name]; ok {
+		str, ok := val.(string)
+		return str, ok
+	}
+	if r.result == nil {
+		return "", false
+	}
+	if f := idx.field(name); f != nil {
+		name = f.identifier
+	}
+	return r.result.get(name)
+}
+
+func (r *aggregateRow) set(name string, val any) {
+	if _, ok := r.values[name]; !ok {
+		r.names = append(r.names, name)
+	}
+	r.values[name] = val
+}
+
+// aggregateReducer is a REDUCE clause of a GROUPBY step.
+type aggregateReducer struct {
+	fn, arg, name string
+}
+
+// reduce computes the reducer over the rows of a group.
+func (red aggregateReducer) reduce(idx *SearchIndex, rows []*aggregateRow) any {
+	if red.fn == "COUNT" {
+		return strconv.Itoa(len(rows))
+	}
+	values := []string{}
+	for _, row := range rows {
+		if val, ok := row.get(idx, red.arg); ok {
+			values = append(values, val)
+		}
+	}
+	switch red.fn {
+	case "COUNT_DISTINCT":
+		return strconv.Itoa(len(uniqueStrings(values)))
+	case "TOLIST":
+		return uniqueStrings(values)
+	case "FIRST_VALUE":
+		if len(values) == 0 {
+			return nil
+		}
+		return values[0]
+	}
+	nums := []float64{}
+	for _, val := range values {
+		if num, err := strconv.ParseFloat(val, 64); err == nil {
+			nums = append(nums, num)
+		}
+	}
+	var result float64
+	switch red.fn {
+	case "SUM":
+		for _, num := range nums {
+			result += num
+		}
+	case "MIN":
+		result = math.Inf(1)
+		for _, num := range nums {
+			result = min(result, num)
+		}
+	case "MAX":
+		result = math.Inf(-1)
+		for _, num := range nums {
+			result = max(result, num)
+		}
+	case "AVG":
+		if len(nums) == 0 {
+			return "nan"
+		}
+		for _, num := range nums {
+			result += num
+		}
+		result /= float64(len(nums))
+	case "STDDEV":
+		if len(nums) < 2 {
+			return "0"
+		}
+		result = math.Sqrt(tsAggregate("var.s", nums))
+	}
+	return formatFloat(result)
+}
+
+func uniqueStrings(values []string) []string {
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, val := range values {
+		if !seen[val] {
+			seen[val] = true
+			unique = append(unique, val)
+		}
+	}
+	return unique
+}
+
+// parseAggregateGroupBy parses "GROUPBY nargs @property... REDUCE ..." at
+// args[i] and returns the position of its last argument.
+func parseAggregateGroupBy(args []string, i int) ([]string, []aggregateReducer, int, error) {
+	if i+1 >= len(args) {
+		return nil, nil, 0, errSyntax
+	}
+	n, err := strconv.Atoi(args[i+1])
+	if err != nil || n < 0 || i+1+n >= len(args) {
+		return nil, nil, 0, fmt.Errorf("Bad arguments for GROUPBY: invalid count")
+	}
+	props := make([]string, n)
+	for j, prop := range args[i+2 : i+2+n] {
+		if !strings.HasPrefix(prop, "@") {
+			return nil, nil, 0, fmt.Errorf("Bad arguments for GROUPBY: Unknown property `%s`. Did you mean `@%s`?", prop, prop)
+		}
+		props[j] = prop[1:]
+	}
+	i += 1 + n
+	reducers := []aggregateReducer{}
+	for i+1 < len(args) && strings.EqualFold(args[i+1], "REDUCE") {
+		if i+3 >= len(args) {
+			return nil, nil, 0, errSyntax
+		}
+		red := aggregateReducer{fn: strings.ToUpper(args[i+2])}
+		nargs, err := strconv.Atoi(args[i+3])
+		if err != nil || nargs < 0 || i+3+nargs >= len(args) {
+			return nil, nil, 0, fmt.Errorf("Bad arguments for REDUCE: invalid count")
+		}
+		switch red.fn {
+		case "COUNT":
+			if nargs != 0 {
+				return nil, nil, 0, fmt.Errorf("Count accepts 0 values only")
+			}
+		case "COUNT_DISTINCT", "SUM", "MIN", "MAX", "AVG", "STDDEV", "TOLIST", "FIRST_VALUE":
+			if nargs != 1 {
+				return nil, nil, 0, fmt.Errorf("Bad arguments for %s: expected one property", red.fn)
+			}
+			red.arg = strings.TrimPrefix(args[i+4], "@")
+		default:
+			return nil, nil, 0, fmt.Errorf("No such reducer `%s`", args[i+2])
+		}
+		i += 3 + nargs
+		red.name = "__generated_alias" + strings.ToLower(red.fn) + strings.ToLower(red.arg)
+		if i+2 < len(args) && strings.EqualFold(args[i+1], "AS") {
+			red.name = args[i+2]
+			i += 2
+		}
+		reducers = append(reducers, red)
+	}
+	return props, reducers, i, nil
+}
+
+// groupRows groups rows by the values of props and reduces each group.
+func groupRows(idx *SearchIndex, rows []*aggregateRow, props []string, reducers []aggregateReducer) []*aggregateRow {
+	groups := map[string][]*aggregateRow{}
+	order := []string{}
+	for _, row := range rows {
+		values := make([]string, len(props))
+		for i, prop := range props {
+			values[i], _ = row.get(idx, prop)
+		}
+		id := encodeBulkStringArray(len(values), values...)
+		if _, ok := groups[id]; !ok {
+			order = append(order, id)
+		}
+		groups[id] = append(groups[id], row)
+	}
+	grouped := make([]*aggregateRow, 0, len(order))
+	for _, id := range order {
+		members := groups[id]
+		row := &aggregateRow{values: map[string]any{}}
+		for _, prop := range props {
+			if val, ok := members[0].get(idx, prop); ok {
+				row.set(prop, val)
+			} else {
+				row.set(prop, nil)
+			}
+		}
+		for _, red := range reducers {
+			row.set(red.name, red.reduce(idx, members))
+		}
+		grouped = append(grouped, row)
+	}
+	return grouped
+}
+
+// compareAggregateValues compares two property values, as numbers when
+// both are numeric. Missing values sort last.
+func compareAggregateValues(a string, aok bool, b string, bok bool) int {
+	if !aok || !bok {
+		switch {
+		case aok == bok:
+			return 0
+		case aok:
+			return -1
+		}
+		return 1
+	}
+	an, aerr := strconv.ParseFloat(a, 64)
+	bn, berr := strconv.ParseFloat(b, 64)
+	if aerr == nil && berr == nil {
+		switch {
+		case an < bn:
+			return -1
+		case an > bn:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+// handleFTAggregate handles FT.AGGREGATE commands. The LOAD, GROUPBY,
+// SORTBY and LIMIT steps run in the order they are given.
+func (c *ClientHandler) handleFTAggregate(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("insufficient number of arguments for FT.AGGREGATE")
+	}
+	idx, err := c.Store.searchIndex(args[0])
+	if err != nil {
+		return err
+	}
+	var params map[string]string
+	for i := 2; i < len(args); i++ {
+		if strings.EqualFold(args[i], "PARAMS") {
+			if params, _, err = parseSearchParams(args, i); err != nil {
+				return err
+			}
+		}
+	}
+	fmt.Printf("FT.AGGREGATE %s command received.", idx.name)
+
+	results, err := c.Store.runQuery(idx, args[1], params)
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(results, func(a, b searchResult) int { return int(a.doc.id) - int(b.doc.id) })
+	rows := make([]*aggregateRow, len(results))
+	for i := range results {
+		rows[i] = &aggregateRow{result: &results[i], values: map[string]any{}}
+	}
+	total := len(rows)
+
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "VERBATIM":
+		case "DIALECT", "TIMEOUT":
+			i++
+		case "PARAMS":
+			_, i, _ = parseSearchParams(args, i)
+		case "LOAD":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			if args[i+1] == "*" {
+				for _, row := range rows {
+					if row.result == nil {
+						continue
+					}
+					names := make([]string, 0, row.result.hash.Len())
+					for field := range row.result.hash.fields {
+						names = append(names, field)
+					}
+					sort.Strings(names)
+					for _, field := range names {
+						row.set(field, row.result.hash.fields[field])
+					}
+				}
+				i++
+				continue
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 0 || i+1+n >= len(args) {
+				return fmt.Errorf("Bad arguments for LOAD: invalid count")
+			}
+			for _, prop := range args[i+2 : i+2+n] {
+				prop = strings.TrimPrefix(prop, "@")
+				for _, row := range rows {
+					if val, ok := row.get(idx, prop); ok {
+						row.set(prop, val)
+					}
+				}
+			}
+			i += 1 + n
+		case "GROUPBY":
+			props, reducers, next, err := parseAggregateGroupBy(args, i)
+			if err != nil {
+				return err
+			}
+			rows = groupRows(idx, rows, props, reducers)
+			total = len(rows)
+			i = next
+		case "SORTBY":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 0 || i+1+n >= len(args) {
+				return fmt.Errorf("Bad arguments for SORTBY: invalid count")
+			}
+			type sortKey struct {
+				prop string
+				desc bool
+			}
+			keys := []sortKey{}
+			for j := i + 2; j < i+2+n; j++ {
+				switch strings.ToUpper(args[j]) {
+				case "ASC", "DESC":
+					if len(keys) == 0 {
+						return errSyntax
+					}
+					keys[len(keys)-1].desc = strings.EqualFold(args[j], "DESC")
+				default:
+					keys = append(keys, sortKey{prop: strings.TrimPrefix(args[j], "@")})
+				}
+			}
+			i += 1 + n
+			slices.SortStableFunc(rows, func(a, b *aggregateRow) int {
+				for _, k := range keys {
+					av, aok := a.get(idx, k.prop)
+					bv, bok := b.get(idx, k.prop)
+					if cmp := compareAggregateValues(av, aok, bv, bok); cmp != 0 {
+						if k.desc && aok && bok {
+							return -cmp
+						}
+						return cmp
+					}
+				}
+				return 0
+			})
+			if i+2 < len(args) && strings.EqualFold(args[i+1], "MAX") {
+				limit, err := strconv.Atoi(args[i+2])
+				if err != nil || limit < 0 {
+					return fmt.Errorf("Bad arguments for MAX: Value is not an integer or out of range")
+				}
+				rows = rows[:min(limit, len(rows))]
+				i += 2
+			}
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return errSyntax
+			}
+			offset, err := strconv.Atoi(args[i+1])
+			if err != nil || offset < 0 {
+				return fmt.Errorf("Bad arguments for LIMIT: Value is not an integer or out of range")
+			}
+			limit, err := strconv.Atoi(args[i+2])
+			if err != nil || limit < 0 {
+				return fmt.Errorf("Bad arguments for LIMIT: Value is not an integer or out of range")
+			}
+			rows = rows[min(offset, len(rows)):min(offset+limit, len(rows))]
+			i += 2
+		default:
+			return fmt.Errorf("Unknown argument `%s`", args[i])
+		}
+	}
+
+	reply := []string{encodeInteger(total)}
+	for _, row := range rows {
+		fields := []string{}
+		for _, name := range row.names {
+			var val string
+			switch v := row.values[name].(type) {
+			case string:
+				val = encodeBulkString(v)
+			case []string:
+				val = encodeBulkStringArray(len(v), v...)
+			default:
+				val = nullResponse
+			}
+			fields = append(fields, encodeBulkString(name), val)
+		}
+		reply = append(reply, encodeArray(fields...))
+	}
+	return c.send(encodeArray(reply...))
+}
@@ -0,0 +1,683 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// docSet is a set of document keys.
+type docSet map[string]struct{}
+
+func (d docSet) has(key string) bool {
+	_, ok := d[key]
+	return ok
+}
+
+// searchNode is a node of a parsed query.
+type searchNode interface {
+	eval(idx *SearchIndex) docSet
+}
+
+// searchQuery is a parsed FT.SEARCH query. terms are the terms outside of
+// negations, which are the ones that contribute to a document's score. A
+// KNN query uses the rest of the query as its filter.
+type searchQuery struct {
+	root  searchNode
+	terms []*queryTerm
+	knn   *queryKNN
+}
+
+func (q *searchQuery) eval(idx *SearchIndex) docSet {
+	if q.root == nil {
+		return docSet{}
+	}
+	return q.root.eval(idx)
+}
+
+// score returns the TF-IDF score of doc: for every query term, the number
+// of times it appears in each field times the field weight, scaled by how
+// rare the term is across the index.
+func (q *searchQuery) score(idx *SearchIndex, doc *searchDoc) float64 {
+	score := 0.0
+	for _, t := range q.terms {
+		for _, f := range t.textFields(idx) {
+			for _, term := range t.expand(idx, f.name) {
+				tf := idx.terms[f.name][term][doc.key]
+				if tf == 0 {
+					continue
+				}
+				df := len(queryTerm{word: term}.eval(idx))
+				score += float64(tf) * f.weight * math.Log2(1+float64(len(idx.docs))/float64(df))
+			}
+		}
+	}
+	return score
+}
+
+// queryAll matches every document.
+type queryAll struct{}
+
+func (queryAll) eval(idx *SearchIndex) docSet {
+	result := make(docSet, len(idx.docs))
+	for key := range idx.docs {
+		result[key] = struct{}{}
+	}
+	return result
+}
+
+// queryTerm matches documents containing a term, or any term starting with
+// it when prefix is set, in one of fields or in any text field.
+type queryTerm struct {
+	fields []string
+	word   string
+	prefix bool
+}
+
+// textFields returns the indexed text fields the term is looked up in.
+func (t queryTerm) textFields(idx *SearchIndex) []*searchField {
+	fields := []*searchField{}
+	for _, f := range idx.fields {
+		if f.kind == searchText && !f.noIndex && (t.fields == nil || slices.Contains(t.fields, f.name)) {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// expand returns the terms of field that the term matches.
+func (t queryTerm) expand(idx *SearchIndex, field string) []string {
+	if !t.prefix {
+		return []string{t.word}
+	}
+	terms := []string{}
+	for term := range idx.terms[field] {
+		if strings.HasPrefix(term, t.word) {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+func (t queryTerm) eval(idx *SearchIndex) docSet {
+	result := docSet{}
+	for _, f := range t.textFields(idx) {
+		for _, term := range t.expand(idx, f.name) {
+			for key := range idx.terms[f.name][term] {
+				result[key] = struct{}{}
+			}
+		}
+	}
+	return result
+}
+
+// queryPhrase matches documents where the terms appear next to each other,
+// in order, in one field.
+type queryPhrase struct {
+	terms []*queryTerm
+}
+
+func (p queryPhrase) eval(idx *SearchIndex) docSet {
+	result := p.terms[0].eval(idx)
+	for _, t := range p.terms[1:] {
+		result = intersectDocs(result, t.eval(idx))
+	}
+	for key := range result {
+		doc := idx.docs[key]
+		found := false
+		for _, f := range p.terms[0].textFields(idx) {
+			tokens := doc.tokens[f.name]
+			for i := 0; i+len(p.terms) <= len(tokens) && !found; i++ {
+				found = true
+				for j, t := range p.terms {
+					if tokens[i+j] != t.word {
+						found = false
+						break
+					}
+				}
+			}
+		}
+		if !found {
+			delete(result, key)
+		}
+	}
+	return result
+}
+
+// queryNumeric matches documents whose numeric field is within a range.
+type queryNumeric struct {
+	field            string
+	min, max         float64
+	minExcl, maxExcl bool
+}
+
+func (n *queryNumeric) matches(doc *searchDoc) bool {
+	num, ok := doc.numbers[n.field]
+	if !ok {
+		return false
+	}
+	if num < n.min || n.minExcl && num == n.min {
+		return false
+	}
+	return num < n.max || !n.maxExcl && num == n.max
+}
+
+func (n *queryNumeric) eval(idx *SearchIndex) docSet {
+	result := docSet{}
+	for key, doc := range idx.docs {
+		if n.matches(doc) {
+			result[key] = struct{}{}
+		}
+	}
+	return result
+}
+
+// queryTag matches documents with one of the tags in a tag field. Tags
+// ending in an unescaped * match by prefix.
+type queryTag struct {
+	field    string
+	tags     []string
+	prefixes []string
+}
+
+func (t queryTag) eval(idx *SearchIndex) docSet {
+	result := docSet{}
+	for key, doc := range idx.docs {
+		for _, tag := range doc.tags[t.field] {
+			if slices.Contains(t.tags, tag) ||
+				slices.ContainsFunc(t.prefixes, func(p string) bool { return strings.HasPrefix(tag, p) }) {
+				result[key] = struct{}{}
+				break
+			}
+		}
+	}
+	return result
+}
+
+// queryAnd matches documents matching every child.
+type queryAnd struct {
+	children []searchNode
+}
+
+func (a queryAnd) eval(idx *SearchIndex) docSet {
+	result := a.children[0].eval(idx)
+	for _, child := range a.children[1:] {
+		result = intersectDocs(result, child.eval(idx))
+	}
+	return result
+}
+
+func intersectDocs(a, b docSet) docSet {
+	for key := range a {
+		if !b.has(key) {
+			delete(a, key)
+		}
+	}
+	return a
+}
+
+// queryOr matches documents matching any child.
+type queryOr struct {
+	children []searchNode
+}
+
+func (o queryOr) eval(idx *SearchIndex) docSet {
+	result := docSet{}
+	for _, child := range o.children {
+		for key := range child.eval(idx) {
+			result[key] = struct{}{}
+		}
+	}
+	return result
+}
+
+// queryNot matches documents not matching its child.
+type queryNot struct {
+	child searchNode
+}
+
+func (n queryNot) eval(idx *SearchIndex) docSet {
+	excluded := n.child.eval(idx)
+	result := docSet{}
+	for key := range idx.docs {
+		if !excluded.has(key) {
+			result[key] = struct{}{}
+		}
+	}
+	return result
+}
+
+// queryParser parses the query language of FT.SEARCH:
+//
+//	hello world        documents containing both terms
+//	hello|world        documents containing either term
+//	-hello             documents not containing the term
+//	hel*               terms starting with a prefix
+//	"hello world"      an exact phrase
+//	@title:hello       a term in a given text field
+//	@price:[10 (20]    a numeric range, ( marks an exclusive bound
+//	@tags:{red | blue} documents with one of the tags
+//
+// Parentheses group expressions, and intersection binds tighter than union.
+// $name is replaced by the value of a PARAMS parameter. A query may end in
+// a KNN clause, as in "(@tags:{red})=>[KNN 10 @vec $blob]".
+type queryParser struct {
+	idx    *SearchIndex
+	src    []rune
+	pos    int
+	params map[string]string
+	negate int
+	terms  []*queryTerm
+}
+
+func parseSearchQuery(idx *SearchIndex, query string, params map[string]string) (*searchQuery, error) {
+	if i := strings.LastIndex(query, "=>"); i >= 0 {
+		clause := strings.TrimSpace(query[i+2:])
+		if strings.HasPrefix(clause, "[") && strings.HasSuffix(clause, "]") {
+			knn, err := parseKNN(idx, clause[1:len(clause)-1], params)
+			if err != nil {
+				return nil, err
+			}
+			q, err := parseSearchQuery(idx, query[:i], params)
+			if err != nil {
+				return nil, err
+			}
+			q.knn = knn
+			return q, nil
+		}
+	}
+	if trimmed := strings.TrimSpace(query); trimmed == "*" || trimmed == "(*)" {
+		return &searchQuery{root: queryAll{}}, nil
+	}
+	p := &queryParser{idx: idx, src: []rune(query), params: params}
+	root, err := p.parseUnion(nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.src) {
+		return nil, p.syntaxError()
+	}
+	return &searchQuery{root: root, terms: p.terms}, nil
+}
+
+func (p *queryParser) syntaxError() error {
+	near := string(p.src[min(p.pos, len(p.src)):])
+	return fmt.Errorf("Syntax error at offset %d near %s", p.pos, near)
+}
+
+func (p *queryParser) peek() rune {
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *queryParser) skipSpace() {
+	for p.pos < len(p.src) && unicode.IsSpace(p.src[p.pos]) {
+		p.pos++
+	}
+}
+
+func (p *queryParser) expect(r rune) error {
+	p.skipSpace()
+	if p.peek() != r {
+		return p.syntaxError()
+	}
+	p.pos++
+	return nil
+}
+
+func (p *queryParser) parseUnion(scope []string) (searchNode, error) {
+	nodes := []searchNode{}
+	for {
+		node, err := p.parseIntersect(scope)
+		if err != nil {
+			return nil, err
+		}
+		if node != nil {
+			nodes = append(nodes, node)
+		}
+		if p.skipSpace(); p.peek() != '|' {
+			break
+		}
+		p.pos++
+	}
+	switch len(nodes) {
+	case 0:
+		return nil, nil
+	case 1:
+		return nodes[0], nil
+	}
+	return queryOr{nodes}, nil
+}
+
+func (p *queryParser) parseIntersect(scope []string) (searchNode, error) {
+	nodes := []searchNode{}
+	for {
+		p.skipSpace()
+		if r := p.peek(); r == 0 || r == ')' || r == '|' {
+			break
+		}
+		node, err := p.parseUnary(scope)
+		if err != nil {
+			return nil, err
+		}
+		if node != nil {
+			nodes = append(nodes, node)
+		}
+	}
+	switch len(nodes) {
+	case 0:
+		return nil, nil
+	case 1:
+		return nodes[0], nil
+	}
+	// Negations only narrow the other terms down, so evaluate them last.
+	slices.SortStableFunc(nodes, func(a, b searchNode) int {
+		_, an := a.(queryNot)
+		_, bn := b.(queryNot)
+		switch {
+		case !an && bn:
+			return -1
+		case an && !bn:
+			return 1
+		}
+		return 0
+	})
+	return queryAnd{nodes}, nil
+}
+
+func (p *queryParser) parseUnary(scope []string) (searchNode, error) {
+	p.skipSpace()
+	switch p.peek() {
+	case '-':
+		p.pos++
+		p.negate++
+		node, err := p.parseUnary(scope)
+		p.negate--
+		if err != nil || node == nil {
+			return nil, err
+		}
+		return queryNot{node}, nil
+	case '(':
+		p.pos++
+		node, err := p.parseUnion(scope)
+		if err != nil {
+			return nil, err
+		}
+		return node, p.expect(')')
+	case '@':
+		return p.parseField()
+	case '"':
+		return p.parsePhrase(scope)
+	case '*':
+		p.pos++
+		return queryAll{}, nil
+	}
+	word, err := p.readWord()
+	if err != nil {
+		return nil, err
+	}
+	if word == "" {
+		return nil, p.syntaxError()
+	}
+	prefix := false
+	if p.peek() == '*' {
+		p.pos++
+		prefix = true
+	}
+	return p.term(scope, word, prefix), nil
+}
+
+// readWord reads a term or a $parameter reference.
+func (p *queryParser) readWord() (string, error) {
+	if p.peek() == '$' {
+		p.pos++
+		name := p.readWhile(func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' })
+		val, ok := p.params[name]
+		if !ok {
+			return "", fmt.Errorf("No such parameter `%s`", name)
+		}
+		return val, nil
+	}
+	var sb strings.Builder
+	for p.pos < len(p.src) {
+		r := p.src[p.pos]
+		if r == '\\' && p.pos+1 < len(p.src) {
+			sb.WriteRune(p.src[p.pos+1])
+			p.pos += 2
+			continue
+		}
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+			break
+		}
+		sb.WriteRune(r)
+		p.pos++
+	}
+	return sb.String(), nil
+}
+
+func (p *queryParser) readWhile(accept func(rune) bool) string {
+	start := p.pos
+	for p.pos < len(p.src) && accept(p.src[p.pos]) {
+		p.pos++
+	}
+	return string(p.src[start:p.pos])
+}
+
+// term builds the node for a word, which may tokenize into several terms.
+// Stopwords are dropped.
+func (p *queryParser) term(scope []string, word string, prefix bool) searchNode {
+	var tokens []string
+	if prefix {
+		tokens = []string{strings.ToLower(word)}
+	} else {
+		tokens = p.idx.tokenize(word)
+	}
+	nodes := []searchNode{}
+	for _, token := range tokens {
+		t := &queryTerm{fields: scope, word: token, prefix: prefix}
+		if p.negate == 0 {
+			p.terms = append(p.terms, t)
+		}
+		nodes = append(nodes, t)
+	}
+	switch len(nodes) {
+	case 0:
+		return nil
+	case 1:
+		return nodes[0]
+	}
+	return queryAnd{nodes}
+}
+
+func (p *queryParser) parsePhrase(scope []string) (searchNode, error) {
+	p.pos++
+	var sb strings.Builder
+	for {
+		if p.pos >= len(p.src) {
+			return nil, p.syntaxError()
+		}
+		r := p.src[p.pos]
+		p.pos++
+		if r == '"' {
+			break
+		}
+		if r == '\\' && p.pos < len(p.src) {
+			r = p.src[p.pos]
+			p.pos++
+		}
+		sb.WriteRune(r)
+	}
+	phrase := queryPhrase{}
+	for _, token := range p.idx.tokenize(sb.String()) {
+		t := &queryTerm{fields: scope, word: token}
+		if p.negate == 0 {
+			p.terms = append(p.terms, t)
+		}
+		phrase.terms = append(phrase.terms, t)
+	}
+	switch len(phrase.terms) {
+	case 0:
+		return nil, nil
+	case 1:
+		return phrase.terms[0], nil
+	}
+	return phrase, nil
+}
+
+// parseField parses a query restricted to fields, such as @title:hello or
+// @title|body:(hello world).
+func (p *queryParser) parseField() (searchNode, error) {
+	p.pos++
+	names := strings.Split(p.readWhile(func(r rune) bool { return r != ':' && !unicode.IsSpace(r) }), "|")
+	if err := p.expect(':'); err != nil {
+		return nil, err
+	}
+	fields := make([]*searchField, len(names))
+	for i, name := range names {
+		if fields[i] = p.idx.field(name); fields[i] == nil {
+			return nil, fmt.Errorf("Unknown field `%s`", name)
+		}
+	}
+	p.skipSpace()
+	switch kind := fields[0].kind; {
+	case kind == searchNumeric && len(fields) == 1:
+		return p.parseNumeric(fields[0])
+	case kind == searchTag && len(fields) == 1:
+		return p.parseTags(fields[0])
+	case kind == searchText:
+		for _, f := range fields {
+			if f.kind != searchText {
+				return nil, p.syntaxError()
+			}
+		}
+		return p.parseUnary(names)
+	}
+	return nil, p.syntaxError()
+}
+
+// parseNumeric parses a range such as [10 20] or [(10 +inf].
+func (p *queryParser) parseNumeric(f *searchField) (searchNode, error) {
+	if err := p.expect('['); err != nil {
+		return nil, err
+	}
+	body := p.readWhile(func(r rune) bool { return r != ']' })
+	if err := p.expect(']'); err != nil {
+		return nil, err
+	}
+	bounds := strings.FieldsFunc(body, func(r rune) bool { return unicode.IsSpace(r) || r == ',' })
+	for i, b := range bounds {
+		excl := strings.HasPrefix(b, "(")
+		name := strings.TrimPrefix(b, "(")
+		if strings.HasPrefix(name, "$") {
+			val, ok := p.params[name[1:]]
+			if !ok {
+				return nil, fmt.Errorf("No such parameter `%s`", name[1:])
+			}
+			bounds[i] = val
+			if excl {
+				bounds[i] = "(" + val
+			}
+		}
+	}
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("Syntax error: expected a numeric range in [min max] form")
+	}
+	return parseNumericRange(p.idx, f.name, bounds[0], bounds[1])
+}
+
+// parseNumericRange parses the bounds of a numeric range, which may be
+// -inf, +inf, or a number prefixed with ( to exclude it.
+func parseNumericRange(idx *SearchIndex, field, lo, hi string) (*queryNumeric, error) {
+	if f := idx.field(field); f == nil || f.kind != searchNumeric {
+		return nil, fmt.Errorf("Unknown numeric field `%s`", field)
+	}
+	n := &queryNumeric{field: field}
+	var err error
+	if n.min, n.minExcl, err = parseNumericBound(lo); err != nil {
+		return nil, err
+	}
+	if n.max, n.maxExcl, err = parseNumericBound(hi); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func parseNumericBound(arg string) (float64, bool, error) {
+	excl := strings.HasPrefix(arg, "(")
+	arg = strings.TrimPrefix(arg, "(")
+	num, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(num) {
+		return 0, false, fmt.Errorf("Bad lower range: %s", arg)
+	}
+	return num, excl, nil
+}
+
+// parseTags parses a tag list such as {red | dark\ blue | gr*}.
+func (p *queryParser) parseTags(f *searchField) (searchNode, error) {
+	if err := p.expect('{'); err != nil {
+		return nil, err
+	}
+	node := queryTag{field: f.name}
+	var sb strings.Builder
+	escaped := false
+	flush := func() error {
+		tag := strings.TrimSpace(sb.String())
+		sb.Reset()
+		prefix := false
+		if strings.HasSuffix(tag, "*") && !escaped {
+			tag, prefix = strings.TrimSuffix(tag, "*"), true
+		}
+		escaped = false
+		if strings.HasPrefix(tag, "$") {
+			val, ok := p.params[tag[1:]]
+			if !ok {
+				return fmt.Errorf("No such parameter `%s`", tag[1:])
+			}
+			tag = val
+		}
+		if !f.caseSensitive {
+			tag = strings.ToLower(tag)
+		}
+		switch {
+		case tag == "":
+		case prefix:
+			node.prefixes = append(node.prefixes, tag)
+		default:
+			node.tags = append(node.tags, tag)
+		}
+		return nil
+	}
+	for {
+		if p.pos >= len(p.src) {
+			return nil, p.syntaxError()
+		}
+		r := p.src[p.pos]
+		p.pos++
+		switch r {
+		case '\\':
+			if p.pos < len(p.src) {
+				sb.WriteRune(p.src[p.pos])
+				escaped = true
+				p.pos++
+			}
+			continue
+		case '|', '}':
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			if r == '}' {
+				return node, nil
+			}
+			continue
+		}
+		if !unicode.IsSpace(r) {
+			escaped = false
+		}
+		sb.WriteRune(r)
+	}
+}
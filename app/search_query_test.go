@@ -0,0 +1,186 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testSearchIndex returns an index over the hashes in docs, keyed by
+// document key.
+func testSearchIndex(t *testing.T, args string, docs map[string][]string) *SearchIndex {
+	t.Helper()
+	idx, err := parseSearchIndex("idx", strings.Fields(args))
+	if err != nil {
+		t.Fatalf("parseSearchIndex: %v", err)
+	}
+	for key, fields := range docs {
+		h := NewHash()
+		for i := 0; i < len(fields); i += 2 {
+			h.Set(fields[i], fields[i+1])
+		}
+		idx.add(key, h)
+	}
+	return idx
+}
+
+func sortedKeys(d docSet) []string {
+	keys := []string{}
+	for key := range d {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func TestSearchQuery(t *testing.T) {
+	idx := testSearchIndex(t, "ON HASH SCHEMA title TEXT WEIGHT 2 body TEXT price NUMERIC tags TAG", map[string][]string{
+		"a": {"title", "Red apples", "body", "Fresh from the farm", "price", "3", "tags", "fruit,red"},
+		"b": {"title", "Green apples", "body", "Sour and crisp", "price", "4.5", "tags", "fruit, Green"},
+		"c": {"title", "Red car", "body", "A fast red sports car", "price", "30000", "tags", "vehicle,red"},
+		"d": {"title", "Bananas", "body", "Yellow and fresh", "price", "1", "tags", "fruit,yellow"},
+	})
+	params := map[string]string{"word": "crisp", "lo": "2", "color": "yellow"}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"*", []string{"a", "b", "c", "d"}},
+		{"apples", []string{"a", "b"}},
+		{"APPLES", []string{"a", "b"}},
+		{"red apples", []string{"a"}},
+		{"red | bananas", []string{"a", "c", "d"}},
+		{"apples -red", []string{"b"}},
+		{"-apples", []string{"c", "d"}},
+		{"app*", []string{"a", "b"}},
+		{`"red car"`, []string{"c"}},
+		{`"car red"`, []string{}},
+		{"@title:red", []string{"a", "c"}},
+		{"@body:red", []string{"c"}},
+		{"@title|body:fresh", []string{"a", "d"}},
+		{"@title:(red apples)", []string{"a"}},
+		{"@price:[1 4.5]", []string{"a", "b", "d"}},
+		{"@price:[(1 (4.5]", []string{"a"}},
+		{"@price:[100 +inf]", []string{"c"}},
+		{"@price:[-inf 1]", []string{"d"}},
+		{"@tags:{red}", []string{"a", "c"}},
+		{"@tags:{green | yellow}", []string{"b", "d"}},
+		{"@tags:{veh*}", []string{"c"}},
+		{"@tags:{fruit} -@tags:{red}", []string{"b", "d"}},
+		{"(apples | bananas) @price:[0 3]", []string{"a", "d"}},
+		{"the and", []string{}},
+		{"$word", []string{"b"}},
+		{"@price:[$lo +inf] @tags:{$color}", []string{}},
+		{"@price:[(0 $lo] @tags:{$color}", []string{"d"}},
+	}
+	for _, tt := range tests {
+		q, err := parseSearchQuery(idx, tt.query, params)
+		if err != nil {
+			t.Errorf("parseSearchQuery(%q): %v", tt.query, err)
+			continue
+		}
+		if got := sortedKeys(q.eval(idx)); !slices.Equal(got, tt.want) {
+			t.Errorf("%q matched %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestSearchQueryScore(t *testing.T) {
+	idx := testSearchIndex(t, "SCHEMA title TEXT WEIGHT 5 body TEXT", map[string][]string{
+		"in-title": {"title", "hello", "body", "something else"},
+		"in-body":  {"title", "something else", "body", "hello"},
+		"twice":    {"title", "other", "body", "hello hello"},
+		"none":     {"title", "other", "body", "other"},
+	})
+	q, err := parseSearchQuery(idx, "hello", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	score := func(key string) float64 { return q.score(idx, idx.docs[key]) }
+	if !(score("in-title") > score("twice") && score("twice") > score("in-body") && score("in-body") > 0) {
+		t.Errorf("scores: title %v, twice %v, body %v", score("in-title"), score("twice"), score("in-body"))
+	}
+	if score("none") != 0 {
+		t.Errorf("a document without the term scored %v", score("none"))
+	}
+}
+
+func TestSearchQueryErrors(t *testing.T) {
+	idx := testSearchIndex(t, "SCHEMA title TEXT price NUMERIC tags TAG", nil)
+	tests := []struct {
+		query, want string
+	}{
+		{"(hello", "Syntax error"},
+		{"hello)", "Syntax error"},
+		{`"unterminated`, "Syntax error"},
+		{"@missing:hello", "Unknown field"},
+		{"@price:[1]", "numeric range"},
+		{"@price:[a 2]", "Bad lower range"},
+		{"@tags:{red", "Syntax error"},
+		{"@price:hello", "Syntax error"},
+		{"$nope", "No such parameter"},
+		{"@tags:{$nope}", "No such parameter"},
+	}
+	for _, tt := range tests {
+		_, err := parseSearchQuery(idx, tt.query, nil)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseSearchQuery(%q) error = %v, want %q", tt.query, err, tt.want)
+		}
+	}
+}
+
+func TestParseSearchIndex(t *testing.T) {
+	tests := []struct {
+		args, want string
+	}{
+		{"ON JSON SCHEMA a TEXT", "only HASH"},
+		{"PREFIX 5 a: SCHEMA a TEXT", "invalid count"},
+		{"ON HASH", "Fields arguments are missing"},
+		{"SCHEMA a", "has no type"},
+		{"SCHEMA a GEO", "Invalid field type"},
+		{"SCHEMA a TEXT a TAG", "Duplicate field"},
+		{"SCHEMA a TAG SEPARATOR ab", "single character"},
+		{"SCHEMA a TEXT WEIGHT x", "WEIGHT"},
+		{"FILTER x SCHEMA a TEXT", "Unknown argument"},
+	}
+	for _, tt := range tests {
+		_, err := parseSearchIndex("idx", strings.Fields(tt.args))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseSearchIndex(%q) error = %v, want %q", tt.args, err, tt.want)
+		}
+	}
+
+	idx := testSearchIndex(t, "PREFIX 2 a: b: STOPWORDS 1 foo SCHEMA t TEXT n AS num NUMERIC SORTABLE", nil)
+	if !idx.covers("a:1") || !idx.covers("b:1") || idx.covers("c:1") {
+		t.Errorf("prefixes = %v", idx.prefixes)
+	}
+	if got := idx.tokenize("The foo, BAR!"); !slices.Equal(got, []string{"the", "bar"}) {
+		t.Errorf("tokenize = %v", got)
+	}
+	if f := idx.field("num"); f == nil || f.identifier != "n" || !f.sortable {
+		t.Errorf("field num = %+v", f)
+	}
+}
+
+func TestSearchIndexUpdates(t *testing.T) {
+	idx := testSearchIndex(t, "SCHEMA title TEXT price NUMERIC", map[string][]string{
+		"a": {"title", "old words"},
+	})
+	h := NewHash()
+	h.Set("title", "new words")
+	idx.add("a", h)
+	if _, ok := idx.terms["title"]["old"]; ok {
+		t.Errorf("replaced document still indexed under old")
+	}
+	bad := NewHash()
+	bad.Set("price", "cheap")
+	idx.add("b", bad)
+	if idx.docs["b"] != nil || idx.failures != 1 {
+		t.Errorf("document with a bad number indexed, failures = %d", idx.failures)
+	}
+	idx.remove("a")
+	if len(idx.docs) != 0 || idx.numTerms() != 0 {
+		t.Errorf("%d docs and %d terms left", len(idx.docs), idx.numTerms())
+	}
+}
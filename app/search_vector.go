@@ -0,0 +1,483 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	vectorFlat = "FLAT"
+	vectorHNSW = "HNSW"
+
+	vectorL2     = "L2"
+	vectorIP     = "IP"
+	vectorCosine = "COSINE"
+
+	hnswDefaultM              = 16
+	hnswDefaultEFConstruction = 200
+	hnswDefaultEFRuntime      = 10
+)
+
+// vectorParams are the attributes of a VECTOR field.
+type vectorParams struct {
+	algorithm      string
+	dim            int
+	metric         string
+	m              int
+	efConstruction int
+	efRuntime      int
+}
+
+// parseVectorParams parses "FLAT|HNSW nargs attribute value ..." at
+// schema[j] and returns the position after it.
+func parseVectorParams(schema []string, j int) (*vectorParams, int, error) {
+	if j+1 >= len(schema) {
+		return nil, 0, fmt.Errorf("Bad arguments for vector similarity algorithm")
+	}
+	p := &vectorParams{
+		algorithm:      strings.ToUpper(schema[j]),
+		m:              hnswDefaultM,
+		efConstruction: hnswDefaultEFConstruction,
+		efRuntime:      hnswDefaultEFRuntime,
+	}
+	if p.algorithm != vectorFlat && p.algorithm != vectorHNSW {
+		return nil, 0, fmt.Errorf("Bad arguments for vector similarity algorithm")
+	}
+	n, err := strconv.Atoi(schema[j+1])
+	if err != nil || n < 0 || n%2 != 0 || j+1+n >= len(schema) {
+		return nil, 0, fmt.Errorf("Bad arguments for vector similarity %s params: invalid count", p.algorithm)
+	}
+	for k := j + 2; k < j+2+n; k += 2 {
+		attr, val := strings.ToUpper(schema[k]), schema[k+1]
+		num, numErr := strconv.Atoi(val)
+		switch {
+		case attr == "TYPE":
+			if !strings.EqualFold(val, "FLOAT32") {
+				return nil, 0, fmt.Errorf("Bad arguments for vector similarity %s argument TYPE: only FLOAT32 is supported", p.algorithm)
+			}
+		case attr == "DIM" && numErr == nil && num > 0:
+			p.dim = num
+		case attr == "DISTANCE_METRIC":
+			p.metric = strings.ToUpper(val)
+			if p.metric != vectorL2 && p.metric != vectorIP && p.metric != vectorCosine {
+				return nil, 0, fmt.Errorf("Bad arguments for vector similarity %s argument DISTANCE_METRIC", p.algorithm)
+			}
+		case attr == "INITIAL_CAP" || attr == "BLOCK_SIZE" || attr == "EPSILON":
+		case attr == "M" && p.algorithm == vectorHNSW && numErr == nil && num > 1:
+			p.m = num
+		case attr == "EF_CONSTRUCTION" && p.algorithm == vectorHNSW && numErr == nil && num > 0:
+			p.efConstruction = num
+		case attr == "EF_RUNTIME" && p.algorithm == vectorHNSW && numErr == nil && num > 0:
+			p.efRuntime = num
+		default:
+			return nil, 0, fmt.Errorf("Bad arguments for vector similarity %s argument %s", p.algorithm, attr)
+		}
+	}
+	if p.dim == 0 || p.metric == "" {
+		return nil, 0, fmt.Errorf("Missing mandatory parameter: cannot create %s index without specifying TYPE, DIM and DISTANCE_METRIC", p.algorithm)
+	}
+	return p, j + 2 + n, nil
+}
+
+// parseVector decodes a blob of little endian float32 values.
+func (p *vectorParams) parseVector(blob string) ([]float32, bool) {
+	if len(blob) != 4*p.dim {
+		return nil, false
+	}
+	vec := make([]float32, p.dim)
+	for i := range vec {
+		vec[i] = math.Float32frombits(binary.LittleEndian.Uint32([]byte(blob[4*i:])))
+	}
+	return vec, true
+}
+
+// vectorDistance returns the distance between two vectors: the squared
+// euclidean distance for L2, and one minus the inner product or cosine
+// similarity otherwise, so that smaller is always closer.
+func vectorDistance(metric string, a, b []float32) float64 {
+	var dot, na, nb, l2 float64
+	for i := range a {
+		x, y := float64(a[i]), float64(b[i])
+		dot += x * y
+		na += x * x
+		nb += y * y
+		l2 += (x - y) * (x - y)
+	}
+	switch metric {
+	case vectorL2:
+		return l2
+	case vectorIP:
+		return 1 - dot
+	}
+	if na == 0 || nb == 0 {
+		return 1
+	}
+	return 1 - dot/math.Sqrt(na*nb)
+}
+
+// vectorHit is a result of a KNN query.
+type vectorHit struct {
+	key  string
+	dist float64
+}
+
+// vectorIndex stores the vectors of one field for nearest neighbour
+// queries. filter, when not nil, restricts the results to its keys.
+type vectorIndex interface {
+	add(key string, vec []float32)
+	remove(key string)
+	knn(query []float32, k int, filter docSet, ef int) []vectorHit
+}
+
+// bruteForce compares query against every vector passing the filter.
+func bruteForce(vectors map[string][]float32, metric string, query []float32, k int, filter docSet) []vectorHit {
+	hits := []vectorHit{}
+	for key, vec := range vectors {
+		if filter == nil || filter.has(key) {
+			hits = append(hits, vectorHit{key, vectorDistance(metric, query, vec)})
+		}
+	}
+	sortHits(hits)
+	return hits[:min(k, len(hits))]
+}
+
+func sortHits(hits []vectorHit) {
+	slices.SortFunc(hits, func(a, b vectorHit) int {
+		switch {
+		case a.dist < b.dist:
+			return -1
+		case a.dist > b.dist:
+			return 1
+		}
+		return strings.Compare(a.key, b.key)
+	})
+}
+
+// flatIndex answers queries by comparing against every vector.
+type flatIndex struct {
+	metric  string
+	vectors map[string][]float32
+}
+
+func (f *flatIndex) add(key string, vec []float32) {
+	f.vectors[key] = vec
+}
+
+func (f *flatIndex) remove(key string) {
+	delete(f.vectors, key)
+}
+
+func (f *flatIndex) knn(query []float32, k int, filter docSet, _ int) []vectorHit {
+	return bruteForce(f.vectors, f.metric, query, k, filter)
+}
+
+// hnswNode is a vector in the HNSW graph, linked to its neighbours on each
+// layer up to its level.
+type hnswNode struct {
+	key   string
+	vec   []float32
+	links [][]*hnswNode
+}
+
+// hnswIndex is a hierarchical navigable small world graph. Each node is
+// placed on a random number of layers, with exponentially fewer nodes on
+// higher layers, and searches descend greedily from the sparse top layer.
+type hnswIndex struct {
+	params    *vectorParams
+	nodes     map[string]*hnswNode
+	vectors   map[string][]float32
+	entry     *hnswNode
+	levelMult float64
+}
+
+func newHNSWIndex(p *vectorParams) *hnswIndex {
+	return &hnswIndex{
+		params:    p,
+		nodes:     make(map[string]*hnswNode),
+		vectors:   make(map[string][]float32),
+		levelMult: 1 / math.Log(float64(p.m)),
+	}
+}
+
+// maxLinks returns how many neighbours a node keeps on a layer.
+func (h *hnswIndex) maxLinks(layer int) int {
+	if layer == 0 {
+		return 2 * h.params.m
+	}
+	return h.params.m
+}
+
+func (h *hnswIndex) distance(a []float32, n *hnswNode) float64 {
+	return vectorDistance(h.params.metric, a, n.vec)
+}
+
+// hnswCandidate is a node and its distance to the query.
+type hnswCandidate struct {
+	node *hnswNode
+	dist float64
+}
+
+// hnswHeap is a heap of candidates, closest first unless farthest is set.
+type hnswHeap struct {
+	items    []hnswCandidate
+	farthest bool
+}
+
+func (q *hnswHeap) Len() int { return len(q.items) }
+func (q *hnswHeap) Less(i, j int) bool {
+	if q.farthest {
+		return q.items[i].dist > q.items[j].dist
+	}
+	return q.items[i].dist < q.items[j].dist
+}
+func (q *hnswHeap) Swap(i, j int) { q.items[i], q.items[j] = q.items[j], q.items[i] }
+func (q *hnswHeap) Push(x any)    { q.items = append(q.items, x.(hnswCandidate)) }
+func (q *hnswHeap) Pop() any {
+	last := q.items[len(q.items)-1]
+	q.items = q.items[:len(q.items)-1]
+	return last
+}
+
+// searchLayer returns the ef nodes closest to query that can be reached
+// from entries on a layer, closest first.
+func (h *hnswIndex) searchLayer(query []float32, entries []hnswCandidate, ef, layer int) []hnswCandidate {
+	visited := map[*hnswNode]bool{}
+	candidates := &hnswHeap{}
+	results := &hnswHeap{farthest: true}
+	for _, e := range entries {
+		visited[e.node] = true
+		heap.Push(candidates, e)
+		heap.Push(results, e)
+	}
+	for candidates.Len() > 0 {
+		c := heap.Pop(candidates).(hnswCandidate)
+		if results.Len() >= ef && c.dist > results.items[0].dist {
+			break
+		}
+		for _, n := range c.node.links[layer] {
+			if visited[n] {
+				continue
+			}
+			visited[n] = true
+			d := h.distance(query, n)
+			if results.Len() < ef || d < results.items[0].dist {
+				heap.Push(candidates, hnswCandidate{n, d})
+				heap.Push(results, hnswCandidate{n, d})
+				if results.Len() > ef {
+					heap.Pop(results)
+				}
+			}
+		}
+	}
+	found := results.items
+	slices.SortFunc(found, func(a, b hnswCandidate) int {
+		switch {
+		case a.dist < b.dist:
+			return -1
+		case a.dist > b.dist:
+			return 1
+		}
+		return 0
+	})
+	return found
+}
+
+// descend walks greedily from the entry point down to layer, returning the
+// closest node found.
+func (h *hnswIndex) descend(query []float32, layer int) []hnswCandidate {
+	ep := []hnswCandidate{{h.entry, h.distance(query, h.entry)}}
+	for l := len(h.entry.links) - 1; l > layer; l-- {
+		ep = h.searchLayer(query, ep, 1, l)
+	}
+	return ep
+}
+
+// prune keeps the closest maxLinks neighbours of n on a layer.
+func (h *hnswIndex) prune(n *hnswNode, layer int) {
+	links := n.links[layer]
+	if len(links) <= h.maxLinks(layer) {
+		return
+	}
+	slices.SortFunc(links, func(a, b *hnswNode) int {
+		da, db := h.distance(n.vec, a), h.distance(n.vec, b)
+		switch {
+		case da < db:
+			return -1
+		case da > db:
+			return 1
+		}
+		return 0
+	})
+	n.links[layer] = links[:h.maxLinks(layer)]
+}
+
+func (h *hnswIndex) add(key string, vec []float32) {
+	h.remove(key)
+	level := int(-math.Log(1-rand.Float64()) * h.levelMult)
+	n := &hnswNode{key: key, vec: vec, links: make([][]*hnswNode, level+1)}
+	h.nodes[key] = n
+	h.vectors[key] = vec
+	if h.entry == nil {
+		h.entry = n
+		return
+	}
+
+	top := len(h.entry.links) - 1
+	ep := h.descend(vec, min(level, top))
+	for layer := min(level, top); layer >= 0; layer-- {
+		ep = h.searchLayer(vec, ep, h.params.efConstruction, layer)
+		for _, c := range ep[:min(h.params.m, len(ep))] {
+			n.links[layer] = append(n.links[layer], c.node)
+			c.node.links[layer] = append(c.node.links[layer], n)
+			h.prune(c.node, layer)
+		}
+	}
+	if level > top {
+		h.entry = n
+	}
+}
+
+// remove unlinks the node of key. Every node that linked to it, which may
+// not be among its own links, is offered the removed node's neighbours in
+// its place and keeps the closest of its old and new links.
+func (h *hnswIndex) remove(key string) {
+	n, ok := h.nodes[key]
+	if !ok {
+		return
+	}
+	delete(h.nodes, key)
+	delete(h.vectors, key)
+	for layer, links := range n.links {
+		for _, other := range h.nodes {
+			if layer >= len(other.links) || !slices.Contains(other.links[layer], n) {
+				continue
+			}
+			other.links[layer] = slices.DeleteFunc(other.links[layer], func(x *hnswNode) bool { return x == n })
+			for _, candidate := range links {
+				if candidate != other && candidate != n && !slices.Contains(other.links[layer], candidate) {
+					other.links[layer] = append(other.links[layer], candidate)
+				}
+			}
+			h.prune(other, layer)
+		}
+	}
+	if h.entry == n {
+		h.entry = nil
+		for _, other := range h.nodes {
+			if h.entry == nil || len(other.links) > len(h.entry.links) {
+				h.entry = other
+			}
+		}
+	}
+}
+
+// knn searches the graph with a candidate list of size ef, widened by the
+// share of documents a filter leaves out. When the filter still leaves
+// fewer than k of the candidates, the filtered documents are compared one
+// by one instead.
+func (h *hnswIndex) knn(query []float32, k int, filter docSet, ef int) []vectorHit {
+	if h.entry == nil || k == 0 {
+		return []vectorHit{}
+	}
+	ef = max(ef, k)
+	if filter != nil {
+		ef = min(max(ef, k*len(h.nodes)/max(len(filter), 1)), len(h.nodes))
+	}
+	hits := []vectorHit{}
+	for _, c := range h.searchLayer(query, h.descend(query, 0), ef, 0) {
+		if filter == nil || filter.has(c.node.key) {
+			hits = append(hits, vectorHit{c.node.key, c.dist})
+		}
+	}
+	if len(hits) < k && filter != nil && len(filter) > len(hits) {
+		return bruteForce(h.vectors, h.params.metric, query, k, filter)
+	}
+	sortHits(hits)
+	return hits[:min(k, len(hits))]
+}
+
+// newVectorIndex creates the index for a VECTOR field.
+func newVectorIndex(p *vectorParams) vectorIndex {
+	if p.algorithm == vectorHNSW {
+		return newHNSWIndex(p)
+	}
+	return &flatIndex{metric: p.metric, vectors: make(map[string][]float32)}
+}
+
+// queryKNN is the "=>[KNN k @field $blob]" part of a query, which returns
+// the k documents passing the filter that are closest to a vector.
+type queryKNN struct {
+	field     *searchField
+	k         int
+	vec       []float32
+	ef        int
+	scoreName string
+}
+
+// parseKNN parses the body of a KNN clause, such as
+// "KNN 10 @embedding $blob EF_RUNTIME 50 AS dist".
+func parseKNN(idx *SearchIndex, clause string, params map[string]string) (*queryKNN, error) {
+	param := func(arg string) (string, error) {
+		if !strings.HasPrefix(arg, "$") {
+			return arg, nil
+		}
+		val, ok := params[arg[1:]]
+		if !ok {
+			return "", fmt.Errorf("No such parameter `%s`", arg[1:])
+		}
+		return val, nil
+	}
+	words := strings.Fields(clause)
+	if len(words) < 4 || !strings.EqualFold(words[0], "KNN") || !strings.HasPrefix(words[2], "@") {
+		return nil, fmt.Errorf("Syntax error: expected KNN <k> @<field> $<blob>")
+	}
+	q := &queryKNN{}
+	kArg, err := param(words[1])
+	if err != nil {
+		return nil, err
+	}
+	if q.k, err = strconv.Atoi(kArg); err != nil || q.k < 0 {
+		return nil, fmt.Errorf("Error parsing vector similarity query: invalid K")
+	}
+	name := words[2][1:]
+	if q.field = idx.field(name); q.field == nil || q.field.kind != searchVector {
+		return nil, fmt.Errorf("Error parsing vector similarity query: `%s` is not a vector field", name)
+	}
+	blob, err := param(words[3])
+	if err != nil {
+		return nil, err
+	}
+	var ok bool
+	if q.vec, ok = q.field.vector.parseVector(blob); !ok {
+		return nil, fmt.Errorf("Error parsing vector similarity query: query vector blob size (%d) does not match index's expected size (%d).",
+			len(blob), 4*q.field.vector.dim)
+	}
+	q.ef = q.field.vector.efRuntime
+	q.scoreName = "__" + name + "_score"
+	for i := 4; i < len(words); i += 2 {
+		if i+1 >= len(words) {
+			return nil, errSyntax
+		}
+		val, err := param(words[i+1])
+		if err != nil {
+			return nil, err
+		}
+		switch strings.ToUpper(words[i]) {
+		case "EF_RUNTIME":
+			if q.ef, err = strconv.Atoi(val); err != nil || q.ef < 1 {
+				return nil, fmt.Errorf("Error parsing vector similarity query: invalid EF_RUNTIME")
+			}
+		case "AS", "YIELD_DISTANCE_AS":
+			q.scoreName = val
+		default:
+			return nil, errSyntax
+		}
+	}
+	return q, nil
+}
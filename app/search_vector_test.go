@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// vectorBlob encodes vec the way clients send it.
+func vectorBlob(vec ...float32) string {
+	buf := []byte{}
+	for _, x := range vec {
+		buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(x))
+	}
+	return string(buf)
+}
+
+func TestVectorDistance(t *testing.T) {
+	tests := []struct {
+		metric string
+		a, b   []float32
+		want   float64
+	}{
+		{vectorL2, []float32{0, 0}, []float32{3, 4}, 25},
+		{vectorL2, []float32{1, 2}, []float32{1, 2}, 0},
+		{vectorIP, []float32{1, 0}, []float32{0.5, 3}, 0.5},
+		{vectorCosine, []float32{1, 0}, []float32{5, 0}, 0},
+		{vectorCosine, []float32{1, 0}, []float32{0, 2}, 1},
+		{vectorCosine, []float32{1, 0}, []float32{-1, 0}, 2},
+		{vectorCosine, []float32{0, 0}, []float32{1, 0}, 1},
+	}
+	for _, tt := range tests {
+		if got := vectorDistance(tt.metric, tt.a, tt.b); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("vectorDistance(%s, %v, %v) = %v, want %v", tt.metric, tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestParseVectorParams(t *testing.T) {
+	p, next, err := parseVectorParams(strings.Fields("v VECTOR HNSW 10 TYPE FLOAT32 DIM 4 DISTANCE_METRIC cosine M 8 EF_RUNTIME 20 rest"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != 14 || p.algorithm != vectorHNSW || p.dim != 4 || p.metric != vectorCosine || p.m != 8 || p.efRuntime != 20 {
+		t.Errorf("parsed %+v, next %d", p, next)
+	}
+	if vec, ok := p.parseVector(vectorBlob(1, -2, 0.5, 3)); !ok || vec[1] != -2 || vec[2] != 0.5 {
+		t.Errorf("parseVector = %v, %v", vec, ok)
+	}
+	if _, ok := p.parseVector(vectorBlob(1, 2, 3)); ok {
+		t.Errorf("parsed a vector of the wrong size")
+	}
+
+	for _, args := range []string{
+		"IVF 6 TYPE FLOAT32 DIM 4 DISTANCE_METRIC L2",
+		"FLAT 5 TYPE FLOAT32 DIM 4 DISTANCE_METRIC",
+		"FLAT 8 TYPE FLOAT32 DIM 4 DISTANCE_METRIC L2",
+		"FLAT 6 TYPE FLOAT64 DIM 4 DISTANCE_METRIC L2",
+		"FLAT 6 TYPE FLOAT32 DIM 0 DISTANCE_METRIC L2",
+		"FLAT 6 TYPE FLOAT32 DIM 4 DISTANCE_METRIC L1",
+		"FLAT 4 TYPE FLOAT32 DIM 4",
+		"FLAT 8 TYPE FLOAT32 DIM 4 DISTANCE_METRIC L2 M 8",
+		"HNSW 8 TYPE FLOAT32 DIM 4 DISTANCE_METRIC L2 M 1",
+	} {
+		if _, _, err := parseVectorParams(strings.Fields(args), 0); err == nil {
+			t.Errorf("parseVectorParams(%q) succeeded", args)
+		}
+	}
+}
+
+func TestVectorIndexKNN(t *testing.T) {
+	const dim, n, k = 8, 1000, 10
+	rng := rand.New(rand.NewSource(1))
+	random := func() []float32 {
+		vec := make([]float32, dim)
+		for i := range vec {
+			vec[i] = rng.Float32()*2 - 1
+		}
+		return vec
+	}
+	vectors := map[string][]float32{}
+	for i := 0; i < n; i++ {
+		vectors["v"+strconv.Itoa(i)] = random()
+	}
+
+	for _, metric := range []string{vectorL2, vectorCosine} {
+		params := &vectorParams{dim: dim, metric: metric, m: hnswDefaultM, efConstruction: hnswDefaultEFConstruction, efRuntime: hnswDefaultEFRuntime}
+		flat := newVectorIndex(&vectorParams{algorithm: vectorFlat, dim: dim, metric: metric})
+		params.algorithm = vectorHNSW
+		hnsw := newVectorIndex(params)
+		for key, vec := range vectors {
+			flat.add(key, vec)
+			hnsw.add(key, vec)
+		}
+		// Removing vectors must leave the graph connected.
+		for i := 0; i < n; i += 10 {
+			flat.remove("v" + strconv.Itoa(i))
+			hnsw.remove("v" + strconv.Itoa(i))
+		}
+
+		found, total := 0, 0
+		for q := 0; q < 50; q++ {
+			query := random()
+			exact := flat.knn(query, k, nil, 0)
+			if len(exact) != k {
+				t.Fatalf("%s: flat returned %d hits", metric, len(exact))
+			}
+			for i := 1; i < len(exact); i++ {
+				if exact[i].dist < exact[i-1].dist {
+					t.Fatalf("%s: flat hits out of order", metric)
+				}
+			}
+			want := map[string]bool{}
+			for _, hit := range exact {
+				want[hit.key] = true
+			}
+			for _, hit := range hnsw.knn(query, k, nil, 50) {
+				if want[hit.key] {
+					found++
+				}
+			}
+			total += k
+		}
+		if recall := float64(found) / float64(total); recall < 0.9 {
+			t.Errorf("%s: HNSW recall %.2f", metric, recall)
+		}
+	}
+}
+
+func TestVectorIndexFilter(t *testing.T) {
+	for _, algorithm := range []string{vectorFlat, vectorHNSW} {
+		idx := newVectorIndex(&vectorParams{algorithm: algorithm, dim: 1, metric: vectorL2, m: 4, efConstruction: 20, efRuntime: 10})
+		for i := 0; i < 200; i++ {
+			idx.add(strconv.Itoa(i), []float32{float32(i)})
+		}
+		// The filter keeps only keys far from the query.
+		filter := docSet{"150": {}, "199": {}, "180": {}}
+		hits := idx.knn([]float32{0}, 2, filter, 10)
+		if len(hits) != 2 || hits[0].key != "150" || hits[1].key != "180" {
+			t.Errorf("%s: filtered hits = %v", algorithm, hits)
+		}
+		if hits := idx.knn([]float32{0}, 0, nil, 10); len(hits) != 0 {
+			t.Errorf("%s: k=0 returned %v", algorithm, hits)
+		}
+	}
+}
+
+func TestParseKNN(t *testing.T) {
+	idx := testSearchIndex(t, "SCHEMA v VECTOR FLAT 6 TYPE FLOAT32 DIM 2 DISTANCE_METRIC L2 title TEXT", nil)
+	params := map[string]string{"blob": vectorBlob(1, 2), "k": "5", "short": vectorBlob(1)}
+
+	q, err := parseKNN(idx, "KNN $k @v $blob EF_RUNTIME 40 AS dist", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.k != 5 || q.ef != 40 || q.scoreName != "dist" || q.vec[1] != 2 {
+		t.Errorf("parsed %+v", q)
+	}
+	if q, _ := parseKNN(idx, "KNN 3 @v $blob", params); q.scoreName != "__v_score" {
+		t.Errorf("default score name = %s", q.scoreName)
+	}
+
+	tests := []struct {
+		clause, want string
+	}{
+		{"KNN 3 v $blob", "expected KNN"},
+		{"KNN -1 @v $blob", "invalid K"},
+		{"KNN 3 @title $blob", "not a vector field"},
+		{"KNN 3 @v $short", "blob size"},
+		{"KNN 3 @v $missing", "No such parameter"},
+		{"KNN 3 @v $blob EF_RUNTIME 0", "invalid EF_RUNTIME"},
+		{"KNN 3 @v $blob AS", "syntax error"},
+	}
+	for _, tt := range tests {
+		_, err := parseKNN(idx, tt.clause, params)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseKNN(%q) error = %v, want %q", tt.clause, err, tt.want)
+		}
+	}
+}
@@ -4,9 +4,12 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"os"
 	"os/signal"
+	"path/filepath"
   "strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
   "time"
 )
@@ -14,6 +17,18 @@ import (
 type Server struct {
 	Context   context.Context
 	Config    *Store
+	Store     *Store
+	scripts   *scriptEngine
+	pubsub    *pubSub
+	tracking  *trackingTable
+	exit      func(code int) // ends the process for SHUTDOWN
+
+	// propagated holds the writes waiting to be sent to replicas. It is
+	// only used with the store lock held.
+	propagated []Command
+
+	clients      map[int64]*ClientHandler
+	lastClientID atomic.Int64
   Replicas  []net.Conn
   mu        sync.Mutex
 }
@@ -53,7 +68,12 @@ func (s *Server) CloseReplicas() {
 }
 
 func NewServer(ctx context.Context, config *Store) *Server {
-	server := &Server{Context: ctx, Config: config}
+	server := &Server{Context: ctx, Config: config, Store: NewStore(), scripts: newScriptEngine(), pubsub: newPubSub(), clients: make(map[int64]*ClientHandler), exit: os.Exit}
+	server.tracking = newTrackingTable(server)
+	server.Store.functions = server.scripts.functions
+	server.Store.tracking = server.tracking
+	server.Store.events = server.publishKeyspaceEvent
+	server.Store.propagate = server.propagate
 	return server
 }
 
@@ -76,6 +96,17 @@ func (s *Server) Run() error {
 	}
 	fmt.Printf("Listening on port %s...", port)
 
+	if s.IsPersistent() {
+		file, err := s.dbFile()
+		if err != nil {
+			fmt.Printf("Error opening db file: %v", err)
+		} else if err := s.Store.Load(file); err != nil {
+			fmt.Printf("Error reading from db: %v", err)
+		}
+	} else {
+		fmt.Printf("Database file not provided, data will not be saved between sessions.")
+	}
+
   var masterConn net.Conn
   if master != "" {
     params := strings.Split(master, " ")
@@ -111,6 +142,26 @@ func (s *Server) Run() error {
 		listener.Close()
 	}()
 
+	// Start goroutine that actively expires keys until shutdown.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(expireCycleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.Store.mu.Lock()
+				s.Store.ExpireCycle()
+				s.tracking.flushBroadcast()
+				s.flushPropagated()
+				s.Store.mu.Unlock()
+			}
+		}
+	}()
+
 	// Listen for client connections and send to handler.
 	for {
 		conn, err := listener.Accept()
@@ -147,9 +198,48 @@ func (s *Server) Run() error {
 	}
 }
 
+// shutdown disconnects the replicas and ends the process. It doesn't wait
+// for client handlers, as one of them may be running a script that never
+// returns.
+func (s *Server) shutdown() {
+	s.CloseReplicas()
+	fmt.Printf("Redis is now ready to exit, bye bye...")
+	s.exit(0)
+}
+
 // IsPersistent returns true if a db directory and filename are defined.
 func (s *Server) IsPersistent() bool {
 	_, dirErr := s.Config.Get(keyDBDir)
 	_, fileErr := s.Config.Get(keyDBFilename)
 	return dirErr == nil && fileErr == nil
 }
+
+// dbPath returns the path of the database file, if one is configured.
+func (s *Server) dbPath() (string, error) {
+	dir, err := s.Config.Get(keyDBDir)
+	if err != nil {
+		return "", fmt.Errorf("no database path provided: %v", err)
+	}
+	filename, err := s.Config.Get(keyDBFilename)
+	if err != nil {
+		return "", fmt.Errorf("no database filename provided: %v", err)
+	}
+	return filepath.Join(dir, filename), nil
+}
+
+// dbFile returns a pointer to the database file, if there is one configured.
+func (s *Server) dbFile() (*os.File, error) {
+	path, err := s.dbPath()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("database file not found: %v", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open file: %v", err)
+	}
+	return file, nil
+}
@@ -0,0 +1,635 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const setMaxIntsetEntries = 512 // largest set kept in the integer encoding
+
+// Set is an unordered collection of unique strings. Small sets made up only
+// of integers are kept as a sorted slice of int64s, like the Redis intset
+// encoding, and are converted to a hash table once that no longer holds.
+type Set struct {
+	ints    []int64             // members while the set is intset encoded
+	members map[string]struct{} // members once converted, nil before that
+	table   keyTable            // members once converted, for SSCAN
+}
+
+func NewSet() *Set {
+	return &Set{}
+}
+
+// parseSetInt returns member as an integer, if it is the canonical string
+// form of an int64. Members like "007" must stay strings to round-trip.
+func parseSetInt(member string) (int64, bool) {
+	num, err := strconv.ParseInt(member, 10, 64)
+	if err != nil || strconv.FormatInt(num, 10) != member {
+		return 0, false
+	}
+	return num, true
+}
+
+// IsIntset returns true while the set uses the compact integer encoding.
+func (s *Set) IsIntset() bool {
+	return s.members == nil
+}
+
+// convert moves the set from the integer encoding to a hash table.
+func (s *Set) convert() {
+	s.members = make(map[string]struct{}, len(s.ints)+1)
+	for _, num := range s.ints {
+		member := strconv.FormatInt(num, 10)
+		s.members[member] = struct{}{}
+		s.table.add(member)
+	}
+	s.ints = nil
+}
+
+// Add adds member to the set, returning true if it was not already there.
+func (s *Set) Add(member string) bool {
+	if s.IsIntset() {
+		num, ok := parseSetInt(member)
+		if ok {
+			i := sort.Search(len(s.ints), func(i int) bool { return s.ints[i] >= num })
+			if i < len(s.ints) && s.ints[i] == num {
+				return false
+			}
+			if len(s.ints) < setMaxIntsetEntries {
+				s.ints = append(s.ints, 0)
+				copy(s.ints[i+1:], s.ints[i:])
+				s.ints[i] = num
+				return true
+			}
+		}
+		s.convert()
+	}
+	if _, found := s.members[member]; found {
+		return false
+	}
+	s.members[member] = struct{}{}
+	s.table.add(member)
+	return true
+}
+
+// Remove removes member from the set, returning true if it was there.
+func (s *Set) Remove(member string) bool {
+	if s.IsIntset() {
+		num, ok := parseSetInt(member)
+		if !ok {
+			return false
+		}
+		i := sort.Search(len(s.ints), func(i int) bool { return s.ints[i] >= num })
+		if i == len(s.ints) || s.ints[i] != num {
+			return false
+		}
+		s.ints = append(s.ints[:i], s.ints[i+1:]...)
+		return true
+	}
+	if _, found := s.members[member]; !found {
+		return false
+	}
+	delete(s.members, member)
+	s.table.remove(member)
+	return true
+}
+
+// Contains returns true if member is in the set.
+func (s *Set) Contains(member string) bool {
+	if s.IsIntset() {
+		num, ok := parseSetInt(member)
+		if !ok {
+			return false
+		}
+		i := sort.Search(len(s.ints), func(i int) bool { return s.ints[i] >= num })
+		return i < len(s.ints) && s.ints[i] == num
+	}
+	_, found := s.members[member]
+	return found
+}
+
+// Len returns the number of members in the set.
+func (s *Set) Len() int {
+	if s.IsIntset() {
+		return len(s.ints)
+	}
+	return len(s.members)
+}
+
+// Members returns all members of the set. Intset encoded sets are returned
+// in ascending order.
+func (s *Set) Members() []string {
+	members := make([]string, 0, s.Len())
+	if s.IsIntset() {
+		for _, num := range s.ints {
+			members = append(members, strconv.FormatInt(num, 10))
+		}
+		return members
+	}
+	for member := range s.members {
+		members = append(members, member)
+	}
+	return members
+}
+
+// RandomMember returns a random member of the set, which must not be
+// empty.
+func (s *Set) RandomMember() string {
+	if s.IsIntset() {
+		return strconv.FormatInt(s.ints[rand.Intn(len(s.ints))], 10)
+	}
+	return s.table.random()
+}
+
+// Random returns count distinct random members, or every member if the
+// set is not larger than count. Like Redis, it only lists the whole set
+// when count is close to its size, and otherwise picks members one by
+// one, so that it costs O(count) rather than O(N).
+func (s *Set) Random(count int) []string {
+	n := s.Len()
+	if count >= n {
+		return s.Members()
+	}
+	if count*3 > n {
+		members := s.Members()
+		for i := 0; i < count; i++ {
+			j := i + rand.Intn(len(members)-i)
+			members[i], members[j] = members[j], members[i]
+		}
+		return members[:count]
+	}
+	members := make([]string, 0, count)
+	picked := make(map[string]struct{}, count)
+	for len(members) < count {
+		member := s.RandomMember()
+		if _, found := picked[member]; !found {
+			picked[member] = struct{}{}
+			members = append(members, member)
+		}
+	}
+	return members
+}
+
+// encodeIntset encodes the members of an intset encoded set in the Redis
+// intset blob format: the integer width and member count as 32 bit
+// little-endian numbers, followed by the sorted members.
+func (s *Set) encodeIntset() string {
+	width := 2
+	for _, num := range s.ints {
+		switch {
+		case num < -1<<31 || num > 1<<31-1:
+			width = 8
+		case (num < -1<<15 || num > 1<<15-1) && width < 4:
+			width = 4
+		}
+	}
+	blob := make([]byte, 8, 8+width*len(s.ints))
+	binary.LittleEndian.PutUint32(blob, uint32(width))
+	binary.LittleEndian.PutUint32(blob[4:], uint32(len(s.ints)))
+	for _, num := range s.ints {
+		switch width {
+		case 2:
+			blob = binary.LittleEndian.AppendUint16(blob, uint16(num))
+		case 4:
+			blob = binary.LittleEndian.AppendUint32(blob, uint32(num))
+		default:
+			blob = binary.LittleEndian.AppendUint64(blob, uint64(num))
+		}
+	}
+	return string(blob)
+}
+
+// decodeIntset builds a set from a Redis intset blob.
+func decodeIntset(blob string) (*Set, error) {
+	if len(blob) < 8 {
+		return nil, fmt.Errorf("intset blob too short")
+	}
+	data := []byte(blob)
+	width := int(binary.LittleEndian.Uint32(data))
+	length := int(binary.LittleEndian.Uint32(data[4:]))
+	if (width != 2 && width != 4 && width != 8) || len(data) != 8+width*length {
+		return nil, fmt.Errorf("invalid intset blob")
+	}
+	set := NewSet()
+	for i := 0; i < length; i++ {
+		item := data[8+i*width:]
+		var num int64
+		switch width {
+		case 2:
+			num = int64(int16(binary.LittleEndian.Uint16(item)))
+		case 4:
+			num = int64(int32(binary.LittleEndian.Uint32(item)))
+		default:
+			num = int64(binary.LittleEndian.Uint64(item))
+		}
+		set.Add(strconv.FormatInt(num, 10))
+	}
+	return set, nil
+}
+
+// set returns the set stored at key. If there is no such key, a new set is
+// created when create is true and nil is returned otherwise.
+func (s *Store) set(key string, create bool) (*Set, error) {
+	val, found := s.lookup(key)
+	if !found {
+		if !create {
+			return nil, nil
+		}
+		set := NewSet()
+		s.create(key, set)
+		return set, nil
+	}
+	set, ok := val.(*Set)
+	if !ok {
+		return nil, errWrongType
+	}
+	return set, nil
+}
+
+// setChanged deletes key once the set stored there has no members left.
+func (s *Store) setChanged(key string, set *Set) {
+	if set.Len() == 0 {
+		s.remove(key)
+		s.notify(notifyGeneric, "del", key)
+	}
+}
+
+// sets returns the sets stored at the given keys, with nil for missing keys.
+func (s *Store) sets(keys []string) ([]*Set, error) {
+	sets := make([]*Set, 0, len(keys))
+	for _, key := range keys {
+		set, err := s.set(key, false)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, set)
+	}
+	return sets, nil
+}
+
+// Set operations supported by SINTER, SUNION and SDIFF.
+const (
+	setOpInter = iota
+	setOpUnion
+	setOpDiff
+)
+
+// setStoreEvents holds the keyspace events of the STORE variants of the
+// set operations.
+var setStoreEvents = [...]string{
+	setOpInter: "sinterstore",
+	setOpUnion: "sunionstore",
+	setOpDiff:  "sdiffstore",
+}
+
+// setAlgebra computes the intersection, union or difference of sets, where
+// nil stands for an empty set. A limit above 0 stops an intersection once
+// it has that many members.
+func setAlgebra(op int, sets []*Set, limit int) *Set {
+	result := NewSet()
+	if len(sets) == 0 || (op != setOpUnion && sets[0] == nil) {
+		return result
+	}
+
+	switch op {
+	case setOpInter:
+		// Iterate the smallest set and probe the others.
+		smallest := 0
+		for i, set := range sets {
+			if set == nil {
+				return result
+			}
+			if set.Len() < sets[smallest].Len() {
+				smallest = i
+			}
+		}
+		for _, member := range sets[smallest].Members() {
+			inAll := true
+			for _, set := range sets {
+				if !set.Contains(member) {
+					inAll = false
+					break
+				}
+			}
+			if inAll {
+				result.Add(member)
+				if limit > 0 && result.Len() == limit {
+					break
+				}
+			}
+		}
+	case setOpUnion:
+		for _, set := range sets {
+			if set == nil {
+				continue
+			}
+			for _, member := range set.Members() {
+				result.Add(member)
+			}
+		}
+	case setOpDiff:
+		for _, member := range sets[0].Members() {
+			inOther := false
+			for _, set := range sets[1:] {
+				if set != nil && set.Contains(member) {
+					inOther = true
+					break
+				}
+			}
+			if !inOther {
+				result.Add(member)
+			}
+		}
+	}
+	return result
+}
+
+// handleSAdd handles SADD commands.
+func (c *ClientHandler) handleSAdd(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("insufficient number of arguments for SADD")
+	}
+	key := args[0]
+	fmt.Printf("SADD %s command received.", key)
+	set, err := c.Store.set(key, true)
+	if err != nil {
+		return err
+	}
+	added := 0
+	for _, member := range args[1:] {
+		if set.Add(member) {
+			added++
+		}
+	}
+	if added > 0 {
+		c.Store.notify(notifySet, "sadd", key)
+		c.Store.touch(key)
+	}
+	return c.send(encodeInteger(added))
+}
+
+// handleSRem handles SREM commands.
+func (c *ClientHandler) handleSRem(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("insufficient number of arguments for SREM")
+	}
+	key := args[0]
+	set, err := c.Store.set(key, false)
+	if err != nil {
+		return err
+	}
+	if set == nil {
+		return c.send(encodeInteger(0))
+	}
+	removed := 0
+	for _, member := range args[1:] {
+		if set.Remove(member) {
+			removed++
+		}
+	}
+	if removed > 0 {
+		c.Store.notify(notifySet, "srem", key)
+		c.Store.setChanged(key, set)
+		c.Store.touch(key)
+	}
+	return c.send(encodeInteger(removed))
+}
+
+// handleSMembers handles SMEMBERS commands.
+func (c *ClientHandler) handleSMembers(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("wrong number of arguments for SMEMBERS")
+	}
+	set, err := c.Store.set(args[0], false)
+	if err != nil {
+		return err
+	}
+	if set == nil {
+		return c.send(encodeBulkStringArray(0))
+	}
+	members := set.Members()
+	return c.send(encodeBulkStringArray(len(members), members...))
+}
+
+// handleSIsMember handles SISMEMBER and SMISMEMBER commands.
+func (c *ClientHandler) handleSIsMember(args []string, multi bool) error {
+	if len(args) < 2 || (!multi && len(args) != 2) {
+		return fmt.Errorf("wrong number of arguments for SISMEMBER")
+	}
+	set, err := c.Store.set(args[0], false)
+	if err != nil {
+		return err
+	}
+	result := make([]string, 0, len(args)-1)
+	for _, member := range args[1:] {
+		if set != nil && set.Contains(member) {
+			result = append(result, encodeInteger(1))
+		} else {
+			result = append(result, encodeInteger(0))
+		}
+	}
+	if !multi {
+		return c.send(result[0])
+	}
+	return c.send(encodeArray(result...))
+}
+
+// handleSCard handles SCARD commands.
+func (c *ClientHandler) handleSCard(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("wrong number of arguments for SCARD")
+	}
+	set, err := c.Store.set(args[0], false)
+	if err != nil {
+		return err
+	}
+	if set == nil {
+		return c.send(encodeInteger(0))
+	}
+	return c.send(encodeInteger(set.Len()))
+}
+
+// handleSPop handles SPOP and SRANDMEMBER commands. SRANDMEMBER leaves the
+// set untouched and, with a negative count, may return the same member
+// more than once.
+func (c *ClientHandler) handleSPop(args []string, remove bool) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("wrong number of arguments for SPOP")
+	}
+	key := args[0]
+	count, hasCount := 1, len(args) == 2
+	if hasCount {
+		var err error
+		if count, err = strconv.Atoi(args[1]); err != nil {
+			return errNotInteger
+		}
+		if count < 0 && remove {
+			return fmt.Errorf("value is out of range, must be positive")
+		}
+	}
+
+	c.replicateEffects() // SPOP sends the members it removed, if any
+	set, err := c.Store.set(key, false)
+	if err != nil {
+		return err
+	}
+	if set == nil {
+		if hasCount {
+			return c.send(encodeBulkStringArray(0))
+		}
+		return c.send(nullResponse)
+	}
+
+	var members []string
+	if count < 0 {
+		for i := 0; i < -count; i++ {
+			members = append(members, set.RandomMember())
+		}
+	} else {
+		members = set.Random(count)
+	}
+	if remove && len(members) > 0 {
+		for _, member := range members {
+			set.Remove(member)
+		}
+		// Replicas remove the members that were picked here.
+		c.replicateEffects(Command{"SREM", append([]string{key}, members...)})
+		c.Store.notify(notifySet, "spop", key)
+		c.Store.setChanged(key, set)
+		c.Store.touch(key)
+	}
+
+	if !hasCount {
+		return c.send(encodeBulkString(members[0]))
+	}
+	return c.send(encodeBulkStringArray(len(members), members...))
+}
+
+// handleSMove handles SMOVE commands.
+func (c *ClientHandler) handleSMove(args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("wrong number of arguments for SMOVE")
+	}
+	srcKey, dstKey, member := args[0], args[1], args[2]
+	src, err := c.Store.set(srcKey, false)
+	if err != nil {
+		return err
+	}
+	dst, err := c.Store.set(dstKey, false)
+	if err != nil {
+		return err
+	}
+	if src == nil || !src.Contains(member) {
+		return c.send(encodeInteger(0))
+	}
+	if srcKey == dstKey {
+		return c.send(encodeInteger(1))
+	}
+
+	src.Remove(member)
+	c.Store.notify(notifySet, "srem", srcKey)
+	c.Store.setChanged(srcKey, src)
+	c.Store.touch(srcKey)
+	if dst == nil {
+		dst, _ = c.Store.set(dstKey, true)
+	}
+	if dst.Add(member) {
+		c.Store.notify(notifySet, "sadd", dstKey)
+		c.Store.touch(dstKey)
+	}
+	return c.send(encodeInteger(1))
+}
+
+// handleSetAlgebra handles SINTER, SUNION and SDIFF commands, and with
+// store set, their STORE variants taking the destination key first.
+func (c *ClientHandler) handleSetAlgebra(args []string, op int, store bool) error {
+	if len(args) < 1 || (store && len(args) < 2) {
+		return fmt.Errorf("insufficient number of arguments for set operation")
+	}
+	var dst string
+	if store {
+		dst, args = args[0], args[1:]
+	}
+	sets, err := c.Store.sets(args)
+	if err != nil {
+		return err
+	}
+	result := setAlgebra(op, sets, 0)
+
+	if !store {
+		members := result.Members()
+		return c.send(encodeBulkStringArray(len(members), members...))
+	}
+	c.Store.storeResult(dst, result, result.Len() > 0, notifySet, setStoreEvents[op])
+	return c.send(encodeInteger(result.Len()))
+}
+
+// handleSInterCard handles SINTERCARD commands.
+func (c *ClientHandler) handleSInterCard(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("insufficient number of arguments for SINTERCARD")
+	}
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil || numKeys <= 0 {
+		return fmt.Errorf("numkeys should be greater than 0")
+	}
+	if len(args)-1 < numKeys {
+		return fmt.Errorf("Number of keys can't be greater than number of args")
+	}
+	keys, opts := args[1:numKeys+1], args[numKeys+1:]
+
+	limit := 0
+	for i := 0; i < len(opts); i += 2 {
+		if strings.ToUpper(opts[i]) != "LIMIT" || i+1 >= len(opts) {
+			return errSyntax
+		}
+		if limit, err = strconv.Atoi(opts[i+1]); err != nil || limit < 0 {
+			return fmt.Errorf("LIMIT can't be negative")
+		}
+	}
+
+	sets, err := c.Store.sets(keys)
+	if err != nil {
+		return err
+	}
+	return c.send(encodeInteger(setAlgebra(setOpInter, sets, limit).Len()))
+}
+
+// handleSScan handles SSCAN commands.
+func (c *ClientHandler) handleSScan(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("insufficient number of arguments for SSCAN")
+	}
+	cursor, err := parseCursor(args[1])
+	if err != nil {
+		return err
+	}
+	opts, err := parseScanOptions(args[2:], false)
+	if err != nil {
+		return err
+	}
+	set, err := c.Store.set(args[0], false)
+	if err != nil {
+		return err
+	}
+	if set == nil {
+		return c.send(encodeScanReply(0, nil))
+	}
+
+	// Like Redis, intset encoded sets are small enough to return whole.
+	page, next := set.Members(), uint64(0)
+	if !set.IsIntset() {
+		page, next = set.table.scan(cursor, opts.count)
+	}
+	result := []string{}
+	for _, member := range page {
+		if opts.matches(member) {
+			result = append(result, member)
+		}
+	}
+	return c.send(encodeScanReply(next, result))
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func setOf(members ...string) *Set {
+	s := NewSet()
+	for _, m := range members {
+		s.Add(m)
+	}
+	return s
+}
+
+func TestSetEncoding(t *testing.T) {
+	tests := []struct {
+		name       string
+		members    []string
+		wantIntset bool
+	}{
+		{"integers", []string{"3", "-1", "1000000"}, true},
+		{"leading zero", []string{"1", "007"}, false},
+		{"plus sign", []string{"+1"}, false},
+		{"text", []string{"1", "a"}, false},
+		{"too large for int64", []string{"9223372036854775808"}, false},
+	}
+	for _, tt := range tests {
+		s := setOf(tt.members...)
+		if s.IsIntset() != tt.wantIntset {
+			t.Errorf("%s: IsIntset() = %v", tt.name, s.IsIntset())
+		}
+		if s.Len() != len(tt.members) {
+			t.Errorf("%s: Len() = %d", tt.name, s.Len())
+		}
+		for _, m := range tt.members {
+			if !s.Contains(m) {
+				t.Errorf("%s: %q missing", tt.name, m)
+			}
+		}
+	}
+
+	s := NewSet()
+	for i := setMaxIntsetEntries; i > 0; i-- {
+		s.Add(strconv.Itoa(i))
+	}
+	if !s.IsIntset() || s.Members()[0] != "1" {
+		t.Fatalf("a full intset isn't sorted or was converted")
+	}
+	s.Add("0")
+	if s.IsIntset() || s.Len() != setMaxIntsetEntries+1 {
+		t.Errorf("intset wasn't converted past %d members", setMaxIntsetEntries)
+	}
+}
+
+func TestSetAddRemove(t *testing.T) {
+	for _, members := range [][]string{{"1", "2", "3"}, {"a", "b", "3"}} {
+		s := setOf(members...)
+		tests := []struct {
+			op     string
+			member string
+			want   bool
+		}{
+			{"add", members[0], false},
+			{"remove", members[1], true},
+			{"remove", members[1], false},
+			{"remove", "missing", false},
+			{"add", members[1], true},
+		}
+		for _, tt := range tests {
+			var got bool
+			if tt.op == "add" {
+				got = s.Add(tt.member)
+			} else {
+				got = s.Remove(tt.member)
+			}
+			if got != tt.want {
+				t.Errorf("%v: %s(%s) = %v", members, tt.op, tt.member, got)
+			}
+		}
+		if s.Len() != 3 {
+			t.Errorf("%v: Len() = %d", members, s.Len())
+		}
+	}
+}
+
+func TestIntsetRoundTrip(t *testing.T) {
+	tests := []struct {
+		members []string
+		width   byte
+	}{
+		{[]string{}, 2},
+		{[]string{"-32768", "0", "32767"}, 2},
+		{[]string{"1", "32768"}, 4},
+		{[]string{"-2147483648", "2147483647"}, 4},
+		{[]string{"2147483648", "-5"}, 8},
+		{[]string{"-9223372036854775808", "9223372036854775807"}, 8},
+	}
+	for _, tt := range tests {
+		blob := setOf(tt.members...).encodeIntset()
+		if blob[0] != tt.width || len(blob) != 8+int(tt.width)*len(tt.members) {
+			t.Errorf("%v: width %d, %d bytes", tt.members, blob[0], len(blob))
+		}
+		s, err := decodeIntset(blob)
+		if err != nil {
+			t.Errorf("%v: decodeIntset: %v", tt.members, err)
+			continue
+		}
+		want := slices.Clone(tt.members)
+		slices.SortFunc(want, func(a, b string) int {
+			x, _ := strconv.ParseInt(a, 10, 64)
+			y, _ := strconv.ParseInt(b, 10, 64)
+			return cmp.Compare(x, y)
+		})
+		if got := s.Members(); !slices.Equal(got, want) {
+			t.Errorf("decoded %v, want %v", got, want)
+		}
+	}
+
+	for _, blob := range []string{"\x02\x00\x00", "\x03\x00\x00\x00\x00\x00\x00\x00", "\x02\x00\x00\x00\x02\x00\x00\x00\x01\x00"} {
+		if _, err := decodeIntset(blob); err == nil {
+			t.Errorf("decodeIntset(%q) succeeded", blob)
+		}
+	}
+}
+
+func TestSetAlgebra(t *testing.T) {
+	a := setOf("1", "2", "3", "x")
+	b := setOf("2", "3", "4")
+	c := setOf("3", "x", "y")
+	tests := []struct {
+		name  string
+		op    int
+		sets  []*Set
+		limit int
+		want  []string
+	}{
+		{"inter", setOpInter, []*Set{a, b}, 0, []string{"2", "3"}},
+		{"inter of three", setOpInter, []*Set{a, b, c}, 0, []string{"3"}},
+		{"inter with missing", setOpInter, []*Set{a, nil}, 0, []string{}},
+		{"inter with limit", setOpInter, []*Set{a, b}, 1, nil},
+		{"union", setOpUnion, []*Set{a, nil, c}, 0, []string{"1", "2", "3", "x", "y"}},
+		{"diff", setOpDiff, []*Set{a, b, nil}, 0, []string{"1", "x"}},
+		{"diff of missing", setOpDiff, []*Set{nil, a}, 0, []string{}},
+	}
+	for _, tt := range tests {
+		got := setAlgebra(tt.op, tt.sets, tt.limit).Members()
+		if tt.want == nil {
+			if len(got) != tt.limit {
+				t.Errorf("%s: %v, want %d members", tt.name, got, tt.limit)
+			}
+			continue
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSetRandom(t *testing.T) {
+	numbered := func(prefix string, n int) *Set {
+		s := NewSet()
+		for i := 0; i < n; i++ {
+			s.Add(prefix + strconv.Itoa(i))
+		}
+		return s
+	}
+	tests := []struct {
+		name  string
+		set   *Set
+		count int
+	}{
+		{"intset, few", numbered("", 100), 5},
+		{"intset, most", numbered("", 100), 90},
+		{"intset, all", numbered("", 100), 100},
+		{"intset, more than all", numbered("", 100), 500},
+		{"hash table, few", numbered("m", 5000), 10},
+		{"hash table, most", numbered("m", 5000), 4000},
+		{"hash table, all", numbered("m", 5000), 5000},
+		{"single member", setOf("x"), 3},
+	}
+	for _, tt := range tests {
+		got := tt.set.Random(tt.count)
+		if want := min(tt.count, tt.set.Len()); len(got) != want {
+			t.Errorf("%s: %d members, want %d", tt.name, len(got), want)
+		}
+		seen := map[string]bool{}
+		for _, m := range got {
+			if seen[m] || !tt.set.Contains(m) {
+				t.Errorf("%s: %q is repeated or not a member", tt.name, m)
+				break
+			}
+			seen[m] = true
+		}
+	}
+
+	// Every member of a small set comes up eventually, whichever the
+	// encoding, and removals are never returned.
+	for _, s := range []*Set{numbered("", 20), numbered("m", 20)} {
+		s.Remove(strconv.Itoa(7))
+		s.Remove("m7")
+		seen := map[string]bool{}
+		for i := 0; i < 2000; i++ {
+			seen[s.RandomMember()] = true
+		}
+		if len(seen) != 19 || seen["7"] || seen["m7"] {
+			t.Errorf("RandomMember returned %d distinct members: %v", len(seen), seen)
+		}
+	}
+}
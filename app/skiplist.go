@@ -0,0 +1,273 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+)
+
+const (
+	skiplistMaxLevel = 32   // enough for 2^64 elements
+	skiplistP        = 0.25 // probability of a node having one more level
+)
+
+// skiplistNode is an element of a skiplist. Each level links to the next
+// node on that level and records the number of nodes it skips, so ranks
+// can be computed while searching.
+type skiplistNode struct {
+	member   string
+	score    float64
+	backward *skiplistNode
+	level    []skiplistLevel
+}
+
+type skiplistLevel struct {
+	forward *skiplistNode
+	span    int
+}
+
+// skiplist keeps members ordered by score, then lexicographically. It is a
+// port of the Redis zskiplist, which supports lookups and updates by rank in
+// addition to the usual ordered operations.
+type skiplist struct {
+	header *skiplistNode
+	tail   *skiplistNode
+	length int
+	level  int
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		header: &skiplistNode{level: make([]skiplistLevel, skiplistMaxLevel)},
+		level:  1,
+	}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Float64() < skiplistP {
+		level++
+	}
+	return level
+}
+
+// before reports whether node sorts before the given score and member.
+func (n *skiplistNode) before(score float64, member string) bool {
+	return n.score < score || (n.score == score && n.member < member)
+}
+
+// insert adds a new node. The member must not already be in the list.
+func (sl *skiplist) insert(score float64, member string) *skiplistNode {
+	var update [skiplistMaxLevel]*skiplistNode
+	var rank [skiplistMaxLevel]int
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		if i < sl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomLevel()
+	if level > sl.level {
+		for i := sl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = sl.header
+			update[i].level[i].span = sl.length
+		}
+		sl.level = level
+	}
+
+	x = &skiplistNode{member: member, score: score, level: make([]skiplistLevel, level)}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+	for i := level; i < sl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != sl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		sl.tail = x
+	}
+	sl.length++
+	return x
+}
+
+// deleteNode unlinks x, given the last node before it on every level.
+func (sl *skiplist) deleteNode(x *skiplistNode, update []*skiplistNode) {
+	for i := 0; i < sl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		sl.tail = x.backward
+	}
+	for sl.level > 1 && sl.header.level[sl.level-1].forward == nil {
+		sl.level--
+	}
+	sl.length--
+}
+
+// delete removes the node with the given score and member, returning true
+// if it was found.
+func (sl *skiplist) delete(score float64, member string) bool {
+	update := make([]*skiplistNode, skiplistMaxLevel)
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	x = x.level[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+	sl.deleteNode(x, update)
+	return true
+}
+
+// rank returns the 1-based rank of the node with the given score and
+// member, or 0 if there is no such node.
+func (sl *skiplist) rank(score float64, member string) int {
+	rank := 0
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil &&
+			(x.level[i].forward.before(score, member) ||
+				(x.level[i].forward.score == score && x.level[i].forward.member == member)) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+		if x != sl.header && x.member == member {
+			return rank
+		}
+	}
+	return 0
+}
+
+// byRank returns the node at the given 1-based rank.
+func (sl *skiplist) byRank(rank int) *skiplistNode {
+	traversed := 0
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+// rangeSpec is a range of scores or, for lexicographical ranges, members.
+// It decides which side of its bounds a node falls on.
+type rangeSpec interface {
+	aboveMin(n *skiplistNode) bool
+	belowMax(n *skiplistNode) bool
+}
+
+// scoreRange is an inclusive or exclusive range of scores.
+type scoreRange struct {
+	min, max     float64
+	minex, maxex bool
+}
+
+func (r scoreRange) aboveMin(n *skiplistNode) bool {
+	if r.minex {
+		return n.score > r.min
+	}
+	return n.score >= r.min
+}
+
+func (r scoreRange) belowMax(n *skiplistNode) bool {
+	if r.maxex {
+		return n.score < r.max
+	}
+	return n.score <= r.max
+}
+
+// lexBound is one end of a lexicographical range. An inf of -1 or 1 stands
+// for the "-" and "+" bounds, which sort before and after every member.
+type lexBound struct {
+	value     string
+	exclusive bool
+	inf       int
+}
+
+// lexRange is a range of members, for sorted sets whose members all have
+// the same score.
+type lexRange struct {
+	min, max lexBound
+}
+
+func (r lexRange) aboveMin(n *skiplistNode) bool {
+	switch r.min.inf {
+	case -1:
+		return true
+	case 1:
+		return false
+	}
+	cmp := strings.Compare(n.member, r.min.value)
+	return cmp > 0 || (cmp == 0 && !r.min.exclusive)
+}
+
+func (r lexRange) belowMax(n *skiplistNode) bool {
+	switch r.max.inf {
+	case -1:
+		return false
+	case 1:
+		return true
+	}
+	cmp := strings.Compare(n.member, r.max.value)
+	return cmp < 0 || (cmp == 0 && !r.max.exclusive)
+}
+
+// firstInRange returns the first node inside the range.
+func (sl *skiplist) firstInRange(r rangeSpec) *skiplistNode {
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.aboveMin(x.level[i].forward) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if x == nil || !r.belowMax(x) {
+		return nil
+	}
+	return x
+}
+
+// lastInRange returns the last node inside the range.
+func (sl *skiplist) lastInRange(r rangeSpec) *skiplistNode {
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.belowMax(x.level[i].forward) {
+			x = x.level[i].forward
+		}
+	}
+	if x == sl.header || !r.aboveMin(x) {
+		return nil
+	}
+	return x
+}
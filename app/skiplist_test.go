@@ -0,0 +1,126 @@
+package main
+
+import (
+	"math/rand"
+	"slices"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// checkSkiplist compares every level of sl and every rank lookup against
+// want, which must be sorted.
+func checkSkiplist(t *testing.T, sl *skiplist, want []zsetEntry) {
+	t.Helper()
+	if sl.length != len(want) {
+		t.Fatalf("length = %d, want %d", sl.length, len(want))
+	}
+	var got []zsetEntry
+	for x := sl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		got = append(got, zsetEntry{x.member, x.score})
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("entries = %v, want %v", got, want)
+	}
+	var back []zsetEntry
+	for x := sl.tail; x != nil; x = x.backward {
+		back = append(back, zsetEntry{x.member, x.score})
+	}
+	slices.Reverse(back)
+	if !slices.Equal(back, want) {
+		t.Fatalf("backward entries = %v, want %v", back, want)
+	}
+	for i, e := range want {
+		if rank := sl.rank(e.score, e.member); rank != i+1 {
+			t.Errorf("rank(%v, %s) = %d, want %d", e.score, e.member, rank, i+1)
+		}
+		if x := sl.byRank(i + 1); x == nil || x.member != e.member {
+			t.Errorf("byRank(%d) = %v, want %s", i+1, x, e.member)
+		}
+	}
+}
+
+func TestSkiplist(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	sl := newSkiplist()
+	scores := map[string]float64{}
+	for i := 0; i < 2000; i++ {
+		member := "m" + strconv.Itoa(rng.Intn(500))
+		if score, ok := scores[member]; ok && rng.Intn(2) == 0 {
+			if !sl.delete(score, member) {
+				t.Fatalf("delete(%v, %s) = false", score, member)
+			}
+			delete(scores, member)
+			continue
+		}
+		if score, ok := scores[member]; ok {
+			sl.delete(score, member)
+		}
+		// Few distinct scores, so ties are ordered by member.
+		score := float64(rng.Intn(20))
+		sl.insert(score, member)
+		scores[member] = score
+	}
+
+	want := []zsetEntry{}
+	for member, score := range scores {
+		want = append(want, zsetEntry{member, score})
+	}
+	sort.Slice(want, func(i, j int) bool {
+		if want[i].score != want[j].score {
+			return want[i].score < want[j].score
+		}
+		return want[i].member < want[j].member
+	})
+	checkSkiplist(t, sl, want)
+
+	if sl.delete(100, "missing") {
+		t.Errorf("delete of a missing member succeeded")
+	}
+	if rank := sl.rank(100, "missing"); rank != 0 {
+		t.Errorf("rank of a missing member = %d", rank)
+	}
+}
+
+func TestSkiplistRanges(t *testing.T) {
+	sl := newSkiplist()
+	for i, member := range []string{"a", "b", "c", "d", "e"} {
+		sl.insert(float64(i+1), member)
+	}
+	same := newSkiplist()
+	for _, member := range []string{"a", "b", "c", "d", "e"} {
+		same.insert(0, member)
+	}
+
+	tests := []struct {
+		name        string
+		sl          *skiplist
+		r           rangeSpec
+		first, last string
+	}{
+		{"all scores", sl, scoreRange{min: 1, max: 5}, "a", "e"},
+		{"exclusive scores", sl, scoreRange{min: 1, max: 5, minex: true, maxex: true}, "b", "d"},
+		{"single score", sl, scoreRange{min: 3, max: 3}, "c", "c"},
+		{"between scores", sl, scoreRange{min: 3.2, max: 3.8}, "", ""},
+		{"above every score", sl, scoreRange{min: 6, max: 10}, "", ""},
+		{"empty exclusive", sl, scoreRange{min: 3, max: 3, minex: true}, "", ""},
+		{"whole lex range", same, lexRange{lexBound{inf: -1}, lexBound{inf: 1}}, "a", "e"},
+		{"inclusive lex", same, lexRange{lexBound{value: "b"}, lexBound{value: "d"}}, "b", "d"},
+		{"exclusive lex", same, lexRange{lexBound{value: "b", exclusive: true}, lexBound{value: "d", exclusive: true}}, "c", "c"},
+		{"lex prefix", same, lexRange{lexBound{value: "bb"}, lexBound{inf: 1}}, "c", "e"},
+		{"inverted lex", same, lexRange{lexBound{inf: 1}, lexBound{inf: -1}}, "", ""},
+	}
+	for _, tt := range tests {
+		first, last := tt.sl.firstInRange(tt.r), tt.sl.lastInRange(tt.r)
+		if nodeMember(first) != tt.first || nodeMember(last) != tt.last {
+			t.Errorf("%s: range is %q to %q, want %q to %q", tt.name, nodeMember(first), nodeMember(last), tt.first, tt.last)
+		}
+	}
+}
+
+func nodeMember(n *skiplistNode) string {
+	if n == nil {
+		return ""
+	}
+	return n.member
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// sortItem is one element being sorted, along with the value it is sorted
+// by.
+type sortItem struct {
+	elem   string
+	score  float64
+	byVal  string
+	hasVal bool
+}
+
+// sortLookup returns the value the BY or GET pattern refers to for elem.
+// The first * in pattern is replaced by elem to form a key, and a trailing
+// ->field selects a field of the hash stored there. The pattern # refers
+// to the element itself. Missing keys and values of other types yield
+// false.
+func (s *Store) sortLookup(pattern, elem string) (string, bool) {
+	if pattern == "#" {
+		return elem, true
+	}
+	star := strings.IndexByte(pattern, '*')
+	if star < 0 {
+		return "", false
+	}
+	key, field := pattern, ""
+	if arrow := strings.Index(pattern[star+1:], "->"); arrow >= 0 {
+		arrow += star + 1
+		if arrow+2 < len(pattern) {
+			key, field = pattern[:arrow], pattern[arrow+2:]
+		}
+	}
+	key = key[:star] + elem + key[star+1:]
+
+	val, found := s.lookup(key)
+	if !found {
+		return "", false
+	}
+	if field != "" {
+		h, ok := val.(*Hash)
+		if !ok {
+			return "", false
+		}
+		return h.Get(field)
+	}
+	switch v := val.(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	}
+	return "", false
+}
+
+// handleSort handles SORT and, with readOnly set, SORT_RO commands.
+func (c *ClientHandler) handleSort(args []string, readOnly bool) error {
+	if len(args) < 1 {
+		return fmt.Errorf("insufficient number of arguments for SORT")
+	}
+	key := args[0]
+	var by, store string
+	var gets []string
+	desc, alpha, dontSort := false, false, false
+	offset, count := 0, -1
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "ASC":
+			desc = false
+		case "DESC":
+			desc = true
+		case "ALPHA":
+			alpha = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return errSyntax
+			}
+			var err error
+			if offset, err = strconv.Atoi(args[i+1]); err != nil {
+				return errNotInteger
+			}
+			if count, err = strconv.Atoi(args[i+2]); err != nil {
+				return errNotInteger
+			}
+			i += 2
+		case "BY":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			by = args[i+1]
+			// A pattern that names no per-element key skips sorting.
+			dontSort = !strings.Contains(by, "*")
+			i++
+		case "GET":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			gets = append(gets, args[i+1])
+			i++
+		case "STORE":
+			if readOnly || i+1 >= len(args) {
+				return errSyntax
+			}
+			store = args[i+1]
+			i++
+		default:
+			return errSyntax
+		}
+	}
+	fmt.Printf("SORT %s command received.", key)
+
+	var elements []string
+	val, found := c.Store.lookup(key)
+	if found {
+		switch v := val.(type) {
+		case *List:
+			elements = slices.Clone(v.Elements())
+		case *Set:
+			elements = v.Members()
+			// Sets have no order of their own, so stored results are
+			// sorted to make them deterministic.
+			if dontSort && store != "" {
+				dontSort, alpha, by = false, true, ""
+			}
+		case *ZSet:
+			for _, entry := range v.Entries() {
+				elements = append(elements, entry.member)
+			}
+			if dontSort && desc {
+				slices.Reverse(elements)
+			}
+		default:
+			return errWrongType
+		}
+	}
+
+	if !dontSort {
+		items := make([]sortItem, len(elements))
+		for i, elem := range elements {
+			item := sortItem{elem: elem, byVal: elem, hasVal: true}
+			if by != "" {
+				item.byVal, item.hasVal = c.Store.sortLookup(by, elem)
+			}
+			if !alpha && item.hasVal {
+				score, err := parseFloat(item.byVal)
+				if err != nil {
+					return fmt.Errorf("One or more scores can't be converted into double")
+				}
+				item.score = score
+			}
+			items[i] = item
+		}
+		slices.SortStableFunc(items, func(a, b sortItem) int {
+			cmp := 0
+			if alpha {
+				switch {
+				case !a.hasVal && !b.hasVal:
+				case !a.hasVal:
+					cmp = -1
+				case !b.hasVal:
+					cmp = 1
+				default:
+					cmp = strings.Compare(a.byVal, b.byVal)
+				}
+			} else {
+				switch {
+				case a.score < b.score:
+					cmp = -1
+				case a.score > b.score:
+					cmp = 1
+				default:
+					// Equal scores fall back to comparing the elements so
+					// that the order is well defined.
+					cmp = strings.Compare(a.elem, b.elem)
+				}
+			}
+			if desc {
+				return -cmp
+			}
+			return cmp
+		})
+		for i, item := range items {
+			elements[i] = item.elem
+		}
+	}
+
+	start := max(offset, 0)
+	end := len(elements)
+	if count >= 0 {
+		end = min(end, start+count)
+	}
+	if start >= end {
+		elements = nil
+	} else {
+		elements = elements[start:end]
+	}
+
+	// Values are collected with a flag telling whether they exist, as a
+	// missing GET value is returned as nil.
+	type sortValue struct {
+		val   string
+		found bool
+	}
+	var values []sortValue
+	for _, elem := range elements {
+		if len(gets) == 0 {
+			values = append(values, sortValue{elem, true})
+			continue
+		}
+		for _, pattern := range gets {
+			val, found := c.Store.sortLookup(pattern, elem)
+			values = append(values, sortValue{val, found})
+		}
+	}
+
+	if store != "" {
+		stored := make([]string, len(values))
+		for i, v := range values {
+			stored[i] = v.val
+		}
+		c.Store.storeResult(store, NewList(stored), len(stored) > 0, notifyList, "sortstore")
+		return c.send(encodeInteger(len(stored)))
+	}
+	c.replicateEffects() // without STORE, SORT only reads
+	encoded := make([]string, len(values))
+	for i, v := range values {
+		if v.found {
+			encoded[i] = encodeBulkString(v.val)
+		} else {
+			encoded[i] = nullResponse
+		}
+	}
+	return c.send(encodeArray(encoded...))
+}
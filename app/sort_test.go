@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestSortLookup(t *testing.T) {
+	s := NewStore()
+	s.setStringValue("weight_a", "10")
+	s.setStringValue("w->x_b", "20")
+	h := NewHash()
+	h.Set("name", "Alice")
+	s.create("user_a", h)
+	s.create("list_a", NewList([]string{"x"}))
+
+	tests := []struct {
+		pattern, elem string
+		want          string
+		wantOK        bool
+	}{
+		{"#", "a", "a", true},
+		{"weight_*", "a", "10", true},
+		{"weight_*", "b", "", false},
+		{"nostar", "a", "", false},
+		{"user_*->name", "a", "Alice", true},
+		{"user_*->age", "a", "", false},
+		{"weight_*->name", "a", "", false},
+		{"list_*", "a", "", false},
+		// A -> before the * is part of the key name.
+		{"w->x_*", "b", "20", true},
+		// So is a trailing -> without a field.
+		{"weight_*->", "a", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := s.sortLookup(tt.pattern, tt.elem)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("sortLookup(%q, %q) = %q, %v", tt.pattern, tt.elem, got, ok)
+		}
+	}
+}
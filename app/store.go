@@ -2,33 +2,86 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
 const (
-	opCodeTypeString byte = 0x00 // following byte(s) are length encoding
-	opCodeAuxField   byte = 0xFA // key, value follow
-	opCodeResizeDB   byte = 0xFB // follwing are 2 length-encoded ints
-	opCodeExpMilSec  byte = 0xFC // following 8 bytes are expration time (ms)
-	opCodeExpSec     byte = 0xFD // following 4 bytes are expration time (s)
-	opCodeSelectDB   byte = 0xFE // following byte is db number
-	opCodeEOF        byte = 0xFF // following 8 bytes are CRC64 checksum
+	opCodeTypeString           byte = 0x00 // following byte(s) are length encoding
+	opCodeTypeSet              byte = 0x02 // length, then member strings
+	opCodeTypeHash             byte = 0x04 // length, then field-value string pairs
+	opCodeTypeZSet2            byte = 0x05 // length, then members with binary scores
+	opCodeTypeSetIntset        byte = 0x0B // string holding an intset blob
+	opCodeTypeStreamListpacks3 byte = 0x15 // stream nodes, metadata and consumer groups
+	opCodeTypeHashMetadata     byte = 0x18 // hash whose fields carry expiration times
+	opCodeFunction2            byte = 0xF5 // string holding a function library's code
+	opCodeAuxField             byte = 0xFA // key, value follow
+	opCodeResizeDB             byte = 0xFB // follwing are 2 length-encoded ints
+	opCodeExpMilSec            byte = 0xFC // following 8 bytes are expration time (ms)
+	opCodeExpSec               byte = 0xFD // following 4 bytes are expration time (s)
+	opCodeSelectDB             byte = 0xFE // following byte is db number
+	opCodeEOF                  byte = 0xFF // following 8 bytes are CRC64 checksum
 )
 
+const (
+	expireCycleInterval = 100 * time.Millisecond // time between active expiry runs
+	expireCycleSamples  = 20                     // keys sampled per expiry pass
+)
+
+var errWrongType = ReplyError{"WRONGTYPE", "Operation against a key holding the wrong kind of value"}
+
 type Store struct {
-	kv     map[string]string
+	kv     map[string]any
+	keys   keyTable // the keys of kv, for SCAN
 	expiry map[string]time.Time
 	db     *os.File
+	mu     sync.Mutex
+	cond   *sync.Cond // broadcast after each command, for blocked clients
+
+	// volatileHashes holds the keys of hashes that have at least one field
+	// with an expiration time, so the expiry cycle doesn't need to scan the
+	// whole keyspace to find them.
+	volatileHashes map[string]struct{}
+
+	// indexes are the FT.CREATE search indexes, by name.
+	indexes map[string]*SearchIndex
+
+	// watchers holds the transactions that WATCH each key.
+	watchers map[string]map[*transaction]struct{}
+
+	// functions are the FUNCTION LOAD libraries, which are saved along with
+	// the keys. It is set by NewServer.
+	functions *functionLibraries
+
+	// events publishes keyspace notifications. It is set by NewServer.
+	events func(class int, event, key string)
+
+	// propagate queues a command for replicas. It is set by NewServer.
+	propagate func(cmd Command)
+
+	// tracking holds the keys read by CLIENT TRACKING clients. It is set by
+	// NewServer.
+	tracking *trackingTable
+
+	// pause is the CLIENT PAUSE in effect, during which keys don't expire.
+	pause clientPause
 }
 
 func NewStore() *Store {
-	kv := make(map[string]string)
+	kv := make(map[string]any)
 	exp := make(map[string]time.Time)
-	return &Store{kv: kv, expiry: exp}
+	s := &Store{kv: kv, expiry: exp, volatileHashes: make(map[string]struct{}), indexes: make(map[string]*SearchIndex), watchers: make(map[string]map[*transaction]struct{})}
+	s.cond = sync.NewCond(&s.mu)
+	return s
 }
 
 // Load loads the in-memory KV map with values from the db.
@@ -38,23 +91,27 @@ func (s *Store) Load(db *os.File) error {
 	}
 	defer db.Close()
 
-	data, err := parseRDB(db, s.expiry)
+	return parseRDB(db, s)
+}
+
+// Save stores the in-memory KV map to the db at the given path. The
+// snapshot is written to a temporary file first and renamed into place, so
+// a failed save never leaves a truncated db behind.
+func (s *Store) Save(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "temp-*.rdb")
 	if err != nil {
-		return err
+		return fmt.Errorf("unable to create temp file: %v", err)
 	}
+	defer os.Remove(tmp.Name())
 
-	for i := 0; i < len(data); i += 2 {
-		if err := s.Add(data[i], data[i+1]); err != nil {
-			return err
-		}
+	if err := writeRDB(tmp, s); err != nil {
+		tmp.Close()
+		return err
 	}
-
-	return nil
-}
-
-// Save stores the in-memory KV map to the db.
-func (s *Store) Save() error {
-	return nil
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
 }
 
 // Get retreives the value for the given key from the KV map. An error
@@ -73,7 +130,13 @@ func (s *Store) Get(key string) (string, error) {
 	if !found {
 		return "", fmt.Errorf("key %q not found", key)
 	}
-	return val, nil
+	switch v := val.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	}
+	return "", errWrongType
 }
 
 // Add stores the KV-pair in the KV map. An error will be returned if the
@@ -83,10 +146,15 @@ func (s *Store) Add(key, val string) error {
 	if found {
 		return fmt.Errorf("key %q already exists", key)
 	}
-	s.kv[key] = val
+	s.put(key, val)
 	return nil
 }
 
+// Set stores the KV-pair in the KV map, replacing any existing value.
+func (s *Store) Set(key, val string) {
+	s.put(key, val)
+}
+
 // Update replaces the value of an existing key to a new one. An error is
 // returned if the key is not found.
 func (s *Store) Update(key, val string) error {
@@ -105,38 +173,150 @@ func (s *Store) Delete(key string) error {
 	if !found {
 		return fmt.Errorf("key %q not found", key)
 	}
-	delete(s.kv, key)
+	s.remove(key)
 	return nil
 }
 
-// parseRDB parses the values in the RDB file.
-func parseRDB(file *os.File, expiry map[string]time.Time) ([]string, error) {
+// wait releases the store lock until another client has executed a command,
+// for commands that block until a key changes. It returns false once the
+// deadline has passed or ctx is cancelled; a zero deadline never expires.
+// The lock must be held by the caller.
+func (s *Store) wait(ctx context.Context, deadline time.Time) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	wake := func() {
+		s.mu.Lock()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}
+	if !deadline.IsZero() {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		timer := time.AfterFunc(time.Until(deadline), wake)
+		defer timer.Stop()
+	}
+	stop := context.AfterFunc(ctx, wake)
+	defer stop()
+
+	s.cond.Wait()
+	return ctx.Err() == nil && (deadline.IsZero() || time.Now().Before(deadline))
+}
+
+// lookup returns the value stored at key. Keys whose expiration time has
+// passed are deleted and reported as missing.
+func (s *Store) lookup(key string) (any, bool) {
+	val, found := s.kv[key]
+	if !found {
+		return nil, false
+	}
+	if exp, ok := s.expiry[key]; ok && exp.Before(time.Now().UTC()) {
+		if s.pause.active() {
+			return nil, false
+		}
+		s.remove(key)
+		s.replicate("DEL", key)
+		s.notify(notifyExpired, "expired", key)
+		return nil, false
+	}
+	return val, true
+}
+
+// put stores val at key, adding the key to the SCAN table if it is new.
+func (s *Store) put(key string, val any) {
+	if _, found := s.kv[key]; !found {
+		s.keys.add(key)
+	}
+	s.kv[key] = val
+}
+
+// create stores val at key, which doesn't exist yet, and reports the new
+// key.
+func (s *Store) create(key string, val any) {
+	s.put(key, val)
+	s.notify(notifyNew, "new", key)
+}
+
+// remove deletes key along with any expiry bookkeeping attached to it, and
+// marks it as modified for transactions watching it.
+func (s *Store) remove(key string) {
+	if _, found := s.kv[key]; found {
+		s.keys.remove(key)
+	}
+	delete(s.kv, key)
+	delete(s.expiry, key)
+	delete(s.volatileHashes, key)
+	s.unindexKey(key)
+	s.touch(key)
+}
+
+// ExpireCycle actively reclaims expired keys and hash fields, so memory is
+// freed even for keys that are never accessed again. Like Redis, it samples
+// keys with an expiration time and keeps going while more than a quarter of
+// a sample turned out to be expired.
+func (s *Store) ExpireCycle() {
+	if s.pause.active() {
+		return
+	}
+	now := time.Now().UTC()
+	for {
+		sampled, expired := 0, 0
+		for key, exp := range s.expiry {
+			if sampled == expireCycleSamples {
+				break
+			}
+			sampled++
+			if exp.Before(now) {
+				s.remove(key)
+				s.replicate("DEL", key)
+				s.notify(notifyExpired, "expired", key)
+				expired++
+			}
+		}
+		if expired*4 <= sampled {
+			break
+		}
+	}
+
+	sampled := 0
+	for key := range s.volatileHashes {
+		if sampled == expireCycleSamples {
+			break
+		}
+		sampled++
+		h, ok := s.kv[key].(*Hash)
+		if !ok {
+			delete(s.volatileHashes, key)
+			continue
+		}
+		if s.expireHashFields(key, h, now) {
+			s.hashChanged(key, h)
+			s.touch(key)
+		} else if !h.IsVolatile() {
+			delete(s.volatileHashes, key)
+		}
+	}
+}
+
+// parseRDB parses the values in the RDB file into the store.
+func parseRDB(file *os.File, s *Store) error {
 	reader := bufio.NewReader(file)
-	result := []string{}
 
 	// Read header.
 	header := make([]byte, 9)
-	_, err := reader.Read(header)
-	if err != nil {
-		return result, err
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return err
 	}
 	fmt.Printf("RDB file header: %s %s", header[:5], header[5:])
 
-	// Skip the junk after the header.
-	if _, err := reader.ReadBytes(opCodeResizeDB); err != nil {
-		return result, err
-	}
-	if _, err := reader.Read(make([]byte, 2)); err != nil {
-		return result, err
-	}
-
 	// Read in the rest of the data.
 	var expiration time.Time
 	var hasExpiration bool
 	for {
 		opcode, err := reader.ReadByte()
 		if err != nil {
-			return result, err
+			return err
 		}
 
 		switch opcode {
@@ -144,84 +324,326 @@ func parseRDB(file *os.File, expiry map[string]time.Time) ([]string, error) {
 			// Follwing byte(s) is the db number.
 			dbNum, err := decodeLength(reader)
 			if err != nil {
-				return result, err
+				return err
 			}
 			fmt.Printf("DB number: %d", dbNum)
 		case opCodeAuxField:
 			// Length prefixed key and value strings follow.
-			kv := [][]byte{}
-			for i := 0; i < 2; i++ {
-				length, err := decodeLength(reader)
-				if err != nil {
-					return result, err
+			key, err := readString(reader)
+			if err != nil {
+				return err
+			}
+			val, err := readString(reader)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("AUX key-value pair: %s: %s", key, val)
+			if key == rdbAuxSearchIndex {
+				if err := s.loadSearchIndex(val); err != nil {
+					return fmt.Errorf("error loading search index: %v", err)
 				}
-				data := make([]byte, int(length))
-				if _, err = reader.Read(data); err != nil {
-					return result, err
+			}
+		case opCodeFunction2:
+			code, err := readString(reader)
+			if err != nil {
+				return err
+			}
+			if s.functions != nil {
+				if _, err := s.functions.load(code, true); err != nil {
+					return fmt.Errorf("error loading function library: %v", err)
 				}
-				kv = append(kv, data)
 			}
-			fmt.Printf("AUX key-value pair: %s: %s", kv[0], kv[1])
 		case opCodeResizeDB:
-			// Implement
+			// Hash table sizes are only a hint, Go maps grow on their own.
+			for i := 0; i < 2; i++ {
+				if _, err := decodeLength(reader); err != nil {
+					return err
+				}
+			}
 		case opCodeExpSec:
 			data := make([]byte, 4)
-			if _, err = reader.Read(data); err != nil {
-				return result, err
+			if _, err = io.ReadFull(reader, data); err != nil {
+				return err
 			}
 			timestamp := binary.LittleEndian.Uint32(data)
 			expiration = time.Unix(int64(timestamp), 0).UTC()
 			hasExpiration = true
 			fmt.Printf("Expiration %s", expiration.String())
 		case opCodeExpMilSec:
-			data := make([]byte, 8)
-			if _, err = reader.Read(data); err != nil {
-				return result, err
+			expiration, err = readMillisecondTime(reader)
+			if err != nil {
+				return err
 			}
-			timestamp := binary.LittleEndian.Uint64(data)
-			expiration = time.UnixMilli(int64(timestamp)).UTC()
 			hasExpiration = true
 			fmt.Printf("Expiration %s", expiration.String())
-		case opCodeTypeString:
-			kv := [][]byte{}
-			for i := 0; i < 2; i++ {
-				length, err := decodeLength(reader)
-				if err != nil {
-					return result, err
-				}
-				data := make([]byte, int(length))
-				if _, err = reader.Read(data); err != nil {
-					return result, err
-				}
-				kv = append(kv, data)
+		case opCodeEOF:
+			// Get the 8-byte checksum after this
+			checksum := make([]byte, 8)
+			if _, err := io.ReadFull(reader, checksum); err != nil {
+				return err
+			}
+			fmt.Printf("Checksum: %s", hex.EncodeToString(checksum))
+			for _, idx := range s.indexes {
+				idx.build(s)
+			}
+			return nil
+		default:
+			// Anything else is a value type, followed by the key and value.
+			key, err := readString(reader)
+			if err != nil {
+				return err
+			}
+			val, err := readObject(reader, opcode)
+			if err != nil {
+				return fmt.Errorf("error reading key %q: %v", key, err)
 			}
 
 			if hasExpiration {
 				hasExpiration = false
 				if expiration.Before(time.Now().UTC()) {
-					hasExpiration = false
 					break
 				}
-				expiry[string(kv[0])] = expiration
+				s.expiry[key] = expiration
 			}
 
-			result = append(result, string(kv[0]), string(kv[1]))
-			fmt.Printf("STRING key-value pair: %s: %s", kv[0], kv[1])
-		case opCodeEOF:
-			// Get the 8-byte checksum after this
-			checksum := make([]byte, 8)
-			_, err := reader.Read(checksum)
+			s.put(key, val)
+			if h, ok := val.(*Hash); ok && h.IsVolatile() {
+				s.volatileHashes[key] = struct{}{}
+			}
+			fmt.Printf("Loaded key %s", key)
+		}
+	}
+}
+
+// readObject reads a value of the given RDB type.
+func readObject(r *bufio.Reader, valueType byte) (any, error) {
+	switch valueType {
+	case opCodeTypeString:
+		return readString(r)
+	case opCodeTypeSet:
+		length, err := decodeLength(r)
+		if err != nil {
+			return nil, err
+		}
+		set := NewSet()
+		for i := 0; i < length; i++ {
+			member, err := readString(r)
 			if err != nil {
-				return result, err
+				return nil, err
 			}
-			fmt.Printf("Checksum: %s", hex.EncodeToString(checksum))
-			return result, nil
-		default:
-			// Handle any other tags.
+			set.Add(member)
+		}
+		return set, nil
+	case opCodeTypeZSet2:
+		length, err := decodeLength(r)
+		if err != nil {
+			return nil, err
+		}
+		z := NewZSet()
+		for i := 0; i < length; i++ {
+			member, err := readString(r)
+			if err != nil {
+				return nil, err
+			}
+			data := make([]byte, 8)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, err
+			}
+			z.Set(member, math.Float64frombits(binary.LittleEndian.Uint64(data)))
+		}
+		return z, nil
+	case opCodeTypeSetIntset:
+		blob, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		return decodeIntset(blob)
+	case opCodeTypeHash:
+		length, err := decodeLength(r)
+		if err != nil {
+			return nil, err
+		}
+		h := NewHash()
+		for i := 0; i < length; i++ {
+			field, err := readString(r)
+			if err != nil {
+				return nil, err
+			}
+			val, err := readString(r)
+			if err != nil {
+				return nil, err
+			}
+			h.Set(field, val)
+		}
+		return h, nil
+	case opCodeTypeList, opCodeTypeListQuicklist2:
+		return readList(r, valueType)
+	case opCodeTypeStreamListpacks3:
+		return readStream(r)
+	case opCodeTypeModule2:
+		return readModule(r)
+	case opCodeTypeHashMetadata:
+		// The smallest field expiration time comes first. Each field's TTL
+		// is then stored relative to it, offset by one so that zero can mean
+		// "no expiration".
+		minExpire, err := readMillisecondTime(r)
+		if err != nil {
+			return nil, err
+		}
+		length, err := decodeLength(r)
+		if err != nil {
+			return nil, err
+		}
+		h := NewHash()
+		now := time.Now().UTC()
+		for i := 0; i < length; i++ {
+			ttl, err := decodeLength(r)
+			if err != nil {
+				return nil, err
+			}
+			field, err := readString(r)
+			if err != nil {
+				return nil, err
+			}
+			val, err := readString(r)
+			if err != nil {
+				return nil, err
+			}
+			if ttl == 0 {
+				h.Set(field, val)
+				continue
+			}
+			at := minExpire.Add(time.Duration(ttl-1) * time.Millisecond)
+			if at.Before(now) {
+				continue
+			}
+			h.Set(field, val)
+			h.Expire(field, at)
 		}
+		return h, nil
+	default:
+		return nil, fmt.Errorf("unsupported RDB value type %#x", valueType)
 	}
 }
 
+// readString reads a length-prefixed string. Besides plain strings, this
+// handles the special encodings for integers and LZF compressed strings.
+func readString(r *bufio.Reader) (string, error) {
+	peek, err := r.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	if peek[0]>>6 != 0b11 {
+		length, err := decodeLength(r)
+		if err != nil {
+			return "", err
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+
+	// Leading bits 11, the remaining 6 bits indicate the format.
+	if _, err := r.ReadByte(); err != nil {
+		return "", err
+	}
+	switch peek[0] & 0b00111111 {
+	case 0: // 8 bit integer
+		num, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprint(int8(num)), nil
+	case 1: // 16 bit integer
+		data := make([]byte, 2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return "", err
+		}
+		return fmt.Sprint(int16(binary.LittleEndian.Uint16(data))), nil
+	case 2: // 32 bit integer
+		data := make([]byte, 4)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return "", err
+		}
+		return fmt.Sprint(int32(binary.LittleEndian.Uint32(data))), nil
+	case 3: // LZF compressed string
+		compressedLen, err := decodeLength(r)
+		if err != nil {
+			return "", err
+		}
+		length, err := decodeLength(r)
+		if err != nil {
+			return "", err
+		}
+		data := make([]byte, compressedLen)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return "", err
+		}
+		str, err := lzfDecompress(data, length)
+		return string(str), err
+	default:
+		return "", fmt.Errorf("unknown string encoding %#x", peek[0])
+	}
+}
+
+// readMillisecondTime reads an 8-byte little-endian unix time in milliseconds.
+func readMillisecondTime(r *bufio.Reader) (time.Time, error) {
+	data := make([]byte, 8)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return time.Time{}, err
+	}
+	timestamp := binary.LittleEndian.Uint64(data)
+	return time.UnixMilli(int64(timestamp)).UTC(), nil
+}
+
+// lzfDecompress expands LZF compressed data, as used by Redis for long
+// strings in RDB files.
+func lzfDecompress(in []byte, length int) ([]byte, error) {
+	errCorrupt := errors.New("corrupt LZF data")
+	out := make([]byte, 0, length)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 1<<5 {
+			// Literal run of ctrl+1 bytes.
+			n := ctrl + 1
+			if i+n > len(in) {
+				return nil, errCorrupt
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+
+		// Back reference into the output.
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, errCorrupt
+			}
+			n += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errCorrupt
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, errCorrupt
+		}
+		for j := 0; j < n+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != length {
+		return nil, errCorrupt
+	}
+	return out, nil
+}
+
 func decodeLength(r *bufio.Reader) (int, error) {
 	num, err := r.ReadByte()
 	if err != nil {
@@ -240,11 +662,16 @@ func decodeLength(r *bufio.Reader) (int, error) {
 		}
 		length := binary.BigEndian.Uint16([]byte{num & 0b00111111, nextNum})
 		return int(length), nil
+	case num == 0x81: // leading bits 10, 64 bit length
+		bytes := make([]byte, 8)
+		if _, err := io.ReadFull(r, bytes); err != nil {
+			return 0, err
+		}
+		return int(binary.BigEndian.Uint64(bytes)), nil
 	case num <= 191: // leading bits 10
 		// Next 4 bytes are the length
 		bytes := make([]byte, 4)
-		_, err := r.Read(bytes)
-		if err != nil {
+		if _, err := io.ReadFull(r, bytes); err != nil {
 			return 0, err
 		}
 		length := binary.BigEndian.Uint32(bytes)
@@ -0,0 +1,1055 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const streamNodeMaxEntries = 100 // entries per node before a new one is started
+
+// Flags of the entries in a serialized stream node.
+const (
+	streamItemFlagDeleted    = 1 << 0 // entry was removed with XDEL or a trim
+	streamItemFlagSameFields = 1 << 1 // entry has the node's master fields
+)
+
+// Trimming strategies for XADD and XTRIM.
+const (
+	streamTrimNone = iota
+	streamTrimMaxLen
+	streamTrimMinID
+)
+
+var (
+	errStreamID       = fmt.Errorf("Invalid stream ID specified as stream command argument")
+	errStreamIDTooLow = fmt.Errorf("The ID specified in XADD is equal or smaller than the target stream top item")
+	streamIDMax       = StreamID{math.MaxUint64, math.MaxUint64}
+)
+
+// StreamID identifies a stream entry by a millisecond timestamp and a
+// sequence number for entries created within the same millisecond.
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+func (id StreamID) String() string {
+	return fmt.Sprintf("%d-%d", id.Ms, id.Seq)
+}
+
+// Less reports whether id sorts before other.
+func (id StreamID) Less(other StreamID) bool {
+	return id.Ms < other.Ms || (id.Ms == other.Ms && id.Seq < other.Seq)
+}
+
+// IsZero reports whether id is 0-0.
+func (id StreamID) IsZero() bool {
+	return id.Ms == 0 && id.Seq == 0
+}
+
+// next returns the smallest ID greater than id. It returns false if id is
+// already the greatest possible ID.
+func (id StreamID) next() (StreamID, bool) {
+	switch {
+	case id.Seq < math.MaxUint64:
+		return StreamID{id.Ms, id.Seq + 1}, true
+	case id.Ms < math.MaxUint64:
+		return StreamID{id.Ms + 1, 0}, true
+	}
+	return id, false
+}
+
+// prev returns the greatest ID smaller than id. It returns false if id is
+// 0-0.
+func (id StreamID) prev() (StreamID, bool) {
+	switch {
+	case id.Seq > 0:
+		return StreamID{id.Ms, id.Seq - 1}, true
+	case id.Ms > 0:
+		return StreamID{id.Ms - 1, math.MaxUint64}, true
+	}
+	return id, false
+}
+
+// bytes returns the 128 bit big-endian form of id used as a radix tree key
+// and in RDB files.
+func (id StreamID) bytes() []byte {
+	buf := binary.BigEndian.AppendUint64(nil, id.Ms)
+	return binary.BigEndian.AppendUint64(buf, id.Seq)
+}
+
+// parseStreamID parses an ID given as "ms-seq" or just "ms", in which case
+// the sequence number is set to missingSeq.
+func parseStreamID(arg string, missingSeq uint64) (StreamID, error) {
+	msPart, seqPart, hasSeq := strings.Cut(arg, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return StreamID{}, errStreamID
+	}
+	if !hasSeq {
+		return StreamID{ms, missingSeq}, nil
+	}
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return StreamID{}, errStreamID
+	}
+	return StreamID{ms, seq}, nil
+}
+
+// parseRangeID parses the start or end of an XRANGE interval, which may be
+// "-", "+", or an ID prefixed by "(" to exclude it.
+func parseRangeID(arg string, isStart bool) (StreamID, error) {
+	switch arg {
+	case "-":
+		return StreamID{}, nil
+	case "+":
+		return streamIDMax, nil
+	}
+	missingSeq := uint64(0)
+	if !isStart {
+		missingSeq = math.MaxUint64
+	}
+	exclusive := strings.HasPrefix(arg, "(")
+	if !exclusive {
+		return parseStreamID(arg, missingSeq)
+	}
+
+	id, err := parseStreamID(arg[1:], missingSeq)
+	if err != nil {
+		return id, err
+	}
+	var ok bool
+	if isStart {
+		id, ok = id.next()
+	} else {
+		id, ok = id.prev()
+	}
+	if !ok {
+		return id, fmt.Errorf("invalid start or end ID for the interval")
+	}
+	return id, nil
+}
+
+// streamEntry is a single entry of a stream. Deleted entries stay in their
+// node, flagged, until the whole node can be freed.
+type streamEntry struct {
+	id      StreamID
+	fields  []string // field-value pairs
+	deleted bool
+}
+
+// streamNode holds a run of consecutive entries, keyed by the ID of the
+// first one. It is the in-memory counterpart of the listpacks Redis keeps in
+// the radix tree of a stream.
+type streamNode struct {
+	master  StreamID
+	entries []*streamEntry
+	live    int // entries not deleted
+}
+
+// Stream is an append-only log of entries with unique, increasing IDs.
+// Entries are grouped into nodes of up to streamNodeMaxEntries, kept in ID
+// order so that seeks are a binary search over the nodes followed by a scan
+// of a single node, as with the radix tree of listpacks used by Redis.
+type Stream struct {
+	nodes        []*streamNode
+	length       int
+	lastID       StreamID
+	maxDeletedID StreamID
+	entriesAdded uint64
+	groups       map[string]*consumerGroup
+}
+
+func NewStream() *Stream {
+	return &Stream{groups: make(map[string]*consumerGroup)}
+}
+
+// Len returns the number of entries in the stream.
+func (s *Stream) Len() int {
+	return s.length
+}
+
+// nextID returns the ID for a new entry added at the given time.
+func (s *Stream) nextID(now time.Time) (StreamID, error) {
+	ms := uint64(now.UnixMilli())
+	if ms > s.lastID.Ms {
+		return StreamID{ms, 0}, nil
+	}
+	id, ok := s.lastID.next()
+	if !ok {
+		return id, fmt.Errorf("The stream has exhausted the last possible ID, unable to add more items")
+	}
+	return id, nil
+}
+
+// Append adds an entry, whose ID must be greater than the last ID.
+func (s *Stream) Append(id StreamID, fields []string) {
+	var node *streamNode
+	if len(s.nodes) > 0 {
+		node = s.nodes[len(s.nodes)-1]
+	}
+	if node == nil || len(node.entries) >= streamNodeMaxEntries {
+		node = &streamNode{master: id}
+		s.nodes = append(s.nodes, node)
+	}
+	node.entries = append(node.entries, &streamEntry{id: id, fields: fields})
+	node.live++
+	s.length++
+	s.lastID = id
+	s.entriesAdded++
+}
+
+// firstEntry returns the oldest entry, or nil if the stream is empty.
+func (s *Stream) firstEntry() *streamEntry {
+	entries := s.Range(StreamID{}, streamIDMax, 1, false)
+	if len(entries) == 0 {
+		return nil
+	}
+	return entries[0]
+}
+
+// lastEntry returns the newest entry, or nil if the stream is empty.
+func (s *Stream) lastEntry() *streamEntry {
+	entries := s.Range(StreamID{}, streamIDMax, 1, true)
+	if len(entries) == 0 {
+		return nil
+	}
+	return entries[0]
+}
+
+// firstID returns the ID of the oldest entry, or 0-0 if there is none.
+func (s *Stream) firstID() StreamID {
+	if e := s.firstEntry(); e != nil {
+		return e.id
+	}
+	return StreamID{}
+}
+
+// findNode returns the index of the first node that may hold an entry with
+// an ID of at least id.
+func (s *Stream) findNode(id StreamID) int {
+	return sort.Search(len(s.nodes), func(i int) bool {
+		entries := s.nodes[i].entries
+		return !entries[len(entries)-1].id.Less(id)
+	})
+}
+
+// Range returns up to count entries with IDs between start and end,
+// inclusive, in ascending order or descending when reverse is set. A count
+// of 0 or less returns every entry in the range.
+func (s *Stream) Range(start, end StreamID, count int, reverse bool) []*streamEntry {
+	entries := []*streamEntry{}
+	if end.Less(start) {
+		return entries
+	}
+	inRange := func(e *streamEntry) bool {
+		return !e.deleted && !e.id.Less(start) && !end.Less(e.id)
+	}
+	full := func() bool { return count > 0 && len(entries) >= count }
+
+	if !reverse {
+		for n := s.findNode(start); n < len(s.nodes) && !full(); n++ {
+			for _, e := range s.nodes[n].entries {
+				if end.Less(e.id) || full() {
+					return entries
+				}
+				if inRange(e) {
+					entries = append(entries, e)
+				}
+			}
+		}
+		return entries
+	}
+
+	last := min(s.findNode(end), len(s.nodes)-1)
+	for n := last; n >= 0 && !full(); n-- {
+		node := s.nodes[n].entries
+		for i := len(node) - 1; i >= 0; i-- {
+			e := node[i]
+			if e.id.Less(start) || full() {
+				return entries
+			}
+			if inRange(e) {
+				entries = append(entries, e)
+			}
+		}
+	}
+	return entries
+}
+
+// Get returns the entry with the given ID, or nil if there is none.
+func (s *Stream) Get(id StreamID) *streamEntry {
+	entries := s.Range(id, id, 1, false)
+	if len(entries) == 0 {
+		return nil
+	}
+	return entries[0]
+}
+
+// Delete removes the entry with the given ID, returning true if it existed.
+func (s *Stream) Delete(id StreamID) bool {
+	n := s.findNode(id)
+	if n == len(s.nodes) {
+		return false
+	}
+	node := s.nodes[n]
+	for _, e := range node.entries {
+		if e.id != id || e.deleted {
+			continue
+		}
+		e.deleted = true
+		node.live--
+		s.length--
+		if s.maxDeletedID.Less(id) {
+			s.maxDeletedID = id
+		}
+		if node.live == 0 {
+			s.nodes = append(s.nodes[:n], s.nodes[n+1:]...)
+		}
+		return true
+	}
+	return false
+}
+
+// streamTrim holds the parsed MAXLEN or MINID trimming arguments.
+type streamTrim struct {
+	strategy int
+	maxLen   int
+	minID    StreamID
+	approx   bool
+	limit    int
+}
+
+// parseStreamTrim parses "MAXLEN|MINID [=|~] threshold [LIMIT count]" at the
+// start of args, returning the number of arguments consumed.
+func parseStreamTrim(args []string) (streamTrim, int, error) {
+	var t streamTrim
+	if len(args) == 0 {
+		return t, 0, nil
+	}
+	switch strings.ToUpper(args[0]) {
+	case "MAXLEN":
+		t.strategy = streamTrimMaxLen
+	case "MINID":
+		t.strategy = streamTrimMinID
+	default:
+		return t, 0, nil
+	}
+
+	i := 1
+	if i < len(args) && (args[i] == "~" || args[i] == "=") {
+		t.approx = args[i] == "~"
+		i++
+	}
+	if i >= len(args) {
+		return t, 0, errSyntax
+	}
+	if t.strategy == streamTrimMaxLen {
+		maxLen, err := strconv.Atoi(args[i])
+		if err != nil {
+			return t, 0, errNotInteger
+		}
+		if maxLen < 0 {
+			return t, 0, fmt.Errorf("The MAXLEN argument must be >= 0.")
+		}
+		t.maxLen = maxLen
+	} else {
+		minID, err := parseStreamID(args[i], 0)
+		if err != nil {
+			return t, 0, err
+		}
+		t.minID = minID
+	}
+	i++
+
+	t.limit = 100 * streamNodeMaxEntries
+	if i+1 < len(args) && strings.ToUpper(args[i]) == "LIMIT" {
+		if !t.approx {
+			return t, 0, fmt.Errorf("syntax error, LIMIT cannot be used without the special ~ option")
+		}
+		limit, err := strconv.Atoi(args[i+1])
+		if err != nil || limit < 0 {
+			return t, 0, fmt.Errorf("The LIMIT argument must be >= 0.")
+		}
+		t.limit = limit
+		i += 2
+	}
+	if !t.approx {
+		t.limit = 0
+	}
+	return t, i, nil
+}
+
+// Trim removes the oldest entries according to t and returns the number of
+// entries removed. Approximate trimming only frees whole nodes, which is
+// much cheaper but may leave more entries than requested. A limit of 0
+// means there is no limit on the number of entries removed.
+func (s *Stream) Trim(t streamTrim) int {
+	removed := 0
+	for len(s.nodes) > 0 {
+		node := s.nodes[0]
+		lastID := node.entries[len(node.entries)-1].id
+
+		var removeNode bool
+		switch t.strategy {
+		case streamTrimMaxLen:
+			removeNode = s.length-node.live >= t.maxLen
+		case streamTrimMinID:
+			removeNode = lastID.Less(t.minID)
+		default:
+			return removed
+		}
+		if removeNode {
+			if t.limit > 0 && removed+node.live > t.limit {
+				break
+			}
+			s.length -= node.live
+			removed += node.live
+			s.nodes = s.nodes[1:]
+			continue
+		}
+		if t.approx {
+			break
+		}
+
+		// Remove single entries from the node, leaving it in place.
+		for _, e := range node.entries {
+			if e.deleted {
+				continue
+			}
+			if t.strategy == streamTrimMaxLen && s.length <= t.maxLen ||
+				t.strategy == streamTrimMinID && !e.id.Less(t.minID) {
+				break
+			}
+			e.deleted = true
+			node.live--
+			s.length--
+			removed++
+		}
+		break
+	}
+	return removed
+}
+
+// hasTombstones reports whether entries may have been deleted from the
+// stream at or after id, which makes entry counts since id unreliable.
+func (s *Stream) hasTombstones(id StreamID) bool {
+	if s.length == 0 || s.maxDeletedID.IsZero() {
+		return false
+	}
+	return !s.maxDeletedID.Less(id)
+}
+
+// entriesBefore estimates the number of entries ever added up to and
+// including id, or returns -1 if that can't be known because of deletions.
+func (s *Stream) entriesBefore(id StreamID) int64 {
+	if s.entriesAdded == 0 {
+		return 0
+	}
+	if s.length == 0 && !s.lastID.Less(id) {
+		return int64(s.entriesAdded)
+	}
+	if id == s.lastID {
+		return int64(s.entriesAdded)
+	}
+	if s.lastID.Less(id) {
+		return -1
+	}
+	first := s.firstID()
+	if s.maxDeletedID.IsZero() || s.maxDeletedID.Less(first) {
+		if id.Less(first) {
+			return int64(s.entriesAdded) - int64(s.length)
+		}
+		if id == first {
+			return int64(s.entriesAdded) - int64(s.length) + 1
+		}
+	}
+	return -1
+}
+
+// stream returns the stream stored at key. If there is no such key, a new
+// stream is created when create is true and nil is returned otherwise.
+func (s *Store) stream(key string, create bool) (*Stream, error) {
+	val, found := s.lookup(key)
+	if !found {
+		if !create {
+			return nil, nil
+		}
+		st := NewStream()
+		s.create(key, st)
+		return st, nil
+	}
+	st, ok := val.(*Stream)
+	if !ok {
+		return nil, errWrongType
+	}
+	return st, nil
+}
+
+// encodeStreamEntries encodes entries as an array of [id, [field, value,
+// ...]] pairs. Nil entries stand for deleted ones, and are encoded with a
+// null list of fields.
+func encodeStreamEntries(ids []StreamID, entries []*streamEntry) string {
+	result := make([]string, 0, len(entries))
+	for i, e := range entries {
+		if e == nil {
+			result = append(result, encodeArray(encodeBulkString(ids[i].String()), nullArrayResponse))
+			continue
+		}
+		result = append(result, encodeArray(
+			encodeBulkString(e.id.String()),
+			encodeBulkStringArray(len(e.fields), e.fields...),
+		))
+	}
+	return encodeArray(result...)
+}
+
+// handleXAdd handles XADD commands.
+func (c *ClientHandler) handleXAdd(args []string) error {
+	if len(args) < 4 {
+		return fmt.Errorf("insufficient number of arguments for XADD")
+	}
+	key := args[0]
+	argv := args
+	args = args[1:]
+
+	noMkStream := false
+	if strings.ToUpper(args[0]) == "NOMKSTREAM" {
+		noMkStream = true
+		args = args[1:]
+	}
+	trim, n, err := parseStreamTrim(args)
+	if err != nil {
+		return err
+	}
+	args = args[n:]
+	if len(args) < 3 || len(args)%2 == 0 {
+		return fmt.Errorf("wrong number of arguments for XADD")
+	}
+	idArg, fields := args[0], args[1:]
+
+	st, err := c.Store.stream(key, false)
+	if err != nil {
+		return err
+	}
+	if st == nil {
+		if noMkStream {
+			return c.send(nullResponse)
+		}
+		st = NewStream()
+	}
+
+	var id StreamID
+	switch {
+	case idArg == "*":
+		if id, err = st.nextID(time.Now()); err != nil {
+			return err
+		}
+	case strings.HasSuffix(idArg, "-*"):
+		ms, err := strconv.ParseUint(strings.TrimSuffix(idArg, "-*"), 10, 64)
+		if err != nil {
+			return errStreamID
+		}
+		switch {
+		case ms < st.lastID.Ms:
+			return errStreamIDTooLow
+		case ms == st.lastID.Ms && st.entriesAdded > 0:
+			if st.lastID.Seq == math.MaxUint64 {
+				return errStreamIDTooLow
+			}
+			id = StreamID{ms, st.lastID.Seq + 1}
+		case ms == 0:
+			id = StreamID{0, 1}
+		default:
+			id = StreamID{ms, 0}
+		}
+	default:
+		if id, err = parseStreamID(idArg, 0); err != nil {
+			return err
+		}
+		if id.IsZero() {
+			return fmt.Errorf("The ID specified in XADD must be greater than 0-0")
+		}
+		if !st.lastID.Less(id) {
+			return errStreamIDTooLow
+		}
+	}
+	fmt.Printf("XADD %s %s command received.", key, id)
+
+	if _, found := c.Store.kv[key]; !found {
+		c.Store.create(key, st)
+	}
+	st.Append(id, append([]string(nil), fields...))
+	// Replicas are given the ID the entry was added with.
+	effect := slices.Clone(argv)
+	effect[len(argv)-len(args)] = id.String()
+	c.replicateEffects(Command{"XADD", effect})
+	c.Store.notify(notifyStream, "xadd", key)
+	if st.Trim(trim) > 0 {
+		c.Store.notify(notifyStream, "xtrim", key)
+	}
+	c.Store.touch(key)
+	return c.send(encodeBulkString(id.String()))
+}
+
+// handleXRange handles XRANGE and XREVRANGE commands. XREVRANGE takes the
+// end of the interval first.
+func (c *ClientHandler) handleXRange(args []string, reverse bool) error {
+	if len(args) != 3 && len(args) != 5 {
+		return fmt.Errorf("wrong number of arguments for XRANGE")
+	}
+	startArg, endArg := args[1], args[2]
+	if reverse {
+		startArg, endArg = endArg, startArg
+	}
+	start, err := parseRangeID(startArg, true)
+	if err != nil {
+		return err
+	}
+	end, err := parseRangeID(endArg, false)
+	if err != nil {
+		return err
+	}
+	count := -1
+	if len(args) == 5 {
+		if strings.ToUpper(args[3]) != "COUNT" {
+			return errSyntax
+		}
+		if count, err = strconv.Atoi(args[4]); err != nil {
+			return errNotInteger
+		}
+		if count <= 0 {
+			return c.send(encodeArray())
+		}
+	}
+
+	st, err := c.Store.stream(args[0], false)
+	if err != nil {
+		return err
+	}
+	if st == nil {
+		return c.send(encodeArray())
+	}
+	return c.send(encodeStreamEntries(nil, st.Range(start, end, count, reverse)))
+}
+
+// handleXLen handles XLEN commands.
+func (c *ClientHandler) handleXLen(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("wrong number of arguments for XLEN")
+	}
+	st, err := c.Store.stream(args[0], false)
+	if err != nil {
+		return err
+	}
+	if st == nil {
+		return c.send(encodeInteger(0))
+	}
+	return c.send(encodeInteger(st.Len()))
+}
+
+// handleXDel handles XDEL commands.
+func (c *ClientHandler) handleXDel(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("insufficient number of arguments for XDEL")
+	}
+	ids := make([]StreamID, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		id, err := parseStreamID(arg, 0)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	st, err := c.Store.stream(args[0], false)
+	if err != nil {
+		return err
+	}
+	deleted := 0
+	for _, id := range ids {
+		if st != nil && st.Delete(id) {
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		c.Store.notify(notifyStream, "xdel", args[0])
+		c.Store.touch(args[0])
+	}
+	return c.send(encodeInteger(deleted))
+}
+
+// handleXTrim handles XTRIM commands.
+func (c *ClientHandler) handleXTrim(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("insufficient number of arguments for XTRIM")
+	}
+	trim, n, err := parseStreamTrim(args[1:])
+	if err != nil {
+		return err
+	}
+	if trim.strategy == streamTrimNone || n != len(args)-1 {
+		return errSyntax
+	}
+	st, err := c.Store.stream(args[0], false)
+	if err != nil {
+		return err
+	}
+	if st == nil {
+		return c.send(encodeInteger(0))
+	}
+	trimmed := st.Trim(trim)
+	if trimmed > 0 {
+		c.Store.notify(notifyStream, "xtrim", args[0])
+		c.Store.touch(args[0])
+	}
+	return c.send(encodeInteger(trimmed))
+}
+
+// streamReadArgs holds the arguments shared by XREAD and XREADGROUP.
+type streamReadArgs struct {
+	count    int
+	block    bool
+	deadline time.Time
+	noAck    bool
+	keys     []string
+	ids      []string
+}
+
+// parseStreamReadArgs parses the options and STREAMS block of XREAD and,
+// with group set, XREADGROUP.
+func parseStreamReadArgs(args []string, group bool) (streamReadArgs, error) {
+	var r streamReadArgs
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COUNT":
+			if i+1 >= len(args) {
+				return r, errSyntax
+			}
+			count, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return r, errNotInteger
+			}
+			r.count = max(count, 0)
+			i++
+		case "BLOCK":
+			if i+1 >= len(args) {
+				return r, errSyntax
+			}
+			deadline, err := parseBlockTimeout(args[i+1], time.Millisecond)
+			if err != nil {
+				return r, err
+			}
+			r.block, r.deadline = true, deadline
+			i++
+		case "NOACK":
+			if !group {
+				return r, errSyntax
+			}
+			r.noAck = true
+		case "STREAMS":
+			rest := args[i+1:]
+			if len(rest) == 0 || len(rest)%2 != 0 {
+				return r, fmt.Errorf("Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.")
+			}
+			r.keys, r.ids = rest[:len(rest)/2], rest[len(rest)/2:]
+			return r, nil
+		default:
+			return r, errSyntax
+		}
+	}
+	return r, errSyntax
+}
+
+// handleXRead handles XREAD commands.
+func (c *ClientHandler) handleXRead(args []string) error {
+	r, err := parseStreamReadArgs(args, false)
+	if err != nil {
+		return err
+	}
+
+	// Resolve the IDs up front, so that "$" refers to the last entry at
+	// the time the command was issued even when it blocks.
+	after := make([]StreamID, len(r.keys))
+	for i, key := range r.keys {
+		st, err := c.Store.stream(key, false)
+		if err != nil {
+			return err
+		}
+		switch r.ids[i] {
+		case "$":
+			if st != nil {
+				after[i] = st.lastID
+			}
+		case "+":
+			if st != nil {
+				if last := st.lastEntry(); last != nil {
+					after[i], _ = last.id.prev()
+				}
+			}
+		default:
+			if after[i], err = parseStreamID(r.ids[i], 0); err != nil {
+				return err
+			}
+		}
+	}
+
+	for {
+		result := []string{}
+		for i, key := range r.keys {
+			st, err := c.Store.stream(key, false)
+			if err != nil {
+				return err
+			}
+			if st == nil {
+				continue
+			}
+			start, ok := after[i].next()
+			if !ok {
+				continue
+			}
+			entries := st.Range(start, streamIDMax, r.count, false)
+			if len(entries) > 0 {
+				result = append(result, encodeArray(encodeBulkString(key), encodeStreamEntries(nil, entries)))
+			}
+		}
+		if len(result) > 0 {
+			return c.send(encodeArray(result...))
+		}
+		if !r.block || !c.wait(r.deadline) {
+			if c.Context.Err() != nil {
+				return nil
+			}
+			return c.send(nullArrayResponse)
+		}
+	}
+}
+
+// readStream reads a stream saved in the STREAM_LISTPACKS_3 RDB format.
+func readStream(r *bufio.Reader) (*Stream, error) {
+	st := NewStream()
+	numNodes, err := decodeLength(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < numNodes; i++ {
+		key, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != 16 {
+			return nil, fmt.Errorf("invalid stream node key")
+		}
+		master := StreamID{binary.BigEndian.Uint64([]byte(key)), binary.BigEndian.Uint64([]byte(key[8:]))}
+		blob, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		node, err := decodeStreamNode(master, []byte(blob))
+		if err != nil {
+			return nil, err
+		}
+		if node.live > 0 {
+			st.nodes = append(st.nodes, node)
+		}
+	}
+
+	var nums [8]int
+	for i := range nums {
+		if nums[i], err = decodeLength(r); err != nil {
+			return nil, err
+		}
+	}
+	st.length = nums[0]
+	st.lastID = StreamID{uint64(nums[1]), uint64(nums[2])}
+	// nums[3] and nums[4] are the first ID, which is derived from the nodes.
+	st.maxDeletedID = StreamID{uint64(nums[5]), uint64(nums[6])}
+	st.entriesAdded = uint64(nums[7])
+
+	numGroups, err := decodeLength(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < numGroups; i++ {
+		name, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		g, err := readConsumerGroup(r)
+		if err != nil {
+			return nil, err
+		}
+		st.groups[name] = g
+	}
+	return st, nil
+}
+
+// decodeStreamNode decodes the listpack of a stream node. It starts with a
+// master entry holding the entry counts and the fields of the first entry,
+// which later entries with the same fields don't repeat.
+func decodeStreamNode(master StreamID, blob []byte) (*streamNode, error) {
+	elements, err := decodeListpack(blob)
+	if err != nil {
+		return nil, err
+	}
+	errCorrupt := fmt.Errorf("corrupt stream node")
+	pos := 0
+	nextInt := func() (int64, error) {
+		if pos >= len(elements) {
+			return 0, errCorrupt
+		}
+		num, err := strconv.ParseInt(elements[pos], 10, 64)
+		pos++
+		return num, err
+	}
+	nextStrings := func(n int64) ([]string, error) {
+		if n < 0 || pos+int(n) > len(elements) {
+			return nil, errCorrupt
+		}
+		strs := elements[pos : pos+int(n)]
+		pos += int(n)
+		return strs, nil
+	}
+
+	node := &streamNode{master: master}
+	var header [3]int64 // live count, deleted count, number of master fields
+	for i := range header {
+		if header[i], err = nextInt(); err != nil {
+			return nil, errCorrupt
+		}
+	}
+	masterFields, err := nextStrings(header[2])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := nextInt(); err != nil { // master entry terminator
+		return nil, errCorrupt
+	}
+
+	for pos < len(elements) {
+		flags, err := nextInt()
+		if err != nil {
+			return nil, errCorrupt
+		}
+		msDiff, err := nextInt()
+		if err != nil {
+			return nil, errCorrupt
+		}
+		seqDiff, err := nextInt()
+		if err != nil {
+			return nil, errCorrupt
+		}
+		e := &streamEntry{
+			id:      StreamID{master.Ms + uint64(msDiff), master.Seq + uint64(seqDiff)},
+			deleted: flags&streamItemFlagDeleted != 0,
+		}
+		if flags&streamItemFlagSameFields != 0 {
+			values, err := nextStrings(int64(len(masterFields)))
+			if err != nil {
+				return nil, err
+			}
+			for i, field := range masterFields {
+				e.fields = append(e.fields, field, values[i])
+			}
+		} else {
+			numFields, err := nextInt()
+			if err != nil {
+				return nil, errCorrupt
+			}
+			pairs, err := nextStrings(2 * numFields)
+			if err != nil {
+				return nil, err
+			}
+			e.fields = append([]string(nil), pairs...)
+		}
+		if _, err := nextInt(); err != nil { // lp-count, for backward iteration
+			return nil, errCorrupt
+		}
+		node.entries = append(node.entries, e)
+		if !e.deleted {
+			node.live++
+		}
+	}
+	return node, nil
+}
+
+// writeStream writes st in the STREAM_LISTPACKS_3 RDB format.
+func (rw *rdbWriter) writeStream(st *Stream) {
+	rw.writeLength(len(st.nodes))
+	for _, node := range st.nodes {
+		rw.writeString(string(node.master.bytes()))
+		rw.writeString(string(node.listpack()))
+	}
+
+	first := st.firstID()
+	for _, num := range []uint64{
+		uint64(st.length),
+		st.lastID.Ms, st.lastID.Seq,
+		first.Ms, first.Seq,
+		st.maxDeletedID.Ms, st.maxDeletedID.Seq,
+		st.entriesAdded,
+	} {
+		rw.writeLength(int(num))
+	}
+
+	names := st.groupNames()
+	rw.writeLength(len(names))
+	for _, name := range names {
+		rw.writeString(name)
+		rw.writeConsumerGroup(st.groups[name])
+	}
+}
+
+// listpack serializes the node in the layout read by decodeStreamNode.
+func (n *streamNode) listpack() []byte {
+	lp := newListpackWriter()
+	var masterFields []string
+	for i := 0; i < len(n.entries[0].fields); i += 2 {
+		masterFields = append(masterFields, n.entries[0].fields[i])
+	}
+	lp.appendInt(int64(n.live))
+	lp.appendInt(int64(len(n.entries) - n.live))
+	lp.appendInt(int64(len(masterFields)))
+	for _, field := range masterFields {
+		lp.appendString(field)
+	}
+	lp.appendInt(0)
+
+	for _, e := range n.entries {
+		numFields := len(e.fields) / 2
+		sameFields := numFields == len(masterFields)
+		for i := 0; sameFields && i < numFields; i++ {
+			sameFields = e.fields[2*i] == masterFields[i]
+		}
+
+		flags := int64(0)
+		if e.deleted {
+			flags |= streamItemFlagDeleted
+		}
+		if sameFields {
+			flags |= streamItemFlagSameFields
+		}
+		lp.appendInt(flags)
+		lp.appendInt(int64(e.id.Ms - n.master.Ms))
+		lp.appendInt(int64(e.id.Seq - n.master.Seq))
+		if sameFields {
+			for i := 1; i < len(e.fields); i += 2 {
+				lp.appendString(e.fields[i])
+			}
+			lp.appendInt(int64(numFields + 3))
+		} else {
+			lp.appendInt(int64(numFields))
+			for _, str := range e.fields {
+				lp.appendString(str)
+			}
+			lp.appendInt(int64(2*numFields + 4))
+		}
+	}
+	return lp.bytes()
+}
@@ -0,0 +1,1056 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// consumerGroup tracks the entries delivered to a group of consumers that
+// share the work of reading a stream. Entries stay in the pending entries
+// list (PEL) until a consumer acknowledges them.
+type consumerGroup struct {
+	lastID      StreamID // last entry delivered to the group
+	entriesRead int64    // entries delivered since the stream began, -1 if unknown
+	pel         map[StreamID]*pendingEntry
+	consumers   map[string]*streamConsumer
+}
+
+// pendingEntry is an entry delivered to a consumer but not acknowledged.
+type pendingEntry struct {
+	consumer      *streamConsumer
+	deliveryTime  time.Time
+	deliveryCount int
+}
+
+// streamConsumer is a member of a consumer group, with the entries it has
+// been delivered and not yet acknowledged.
+type streamConsumer struct {
+	name       string
+	seenTime   time.Time // last attempted interaction
+	activeTime time.Time // last successful interaction
+	pel        map[StreamID]*pendingEntry
+}
+
+func newConsumerGroup(lastID StreamID, entriesRead int64) *consumerGroup {
+	return &consumerGroup{
+		lastID:      lastID,
+		entriesRead: entriesRead,
+		pel:         make(map[StreamID]*pendingEntry),
+		consumers:   make(map[string]*streamConsumer),
+	}
+}
+
+// consumer returns the named consumer, creating it if needed.
+func (g *consumerGroup) consumer(name string, now time.Time) *streamConsumer {
+	c, found := g.consumers[name]
+	if !found {
+		c = &streamConsumer{name: name, pel: make(map[StreamID]*pendingEntry)}
+		g.consumers[name] = c
+	}
+	c.seenTime = now
+	return c
+}
+
+// deliver adds id to the PEL of consumer c, taking it over from any other
+// consumer it was pending for.
+func (g *consumerGroup) deliver(c *streamConsumer, id StreamID, now time.Time) {
+	pe, found := g.pel[id]
+	if found {
+		delete(pe.consumer.pel, id)
+	} else {
+		pe = &pendingEntry{}
+		g.pel[id] = pe
+	}
+	pe.consumer = c
+	pe.deliveryTime = now
+	pe.deliveryCount++
+	c.pel[id] = pe
+}
+
+// ack removes id from the PEL, returning true if it was pending.
+func (g *consumerGroup) ack(id StreamID) bool {
+	pe, found := g.pel[id]
+	if !found {
+		return false
+	}
+	delete(pe.consumer.pel, id)
+	delete(g.pel, id)
+	return true
+}
+
+// claimEffect returns the XCLAIM that gives replicas the pending entry id
+// of g as it is here: delivered to the same consumer, at the same time and
+// as many times, with the group's last delivered ID.
+func claimEffect(key, group string, g *consumerGroup, id StreamID) Command {
+	pe := g.pel[id]
+	return Command{"XCLAIM", []string{
+		key, group, pe.consumer.name, "0", id.String(),
+		"TIME", strconv.FormatInt(pe.deliveryTime.UnixMilli(), 10),
+		"RETRYCOUNT", strconv.Itoa(pe.deliveryCount),
+		"FORCE", "JUSTID", "LASTID", g.lastID.String(),
+	}}
+}
+
+// setIDEffect returns the XGROUP SETID that gives replicas the last
+// delivered ID and read counter of g.
+func setIDEffect(key, group string, g *consumerGroup) Command {
+	return Command{"XGROUP", []string{"SETID", key, group, g.lastID.String(), "ENTRIESREAD", strconv.FormatInt(g.entriesRead, 10)}}
+}
+
+// groupConsumer returns the named consumer of g, creating it if needed.
+// Replicas are told about new consumers, which the commands that create
+// them are not sent as.
+func (c *ClientHandler) groupConsumer(key, group string, g *consumerGroup, name string, now time.Time) *streamConsumer {
+	if _, found := g.consumers[name]; !found {
+		c.replicateEffects(Command{"XGROUP", []string{"CREATECONSUMER", key, group, name}})
+	}
+	return g.consumer(name, now)
+}
+
+// sortedIDs returns the IDs of a PEL in ascending order.
+func sortedIDs(pel map[StreamID]*pendingEntry) []StreamID {
+	ids := make([]StreamID, 0, len(pel))
+	for id := range pel {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Less(ids[j]) })
+	return ids
+}
+
+// groupNames returns the names of the consumer groups in sorted order.
+func (s *Stream) groupNames() []string {
+	names := make([]string, 0, len(s.groups))
+	for name := range s.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lag returns the number of entries not yet delivered to the group, if it
+// can be determined.
+func (s *Stream) lag(g *consumerGroup) (int64, bool) {
+	if s.entriesAdded == 0 {
+		return 0, true
+	}
+	if g.entriesRead >= 0 && !s.hasTombstones(g.lastID) && !g.lastID.Less(s.firstID()) {
+		return int64(s.entriesAdded) - g.entriesRead, true
+	}
+	if read := s.entriesBefore(g.lastID); read >= 0 {
+		return int64(s.entriesAdded) - read, true
+	}
+	return 0, false
+}
+
+// errNoGroup returns the error reply for a missing key or consumer group.
+func errNoGroup(key, group, command string) error {
+	return ReplyError{"NOGROUP", fmt.Sprintf("No such key '%s' or consumer group '%s' in %s", key, group, command)}
+}
+
+// streamGroup returns the stream at key and the named consumer group.
+func (s *Store) streamGroup(key, group, command string) (*Stream, *consumerGroup, error) {
+	st, err := s.stream(key, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	if st == nil {
+		return nil, nil, errNoGroup(key, group, command)
+	}
+	g, found := st.groups[group]
+	if !found {
+		return nil, nil, errNoGroup(key, group, command)
+	}
+	return st, g, nil
+}
+
+// parseGroupID parses the ID argument of XGROUP CREATE and SETID, where "$"
+// stands for the last ID of the stream.
+func parseGroupID(arg string, st *Stream) (StreamID, error) {
+	if arg == "$" {
+		if st == nil {
+			return StreamID{}, nil
+		}
+		return st.lastID, nil
+	}
+	return parseStreamID(arg, 0)
+}
+
+// handleXGroup handles XGROUP commands.
+func (c *ClientHandler) handleXGroup(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("insufficient number of arguments for XGROUP")
+	}
+	subCmd, key, group := strings.ToUpper(args[0]), args[1], args[2]
+	args = args[3:]
+
+	st, err := c.Store.stream(key, false)
+	if err != nil {
+		return err
+	}
+
+	if subCmd == "CREATE" {
+		if len(args) < 1 {
+			return fmt.Errorf("insufficient number of arguments for XGROUP CREATE")
+		}
+		mkStream := false
+		entriesRead := int64(-1)
+		for i := 1; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "MKSTREAM":
+				mkStream = true
+			case "ENTRIESREAD":
+				if i+1 >= len(args) {
+					return errSyntax
+				}
+				n, err := strconv.ParseInt(args[i+1], 10, 64)
+				if err != nil || n < -1 {
+					return fmt.Errorf("value for ENTRIESREAD must be positive or -1")
+				}
+				entriesRead = n
+				i++
+			default:
+				return errSyntax
+			}
+		}
+		id, err := parseGroupID(args[0], st)
+		if err != nil {
+			return err
+		}
+		if st == nil {
+			if !mkStream {
+				return fmt.Errorf("The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+			}
+			st, _ = c.Store.stream(key, true)
+		}
+		if _, found := st.groups[group]; found {
+			return ReplyError{"BUSYGROUP", "Consumer Group name already exists"}
+		}
+		st.groups[group] = newConsumerGroup(id, entriesRead)
+		c.Store.notify(notifyStream, "xgroup-create", key)
+		c.Store.touch(key)
+		return c.send(okResponse)
+	}
+
+	if st == nil {
+		return fmt.Errorf("The XGROUP subcommand requires the key to exist.")
+	}
+	g, found := st.groups[group]
+	if !found && subCmd != "DESTROY" {
+		return ReplyError{"NOGROUP", fmt.Sprintf("No such consumer group '%s' for key name '%s'", group, key)}
+	}
+
+	switch subCmd {
+	case "SETID":
+		if len(args) != 1 && len(args) != 3 {
+			return errSyntax
+		}
+		id, err := parseGroupID(args[0], st)
+		if err != nil {
+			return err
+		}
+		entriesRead := int64(-1)
+		if len(args) == 3 {
+			if strings.ToUpper(args[1]) != "ENTRIESREAD" {
+				return errSyntax
+			}
+			if entriesRead, err = strconv.ParseInt(args[2], 10, 64); err != nil || entriesRead < -1 {
+				return fmt.Errorf("value for ENTRIESREAD must be positive or -1")
+			}
+		}
+		g.lastID, g.entriesRead = id, entriesRead
+		c.Store.notify(notifyStream, "xgroup-setid", key)
+		c.Store.touch(key)
+		return c.send(okResponse)
+	case "DESTROY":
+		if !found {
+			return c.send(encodeInteger(0))
+		}
+		delete(st.groups, group)
+		c.Store.notify(notifyStream, "xgroup-destroy", key)
+		c.Store.touch(key)
+		return c.send(encodeInteger(1))
+	case "CREATECONSUMER":
+		if len(args) != 1 {
+			return errSyntax
+		}
+		if _, exists := g.consumers[args[0]]; exists {
+			return c.send(encodeInteger(0))
+		}
+		g.consumer(args[0], time.Now())
+		c.Store.notify(notifyStream, "xgroup-createconsumer", key)
+		c.Store.touch(key)
+		return c.send(encodeInteger(1))
+	case "DELCONSUMER":
+		if len(args) != 1 {
+			return errSyntax
+		}
+		consumer, exists := g.consumers[args[0]]
+		if !exists {
+			return c.send(encodeInteger(0))
+		}
+		pending := len(consumer.pel)
+		for id := range consumer.pel {
+			g.ack(id)
+		}
+		delete(g.consumers, args[0])
+		c.Store.notify(notifyStream, "xgroup-delconsumer", key)
+		c.Store.touch(key)
+		return c.send(encodeInteger(pending))
+	}
+	return fmt.Errorf("unknown subcommand %q for XGROUP", subCmd)
+}
+
+// handleXReadGroup handles XREADGROUP commands. An ID of ">" reads entries
+// never delivered to the group, any other ID reads the history of entries
+// pending for the consumer.
+func (c *ClientHandler) handleXReadGroup(args []string) error {
+	if len(args) < 3 || strings.ToUpper(args[0]) != "GROUP" {
+		return errSyntax
+	}
+	group, consumerName := args[1], args[2]
+	r, err := parseStreamReadArgs(args[3:], true)
+	if err != nil {
+		return err
+	}
+	history := make([]bool, len(r.ids))
+	after := make([]StreamID, len(r.ids))
+	for i, id := range r.ids {
+		if id == ">" {
+			continue
+		}
+		history[i] = true
+		if after[i], err = parseStreamID(id, 0); err != nil {
+			return err
+		}
+		r.block = false // only new entries can be waited for
+	}
+
+	// Replicas are given the deliveries rather than the read, whose
+	// outcome depends on when it ran.
+	c.replicateEffects()
+	for {
+		result := []string{}
+		now := time.Now()
+		for i, key := range r.keys {
+			st, g, err := c.Store.streamGroup(key, group, "XREADGROUP with GROUP option")
+			if err != nil {
+				return err
+			}
+			consumer := c.groupConsumer(key, group, g, consumerName, now)
+
+			if history[i] {
+				ids := []StreamID{}
+				entries := []*streamEntry{}
+				for _, id := range sortedIDs(consumer.pel) {
+					if !after[i].Less(id) {
+						continue
+					}
+					if r.count > 0 && len(ids) == r.count {
+						break
+					}
+					ids = append(ids, id)
+					entries = append(entries, st.Get(id))
+					pe := consumer.pel[id]
+					pe.deliveryTime = now
+					pe.deliveryCount++
+					c.replicateEffects(claimEffect(key, group, g, id))
+				}
+				consumer.activeTime = now
+				result = append(result, encodeArray(encodeBulkString(key), encodeStreamEntries(ids, entries)))
+				continue
+			}
+
+			start, ok := g.lastID.next()
+			if !ok {
+				continue
+			}
+			entries := st.Range(start, streamIDMax, r.count, false)
+			if len(entries) == 0 {
+				continue
+			}
+			for _, e := range entries {
+				if g.entriesRead >= 0 && !st.hasTombstones(g.lastID) {
+					g.entriesRead++
+				} else {
+					g.entriesRead = st.entriesBefore(e.id)
+				}
+				g.lastID = e.id
+				if !r.noAck {
+					g.deliver(consumer, e.id, now)
+					c.replicateEffects(claimEffect(key, group, g, e.id))
+				}
+			}
+			c.replicateEffects(setIDEffect(key, group, g))
+			consumer.activeTime = now
+			result = append(result, encodeArray(encodeBulkString(key), encodeStreamEntries(nil, entries)))
+		}
+		if len(result) > 0 {
+			return c.send(encodeArray(result...))
+		}
+		if !r.block || !c.wait(r.deadline) {
+			if c.Context.Err() != nil {
+				return nil
+			}
+			return c.send(nullArrayResponse)
+		}
+	}
+}
+
+// handleXAck handles XACK commands.
+func (c *ClientHandler) handleXAck(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("insufficient number of arguments for XACK")
+	}
+	ids := make([]StreamID, 0, len(args)-2)
+	for _, arg := range args[2:] {
+		id, err := parseStreamID(arg, 0)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	st, err := c.Store.stream(args[0], false)
+	if err != nil {
+		return err
+	}
+	if st == nil {
+		return c.send(encodeInteger(0))
+	}
+	g, found := st.groups[args[1]]
+	if !found {
+		return c.send(encodeInteger(0))
+	}
+	acked := 0
+	for _, id := range ids {
+		if g.ack(id) {
+			acked++
+		}
+	}
+	return c.send(encodeInteger(acked))
+}
+
+// handleXPending handles XPENDING commands, in both the summary form and
+// the extended form listing individual entries.
+func (c *ClientHandler) handleXPending(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("insufficient number of arguments for XPENDING")
+	}
+	_, g, err := c.Store.streamGroup(args[0], args[1], "XPENDING")
+	if err != nil {
+		return err
+	}
+	args = args[2:]
+
+	if len(args) == 0 {
+		ids := sortedIDs(g.pel)
+		if len(ids) == 0 {
+			return c.send(encodeArray(encodeInteger(0), nullResponse, nullResponse, nullArrayResponse))
+		}
+		names := []string{}
+		for name, consumer := range g.consumers {
+			if len(consumer.pel) > 0 {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		consumers := make([]string, 0, len(names))
+		for _, name := range names {
+			count := strconv.Itoa(len(g.consumers[name].pel))
+			consumers = append(consumers, encodeBulkStringArray(2, name, count))
+		}
+		return c.send(encodeArray(
+			encodeInteger(len(ids)),
+			encodeBulkString(ids[0].String()),
+			encodeBulkString(ids[len(ids)-1].String()),
+			encodeArray(consumers...),
+		))
+	}
+
+	var minIdle time.Duration
+	if strings.ToUpper(args[0]) == "IDLE" {
+		if len(args) < 2 {
+			return errSyntax
+		}
+		ms, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return errNotInteger
+		}
+		minIdle = time.Duration(ms) * time.Millisecond
+		args = args[2:]
+	}
+	if len(args) != 3 && len(args) != 4 {
+		return errSyntax
+	}
+	start, err := parseRangeID(args[0], true)
+	if err != nil {
+		return err
+	}
+	end, err := parseRangeID(args[1], false)
+	if err != nil {
+		return err
+	}
+	count, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errNotInteger
+	}
+	pel := g.pel
+	if len(args) == 4 {
+		consumer, found := g.consumers[args[3]]
+		if !found {
+			return c.send(encodeArray())
+		}
+		pel = consumer.pel
+	}
+
+	now := time.Now()
+	result := []string{}
+	for _, id := range sortedIDs(pel) {
+		if len(result) >= count {
+			break
+		}
+		if id.Less(start) || end.Less(id) {
+			continue
+		}
+		pe := pel[id]
+		idle := now.Sub(pe.deliveryTime)
+		if idle < minIdle {
+			continue
+		}
+		result = append(result, encodeArray(
+			encodeBulkString(id.String()),
+			encodeBulkString(pe.consumer.name),
+			encodeInteger(int(idle.Milliseconds())),
+			encodeInteger(pe.deliveryCount),
+		))
+	}
+	return c.send(encodeArray(result...))
+}
+
+// parseMinIdle parses the min-idle-time argument of XCLAIM and XAUTOCLAIM.
+func parseMinIdle(arg string) (time.Duration, error) {
+	ms, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid min-idle-time argument for XCLAIM")
+	}
+	return time.Duration(max(ms, 0)) * time.Millisecond, nil
+}
+
+// handleXClaim handles XCLAIM commands.
+func (c *ClientHandler) handleXClaim(args []string) error {
+	if len(args) < 5 {
+		return fmt.Errorf("insufficient number of arguments for XCLAIM")
+	}
+	key, group, consumerName := args[0], args[1], args[2]
+	minIdle, err := parseMinIdle(args[3])
+	if err != nil {
+		return err
+	}
+
+	ids := []StreamID{}
+	i := 4
+	for ; i < len(args); i++ {
+		id, err := parseStreamID(args[i], 0)
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+
+	now := time.Now()
+	deliveryTime := now
+	retryCount := -1
+	var force, justID bool
+	var lastID StreamID
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(args[i])
+		switch opt {
+		case "FORCE":
+			force = true
+			continue
+		case "JUSTID":
+			justID = true
+			continue
+		case "IDLE", "TIME", "RETRYCOUNT", "LASTID":
+		default:
+			return fmt.Errorf("Unrecognized XCLAIM option '%s'", args[i])
+		}
+		if i+1 >= len(args) {
+			return errSyntax
+		}
+		i++
+		if opt == "LASTID" {
+			if lastID, err = parseStreamID(args[i], 0); err != nil {
+				return err
+			}
+			continue
+		}
+		num, err := strconv.ParseInt(args[i], 10, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid %s option argument for XCLAIM", opt)
+		}
+		switch opt {
+		case "IDLE":
+			deliveryTime = now.Add(-time.Duration(num) * time.Millisecond)
+		case "TIME":
+			deliveryTime = time.UnixMilli(num)
+		case "RETRYCOUNT":
+			retryCount = int(num)
+		}
+	}
+	if deliveryTime.After(now) {
+		deliveryTime = now
+	}
+
+	st, g, err := c.Store.streamGroup(key, group, "XCLAIM")
+	if err != nil {
+		return err
+	}
+	// Replicas are given the claims rather than the command, whose
+	// outcome depends on when it ran.
+	c.replicateEffects()
+	if g.lastID.Less(lastID) {
+		g.lastID = lastID
+		c.replicateEffects(setIDEffect(key, group, g))
+	}
+	consumer := c.groupConsumer(key, group, g, consumerName, now)
+
+	claimed := []*streamEntry{}
+	for _, id := range ids {
+		pe, found := g.pel[id]
+		entry := st.Get(id)
+		if !found {
+			if !force || entry == nil {
+				continue
+			}
+			pe = &pendingEntry{consumer: consumer}
+			g.pel[id] = pe
+		}
+		if entry == nil {
+			// The entry was deleted from the stream, so it can never be
+			// processed. Drop it from the PEL instead of claiming it.
+			g.ack(id)
+			c.replicateEffects(Command{"XACK", []string{key, group, id.String()}})
+			continue
+		}
+		if minIdle > 0 && now.Sub(pe.deliveryTime) < minIdle {
+			continue
+		}
+
+		delete(pe.consumer.pel, id)
+		pe.consumer = consumer
+		consumer.pel[id] = pe
+		pe.deliveryTime = deliveryTime
+		if retryCount >= 0 {
+			pe.deliveryCount = retryCount
+		} else if !justID {
+			pe.deliveryCount++
+		}
+		c.replicateEffects(claimEffect(key, group, g, id))
+		claimed = append(claimed, entry)
+	}
+	if len(claimed) > 0 {
+		consumer.activeTime = now
+	}
+
+	if justID {
+		result := make([]string, 0, len(claimed))
+		for _, e := range claimed {
+			result = append(result, e.id.String())
+		}
+		return c.send(encodeBulkStringArray(len(result), result...))
+	}
+	return c.send(encodeStreamEntries(nil, claimed))
+}
+
+// handleXAutoClaim handles XAUTOCLAIM commands.
+func (c *ClientHandler) handleXAutoClaim(args []string) error {
+	if len(args) < 5 {
+		return fmt.Errorf("insufficient number of arguments for XAUTOCLAIM")
+	}
+	key, group, consumerName := args[0], args[1], args[2]
+	minIdle, err := parseMinIdle(args[3])
+	if err != nil {
+		return err
+	}
+	start, err := parseRangeID(args[4], true)
+	if err != nil {
+		return err
+	}
+	count := 100
+	justID := false
+	for i := 5; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COUNT":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+				return fmt.Errorf("COUNT must be > 0")
+			}
+			i++
+		case "JUSTID":
+			justID = true
+		default:
+			return errSyntax
+		}
+	}
+
+	st, g, err := c.Store.streamGroup(key, group, "XAUTOCLAIM")
+	if err != nil {
+		return err
+	}
+	// Replicas are given the claims rather than the command, whose
+	// outcome depends on when it ran.
+	c.replicateEffects()
+	now := time.Now()
+	consumer := c.groupConsumer(key, group, g, consumerName, now)
+
+	claimed := []*streamEntry{}
+	deleted := []string{}
+	next := StreamID{}
+	attempts := count * 10 // bounds the work done per call
+	for _, id := range sortedIDs(g.pel) {
+		if id.Less(start) {
+			continue
+		}
+		if len(claimed) == count || attempts == 0 {
+			next = id
+			break
+		}
+		attempts--
+
+		pe := g.pel[id]
+		entry := st.Get(id)
+		if entry == nil {
+			g.ack(id)
+			deleted = append(deleted, id.String())
+			continue
+		}
+		if minIdle > 0 && now.Sub(pe.deliveryTime) < minIdle {
+			continue
+		}
+		delete(pe.consumer.pel, id)
+		pe.consumer = consumer
+		consumer.pel[id] = pe
+		pe.deliveryTime = now
+		if !justID {
+			pe.deliveryCount++
+		}
+		c.replicateEffects(claimEffect(key, group, g, id))
+		claimed = append(claimed, entry)
+	}
+	if len(claimed) > 0 {
+		consumer.activeTime = now
+	}
+	if len(deleted) > 0 {
+		c.replicateEffects(Command{"XACK", append([]string{key, group}, deleted...)})
+	}
+
+	var entries string
+	if justID {
+		ids := make([]string, 0, len(claimed))
+		for _, e := range claimed {
+			ids = append(ids, e.id.String())
+		}
+		entries = encodeBulkStringArray(len(ids), ids...)
+	} else {
+		entries = encodeStreamEntries(nil, claimed)
+	}
+	return c.send(encodeArray(
+		encodeBulkString(next.String()),
+		entries,
+		encodeBulkStringArray(len(deleted), deleted...),
+	))
+}
+
+// handleXInfo handles XINFO STREAM, GROUPS and CONSUMERS commands.
+func (c *ClientHandler) handleXInfo(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("insufficient number of arguments for XINFO")
+	}
+	subCmd, key := strings.ToUpper(args[0]), args[1]
+	st, err := c.Store.stream(key, false)
+	if err != nil {
+		return err
+	}
+	if st == nil {
+		return fmt.Errorf("no such key")
+	}
+	now := time.Now()
+
+	switch subCmd {
+	case "STREAM":
+		full := len(args) > 2 && strings.ToUpper(args[2]) == "FULL"
+		return c.send(encodeStreamInfo(st, full, now))
+	case "GROUPS":
+		groups := []string{}
+		for _, name := range st.groupNames() {
+			g := st.groups[name]
+			groups = append(groups, encodeArray(
+				encodeBulkString("name"), encodeBulkString(name),
+				encodeBulkString("consumers"), encodeInteger(len(g.consumers)),
+				encodeBulkString("pending"), encodeInteger(len(g.pel)),
+				encodeBulkString("last-delivered-id"), encodeBulkString(g.lastID.String()),
+				encodeBulkString("entries-read"), encodeEntriesRead(g.entriesRead),
+				encodeBulkString("lag"), encodeLag(st, g),
+			))
+		}
+		return c.send(encodeArray(groups...))
+	case "CONSUMERS":
+		if len(args) != 3 {
+			return errSyntax
+		}
+		_, g, err := c.Store.streamGroup(key, args[2], "XINFO CONSUMERS")
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(g.consumers))
+		for name := range g.consumers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		consumers := []string{}
+		for _, name := range names {
+			consumer := g.consumers[name]
+			inactive := -1
+			if !consumer.activeTime.IsZero() {
+				inactive = int(now.Sub(consumer.activeTime).Milliseconds())
+			}
+			consumers = append(consumers, encodeArray(
+				encodeBulkString("name"), encodeBulkString(name),
+				encodeBulkString("pending"), encodeInteger(len(consumer.pel)),
+				encodeBulkString("idle"), encodeInteger(int(now.Sub(consumer.seenTime).Milliseconds())),
+				encodeBulkString("inactive"), encodeInteger(inactive),
+			))
+		}
+		return c.send(encodeArray(consumers...))
+	}
+	return fmt.Errorf("unknown subcommand %q for XINFO", subCmd)
+}
+
+func encodeEntriesRead(entriesRead int64) string {
+	if entriesRead < 0 {
+		return nullResponse
+	}
+	return encodeInteger(int(entriesRead))
+}
+
+func encodeLag(st *Stream, g *consumerGroup) string {
+	lag, ok := st.lag(g)
+	if !ok {
+		return nullResponse
+	}
+	return encodeInteger(int(lag))
+}
+
+// encodeStreamInfo encodes the reply of XINFO STREAM. The FULL form lists
+// every entry and the state of every consumer group.
+func encodeStreamInfo(st *Stream, full bool, now time.Time) string {
+	nodeKeys := len(st.nodes)
+	info := []string{
+		encodeBulkString("length"), encodeInteger(st.Len()),
+		encodeBulkString("radix-tree-keys"), encodeInteger(nodeKeys),
+		encodeBulkString("radix-tree-nodes"), encodeInteger(nodeKeys + 1),
+		encodeBulkString("last-generated-id"), encodeBulkString(st.lastID.String()),
+		encodeBulkString("max-deleted-entry-id"), encodeBulkString(st.maxDeletedID.String()),
+		encodeBulkString("entries-added"), encodeInteger(int(st.entriesAdded)),
+		encodeBulkString("recorded-first-entry-id"), encodeBulkString(st.firstID().String()),
+	}
+
+	if !full {
+		first, last := nullArrayResponse, nullArrayResponse
+		if e := st.firstEntry(); e != nil {
+			first = encodeArray(encodeBulkString(e.id.String()), encodeBulkStringArray(len(e.fields), e.fields...))
+		}
+		if e := st.lastEntry(); e != nil {
+			last = encodeArray(encodeBulkString(e.id.String()), encodeBulkStringArray(len(e.fields), e.fields...))
+		}
+		info = append(info,
+			encodeBulkString("groups"), encodeInteger(len(st.groups)),
+			encodeBulkString("first-entry"), first,
+			encodeBulkString("last-entry"), last,
+		)
+		return encodeArray(info...)
+	}
+
+	groups := []string{}
+	for _, name := range st.groupNames() {
+		g := st.groups[name]
+		pending := []string{}
+		for _, id := range sortedIDs(g.pel) {
+			pe := g.pel[id]
+			pending = append(pending, encodeArray(
+				encodeBulkString(id.String()),
+				encodeBulkString(pe.consumer.name),
+				encodeInteger(int(pe.deliveryTime.UnixMilli())),
+				encodeInteger(pe.deliveryCount),
+			))
+		}
+		names := make([]string, 0, len(g.consumers))
+		for cname := range g.consumers {
+			names = append(names, cname)
+		}
+		sort.Strings(names)
+		consumers := []string{}
+		for _, cname := range names {
+			consumer := g.consumers[cname]
+			cpending := []string{}
+			for _, id := range sortedIDs(consumer.pel) {
+				pe := consumer.pel[id]
+				cpending = append(cpending, encodeArray(
+					encodeBulkString(id.String()),
+					encodeInteger(int(pe.deliveryTime.UnixMilli())),
+					encodeInteger(pe.deliveryCount),
+				))
+			}
+			consumers = append(consumers, encodeArray(
+				encodeBulkString("name"), encodeBulkString(cname),
+				encodeBulkString("seen-time"), encodeInteger(int(consumer.seenTime.UnixMilli())),
+				encodeBulkString("active-time"), encodeInteger(int(consumer.activeTime.UnixMilli())),
+				encodeBulkString("pel-count"), encodeInteger(len(consumer.pel)),
+				encodeBulkString("pending"), encodeArray(cpending...),
+			))
+		}
+		groups = append(groups, encodeArray(
+			encodeBulkString("name"), encodeBulkString(name),
+			encodeBulkString("last-delivered-id"), encodeBulkString(g.lastID.String()),
+			encodeBulkString("entries-read"), encodeEntriesRead(g.entriesRead),
+			encodeBulkString("lag"), encodeLag(st, g),
+			encodeBulkString("pel-count"), encodeInteger(len(g.pel)),
+			encodeBulkString("pending"), encodeArray(pending...),
+			encodeBulkString("consumers"), encodeArray(consumers...),
+		))
+	}
+	info = append(info,
+		encodeBulkString("entries"), encodeStreamEntries(nil, st.Range(StreamID{}, streamIDMax, 0, false)),
+		encodeBulkString("groups"), encodeArray(groups...),
+	)
+	return encodeArray(info...)
+}
+
+// readConsumerGroup reads the state of a consumer group saved by
+// writeConsumerGroup, following its name.
+func readConsumerGroup(r *bufio.Reader) (*consumerGroup, error) {
+	var nums [3]int
+	for i := range nums {
+		var err error
+		if nums[i], err = decodeLength(r); err != nil {
+			return nil, err
+		}
+	}
+	g := newConsumerGroup(StreamID{uint64(nums[0]), uint64(nums[1])}, int64(nums[2]))
+
+	// The group PEL holds delivery times and counts, the consumer PELs
+	// only refer to its entries by ID.
+	pelSize, err := decodeLength(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < pelSize; i++ {
+		id, err := readRawStreamID(r)
+		if err != nil {
+			return nil, err
+		}
+		deliveryTime, err := readMillisecondTime(r)
+		if err != nil {
+			return nil, err
+		}
+		deliveryCount, err := decodeLength(r)
+		if err != nil {
+			return nil, err
+		}
+		g.pel[id] = &pendingEntry{deliveryTime: deliveryTime, deliveryCount: deliveryCount}
+	}
+
+	numConsumers, err := decodeLength(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < numConsumers; i++ {
+		name, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		seenTime, err := readMillisecondTime(r)
+		if err != nil {
+			return nil, err
+		}
+		activeTime, err := readMillisecondTime(r)
+		if err != nil {
+			return nil, err
+		}
+		consumer := g.consumer(name, seenTime)
+		consumer.activeTime = activeTime
+		pelSize, err := decodeLength(r)
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < pelSize; j++ {
+			id, err := readRawStreamID(r)
+			if err != nil {
+				return nil, err
+			}
+			pe, found := g.pel[id]
+			if !found {
+				return nil, fmt.Errorf("consumer PEL entry %s missing from group PEL", id)
+			}
+			pe.consumer = consumer
+			consumer.pel[id] = pe
+		}
+	}
+	for id, pe := range g.pel {
+		if pe.consumer == nil {
+			return nil, fmt.Errorf("group PEL entry %s has no consumer", id)
+		}
+	}
+	return g, nil
+}
+
+// readRawStreamID reads a 128 bit big-endian stream ID.
+func readRawStreamID(r *bufio.Reader) (StreamID, error) {
+	data := make([]byte, 16)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return StreamID{}, err
+	}
+	return StreamID{binary.BigEndian.Uint64(data), binary.BigEndian.Uint64(data[8:])}, nil
+}
+
+// writeConsumerGroup writes the state of a consumer group.
+func (rw *rdbWriter) writeConsumerGroup(g *consumerGroup) {
+	rw.writeLength(int(g.lastID.Ms))
+	rw.writeLength(int(g.lastID.Seq))
+	rw.writeLength(int(g.entriesRead))
+
+	ids := sortedIDs(g.pel)
+	rw.writeLength(len(ids))
+	for _, id := range ids {
+		pe := g.pel[id]
+		rw.w.Write(id.bytes())
+		rw.writeMillisecondTime(pe.deliveryTime)
+		rw.writeLength(pe.deliveryCount)
+	}
+
+	names := make([]string, 0, len(g.consumers))
+	for name := range g.consumers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	rw.writeLength(len(names))
+	for _, name := range names {
+		consumer := g.consumers[name]
+		rw.writeString(name)
+		rw.writeMillisecondTime(consumer.seenTime)
+		rw.writeMillisecondTime(consumer.activeTime)
+		ids := sortedIDs(consumer.pel)
+		rw.writeLength(len(ids))
+		for _, id := range ids {
+			rw.w.Write(id.bytes())
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestParseStreamID(t *testing.T) {
+	tests := []struct {
+		arg        string
+		missingSeq uint64
+		want       StreamID
+		wantErr    bool
+	}{
+		{"1-2", 0, StreamID{1, 2}, false},
+		{"5", 0, StreamID{5, 0}, false},
+		{"5", math.MaxUint64, StreamID{5, math.MaxUint64}, false},
+		{"18446744073709551615-18446744073709551615", 0, streamIDMax, false},
+		{"18446744073709551616-0", 0, StreamID{}, true},
+		{"1-", 0, StreamID{}, true},
+		{"-1", 0, StreamID{}, true},
+		{"1-2-3", 0, StreamID{}, true},
+		{"abc", 0, StreamID{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseStreamID(tt.arg, tt.missingSeq)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseStreamID(%q) = %v, %v", tt.arg, got, err)
+		}
+	}
+}
+
+func TestParseRangeID(t *testing.T) {
+	tests := []struct {
+		arg     string
+		isStart bool
+		want    StreamID
+		wantErr bool
+	}{
+		{"-", true, StreamID{}, false},
+		{"+", false, streamIDMax, false},
+		{"7", true, StreamID{7, 0}, false},
+		{"7", false, StreamID{7, math.MaxUint64}, false},
+		{"(7-3", true, StreamID{7, 4}, false},
+		{"(7-0", false, StreamID{6, math.MaxUint64}, false},
+		{"(7", true, StreamID{7, 1}, false},
+		{"(0-0", false, StreamID{}, true},
+		{"(18446744073709551615-18446744073709551615", true, StreamID{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRangeID(tt.arg, tt.isStart)
+		if (err != nil) != tt.wantErr || !tt.wantErr && got != tt.want {
+			t.Errorf("parseRangeID(%q, %v) = %v, %v", tt.arg, tt.isStart, got, err)
+		}
+	}
+}
+
+// numberedStream returns a stream with entries 1-0 to n-0.
+func numberedStream(n int) *Stream {
+	s := NewStream()
+	for i := 1; i <= n; i++ {
+		s.Append(StreamID{uint64(i), 0}, []string{"f", "v"})
+	}
+	return s
+}
+
+func streamIDs(entries []*streamEntry) []uint64 {
+	ids := []uint64{}
+	for _, e := range entries {
+		ids = append(ids, e.id.Ms)
+	}
+	return ids
+}
+
+func TestStreamRange(t *testing.T) {
+	// Enough entries to span several nodes, with a few deleted.
+	s := numberedStream(3*streamNodeMaxEntries + 10)
+	for _, ms := range []uint64{100, 101, 250} {
+		if !s.Delete(StreamID{ms, 0}) {
+			t.Fatalf("Delete(%d-0) = false", ms)
+		}
+	}
+	if s.Delete(StreamID{100, 0}) {
+		t.Errorf("deleted 100-0 twice")
+	}
+
+	tests := []struct {
+		name       string
+		start, end uint64
+		count      int
+		reverse    bool
+		want       []uint64
+	}{
+		{"inside a node", 3, 5, 0, false, []uint64{3, 4, 5}},
+		{"across nodes", 98, 103, 0, false, []uint64{98, 99, 102, 103}},
+		{"with count", 98, 300, 3, false, []uint64{98, 99, 102}},
+		{"reversed", 248, 252, 0, true, []uint64{252, 251, 249, 248}},
+		{"reversed with count", 1, 310, 2, true, []uint64{310, 309}},
+		{"past the end", 400, 500, 0, false, []uint64{}},
+		{"empty interval", 5, 4, 0, false, []uint64{}},
+	}
+	for _, tt := range tests {
+		got := streamIDs(s.Range(StreamID{tt.start, 0}, StreamID{tt.end, 0}, tt.count, tt.reverse))
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if s.Len() != 307 {
+		t.Errorf("Len() = %d, want 307", s.Len())
+	}
+}
+
+func TestStreamTrim(t *testing.T) {
+	const n = 3*streamNodeMaxEntries + 10
+	tests := []struct {
+		name        string
+		args        []string
+		wantRemoved int
+	}{
+		{"exact maxlen", []string{"MAXLEN", "5"}, n - 5},
+		{"exact maxlen above the length", []string{"MAXLEN", "=", "1000"}, 0},
+		{"approximate maxlen frees whole nodes", []string{"MAXLEN", "~", "5"}, 3 * streamNodeMaxEntries},
+		{"approximate maxlen with a limit", []string{"MAXLEN", "~", "5", "LIMIT", "150"}, streamNodeMaxEntries},
+		{"exact minid", []string{"MINID", "150"}, 149},
+		{"approximate minid", []string{"MINID", "~", "150"}, streamNodeMaxEntries},
+	}
+	for _, tt := range tests {
+		trim, consumed, err := parseStreamTrim(tt.args)
+		if err != nil || consumed != len(tt.args) {
+			t.Errorf("%s: parseStreamTrim = %d, %v", tt.name, consumed, err)
+			continue
+		}
+		s := numberedStream(n)
+		if removed := s.Trim(trim); removed != tt.wantRemoved || s.Len() != n-removed {
+			t.Errorf("%s: removed %d leaving %d, want %d removed", tt.name, removed, s.Len(), tt.wantRemoved)
+		}
+	}
+}
+
+func TestParseStreamTrimErrors(t *testing.T) {
+	tests := [][]string{
+		{"MAXLEN"},
+		{"MAXLEN", "-1"},
+		{"MAXLEN", "x"},
+		{"MAXLEN", "5", "LIMIT", "10"},
+		{"MAXLEN", "~", "5", "LIMIT", "-1"},
+		{"MINID", "bad-id"},
+	}
+	for _, args := range tests {
+		if _, _, err := parseStreamTrim(args); err == nil {
+			t.Errorf("parseStreamTrim(%q) succeeded", args)
+		}
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const tdigestDefaultCompression = 100
+
+// centroid is a cluster of samples summarized by their mean and count.
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+// TDigest estimates quantiles of a stream of samples with a merging
+// t-digest. Samples are buffered and periodically merged into centroids,
+// which are kept small near the tails so extreme quantiles stay accurate.
+type TDigest struct {
+	compression float64
+	centroids   []centroid
+	buffer      []centroid
+	count       float64
+	min, max    float64
+}
+
+func NewTDigest(compression float64) *TDigest {
+	return &TDigest{compression: compression, min: math.Inf(1), max: math.Inf(-1)}
+}
+
+// Add records a sample.
+func (t *TDigest) Add(value, weight float64) {
+	t.buffer = append(t.buffer, centroid{value, weight})
+	t.count += weight
+	t.min = min(t.min, value)
+	t.max = max(t.max, value)
+	if len(t.buffer) >= int(5*t.compression) {
+		t.compress()
+	}
+}
+
+// compress merges buffered samples into the centroids. A centroid may grow
+// while its weight stays below a limit proportional to q(1-q) at its
+// position q, so centroids near the tails stay small.
+func (t *TDigest) compress() {
+	if len(t.buffer) == 0 {
+		return
+	}
+	all := append(t.centroids, t.buffer...)
+	t.buffer = nil
+	slices.SortFunc(all, func(a, b centroid) int {
+		switch {
+		case a.mean < b.mean:
+			return -1
+		case a.mean > b.mean:
+			return 1
+		}
+		return 0
+	})
+
+	merged := []centroid{all[0]}
+	soFar := 0.0
+	for _, c := range all[1:] {
+		last := &merged[len(merged)-1]
+		q0 := soFar / t.count
+		q2 := (soFar + last.weight + c.weight) / t.count
+		limit := 4 * t.count * min(q0*(1-q0), q2*(1-q2)) / t.compression
+		if last.weight+c.weight <= max(limit, 1) {
+			last.mean += (c.mean - last.mean) * c.weight / (last.weight + c.weight)
+			last.weight += c.weight
+			continue
+		}
+		soFar += last.weight
+		merged = append(merged, c)
+	}
+	t.centroids = merged
+}
+
+// points returns the piecewise linear curve from cumulative weight to
+// value, running from the minimum through each centroid's middle to the
+// maximum.
+func (t *TDigest) points() ([]float64, []float64) {
+	t.compress()
+	positions := []float64{0}
+	values := []float64{t.min}
+	soFar := 0.0
+	for _, c := range t.centroids {
+		positions = append(positions, soFar+c.weight/2)
+		values = append(values, c.mean)
+		soFar += c.weight
+	}
+	return append(positions, t.count), append(values, t.max)
+}
+
+// Quantile returns the estimated value at quantile q.
+func (t *TDigest) Quantile(q float64) float64 {
+	if t.count == 0 {
+		return math.NaN()
+	}
+	if q <= 0 {
+		return t.min
+	}
+	if q >= 1 {
+		return t.max
+	}
+	positions, values := t.points()
+	index := q * t.count
+	for i := 1; i < len(positions); i++ {
+		if index <= positions[i] {
+			span := positions[i] - positions[i-1]
+			if span == 0 {
+				return values[i]
+			}
+			return values[i-1] + (index-positions[i-1])/span*(values[i]-values[i-1])
+		}
+	}
+	return t.max
+}
+
+// CDF returns the estimated fraction of samples at or below value, counting
+// samples equal to value as half.
+func (t *TDigest) CDF(value float64) float64 {
+	if t.count == 0 {
+		return math.NaN()
+	}
+	if value < t.min {
+		return 0
+	}
+	if value > t.max {
+		return 1
+	}
+	positions, values := t.points()
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for i := 1; i < len(positions); i++ {
+		v0, v1 := values[i-1], values[i]
+		if value < v0 || value > v1 {
+			continue
+		}
+		if v0 == v1 {
+			lo, hi = min(lo, positions[i-1]), max(hi, positions[i])
+			continue
+		}
+		p := positions[i-1] + (value-v0)/(v1-v0)*(positions[i]-positions[i-1])
+		lo, hi = min(lo, p), max(hi, p)
+	}
+	return (lo + hi) / 2 / t.count
+}
+
+// Merge adds the samples summarized by other.
+func (t *TDigest) Merge(other *TDigest) {
+	other.compress()
+	t.buffer = append(t.buffer, other.centroids...)
+	t.count += other.count
+	t.min = min(t.min, other.min)
+	t.max = max(t.max, other.max)
+	t.compress()
+}
+
+// T-digests are saved as module entries of this server's own type.
+const (
+	tdigestModuleName   = "TDigestMG"
+	tdigestModuleEncver = 1
+)
+
+func (t *TDigest) moduleType() (string, int) {
+	return tdigestModuleName, tdigestModuleEncver
+}
+
+func (t *TDigest) saveModule(w *moduleWriter) {
+	t.compress()
+	w.saveDouble(t.compression)
+	w.saveDouble(t.min)
+	w.saveDouble(t.max)
+	w.saveUnsigned(uint64(len(t.centroids)))
+	for _, c := range t.centroids {
+		w.saveDouble(c.mean)
+		w.saveDouble(c.weight)
+	}
+}
+
+func loadTDigest(r *moduleReader, encver int) (any, error) {
+	if encver != tdigestModuleEncver {
+		return nil, fmt.Errorf("unsupported t-digest encoding version %d", encver)
+	}
+	var params [3]float64
+	for i := range params {
+		f, err := r.loadDouble()
+		if err != nil {
+			return nil, err
+		}
+		params[i] = f
+	}
+	t := NewTDigest(params[0])
+	t.min, t.max = params[1], params[2]
+	n, err := r.loadUnsigned()
+	if err != nil {
+		return nil, err
+	}
+	for range n {
+		mean, err := r.loadDouble()
+		if err != nil {
+			return nil, err
+		}
+		weight, err := r.loadDouble()
+		if err != nil {
+			return nil, err
+		}
+		t.centroids = append(t.centroids, centroid{mean, weight})
+		t.count += weight
+	}
+	return t, nil
+}
+
+func init() {
+	moduleLoaders[tdigestModuleName] = loadTDigest
+}
+
+var errTDigestNoKey = fmt.Errorf("T-Digest: key does not exist")
+
+// tdigest returns the t-digest stored at key, or nil if there is none.
+func (s *Store) tdigest(key string) (*TDigest, error) {
+	val, found := s.lookup(key)
+	if !found {
+		return nil, nil
+	}
+	t, ok := val.(*TDigest)
+	if !ok {
+		return nil, errWrongType
+	}
+	return t, nil
+}
+
+// encodeTDigestValue encodes an estimate, which may be NaN or infinite.
+func encodeTDigestValue(f float64) string {
+	if math.IsNaN(f) {
+		return encodeBulkString("nan")
+	}
+	return encodeBulkString(formatFloat(f))
+}
+
+// parseCompression parses the argument of a COMPRESSION option.
+func parseCompression(arg string) (float64, error) {
+	compression, err := strconv.Atoi(arg)
+	if err != nil || compression < 1 {
+		return 0, fmt.Errorf("T-Digest: compression parameter needs to be a positive integer")
+	}
+	return float64(compression), nil
+}
+
+// handleTDigestCreate handles TDIGEST.CREATE commands.
+func (c *ClientHandler) handleTDigestCreate(args []string) error {
+	if len(args) != 1 && len(args) != 3 {
+		return fmt.Errorf("wrong number of arguments for TDIGEST.CREATE")
+	}
+	key := args[0]
+	compression := float64(tdigestDefaultCompression)
+	if len(args) == 3 {
+		if !strings.EqualFold(args[1], "COMPRESSION") {
+			return errSyntax
+		}
+		var err error
+		if compression, err = parseCompression(args[2]); err != nil {
+			return err
+		}
+	}
+	if _, found := c.Store.lookup(key); found {
+		return fmt.Errorf("T-Digest: key already exists")
+	}
+	fmt.Printf("TDIGEST.CREATE %s command received.", key)
+
+	c.Store.create(key, NewTDigest(compression))
+	c.Store.notify(notifyModule, "tdigest.create", key)
+	c.Store.touch(key)
+	return c.send(okResponse)
+}
+
+// handleTDigestAdd handles TDIGEST.ADD commands.
+func (c *ClientHandler) handleTDigestAdd(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("insufficient number of arguments for TDIGEST.ADD")
+	}
+	values := make([]float64, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		val, err := strconv.ParseFloat(arg, 64)
+		if err != nil || math.IsNaN(val) || math.IsInf(val, 0) {
+			return fmt.Errorf("T-Digest: error parsing val parameter")
+		}
+		values = append(values, val)
+	}
+	t, err := c.Store.tdigest(args[0])
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return errTDigestNoKey
+	}
+	fmt.Printf("TDIGEST.ADD %s command received.", args[0])
+
+	for _, val := range values {
+		t.Add(val, 1)
+	}
+	c.Store.notify(notifyModule, "tdigest.add", args[0])
+	c.Store.touch(args[0])
+	return c.send(okResponse)
+}
+
+// handleTDigestEstimate handles TDIGEST.QUANTILE and, with cdf set,
+// TDIGEST.CDF commands.
+func (c *ClientHandler) handleTDigestEstimate(args []string, cdf bool) error {
+	if len(args) < 2 {
+		return fmt.Errorf("insufficient number of arguments for TDIGEST.QUANTILE")
+	}
+	inputs := make([]float64, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		val, err := strconv.ParseFloat(arg, 64)
+		if err != nil || math.IsNaN(val) {
+			return fmt.Errorf("T-Digest: error parsing value")
+		}
+		if !cdf && (val < 0 || val > 1) {
+			return fmt.Errorf("T-Digest: quantile should be in [0,1]")
+		}
+		inputs = append(inputs, val)
+	}
+	t, err := c.Store.tdigest(args[0])
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return errTDigestNoKey
+	}
+	result := make([]string, 0, len(inputs))
+	for _, val := range inputs {
+		if cdf {
+			result = append(result, encodeTDigestValue(t.CDF(val)))
+		} else {
+			result = append(result, encodeTDigestValue(t.Quantile(val)))
+		}
+	}
+	return c.send(encodeArray(result...))
+}
+
+// handleTDigestMinMax handles TDIGEST.MIN and, with max set, TDIGEST.MAX
+// commands.
+func (c *ClientHandler) handleTDigestMinMax(args []string, max bool) error {
+	if len(args) != 1 {
+		return fmt.Errorf("wrong number of arguments for TDIGEST.MIN")
+	}
+	t, err := c.Store.tdigest(args[0])
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return errTDigestNoKey
+	}
+	switch {
+	case t.count == 0:
+		return c.send(encodeTDigestValue(math.NaN()))
+	case max:
+		return c.send(encodeTDigestValue(t.max))
+	}
+	return c.send(encodeTDigestValue(t.min))
+}
+
+// handleTDigestMerge handles TDIGEST.MERGE commands.
+func (c *ClientHandler) handleTDigestMerge(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("insufficient number of arguments for TDIGEST.MERGE")
+	}
+	dst := args[0]
+	numKeys, err := strconv.Atoi(args[1])
+	if err != nil || numKeys < 1 || len(args) < 2+numKeys {
+		return fmt.Errorf("T-Digest: invalid numkeys")
+	}
+	keys := args[2 : 2+numKeys]
+	compression := 0.0
+	override := false
+	for i := 2 + numKeys; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COMPRESSION":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			if compression, err = parseCompression(args[i+1]); err != nil {
+				return err
+			}
+			i++
+		case "OVERRIDE":
+			override = true
+		default:
+			return errSyntax
+		}
+	}
+
+	sources := make([]*TDigest, 0, numKeys)
+	for _, key := range keys {
+		src, err := c.Store.tdigest(key)
+		if err != nil {
+			return err
+		}
+		if src == nil {
+			return errTDigestNoKey
+		}
+		sources = append(sources, src)
+	}
+	target, err := c.Store.tdigest(dst)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("TDIGEST.MERGE %s command received.", dst)
+
+	// Without an explicit compression, use the largest of the inputs.
+	if target != nil && !override {
+		sources = append(sources, target)
+	}
+	if compression == 0 {
+		for _, src := range sources {
+			compression = max(compression, src.compression)
+		}
+	}
+	result := NewTDigest(compression)
+	for _, src := range sources {
+		result.Merge(src)
+	}
+	if target == nil {
+		c.Store.create(dst, result)
+	} else {
+		c.Store.kv[dst] = result
+	}
+	c.Store.notify(notifyModule, "tdigest.merge", dst)
+	c.Store.touch(dst)
+	return c.send(okResponse)
+}
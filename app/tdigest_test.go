@@ -0,0 +1,119 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// uniformDigest returns a digest of the values 1 to n, added in random
+// order.
+func uniformDigest(n int) *TDigest {
+	t := NewTDigest(tdigestDefaultCompression)
+	for _, i := range rand.New(rand.NewSource(1)).Perm(n) {
+		t.Add(float64(i+1), 1)
+	}
+	return t
+}
+
+func TestTDigestQuantile(t *testing.T) {
+	const n = 10000
+	digest := uniformDigest(n)
+	tests := []struct {
+		q, want, tolerance float64
+	}{
+		{0, 1, 0},
+		{1, n, 0},
+		{0.001, 10, 2},
+		{0.01, 100, 5},
+		{0.1, 1000, 20},
+		{0.5, 5000, 50},
+		{0.9, 9000, 20},
+		{0.99, 9900, 5},
+		{0.999, 9990, 2},
+	}
+	for _, tt := range tests {
+		if got := digest.Quantile(tt.q); math.Abs(got-tt.want) > tt.tolerance {
+			t.Errorf("Quantile(%v) = %v, want %v±%v", tt.q, got, tt.want, tt.tolerance)
+		}
+	}
+}
+
+func TestTDigestCDF(t *testing.T) {
+	const n = 10000
+	digest := uniformDigest(n)
+	tests := []struct {
+		value, want, tolerance float64
+	}{
+		{0, 0, 0},
+		{n + 1, 1, 0},
+		{100, 0.01, 0.001},
+		{5000, 0.5, 0.005},
+		{9900, 0.99, 0.001},
+	}
+	for _, tt := range tests {
+		if got := digest.CDF(tt.value); math.Abs(got-tt.want) > tt.tolerance {
+			t.Errorf("CDF(%v) = %v, want %v±%v", tt.value, got, tt.want, tt.tolerance)
+		}
+	}
+}
+
+func TestTDigestSmall(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		q      float64
+		want   float64
+	}{
+		{"single value", []float64{7}, 0.5, 7},
+		{"repeated value", []float64{3, 3, 3, 3}, 0.3, 3},
+		{"two values, median", []float64{1, 3}, 0.5, 2},
+	}
+	for _, tt := range tests {
+		digest := NewTDigest(tdigestDefaultCompression)
+		for _, v := range tt.values {
+			digest.Add(v, 1)
+		}
+		if got := digest.Quantile(tt.q); got != tt.want {
+			t.Errorf("%s: Quantile(%v) = %v, want %v", tt.name, tt.q, got, tt.want)
+		}
+	}
+
+	empty := NewTDigest(tdigestDefaultCompression)
+	if !math.IsNaN(empty.Quantile(0.5)) || !math.IsNaN(empty.CDF(1)) {
+		t.Errorf("empty digest gave a number")
+	}
+}
+
+func TestTDigestMerge(t *testing.T) {
+	low, high := NewTDigest(100), NewTDigest(100)
+	for i := 1; i <= 5000; i++ {
+		low.Add(float64(i), 1)
+		high.Add(float64(i+5000), 1)
+	}
+	low.Merge(high)
+	if low.count != 10000 || low.min != 1 || low.max != 10000 {
+		t.Errorf("merged count %v, min %v, max %v", low.count, low.min, low.max)
+	}
+	if got := low.Quantile(0.5); math.Abs(got-5000) > 50 {
+		t.Errorf("merged median = %v, want about 5000", got)
+	}
+}
+
+func TestTDigestDumpRoundTrip(t *testing.T) {
+	digest := uniformDigest(1000)
+	payload, err := dumpValue(digest)
+	if err != nil {
+		t.Fatalf("dumpValue: %v", err)
+	}
+	val, err := restoreValue(payload)
+	if err != nil {
+		t.Fatalf("restoreValue: %v", err)
+	}
+	restored := val.(*TDigest)
+	for _, q := range []float64{0, 0.01, 0.5, 0.99, 1} {
+		if got, want := restored.Quantile(q), digest.Quantile(q); got != want {
+			t.Errorf("Quantile(%v) = %v after restoring, want %v", q, got, want)
+		}
+	}
+}
@@ -0,0 +1,1177 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duplicate policies decide what happens when a sample is added at a
+// timestamp that already has one.
+const (
+	tsPolicyBlock = "BLOCK"
+	tsPolicyFirst = "FIRST"
+	tsPolicyLast  = "LAST"
+	tsPolicyMin   = "MIN"
+	tsPolicyMax   = "MAX"
+	tsPolicySum   = "SUM"
+)
+
+var (
+	errTSNoKey     = fmt.Errorf("TSDB: the key does not exist")
+	errTSKeyExists = fmt.Errorf("TSDB: key already exists")
+	errTSTimestamp = fmt.Errorf("TSDB: invalid timestamp")
+	errTSValue     = fmt.Errorf("TSDB: invalid value")
+)
+
+// tsSample is a value at a timestamp in milliseconds.
+type tsSample struct {
+	ts    int64
+	value float64
+}
+
+// tsRule is a compaction rule that downsamples a series into dest. current
+// is the start of the bucket still being filled, or -1.
+type tsRule struct {
+	dest     string
+	agg      string
+	duration int64
+	align    int64
+	current  int64
+}
+
+// bucketStart returns the start of the bucket containing ts.
+func (r tsRule) bucketStart(ts int64) int64 {
+	return tsBucketStart(ts, r.duration, r.align)
+}
+
+func tsBucketStart(ts, duration, align int64) int64 {
+	offset := (ts - align) % duration
+	if offset < 0 {
+		offset += duration
+	}
+	return ts - offset
+}
+
+// TimeSeries is a series of samples ordered by timestamp.
+type TimeSeries struct {
+	samples   []tsSample
+	retention int64 // milliseconds, 0 keeps samples forever
+	policy    string
+	labels    [][2]string
+	rules     []*tsRule
+	srcKey    string // set when the series is the destination of a rule
+}
+
+func NewTimeSeries() *TimeSeries {
+	return &TimeSeries{policy: tsPolicyBlock}
+}
+
+// Label returns the value of a label.
+func (t *TimeSeries) Label(name string) (string, bool) {
+	for _, l := range t.labels {
+		if l[0] == name {
+			return l[1], true
+		}
+	}
+	return "", false
+}
+
+// lastTimestamp returns the newest timestamp, or -1 if there are no samples.
+func (t *TimeSeries) lastTimestamp() int64 {
+	if len(t.samples) == 0 {
+		return -1
+	}
+	return t.samples[len(t.samples)-1].ts
+}
+
+// Add adds a sample, resolving duplicate timestamps with policy, and drops
+// samples that fall out of the retention window.
+func (t *TimeSeries) Add(ts int64, value float64, policy string) error {
+	if t.retention > 0 && ts < t.lastTimestamp()-t.retention {
+		return fmt.Errorf("TSDB: Timestamp is older than retention")
+	}
+	i := sort.Search(len(t.samples), func(i int) bool { return t.samples[i].ts >= ts })
+	if i < len(t.samples) && t.samples[i].ts == ts {
+		s := &t.samples[i]
+		switch policy {
+		case tsPolicyBlock:
+			return fmt.Errorf("TSDB: Error at upsert, update is not supported when DUPLICATE_POLICY is set to BLOCK mode")
+		case tsPolicyLast:
+			s.value = value
+		case tsPolicyMin:
+			s.value = min(s.value, value)
+		case tsPolicyMax:
+			s.value = max(s.value, value)
+		case tsPolicySum:
+			s.value += value
+		}
+		return nil
+	}
+	t.samples = slices.Insert(t.samples, i, tsSample{ts, value})
+
+	if t.retention > 0 {
+		cutoff := t.lastTimestamp() - t.retention
+		drop := sort.Search(len(t.samples), func(i int) bool { return t.samples[i].ts >= cutoff })
+		t.samples = t.samples[drop:]
+	}
+	return nil
+}
+
+// Range returns the samples with timestamps between from and to.
+func (t *TimeSeries) Range(from, to int64) []tsSample {
+	start := sort.Search(len(t.samples), func(i int) bool { return t.samples[i].ts >= from })
+	end := sort.Search(len(t.samples), func(i int) bool { return t.samples[i].ts > to })
+	if start >= end {
+		return nil
+	}
+	return t.samples[start:end]
+}
+
+// tsAggregate reduces the values of a bucket.
+func tsAggregate(agg string, values []float64) float64 {
+	if len(values) == 0 {
+		if agg == "count" || agg == "sum" {
+			return 0
+		}
+		return math.NaN()
+	}
+	sum, lo, hi := 0.0, math.Inf(1), math.Inf(-1)
+	for _, v := range values {
+		sum += v
+		lo, hi = min(lo, v), max(hi, v)
+	}
+	n := float64(len(values))
+	variance := func(sample bool) float64 {
+		if sample && n < 2 {
+			return 0
+		}
+		mean, sq := sum/n, 0.0
+		for _, v := range values {
+			sq += (v - mean) * (v - mean)
+		}
+		if sample {
+			return sq / (n - 1)
+		}
+		return sq / n
+	}
+	switch agg {
+	case "avg":
+		return sum / n
+	case "sum":
+		return sum
+	case "min":
+		return lo
+	case "max":
+		return hi
+	case "range":
+		return hi - lo
+	case "count":
+		return n
+	case "first":
+		return values[0]
+	case "last":
+		return values[len(values)-1]
+	case "var.p":
+		return variance(false)
+	case "var.s":
+		return variance(true)
+	case "std.p":
+		return math.Sqrt(variance(false))
+	case "std.s":
+		return math.Sqrt(variance(true))
+	}
+	return math.NaN()
+}
+
+// parseTSAggregation validates an aggregation type.
+func parseTSAggregation(arg string) (string, error) {
+	agg := strings.ToLower(arg)
+	switch agg {
+	case "avg", "sum", "min", "max", "range", "count", "first", "last", "std.p", "std.s", "var.p", "var.s":
+		return agg, nil
+	}
+	return "", fmt.Errorf("TSDB: Unknown aggregation type")
+}
+
+// Time series are saved as module entries of this server's own type.
+const (
+	tsModuleName   = "TSeriesRG"
+	tsModuleEncver = 1
+)
+
+func (t *TimeSeries) moduleType() (string, int) {
+	return tsModuleName, tsModuleEncver
+}
+
+func (t *TimeSeries) saveModule(w *moduleWriter) {
+	w.saveSigned(t.retention)
+	w.saveString(t.policy)
+	w.saveString(t.srcKey)
+	w.saveUnsigned(uint64(len(t.labels)))
+	for _, l := range t.labels {
+		w.saveString(l[0])
+		w.saveString(l[1])
+	}
+	w.saveUnsigned(uint64(len(t.rules)))
+	for _, r := range t.rules {
+		w.saveString(r.dest)
+		w.saveString(r.agg)
+		w.saveSigned(r.duration)
+		w.saveSigned(r.align)
+		w.saveSigned(r.current)
+	}
+	w.saveUnsigned(uint64(len(t.samples)))
+	for _, s := range t.samples {
+		w.saveSigned(s.ts)
+		w.saveDouble(s.value)
+	}
+}
+
+func loadTimeSeries(r *moduleReader, encver int) (any, error) {
+	if encver != tsModuleEncver {
+		return nil, fmt.Errorf("unsupported time series encoding version %d", encver)
+	}
+	t := NewTimeSeries()
+	var err error
+	if t.retention, err = r.loadSigned(); err != nil {
+		return nil, err
+	}
+	if t.policy, err = r.loadString(); err != nil {
+		return nil, err
+	}
+	if t.srcKey, err = r.loadString(); err != nil {
+		return nil, err
+	}
+	n, err := r.loadUnsigned()
+	if err != nil {
+		return nil, err
+	}
+	for range n {
+		name, err := r.loadString()
+		if err != nil {
+			return nil, err
+		}
+		value, err := r.loadString()
+		if err != nil {
+			return nil, err
+		}
+		t.labels = append(t.labels, [2]string{name, value})
+	}
+	if n, err = r.loadUnsigned(); err != nil {
+		return nil, err
+	}
+	for range n {
+		rule := &tsRule{}
+		if rule.dest, err = r.loadString(); err != nil {
+			return nil, err
+		}
+		if rule.agg, err = r.loadString(); err != nil {
+			return nil, err
+		}
+		if rule.duration, err = r.loadSigned(); err != nil {
+			return nil, err
+		}
+		if rule.align, err = r.loadSigned(); err != nil {
+			return nil, err
+		}
+		if rule.current, err = r.loadSigned(); err != nil {
+			return nil, err
+		}
+		t.rules = append(t.rules, rule)
+	}
+	if n, err = r.loadUnsigned(); err != nil {
+		return nil, err
+	}
+	t.samples = make([]tsSample, 0, n)
+	for range n {
+		ts, err := r.loadSigned()
+		if err != nil {
+			return nil, err
+		}
+		value, err := r.loadDouble()
+		if err != nil {
+			return nil, err
+		}
+		t.samples = append(t.samples, tsSample{ts, value})
+	}
+	return t, nil
+}
+
+func init() {
+	moduleLoaders[tsModuleName] = loadTimeSeries
+}
+
+// timeSeries returns the time series stored at key, or nil if there is none.
+func (s *Store) timeSeries(key string) (*TimeSeries, error) {
+	val, found := s.lookup(key)
+	if !found {
+		return nil, nil
+	}
+	t, ok := val.(*TimeSeries)
+	if !ok {
+		return nil, errWrongType
+	}
+	return t, nil
+}
+
+// tsCompact runs the compaction rules of the series at key after a sample
+// was added at ts. Reaching a new bucket closes the previous one; a sample
+// in an already closed bucket recomputes that bucket.
+func (s *Store) tsCompact(t *TimeSeries, ts int64) {
+	for _, rule := range t.rules {
+		dest, err := s.timeSeries(rule.dest)
+		if err != nil || dest == nil {
+			continue
+		}
+		bucket := rule.bucketStart(ts)
+		switch {
+		case rule.current < 0:
+			rule.current = bucket
+			continue
+		case bucket > rule.current:
+			s.tsCloseBucket(t, rule, dest, rule.current)
+			rule.current = bucket
+			continue
+		case bucket < rule.current:
+			s.tsCloseBucket(t, rule, dest, bucket)
+		}
+	}
+}
+
+// tsCloseBucket aggregates one bucket of the source into the destination
+// of a rule.
+func (s *Store) tsCloseBucket(src *TimeSeries, rule *tsRule, dest *TimeSeries, start int64) {
+	samples := src.Range(start, start+rule.duration-1)
+	if len(samples) == 0 {
+		return
+	}
+	values := make([]float64, len(samples))
+	for i, sample := range samples {
+		values[i] = sample.value
+	}
+	if dest.Add(start, tsAggregate(rule.agg, values), tsPolicyLast) == nil {
+		s.notify(notifyModule, "ts.add:dest", rule.dest)
+		s.touch(rule.dest)
+		s.tsCompact(dest, start)
+	}
+}
+
+// tsOptions holds the options shared by TS.CREATE, TS.ADD and TS.INCRBY.
+type tsOptions struct {
+	retention   *int64
+	policy      string
+	onDuplicate string
+	labels      [][2]string
+	timestamp   *int64
+}
+
+// parseTSTimestamp parses a timestamp, where "*" means now.
+func parseTSTimestamp(arg string) (int64, error) {
+	if arg == "*" {
+		return time.Now().UnixMilli(), nil
+	}
+	ts, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || ts < 0 {
+		return 0, errTSTimestamp
+	}
+	return ts, nil
+}
+
+func parseTSPolicy(arg string) (string, error) {
+	policy := strings.ToUpper(arg)
+	switch policy {
+	case tsPolicyBlock, tsPolicyFirst, tsPolicyLast, tsPolicyMin, tsPolicyMax, tsPolicySum:
+		return policy, nil
+	}
+	return "", fmt.Errorf("TSDB: Unknown DUPLICATE_POLICY")
+}
+
+// parseTSOptions parses options. ON_DUPLICATE and TIMESTAMP are only
+// accepted when allowed lists them.
+func parseTSOptions(args []string, allowed ...string) (tsOptions, error) {
+	var opts tsOptions
+	for i := 0; i < len(args); i++ {
+		opt := strings.ToUpper(args[i])
+		if opt == "LABELS" {
+			rest := args[i+1:]
+			if len(rest) == 0 || len(rest)%2 != 0 {
+				return opts, fmt.Errorf("TSDB: wrong number of arguments for LABELS")
+			}
+			for j := 0; j < len(rest); j += 2 {
+				opts.labels = append(opts.labels, [2]string{rest[j], rest[j+1]})
+			}
+			return opts, nil
+		}
+		if (opt == "ON_DUPLICATE" || opt == "TIMESTAMP") && !slices.Contains(allowed, opt) {
+			return opts, errSyntax
+		}
+		if i+1 >= len(args) {
+			return opts, errSyntax
+		}
+		arg := args[i+1]
+		i++
+		switch opt {
+		case "RETENTION":
+			retention, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil || retention < 0 {
+				return opts, fmt.Errorf("TSDB: Couldn't parse RETENTION")
+			}
+			opts.retention = &retention
+		case "ENCODING":
+			if !strings.EqualFold(arg, "COMPRESSED") && !strings.EqualFold(arg, "UNCOMPRESSED") {
+				return opts, fmt.Errorf("TSDB: unknown ENCODING parameter")
+			}
+		case "CHUNK_SIZE":
+			if size, err := strconv.Atoi(arg); err != nil || size < 48 || size%8 != 0 {
+				return opts, fmt.Errorf("TSDB: CHUNK_SIZE value must be a multiple of 8 in the range [48 .. 1048576]")
+			}
+		case "DUPLICATE_POLICY", "ON_DUPLICATE":
+			policy, err := parseTSPolicy(arg)
+			if err != nil {
+				return opts, err
+			}
+			if opt == "ON_DUPLICATE" {
+				opts.onDuplicate = policy
+			} else {
+				opts.policy = policy
+			}
+		case "TIMESTAMP":
+			ts, err := parseTSTimestamp(arg)
+			if err != nil {
+				return opts, err
+			}
+			opts.timestamp = &ts
+		default:
+			return opts, errSyntax
+		}
+	}
+	return opts, nil
+}
+
+// newTimeSeries creates a series configured by opts.
+func newTimeSeries(opts tsOptions) *TimeSeries {
+	t := NewTimeSeries()
+	if opts.retention != nil {
+		t.retention = *opts.retention
+	}
+	if opts.policy != "" {
+		t.policy = opts.policy
+	}
+	t.labels = opts.labels
+	return t
+}
+
+// handleTSCreate handles TS.CREATE commands.
+func (c *ClientHandler) handleTSCreate(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("insufficient number of arguments for TS.CREATE")
+	}
+	key := args[0]
+	opts, err := parseTSOptions(args[1:])
+	if err != nil {
+		return err
+	}
+	if _, found := c.Store.lookup(key); found {
+		return errTSKeyExists
+	}
+	fmt.Printf("TS.CREATE %s command received.", key)
+
+	c.Store.create(key, newTimeSeries(opts))
+	c.Store.notify(notifyModule, "ts.create", key)
+	c.Store.touch(key)
+	return c.send(okResponse)
+}
+
+// tsAdd adds a sample to the series at key, creating it with opts if
+// allowed, reports event and runs its compaction rules.
+func (c *ClientHandler) tsAdd(key string, ts int64, value float64, opts *tsOptions, event string) error {
+	t, err := c.Store.timeSeries(key)
+	if err != nil {
+		return err
+	}
+	created := false
+	if t == nil {
+		if opts == nil {
+			return errTSNoKey
+		}
+		t = newTimeSeries(*opts)
+		c.Store.create(key, t)
+		c.Store.notify(notifyModule, "ts.create", key)
+		created = true
+	}
+	policy := t.policy
+	if opts != nil && opts.onDuplicate != "" {
+		policy = opts.onDuplicate
+	}
+	if err := t.Add(ts, value, policy); err != nil {
+		if created {
+			c.Store.touch(key)
+		}
+		return err
+	}
+	c.Store.notify(notifyModule, event, key)
+	c.Store.touch(key)
+	c.Store.tsCompact(t, ts)
+	return nil
+}
+
+// parseTSValue parses a sample value.
+func parseTSValue(arg string) (float64, error) {
+	value, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(value) {
+		return 0, errTSValue
+	}
+	return value, nil
+}
+
+// handleTSAdd handles TS.ADD commands.
+func (c *ClientHandler) handleTSAdd(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("insufficient number of arguments for TS.ADD")
+	}
+	key := args[0]
+	ts, err := parseTSTimestamp(args[1])
+	if err != nil {
+		return err
+	}
+	value, err := parseTSValue(args[2])
+	if err != nil {
+		return err
+	}
+	opts, err := parseTSOptions(args[3:], "ON_DUPLICATE")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("TS.ADD %s command received.", key)
+
+	if err := c.tsAdd(key, ts, value, &opts, "ts.add"); err != nil {
+		return err
+	}
+	// Replicas are given the timestamp "*" stood for.
+	effect := slices.Clone(args)
+	effect[1] = strconv.FormatInt(ts, 10)
+	c.replicateEffects(Command{"TS.ADD", effect})
+	return c.send(encodeInteger(int(ts)))
+}
+
+// handleTSMAdd handles TS.MADD commands.
+func (c *ClientHandler) handleTSMAdd(args []string) error {
+	if len(args) < 3 || len(args)%3 != 0 {
+		return fmt.Errorf("wrong number of arguments for TS.MADD")
+	}
+	result := make([]string, 0, len(args)/3)
+	var effect []string // the samples added, with their timestamps
+	for i := 0; i < len(args); i += 3 {
+		ts, err := parseTSTimestamp(args[i+1])
+		if err == nil {
+			var value float64
+			if value, err = parseTSValue(args[i+2]); err == nil {
+				err = c.tsAdd(args[i], ts, value, nil, "ts.add")
+			}
+		}
+		if err != nil {
+			result = append(result, encodeError(err))
+			continue
+		}
+		effect = append(effect, args[i], strconv.FormatInt(ts, 10), args[i+2])
+		result = append(result, encodeInteger(int(ts)))
+	}
+	c.replicateEffects()
+	if len(effect) > 0 {
+		c.replicateEffects(Command{"TS.MADD", effect})
+	}
+	return c.send(encodeArray(result...))
+}
+
+// handleTSIncrBy handles TS.INCRBY and, with decr set, TS.DECRBY commands.
+func (c *ClientHandler) handleTSIncrBy(args []string, decr bool) error {
+	if len(args) < 2 {
+		return fmt.Errorf("insufficient number of arguments for TS.INCRBY")
+	}
+	key := args[0]
+	incr, err := parseTSValue(args[1])
+	if err != nil {
+		return err
+	}
+	if decr {
+		incr = -incr
+	}
+	opts, err := parseTSOptions(args[2:], "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	t, err := c.Store.timeSeries(key)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("TS.INCRBY %s command received.", key)
+
+	ts := time.Now().UnixMilli()
+	if opts.timestamp != nil {
+		ts = *opts.timestamp
+	}
+	value := incr
+	if t != nil && len(t.samples) > 0 {
+		last := t.samples[len(t.samples)-1]
+		if ts < last.ts {
+			return fmt.Errorf("TSDB: timestamp must be equal to or higher than the maximum existing timestamp")
+		}
+		value += last.value
+	}
+	opts.onDuplicate = tsPolicyLast
+	event := "ts.incrby"
+	if decr {
+		event = "ts.decrby"
+	}
+	if err := c.tsAdd(key, ts, value, &opts, event); err != nil {
+		return err
+	}
+	name := "TS.INCRBY"
+	if decr {
+		name = "TS.DECRBY"
+	}
+	c.replicateEffects(Command{name, tsIncrByEffect(args, ts)})
+	return c.send(encodeInteger(int(ts)))
+}
+
+// tsIncrByEffect returns the arguments of a TS.INCRBY or TS.DECRBY with
+// its sample's timestamp given as ts, so that replicas add the sample at
+// the same time.
+func tsIncrByEffect(args []string, ts int64) []string {
+	effect := []string{args[0], args[1], "TIMESTAMP", strconv.FormatInt(ts, 10)}
+	for i := 2; i < len(args); i += 2 {
+		switch strings.ToUpper(args[i]) {
+		case "LABELS":
+			return append(effect, args[i:]...)
+		case "TIMESTAMP":
+		default:
+			effect = append(effect, args[i:i+2]...)
+		}
+	}
+	return effect
+}
+
+// handleTSCreateRule handles TS.CREATERULE commands.
+func (c *ClientHandler) handleTSCreateRule(args []string) error {
+	if len(args) != 5 && len(args) != 6 {
+		return fmt.Errorf("wrong number of arguments for TS.CREATERULE")
+	}
+	srcKey, destKey := args[0], args[1]
+	if !strings.EqualFold(args[2], "AGGREGATION") {
+		return errSyntax
+	}
+	agg, err := parseTSAggregation(args[3])
+	if err != nil {
+		return err
+	}
+	duration, err := strconv.ParseInt(args[4], 10, 64)
+	if err != nil || duration <= 0 {
+		return fmt.Errorf("TSDB: bucketDuration must be greater than zero")
+	}
+	var align int64
+	if len(args) == 6 {
+		if align, err = strconv.ParseInt(args[5], 10, 64); err != nil {
+			return errTSTimestamp
+		}
+	}
+	if srcKey == destKey {
+		return fmt.Errorf("TSDB: the source key and destination key should be different")
+	}
+	src, err := c.Store.timeSeries(srcKey)
+	if err != nil {
+		return err
+	}
+	dest, err := c.Store.timeSeries(destKey)
+	if err != nil {
+		return err
+	}
+	if src == nil || dest == nil {
+		return errTSNoKey
+	}
+	if src.srcKey != "" {
+		return fmt.Errorf("TSDB: the source key already has a source rule")
+	}
+	if dest.srcKey != "" || len(dest.rules) > 0 {
+		return fmt.Errorf("TSDB: the destination key already has a src rule")
+	}
+	fmt.Printf("TS.CREATERULE %s %s command received.", srcKey, destKey)
+
+	src.rules = append(src.rules, &tsRule{dest: destKey, agg: agg, duration: duration, align: align, current: -1})
+	dest.srcKey = srcKey
+	c.Store.notify(notifyModule, "ts.createrule:src", srcKey)
+	c.Store.notify(notifyModule, "ts.createrule:dest", destKey)
+	c.Store.touch(srcKey)
+	c.Store.touch(destKey)
+	return c.send(okResponse)
+}
+
+// handleTSDeleteRule handles TS.DELETERULE commands.
+func (c *ClientHandler) handleTSDeleteRule(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("wrong number of arguments for TS.DELETERULE")
+	}
+	src, err := c.Store.timeSeries(args[0])
+	if err != nil {
+		return err
+	}
+	if src == nil {
+		return errTSNoKey
+	}
+	i := slices.IndexFunc(src.rules, func(r *tsRule) bool { return r.dest == args[1] })
+	if i < 0 {
+		return fmt.Errorf("TSDB: compaction rule does not exist")
+	}
+	src.rules = slices.Delete(src.rules, i, i+1)
+	c.Store.notify(notifyModule, "ts.deleterule:src", args[0])
+	c.Store.touch(args[0])
+	if dest, err := c.Store.timeSeries(args[1]); err == nil && dest != nil {
+		dest.srcKey = ""
+		c.Store.notify(notifyModule, "ts.deleterule:dest", args[1])
+		c.Store.touch(args[1])
+	}
+	return c.send(okResponse)
+}
+
+// tsRangeQuery holds the options of TS.RANGE, TS.REVRANGE and TS.MRANGE.
+type tsRangeQuery struct {
+	from, to       int64
+	reverse        bool
+	filterTS       []int64
+	filterValue    bool
+	minVal, maxVal float64
+	count          int
+	agg            string
+	duration       int64
+	align          int64
+	bucketTS       string
+	empty          bool
+
+	// TS.MRANGE only.
+	withLabels     bool
+	selectedLabels []string
+	filters        []tsLabelFilter
+	groupBy        string
+	reducer        string
+}
+
+// parseTSRangeBound parses "-", "+" or a timestamp.
+func parseTSRangeBound(arg string, def int64) (int64, error) {
+	if arg == "-" || arg == "+" {
+		return def, nil
+	}
+	ts, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, errTSTimestamp
+	}
+	return ts, nil
+}
+
+// parseTSRangeQuery parses the arguments after the key of a range command,
+// or after TS.MRANGE itself when multi is set.
+func parseTSRangeQuery(args []string, reverse, multi bool) (tsRangeQuery, error) {
+	q := tsRangeQuery{reverse: reverse, count: -1, bucketTS: "-"}
+	if len(args) < 2 {
+		return q, errSyntax
+	}
+	var err error
+	if q.from, err = parseTSRangeBound(args[0], 0); err != nil {
+		return q, err
+	}
+	if q.to, err = parseTSRangeBound(args[1], math.MaxInt64); err != nil {
+		return q, err
+	}
+	alignArg := ""
+	for i := 2; i < len(args); i++ {
+		need := func(n int) error {
+			if i+n >= len(args) {
+				return errSyntax
+			}
+			return nil
+		}
+		switch opt := strings.ToUpper(args[i]); opt {
+		case "LATEST", "EMPTY":
+			q.empty = q.empty || opt == "EMPTY"
+		case "FILTER_BY_TS":
+			for i+1 < len(args) {
+				ts, err := strconv.ParseInt(args[i+1], 10, 64)
+				if err != nil {
+					break
+				}
+				q.filterTS = append(q.filterTS, ts)
+				i++
+			}
+			if len(q.filterTS) == 0 {
+				return q, errSyntax
+			}
+		case "FILTER_BY_VALUE":
+			if err := need(2); err != nil {
+				return q, err
+			}
+			if q.minVal, err = parseTSValue(args[i+1]); err != nil {
+				return q, err
+			}
+			if q.maxVal, err = parseTSValue(args[i+2]); err != nil {
+				return q, err
+			}
+			q.filterValue = true
+			i += 2
+		case "COUNT":
+			if err := need(1); err != nil {
+				return q, err
+			}
+			if q.count, err = strconv.Atoi(args[i+1]); err != nil || q.count < 0 {
+				return q, fmt.Errorf("TSDB: Couldn't parse COUNT")
+			}
+			i++
+		case "ALIGN":
+			if err := need(1); err != nil {
+				return q, err
+			}
+			alignArg = args[i+1]
+			i++
+		case "AGGREGATION":
+			if err := need(2); err != nil {
+				return q, err
+			}
+			if q.agg, err = parseTSAggregation(args[i+1]); err != nil {
+				return q, err
+			}
+			if q.duration, err = strconv.ParseInt(args[i+2], 10, 64); err != nil || q.duration <= 0 {
+				return q, fmt.Errorf("TSDB: bucketDuration must be greater than zero")
+			}
+			i += 2
+		case "BUCKETTIMESTAMP":
+			if err := need(1); err != nil {
+				return q, err
+			}
+			switch strings.ToLower(args[i+1]) {
+			case "-", "start":
+				q.bucketTS = "-"
+			case "+", "end":
+				q.bucketTS = "+"
+			case "~", "mid":
+				q.bucketTS = "~"
+			default:
+				return q, fmt.Errorf("TSDB: unknown BUCKETTIMESTAMP parameter")
+			}
+			i++
+		case "WITHLABELS":
+			if !multi {
+				return q, errSyntax
+			}
+			q.withLabels = true
+		case "SELECTED_LABELS":
+			if !multi {
+				return q, errSyntax
+			}
+			for i+1 < len(args) && !isTSRangeKeyword(args[i+1]) {
+				q.selectedLabels = append(q.selectedLabels, args[i+1])
+				i++
+			}
+		case "FILTER":
+			if !multi {
+				return q, errSyntax
+			}
+			for i+1 < len(args) && !isTSRangeKeyword(args[i+1]) {
+				f, err := parseTSLabelFilter(args[i+1])
+				if err != nil {
+					return q, err
+				}
+				q.filters = append(q.filters, f)
+				i++
+			}
+		case "GROUPBY":
+			if !multi || i+3 >= len(args) || !strings.EqualFold(args[i+2], "REDUCE") {
+				return q, errSyntax
+			}
+			q.groupBy = args[i+1]
+			if q.reducer, err = parseTSAggregation(args[i+3]); err != nil {
+				return q, err
+			}
+			i += 3
+		default:
+			return q, errSyntax
+		}
+	}
+
+	if alignArg != "" {
+		switch alignArg {
+		case "-", "start":
+			q.align = q.from
+		case "+", "end":
+			q.align = q.to
+		default:
+			if q.align, err = strconv.ParseInt(alignArg, 10, 64); err != nil {
+				return q, errTSTimestamp
+			}
+		}
+	}
+	if multi && !slices.ContainsFunc(q.filters, func(f tsLabelFilter) bool { return f.positive() }) {
+		return q, fmt.Errorf("TSDB: please provide at least one matcher")
+	}
+	if q.withLabels && q.selectedLabels != nil {
+		return q, fmt.Errorf("TSDB: WITHLABELS and SELECTED_LABELS are mutually exclusive")
+	}
+	return q, nil
+}
+
+func isTSRangeKeyword(arg string) bool {
+	switch strings.ToUpper(arg) {
+	case "LATEST", "EMPTY", "FILTER_BY_TS", "FILTER_BY_VALUE", "COUNT", "ALIGN", "AGGREGATION",
+		"BUCKETTIMESTAMP", "WITHLABELS", "SELECTED_LABELS", "FILTER", "GROUPBY":
+		return true
+	}
+	return false
+}
+
+// run returns the samples of a series selected by the query.
+func (q tsRangeQuery) run(t *TimeSeries) []tsSample {
+	samples := []tsSample{}
+	for _, s := range t.Range(q.from, q.to) {
+		if q.filterTS != nil && !slices.Contains(q.filterTS, s.ts) {
+			continue
+		}
+		if q.filterValue && (s.value < q.minVal || s.value > q.maxVal) {
+			continue
+		}
+		samples = append(samples, s)
+	}
+	if q.agg != "" {
+		samples = q.aggregate(samples)
+	}
+	if q.reverse {
+		slices.Reverse(samples)
+	}
+	if q.count >= 0 && len(samples) > q.count {
+		samples = samples[:q.count]
+	}
+	return samples
+}
+
+// aggregate groups samples into buckets and reduces each one.
+func (q tsRangeQuery) aggregate(samples []tsSample) []tsSample {
+	result := []tsSample{}
+	emit := func(start int64, values []float64) {
+		ts := start
+		switch q.bucketTS {
+		case "+":
+			ts += q.duration
+		case "~":
+			ts += q.duration / 2
+		}
+		result = append(result, tsSample{ts, tsAggregate(q.agg, values)})
+	}
+	for i := 0; i < len(samples); {
+		start := tsBucketStart(samples[i].ts, q.duration, q.align)
+		if q.empty && len(result) > 0 {
+			prev := tsBucketStart(samples[i-1].ts, q.duration, q.align)
+			for b := prev + q.duration; b < start; b += q.duration {
+				emit(b, nil)
+			}
+		}
+		values := []float64{}
+		for i < len(samples) && samples[i].ts < start+q.duration {
+			values = append(values, samples[i].value)
+			i++
+		}
+		emit(start, values)
+	}
+	return result
+}
+
+// encodeTSSamples encodes samples as [timestamp, value] pairs.
+func encodeTSSamples(samples []tsSample) string {
+	result := make([]string, 0, len(samples))
+	for _, s := range samples {
+		value := "nan"
+		if !math.IsNaN(s.value) {
+			value = formatFloat(s.value)
+		}
+		result = append(result, encodeArray(encodeInteger(int(s.ts)), encodeBulkString(value)))
+	}
+	return encodeArray(result...)
+}
+
+// handleTSRange handles TS.RANGE and, with reverse set, TS.REVRANGE
+// commands.
+func (c *ClientHandler) handleTSRange(args []string, reverse bool) error {
+	if len(args) < 3 {
+		return fmt.Errorf("insufficient number of arguments for TS.RANGE")
+	}
+	q, err := parseTSRangeQuery(args[1:], reverse, false)
+	if err != nil {
+		return err
+	}
+	t, err := c.Store.timeSeries(args[0])
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return errTSNoKey
+	}
+	return c.send(encodeTSSamples(q.run(t)))
+}
+
+// tsLabelFilter is a TS.MRANGE filter such as area=(north,south) or
+// sensor!=. An empty value list matches series without the label.
+type tsLabelFilter struct {
+	label  string
+	equal  bool
+	values []string
+}
+
+// positive reports whether the filter requires a label value, which every
+// TS.MRANGE needs at least one of.
+func (f tsLabelFilter) positive() bool {
+	return f.equal && len(f.values) > 0
+}
+
+func parseTSLabelFilter(arg string) (tsLabelFilter, error) {
+	f := tsLabelFilter{equal: true}
+	i := strings.Index(arg, "=")
+	if i <= 0 {
+		return f, fmt.Errorf("TSDB: failed parsing labels")
+	}
+	f.label = arg[:i]
+	if strings.HasSuffix(f.label, "!") {
+		f.label, f.equal = f.label[:len(f.label)-1], false
+	}
+	value := arg[i+1:]
+	if strings.HasPrefix(value, "(") && strings.HasSuffix(value, ")") {
+		f.values = strings.Split(value[1:len(value)-1], ",")
+	} else if value != "" {
+		f.values = []string{value}
+	}
+	return f, nil
+}
+
+func (f tsLabelFilter) match(t *TimeSeries) bool {
+	value, ok := t.Label(f.label)
+	in := ok && slices.Contains(f.values, value)
+	if len(f.values) == 0 {
+		// label= matches series without the label, label!= those with it.
+		return ok != f.equal
+	}
+	return in == f.equal
+}
+
+// handleTSMRange handles TS.MRANGE and, with reverse set, TS.MREVRANGE
+// commands.
+func (c *ClientHandler) handleTSMRange(args []string, reverse bool) error {
+	if len(args) < 3 {
+		return fmt.Errorf("insufficient number of arguments for TS.MRANGE")
+	}
+	q, err := parseTSRangeQuery(args, reverse, true)
+	if err != nil {
+		return err
+	}
+
+	type series struct {
+		key     string
+		labels  [][2]string
+		samples []tsSample
+	}
+	matched := []series{}
+	for key, val := range c.Store.kv {
+		t, ok := val.(*TimeSeries)
+		if !ok {
+			continue
+		}
+		if _, found := c.Store.lookup(key); !found {
+			continue
+		}
+		if !slices.ContainsFunc(q.filters, func(f tsLabelFilter) bool { return !f.match(t) }) {
+			matched = append(matched, series{key, t.labels, q.run(t)})
+		}
+	}
+	slices.SortFunc(matched, func(a, b series) int { return strings.Compare(a.key, b.key) })
+
+	if q.groupBy != "" {
+		groups := map[string][]series{}
+		names := []string{}
+		for _, s := range matched {
+			t := &TimeSeries{labels: s.labels}
+			value, ok := t.Label(q.groupBy)
+			if !ok {
+				continue
+			}
+			if _, seen := groups[value]; !seen {
+				names = append(names, value)
+			}
+			groups[value] = append(groups[value], s)
+		}
+		matched = matched[:0]
+		for _, value := range names {
+			byTS := map[int64][]float64{}
+			sources := []string{}
+			for _, s := range groups[value] {
+				sources = append(sources, s.key)
+				for _, sample := range s.samples {
+					byTS[sample.ts] = append(byTS[sample.ts], sample.value)
+				}
+			}
+			samples := make([]tsSample, 0, len(byTS))
+			for ts, values := range byTS {
+				samples = append(samples, tsSample{ts, tsAggregate(q.reducer, values)})
+			}
+			slices.SortFunc(samples, func(a, b tsSample) int {
+				if q.reverse {
+					a, b = b, a
+				}
+				return int(max(min(a.ts-b.ts, 1), -1))
+			})
+			labels := [][2]string{
+				{q.groupBy, value},
+				{"__reducer__", q.reducer},
+				{"__source__", strings.Join(sources, ",")},
+			}
+			matched = append(matched, series{q.groupBy + "=" + value, labels, samples})
+		}
+	}
+
+	result := make([]string, 0, len(matched))
+	for _, s := range matched {
+		labels := []string{}
+		switch {
+		case q.withLabels || q.groupBy != "":
+			for _, l := range s.labels {
+				labels = append(labels, encodeBulkStringArray(2, l[0], l[1]))
+			}
+		case q.selectedLabels != nil:
+			t := &TimeSeries{labels: s.labels}
+			for _, name := range q.selectedLabels {
+				if value, ok := t.Label(name); ok {
+					labels = append(labels, encodeBulkStringArray(2, name, value))
+				} else {
+					labels = append(labels, encodeArray(encodeBulkString(name), nullResponse))
+				}
+			}
+		}
+		result = append(result, encodeArray(encodeBulkString(s.key), encodeArray(labels...), encodeTSSamples(s.samples)))
+	}
+	return c.send(encodeArray(result...))
+}
+
+// tsRenamed updates the compaction rules linking a series to others after
+// it was renamed.
+func (s *Store) tsRenamed(t *TimeSeries, from, to string) {
+	if t.srcKey != "" {
+		if src, err := s.timeSeries(t.srcKey); err == nil && src != nil {
+			for _, rule := range src.rules {
+				if rule.dest == from {
+					rule.dest = to
+				}
+			}
+		}
+	}
+	for _, rule := range t.rules {
+		if dest, err := s.timeSeries(rule.dest); err == nil && dest != nil {
+			dest.srcKey = to
+		}
+	}
+}
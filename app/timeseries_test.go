@@ -0,0 +1,217 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestTimeSeriesAdd(t *testing.T) {
+	tests := []struct {
+		policy  string
+		want    float64
+		wantErr bool
+	}{
+		{tsPolicyBlock, 10, true},
+		{tsPolicyFirst, 10, false},
+		{tsPolicyLast, 4, false},
+		{tsPolicyMin, 4, false},
+		{tsPolicyMax, 10, false},
+		{tsPolicySum, 14, false},
+	}
+	for _, tt := range tests {
+		ts := NewTimeSeries()
+		ts.Add(100, 10, tt.policy)
+		err := ts.Add(100, 4, tt.policy)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Add error = %v", tt.policy, err)
+		}
+		if got := ts.samples[0].value; len(ts.samples) != 1 || got != tt.want {
+			t.Errorf("%s: samples = %v, want a single %v", tt.policy, ts.samples, tt.want)
+		}
+	}
+}
+
+func TestTimeSeriesRetention(t *testing.T) {
+	ts := NewTimeSeries()
+	ts.retention = 100
+	for _, stamp := range []int64{50, 10, 120, 200} {
+		if err := ts.Add(stamp, 1, tsPolicyBlock); err != nil {
+			t.Fatalf("Add(%d): %v", stamp, err)
+		}
+	}
+	// 200 leaves only samples at 100 or later.
+	var got []int64
+	for _, s := range ts.samples {
+		got = append(got, s.ts)
+	}
+	if !slices.Equal(got, []int64{120, 200}) {
+		t.Errorf("timestamps = %v, want [120 200]", got)
+	}
+	if err := ts.Add(99, 1, tsPolicyBlock); err == nil {
+		t.Errorf("added a sample older than the retention window")
+	}
+}
+
+func TestTSBucketStart(t *testing.T) {
+	tests := []struct {
+		ts, duration, align, want int64
+	}{
+		{0, 10, 0, 0},
+		{9, 10, 0, 0},
+		{10, 10, 0, 10},
+		{15, 10, 3, 13},
+		{12, 10, 3, 3},
+		{2, 10, 3, -7},
+	}
+	for _, tt := range tests {
+		if got := tsBucketStart(tt.ts, tt.duration, tt.align); got != tt.want {
+			t.Errorf("tsBucketStart(%d, %d, %d) = %d, want %d", tt.ts, tt.duration, tt.align, got, tt.want)
+		}
+	}
+}
+
+func TestTSAggregate(t *testing.T) {
+	values := []float64{2, 4, 4, 4, 5, 5, 7, 9}
+	tests := []struct {
+		agg  string
+		want float64
+	}{
+		{"avg", 5},
+		{"sum", 40},
+		{"min", 2},
+		{"max", 9},
+		{"range", 7},
+		{"count", 8},
+		{"first", 2},
+		{"last", 9},
+		{"var.p", 4},
+		{"std.p", 2},
+		{"var.s", 32.0 / 7},
+		{"std.s", math.Sqrt(32.0 / 7)},
+	}
+	for _, tt := range tests {
+		if got := tsAggregate(tt.agg, values); math.Abs(got-tt.want) > 1e-12 {
+			t.Errorf("tsAggregate(%s) = %v, want %v", tt.agg, got, tt.want)
+		}
+	}
+	if got := tsAggregate("count", nil); got != 0 {
+		t.Errorf("count of an empty bucket = %v", got)
+	}
+	if got := tsAggregate("avg", nil); !math.IsNaN(got) {
+		t.Errorf("avg of an empty bucket = %v", got)
+	}
+	if got := tsAggregate("std.s", []float64{3}); got != 0 {
+		t.Errorf("std.s of one value = %v", got)
+	}
+}
+
+func TestTSRangeQuery(t *testing.T) {
+	ts := NewTimeSeries()
+	for _, s := range []tsSample{{0, 1}, {5, 2}, {12, 3}, {35, 4}, {38, 5}} {
+		ts.Add(s.ts, s.value, tsPolicyBlock)
+	}
+	tests := []struct {
+		args    []string
+		reverse bool
+		want    []tsSample
+	}{
+		{[]string{"-", "+"}, false, []tsSample{{0, 1}, {5, 2}, {12, 3}, {35, 4}, {38, 5}}},
+		{[]string{"5", "35"}, false, []tsSample{{5, 2}, {12, 3}, {35, 4}}},
+		{[]string{"-", "+", "COUNT", "2"}, true, []tsSample{{38, 5}, {35, 4}}},
+		{[]string{"-", "+", "FILTER_BY_TS", "5", "38", "FILTER_BY_VALUE", "3", "10"}, false, []tsSample{{38, 5}}},
+		{[]string{"-", "+", "AGGREGATION", "sum", "10"}, false, []tsSample{{0, 3}, {10, 3}, {30, 9}}},
+		{[]string{"-", "+", "AGGREGATION", "count", "10", "EMPTY"}, false, []tsSample{{0, 2}, {10, 1}, {20, 0}, {30, 2}}},
+		{[]string{"-", "+", "AGGREGATION", "max", "10", "BUCKETTIMESTAMP", "end"}, false, []tsSample{{10, 2}, {20, 3}, {40, 5}}},
+		{[]string{"-", "+", "AGGREGATION", "min", "10", "ALIGN", "5"}, false, []tsSample{{-5, 1}, {5, 2}, {35, 4}}},
+	}
+	for _, tt := range tests {
+		q, err := parseTSRangeQuery(tt.args, tt.reverse, false)
+		if err != nil {
+			t.Errorf("parseTSRangeQuery(%q): %v", tt.args, err)
+			continue
+		}
+		if got := q.run(ts); !slices.Equal(got, tt.want) {
+			t.Errorf("%q = %v, want %v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestParseTSRangeQueryErrors(t *testing.T) {
+	tests := []struct {
+		args  []string
+		multi bool
+	}{
+		{[]string{"-"}, false},
+		{[]string{"x", "+"}, false},
+		{[]string{"-", "+", "COUNT"}, false},
+		{[]string{"-", "+", "COUNT", "-1"}, false},
+		{[]string{"-", "+", "AGGREGATION", "median", "10"}, false},
+		{[]string{"-", "+", "AGGREGATION", "avg", "0"}, false},
+		{[]string{"-", "+", "BUCKETTIMESTAMP", "late"}, false},
+		{[]string{"-", "+", "WITHLABELS"}, false},
+		{[]string{"-", "+", "FILTER", "a!=b"}, true},
+		{[]string{"-", "+", "WITHLABELS", "SELECTED_LABELS", "a", "FILTER", "a=b"}, true},
+	}
+	for _, tt := range tests {
+		if _, err := parseTSRangeQuery(tt.args, false, tt.multi); err == nil {
+			t.Errorf("parseTSRangeQuery(%q) succeeded", tt.args)
+		}
+	}
+}
+
+func TestTSLabelFilter(t *testing.T) {
+	ts := NewTimeSeries()
+	ts.labels = [][2]string{{"area", "north"}, {"sensor", "1"}}
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{"area=north", true},
+		{"area=south", false},
+		{"area=(south,north)", true},
+		{"area!=north", false},
+		{"area!=(south,east)", true},
+		{"missing=", true},
+		{"sensor=", false},
+		{"sensor!=", true},
+		{"missing!=", false},
+	}
+	for _, tt := range tests {
+		f, err := parseTSLabelFilter(tt.filter)
+		if err != nil {
+			t.Errorf("parseTSLabelFilter(%s): %v", tt.filter, err)
+			continue
+		}
+		if got := f.match(ts); got != tt.want {
+			t.Errorf("%s matched %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+	if _, err := parseTSLabelFilter("=x"); err == nil {
+		t.Errorf("parseTSLabelFilter(=x) succeeded")
+	}
+}
+
+func TestTSCompaction(t *testing.T) {
+	s := NewStore()
+	src, dest := NewTimeSeries(), NewTimeSeries()
+	s.create("src", src)
+	s.create("dest", dest)
+	src.rules = []*tsRule{{dest: "dest", agg: "avg", duration: 10, current: -1}}
+
+	for _, sample := range []tsSample{{1, 2}, {5, 4}, {12, 10}, {25, 1}} {
+		src.Add(sample.ts, sample.value, tsPolicyBlock)
+		s.tsCompact(src, sample.ts)
+	}
+	// The bucket starting at 20 is still open.
+	if want := []tsSample{{0, 3}, {10, 10}}; !slices.Equal(dest.samples, want) {
+		t.Errorf("dest = %v, want %v", dest.samples, want)
+	}
+
+	// A late sample recomputes its closed bucket.
+	src.Add(8, 6, tsPolicyBlock)
+	s.tsCompact(src, 8)
+	if want := []tsSample{{0, 4}, {10, 10}}; !slices.Equal(dest.samples, want) {
+		t.Errorf("dest = %v after a late sample, want %v", dest.samples, want)
+	}
+}
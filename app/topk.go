@@ -0,0 +1,353 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	topkDefaultWidth   = 8
+	topkDefaultDepth   = 7
+	topkDefaultDecay   = 0.9
+	topkFingerprintKey = 1919 // seed of the fingerprint hash
+	topkDecayTableSize = 256
+)
+
+// topkBucket is a HeavyKeeper counter, owned by the item whose fingerprint
+// it holds.
+type topkBucket struct {
+	fp    uint32
+	count uint32
+}
+
+// topkEntry is an item in the heap of the current top k.
+type topkEntry struct {
+	item  string
+	fp    uint32
+	count uint32
+}
+
+// TopK tracks the k most frequent items with the HeavyKeeper algorithm.
+// Colliding items decay a bucket's count with exponentially falling
+// probability, so heavy hitters keep their buckets while rare items do not.
+type TopK struct {
+	k, width, depth int
+	decay           float64
+	buckets         []topkBucket
+	heap            []topkEntry // min-heap on count
+}
+
+func NewTopK(k, width, depth int, decay float64) *TopK {
+	return &TopK{
+		k: k, width: width, depth: depth, decay: decay,
+		buckets: make([]topkBucket, width*depth),
+		heap:    make([]topkEntry, k),
+	}
+}
+
+func (t *TopK) fingerprint(item string) uint32 {
+	return uint32(murmurHash64A([]byte(item), topkFingerprintKey))
+}
+
+// heapIndex returns the position of item in the heap, or -1.
+func (t *TopK) heapIndex(item string, fp uint32) int {
+	for i, e := range t.heap {
+		if e.fp == fp && e.item == item && e.count > 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// siftDown restores the heap order below i.
+func (t *TopK) siftDown(i int) {
+	for {
+		smallest := i
+		for _, child := range []int{2*i + 1, 2*i + 2} {
+			if child < len(t.heap) && t.heap[child].count < t.heap[smallest].count {
+				smallest = child
+			}
+		}
+		if smallest == i {
+			return
+		}
+		t.heap[i], t.heap[smallest] = t.heap[smallest], t.heap[i]
+		i = smallest
+	}
+}
+
+// Add counts item incr times and returns the item it expelled from the
+// top k, if any.
+func (t *TopK) Add(item string, incr uint32) (string, bool) {
+	fp := t.fingerprint(item)
+	var maxCount uint32
+	for row := 0; row < t.depth; row++ {
+		loc := murmurHash64A([]byte(item), uint64(row)) % uint64(t.width)
+		b := &t.buckets[row*t.width+int(loc)]
+		switch {
+		case b.count == 0:
+			b.fp, b.count = fp, incr
+		case b.fp == fp:
+			b.count += incr
+		default:
+			for local := incr; local > 0; local-- {
+				decay := math.Pow(t.decay, float64(min(b.count, topkDecayTableSize-1)))
+				if rand.Float64() < decay {
+					b.count--
+					if b.count == 0 {
+						b.fp, b.count = fp, local
+						break
+					}
+				}
+			}
+		}
+		if b.fp == fp {
+			maxCount = max(maxCount, b.count)
+		}
+	}
+
+	if maxCount < t.heap[0].count {
+		return "", false
+	}
+	if i := t.heapIndex(item, fp); i >= 0 {
+		t.heap[i].count = maxCount
+		t.siftDown(i)
+		return "", false
+	}
+	expelled := t.heap[0]
+	t.heap[0] = topkEntry{item, fp, maxCount}
+	t.siftDown(0)
+	return expelled.item, expelled.count > 0
+}
+
+// Query reports whether item is among the top k.
+func (t *TopK) Query(item string) bool {
+	return t.heapIndex(item, t.fingerprint(item)) >= 0
+}
+
+// List returns the top k items, most frequent first.
+func (t *TopK) List() []topkEntry {
+	entries := []topkEntry{}
+	for _, e := range t.heap {
+		if e.count > 0 {
+			entries = append(entries, e)
+		}
+	}
+	slices.SortStableFunc(entries, func(a, b topkEntry) int {
+		switch {
+		case a.count > b.count:
+			return -1
+		case a.count < b.count:
+			return 1
+		}
+		return strings.Compare(a.item, b.item)
+	})
+	return entries
+}
+
+// Top-K sketches are saved as module entries of this server's own type.
+const (
+	topkModuleName   = "TopKHeavy"
+	topkModuleEncver = 1
+)
+
+func (t *TopK) moduleType() (string, int) {
+	return topkModuleName, topkModuleEncver
+}
+
+func (t *TopK) saveModule(w *moduleWriter) {
+	w.saveUnsigned(uint64(t.k))
+	w.saveUnsigned(uint64(t.width))
+	w.saveUnsigned(uint64(t.depth))
+	w.saveDouble(t.decay)
+	for _, b := range t.buckets {
+		w.saveUnsigned(uint64(b.fp))
+		w.saveUnsigned(uint64(b.count))
+	}
+	for _, e := range t.heap {
+		w.saveString(e.item)
+		w.saveUnsigned(uint64(e.fp))
+		w.saveUnsigned(uint64(e.count))
+	}
+}
+
+func loadTopK(r *moduleReader, encver int) (any, error) {
+	if encver != topkModuleEncver {
+		return nil, fmt.Errorf("unsupported Top-K encoding version %d", encver)
+	}
+	var dims [3]int
+	for i := range dims {
+		n, err := r.loadUnsigned()
+		if err != nil {
+			return nil, err
+		}
+		dims[i] = int(n)
+	}
+	decay, err := r.loadDouble()
+	if err != nil {
+		return nil, err
+	}
+	t := NewTopK(dims[0], dims[1], dims[2], decay)
+	for i := range t.buckets {
+		fp, err := r.loadUnsigned()
+		if err != nil {
+			return nil, err
+		}
+		count, err := r.loadUnsigned()
+		if err != nil {
+			return nil, err
+		}
+		t.buckets[i] = topkBucket{uint32(fp), uint32(count)}
+	}
+	for i := range t.heap {
+		item, err := r.loadString()
+		if err != nil {
+			return nil, err
+		}
+		fp, err := r.loadUnsigned()
+		if err != nil {
+			return nil, err
+		}
+		count, err := r.loadUnsigned()
+		if err != nil {
+			return nil, err
+		}
+		t.heap[i] = topkEntry{item, uint32(fp), uint32(count)}
+	}
+	return t, nil
+}
+
+func init() {
+	moduleLoaders[topkModuleName] = loadTopK
+}
+
+var errTopKNoKey = fmt.Errorf("TopK: key does not exist")
+
+// topk returns the Top-K sketch stored at key, or nil if there is none.
+func (s *Store) topk(key string) (*TopK, error) {
+	val, found := s.lookup(key)
+	if !found {
+		return nil, nil
+	}
+	t, ok := val.(*TopK)
+	if !ok {
+		return nil, errWrongType
+	}
+	return t, nil
+}
+
+// handleTopKReserve handles TOPK.RESERVE commands.
+func (c *ClientHandler) handleTopKReserve(args []string) error {
+	if len(args) != 2 && len(args) != 5 {
+		return fmt.Errorf("wrong number of arguments for TOPK.RESERVE")
+	}
+	key := args[0]
+	k, err := strconv.Atoi(args[1])
+	if err != nil || k < 1 {
+		return fmt.Errorf("TopK: invalid k")
+	}
+	width, depth, decay := topkDefaultWidth, topkDefaultDepth, topkDefaultDecay
+	if len(args) == 5 {
+		if width, err = strconv.Atoi(args[2]); err != nil || width < 1 {
+			return fmt.Errorf("TopK: invalid width")
+		}
+		if depth, err = strconv.Atoi(args[3]); err != nil || depth < 1 {
+			return fmt.Errorf("TopK: invalid depth")
+		}
+		if decay, err = strconv.ParseFloat(args[4], 64); err != nil || decay <= 0 || decay > 1 {
+			return fmt.Errorf("TopK: invalid decay value. must be '<= 1' & '> 0'")
+		}
+	}
+	if _, found := c.Store.lookup(key); found {
+		return fmt.Errorf("TopK: key already exists")
+	}
+	fmt.Printf("TOPK.RESERVE %s command received.", key)
+
+	c.Store.create(key, NewTopK(k, width, depth, decay))
+	c.Store.notify(notifyModule, "topk.reserve", key)
+	c.Store.touch(key)
+	return c.send(okResponse)
+}
+
+// handleTopKAdd handles TOPK.ADD commands.
+func (c *ClientHandler) handleTopKAdd(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("insufficient number of arguments for TOPK.ADD")
+	}
+	t, err := c.Store.topk(args[0])
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return errTopKNoKey
+	}
+	fmt.Printf("TOPK.ADD %s command received.", args[0])
+
+	result := make([]string, 0, len(args)-1)
+	for _, item := range args[1:] {
+		if expelled, ok := t.Add(item, 1); ok {
+			result = append(result, encodeBulkString(expelled))
+		} else {
+			result = append(result, nullResponse)
+		}
+	}
+	c.Store.notify(notifyModule, "topk.add", args[0])
+	c.Store.touch(args[0])
+	return c.send(encodeArray(result...))
+}
+
+// handleTopKQuery handles TOPK.QUERY commands.
+func (c *ClientHandler) handleTopKQuery(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("insufficient number of arguments for TOPK.QUERY")
+	}
+	t, err := c.Store.topk(args[0])
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return errTopKNoKey
+	}
+	result := make([]string, 0, len(args)-1)
+	for _, item := range args[1:] {
+		if t.Query(item) {
+			result = append(result, encodeInteger(1))
+		} else {
+			result = append(result, encodeInteger(0))
+		}
+	}
+	return c.send(encodeArray(result...))
+}
+
+// handleTopKList handles TOPK.LIST commands.
+func (c *ClientHandler) handleTopKList(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("wrong number of arguments for TOPK.LIST")
+	}
+	withCount := false
+	if len(args) == 2 {
+		if !strings.EqualFold(args[1], "WITHCOUNT") {
+			return errSyntax
+		}
+		withCount = true
+	}
+	t, err := c.Store.topk(args[0])
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return errTopKNoKey
+	}
+	result := []string{}
+	for _, e := range t.List() {
+		result = append(result, encodeBulkString(e.item))
+		if withCount {
+			result = append(result, encodeInteger(int(e.count)))
+		}
+	}
+	return c.send(encodeArray(result...))
+}
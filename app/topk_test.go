@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestTopK(t *testing.T) {
+	tk := NewTopK(3, 50, 5, topkDefaultDecay)
+	// Three heavy hitters among many items seen once.
+	heavy := map[string]uint32{"a": 300, "b": 200, "c": 100}
+	for i := 0; i < 1000; i++ {
+		tk.Add("noise"+strconv.Itoa(i), 1)
+		for item, count := range heavy {
+			if uint32(i) < count {
+				tk.Add(item, 1)
+			}
+		}
+	}
+
+	list := tk.List()
+	want := []string{"a", "b", "c"}
+	if len(list) != len(want) {
+		t.Fatalf("List() has %d items, want %d", len(list), len(want))
+	}
+	for i, e := range list {
+		if e.item != want[i] {
+			t.Errorf("List()[%d] = %s, want %s", i, e.item, want[i])
+		}
+		if !tk.Query(e.item) {
+			t.Errorf("Query(%s) = false", e.item)
+		}
+	}
+	if tk.Query("noise1") {
+		t.Errorf("Query(noise1) = true")
+	}
+}
+
+func TestTopKExpel(t *testing.T) {
+	tk := NewTopK(1, 8, 7, topkDefaultDecay)
+	tests := []struct {
+		item         string
+		incr         uint32
+		wantExpelled string
+	}{
+		{"a", 1, ""},
+		{"a", 1, ""},
+		{"b", 5, "a"},
+		{"a", 1, ""},
+	}
+	for _, tt := range tests {
+		if expelled, _ := tk.Add(tt.item, tt.incr); expelled != tt.wantExpelled {
+			t.Errorf("Add(%s, %d) expelled %q, want %q", tt.item, tt.incr, expelled, tt.wantExpelled)
+		}
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	keyTrackingTableMaxKeys     = "tracking-table-max-keys" // config key for the tracking table size, 0 for no limit
+	defaultTrackingTableMaxKeys = 1000000
+
+	// invalidateChannel carries the invalidation messages of RESP2 clients,
+	// which can only receive them through a redirect to a subscriber.
+	invalidateChannel = "__redis__:invalidate"
+)
+
+// clientTracking is the CLIENT TRACKING state of a client that turned it on.
+type clientTracking struct {
+	redirect int64    // ID of the client receiving invalidations, or 0
+	bcast    bool     // announce changes to keys with the prefixes
+	prefixes []string // BCAST prefixes
+	optin    bool     // only track reads following CLIENT CACHING YES
+	optout   bool     // track reads unless following CLIENT CACHING NO
+	noloop   bool     // skip invalidations of keys the client changed
+
+	// caching is the CLIENT CACHING answer for the next command: 1 for
+	// yes, -1 for no and 0 if it wasn't called.
+	caching int
+}
+
+// trackingTable remembers which keys clients may have cached, to tell them
+// when the keys change. Like the rest of the store, it is used with the
+// store lock held.
+type trackingTable struct {
+	server *Server
+
+	// keys holds the IDs of the clients that read each key, in the default
+	// mode. Each key is forgotten once its readers have been told it
+	// changed, and disconnected clients are skipped.
+	keys map[string]map[int64]struct{}
+
+	// prefixes holds the BCAST clients of each prefix, and broadcast the
+	// keys changed by the running command, with the client that changed
+	// them. They are announced together once the command is done.
+	prefixes  map[string]map[*ClientHandler]struct{}
+	broadcast map[string]*ClientHandler
+
+	// current is the client running a command, for NOLOOP.
+	current *ClientHandler
+}
+
+func newTrackingTable(server *Server) *trackingTable {
+	return &trackingTable{
+		server:    server,
+		keys:      make(map[string]map[int64]struct{}),
+		prefixes:  make(map[string]map[*ClientHandler]struct{}),
+		broadcast: make(map[string]*ClientHandler),
+	}
+}
+
+// maxKeys returns the size limit of the tracking table.
+func (t *trackingTable) maxKeys() int {
+	if val, err := t.server.Config.Get(keyTrackingTableMaxKeys); err == nil {
+		if n, err := strconv.Atoi(val); err == nil && n >= 0 {
+			return n
+		}
+	}
+	return defaultTrackingTableMaxKeys
+}
+
+// track remembers that c read key. Once the table is full, other keys are
+// evicted by telling their readers they changed.
+func (t *trackingTable) track(c *ClientHandler, key string) {
+	if t.keys[key] == nil {
+		t.keys[key] = make(map[int64]struct{})
+	}
+	t.keys[key][c.id] = struct{}{}
+	t.evict(key)
+}
+
+// evict shrinks the table to its size limit, evicting keys other than keep
+// by telling their readers they changed.
+func (t *trackingTable) evict(keep string) {
+	for limit := t.maxKeys(); limit > 0 && len(t.keys) > limit; {
+		for other := range t.keys {
+			if other != keep {
+				t.invalidateKey(other, false)
+				break
+			}
+		}
+	}
+}
+
+// untrack forgets the BCAST prefixes of c.
+func (t *trackingTable) untrack(c *ClientHandler) {
+	for _, prefix := range c.tracking.prefixes {
+		delete(t.prefixes[prefix], c)
+		if len(t.prefixes[prefix]) == 0 {
+			delete(t.prefixes, prefix)
+		}
+	}
+}
+
+// invalidate tells the clients tracking key that it changed, the BCAST
+// ones once the running command is done.
+func (t *trackingTable) invalidate(key string) {
+	if t == nil {
+		return
+	}
+	t.invalidateKey(key, true)
+	if len(t.prefixes) > 0 {
+		t.broadcast[key] = t.current
+	}
+}
+
+// flushBroadcast tells the BCAST clients about the keys changed under
+// their prefixes, in one message per client.
+func (t *trackingTable) flushBroadcast() {
+	if t == nil || len(t.broadcast) == 0 {
+		return
+	}
+	keys := make(map[*ClientHandler][]string)
+	for prefix, clients := range t.prefixes {
+		for key, changedBy := range t.broadcast {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			for c := range clients {
+				if !c.tracking.noloop || c != changedBy {
+					keys[c] = append(keys[c], key)
+				}
+			}
+		}
+	}
+	t.broadcast = make(map[string]*ClientHandler)
+	for c, keys := range keys {
+		sort.Strings(keys)
+		c.invalidate(keys)
+	}
+}
+
+// invalidateKey tells the clients that read key in the default mode that
+// it changed, skipping the client that changed it if it asked for NOLOOP.
+func (t *trackingTable) invalidateKey(key string, changed bool) {
+	ids := t.keys[key]
+	delete(t.keys, key)
+	for id := range ids {
+		c := t.server.client(id)
+		if c == nil || c.tracking == nil || c.tracking.bcast {
+			continue
+		}
+		if changed && c.tracking.noloop && c == t.current {
+			continue
+		}
+		c.invalidate([]string{key})
+	}
+}
+
+// invalidateAll tells every tracking client that all keys changed, after
+// the keyspace was flushed.
+func (t *trackingTable) invalidateAll() {
+	if t == nil {
+		return
+	}
+	t.keys = make(map[string]map[int64]struct{})
+	for _, c := range t.server.getClients() {
+		if c.tracking != nil {
+			c.invalidate(nil)
+		}
+	}
+}
+
+// invalidate sends an invalidation message for keys, or for every key if
+// keys is nil, to the client or the client it redirects to. RESP3 clients
+// get a push message, and RESP2 clients a message on invalidateChannel if
+// they subscribed to it.
+func (c *ClientHandler) invalidate(keys []string) {
+	target := c
+	if c.tracking.redirect != 0 {
+		target = c.Server.client(c.tracking.redirect)
+		if target == nil {
+			if c.resp == 3 {
+				c.sub.push(encodePush(encodeBulkString("tracking-redir-broken"), encodeInteger(int(c.tracking.redirect))))
+			}
+			return
+		}
+	}
+	payload := encodeBulkStringArray(len(keys), keys...)
+	if target.resp == 3 {
+		if keys == nil {
+			payload = "_\r\n"
+		}
+		target.sub.push(encodePush(encodeBulkString("invalidate"), payload))
+		return
+	}
+	if keys == nil {
+		payload = nullArrayResponse
+	}
+	ps := c.Server.pubsub
+	ps.mu.Lock()
+	_, subscribed := ps.channels[invalidateChannel][target.sub]
+	ps.mu.Unlock()
+	if subscribed {
+		target.sub.push(encodeArray(encodeBulkString("message"), encodeBulkString(invalidateChannel), payload))
+	}
+}
+
+// trackCommand remembers the keys read by cmd for a client tracking them
+// in the default mode, and uses up the CLIENT CACHING answer.
+func (c *ClientHandler) trackCommand(cmd Command, info commandInfo, keys []string) {
+	t := c.tracking
+	if t == nil {
+		return
+	}
+	if strings.EqualFold(cmd.Command, "CLIENT") && len(cmd.Args) > 0 && strings.EqualFold(cmd.Args[0], "CACHING") {
+		return
+	}
+	caching := t.caching
+	t.caching = 0
+	if t.bcast || info.flags&cmdReadOnly == 0 {
+		return
+	}
+	if (t.optin && caching != 1) || (t.optout && caching == -1) {
+		return
+	}
+	for _, key := range keys {
+		c.Server.tracking.track(c, key)
+	}
+}
+
+// stopTracking turns CLIENT TRACKING off for c.
+func (c *ClientHandler) stopTracking() {
+	if c.tracking == nil {
+		return
+	}
+	c.Server.tracking.untrack(c)
+	c.tracking = nil
+}
+
+// handleClientTracking handles CLIENT TRACKING commands.
+func (c *ClientHandler) handleClientTracking(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("wrong number of arguments for CLIENT TRACKING")
+	}
+	var on bool
+	switch strings.ToUpper(args[0]) {
+	case "ON":
+		on = true
+	case "OFF":
+	default:
+		return errSyntax
+	}
+
+	opts := clientTracking{}
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "REDIRECT":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			i++
+			id, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				return errNotInteger
+			}
+			if id != c.id && c.Server.client(id) == nil {
+				return fmt.Errorf("The client ID you want redirect to does not exist")
+			}
+			opts.redirect = id
+		case "PREFIX":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			i++
+			opts.prefixes = append(opts.prefixes, args[i])
+		case "BCAST":
+			opts.bcast = true
+		case "OPTIN":
+			opts.optin = true
+		case "OPTOUT":
+			opts.optout = true
+		case "NOLOOP":
+			opts.noloop = true
+		default:
+			return errSyntax
+		}
+	}
+
+	if !on {
+		c.stopTracking()
+		return c.send(okResponse)
+	}
+	if old := c.tracking; old != nil {
+		if old.bcast != opts.bcast {
+			return fmt.Errorf("You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode.")
+		}
+		if old.optin != opts.optin || old.optout != opts.optout {
+			return fmt.Errorf("You can't switch OPTIN/OPTOUT mode before disabling tracking for this client, and then re-enabling it with a different mode.")
+		}
+	}
+	if len(opts.prefixes) > 0 && !opts.bcast {
+		return fmt.Errorf("PREFIX option requires BCAST mode to be enabled")
+	}
+	if opts.bcast && (opts.optin || opts.optout) {
+		return fmt.Errorf("OPTIN and OPTOUT are not compatible with BCAST")
+	}
+	if opts.optin && opts.optout {
+		return fmt.Errorf("You can't use both OPTIN and OPTOUT")
+	}
+
+	prefixes := opts.prefixes
+	if opts.bcast && len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+	if c.tracking != nil {
+		prefixes = append(append([]string{}, c.tracking.prefixes...), prefixes...)
+	}
+	for i, prefix := range prefixes {
+		for _, other := range prefixes[:i] {
+			if prefix != other && (strings.HasPrefix(prefix, other) || strings.HasPrefix(other, prefix)) {
+				return fmt.Errorf("Prefix '%s' overlaps with an existing prefix '%s'. Prefixes for a single client must not overlap.", prefix, other)
+			}
+		}
+	}
+
+	c.stopTracking()
+	opts.prefixes = nil
+	t := c.Server.tracking
+	for _, prefix := range prefixes {
+		if t.prefixes[prefix] == nil {
+			t.prefixes[prefix] = make(map[*ClientHandler]struct{})
+		}
+		if _, found := t.prefixes[prefix][c]; !found {
+			t.prefixes[prefix][c] = struct{}{}
+			opts.prefixes = append(opts.prefixes, prefix)
+		}
+	}
+	c.tracking = &opts
+	return c.send(okResponse)
+}
+
+// handleClientCaching handles CLIENT CACHING commands, which decide whether
+// the keys read by the next command are tracked in the OPTIN and OPTOUT
+// modes.
+func (c *ClientHandler) handleClientCaching(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("wrong number of arguments for CLIENT CACHING")
+	}
+	t := c.tracking
+	if t == nil || (!t.optin && !t.optout) {
+		return fmt.Errorf("CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled")
+	}
+	switch strings.ToUpper(args[0]) {
+	case "YES":
+		if !t.optin {
+			return fmt.Errorf("CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode.")
+		}
+		t.caching = 1
+	case "NO":
+		if !t.optout {
+			return fmt.Errorf("CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.")
+		}
+		t.caching = -1
+	default:
+		return errSyntax
+	}
+	return c.send(okResponse)
+}
+
+// trackingInfo returns the CLIENT TRACKINGINFO reply.
+func (c *ClientHandler) trackingInfo() string {
+	t := c.tracking
+	if t == nil {
+		return encodeMap(c.resp,
+			encodeBulkString("flags"), encodeBulkStringArray(1, "off"),
+			encodeBulkString("redirect"), encodeInteger(-1),
+			encodeBulkString("prefixes"), encodeArray(),
+		)
+	}
+	flags := []string{"on"}
+	for _, flag := range []struct {
+		set  bool
+		name string
+	}{
+		{t.bcast, "bcast"},
+		{t.optin, "optin"},
+		{t.optout, "optout"},
+		{t.caching == 1, "caching-yes"},
+		{t.caching == -1, "caching-no"},
+		{t.noloop, "noloop"},
+		{t.redirect != 0 && c.Server.client(t.redirect) == nil, "broken_redirect"},
+	} {
+		if flag.set {
+			flags = append(flags, flag.name)
+		}
+	}
+	return encodeMap(c.resp,
+		encodeBulkString("flags"), encodeBulkStringArray(len(flags), flags...),
+		encodeBulkString("redirect"), encodeInteger(int(t.redirect)),
+		encodeBulkString("prefixes"), encodeBulkStringArray(len(t.prefixes), t.prefixes...),
+	)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+// invalidation returns the RESP3 push message invalidating keys.
+func invalidation(keys ...string) string {
+	return encodePush(encodeBulkString("invalidate"), encodeBulkStringArray(len(keys), keys...))
+}
+
+// newResp3Client connects a client to s and switches it to RESP3, so that
+// it receives invalidation messages as push messages.
+func newResp3Client(t *testing.T, s *Server) *testClient {
+	c := newTestClient(s)
+	c.do("HELLO", "3")
+	t.Cleanup(c.close)
+	return c
+}
+
+func TestTracking(t *testing.T) {
+	// In each step client 0, which tracks keys, or client 1 sends a
+	// command, and then client 0 is expected to have received want,
+	// replies and invalidations together.
+	type step struct {
+		client int
+		args   []string
+		want   string
+	}
+	ok := "+OK\r\n"
+	tests := []struct {
+		name     string
+		tracking []string
+		steps    []step
+	}{
+		{"default mode", []string{"ON"}, []step{
+			{0, []string{"GET", "k"}, nullResponse},
+			{1, []string{"SET", "k", "1"}, invalidation("k")},
+			{1, []string{"SET", "k", "2"}, ""}, // forgotten once invalidated
+			{0, []string{"GET", "k"}, "$1\r\n2\r\n"},
+			{1, []string{"DEL", "k"}, invalidation("k")},
+			{1, []string{"SET", "other", "1"}, ""},
+		}},
+		{"own writes", []string{"ON"}, []step{
+			{0, []string{"GET", "k"}, nullResponse},
+			{0, []string{"SET", "k", "1"}, invalidation("k") + ok},
+		}},
+		{"NOLOOP", []string{"ON", "NOLOOP"}, []step{
+			{0, []string{"GET", "k"}, nullResponse},
+			{0, []string{"SET", "k", "1"}, ok},
+			{0, []string{"GET", "k"}, "$1\r\n1\r\n"},
+			{1, []string{"SET", "k", "2"}, invalidation("k")},
+		}},
+		{"writes aren't reads", []string{"ON"}, []step{
+			{0, []string{"SET", "k", "1"}, ok},
+			{1, []string{"SET", "k", "2"}, ""},
+		}},
+		{"BCAST with prefixes", []string{"ON", "BCAST", "PREFIX", "user:", "PREFIX", "job:"}, []step{
+			{1, []string{"SET", "user:1", "a"}, invalidation("user:1")},
+			{1, []string{"SET", "other", "a"}, ""},
+			{1, []string{"SET", "user:1", "b"}, invalidation("user:1")},
+			{1, []string{"SET", "job:9", "a"}, invalidation("job:9")},
+			{1, []string{"DEL", "user:1", "job:9", "other"}, invalidation("job:9", "user:1")},
+		}},
+		{"BCAST without prefixes", []string{"ON", "BCAST"}, []step{
+			{1, []string{"SET", "anything", "a"}, invalidation("anything")},
+			{0, []string{"GET", "anything"}, "$1\r\na\r\n"},
+		}},
+		{"BCAST NOLOOP", []string{"ON", "BCAST", "NOLOOP"}, []step{
+			{0, []string{"SET", "k", "1"}, ok},
+			{1, []string{"SET", "k", "2"}, invalidation("k")},
+		}},
+		{"OPTIN", []string{"ON", "OPTIN"}, []step{
+			{0, []string{"GET", "a"}, nullResponse},
+			{0, []string{"CLIENT", "CACHING", "YES"}, ok},
+			{0, []string{"GET", "b"}, nullResponse},
+			{0, []string{"GET", "c"}, nullResponse}, // CACHING YES only covers one command
+			{1, []string{"SET", "a", "1"}, ""},
+			{1, []string{"SET", "b", "1"}, invalidation("b")},
+			{1, []string{"SET", "c", "1"}, ""},
+		}},
+		{"OPTOUT", []string{"ON", "OPTOUT"}, []step{
+			{0, []string{"CLIENT", "CACHING", "NO"}, ok},
+			{0, []string{"GET", "a"}, nullResponse},
+			{0, []string{"GET", "b"}, nullResponse},
+			{1, []string{"SET", "a", "1"}, ""},
+			{1, []string{"SET", "b", "1"}, invalidation("b")},
+		}},
+		{"FLUSHALL", []string{"ON"}, []step{
+			{0, []string{"GET", "k"}, nullResponse},
+			{1, []string{"FLUSHALL"}, encodePush(encodeBulkString("invalidate"), "_\r\n")},
+		}},
+		{"OFF", []string{"OFF"}, []step{
+			{0, []string{"GET", "k"}, nullResponse},
+			{1, []string{"SET", "k", "1"}, ""},
+		}},
+	}
+	for _, tt := range tests {
+		s := newTestServer(nil)
+		clients := []*testClient{newResp3Client(t, s), newTestClient(s)}
+		args := append([]string{"CLIENT", "TRACKING"}, tt.tracking...)
+		if got := clients[0].do(args...); got != ok {
+			t.Errorf("%s: %v = %q", tt.name, args, got)
+			continue
+		}
+		for i, st := range tt.steps {
+			reply := clients[st.client].do(st.args...)
+			if st.client == 0 {
+				if reply != st.want {
+					t.Errorf("%s: step %d %v: client received %q, want %q", tt.name, i, st.args, reply, st.want)
+				}
+				continue
+			}
+			if got := clients[0].read(); got != st.want {
+				t.Errorf("%s: step %d %v: client received %q, want %q", tt.name, i, st.args, got, st.want)
+			}
+		}
+	}
+}
+
+func TestTrackingRedirect(t *testing.T) {
+	s := newTestServer(nil)
+	receiver, reader, writer := newTestClient(s), newTestClient(s), newTestClient(s)
+	t.Cleanup(receiver.close)
+	receiver.do("SUBSCRIBE", invalidateChannel)
+
+	id := strconv.FormatInt(receiver.id, 10)
+	if got := reader.do("CLIENT", "TRACKING", "ON", "REDIRECT", id); got != "+OK\r\n" {
+		t.Fatalf("CLIENT TRACKING ON REDIRECT = %q", got)
+	}
+	reader.do("GET", "k")
+	writer.do("SET", "k", "1")
+	want := encodeArray(encodeBulkString("message"), encodeBulkString(invalidateChannel), encodeBulkStringArray(1, "k"))
+	if got := receiver.read(); got != want {
+		t.Errorf("redirected invalidation = %q, want %q", got, want)
+	}
+	if got := reader.read(); got != "" {
+		t.Errorf("the redirecting client received %q", got)
+	}
+
+	// Once the receiver is gone, the redirect is reported as broken.
+	receiver.close()
+	if got := reader.do("CLIENT", "TRACKINGINFO"); got != encodeMap(2,
+		encodeBulkString("flags"), encodeBulkStringArray(2, "on", "broken_redirect"),
+		encodeBulkString("redirect"), encodeInteger(int(receiver.id)),
+		encodeBulkString("prefixes"), encodeBulkStringArray(0),
+	) {
+		t.Errorf("TRACKINGINFO = %q", got)
+	}
+}
+
+func TestTrackingErrors(t *testing.T) {
+	tests := []struct {
+		before []string // tracking options already in effect
+		args   []string
+		want   string
+	}{
+		{nil, []string{"MAYBE"}, "-ERR syntax error\r\n"},
+		{nil, []string{"ON", "PREFIX", "a"}, "-ERR PREFIX option requires BCAST mode to be enabled\r\n"},
+		{nil, []string{"ON", "BCAST", "OPTIN"}, "-ERR OPTIN and OPTOUT are not compatible with BCAST\r\n"},
+		{nil, []string{"ON", "OPTIN", "OPTOUT"}, "-ERR You can't use both OPTIN and OPTOUT\r\n"},
+		{nil, []string{"ON", "REDIRECT", "999"}, "-ERR The client ID you want redirect to does not exist\r\n"},
+		{nil, []string{"ON", "BCAST", "PREFIX", "ab", "PREFIX", "a"}, "-ERR Prefix 'a' overlaps with an existing prefix 'ab'. Prefixes for a single client must not overlap.\r\n"},
+		{[]string{"ON", "BCAST", "PREFIX", "a"}, []string{"ON", "BCAST", "PREFIX", "ab"}, "-ERR Prefix 'ab' overlaps with an existing prefix 'a'. Prefixes for a single client must not overlap.\r\n"},
+		{[]string{"ON", "BCAST", "PREFIX", "a"}, []string{"ON", "BCAST", "PREFIX", "a", "PREFIX", "b"}, "+OK\r\n"},
+		{[]string{"ON"}, []string{"ON", "BCAST"}, "-ERR You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode.\r\n"},
+		{[]string{"ON", "OPTIN"}, []string{"ON"}, "-ERR You can't switch OPTIN/OPTOUT mode before disabling tracking for this client, and then re-enabling it with a different mode.\r\n"},
+	}
+	for _, tt := range tests {
+		s := newTestServer(nil)
+		c := newTestClient(s)
+		if tt.before != nil {
+			c.do(append([]string{"CLIENT", "TRACKING"}, tt.before...)...)
+		}
+		if got := c.do(append([]string{"CLIENT", "TRACKING"}, tt.args...)...); got != tt.want {
+			t.Errorf("CLIENT TRACKING %v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+
+	c := newTestClient(newTestServer(nil))
+	c.do("CLIENT", "TRACKING", "ON", "OPTIN")
+	if got := c.do("CLIENT", "CACHING", "NO"); got != "-ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.\r\n" {
+		t.Errorf("CLIENT CACHING NO in OPTIN mode = %q", got)
+	}
+}
+
+func TestTrackingTable(t *testing.T) {
+	s := newTestServer(nil)
+	s.Config.Add(keyTrackingTableMaxKeys, "2")
+	a, b := newResp3Client(t, s), newResp3Client(t, s)
+	a.do("CLIENT", "TRACKING", "ON")
+	b.do("CLIENT", "TRACKING", "ON", "BCAST", "PREFIX", "x")
+
+	a.do("GET", "k1")
+	a.do("GET", "k2")
+	if got := a.do("GET", "k3"); got != nullResponse+invalidation("k1") && got != nullResponse+invalidation("k2") {
+		t.Errorf("reading past the table size = %q, want k1 or k2 evicted", got)
+	}
+	if n := len(s.tracking.keys); n != 2 {
+		t.Errorf("table holds %d keys, want 2", n)
+	}
+	s.Config.Update(keyTrackingTableMaxKeys, "1")
+	a.do("GET", "k3")
+	if n := len(s.tracking.keys); n != 1 {
+		t.Errorf("table holds %d keys after shrinking the limit, want 1", n)
+	}
+
+	// Disconnected clients are dropped from the prefix table, and keys
+	// they read are skipped when invalidated.
+	a.close()
+	b.close()
+	if len(s.tracking.prefixes) != 0 {
+		t.Errorf("prefixes left after disconnecting: %v", s.tracking.prefixes)
+	}
+	c := newTestClient(s)
+	c.do("SET", "k3", "1")
+	if len(s.tracking.keys) != 0 {
+		t.Errorf("keys left after invalidating: %v", s.tracking.keys)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// transaction is the MULTI/EXEC state of a client.
+type transaction struct {
+	active    bool // between MULTI and EXEC or DISCARD
+	queued    []Command
+	aborted   bool // a command failed to queue, so EXEC must fail
+	executing bool // EXEC is running the queued commands
+
+	// watched holds the WATCHed keys, and dirty is set once one of them is
+	// modified.
+	watched []string
+	dirty   bool
+}
+
+// watch registers tx to be told when key is modified.
+func (s *Store) watch(key string, tx *transaction) {
+	if s.watchers[key] == nil {
+		s.watchers[key] = make(map[*transaction]struct{})
+	}
+	if _, found := s.watchers[key][tx]; found {
+		return
+	}
+	s.watchers[key][tx] = struct{}{}
+	tx.watched = append(tx.watched, key)
+}
+
+// unwatch forgets every key watched by tx.
+func (s *Store) unwatch(tx *transaction) {
+	for _, key := range tx.watched {
+		delete(s.watchers[key], tx)
+		if len(s.watchers[key]) == 0 {
+			delete(s.watchers, key)
+		}
+	}
+	tx.watched, tx.dirty = nil, false
+}
+
+// touch marks the transactions watching key as dirty, after key was
+// modified, and tells the clients tracking it. Commands call it only for
+// keys they actually changed, so that no-op writes abort no transaction.
+func (s *Store) touch(key string) {
+	for tx := range s.watchers[key] {
+		tx.dirty = true
+	}
+	s.tracking.invalidate(key)
+}
+
+// queue handles a command sent between MULTI and EXEC. Commands that can't
+// be run, because they don't exist or have the wrong number of arguments,
+// make EXEC fail.
+func (c *ClientHandler) queue(cmd Command) error {
+	info, ok := lookupCommand(cmd.Command)
+	if !ok {
+		c.tx.aborted = true
+		return fmt.Errorf("unrecognized command %q", cmd.Command)
+	}
+	if !info.checkArity(len(cmd.Args) + 1) {
+		c.tx.aborted = true
+		return fmt.Errorf("wrong number of arguments for '%s' command", strings.ToLower(cmd.Command))
+	}
+	c.tx.queued = append(c.tx.queued, cmd)
+	return c.send(encodeSimpleString("QUEUED"))
+}
+
+// discard ends the transaction and forgets the watched keys.
+func (c *ClientHandler) discard() {
+	c.Store.unwatch(&c.tx)
+	c.tx = transaction{}
+}
+
+// handleMulti handles MULTI commands.
+func (c *ClientHandler) handleMulti(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("wrong number of arguments for MULTI")
+	}
+	if c.tx.active {
+		return fmt.Errorf("MULTI calls can not be nested")
+	}
+	fmt.Printf("MULTI command received.")
+	c.tx.active = true
+	return c.send(okResponse)
+}
+
+// handleExec handles EXEC commands. The queued commands run while the store
+// is locked, so no other client sees their effects partially applied. The
+// reply is an array of their replies, or a null array if a watched key was
+// modified.
+func (c *ClientHandler) handleExec(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("wrong number of arguments for EXEC")
+	}
+	if !c.tx.active {
+		return fmt.Errorf("EXEC without MULTI")
+	}
+	fmt.Printf("EXEC command received.")
+	if c.tx.aborted {
+		c.discard()
+		return ReplyError{"EXECABORT", "Transaction discarded because of previous errors."}
+	}
+	// Looking up the watched keys deletes those that expired since WATCH,
+	// which marks them as modified.
+	for _, key := range c.tx.watched {
+		c.Store.lookup(key)
+	}
+	if c.tx.dirty {
+		c.discard()
+		return c.send(nullArrayResponse)
+	}
+
+	queued := c.tx.queued
+	c.discard()
+	c.tx.executing = true
+	defer func() { c.tx.executing = false }()
+	if err := c.send(fmt.Sprintf(fmtArray, len(queued))); err != nil {
+		return err
+	}
+	for _, cmd := range queued {
+		if err := c.call(cmd); err != nil {
+			if err := c.send(encodeError(err)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// handleDiscard handles DISCARD commands.
+func (c *ClientHandler) handleDiscard(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("wrong number of arguments for DISCARD")
+	}
+	if !c.tx.active {
+		return fmt.Errorf("DISCARD without MULTI")
+	}
+	fmt.Printf("DISCARD command received.")
+	c.discard()
+	return c.send(okResponse)
+}
+
+// handleWatch handles WATCH commands.
+func (c *ClientHandler) handleWatch(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("insufficient number of arguments for WATCH")
+	}
+	if c.tx.active {
+		return fmt.Errorf("WATCH inside MULTI is not allowed")
+	}
+	fmt.Printf("WATCH %s command received.", strings.Join(args, " "))
+	for _, key := range args {
+		// Expire the key first, so that it doesn't count as modified when
+		// it is found to be expired later on.
+		c.Store.lookup(key)
+		c.Store.watch(key, &c.tx)
+	}
+	return c.send(okResponse)
+}
+
+// handleUnwatch handles UNWATCH commands.
+func (c *ClientHandler) handleUnwatch(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("wrong number of arguments for UNWATCH")
+	}
+	c.Store.unwatch(&c.tx)
+	return c.send(okResponse)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWatchTouch(t *testing.T) {
+	s := NewStore()
+	var a, b transaction
+	s.watch("k", &a)
+	s.watch("k", &a)
+	s.watch("other", &b)
+	if len(a.watched) != 1 {
+		t.Errorf("watching a key twice recorded it %d times", len(a.watched))
+	}
+
+	s.touch("unwatched")
+	if a.dirty || b.dirty {
+		t.Errorf("touching an unwatched key made a transaction dirty")
+	}
+	s.touch("k")
+	if !a.dirty || b.dirty {
+		t.Errorf("dirty = %v, %v after touching k, want true, false", a.dirty, b.dirty)
+	}
+
+	s.unwatch(&a)
+	if a.dirty || len(a.watched) != 0 || s.watchers["k"] != nil {
+		t.Errorf("unwatch left state behind: %+v, %v", a, s.watchers)
+	}
+	s.touch("k")
+	if a.dirty {
+		t.Errorf("touching a key made a transaction that unwatched it dirty")
+	}
+}
+
+func TestWatchExec(t *testing.T) {
+	// A step is a command sent by client 0 or 1, or, with client -1, the
+	// expiration of k.
+	type step struct {
+		client int
+		args   []string
+		want   string
+	}
+	watchThenExec := func(steps ...step) []step {
+		out := []step{
+			{0, []string{"SET", "k", "1"}, "+OK\r\n"},
+			{0, []string{"WATCH", "k"}, "+OK\r\n"},
+			{0, []string{"GET", "k"}, "$1\r\n1\r\n"},
+		}
+		return append(out, steps...)
+	}
+	exec := func(want string) []step {
+		return []step{
+			{0, []string{"MULTI"}, "+OK\r\n"},
+			{0, []string{"SET", "k", "2"}, "+QUEUED\r\n"},
+			{0, []string{"EXEC"}, want},
+		}
+	}
+	committed := "*1\r\n+OK\r\n"
+	aborted := "*-1\r\n"
+
+	tests := []struct {
+		name  string
+		steps []step
+		want  string // value of k once done
+	}{
+		{"read-modify-write", watchThenExec(exec(committed)...), "2"},
+		{"other client writes", watchThenExec(append([]step{{1, []string{"SET", "k", "3"}, "+OK\r\n"}}, exec(aborted)...)...), "3"},
+		{"other client reads", watchThenExec(append([]step{{1, []string{"GET", "k"}, "$1\r\n1\r\n"}}, exec(committed)...)...), "2"},
+		{"other client deletes", watchThenExec(append([]step{{1, []string{"DEL", "k"}, ":1\r\n"}}, exec(aborted)...)...), ""},
+		{"UNWATCH forgets the write", watchThenExec(append([]step{
+			{1, []string{"SET", "k", "3"}, "+OK\r\n"},
+			{0, []string{"UNWATCH"}, "+OK\r\n"},
+		}, exec(committed)...)...), "2"},
+		{"watched key expires", watchThenExec(append([]step{{-1, nil, ""}}, exec(aborted)...)...), ""},
+		{"own write before MULTI", watchThenExec(append([]step{{0, []string{"SET", "k", "3"}, "+OK\r\n"}}, exec(aborted)...)...), "3"},
+		{"dirty state ends with EXEC", watchThenExec(append(append([]step{{1, []string{"SET", "k", "3"}, "+OK\r\n"}}, exec(aborted)...), exec(committed)...)...), "2"},
+	}
+	for _, tt := range tests {
+		s := newTestServer(nil)
+		clients := []*testClient{newTestClient(s), newTestClient(s)}
+		for i, st := range tt.steps {
+			if st.client < 0 {
+				s.Store.expiry["k"] = time.Now().UTC().Add(-time.Millisecond)
+				continue
+			}
+			if got := clients[st.client].do(st.args...); got != st.want {
+				t.Errorf("%s: step %d %v = %q, want %q", tt.name, i, st.args, got, st.want)
+			}
+		}
+		got, _ := s.Store.Get("k")
+		if _, found := s.Store.lookup("k"); !found {
+			got = ""
+		}
+		if got != tt.want {
+			t.Errorf("%s: k = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSetOverwrites(t *testing.T) {
+	s := newTestServer(nil)
+	c := newTestClient(s)
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"SET", "k", "1", "px", "100000"}, "+OK\r\n"},
+		{[]string{"SET", "k", "2"}, "+OK\r\n"},
+		{[]string{"GET", "k"}, "$1\r\n2\r\n"},
+		{[]string{"HSET", "h", "f", "v"}, ":1\r\n"},
+		{[]string{"SET", "h", "str"}, "+OK\r\n"},
+		{[]string{"GET", "h"}, "$3\r\nstr\r\n"},
+	}
+	for _, tt := range tests {
+		if got := c.do(tt.args...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+	if _, found := s.Store.expiry["k"]; found {
+		t.Errorf("SET kept the expiration time of k")
+	}
+}
@@ -0,0 +1,967 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ZSet is a sorted set: unique members ordered by a floating point score.
+// Like Redis, it pairs a dict for O(1) score lookups with a skiplist for
+// ordered and ranked access.
+type ZSet struct {
+	dict  map[string]float64
+	zsl   *skiplist
+	table keyTable // members, for ZSCAN
+}
+
+// zsetEntry is a member of a sorted set along with its score.
+type zsetEntry struct {
+	member string
+	score  float64
+}
+
+func NewZSet() *ZSet {
+	return &ZSet{dict: make(map[string]float64), zsl: newSkiplist()}
+}
+
+// Len returns the number of members in the sorted set.
+func (z *ZSet) Len() int {
+	return len(z.dict)
+}
+
+// Score returns the score of member, if it is in the sorted set.
+func (z *ZSet) Score(member string) (float64, bool) {
+	score, found := z.dict[member]
+	return score, found
+}
+
+// Set adds member with the given score, or updates the score of an
+// existing member. It returns true if the member is new.
+func (z *ZSet) Set(member string, score float64) bool {
+	current, found := z.dict[member]
+	if found {
+		if current == score {
+			return false
+		}
+		z.zsl.delete(current, member)
+	}
+	z.zsl.insert(score, member)
+	z.dict[member] = score
+	if !found {
+		z.table.add(member)
+	}
+	return !found
+}
+
+// Remove removes member, returning true if it was in the sorted set.
+func (z *ZSet) Remove(member string) bool {
+	score, found := z.dict[member]
+	if !found {
+		return false
+	}
+	z.zsl.delete(score, member)
+	delete(z.dict, member)
+	z.table.remove(member)
+	return true
+}
+
+// Rank returns the 0-based rank of member, counting from the highest score
+// when reverse is set.
+func (z *ZSet) Rank(member string, reverse bool) (int, bool) {
+	score, found := z.dict[member]
+	if !found {
+		return 0, false
+	}
+	rank := z.zsl.rank(score, member)
+	if reverse {
+		return z.Len() - rank, true
+	}
+	return rank - 1, true
+}
+
+// RangeByRank returns the members between the 0-based ranks start and stop,
+// inclusive. Both must be within the bounds of the sorted set.
+func (z *ZSet) RangeByRank(start, stop int, reverse bool) []zsetEntry {
+	entries := make([]zsetEntry, 0, stop-start+1)
+	var node *skiplistNode
+	if reverse {
+		node = z.zsl.byRank(z.Len() - start)
+	} else {
+		node = z.zsl.byRank(start + 1)
+	}
+	for i := start; i <= stop && node != nil; i++ {
+		entries = append(entries, zsetEntry{node.member, node.score})
+		if reverse {
+			node = node.backward
+		} else {
+			node = node.level[0].forward
+		}
+	}
+	return entries
+}
+
+// RangeBySpec returns the members within a score or lexicographical range,
+// skipping the first offset matches and returning at most count members.
+// A negative count returns every match.
+func (z *ZSet) RangeBySpec(r rangeSpec, reverse bool, offset, count int) []zsetEntry {
+	var node *skiplistNode
+	if reverse {
+		node = z.zsl.lastInRange(r)
+	} else {
+		node = z.zsl.firstInRange(r)
+	}
+
+	entries := []zsetEntry{}
+	for node != nil && count != 0 {
+		if reverse && !r.aboveMin(node) || !reverse && !r.belowMax(node) {
+			break
+		}
+		if offset > 0 {
+			offset--
+		} else {
+			entries = append(entries, zsetEntry{node.member, node.score})
+			count--
+		}
+		if reverse {
+			node = node.backward
+		} else {
+			node = node.level[0].forward
+		}
+	}
+	return entries
+}
+
+// Count returns the number of members within a range.
+func (z *ZSet) Count(r rangeSpec) int {
+	first := z.zsl.firstInRange(r)
+	if first == nil {
+		return 0
+	}
+	last := z.zsl.lastInRange(r)
+	return z.zsl.rank(last.score, last.member) - z.zsl.rank(first.score, first.member) + 1
+}
+
+// Pop removes and returns up to count members with the lowest scores, or
+// the highest scores when max is set.
+func (z *ZSet) Pop(count int, max bool) []zsetEntry {
+	count = min(count, z.Len())
+	if count == 0 {
+		return []zsetEntry{}
+	}
+	entries := z.RangeByRank(0, count-1, max)
+	for _, entry := range entries {
+		z.Remove(entry.member)
+	}
+	return entries
+}
+
+// Entries returns every member in ascending order.
+func (z *ZSet) Entries() []zsetEntry {
+	if z.Len() == 0 {
+		return []zsetEntry{}
+	}
+	return z.RangeByRank(0, z.Len()-1, false)
+}
+
+// zset returns the sorted set stored at key. If there is no such key, a new
+// sorted set is created when create is true and nil is returned otherwise.
+func (s *Store) zset(key string, create bool) (*ZSet, error) {
+	val, found := s.lookup(key)
+	if !found {
+		if !create {
+			return nil, nil
+		}
+		z := NewZSet()
+		s.create(key, z)
+		return z, nil
+	}
+	z, ok := val.(*ZSet)
+	if !ok {
+		return nil, errWrongType
+	}
+	return z, nil
+}
+
+// zsetChanged deletes key once the sorted set stored there is empty.
+func (s *Store) zsetChanged(key string, z *ZSet) {
+	if z.Len() == 0 {
+		s.remove(key)
+		s.notify(notifyGeneric, "del", key)
+	}
+}
+
+// parseFloat parses a score or other floating point argument. NaN is never
+// a valid value.
+func parseFloat(arg string) (float64, error) {
+	num, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(num) {
+		return 0, fmt.Errorf("value is not a valid float")
+	}
+	return num, nil
+}
+
+// parseScoreRange parses the min and max arguments of a score range, where
+// a leading "(" makes a bound exclusive.
+func parseScoreRange(minArg, maxArg string) (scoreRange, error) {
+	var r scoreRange
+	var err error
+	errRange := fmt.Errorf("min or max is not a float")
+	if r.min, r.minex, err = parseScoreBound(minArg); err != nil {
+		return r, errRange
+	}
+	if r.max, r.maxex, err = parseScoreBound(maxArg); err != nil {
+		return r, errRange
+	}
+	return r, nil
+}
+
+func parseScoreBound(arg string) (float64, bool, error) {
+	exclusive := strings.HasPrefix(arg, "(")
+	if exclusive {
+		arg = arg[1:]
+	}
+	num, err := parseFloat(arg)
+	return num, exclusive, err
+}
+
+// parseLexRange parses the min and max arguments of a lexicographical
+// range. Bounds are "-", "+", or a value prefixed with "[" (inclusive) or
+// "(" (exclusive).
+func parseLexRange(minArg, maxArg string) (lexRange, error) {
+	var r lexRange
+	var ok bool
+	errRange := fmt.Errorf("min or max not valid string range item")
+	if r.min, ok = parseLexBound(minArg); !ok {
+		return r, errRange
+	}
+	if r.max, ok = parseLexBound(maxArg); !ok {
+		return r, errRange
+	}
+	return r, nil
+}
+
+func parseLexBound(arg string) (lexBound, bool) {
+	switch {
+	case arg == "-":
+		return lexBound{inf: -1}, true
+	case arg == "+":
+		return lexBound{inf: 1}, true
+	case strings.HasPrefix(arg, "["):
+		return lexBound{value: arg[1:]}, true
+	case strings.HasPrefix(arg, "("):
+		return lexBound{value: arg[1:], exclusive: true}, true
+	}
+	return lexBound{}, false
+}
+
+// encodeZSetEntries encodes entries as an array of members, each followed
+// by its score when withScores is set.
+func encodeZSetEntries(entries []zsetEntry, withScores bool) string {
+	result := make([]string, 0, 2*len(entries))
+	for _, entry := range entries {
+		result = append(result, entry.member)
+		if withScores {
+			result = append(result, formatFloat(entry.score))
+		}
+	}
+	return encodeBulkStringArray(len(result), result...)
+}
+
+// handleZAdd handles ZADD and ZINCRBY commands.
+func (c *ClientHandler) handleZAdd(args []string, incrBy bool) error {
+	if len(args) < 3 {
+		return fmt.Errorf("insufficient number of arguments for ZADD")
+	}
+	key := args[0]
+	args = args[1:]
+
+	var nx, xx, gt, lt, ch, incr bool
+	incr = incrBy
+flags:
+	for !incrBy && len(args) > 0 {
+		switch strings.ToUpper(args[0]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		case "CH":
+			ch = true
+		case "INCR":
+			incr = true
+		default:
+			break flags
+		}
+		args = args[1:]
+	}
+	if len(args) == 0 || len(args)%2 != 0 {
+		return errSyntax
+	}
+	if nx && xx {
+		return fmt.Errorf("XX and NX options at the same time are not compatible")
+	}
+	if (gt && lt) || (nx && (gt || lt)) {
+		return fmt.Errorf("GT, LT, and/or NX options at the same time are not compatible")
+	}
+	if incr && len(args) > 2 {
+		return fmt.Errorf("INCR option supports a single increment-element pair")
+	}
+
+	scores := make([]float64, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		score, err := parseFloat(args[i])
+		if err != nil {
+			return err
+		}
+		scores = append(scores, score)
+	}
+	fmt.Printf("ZADD %s command received.", key)
+
+	z, err := c.Store.zset(key, !xx)
+	if err != nil {
+		return err
+	}
+	if z == nil {
+		if incr {
+			return c.send(nullResponse)
+		}
+		return c.send(encodeInteger(0))
+	}
+
+	added, changed := 0, 0
+	var result float64
+	aborted := false
+	for i := 0; i < len(args); i += 2 {
+		member, score := args[i+1], scores[i/2]
+		current, found := z.Score(member)
+		if (nx && found) || (xx && !found) {
+			aborted = true
+			continue
+		}
+		if incr && found {
+			score += current
+			if math.IsNaN(score) {
+				c.Store.zsetChanged(key, z)
+				return fmt.Errorf("resulting score is not a number (NaN)")
+			}
+		}
+		if found && ((gt && score <= current) || (lt && score >= current)) {
+			aborted = true
+			continue
+		}
+		result = score
+		if !found {
+			added++
+		} else if score != current {
+			changed++
+		}
+		z.Set(member, score)
+	}
+	if added+changed > 0 {
+		if incr {
+			c.Store.notify(notifyZSet, "zincr", key)
+		} else {
+			c.Store.notify(notifyZSet, "zadd", key)
+		}
+		c.Store.touch(key)
+	}
+	c.Store.zsetChanged(key, z)
+
+	if incr {
+		if aborted {
+			return c.send(nullResponse)
+		}
+		return c.send(encodeBulkString(formatFloat(result)))
+	}
+	if ch {
+		return c.send(encodeInteger(added + changed))
+	}
+	return c.send(encodeInteger(added))
+}
+
+// handleZRem handles ZREM commands.
+func (c *ClientHandler) handleZRem(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("insufficient number of arguments for ZREM")
+	}
+	key := args[0]
+	z, err := c.Store.zset(key, false)
+	if err != nil {
+		return err
+	}
+	if z == nil {
+		return c.send(encodeInteger(0))
+	}
+	removed := 0
+	for _, member := range args[1:] {
+		if z.Remove(member) {
+			removed++
+		}
+	}
+	if removed > 0 {
+		c.Store.notify(notifyZSet, "zrem", key)
+		c.Store.zsetChanged(key, z)
+		c.Store.touch(key)
+	}
+	return c.send(encodeInteger(removed))
+}
+
+// handleZScore handles ZSCORE and ZMSCORE commands.
+func (c *ClientHandler) handleZScore(args []string, multi bool) error {
+	if len(args) < 2 || (!multi && len(args) != 2) {
+		return fmt.Errorf("wrong number of arguments for ZSCORE")
+	}
+	z, err := c.Store.zset(args[0], false)
+	if err != nil {
+		return err
+	}
+	result := make([]string, 0, len(args)-1)
+	for _, member := range args[1:] {
+		if z == nil {
+			result = append(result, nullResponse)
+			continue
+		}
+		score, found := z.Score(member)
+		if !found {
+			result = append(result, nullResponse)
+			continue
+		}
+		result = append(result, encodeBulkString(formatFloat(score)))
+	}
+	if !multi {
+		return c.send(result[0])
+	}
+	return c.send(encodeArray(result...))
+}
+
+// handleZCard handles ZCARD commands.
+func (c *ClientHandler) handleZCard(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("wrong number of arguments for ZCARD")
+	}
+	z, err := c.Store.zset(args[0], false)
+	if err != nil {
+		return err
+	}
+	if z == nil {
+		return c.send(encodeInteger(0))
+	}
+	return c.send(encodeInteger(z.Len()))
+}
+
+// handleZCount handles ZCOUNT and ZLEXCOUNT commands.
+func (c *ClientHandler) handleZCount(args []string, lex bool) error {
+	if len(args) != 3 {
+		return fmt.Errorf("wrong number of arguments for ZCOUNT")
+	}
+	var r rangeSpec
+	var err error
+	if lex {
+		r, err = parseLexRange(args[1], args[2])
+	} else {
+		r, err = parseScoreRange(args[1], args[2])
+	}
+	if err != nil {
+		return err
+	}
+	z, err := c.Store.zset(args[0], false)
+	if err != nil {
+		return err
+	}
+	if z == nil {
+		return c.send(encodeInteger(0))
+	}
+	return c.send(encodeInteger(z.Count(r)))
+}
+
+// handleZRank handles ZRANK and ZREVRANK commands.
+func (c *ClientHandler) handleZRank(args []string, reverse bool) error {
+	if len(args) < 2 || len(args) > 3 {
+		return fmt.Errorf("wrong number of arguments for ZRANK")
+	}
+	withScore := len(args) == 3
+	if withScore && strings.ToUpper(args[2]) != "WITHSCORE" {
+		return errSyntax
+	}
+	z, err := c.Store.zset(args[0], false)
+	if err != nil {
+		return err
+	}
+	if z == nil {
+		if withScore {
+			return c.send(nullArrayResponse)
+		}
+		return c.send(nullResponse)
+	}
+	rank, found := z.Rank(args[1], reverse)
+	if !found {
+		if withScore {
+			return c.send(nullArrayResponse)
+		}
+		return c.send(nullResponse)
+	}
+	if withScore {
+		score, _ := z.Score(args[1])
+		return c.send(encodeArray(encodeInteger(rank), encodeBulkString(formatFloat(score))))
+	}
+	return c.send(encodeInteger(rank))
+}
+
+// Range types of the unified ZRANGE command.
+const (
+	zrangeByRank = iota
+	zrangeByScore
+	zrangeByLex
+)
+
+// zrangeQuery holds the parsed arguments of ZRANGE and ZRANGESTORE.
+type zrangeQuery struct {
+	min, max   string
+	by         int
+	reverse    bool
+	offset     int
+	count      int
+	withScores bool
+}
+
+// parseZRangeQuery parses the arguments following the key of ZRANGE.
+func parseZRangeQuery(args []string, allowWithScores bool) (zrangeQuery, error) {
+	q := zrangeQuery{min: args[0], max: args[1], count: -1}
+	hasLimit := false
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "BYSCORE":
+			q.by = zrangeByScore
+		case "BYLEX":
+			q.by = zrangeByLex
+		case "REV":
+			q.reverse = true
+		case "WITHSCORES":
+			if !allowWithScores {
+				return q, errSyntax
+			}
+			q.withScores = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return q, errSyntax
+			}
+			offset, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return q, errNotInteger
+			}
+			count, err := strconv.Atoi(args[i+2])
+			if err != nil {
+				return q, errNotInteger
+			}
+			q.offset, q.count, hasLimit = offset, count, true
+			i += 2
+		default:
+			return q, errSyntax
+		}
+	}
+	if hasLimit && q.by == zrangeByRank {
+		return q, fmt.Errorf("syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	}
+	if q.withScores && q.by == zrangeByLex {
+		return q, fmt.Errorf("syntax error, WITHSCORES not supported in combination with BYLEX")
+	}
+	// With REV, score and lex ranges are given from max to min.
+	if q.reverse && q.by != zrangeByRank {
+		q.min, q.max = q.max, q.min
+	}
+	return q, nil
+}
+
+// run returns the entries of z selected by the query.
+func (q zrangeQuery) run(z *ZSet) ([]zsetEntry, error) {
+	switch q.by {
+	case zrangeByScore:
+		r, err := parseScoreRange(q.min, q.max)
+		if err != nil {
+			return nil, err
+		}
+		if z == nil || q.offset < 0 {
+			return []zsetEntry{}, nil
+		}
+		return z.RangeBySpec(r, q.reverse, q.offset, q.count), nil
+	case zrangeByLex:
+		r, err := parseLexRange(q.min, q.max)
+		if err != nil {
+			return nil, err
+		}
+		if z == nil || q.offset < 0 {
+			return []zsetEntry{}, nil
+		}
+		return z.RangeBySpec(r, q.reverse, q.offset, q.count), nil
+	}
+
+	start, err := strconv.Atoi(q.min)
+	if err != nil {
+		return nil, errNotInteger
+	}
+	stop, err := strconv.Atoi(q.max)
+	if err != nil {
+		return nil, errNotInteger
+	}
+	if z == nil {
+		return []zsetEntry{}, nil
+	}
+	length := z.Len()
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	start = max(start, 0)
+	stop = min(stop, length-1)
+	if start > stop || start >= length {
+		return []zsetEntry{}, nil
+	}
+	return z.RangeByRank(start, stop, q.reverse), nil
+}
+
+// handleZRange handles ZRANGE commands.
+func (c *ClientHandler) handleZRange(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("insufficient number of arguments for ZRANGE")
+	}
+	q, err := parseZRangeQuery(args[1:], true)
+	if err != nil {
+		return err
+	}
+	z, err := c.Store.zset(args[0], false)
+	if err != nil {
+		return err
+	}
+	entries, err := q.run(z)
+	if err != nil {
+		return err
+	}
+	return c.send(encodeZSetEntries(entries, q.withScores))
+}
+
+// handleZRangeStore handles ZRANGESTORE commands.
+func (c *ClientHandler) handleZRangeStore(args []string) error {
+	if len(args) < 4 {
+		return fmt.Errorf("insufficient number of arguments for ZRANGESTORE")
+	}
+	dst := args[0]
+	q, err := parseZRangeQuery(args[2:], false)
+	if err != nil {
+		return err
+	}
+	z, err := c.Store.zset(args[1], false)
+	if err != nil {
+		return err
+	}
+	entries, err := q.run(z)
+	if err != nil {
+		return err
+	}
+
+	result := NewZSet()
+	for _, entry := range entries {
+		result.Set(entry.member, entry.score)
+	}
+	c.Store.storeResult(dst, result, result.Len() > 0, notifyZSet, "zrangestore")
+	return c.send(encodeInteger(len(entries)))
+}
+
+// handleZPop handles ZPOPMIN and ZPOPMAX commands.
+func (c *ClientHandler) handleZPop(args []string, max bool) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("wrong number of arguments for ZPOP")
+	}
+	key := args[0]
+	count := 1
+	if len(args) == 2 {
+		var err error
+		if count, err = strconv.Atoi(args[1]); err != nil || count < 0 {
+			return fmt.Errorf("value is out of range, must be positive")
+		}
+	}
+	z, err := c.Store.zset(key, false)
+	if err != nil {
+		return err
+	}
+	if z == nil {
+		return c.send(encodeBulkStringArray(0))
+	}
+	entries := z.Pop(count, max)
+	if len(entries) > 0 {
+		c.Store.notify(notifyZSet, zpopEvent(max), key)
+		c.Store.zsetChanged(key, z)
+		c.Store.touch(key)
+	}
+	return c.send(encodeZSetEntries(entries, true))
+}
+
+// zpopEvent returns the keyspace event of ZPOPMIN or, with max set, ZPOPMAX.
+func zpopEvent(max bool) string {
+	if max {
+		return "zpopmax"
+	}
+	return "zpopmin"
+}
+
+// handleBZPop handles BZPOPMIN and BZPOPMAX commands. The client blocks
+// until one of the keys holds a non-empty sorted set or the timeout, in
+// seconds, expires. A timeout of 0 blocks indefinitely.
+func (c *ClientHandler) handleBZPop(args []string, max bool) error {
+	if len(args) < 2 {
+		return fmt.Errorf("insufficient number of arguments for BZPOP")
+	}
+	keys := args[:len(args)-1]
+	deadline, err := parseBlockTimeout(args[len(args)-1], time.Second)
+	if err != nil {
+		return err
+	}
+
+	for {
+		for _, key := range keys {
+			z, err := c.Store.zset(key, false)
+			if err != nil {
+				return err
+			}
+			if z == nil {
+				continue
+			}
+			entry := z.Pop(1, max)[0]
+			c.replicateEffects(Command{strings.ToUpper(zpopEvent(max)), []string{key}})
+			c.Store.notify(notifyZSet, zpopEvent(max), key)
+			c.Store.zsetChanged(key, z)
+			c.Store.touch(key)
+			return c.send(encodeBulkStringArray(3, key, entry.member, formatFloat(entry.score)))
+		}
+		if !c.wait(deadline) {
+			c.replicateEffects()
+			if c.Context.Err() != nil {
+				return nil
+			}
+			return c.send(nullArrayResponse)
+		}
+	}
+}
+
+// parseBlockTimeout parses the timeout of a blocking command, in the given
+// unit, and returns the deadline. A zero deadline means no timeout.
+func parseBlockTimeout(arg string, unit time.Duration) (time.Time, error) {
+	timeout, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(timeout) || math.IsInf(timeout, 0) {
+		return time.Time{}, fmt.Errorf("timeout is not a float or out of range")
+	}
+	if timeout < 0 {
+		return time.Time{}, fmt.Errorf("timeout is negative")
+	}
+	if timeout == 0 {
+		return time.Time{}, nil
+	}
+	return time.Now().Add(time.Duration(timeout * float64(unit))), nil
+}
+
+// zsetStoreEvents holds the keyspace events of ZUNIONSTORE, ZINTERSTORE
+// and ZDIFFSTORE.
+var zsetStoreEvents = [...]string{
+	setOpInter: "zinterstore",
+	setOpUnion: "zunionstore",
+	setOpDiff:  "zdiffstore",
+}
+
+// zsetInputs returns the members and scores of the sorted sets or sets
+// stored at keys, with nil for missing keys. Set members get a score of 1.
+func (s *Store) zsetInputs(keys []string) ([]map[string]float64, error) {
+	inputs := make([]map[string]float64, 0, len(keys))
+	for _, key := range keys {
+		val, found := s.lookup(key)
+		if !found {
+			inputs = append(inputs, nil)
+			continue
+		}
+		switch v := val.(type) {
+		case *ZSet:
+			inputs = append(inputs, v.dict)
+		case *Set:
+			members := make(map[string]float64, v.Len())
+			for _, member := range v.Members() {
+				members[member] = 1
+			}
+			inputs = append(inputs, members)
+		default:
+			return nil, errWrongType
+		}
+	}
+	return inputs, nil
+}
+
+// aggregate combines two scores of the same member according to an
+// AGGREGATE option. Infinities of opposite sign sum to 0 rather than NaN.
+func aggregate(mode string, a, b float64) float64 {
+	switch mode {
+	case "MIN":
+		return math.Min(a, b)
+	case "MAX":
+		return math.Max(a, b)
+	}
+	if sum := a + b; !math.IsNaN(sum) {
+		return sum
+	}
+	return 0
+}
+
+// handleZSetAlgebra handles ZUNION, ZINTER and ZDIFF commands and, with
+// store set, their STORE variants taking the destination key first.
+func (c *ClientHandler) handleZSetAlgebra(args []string, op int, store bool) error {
+	var dst string
+	if store {
+		if len(args) < 1 {
+			return fmt.Errorf("insufficient number of arguments for set operation")
+		}
+		dst, args = args[0], args[1:]
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("insufficient number of arguments for set operation")
+	}
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil || numKeys <= 0 {
+		return fmt.Errorf("at least 1 input key is needed for this command")
+	}
+	if len(args)-1 < numKeys {
+		return errSyntax
+	}
+	keys, opts := args[1:numKeys+1], args[numKeys+1:]
+
+	weights := make([]float64, numKeys)
+	for i := range weights {
+		weights[i] = 1
+	}
+	mode := "SUM"
+	withScores := false
+	for i := 0; i < len(opts); i++ {
+		switch strings.ToUpper(opts[i]) {
+		case "WEIGHTS":
+			if op == setOpDiff || i+numKeys >= len(opts) {
+				return errSyntax
+			}
+			for j := range weights {
+				weight, err := parseFloat(opts[i+1+j])
+				if err != nil {
+					return fmt.Errorf("weight value is not a float")
+				}
+				weights[j] = weight
+			}
+			i += numKeys
+		case "AGGREGATE":
+			if op == setOpDiff || i+1 >= len(opts) {
+				return errSyntax
+			}
+			mode = strings.ToUpper(opts[i+1])
+			if mode != "SUM" && mode != "MIN" && mode != "MAX" {
+				return errSyntax
+			}
+			i++
+		case "WITHSCORES":
+			if store {
+				return errSyntax
+			}
+			withScores = true
+		default:
+			return errSyntax
+		}
+	}
+
+	inputs, err := c.Store.zsetInputs(keys)
+	if err != nil {
+		return err
+	}
+	weighted := func(score float64, i int) float64 {
+		if w := score * weights[i]; !math.IsNaN(w) {
+			return w
+		}
+		return 0
+	}
+
+	scores := make(map[string]float64)
+	switch op {
+	case setOpUnion:
+		for i, input := range inputs {
+			for member, score := range input {
+				if current, found := scores[member]; found {
+					scores[member] = aggregate(mode, current, weighted(score, i))
+				} else {
+					scores[member] = weighted(score, i)
+				}
+			}
+		}
+	case setOpInter:
+	members:
+		for member, score := range inputs[0] {
+			result := weighted(score, 0)
+			for i, input := range inputs[1:] {
+				other, found := input[member]
+				if !found {
+					continue members
+				}
+				result = aggregate(mode, result, weighted(other, i+1))
+			}
+			scores[member] = result
+		}
+	case setOpDiff:
+	diff:
+		for member, score := range inputs[0] {
+			for _, input := range inputs[1:] {
+				if _, found := input[member]; found {
+					continue diff
+				}
+			}
+			scores[member] = score
+		}
+	}
+
+	result := NewZSet()
+	for member, score := range scores {
+		result.Set(member, score)
+	}
+	if !store {
+		return c.send(encodeZSetEntries(result.Entries(), withScores))
+	}
+	c.Store.storeResult(dst, result, result.Len() > 0, notifyZSet, zsetStoreEvents[op])
+	return c.send(encodeInteger(result.Len()))
+}
+
+// handleZScan handles ZSCAN commands.
+func (c *ClientHandler) handleZScan(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("insufficient number of arguments for ZSCAN")
+	}
+	cursor, err := parseCursor(args[1])
+	if err != nil {
+		return err
+	}
+	opts, err := parseScanOptions(args[2:], false)
+	if err != nil {
+		return err
+	}
+	z, err := c.Store.zset(args[0], false)
+	if err != nil {
+		return err
+	}
+	if z == nil {
+		return c.send(encodeScanReply(0, nil))
+	}
+
+	page, next := z.table.scan(cursor, opts.count)
+	result := []string{}
+	for _, member := range page {
+		if opts.matches(member) {
+			result = append(result, member, formatFloat(z.dict[member]))
+		}
+	}
+	return c.send(encodeScanReply(next, result))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestZSetRanges(t *testing.T) {
+	z := NewZSet()
+	for i, m := range []string{"a", "b", "c", "d", "e"} {
+		z.Set(m, float64(i+1))
+	}
+	members := func(entries []zsetEntry) []string {
+		out := []string{}
+		for _, e := range entries {
+			out = append(out, e.member)
+		}
+		return out
+	}
+
+	tests := []struct {
+		name string
+		got  []zsetEntry
+		want []string
+	}{
+		{"by rank", z.RangeByRank(1, 3, false), []string{"b", "c", "d"}},
+		{"by rank reversed", z.RangeByRank(0, 1, true), []string{"e", "d"}},
+		{"by score", z.RangeBySpec(scoreRange{min: 2, max: 4, maxex: true}, false, 0, -1), []string{"b", "c"}},
+		{"by score reversed", z.RangeBySpec(scoreRange{min: 2, max: 5}, true, 0, -1), []string{"e", "d", "c", "b"}},
+		{"with offset and count", z.RangeBySpec(scoreRange{min: 1, max: 5}, false, 1, 2), []string{"b", "c"}},
+		{"offset past the end", z.RangeBySpec(scoreRange{min: 1, max: 5}, false, 10, -1), []string{}},
+	}
+	for _, tt := range tests {
+		if got := members(tt.got); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if n := z.Count(scoreRange{min: 2, max: 4}); n != 3 {
+		t.Errorf("Count = %d, want 3", n)
+	}
+	if rank, _ := z.Rank("b", true); rank != 3 {
+		t.Errorf("reverse Rank(b) = %d, want 3", rank)
+	}
+	if z.Set("b", 10) || z.Len() != 5 {
+		t.Errorf("updating a score added a member")
+	}
+	if rank, _ := z.Rank("b", false); rank != 4 {
+		t.Errorf("Rank(b) = %d after the update, want 4", rank)
+	}
+	if got := members(z.Pop(2, true)); !slices.Equal(got, []string{"b", "e"}) {
+		t.Errorf("Pop(2, max) = %v", got)
+	}
+}
+
+func TestParseRanges(t *testing.T) {
+	scoreTests := []struct {
+		min, max string
+		want     scoreRange
+		wantErr  bool
+	}{
+		{"1", "2", scoreRange{min: 1, max: 2}, false},
+		{"(1", "(2.5", scoreRange{min: 1, max: 2.5, minex: true, maxex: true}, false},
+		{"-inf", "+inf", scoreRange{min: math.Inf(-1), max: math.Inf(1)}, false},
+		{"a", "1", scoreRange{}, true},
+		{"1", "nan", scoreRange{}, true},
+	}
+	for _, tt := range scoreTests {
+		got, err := parseScoreRange(tt.min, tt.max)
+		if (err != nil) != tt.wantErr || !tt.wantErr && got != tt.want {
+			t.Errorf("parseScoreRange(%q, %q) = %v, %v", tt.min, tt.max, got, err)
+		}
+	}
+
+	lexTests := []struct {
+		min, max string
+		want     lexRange
+		wantErr  bool
+	}{
+		{"-", "+", lexRange{lexBound{inf: -1}, lexBound{inf: 1}}, false},
+		{"[a", "(b", lexRange{lexBound{value: "a"}, lexBound{value: "b", exclusive: true}}, false},
+		{"[", "+", lexRange{lexBound{}, lexBound{inf: 1}}, false},
+		{"a", "+", lexRange{}, true},
+		{"-", "", lexRange{}, true},
+	}
+	for _, tt := range lexTests {
+		got, err := parseLexRange(tt.min, tt.max)
+		if (err != nil) != tt.wantErr || !tt.wantErr && got != tt.want {
+			t.Errorf("parseLexRange(%q, %q) = %v, %v", tt.min, tt.max, got, err)
+		}
+	}
+}